@@ -15,12 +15,15 @@
 package main
 
 import (
+	"os"
+
 	log "github.com/sirupsen/logrus"
 
 	docopt "github.com/docopt/docopt-go"
 
 	"github.com/projectcalico/felix/buildinfo"
 	"github.com/projectcalico/felix/daemon"
+	"github.com/projectcalico/felix/ifacemonitor"
 )
 
 const usage = `Felix, the Calico per-host daemon.
@@ -36,6 +39,22 @@ Options:
 // main is the entry point to the calico-felix binary.
 //
 func main() {
+	if len(os.Args) == 2 && os.Args[1] == ifacemonitor.HelperCommand {
+		// We've been started as the interface monitor helper; see ifacemonitor.ExecHelper.
+		if err := ifacemonitor.HelperMain(); err != nil {
+			log.WithError(err).Fatal("Interface monitor helper failed.")
+		}
+		return
+	}
+	if len(os.Args) == 3 && os.Args[1] == ifacemonitor.HelperCommand {
+		// We've been started separately as the interface monitor helper, with its own
+		// privileges, to serve Felix on the given socket; see InterfaceMonitorHelperSocket.
+		if err := ifacemonitor.HelperListenMain(os.Args[2]); err != nil {
+			log.WithError(err).Fatal("Interface monitor helper failed.")
+		}
+		return
+	}
+
 	// Parse command-line args.
 	version := "Version:            " + buildinfo.GitVersion + "\n" +
 		"Full git commit ID: " + buildinfo.GitRevision + "\n" +
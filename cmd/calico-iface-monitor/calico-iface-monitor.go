@@ -0,0 +1,227 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	docopt "github.com/docopt/docopt-go"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+
+	"github.com/projectcalico/felix/buildinfo"
+	"github.com/projectcalico/felix/config"
+	"github.com/projectcalico/felix/dataplane"
+	"github.com/projectcalico/felix/ifacemonitor"
+)
+
+const usage = `calico-iface-monitor, runs Felix's interface monitor on its own.
+
+Usage:
+  calico-iface-monitor dump [options]
+  calico-iface-monitor watch [options]
+
+The "dump" command lists the interfaces, as the monitor sees them after its start-of-day
+resync, and exits.  The "watch" command prints the monitor's updates as they happen.
+
+The monitor is configured from the Felix config file and FELIX_* environment variables, just
+as in Felix.
+
+Options:
+  -c --config-file=<filename>  Felix config file to load [default: /etc/calico/felix.cfg].
+  --exclude=<list>             Override Felix's InterfaceExclude setting (same format).
+  --name=<regexp>              Only show interfaces whose names match.
+  --json                       Output JSON instead of a table (dump) or text (watch).
+  --log-level=<level>          Log level [default: warning].
+  --version                    Print the version and exit.
+
+Exit codes: 0 on success, 2 if we don't have permission to use netlink, 1 for other errors.
+`
+
+const (
+	exitFailure          = 1
+	exitPermissionDenied = 2
+)
+
+func main() {
+	arguments, err := docopt.ParseArgs(usage, nil, buildinfo.GitVersion)
+	if err != nil {
+		println(usage)
+		log.Fatalf("Failed to parse usage, exiting: %v", err)
+	}
+	logLevel, err := log.ParseLevel(arguments["--log-level"].(string))
+	if err != nil {
+		log.Fatalf("Invalid log level: %v", err)
+	}
+	log.SetLevel(logLevel)
+
+	monitorConfig, err := loadMonitorConfig(arguments)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to load config.")
+	}
+	var filter ifacemonitor.SubscriberFilter
+	if expr, ok := arguments["--name"].(string); ok {
+		filter.NameRegexp, err = regexp.Compile(expr)
+		if err != nil {
+			log.WithError(err).Fatal("Invalid --name regexp.")
+		}
+	}
+	jsonOutput := arguments["--json"].(bool)
+
+	if arguments["dump"].(bool) {
+		err = dump(monitorConfig, filter, jsonOutput)
+	} else {
+		err = watch(ifacemonitor.New(monitorConfig), filter, jsonOutput)
+	}
+	if err != nil {
+		log.WithError(err).Error("Interface monitor failed.")
+		if ifacemonitor.IsPermissionError(err) {
+			fmt.Fprintln(os.Stderr, "Permission denied; the interface monitor needs CAP_NET_ADMIN.")
+			os.Exit(exitPermissionDenied)
+		}
+		os.Exit(exitFailure)
+	}
+}
+
+// loadMonitorConfig loads the interface monitor's config in the same way as Felix, from the
+// environment and the config file, with the overrides from the command line.
+func loadMonitorConfig(arguments map[string]interface{}) (ifacemonitor.Config, error) {
+	configParams := config.New()
+	envConfig := config.LoadConfigFromEnvironment(os.Environ())
+	if _, err := configParams.UpdateFrom(envConfig, config.EnvironmentVariable); err != nil {
+		return ifacemonitor.Config{}, err
+	}
+	fileConfig, err := config.LoadConfigFile(arguments["--config-file"].(string))
+	if err != nil {
+		return ifacemonitor.Config{}, err
+	}
+	if _, err := configParams.UpdateFrom(fileConfig, config.ConfigFile); err != nil {
+		return ifacemonitor.Config{}, err
+	}
+	if exclude, ok := arguments["--exclude"].(string); ok {
+		if _, err := configParams.UpdateFrom(map[string]string{
+			"InterfaceExclude": exclude,
+		}, config.InternalOverride); err != nil {
+			return ifacemonitor.Config{}, err
+		}
+	}
+	monitorConfig := dataplane.IfaceMonitorConfig(configParams)
+	// We're only looking, so we don't want to disturb a Felix that is running alongside us.
+	monitorConfig.StateFile = ""
+	monitorConfig.EventStreamSocket = ""
+	monitorConfig.RecordFile = ""
+	return monitorConfig, nil
+}
+
+func dump(monitorConfig ifacemonitor.Config, filter ifacemonitor.SubscriberFilter, jsonOutput bool) error {
+	allStatuses, err := ifacemonitor.ListInterfaces(monitorConfig)
+	if err != nil {
+		return err
+	}
+	var statuses []ifacemonitor.InterfaceStatus
+	for _, status := range allStatuses {
+		if filter.NameRegexp == nil || filter.NameRegexp.MatchString(status.Name) {
+			statuses = append(statuses, status)
+		}
+	}
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(statuses)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "INDEX\tNAME\tSTATE\tMTU\tMAC\tADDRESSES")
+	for _, status := range statuses {
+		state := string(status.State)
+		if status.Excluded {
+			state = "excluded"
+		}
+		addrs := "-"
+		if status.Addrs != nil {
+			addrs = strings.Join(status.Addrs, ",")
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%s\t%s\n",
+			status.Index, status.Name, state, status.MTU, status.HardwareAddr, addrs)
+	}
+	return w.Flush()
+}
+
+type watchEvent struct {
+	Time  time.Time          `json:"time"`
+	Name  string             `json:"name"`
+	Index int                `json:"index,omitempty"`
+	State ifacemonitor.State `json:"state,omitempty"`
+	Addrs []string           `json:"addrs,omitempty"`
+	Gone  bool               `json:"gone,omitempty"`
+}
+
+func watch(m *ifacemonitor.InterfaceMonitor, filter ifacemonitor.SubscriberFilter, jsonOutput bool) error {
+	enc := json.NewEncoder(os.Stdout)
+	printEvent := func(event watchEvent) {
+		event.Time = time.Now()
+		if jsonOutput {
+			_ = enc.Encode(event)
+			return
+		}
+		ts := event.Time.Format(time.RFC3339Nano)
+		switch {
+		case event.State != "":
+			fmt.Printf("%s %s (%d) %s\n", ts, event.Name, event.Index, event.State)
+		case event.Gone:
+			fmt.Printf("%s %s gone\n", ts, event.Name)
+		default:
+			fmt.Printf("%s %s addrs=%s\n", ts, event.Name, strings.Join(event.Addrs, ","))
+		}
+	}
+	m.SetCallbacks(
+		func(ifaceName string, ifaceState ifacemonitor.State, ifIndex int) {},
+		func(ifaceName string, addrs set.Set) {},
+	)
+	m.Subscribe(ifacemonitor.Subscriber{
+		Filter: filter,
+		StateCallback: func(ifaceName string, state ifacemonitor.State, ifIndex int) {
+			printEvent(watchEvent{Name: ifaceName, Index: ifIndex, State: state})
+		},
+		AddrCallback: func(ifaceName string, addrs set.Set) {
+			event := watchEvent{Name: ifaceName, Gone: addrs == nil}
+			if addrs != nil {
+				addrs.Iter(func(item interface{}) error {
+					event.Addrs = append(event.Addrs, item.(string))
+					return nil
+				})
+				sort.Strings(event.Addrs)
+			}
+			printEvent(event)
+		},
+	}, false)
+
+	sigC := make(chan os.Signal, 1)
+	signal.Notify(sigC, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigC
+		m.Stop()
+	}()
+	return m.Run()
+}
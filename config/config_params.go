@@ -190,6 +190,37 @@ type Config struct {
 	InterfacePrefix  string           `config:"iface-list;cali;non-zero,die-on-fail"`
 	InterfaceExclude []*regexp.Regexp `config:"iface-list-regexp;kube-ipvs0"`
 
+	// Tunables for the interface monitor.  InterfaceRefreshInterval (above) controls its resync.
+	// These are per-host tuning knobs so they can only be set locally, not in the
+	// FelixConfiguration resource.
+	InterfaceTeardownWindowMillis       time.Duration    `config:"millis(0,60000);0;local"`
+	InterfaceAddrAnnounceEnabled        bool             `config:"bool;false;local"`
+	InterfaceAddrAnnounceIntervalSecs   time.Duration    `config:"seconds(1,3600);10;local"`
+	InterfaceIPv4Only                   []*regexp.Regexp `config:"iface-list-regexp;;local"`
+	InterfaceIPv6Only                   []*regexp.Regexp `config:"iface-list-regexp;;local"`
+	InterfaceSysfsOperStateCheckEnabled bool             `config:"bool;false;local"`
+	InterfaceProtodownTrackingEnabled   bool             `config:"bool;false;local"`
+	InterfaceProtodownAsDown            bool             `config:"bool;false;local"`
+	InterfaceAltNameMatchingEnabled     bool             `config:"bool;false;local"`
+	// InterfaceMonitorHelperEnabled runs the interface monitor in a separate helper process.
+	// It can't be combined with InterfaceMonitorCanaryIntervalSecs.
+	InterfaceMonitorHelperEnabled bool `config:"bool;false;local"`
+	// InterfaceMonitorHelperSocket, with InterfaceMonitorHelperEnabled, is the path of a unix
+	// socket on which a helper that was started separately, with its own privileges, listens
+	// ("calico-felix interface-monitor-helper <path>").  Felix connects to it instead of
+	// starting a helper with Felix's own privileges.
+	InterfaceMonitorHelperSocket string `config:"file;;local"`
+	// InterfaceEventStreamSocket is the path of a unix socket on which the interface monitor
+	// streams its updates for debugging tools.  Disabled if empty.
+	InterfaceEventStreamSocket string `config:"file;;local"`
+	// InterfaceMonitorRecordFile is the path of a file that the interface monitor records its
+	// netlink inputs to, for replaying when debugging.  Disabled if empty.
+	InterfaceMonitorRecordFile string `config:"file;;local"`
+	// InterfaceMonitorCanaryIntervalSecs enables the interface monitor's self-test, which
+	// toggles a dummy interface at this interval and checks that the netlink event arrives,
+	// reporting the result to the health endpoint.  Disabled if 0.
+	InterfaceMonitorCanaryIntervalSecs time.Duration `config:"seconds(0,3600);0;local"`
+
 	ChainInsertMode             string `config:"oneof(insert,append);insert;non-zero,die-on-fail"`
 	DefaultEndpointToHostAction string `config:"oneof(DROP,RETURN,ACCEPT);DROP;non-zero,die-on-fail"`
 	IptablesFilterAllowAction   string `config:"oneof(ACCEPT,RETURN);ACCEPT;non-zero,die-on-fail"`
@@ -581,6 +612,31 @@ func (config *Config) Validate() (err error) {
 		}
 	}
 
+	// The interface monitor suppresses "up" notifications during the teardown window; a window
+	// as long as the refresh interval would hide genuine state changes that a resync finds.
+	if config.InterfaceRefreshInterval > 0 &&
+		config.InterfaceTeardownWindowMillis >= config.InterfaceRefreshInterval {
+		err = fmt.Errorf("InterfaceTeardownWindowMillis (%v) must be less than "+
+			"InterfaceRefreshInterval (%v)",
+			config.InterfaceTeardownWindowMillis, config.InterfaceRefreshInterval)
+	}
+	if config.InterfaceProtodownAsDown && !config.InterfaceProtodownTrackingEnabled {
+		err = errors.New("InterfaceProtodownAsDown requires InterfaceProtodownTrackingEnabled")
+	}
+	if config.InterfaceMonitorHelperSocket != "" && !config.InterfaceMonitorHelperEnabled {
+		err = errors.New("InterfaceMonitorHelperSocket requires InterfaceMonitorHelperEnabled")
+	}
+	// The helper process only passes back interface state and address updates, so options that
+	// report anything else would be silently ignored.
+	if config.InterfaceMonitorHelperEnabled && config.InterfaceMonitorCanaryIntervalSecs > 0 {
+		err = errors.New("InterfaceMonitorCanaryIntervalSecs isn't supported with " +
+			"InterfaceMonitorHelperEnabled; the self-test's health reports can't reach Felix")
+	}
+	if config.InterfaceMonitorHelperEnabled && config.InterfaceAddrAnnounceEnabled {
+		err = errors.New("InterfaceAddrAnnounceEnabled isn't supported with " +
+			"InterfaceMonitorHelperEnabled; the helper doesn't send announcements")
+	}
+
 	if err != nil {
 		config.Err = err
 	}
@@ -638,9 +694,11 @@ func loadParams() {
 		case "float":
 			param = &FloatParam{}
 		case "seconds":
-			param = &SecondsParam{}
+			min, max := parseDurationBounds(field.Name, kindParams, time.Second)
+			param = &SecondsParam{Min: min, Max: max}
 		case "millis":
-			param = &MillisParam{}
+			min, max := parseDurationBounds(field.Name, kindParams, time.Millisecond)
+			param = &MillisParam{Min: min, Max: max}
 		case "iface-list":
 			param = &RegexpParam{Regexp: IfaceListRegexp,
 				Msg: "invalid Linux interface name"}
@@ -735,6 +793,29 @@ func loadParams() {
 	}
 }
 
+// parseDurationBounds parses the optional "min,max" parameters of a seconds or millis param, in
+// the param's units.
+func parseDurationBounds(fieldName, kindParams string, unit time.Duration) (min, max time.Duration) {
+	if kindParams == "" {
+		return
+	}
+	minAndMax := strings.Split(kindParams, ",")
+	if len(minAndMax) != 2 {
+		log.Panicf("Failed to parse bounds for %v", fieldName)
+	}
+	minF, err := strconv.ParseFloat(minAndMax[0], 64)
+	if err != nil {
+		log.Panicf("Failed to parse min value for %v", fieldName)
+	}
+	maxF, err := strconv.ParseFloat(minAndMax[1], 64)
+	if err != nil {
+		log.Panicf("Failed to parse max value for %v", fieldName)
+	}
+	min = time.Duration(minF * float64(unit))
+	max = time.Duration(maxF * float64(unit))
+	return
+}
+
 func (config *Config) SetUseNodeResourceUpdates(b bool) {
 	config.useNodeResourceUpdates = b
 }
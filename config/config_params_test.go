@@ -438,6 +438,47 @@ var _ = DescribeTable("Config parsing",
 
 	Entry("IptablesNATOutgoingInterfaceFilter", "IptablesNATOutgoingInterfaceFilter", "cali-123", "cali-123"),
 	Entry("IptablesNATOutgoingInterfaceFilter", "IptablesNATOutgoingInterfaceFilter", "cali@123", "", false),
+
+	Entry("InterfaceTeardownWindowMillis", "InterfaceTeardownWindowMillis", "250", 250*time.Millisecond),
+	Entry("InterfaceTeardownWindowMillis empty", "InterfaceTeardownWindowMillis", "", time.Duration(0)),
+	Entry("InterfaceTeardownWindowMillis negative -> defaulted", "InterfaceTeardownWindowMillis", "-1", time.Duration(0)),
+	Entry("InterfaceTeardownWindowMillis too big -> defaulted", "InterfaceTeardownWindowMillis", "60001", time.Duration(0)),
+	Entry("InterfaceAddrAnnounceEnabled", "InterfaceAddrAnnounceEnabled", "true", true),
+	Entry("InterfaceAddrAnnounceEnabled empty", "InterfaceAddrAnnounceEnabled", "", false),
+	Entry("InterfaceAddrAnnounceIntervalSecs", "InterfaceAddrAnnounceIntervalSecs", "30", 30*time.Second),
+	Entry("InterfaceAddrAnnounceIntervalSecs empty", "InterfaceAddrAnnounceIntervalSecs", "", 10*time.Second),
+	Entry("InterfaceAddrAnnounceIntervalSecs too small -> defaulted", "InterfaceAddrAnnounceIntervalSecs", "0.5", 10*time.Second),
+	Entry("InterfaceAddrAnnounceIntervalSecs too big -> defaulted", "InterfaceAddrAnnounceIntervalSecs", "3601", 10*time.Second),
+	Entry("InterfaceIPv4Only", "InterfaceIPv4Only", "eth0,/^ens/", []*regexp.Regexp{
+		regexp.MustCompile("^eth0$"),
+		regexp.MustCompile("^ens"),
+	}),
+	Entry("InterfaceIPv4Only empty", "InterfaceIPv4Only", "", []*regexp.Regexp(nil)),
+	Entry("InterfaceIPv6Only", "InterfaceIPv6Only", "/^v6-/", []*regexp.Regexp{
+		regexp.MustCompile("^v6-"),
+	}),
+	Entry("InterfaceIPv6Only invalid -> defaulted", "InterfaceIPv6Only", `/^v6-\K/`, []*regexp.Regexp(nil)),
+	Entry("InterfaceSysfsOperStateCheckEnabled", "InterfaceSysfsOperStateCheckEnabled", "true", true),
+	Entry("InterfaceSysfsOperStateCheckEnabled empty", "InterfaceSysfsOperStateCheckEnabled", "", false),
+	Entry("InterfaceProtodownTrackingEnabled", "InterfaceProtodownTrackingEnabled", "true", true),
+	Entry("InterfaceProtodownTrackingEnabled empty", "InterfaceProtodownTrackingEnabled", "", false),
+	Entry("InterfaceProtodownAsDown", "InterfaceProtodownAsDown", "true", true),
+	Entry("InterfaceProtodownAsDown empty", "InterfaceProtodownAsDown", "", false),
+	Entry("InterfaceAltNameMatchingEnabled", "InterfaceAltNameMatchingEnabled", "true", true),
+	Entry("InterfaceAltNameMatchingEnabled empty", "InterfaceAltNameMatchingEnabled", "", false),
+	Entry("InterfaceMonitorHelperEnabled", "InterfaceMonitorHelperEnabled", "true", true),
+	Entry("InterfaceMonitorHelperEnabled empty", "InterfaceMonitorHelperEnabled", "", false),
+	Entry("InterfaceMonitorHelperSocket", "InterfaceMonitorHelperSocket", "/var/run/calico/iface-helper.sock",
+		"/var/run/calico/iface-helper.sock"),
+	Entry("InterfaceMonitorHelperSocket empty", "InterfaceMonitorHelperSocket", "", ""),
+	Entry("InterfaceEventStreamSocket", "InterfaceEventStreamSocket", "/var/run/calico/iface-events.sock",
+		"/var/run/calico/iface-events.sock"),
+	Entry("InterfaceEventStreamSocket empty", "InterfaceEventStreamSocket", "", ""),
+	Entry("InterfaceMonitorRecordFile", "InterfaceMonitorRecordFile", "/var/log/calico/iface-recording.jsonl",
+		"/var/log/calico/iface-recording.jsonl"),
+	Entry("InterfaceMonitorRecordFile empty", "InterfaceMonitorRecordFile", "", ""),
+	Entry("InterfaceMonitorCanaryIntervalSecs", "InterfaceMonitorCanaryIntervalSecs", "30", 30*time.Second),
+	Entry("InterfaceMonitorCanaryIntervalSecs empty", "InterfaceMonitorCanaryIntervalSecs", "", time.Duration(0)),
 )
 
 var _ = DescribeTable("OpenStack heuristic tests",
@@ -655,6 +696,46 @@ var _ = DescribeTable("Config validation",
 	Entry("invalid RouteTableRange", map[string]string{
 		"RouteTableRange": "abcde",
 	}, false),
+	Entry("interface teardown window shorter than refresh interval", map[string]string{
+		"InterfaceTeardownWindowMillis": "5000",
+		"InterfaceRefreshInterval":      "10",
+	}, true),
+	Entry("interface teardown window as long as refresh interval", map[string]string{
+		"InterfaceTeardownWindowMillis": "10000",
+		"InterfaceRefreshInterval":      "10",
+	}, false),
+	Entry("interface teardown window with refresh disabled", map[string]string{
+		"InterfaceTeardownWindowMillis": "10000",
+		"InterfaceRefreshInterval":      "0",
+	}, true),
+	Entry("InterfaceProtodownAsDown without tracking", map[string]string{
+		"InterfaceProtodownAsDown": "true",
+	}, false),
+	Entry("InterfaceProtodownAsDown with tracking", map[string]string{
+		"InterfaceProtodownAsDown":          "true",
+		"InterfaceProtodownTrackingEnabled": "true",
+	}, true),
+	Entry("interface monitor helper", map[string]string{
+		"InterfaceMonitorHelperEnabled": "true",
+	}, true),
+	Entry("interface monitor helper socket", map[string]string{
+		"InterfaceMonitorHelperEnabled": "true",
+		"InterfaceMonitorHelperSocket":  "/var/run/calico/iface-helper.sock",
+	}, true),
+	Entry("interface monitor helper socket without the helper", map[string]string{
+		"InterfaceMonitorHelperSocket": "/var/run/calico/iface-helper.sock",
+	}, false),
+	Entry("interface monitor helper with the self-test", map[string]string{
+		"InterfaceMonitorHelperEnabled":      "true",
+		"InterfaceMonitorCanaryIntervalSecs": "30",
+	}, false),
+	Entry("address announcements", map[string]string{
+		"InterfaceAddrAnnounceEnabled": "true",
+	}, true),
+	Entry("interface monitor helper with address announcements", map[string]string{
+		"InterfaceMonitorHelperEnabled": "true",
+		"InterfaceAddrAnnounceEnabled":  "true",
+	}, false),
 )
 
 var _ = DescribeTable("Config InterfaceExclude",
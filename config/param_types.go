@@ -133,6 +133,8 @@ func (p *FloatParam) Parse(raw string) (result interface{}, err error) {
 
 type SecondsParam struct {
 	Metadata
+	Min time.Duration
+	Max time.Duration
 }
 
 func (p *SecondsParam) Parse(raw string) (result interface{}, err error) {
@@ -141,12 +143,16 @@ func (p *SecondsParam) Parse(raw string) (result interface{}, err error) {
 		err = p.parseFailed(raw, "invalid float")
 		return
 	}
-	result = time.Duration(seconds * float64(time.Second))
+	duration := time.Duration(seconds * float64(time.Second))
+	result = duration
+	err = p.checkDurationBounds(raw, duration, p.Min, p.Max)
 	return
 }
 
 type MillisParam struct {
 	Metadata
+	Min time.Duration
+	Max time.Duration
 }
 
 func (p *MillisParam) Parse(raw string) (result interface{}, err error) {
@@ -155,10 +161,26 @@ func (p *MillisParam) Parse(raw string) (result interface{}, err error) {
 		err = p.parseFailed(raw, "invalid float")
 		return
 	}
-	result = time.Duration(millis * float64(time.Millisecond))
+	duration := time.Duration(millis * float64(time.Millisecond))
+	result = duration
+	err = p.checkDurationBounds(raw, duration, p.Min, p.Max)
 	return
 }
 
+// checkDurationBounds checks a parsed duration against the bounds of a seconds or millis param.
+// If both bounds are zero, the param is unbounded.
+func (m *Metadata) checkDurationBounds(raw string, d, min, max time.Duration) error {
+	if min == 0 && max == 0 {
+		return nil
+	}
+	if d < min {
+		return m.parseFailed(raw, fmt.Sprintf("value must be at least %v", min))
+	} else if d > max {
+		return m.parseFailed(raw, fmt.Sprintf("value must be at most %v", max))
+	}
+	return nil
+}
+
 type RegexpParam struct {
 	Metadata
 	Regexp *regexp.Regexp
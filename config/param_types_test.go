@@ -15,6 +15,8 @@
 package config_test
 
 import (
+	"time"
+
 	. "github.com/projectcalico/felix/config"
 
 	. "github.com/onsi/ginkgo/extensions/table"
@@ -83,3 +85,28 @@ var _ = DescribeTable("KeyValue list parameter parsing",
 		"v2":  " x ",
 	}),
 )
+
+var _ = DescribeTable("Duration parameter parsing",
+	func(p durationParam, raw string, expected interface{}, expectSuccess bool) {
+		actual, err := p.Parse(raw)
+		if expectSuccess {
+			Expect(err).To(BeNil())
+			Expect(actual).To(Equal(expected))
+		} else {
+			Expect(err).NotTo(BeNil())
+		}
+	},
+	Entry("Seconds unbounded", &SecondsParam{}, "-1.5", -1500*time.Millisecond, true),
+	Entry("Seconds in range", &SecondsParam{Min: time.Second, Max: time.Minute}, "60", time.Minute, true),
+	Entry("Seconds too small", &SecondsParam{Min: time.Second, Max: time.Minute}, "0.5", nil, false),
+	Entry("Seconds too big", &SecondsParam{Min: time.Second, Max: time.Minute}, "61", nil, false),
+	Entry("Seconds invalid", &SecondsParam{}, "abc", nil, false),
+	Entry("Millis unbounded", &MillisParam{}, "1.5", 1500*time.Microsecond, true),
+	Entry("Millis lower bound of zero", &MillisParam{Max: time.Second}, "0", time.Duration(0), true),
+	Entry("Millis below zero", &MillisParam{Max: time.Second}, "-1", nil, false),
+	Entry("Millis too big", &MillisParam{Max: time.Second}, "1001", nil, false),
+)
+
+type durationParam interface {
+	Parse(raw string) (interface{}, error)
+}
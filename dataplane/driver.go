@@ -152,11 +152,11 @@ func StartDataplaneDriver(configParams *config.Config,
 		}
 
 		dpConfig := intdataplane.Config{
-			Hostname: configParams.FelixHostname,
-			IfaceMonitorConfig: ifacemonitor.Config{
-				InterfaceExcludes: configParams.InterfaceExclude,
-				ResyncInterval:    configParams.InterfaceRefreshInterval,
-			},
+			Hostname:                 configParams.FelixHostname,
+			IfaceMonitorConfig:       IfaceMonitorConfig(configParams),
+			IfaceMonitorHelper:       configParams.InterfaceMonitorHelperEnabled,
+			IfaceMonitorHelperSocket: configParams.InterfaceMonitorHelperSocket,
+			IfaceAddrAnnounce:        configParams.InterfaceAddrAnnounceEnabled,
 			RulesConfig: rules.Config{
 				WorkloadIfacePrefixes: configParams.InterfacePrefixes(),
 
@@ -315,3 +315,29 @@ func StartDataplaneDriver(configParams *config.Config,
 func SupportsBPF() error {
 	return bpf.SupportsBPFDataplane()
 }
+
+// IfaceMonitorConfig builds the interface monitor's config from the resolved Felix config.
+// Combinations that the monitor can't honour, including those that don't work with the helper
+// process, are rejected by config.Validate().
+func IfaceMonitorConfig(configParams *config.Config) ifacemonitor.Config {
+	resyncInterval := configParams.InterfaceRefreshInterval
+	if resyncInterval == 0 {
+		// Felix uses 0 to disable the refresh, whereas the monitor would use its default.
+		resyncInterval = -1
+	}
+	return ifacemonitor.Config{
+		InterfaceExcludes:    configParams.InterfaceExclude,
+		ResyncInterval:       resyncInterval,
+		TeardownWindow:       configParams.InterfaceTeardownWindowMillis,
+		AddrAnnounceInterval: configParams.InterfaceAddrAnnounceIntervalSecs,
+		IPv4OnlyInterfaces:   configParams.InterfaceIPv4Only,
+		IPv6OnlyInterfaces:   configParams.InterfaceIPv6Only,
+		SysfsOperStateCheck:  configParams.InterfaceSysfsOperStateCheckEnabled,
+		TrackProtodown:       configParams.InterfaceProtodownTrackingEnabled,
+		ProtodownAsDown:      configParams.InterfaceProtodownAsDown,
+		MatchAltNames:        configParams.InterfaceAltNameMatchingEnabled,
+		EventStreamSocket:    configParams.InterfaceEventStreamSocket,
+		RecordFile:           configParams.InterfaceMonitorRecordFile,
+		CanaryInterval:       configParams.InterfaceMonitorCanaryIntervalSecs,
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !windows
+
+package dataplane_test
+
+import (
+	"regexp"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/felix/config"
+	"github.com/projectcalico/felix/dataplane"
+	"github.com/projectcalico/felix/ifacemonitor"
+)
+
+var _ = Describe("IfaceMonitorConfig", func() {
+	It("should use the monitor's defaults when nothing is set", func() {
+		configParams := config.New()
+		Expect(configParams.Validate()).To(Succeed())
+		Expect(dataplane.IfaceMonitorConfig(configParams)).To(Equal(ifacemonitor.Config{
+			InterfaceExcludes:    []*regexp.Regexp{regexp.MustCompile("^kube-ipvs0$")},
+			ResyncInterval:       90 * time.Second,
+			AddrAnnounceInterval: 10 * time.Second,
+		}))
+	})
+
+	It("should pass through all the interface monitor params", func() {
+		configParams := config.New()
+		_, err := configParams.UpdateFrom(map[string]string{
+			"InterfaceExclude":                    "/^veth/",
+			"InterfaceRefreshInterval":            "30",
+			"InterfaceTeardownWindowMillis":       "500",
+			"InterfaceAddrAnnounceIntervalSecs":   "60",
+			"InterfaceIPv4Only":                   "eth0",
+			"InterfaceIPv6Only":                   "/^v6-/",
+			"InterfaceSysfsOperStateCheckEnabled": "true",
+			"InterfaceProtodownTrackingEnabled":   "true",
+			"InterfaceProtodownAsDown":            "true",
+			"InterfaceAltNameMatchingEnabled":     "true",
+			"InterfaceEventStreamSocket":          "/var/run/calico/iface-events.sock",
+			"InterfaceMonitorRecordFile":          "/var/log/calico/iface-recording.jsonl",
+			"InterfaceMonitorCanaryIntervalSecs":  "30",
+		}, config.EnvironmentVariable)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(configParams.Validate()).To(Succeed())
+		Expect(dataplane.IfaceMonitorConfig(configParams)).To(Equal(ifacemonitor.Config{
+			InterfaceExcludes:    []*regexp.Regexp{regexp.MustCompile("^veth")},
+			ResyncInterval:       30 * time.Second,
+			TeardownWindow:       500 * time.Millisecond,
+			AddrAnnounceInterval: time.Minute,
+			IPv4OnlyInterfaces:   []*regexp.Regexp{regexp.MustCompile("^eth0$")},
+			IPv6OnlyInterfaces:   []*regexp.Regexp{regexp.MustCompile("^v6-")},
+			SysfsOperStateCheck:  true,
+			TrackProtodown:       true,
+			ProtodownAsDown:      true,
+			MatchAltNames:        true,
+			EventStreamSocket:    "/var/run/calico/iface-events.sock",
+			RecordFile:           "/var/log/calico/iface-recording.jsonl",
+			CanaryInterval:       30 * time.Second,
+		}))
+	})
+
+	It("should disable the monitor's resync if the refresh interval is 0", func() {
+		configParams := config.New()
+		_, err := configParams.UpdateFrom(map[string]string{
+			"InterfaceRefreshInterval": "0",
+		}, config.EnvironmentVariable)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dataplane.IfaceMonitorConfig(configParams).ResyncInterval).To(BeNumerically("<", 0))
+	})
+
+	It("should ignore the interface monitor params from the datastore", func() {
+		configParams := config.New()
+		_, err := configParams.UpdateFrom(map[string]string{
+			"InterfaceAltNameMatchingEnabled": "true",
+		}, config.DatastoreGlobal)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dataplane.IfaceMonitorConfig(configParams).MatchAltNames).To(BeFalse())
+	})
+})
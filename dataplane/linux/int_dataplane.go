@@ -142,6 +142,14 @@ type Config struct {
 	RulesConfig rules.Config
 
 	IfaceMonitorConfig ifacemonitor.Config
+	// IfaceMonitorHelper runs the interface monitor in a helper process.
+	IfaceMonitorHelper bool
+	// IfaceMonitorHelperSocket, if set, is the socket of a helper that was started separately;
+	// we connect to it instead of starting our own.
+	IfaceMonitorHelperSocket string
+	// IfaceAddrAnnounce makes the interface monitor announce new addresses with gratuitous
+	// ARPs and unsolicited neighbour advertisements.  Not supported with the helper.
+	IfaceAddrAnnounce bool
 
 	StatusReportingInterval time.Duration
 
@@ -222,7 +230,7 @@ type InternalDataplane struct {
 
 	wireguardManager *wireguardManager
 
-	ifaceMonitor     *ifacemonitor.InterfaceMonitor
+	ifaceMonitor     ifacemonitor.Monitor
 	ifaceUpdates     chan *ifaceUpdate
 	ifaceAddrUpdates chan *ifaceAddrsUpdate
 
@@ -267,6 +275,9 @@ type InternalDataplane struct {
 const (
 	healthName     = "int_dataplane"
 	healthInterval = 10 * time.Second
+
+	// ifaceMonitorHealthName is the health reporter for the interface monitor's self-test.
+	ifaceMonitorHealthName = "iface_monitor"
 )
 
 func NewIntDataplaneDriver(config Config) *InternalDataplane {
@@ -279,19 +290,61 @@ func NewIntDataplaneDriver(config Config) *InternalDataplane {
 		config.RulesConfig.IptablesMarkEndpoint,
 		config.RulesConfig.IptablesMarkNonCaliEndpoint)
 
+	var ifaceMonitor ifacemonitor.Monitor
+	if config.IfaceMonitorHelper {
+		monitorConfig := config.IfaceMonitorConfig
+		if monitorConfig.CanaryInterval > 0 {
+			// config.Validate() rejects this combination: the helper has no way to pass the
+			// self-test's results back, so running it would just toggle the canary for nothing.
+			log.Warn("Interface monitor self-test isn't supported with the helper process; disabling it.")
+			monitorConfig.CanaryInterval = 0
+		}
+		if config.IfaceAddrAnnounce {
+			// Also rejected by config.Validate(): the announcer runs in our process, and the
+			// helper only sends us updates.
+			log.Warn("Address announcements aren't supported with the helper process; disabling them.")
+		}
+		startHelper := ifacemonitor.ExecHelper()
+		if config.IfaceMonitorHelperSocket != "" {
+			startHelper = ifacemonitor.DialHelper(config.IfaceMonitorHelperSocket)
+		}
+		ifaceMonitor = ifacemonitor.NewHelperClient(monitorConfig, startHelper)
+	} else {
+		monitorConfig := config.IfaceMonitorConfig
+		monitorConfig.Registerer = prometheus.DefaultRegisterer
+		monitor := ifacemonitor.New(monitorConfig)
+		if config.IfaceAddrAnnounce {
+			monitor.AddrAnnouncer = ifacemonitor.NewAddrAnnouncer()
+		}
+		if config.IfaceMonitorConfig.CanaryInterval > 0 && config.HealthAggregator != nil {
+			// The self-test reports liveness: if netlink events stop reaching the monitor,
+			// restarting is the only way to get them back.
+			config.HealthAggregator.RegisterReporter(
+				ifaceMonitorHealthName,
+				&health.HealthReport{Live: true},
+				0,
+			)
+			monitor.CanaryCallback = func(result ifacemonitor.CanaryResult) {
+				config.HealthAggregator.Report(
+					ifaceMonitorHealthName,
+					&health.HealthReport{Live: result != ifacemonitor.CanaryTimedOut},
+				)
+			}
+		}
+		ifaceMonitor = monitor
+	}
 	dp := &InternalDataplane{
 		toDataplane:      make(chan interface{}, msgPeekLimit),
 		fromDataplane:    make(chan interface{}, 100),
 		ruleRenderer:     ruleRenderer,
-		ifaceMonitor:     ifacemonitor.New(config.IfaceMonitorConfig),
+		ifaceMonitor:     ifaceMonitor,
 		ifaceUpdates:     make(chan *ifaceUpdate, 100),
 		ifaceAddrUpdates: make(chan *ifaceAddrsUpdate, 100),
 		config:           config,
 		applyThrottle:    throttle.New(10),
 	}
 	dp.applyThrottle.Refill() // Allow the first apply() immediately.
-	dp.ifaceMonitor.StateCallback = dp.onIfaceStateChange
-	dp.ifaceMonitor.AddrCallback = dp.onIfaceAddrsChange
+	dp.ifaceMonitor.SetCallbacks(dp.onIfaceStateChange, dp.onIfaceAddrsChange)
 
 	backendMode := iptables.DetectBackend(config.LookPathOverride, iptables.NewRealCmd, config.IptablesBackend)
 
@@ -0,0 +1,155 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ifacemonitor/testutils"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Added callbacks", func() {
+	var nl *netlinkTest
+	var im *ifacemonitor.InterfaceMonitor
+	var recorder *testutils.Recorder
+
+	BeforeEach(func() {
+		recorder = testutils.NewRecorder()
+	})
+
+	AfterEach(func() {
+		im.Stop()
+	})
+
+	// start runs a monitor with only the callbacks that setCallbacks sets.
+	start := func(setCallbacks func(im *ifacemonitor.InterfaceMonitor)) {
+		im, nl, _ = startMonitor(ifacemonitor.Config{}, func(_ *netlinkTest, im *ifacemonitor.InterfaceMonitor) {
+			im.SetCallbacks(nil, nil)
+			setCallbacks(im)
+		})
+	}
+
+	sortedAddrs := func(addrs set.Set) string {
+		if addrs == nil {
+			return "nil"
+		}
+		var strs []string
+		addrs.Iter(func(item interface{}) error {
+			strs = append(strs, item.(string))
+			return nil
+		})
+		sort.Strings(strs)
+		return strings.Join(strs, ",")
+	}
+
+	// stateRecorder and addrRecorder make callbacks that record which listener they are on this
+	// spec's recorder.
+	stateRecorder := func(listener string) ifacemonitor.InterfaceStateCallback {
+		rec := recorder
+		return func(ifaceName string, state ifacemonitor.State, ifIndex int) {
+			rec.RecordOther(ifaceName, "%s: state %s", listener, state)
+		}
+	}
+	addrRecorder := func(listener string) ifacemonitor.AddrStateCallback {
+		rec := recorder
+		return func(ifaceName string, addrs set.Set) {
+			rec.RecordOther(ifaceName, "%s: addrs %s", listener, sortedAddrs(addrs))
+		}
+	}
+
+	It("should call the fields' callbacks and then the added ones, in order", func() {
+		start(func(im *ifacemonitor.InterfaceMonitor) {
+			im.StateCallback = stateRecorder("field")
+			im.AddrCallback = addrRecorder("field")
+			im.AddCallback(stateRecorder("first"))
+			im.AddAddrCallback(addrRecorder("first"))
+			im.AddCallback(stateRecorder("second"))
+			im.AddAddrCallback(addrRecorder("second"))
+		})
+
+		nl.addLink("eth0")
+		nl.addAddr("eth0", "10.0.0.1/32")
+		recorder.ExpectSequence(
+			testutils.OtherEvent("eth0", "field: addrs 10.0.0.1"),
+			testutils.OtherEvent("eth0", "first: addrs 10.0.0.1"),
+			testutils.OtherEvent("eth0", "second: addrs 10.0.0.1"),
+		)
+		nl.changeLinkState("eth0", "up")
+		recorder.ExpectSequence(
+			testutils.OtherEvent("eth0", "field: state up"),
+			testutils.OtherEvent("eth0", "first: state up"),
+			testutils.OtherEvent("eth0", "second: state up"),
+		)
+		nl.delLink("eth0")
+		recorder.ExpectSequence(
+			testutils.OtherEvent("eth0", "field: addrs nil"),
+			testutils.OtherEvent("eth0", "first: addrs nil"),
+			testutils.OtherEvent("eth0", "second: addrs nil"),
+			testutils.OtherEvent("eth0", "field: state down"),
+			testutils.OtherEvent("eth0", "first: state down"),
+			testutils.OtherEvent("eth0", "second: state down"),
+		)
+	})
+
+	It("should work without the fields' callbacks", func() {
+		start(func(im *ifacemonitor.InterfaceMonitor) {
+			im.AddCallback(stateRecorder("added"))
+			im.AddAddrCallback(addrRecorder("added"))
+		})
+
+		nl.addLink("eth0")
+		nl.addAddr("eth0", "10.0.0.1/32")
+		nl.changeLinkState("eth0", "up")
+		recorder.ExpectSequence(
+			testutils.OtherEvent("eth0", "added: addrs 10.0.0.1"),
+			testutils.OtherEvent("eth0", "added: state up"),
+		)
+	})
+
+	It("should give each address callback its own copy of the addresses", func() {
+		var lock sync.Mutex
+		var kept []set.Set
+		keep := func(ifaceName string, addrs set.Set) {
+			lock.Lock()
+			defer lock.Unlock()
+			kept = append(kept, addrs)
+			// Scribble on our copy.
+			addrs.Add("10.9.9.9")
+		}
+		start(func(im *ifacemonitor.InterfaceMonitor) {
+			im.AddrCallback = keep
+			im.AddAddrCallback(keep)
+			im.AddAddrCallback(addrRecorder("added"))
+		})
+
+		nl.addLink("eth0")
+		nl.addAddr("eth0", "10.0.0.1/32")
+		recorder.ExpectSequence(testutils.OtherEvent("eth0", "added: addrs 10.0.0.1"))
+		lock.Lock()
+		defer lock.Unlock()
+		Expect(kept).To(HaveLen(2))
+		Expect(kept[0]).NotTo(BeIdenticalTo(kept[1]))
+	})
+})
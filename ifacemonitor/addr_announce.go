@@ -0,0 +1,121 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// defaultAddrAnnounceInterval is the minimum interval between announcements of the same address
+// if Config.AddrAnnounceInterval isn't set.
+const defaultAddrAnnounceInterval = 10 * time.Second
+
+// AddrAnnouncer sends an unsolicited announcement of a newly-arrived address so that neighbours
+// update their ARP/neighbour caches (for example, after a VIP fails over to this host).  For
+// IPv4 that's a gratuitous ARP, for IPv6 an unsolicited neighbour advertisement.
+//
+// Announce is called from the monitor's goroutine so implementations should not block for long.
+type AddrAnnouncer interface {
+	Announce(ifaceName string, ifIndex int, hardwareAddr net.HardwareAddr, addr net.IP) error
+}
+
+// maybeAnnounceAddr calls the AddrAnnouncer, if there is one, for an address that has just
+// appeared on an interface.  We only announce global unicast addresses on up, non-excluded
+// interfaces and we skip addresses that are still tentative (i.e. undergoing IPv6 duplicate
+// address detection).  Announcements of the same address are rate limited.  Failures are logged
+// and otherwise ignored.
+func (m *InterfaceMonitor) maybeAnnounceAddr(ifIndex int, addrStr string) {
+	if m.AddrAnnouncer == nil || !m.startOfDayResyncDone {
+		// Disabled, or this is the start-of-day resync, in which case the addresses aren't
+		// new; they were just already there when we started.
+		return
+	}
+	ifaceName, known := m.ifaceName[ifIndex]
+	if !known || m.isExcludedInterface(ifaceName) {
+		return
+	}
+	logCxt := log.WithFields(log.Fields{
+		"ifaceName": ifaceName,
+		"addr":      addrStr,
+	})
+	if upIdx, up := m.upIfaces[ifaceName]; !up || upIdx != ifIndex {
+		logCxt.Debug("Interface not up, not announcing address.")
+		return
+	}
+	addr := net.ParseIP(addrStr)
+	if addr == nil || !addr.IsGlobalUnicast() {
+		logCxt.Debug("Not a global unicast address, not announcing it.")
+		return
+	}
+	if addr.To4() == nil && m.addrIsTentative(ifaceName, ifIndex, addr) {
+		logCxt.Debug("Address is tentative, not announcing it.")
+		return
+	}
+
+	interval := m.AddrAnnounceInterval
+	if interval <= 0 {
+		interval = defaultAddrAnnounceInterval
+	}
+	now := m.time.Now()
+	if last, ok := m.lastAddrAnnounce[addrStr]; ok && now.Sub(last) < interval {
+		logCxt.Debug("Address announced recently, skipping.")
+		return
+	}
+	m.lastAddrAnnounce[addrStr] = now
+
+	logCxt.Info("Announcing new address.")
+	err := m.AddrAnnouncer.Announce(ifaceName, ifIndex, m.linkAttrs[ifIndex].hardwareAddr, addr)
+	if err != nil {
+		logCxt.WithError(err).Warn("Failed to announce new address.")
+	}
+}
+
+// addrIsTentative returns true if the kernel has flagged the given IPv6 address as tentative.
+func (m *InterfaceMonitor) addrIsTentative(ifaceName string, ifIndex int, addr net.IP) bool {
+	link := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: ifaceName, Index: ifIndex}}
+	addrs, err := m.netlinkStub.AddrList(link, netlink.FAMILY_V6)
+	if err != nil {
+		// Err on the side of not sending anything for an address that might be a duplicate.
+		log.WithError(err).Warn("Netlink address list operation failed.")
+		return true
+	}
+	for _, a := range addrs {
+		if a.IPNet != nil && a.IP.Equal(addr) {
+			return a.Flags&unix.IFA_F_TENTATIVE != 0
+		}
+	}
+	return false
+}
+
+// cleanUpAddrAnnounceHistory removes rate limiting entries that have expired.
+func (m *InterfaceMonitor) cleanUpAddrAnnounceHistory() {
+	interval := m.AddrAnnounceInterval
+	if interval <= 0 {
+		interval = defaultAddrAnnounceInterval
+	}
+	now := m.time.Now()
+	for addr, last := range m.lastAddrAnnounce {
+		if now.Sub(last) >= interval {
+			delete(m.lastAddrAnnounce, addr)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+
+	nlpkg "github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	icmpv6NeighborAdvert = 136
+	// naFlagOverride is the O flag in a neighbour advertisement; it tells receivers to replace
+	// any existing cache entry.
+	naFlagOverride = 0x20
+	// ndOptTargetLLAddr is the target link-layer address option type.
+	ndOptTargetLLAddr = 2
+)
+
+var (
+	ethBroadcast    = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	ip6AllNodesAddr = net.ParseIP("ff02::1")
+)
+
+// NewAddrAnnouncer returns an AddrAnnouncer that sends gratuitous ARPs and unsolicited neighbour
+// advertisements using raw sockets.  Requires CAP_NET_RAW.
+func NewAddrAnnouncer() AddrAnnouncer {
+	return &rawAddrAnnouncer{}
+}
+
+type rawAddrAnnouncer struct {
+}
+
+func (a *rawAddrAnnouncer) Announce(ifaceName string, ifIndex int, hardwareAddr net.HardwareAddr, addr net.IP) error {
+	if len(hardwareAddr) != 6 {
+		// Layer 3 device (for example, IPIP or WireGuard); there are no neighbour caches to
+		// update.
+		return nil
+	}
+	if ip4 := addr.To4(); ip4 != nil {
+		return sendGratuitousARP(ifIndex, hardwareAddr, ip4)
+	}
+	return sendUnsolicitedNA(ifIndex, hardwareAddr, addr)
+}
+
+// htons converts v from host to network byte order, which is how AF_PACKET sockets and their
+// addresses take the protocol.
+func htons(v uint16) uint16 {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	return nlpkg.NativeEndian().Uint16(b[:])
+}
+
+// gratuitousARPFrame builds an Ethernet frame containing a broadcast ARP request for our own
+// address.
+func gratuitousARPFrame(hardwareAddr net.HardwareAddr, ip4 net.IP) []byte {
+	frame := make([]byte, 0, 42)
+	// Ethernet header.
+	frame = append(frame, ethBroadcast...)
+	frame = append(frame, hardwareAddr...)
+	frame = append(frame, unix.ETH_P_ARP>>8, unix.ETH_P_ARP&0xff)
+	// ARP: Ethernet hardware type, IPv4 protocol type, address lengths, request.
+	frame = append(frame, 0, 1, 0x08, 0x00, 6, 4, 0, 1)
+	frame = append(frame, hardwareAddr...)
+	frame = append(frame, ip4...)
+	frame = append(frame, 0, 0, 0, 0, 0, 0)
+	frame = append(frame, ip4...)
+	return frame
+}
+
+func sendGratuitousARP(ifIndex int, hardwareAddr net.HardwareAddr, ip4 net.IP) error {
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, int(htons(unix.ETH_P_ARP)))
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	dest := &unix.SockaddrLinklayer{
+		Protocol: htons(unix.ETH_P_ARP),
+		Ifindex:  ifIndex,
+		Halen:    6,
+	}
+	copy(dest.Addr[:], ethBroadcast)
+	return unix.Sendto(fd, gratuitousARPFrame(hardwareAddr, ip4), 0, dest)
+}
+
+// unsolicitedNAMessage builds an ICMPv6 neighbour advertisement for the given address.  The
+// kernel fills in the checksum for raw ICMPv6 sockets.
+func unsolicitedNAMessage(hardwareAddr net.HardwareAddr, ip6 net.IP) []byte {
+	msg := make([]byte, 0, 32)
+	msg = append(msg, icmpv6NeighborAdvert, 0, 0, 0)
+	msg = append(msg, naFlagOverride, 0, 0, 0)
+	msg = append(msg, ip6...)
+	msg = append(msg, ndOptTargetLLAddr, 1)
+	msg = append(msg, hardwareAddr...)
+	return msg
+}
+
+func sendUnsolicitedNA(ifIndex int, hardwareAddr net.HardwareAddr, addr net.IP) error {
+	ip6 := addr.To16()
+	if ip6 == nil {
+		return errors.New("invalid IPv6 address")
+	}
+	fd, err := unix.Socket(unix.AF_INET6, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.IPPROTO_ICMPV6)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	// Neighbour discovery packets must have a hop limit of 255 (RFC 4861).
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_MULTICAST_HOPS, 255); err != nil {
+		return err
+	}
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_MULTICAST_IF, ifIndex); err != nil {
+		return err
+	}
+	// Send from the address that we're announcing.
+	src := &unix.SockaddrInet6{}
+	copy(src.Addr[:], ip6)
+	if err := unix.Bind(fd, src); err != nil {
+		return err
+	}
+
+	dest := &unix.SockaddrInet6{ZoneId: uint32(ifIndex)}
+	copy(dest.Addr[:], ip6AllNodesAddr)
+	return unix.Sendto(fd, unsolicitedNAMessage(hardwareAddr, ip6), 0, dest)
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultAddrCountWarnInterval = time.Minute
+
+func (m *InterfaceMonitor) addrCountWarnInterval() time.Duration {
+	if m.AddrCountWarnInterval <= 0 {
+		return defaultAddrCountWarnInterval
+	}
+	return m.AddrCountWarnInterval
+}
+
+// addrCountClearThreshold is the address count at or below which we clear the flag on an
+// interface.  It's lower than the threshold so that an interface with a count hovering around
+// the threshold doesn't flap.
+func (m *InterfaceMonitor) addrCountClearThreshold() int {
+	return m.AddrCountThreshold * 9 / 10
+}
+
+// checkAddrCount is called whenever an interface's addresses change.  The set keeps its own
+// count so this is cheap.
+func (m *InterfaceMonitor) checkAddrCount(ifIndex int) {
+	if m.AddrCountThreshold <= 0 {
+		return
+	}
+	addrs := m.ifaceAddrs[ifIndex]
+	if addrs == nil {
+		m.forgetAddrCount(ifIndex)
+		return
+	}
+	numAddrs := addrs.Len()
+	logCxt := log.WithFields(log.Fields{
+		"ifaceName": m.ifaceName[ifIndex],
+		"numAddrs":  numAddrs,
+		"threshold": m.AddrCountThreshold,
+	})
+	if m.tooManyAddrs[ifIndex] {
+		if numAddrs <= m.addrCountClearThreshold() {
+			logCxt.Info("Interface's address count is back below the threshold.")
+			delete(m.tooManyAddrs, ifIndex)
+		} else if numAddrs > m.AddrCountThreshold {
+			// Still growing (or shrinking slowly); remind the user now and then.
+			m.maybeWarnAddrCount(ifIndex, logCxt)
+		}
+		return
+	}
+	if numAddrs <= m.AddrCountThreshold {
+		return
+	}
+	m.tooManyAddrs[ifIndex] = true
+	m.metrics.addrCountThresholdCrossings.Inc()
+	m.maybeWarnAddrCount(ifIndex, logCxt)
+}
+
+func (m *InterfaceMonitor) maybeWarnAddrCount(ifIndex int, logCxt *log.Entry) {
+	now := m.time.Now()
+	if last, ok := m.addrCountWarnedAt[ifIndex]; ok && now.Sub(last) < m.addrCountWarnInterval() {
+		return
+	}
+	m.addrCountWarnedAt[ifIndex] = now
+	logCxt.Warn("Interface has an unusually large number of addresses; they may be leaking.")
+}
+
+// forgetAddrCount is called when an interface is removed.
+func (m *InterfaceMonitor) forgetAddrCount(ifIndex int) {
+	delete(m.tooManyAddrs, ifIndex)
+	delete(m.addrCountWarnedAt, ifIndex)
+}
@@ -0,0 +1,164 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ifacemonitor/testutils"
+	"github.com/projectcalico/felix/timeshim/mocktime"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Address count threshold", func() {
+	var nl *netlinkTest
+	var mockTime *mocktime.MockTime
+	var im *ifacemonitor.InterfaceMonitor
+	var recorder *testutils.Recorder
+	var logHook *logtest.Hook
+	var oldHooks log.LevelHooks
+	var registry *prometheus.Registry
+
+	crossings := func() float64 {
+		families, err := registry.Gather()
+		Expect(err).NotTo(HaveOccurred())
+		for _, family := range families {
+			if family.GetName() == "felix_iface_monitor_addr_count_threshold_crossings" {
+				return family.GetMetric()[0].GetCounter().GetValue()
+			}
+		}
+		return 0
+	}
+	warnings := func() (count int) {
+		for _, entry := range logHook.AllEntries() {
+			if entry.Level == log.WarnLevel && entry.Data["ifaceName"] == "cali1" {
+				count++
+			}
+		}
+		return
+	}
+	tooManyAddrs := func(name string) bool {
+		for _, status := range im.Interfaces() {
+			if status.Name == name {
+				return status.TooManyAddrs
+			}
+		}
+		return false
+	}
+	// setNumAddrs adds or removes addresses on cali1 until it has n of them.
+	numAddrs := 0
+	setNumAddrs := func(n int) {
+		for ; numAddrs < n; numAddrs++ {
+			nl.addAddr("cali1", fmt.Sprintf("10.0.1.%d/32", numAddrs+1))
+		}
+		for ; numAddrs > n; numAddrs-- {
+			nl.delAddr("cali1", fmt.Sprintf("10.0.1.%d/32", numAddrs))
+		}
+		Eventually(func() int {
+			for _, status := range im.Interfaces() {
+				if status.Name == "cali1" {
+					return len(status.Addrs)
+				}
+			}
+			return -1
+		}).Should(Equal(n))
+	}
+
+	BeforeEach(func() {
+		registry = prometheus.NewRegistry()
+		oldHooks = log.StandardLogger().ReplaceHooks(log.LevelHooks{})
+		logHook = logtest.NewGlobal()
+		numAddrs = 0
+		mockTime = mocktime.New()
+		im, nl, recorder = startMonitor(ifacemonitor.Config{
+			AddrCountThreshold: 10,
+			Registerer:         registry,
+		}, func(nl *netlinkTest, im *ifacemonitor.InterfaceMonitor) {
+			setLinkNoSignal(nl, "eth0", "up")
+			setLinkNoSignal(nl, "cali1", "up")
+		}, withMonitorOps(ifacemonitor.WithMonitorTimeShim(mockTime)))
+		recorder.ExpectState("cali1", ifacemonitor.StateUp)
+	})
+
+	AfterEach(func() {
+		im.Stop()
+		log.StandardLogger().ReplaceHooks(oldHooks)
+	})
+
+	It("should flag an interface that crosses the threshold and clear it once it recovers", func() {
+		setNumAddrs(10)
+		Expect(tooManyAddrs("cali1")).To(BeFalse())
+		Expect(crossings()).To(BeZero())
+
+		setNumAddrs(11)
+		Expect(tooManyAddrs("cali1")).To(BeTrue())
+		Expect(tooManyAddrs("eth0")).To(BeFalse())
+		Expect(crossings()).To(Equal(1.0))
+		Expect(warnings()).To(Equal(1))
+
+		// Hovering around the threshold doesn't clear the flag or count more crossings.
+		setNumAddrs(10)
+		setNumAddrs(11)
+		setNumAddrs(10)
+		Expect(tooManyAddrs("cali1")).To(BeTrue())
+		Expect(crossings()).To(Equal(1.0))
+		Expect(warnings()).To(Equal(1))
+
+		setNumAddrs(9)
+		Expect(tooManyAddrs("cali1")).To(BeFalse())
+	})
+
+	It("should rate limit the warnings", func() {
+		setNumAddrs(11)
+		setNumAddrs(9)
+		setNumAddrs(11)
+		Expect(crossings()).To(Equal(2.0))
+		Expect(warnings()).To(Equal(1))
+
+		// Still growing after the interval, so we warn again.
+		mockTime.IncrementTime(time.Minute)
+		setNumAddrs(12)
+		Expect(warnings()).To(Equal(2))
+	})
+
+	It("should reset when the interface is deleted", func() {
+		setNumAddrs(11)
+		Expect(warnings()).To(Equal(1))
+
+		nl.delLink("cali1")
+		recorder.ExpectState("cali1", ifacemonitor.StateDown)
+		setLinkNoSignal(nl, "cali1", "up")
+		nl.signalLink("cali1", 0)
+		recorder.ExpectState("cali1", ifacemonitor.StateUp)
+		Expect(tooManyAddrs("cali1")).To(BeFalse())
+
+		// The new interface's warning isn't held back by the old one's.
+		numAddrs = 0
+		setNumAddrs(11)
+		Expect(tooManyAddrs("cali1")).To(BeTrue())
+		Expect(crossings()).To(Equal(2.0))
+		Expect(warnings()).To(Equal(2))
+	})
+})
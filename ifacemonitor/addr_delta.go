@@ -0,0 +1,65 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"sort"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+// AddrDeltaCallback is called with the addresses that have been added to and removed from an
+// interface since the last call for it.  Each slice is sorted and either may be empty, but not
+// both.  When an interface goes, all its addresses are reported as removed.
+type AddrDeltaCallback func(ifaceName string, added, removed []string)
+
+// notifyAddrDelta works out what has changed since we last called the AddrDeltaCallback for the
+// interface and calls it if anything has.  addrs is a copy of what we've just given to the
+// AddrCallback, so the two callbacks always agree, whether the change came from an update or a
+// resync.  We keep addrs.
+func (m *InterfaceMonitor) notifyAddrDelta(ifaceName string, addrs set.Set) {
+	if m.AddrDeltaCallback == nil {
+		return
+	}
+	old := m.deltaAddrs[ifaceName]
+	var added, removed []string
+	if addrs != nil {
+		addrs.Iter(func(item interface{}) error {
+			if old == nil || !old.Contains(item) {
+				added = append(added, item.(string))
+			}
+			return nil
+		})
+		m.deltaAddrs[ifaceName] = addrs
+	} else {
+		delete(m.deltaAddrs, ifaceName)
+	}
+	if old != nil {
+		old.Iter(func(item interface{}) error {
+			if addrs == nil || !addrs.Contains(item) {
+				removed = append(removed, item.(string))
+			}
+			return nil
+		})
+	}
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	m.AddrDeltaCallback(ifaceName, added, removed)
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"strings"
+	"time"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ifacemonitor/testutils"
+
+	. "github.com/onsi/ginkgo"
+)
+
+var _ = Describe("Address deltas", func() {
+	var nl *netlinkTest
+	var resyncC chan time.Time
+	var im *ifacemonitor.InterfaceMonitor
+	var recorder *testutils.Recorder
+
+	BeforeEach(func() {
+		resyncC = make(chan time.Time)
+		rec := testutils.NewRecorder()
+		im, nl, recorder = startMonitor(ifacemonitor.Config{}, func(nl *netlinkTest, im *ifacemonitor.InterfaceMonitor) {
+			setLinkNoSignal(nl, "eth0", "up", "10.0.0.1/32", "10.0.0.2/32")
+			im.StateCallback = func(ifaceName string, state ifacemonitor.State, ifIndex int) {}
+			im.AddrCallback = func(ifaceName string, addrs set.Set) {
+				// The delta callback mustn't be affected by what the AddrCallback does
+				// to its set.
+				if addrs != nil {
+					addrs.Add("10.9.9.9")
+				}
+			}
+			im.AddrDeltaCallback = func(ifaceName string, added, removed []string) {
+				rec.RecordOther(ifaceName, "+[%s] -[%s]", strings.Join(added, " "), strings.Join(removed, " "))
+			}
+		}, withResyncC(resyncC), withRecorder(rec))
+		recorder.ExpectSequence(testutils.OtherEvent("eth0", "+[10.0.0.1 10.0.0.2] -[]"))
+	})
+
+	AfterEach(func() {
+		im.Stop()
+	})
+
+	setAddrsNoSignal := func(name string, addrs ...string) {
+		nl.linksMutex.Lock()
+		defer nl.linksMutex.Unlock()
+		link := nl.links[name]
+		link.addrs = set.New()
+		for _, addr := range addrs {
+			link.addrs.Add(addr)
+		}
+		nl.links[name] = link
+	}
+
+	It("should report single adds and removes from updates", func() {
+		nl.addAddr("eth0", "10.0.0.3/32")
+		recorder.ExpectSequence(testutils.OtherEvent("eth0", "+[10.0.0.3] -[]"))
+		nl.delAddr("eth0", "10.0.0.1/32")
+		recorder.ExpectSequence(testutils.OtherEvent("eth0", "+[] -[10.0.0.1]"))
+		recorder.ExpectNoNewEvents()
+	})
+
+	It("should report several adds and removes that a resync finds in one call", func() {
+		setAddrsNoSignal("eth0", "10.0.0.2/32", "10.0.0.3/32", "10.0.0.4/32")
+		resyncC <- time.Time{}
+		recorder.ExpectSequence(testutils.OtherEvent("eth0", "+[10.0.0.3 10.0.0.4] -[10.0.0.1]"))
+		resyncC <- time.Time{}
+		recorder.ExpectNoNewEvents()
+	})
+
+	It("should report all the addresses as removed when the interface goes", func() {
+		nl.addLink("eth1")
+		nl.addAddr("eth1", "10.0.1.1/32")
+		recorder.ExpectSequence(testutils.OtherEvent("eth1", "+[10.0.1.1] -[]"))
+		nl.delLink("eth0")
+		recorder.ExpectSequence(testutils.OtherEvent("eth0", "+[] -[10.0.0.1 10.0.0.2]"))
+		recorder.ExpectNoNewEvents()
+
+		// If it comes back, its addresses are new again.
+		setLinkNoSignal(nl, "eth0", "up", "10.0.0.1/32")
+		resyncC <- time.Time{}
+		recorder.ExpectSequence(testutils.OtherEvent("eth0", "+[10.0.0.1] -[]"))
+	})
+
+	It("should report a flap of an address that it sees", func() {
+		// Not back to back, or the update filter would squash the delete.
+		nl.delAddr("eth0", "10.0.0.1/32")
+		recorder.ExpectSequence(testutils.OtherEvent("eth0", "+[] -[10.0.0.1]"))
+		nl.addAddr("eth0", "10.0.0.1/32")
+		recorder.ExpectSequence(testutils.OtherEvent("eth0", "+[10.0.0.1] -[]"))
+		resyncC <- time.Time{}
+		recorder.ExpectNoNewEvents()
+	})
+
+	It("should report nothing for a flap that only happened between resyncs", func() {
+		setAddrsNoSignal("eth0", "10.0.0.2/32")
+		setAddrsNoSignal("eth0", "10.0.0.1/32", "10.0.0.2/32")
+		resyncC <- time.Time{}
+		resyncC <- time.Time{}
+		recorder.ExpectNoNewEvents()
+	})
+})
@@ -0,0 +1,34 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"net"
+)
+
+// isExcludedAddr returns true if we should ignore the given address altogether; see
+// Config.ExcludeLinkLocalAddrs and Config.ExcludeLoopbackAddrs.  Excluded addresses are never
+// stored, so they can't cause a notification.
+func (m *InterfaceMonitor) isExcludedAddr(ip net.IP) bool {
+	switch {
+	case m.ExcludeLoopbackAddrs && ip.IsLoopback():
+		return true
+	case m.ExcludeLinkLocalAddrs && ip.IsLinkLocalUnicast():
+		return true
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"time"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ifacemonitor/testutils"
+
+	. "github.com/onsi/ginkgo"
+)
+
+var _ = Describe("Address exclusions", func() {
+	var nl *netlinkTest
+	var resyncC chan time.Time
+	var im *ifacemonitor.InterfaceMonitor
+	var recorder *testutils.Recorder
+
+	BeforeEach(func() {
+		resyncC = make(chan time.Time)
+		im, nl, recorder = startMonitor(ifacemonitor.Config{
+			ExcludeLinkLocalAddrs: true,
+			ExcludeLoopbackAddrs:  true,
+		}, func(nl *netlinkTest, im *ifacemonitor.InterfaceMonitor) {
+			setLinkNoSignal(nl, "eth0", "up", "10.0.0.1/32", "fe80::1/64")
+			setLinkNoSignal(nl, "eth1", "up", "127.0.0.2/8")
+		}, withResyncC(resyncC))
+		recorder.ExpectAddrs("eth0", "10.0.0.1")
+		recorder.ExpectState("eth0", ifacemonitor.StateUp)
+		recorder.ExpectAddrs("eth1")
+		recorder.ExpectState("eth1", ifacemonitor.StateUp)
+		recorder.NewEvents()
+	})
+
+	AfterEach(func() {
+		im.Stop()
+	})
+
+	It("should never report link-local or loopback addresses", func() {
+		nl.addAddr("eth0", "fe80::2/64")
+		nl.addAddr("eth0", "169.254.0.1/32")
+		nl.delAddr("eth0", "fe80::1/64")
+		nl.addAddr("eth1", "::1/128")
+		resyncC <- time.Time{}
+		resyncC <- time.Time{}
+		recorder.ExpectNoNewEvents()
+
+		nl.addAddr("eth0", "fd00::1/64")
+		recorder.ExpectAddrs("eth0", "10.0.0.1", "fd00::1")
+	})
+})
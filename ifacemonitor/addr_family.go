@@ -0,0 +1,134 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"net"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+// UnexpectedAddrFamilyCallback is called when an interface that is configured to carry only one
+// IP family (see Config.IPv4OnlyInterfaces and Config.IPv6OnlyInterfaces) gets an address of
+// the other family.  family is netlink.FAMILY_V4 or netlink.FAMILY_V6.
+type UnexpectedAddrFamilyCallback func(ifaceName string, addr string, family int)
+
+// FamilyAddrCallback is called with the addresses of one IP family of an interface.  family is
+// netlink.FAMILY_V4 or netlink.FAMILY_V6.  addrs is nil if the interface has gone.
+type FamilyAddrCallback func(ifaceName string, family int, addrs set.Set)
+
+var addrFamilies = [2]int{netlink.FAMILY_V4, netlink.FAMILY_V6}
+
+// SetFamilyAddrCallback sets a callback that gets each interface's addresses split by IP family,
+// in place of the AddrCallback.  The first time that an interface's addresses are reported, the
+// callback is made for both families, even if one of them is empty, so that the consumer can
+// clear any stale state; after that, it's only made for a family whose addresses have changed.
+// When the interface goes, it's made with nil addrs for both families.  Must be called before
+// MonitorInterfaces.
+func (m *InterfaceMonitor) SetFamilyAddrCallback(callback FamilyAddrCallback) {
+	m.AddrCallback = func(ifaceName string, addrs set.Set) {
+		old := m.familyAddrs[ifaceName]
+		if addrs == nil {
+			if old == nil {
+				return
+			}
+			delete(m.familyAddrs, ifaceName)
+			for _, family := range addrFamilies {
+				callback(ifaceName, family, nil)
+			}
+			return
+		}
+		byFamily := map[int]set.Set{
+			netlink.FAMILY_V4: set.New(),
+			netlink.FAMILY_V6: set.New(),
+		}
+		addrs.Iter(func(item interface{}) error {
+			addr := item.(string)
+			ip := addr
+			if i := strings.IndexByte(ip, '%'); i >= 0 {
+				// Strip the zone of a link-local address; see LinkLocalAddrZones.
+				ip = ip[:i]
+			}
+			if parsed := net.ParseIP(ip); parsed != nil {
+				byFamily[addrFamily(parsed)].Add(addr)
+			}
+			return nil
+		})
+		m.familyAddrs[ifaceName] = byFamily
+		for _, family := range addrFamilies {
+			if old != nil && old[family].Equals(byFamily[family]) {
+				continue
+			}
+			callback(ifaceName, family, byFamily[family].Copy())
+		}
+	}
+}
+
+func addrFamily(addr net.IP) int {
+	if addr.To4() != nil {
+		return netlink.FAMILY_V4
+	}
+	return netlink.FAMILY_V6
+}
+
+func matchesAny(exps []*regexp.Regexp, ifaceName string) bool {
+	for _, exp := range exps {
+		if exp.MatchString(ifaceName) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAddrFamily flags a newly-seen address if its family isn't expected on the interface.
+// IPv6 link-local addresses are ignored since the kernel assigns them automatically to every
+// interface that has IPv6 enabled.  The address is still passed to the AddrCallback as normal.
+func (m *InterfaceMonitor) checkAddrFamily(ifIndex int, addrStr string) {
+	if len(m.IPv4OnlyInterfaces) == 0 && len(m.IPv6OnlyInterfaces) == 0 {
+		return
+	}
+	ifaceName, known := m.ifaceName[ifIndex]
+	if !known {
+		return
+	}
+	addr := net.ParseIP(addrStr)
+	if addr == nil || addr.IsLinkLocalUnicast() {
+		return
+	}
+	family := addrFamily(addr)
+	var unexpected bool
+	if family == netlink.FAMILY_V6 {
+		unexpected = matchesAny(m.IPv4OnlyInterfaces, ifaceName)
+	} else {
+		unexpected = matchesAny(m.IPv6OnlyInterfaces, ifaceName)
+	}
+	if !unexpected {
+		return
+	}
+	log.WithFields(log.Fields{
+		"ifaceName": ifaceName,
+		"addr":      addrStr,
+	}).Warn("Interface has an address of an unexpected IP family.")
+	if m.UnexpectedAddrFamilyCallback != nil {
+		m.UnexpectedAddrFamilyCallback(ifaceName, addrStr, family)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Per-family address callback", func() {
+	var nl *netlinkTest
+	var im *ifacemonitor.InterfaceMonitor
+	var updates chan string
+
+	BeforeEach(func() {
+		updates = make(chan string, 10)
+		im, nl, _ = startMonitor(ifacemonitor.Config{}, func(nl *netlinkTest, im *ifacemonitor.InterfaceMonitor) {
+			setLinkNoSignal(nl, "eth0", "up", "10.0.0.1/32", "fe80::1/64")
+			im.StateCallback = func(ifaceName string, state ifacemonitor.State, ifIndex int) {}
+			im.SetFamilyAddrCallback(func(ifaceName string, family int, addrs set.Set) {
+				familyName := "v4"
+				if family == netlink.FAMILY_V6 {
+					familyName = "v6"
+				}
+				if addrs == nil {
+					updates <- fmt.Sprintf("%s %s gone", ifaceName, familyName)
+					return
+				}
+				var sorted []string
+				addrs.Iter(func(item interface{}) error {
+					sorted = append(sorted, item.(string))
+					return nil
+				})
+				sort.Strings(sorted)
+				updates <- fmt.Sprintf("%s %s %v", ifaceName, familyName, sorted)
+			})
+		})
+		Eventually(updates).Should(Receive(Equal("eth0 v4 [10.0.0.1]")))
+		Eventually(updates).Should(Receive(Equal("eth0 v6 [fe80::1]")))
+	})
+
+	AfterEach(func() {
+		im.Stop()
+	})
+
+	It("should report both families for a new interface, even if one is empty", func() {
+		nl.addLinkNoSignal("cali1")
+		nl.linksMutex.Lock()
+		nl.links["cali1"].addrs.Add("fe80::2/64")
+		nl.linksMutex.Unlock()
+		nl.signalLink("cali1", 0)
+		Eventually(updates).Should(Receive(Equal("cali1 v4 []")))
+		Eventually(updates).Should(Receive(Equal("cali1 v6 [fe80::2]")))
+	})
+
+	It("should only report the family that changed", func() {
+		nl.addAddr("eth0", "fd00::1/64")
+		Eventually(updates).Should(Receive(Equal("eth0 v6 [fd00::1 fe80::1]")))
+		Consistently(updates, "50ms", "5ms").ShouldNot(Receive())
+
+		nl.delLink("eth0")
+		Eventually(updates).Should(Receive(Equal("eth0 v4 gone")))
+		Eventually(updates).Should(Receive(Equal("eth0 v6 gone")))
+	})
+})
@@ -0,0 +1,53 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+func (m *InterfaceMonitor) flushAddrsEnabled() bool {
+	return m.FlushAddrs || m.FlushAddrsOnDown
+}
+
+// flushAddrsOnDown reports an empty set of addresses for an interface that has just gone down,
+// if FlushAddrsOnDown is set.  Until unflushAddrs, notifyIfaceAddrs holds back changes to the
+// interface's addresses.
+func (m *InterfaceMonitor) flushAddrsOnDown(ifIndex int) {
+	if !m.FlushAddrsOnDown || m.DisableAddrMonitoring || m.addrsFlushed[ifIndex] {
+		return
+	}
+	name := m.ifaceName[ifIndex]
+	if m.isExcludedInterface(name) || m.ifaceAddrs[ifIndex] == nil {
+		return
+	}
+	log.WithField("ifaceName", name).Debug("Interface down, flushing addresses.")
+	m.sendAddrs(name, ifIndex, set.New())
+	m.addrsFlushed[ifIndex] = true
+}
+
+// unflushAddrs reports the current addresses of an interface that has come back up after
+// flushAddrsOnDown.
+func (m *InterfaceMonitor) unflushAddrs(ifIndex int) {
+	if !m.addrsFlushed[ifIndex] {
+		return
+	}
+	delete(m.addrsFlushed, ifIndex)
+	m.notifyIfaceAddrs(ifIndex)
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ifacemonitor/testutils"
+
+	. "github.com/onsi/ginkgo"
+)
+
+var _ = Describe("Address flushing", func() {
+	var nl *netlinkTest
+	var im *ifacemonitor.InterfaceMonitor
+	var recorder *testutils.Recorder
+
+	start := func(config ifacemonitor.Config) {
+		im, nl, recorder = startMonitor(config, func(nl *netlinkTest, im *ifacemonitor.InterfaceMonitor) {
+			setLinkNoSignal(nl, "eth0", "up", "10.0.0.1/32", "fd00::1/128")
+		})
+		recorder.ExpectSequence(
+			testutils.StateEvent("eth0", ifacemonitor.StateUp),
+			testutils.AddrsEvent("eth0", "10.0.0.1", "fd00::1"),
+		)
+	}
+
+	AfterEach(func() {
+		im.Stop()
+	})
+
+	It("should flush the addresses before reporting that an interface has gone", func() {
+		start(ifacemonitor.Config{FlushAddrs: true})
+		nl.changeLinkState("eth0", "down")
+		recorder.ExpectSequence(testutils.StateEvent("eth0", ifacemonitor.StateDown))
+		nl.delLink("eth0")
+		recorder.ExpectSequence(
+			testutils.AddrsEvent("eth0"),
+			testutils.AddrsGoneEvent("eth0"),
+		)
+		recorder.ExpectNoNewEvents()
+	})
+
+	It("should flush the addresses when an interface goes down, if configured", func() {
+		start(ifacemonitor.Config{FlushAddrsOnDown: true})
+		nl.changeLinkState("eth0", "down")
+		recorder.ExpectSequence(
+			testutils.StateEvent("eth0", ifacemonitor.StateDown),
+			testutils.AddrsEvent("eth0"),
+		)
+
+		// Changes are held back while the interface is down.  The deletion is damped, so wait
+		// for longer than that to make sure that the monitor has seen it...
+		nl.addAddr("eth0", "10.0.0.2/32")
+		nl.delAddr("eth0", "fd00::1/128")
+		recorder.QuietPeriod = 3 * ifacemonitor.FlapDampingDelay
+		recorder.ExpectNoNewEvents()
+		recorder.QuietPeriod = 0
+
+		// ...and the current addresses are reported when it comes back up.
+		nl.changeLinkState("eth0", "up")
+		recorder.ExpectSequence(
+			testutils.StateEvent("eth0", ifacemonitor.StateUp),
+			testutils.AddrsEvent("eth0", "10.0.0.1", "10.0.0.2"),
+		)
+
+		// Deleting an interface that's already been flushed doesn't flush again.
+		nl.changeLinkState("eth0", "down")
+		recorder.ExpectSequence(
+			testutils.StateEvent("eth0", ifacemonitor.StateDown),
+			testutils.AddrsEvent("eth0"),
+		)
+		nl.delLink("eth0")
+		recorder.ExpectSequence(testutils.AddrsGoneEvent("eth0"))
+		recorder.ExpectNoNewEvents()
+	})
+
+	It("should flush the addresses of an interface that is deleted while up", func() {
+		start(ifacemonitor.Config{FlushAddrsOnDown: true})
+		nl.delLink("eth0")
+		recorder.ExpectSequence(
+			testutils.AddrsEvent("eth0"),
+			testutils.AddrsGoneEvent("eth0"),
+			testutils.StateEvent("eth0", ifacemonitor.StateDown),
+		)
+		recorder.ExpectNoNewEvents()
+	})
+
+	It("should not flush by default", func() {
+		start(ifacemonitor.Config{})
+		nl.delLink("eth0")
+		recorder.ExpectSequence(
+			testutils.AddrsGoneEvent("eth0"),
+			testutils.StateEvent("eth0", ifacemonitor.StateDown),
+		)
+		recorder.ExpectNoNewEvents()
+	})
+})
@@ -0,0 +1,95 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+// AddrPrefixCallback is called with the addresses of an interface in CIDR form, such as
+// "10.0.0.1/24", for consumers that need the prefix lengths, which the AddrCallback's bare
+// addresses don't have.  An address that the interface has with more than one prefix length
+// appears once for each.  The set is empty when the interface no longer has any addresses.
+type AddrPrefixCallback func(ifaceName string, cidrs set.Set)
+
+// refreshAddrPrefixes re-reads the addresses of an interface, with their prefix lengths, and
+// notifies the AddrPrefixCallback if they changed.  Called whenever the interface's addresses
+// change and when its link is listed.  The local routes that we use to track addresses are all
+// /32 or /128, and adding an address that the interface already has, with another prefix
+// length, doesn't add one; only the next resync notices that.
+func (m *InterfaceMonitor) refreshAddrPrefixes(ifIndex int) {
+	if m.AddrPrefixCallback == nil {
+		return
+	}
+	ifaceName, known := m.ifaceName[ifIndex]
+	if !known {
+		return
+	}
+	newCIDRs := set.New()
+	if addrs := m.ifaceAddrs[ifIndex]; addrs != nil {
+		link := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: ifaceName, Index: ifIndex}}
+		for _, family := range [2]int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+			nlAddrs, err := m.netlinkStub.AddrList(link, family)
+			if err != nil {
+				log.WithError(err).Warn("Netlink address list operation failed.")
+				return
+			}
+			for _, addr := range nlAddrs {
+				// Only report the addresses that the AddrCallback has, so that the two
+				// agree; for example, tentative addresses are skipped.
+				if addr.IPNet == nil || !addrs.Contains(addr.IP.String()) {
+					continue
+				}
+				newCIDRs.Add(addr.IPNet.String())
+			}
+		}
+	}
+	m.storeAndNotifyAddrPrefixes(ifIndex, ifaceName, newCIDRs)
+}
+
+// storeAndNotifyAddrPrefixes notifies the AddrPrefixCallback if the interface's CIDRs have
+// changed.  nil means that the interface has no addresses.
+func (m *InterfaceMonitor) storeAndNotifyAddrPrefixes(ifIndex int, ifaceName string, newCIDRs set.Set) {
+	if m.AddrPrefixCallback == nil {
+		return
+	}
+	if newCIDRs == nil {
+		newCIDRs = set.New()
+	}
+	oldCIDRs := m.addrPrefixes[ifIndex]
+	if oldCIDRs == nil {
+		oldCIDRs = set.New()
+	}
+	if oldCIDRs.Equals(newCIDRs) {
+		return
+	}
+	if newCIDRs.Len() == 0 {
+		delete(m.addrPrefixes, ifIndex)
+	} else {
+		m.addrPrefixes[ifIndex] = newCIDRs
+	}
+	log.WithFields(log.Fields{
+		"ifaceName": ifaceName,
+		"cidrs":     newCIDRs,
+	}).Info("Interface address prefixes changed.")
+
+	// Take a copy, so that the callback's set is independent of ours.
+	m.AddrPrefixCallback(ifaceName, newCIDRs.Copy())
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ifacemonitor/testutils"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Address prefix callback", func() {
+	var nl *netlinkTest
+	var resyncC chan time.Time
+	var im *ifacemonitor.InterfaceMonitor
+	var recorder *testutils.Recorder
+	var prefixC chan string
+
+	BeforeEach(func() {
+		resyncC = make(chan time.Time)
+		prefixC = make(chan string, 10)
+		im, nl, recorder = startMonitor(ifacemonitor.Config{}, func(nl *netlinkTest, im *ifacemonitor.InterfaceMonitor) {
+			setLinkNoSignal(nl, "eth0", "up", "10.0.0.1/24")
+			im.AddrPrefixCallback = func(ifaceName string, cidrs set.Set) {
+				var sorted []string
+				cidrs.Iter(func(item interface{}) error {
+					sorted = append(sorted, item.(string))
+					return nil
+				})
+				sort.Strings(sorted)
+				prefixC <- fmt.Sprintf("%s %v", ifaceName, sorted)
+			}
+		}, withResyncC(resyncC))
+		Eventually(prefixC).Should(Receive(Equal("eth0 [10.0.0.1/24]")))
+	})
+
+	AfterEach(func() {
+		im.Stop()
+	})
+
+	It("should report address changes with their prefix lengths", func() {
+		nl.addAddr("eth0", "fd00::1/64")
+		Eventually(prefixC).Should(Receive(Equal("eth0 [10.0.0.1/24 fd00::1/64]")))
+		recorder.ExpectAddrs("eth0", "10.0.0.1", "fd00::1")
+
+		nl.delLink("eth0")
+		Eventually(prefixC).Should(Receive(Equal("eth0 []")))
+	})
+
+	It("should pick up the same address with another prefix length on resync", func() {
+		nl.addAddr("eth0", "10.0.0.1/16")
+		Consistently(prefixC, "50ms", "5ms").ShouldNot(Receive())
+
+		resyncC <- time.Time{}
+		Eventually(prefixC).Should(Receive(Equal("eth0 [10.0.0.1/16 10.0.0.1/24]")))
+		recorder.ExpectAddrs("eth0", "10.0.0.1")
+
+		// Nothing to report on the next resync.
+		resyncC <- time.Time{}
+		resyncC <- time.Time{}
+		Consistently(prefixC, "50ms", "5ms").ShouldNot(Receive())
+	})
+})
@@ -0,0 +1,66 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// updateAltNames re-reads the alternative names of an interface.  oldName is the interface's
+// previous primary name (empty if it's new).  If the change means that the interface is now
+// excluded, we send the same address callback as if it had been removed; if it's no longer
+// excluded, the caller's usual address listing reports its addresses as if it were new.
+func (m *InterfaceMonitor) updateAltNames(ifIndex int, oldName, ifaceName string) {
+	if !m.MatchAltNames {
+		return
+	}
+	altNames, err := m.netlinkStub.LinkAltNames(ifIndex)
+	if err != nil {
+		// Most likely the interface has just gone; keep what we had.
+		log.WithError(err).WithField("ifaceName", ifaceName).Warn("Failed to read interface altnames.")
+		return
+	}
+	sort.Strings(altNames)
+
+	wasExcluded := oldName != "" && m.isExcludedInterface(oldName)
+	delete(m.altNames, oldName)
+	if len(altNames) > 0 {
+		m.altNames[ifaceName] = altNames
+	} else {
+		delete(m.altNames, ifaceName)
+	}
+	if oldName == "" {
+		return
+	}
+	isExcluded := m.isExcludedInterface(ifaceName)
+	if isExcluded == wasExcluded {
+		return
+	}
+	log.WithFields(log.Fields{
+		"ifaceName":  ifaceName,
+		"altNames":   altNames,
+		"isExcluded": isExcluded,
+	}).Info("Change to interface altnames changed whether it is excluded.")
+	if isExcluded && m.ifaceAddrs[ifIndex] != nil && !m.DisableAddrMonitoring {
+		delete(m.ifaceAddrs, ifIndex)
+		m.notifyAddrs(oldName, ifIndex, nil)
+		m.storeAndNotifyPeerAddrs(ifIndex, oldName, nil)
+		m.storeAndNotifyAddrPrefixes(ifIndex, oldName, nil)
+	}
+}
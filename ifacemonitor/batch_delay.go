@@ -0,0 +1,60 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// holdForBatch is called before each StateCallback and AddrCallback notification.  If
+// Config.BatchDelay is set, it starts a batch, if there isn't one already, and returns true to
+// say that the notification should be held back until the batch ends.  The batch ends
+// BatchDelay after it started, so no notification is delayed by more than that, however busy
+// the interfaces are.
+func (m *InterfaceMonitor) holdForBatch() bool {
+	if m.BatchDelay <= 0 {
+		return false
+	}
+	if m.batchTimer == nil {
+		log.WithField("delay", m.BatchDelay).Debug("Starting a batch of notifications.")
+		m.batchTimer = m.time.NewTimer(m.BatchDelay)
+		m.batchTimerC = m.batchTimer.Chan()
+	}
+	return true
+}
+
+// endBatch makes the notifications held back since the batch started, coalesced in the same
+// way as on Resume, unless we're paused, in which case they're held until Resume.
+func (m *InterfaceMonitor) endBatch() {
+	if m.batchTimer == nil {
+		return
+	}
+	m.stopBatchTimer()
+	if m.paused {
+		return
+	}
+	m.deliverHeldNotifications()
+}
+
+func (m *InterfaceMonitor) stopBatchTimer() {
+	if m.batchTimer == nil {
+		return
+	}
+	m.batchTimer.Stop()
+	m.batchTimer = nil
+	m.batchTimerC = nil
+}
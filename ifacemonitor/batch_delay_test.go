@@ -0,0 +1,116 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ifacemonitor/testutils"
+	"github.com/projectcalico/felix/timeshim/mocktime"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Batch delay", func() {
+	var nl *netlinkTest
+	var im *ifacemonitor.InterfaceMonitor
+	var mockTime *mocktime.MockTime
+	var recorder *testutils.Recorder
+
+	BeforeEach(func() {
+		mockTime = mocktime.New()
+		im, nl, recorder = startMonitor(ifacemonitor.Config{BatchDelay: 50 * time.Millisecond},
+			func(nl *netlinkTest, im *ifacemonitor.InterfaceMonitor) {
+				setLinkNoSignal(nl, "cali1", "up", "10.0.0.1/32")
+			},
+			withMonitorOps(ifacemonitor.WithMonitorTimeShim(mockTime)),
+			withRecorderOps(testutils.WithTimeShim(mockTime)),
+		)
+		// Short enough that checking for no events doesn't run the clock on to the end of the
+		// batch.
+		recorder.QuietPeriod = 40 * time.Millisecond
+	})
+
+	AfterEach(func() {
+		im.Stop()
+	})
+
+	// view summarises the monitor's view of the interfaces.  Once it shows a change, the
+	// monitor has handled the update and started the batch.
+	view := func() []string {
+		var summary []string
+		for _, status := range im.Interfaces() {
+			summary = append(summary, fmt.Sprintf("%s %s %v", status.Name, status.State, status.Addrs))
+		}
+		return summary
+	}
+
+	It("should hold the start of day notifications until the end of the batch", func() {
+		Eventually(view).Should(Equal([]string{"cali1 up [10.0.0.1]"}))
+		batchStart := mockTime.Now()
+		recorder.ExpectNoNewEvents()
+
+		recorder.ExpectSequence(
+			testutils.AddrsEvent("cali1", "10.0.0.1"),
+			testutils.StateEvent("cali1", ifacemonitor.StateUp),
+		)
+		Expect(recorder.Events()[0].Time.Sub(batchStart)).To(BeNumerically(">=", 50*time.Millisecond))
+		recorder.ExpectNoNewEvents()
+	})
+
+	It("should coalesce a burst of updates", func() {
+		Eventually(view).Should(Equal([]string{"cali1 up [10.0.0.1]"}))
+		recorder.ExpectSequence(
+			testutils.AddrsEvent("cali1", "10.0.0.1"),
+			testutils.StateEvent("cali1", ifacemonitor.StateUp),
+		)
+
+		// A flap and a couple of new addresses, within one batch.
+		nl.changeLinkState("cali1", "down")
+		nl.changeLinkState("cali1", "up")
+		nl.addAddr("cali1", "10.0.0.2/32")
+		nl.addAddr("cali1", "10.0.0.3/32")
+		Eventually(view).Should(Equal([]string{"cali1 up [10.0.0.1 10.0.0.2 10.0.0.3]"}))
+		batchStart := mockTime.Now()
+		recorder.ExpectNoNewEvents()
+
+		// The flap came to nothing, and the addresses are reported once.
+		recorder.ExpectSequence(testutils.AddrsEvent("cali1", "10.0.0.1", "10.0.0.2", "10.0.0.3"))
+		Expect(recorder.Events()[2].Time.Sub(batchStart)).To(BeNumerically(">=", 50*time.Millisecond))
+		recorder.ExpectNoNewEvents()
+
+		// The next update starts a new batch.
+		nl.changeLinkState("cali1", "down")
+		Eventually(view).Should(Equal([]string{"cali1 down [10.0.0.1 10.0.0.2 10.0.0.3]"}))
+		recorder.ExpectSequence(testutils.StateEvent("cali1", ifacemonitor.StateDown))
+	})
+
+	It("should make the withdrawals straight away on StopAndWithdraw", func() {
+		Eventually(view).Should(Equal([]string{"cali1 up [10.0.0.1]"}))
+		im.StopAndWithdraw()
+		// The held notifications go out first, then the withdrawals.
+		recorder.ExpectSequence(
+			testutils.AddrsEvent("cali1", "10.0.0.1"),
+			testutils.StateEvent("cali1", ifacemonitor.StateUp),
+			testutils.StateEvent("cali1", ifacemonitor.StateDown),
+			testutils.AddrsGoneEvent("cali1"),
+		)
+	})
+})
@@ -0,0 +1,104 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// BondActiveSlaveCallback is called when the active slave of a bond changes, for example on
+// failover.  oldSlave and newSlave are interface names; either may be empty if the bond had, or
+// now has, no active slave (for example, because all its links are down).  From a slave's point
+// of view, it has become active if it is newSlave and stopped being active if it is oldSlave.
+type BondActiveSlaveCallback func(bondName, oldSlave, newSlave string)
+
+type trackedBond struct {
+	// activeSlaveIdx is the active slave's index, as last reported by the kernel; 0 if none.
+	activeSlaveIdx int
+	// notifiedIdx and notifiedName are the active slave that we last notified.
+	notifiedIdx  int
+	notifiedName string
+}
+
+// storeBondActiveSlave records the active slave of a bond (IFLA_BOND_ACTIVE_SLAVE).  The kernel
+// omits the attribute if the bond has no active slave.  The caller must follow up with
+// notifyBondActiveSlaves.
+func (m *InterfaceMonitor) storeBondActiveSlave(link netlink.Link) {
+	ifIndex := link.Attrs().Index
+	bond, isBond := link.(*netlink.Bond)
+	if !isBond {
+		delete(m.bonds, ifIndex)
+		return
+	}
+	activeSlaveIdx := bond.ActiveSlave
+	if activeSlaveIdx < 0 {
+		activeSlaveIdx = 0
+	}
+	b := m.bonds[ifIndex]
+	b.activeSlaveIdx = activeSlaveIdx
+	m.bonds[ifIndex] = b
+}
+
+// maybeNotifyBondActiveSlave notifies the BondActiveSlaveCallback if the bond's active slave
+// has changed since we last notified.  If we haven't heard about the slave yet (say, it comes
+// after the bond in a link dump), the notification is deferred until we can resolve its name.
+func (m *InterfaceMonitor) maybeNotifyBondActiveSlave(bondIdx int) {
+	b, ok := m.bonds[bondIdx]
+	if !ok || b.activeSlaveIdx == b.notifiedIdx {
+		return
+	}
+	bondName := m.ifaceName[bondIdx]
+	newSlave := ""
+	if b.activeSlaveIdx != 0 {
+		var known bool
+		newSlave, known = m.ifaceName[b.activeSlaveIdx]
+		if !known {
+			log.WithFields(log.Fields{
+				"bond":           bondName,
+				"activeSlaveIdx": b.activeSlaveIdx,
+			}).Debug("Bond's active slave not known yet.")
+			return
+		}
+	}
+	oldSlave := b.notifiedName
+	b.notifiedIdx = b.activeSlaveIdx
+	b.notifiedName = newSlave
+	m.bonds[bondIdx] = b
+
+	logCxt := log.WithFields(log.Fields{
+		"bond":     bondName,
+		"oldSlave": oldSlave,
+		"newSlave": newSlave,
+	})
+	if newSlave == "" {
+		logCxt.Warn("Bond has no active slave.")
+	} else {
+		logCxt.Info("Bond's active slave changed.")
+	}
+	if m.BondActiveSlaveCallback != nil && !m.isExcludedInterface(bondName) {
+		m.BondActiveSlaveCallback(bondName, oldSlave, newSlave)
+	}
+}
+
+// notifyBondActiveSlaves sends any pending active slave notifications, including ones that were
+// deferred because we might now know the slave's name.  Cheap when there are no bonds.
+func (m *InterfaceMonitor) notifyBondActiveSlaves() {
+	for bondIdx := range m.bonds {
+		m.maybeNotifyBondActiveSlave(bondIdx)
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+const (
+	defaultCallbackRetryAttempts = 5
+	defaultCallbackRetryInterval = 100 * time.Millisecond
+)
+
+// FallibleStateCallback and FallibleAddrCallback are alternatives to InterfaceStateCallback and
+// AddrStateCallback for consumers that can fail to handle a notification.  See
+// SetFallibleCallbacks.
+type FallibleStateCallback func(ifaceName string, ifaceState State, ifIndex int) error
+type FallibleAddrCallback func(ifaceName string, addrs set.Set) error
+
+// CallbackGiveUpCallback is called when we give up on a notification after it has failed
+// CallbackRetryAttempts times.  err is the error from the last attempt.
+type CallbackGiveUpCallback func(ifaceName string, err error)
+
+// notificationKind distinguishes the two streams of notifications for an interface; a
+// notification only supersedes a pending retry of the same kind.
+type notificationKind int
+
+const (
+	notificationState notificationKind = iota
+	notificationAddrs
+)
+
+type retryKey struct {
+	kind      notificationKind
+	ifaceName string
+}
+
+// pendingRetry is a failed notification that is waiting to be retried.
+type pendingRetry struct {
+	ifIndex     int // Only set for state notifications.
+	state       State
+	addrs       set.Set
+	attempts    int
+	nextAttempt time.Time
+}
+
+// SetFallibleCallbacks sets callbacks that can return an error, in place of the StateCallback and
+// AddrCallback.  If a callback returns an error, we retry that notification with backoff (see
+// Config.CallbackRetryAttempts and CallbackRetryInterval) while carrying on with other
+// notifications.  A newer notification of the same kind for the same interface supersedes a
+// pending retry, so the consumer never sees an interface's state go backwards.  If all the
+// attempts fail, we drop the notification and call the CallbackGiveUpCallback, if set.  Retries
+// are made from the main loop, so must be called before MonitorInterfaces.
+func (m *InterfaceMonitor) SetFallibleCallbacks(stateCallback FallibleStateCallback, addrCallback FallibleAddrCallback) {
+	m.fallibleStateCallback = stateCallback
+	m.fallibleAddrCallback = addrCallback
+	m.StateCallback = func(ifaceName string, ifaceState State, ifIndex int) {
+		m.notifyFallible(retryKey{notificationState, ifaceName}, &pendingRetry{
+			ifIndex: ifIndex,
+			state:   ifaceState,
+		})
+	}
+	m.AddrCallback = func(ifaceName string, addrs set.Set) {
+		if addrs != nil {
+			// We may need to retry later, by which time the caller may have modified the set.
+			addrs = addrs.Copy()
+		}
+		m.notifyFallible(retryKey{notificationAddrs, ifaceName}, &pendingRetry{addrs: addrs})
+	}
+}
+
+// notifyFallible makes a new notification, superseding any pending retry for the same key.
+func (m *InterfaceMonitor) notifyFallible(key retryKey, n *pendingRetry) {
+	if _, ok := m.pendingRetries[key]; ok {
+		log.WithField("ifaceName", key.ifaceName).Debug(
+			"New notification supersedes pending retry.")
+		delete(m.pendingRetries, key)
+	}
+	m.attemptNotification(key, n)
+	m.scheduleRetryTimer()
+}
+
+// attemptNotification calls the fallible callback and, if it fails, queues the notification for
+// retry or gives up on it.
+func (m *InterfaceMonitor) attemptNotification(key retryKey, n *pendingRetry) {
+	var err error
+	switch key.kind {
+	case notificationState:
+		err = m.fallibleStateCallback(key.ifaceName, n.state, n.ifIndex)
+	case notificationAddrs:
+		err = m.fallibleAddrCallback(key.ifaceName, n.addrs)
+	}
+	n.attempts++
+	logCxt := log.WithFields(log.Fields{
+		"ifaceName": key.ifaceName,
+		"attempts":  n.attempts,
+	})
+	if err == nil {
+		if n.attempts > 1 {
+			logCxt.Info("Retried notification succeeded.")
+		}
+		return
+	}
+	maxAttempts := m.CallbackRetryAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultCallbackRetryAttempts
+	}
+	if n.attempts >= maxAttempts {
+		logCxt.WithError(err).Error("Notification failed too many times, giving up.")
+		m.metrics.callbackGiveUps.Inc()
+		if m.CallbackGiveUpCallback != nil {
+			m.CallbackGiveUpCallback(key.ifaceName, err)
+		}
+		return
+	}
+	interval := m.CallbackRetryInterval
+	if interval <= 0 {
+		interval = defaultCallbackRetryInterval
+	}
+	interval <<= uint(n.attempts - 1)
+	logCxt.WithError(err).WithField("retryIn", interval).Warn("Notification failed, will retry.")
+	n.nextAttempt = m.time.Now().Add(interval)
+	m.pendingRetries[key] = n
+}
+
+// retryNotifications retries the notifications that are due, in a stable order, and reschedules
+// the timer.
+func (m *InterfaceMonitor) retryNotifications() {
+	now := m.time.Now()
+	var due []retryKey
+	for key, n := range m.pendingRetries {
+		if !n.nextAttempt.After(now) {
+			due = append(due, key)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if due[i].ifaceName != due[j].ifaceName {
+			return due[i].ifaceName < due[j].ifaceName
+		}
+		return due[i].kind < due[j].kind
+	})
+	for _, key := range due {
+		n := m.pendingRetries[key]
+		delete(m.pendingRetries, key)
+		m.attemptNotification(key, n)
+	}
+	m.scheduleRetryTimer()
+}
+
+// dropPendingRetries gives up on the pending retries, when there's no loop to make them.
+func (m *InterfaceMonitor) dropPendingRetries() {
+	if len(m.pendingRetries) > 0 {
+		log.WithField("numDropped", len(m.pendingRetries)).Warn(
+			"Not retrying failed notifications in one-shot mode.")
+	}
+	m.pendingRetries = map[retryKey]*pendingRetry{}
+	m.scheduleRetryTimer()
+}
+
+// scheduleRetryTimer (re)starts the retry timer for the earliest pending retry, or stops it if
+// there are none.
+func (m *InterfaceMonitor) scheduleRetryTimer() {
+	if m.retryTimer != nil {
+		m.retryTimer.Stop()
+		m.retryTimer = nil
+		m.retryTimerC = nil
+	}
+	var earliest time.Time
+	for _, n := range m.pendingRetries {
+		if earliest.IsZero() || n.nextAttempt.Before(earliest) {
+			earliest = n.nextAttempt
+		}
+	}
+	if earliest.IsZero() {
+		return
+	}
+	m.retryTimer = m.time.NewTimer(m.time.Until(earliest))
+	m.retryTimerC = m.retryTimer.Chan()
+}
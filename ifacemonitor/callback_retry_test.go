@@ -0,0 +1,152 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/timeshim/mocktime"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Fallible callbacks", func() {
+	var nl *netlinkTest
+	var im *ifacemonitor.InterfaceMonitor
+	var mockTime *mocktime.MockTime
+	var config ifacemonitor.Config
+
+	// failing holds the names of the interfaces whose state notifications fail.
+	var failingLock sync.Mutex
+	var failing map[string]bool
+	setFailing := func(name string, fail bool) {
+		failingLock.Lock()
+		defer failingLock.Unlock()
+		failing[name] = fail
+	}
+
+	// attempts receives every state notification attempt and delivered the ones that succeed.
+	var attempts, delivered, gaveUp chan string
+
+	BeforeEach(func() {
+		mockTime = mocktime.New()
+		config = ifacemonitor.Config{
+			CallbackRetryAttempts: 3,
+			CallbackRetryInterval: time.Second,
+		}
+		failing = map[string]bool{}
+		attempts = make(chan string, 100)
+		delivered = make(chan string, 100)
+		gaveUp = make(chan string, 100)
+	})
+
+	JustBeforeEach(func() {
+		im, nl, _ = startMonitor(config, func(nl *netlinkTest, im *ifacemonitor.InterfaceMonitor) {
+			im.SetFallibleCallbacks(
+				func(ifaceName string, state ifacemonitor.State, ifIndex int) error {
+					update := fmt.Sprintf("%s %s", ifaceName, state)
+					attempts <- update
+					failingLock.Lock()
+					defer failingLock.Unlock()
+					if failing[ifaceName] {
+						return errors.New("dataplane not ready")
+					}
+					delivered <- update
+					return nil
+				},
+				func(ifaceName string, addrs set.Set) error {
+					return nil
+				},
+			)
+			im.CallbackGiveUpCallback = func(ifaceName string, err error) {
+				gaveUp <- fmt.Sprintf("%s: %v", ifaceName, err)
+			}
+		}, withMonitorOps(ifacemonitor.WithMonitorTimeShim(mockTime)))
+	})
+
+	AfterEach(func() {
+		im.Stop()
+	})
+
+	It("should retry a failed notification until it succeeds", func() {
+		setFailing("cali1", true)
+		nl.addLink("cali1")
+		nl.changeLinkState("cali1", "up")
+		Eventually(attempts).Should(Receive(Equal("cali1 up")))
+
+		// Other interfaces are still notified while the retry is pending.
+		nl.addLink("cali2")
+		nl.changeLinkState("cali2", "up")
+		Eventually(delivered).Should(Receive(Equal("cali2 up")))
+
+		setFailing("cali1", false)
+		Eventually(mockTime.HasTimers).Should(BeTrue())
+		mockTime.IncrementTime(time.Second)
+		Eventually(delivered).Should(Receive(Equal("cali1 up")))
+		Consistently(gaveUp).ShouldNot(Receive())
+	})
+
+	It("should drop a pending retry when a newer state supersedes it", func() {
+		setFailing("cali1", true)
+		nl.addLink("cali1")
+		nl.changeLinkState("cali1", "up")
+		Eventually(attempts).Should(Receive(Equal("cali1 up")))
+
+		setFailing("cali1", false)
+		nl.changeLinkState("cali1", "down")
+		Eventually(delivered).Should(Receive(Equal("cali1 down")))
+
+		// The stale "up" must never be delivered after the "down".
+		Eventually(mockTime.HasTimers).Should(BeFalse())
+		mockTime.IncrementTime(10 * time.Second)
+		Consistently(delivered).ShouldNot(Receive())
+		Consistently(gaveUp).ShouldNot(Receive())
+	})
+
+	It("should back off and give up after the configured number of attempts", func() {
+		setFailing("cali1", true)
+		nl.addLink("cali1")
+		nl.changeLinkState("cali1", "up")
+		Eventually(attempts).Should(Receive(Equal("cali1 up")))
+
+		// First retry after 1s.
+		Eventually(mockTime.HasTimers).Should(BeTrue())
+		mockTime.IncrementTime(time.Second)
+		Eventually(attempts).Should(Receive(Equal("cali1 up")))
+
+		// Second retry after a further 2s, not 1s.
+		Eventually(mockTime.HasTimers).Should(BeTrue())
+		mockTime.IncrementTime(time.Second)
+		Consistently(attempts).ShouldNot(Receive())
+		mockTime.IncrementTime(time.Second)
+		Eventually(attempts).Should(Receive(Equal("cali1 up")))
+
+		// That was the third attempt so we give up.
+		Eventually(gaveUp).Should(Receive(Equal("cali1: dataplane not ready")))
+		Eventually(mockTime.HasTimers).Should(BeFalse())
+		mockTime.IncrementTime(time.Minute)
+		Consistently(attempts).ShouldNot(Receive())
+		Expect(delivered).NotTo(Receive())
+	})
+})
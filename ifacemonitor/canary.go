@@ -0,0 +1,197 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// CanaryIfaceName is the name of the dummy interface that the self-test toggles.  While the
+// self-test is enabled, the monitor hides the interface of this name from all its callbacks.
+const CanaryIfaceName = "felixcanary0"
+
+const defaultCanaryTimeout = 5 * time.Second
+
+// CanaryResult is the outcome of a self-test.
+type CanaryResult string
+
+const (
+	// CanaryOK means that the netlink event for the canary interface arrived in time.
+	CanaryOK CanaryResult = "ok"
+	// CanaryTimedOut means that it didn't; events may not be reaching the monitor.
+	CanaryTimedOut CanaryResult = "timed-out"
+	// CanaryUnavailable means that the canary interface couldn't be created or changed,
+	// typically for lack of CAP_NET_ADMIN.  The self-test is disabled after this result.
+	CanaryUnavailable CanaryResult = "unavailable"
+)
+
+// CanaryCallback is called with the result of each self-test.
+type CanaryCallback func(result CanaryResult)
+
+// canaryStub makes the changes to the canary interface.
+type canaryStub interface {
+	// SetLinkUp creates the dummy interface, if it doesn't exist, and sets its admin state.
+	SetLinkUp(name string, up bool) error
+	DeleteLink(name string) error
+}
+
+type canaryReal struct {
+	ns *targetNetns
+}
+
+func (c *canaryReal) SetLinkUp(name string, up bool) error {
+	return c.ns.run(func() error {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			link = &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: name}}
+			if err := netlink.LinkAdd(link); err != nil {
+				return err
+			}
+		}
+		if up {
+			return netlink.LinkSetUp(link)
+		}
+		return netlink.LinkSetDown(link)
+	})
+}
+
+func (c *canaryReal) DeleteLink(name string) error {
+	return c.ns.run(func() error {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return nil
+		}
+		return netlink.LinkDel(link)
+	})
+}
+
+func WithCanaryStub(c canaryStub) InterfaceMonitorOp {
+	return func(m *InterfaceMonitor) {
+		m.canary = c
+	}
+}
+
+func (m *InterfaceMonitor) canaryEnabled() bool {
+	return m.CanaryInterval > 0 && !m.canaryUnavailable
+}
+
+// isCanary returns true for the canary interface, which we don't report.
+func (m *InterfaceMonitor) isCanary(ifaceName string) bool {
+	return m.CanaryInterval > 0 && ifaceName == CanaryIfaceName
+}
+
+func (m *InterfaceMonitor) canaryTimeout() time.Duration {
+	if m.CanaryTimeout <= 0 {
+		return defaultCanaryTimeout
+	}
+	return m.CanaryTimeout
+}
+
+// initCanary starts the self-test, if enabled.  A canary interface left over from an earlier
+// run may already be up, which would hide the first toggle, so we remove it first.
+func (m *InterfaceMonitor) initCanary() {
+	if !m.canaryEnabled() {
+		return
+	}
+	if err := m.canary.DeleteLink(CanaryIfaceName); err != nil {
+		log.WithError(err).Warn("Failed to remove old canary interface.")
+	}
+	m.scheduleCanary()
+}
+
+func (m *InterfaceMonitor) scheduleCanary() {
+	if !m.canaryEnabled() {
+		return
+	}
+	m.canaryTimer = m.time.NewTimer(m.CanaryInterval)
+	m.canaryTimerC = m.canaryTimer.Chan()
+}
+
+// startCanary toggles the canary interface; checkCanaryUpdate then waits for the netlink event.
+func (m *InterfaceMonitor) startCanary() {
+	m.canaryTimerC = nil
+	if m.canaryPending {
+		// Still waiting for the last one, which will time out soon.
+		m.scheduleCanary()
+		return
+	}
+	wantUp := !m.canaryWantUp
+	if err := m.canary.SetLinkUp(CanaryIfaceName, wantUp); err != nil {
+		log.WithError(err).WithField("ifaceName", CanaryIfaceName).Warn(
+			"Canary unavailable, disabling interface monitor self-test.")
+		m.canaryUnavailable = true
+		m.reportCanary(CanaryUnavailable)
+		return
+	}
+	log.WithField("up", wantUp).Debug("Toggled canary interface.")
+	m.canaryWantUp = wantUp
+	m.canaryPending = true
+	m.canaryStart = m.time.Now()
+	m.canaryDeadline = m.time.NewTimer(m.canaryTimeout())
+	m.canaryDeadlineC = m.canaryDeadline.Chan()
+	m.scheduleCanary()
+}
+
+// checkCanaryUpdate is called with each netlink update for the canary interface.
+func (m *InterfaceMonitor) checkCanaryUpdate(ifaceExists bool, attrs *netlink.LinkAttrs) {
+	if !m.canaryPending || !ifaceExists {
+		return
+	}
+	if (attrs.RawFlags&syscall.IFF_UP != 0) != m.canaryWantUp {
+		return
+	}
+	log.WithField("latency", m.time.Since(m.canaryStart)).Debug("Canary event arrived.")
+	m.canaryPending = false
+	m.canaryDeadline.Stop()
+	m.canaryDeadlineC = nil
+	m.reportCanary(CanaryOK)
+}
+
+func (m *InterfaceMonitor) onCanaryDeadline() {
+	m.canaryDeadlineC = nil
+	m.canaryPending = false
+	log.WithField("timeout", m.canaryTimeout()).Warn(
+		"Netlink event for the canary interface didn't arrive in time; interface events may not be flowing.")
+	m.reportCanary(CanaryTimedOut)
+}
+
+func (m *InterfaceMonitor) reportCanary(result CanaryResult) {
+	m.metrics.canaryResults.WithLabelValues(string(result)).Inc()
+	if m.CanaryCallback != nil {
+		m.CanaryCallback(result)
+	}
+}
+
+// stopCanary stops the timers and removes the canary interface.
+func (m *InterfaceMonitor) stopCanary() {
+	if m.canaryTimer != nil {
+		m.canaryTimer.Stop()
+	}
+	if m.canaryDeadline != nil {
+		m.canaryDeadline.Stop()
+	}
+	if m.CanaryInterval <= 0 || m.canaryUnavailable {
+		return
+	}
+	if err := m.canary.DeleteLink(CanaryIfaceName); err != nil {
+		log.WithError(err).Warn("Failed to remove canary interface.")
+	}
+}
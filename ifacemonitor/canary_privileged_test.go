@@ -0,0 +1,100 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build privileged,!darwin
+
+// These tests create a real dummy interface, so they need CAP_NET_ADMIN.  Run them with:
+// sudo -E go test -tags privileged ./ifacemonitor/ -count=1 -args -ginkgo.focus=Privileged
+
+package ifacemonitor_test
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ifacemonitor/testutils"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Privileged canary self-test", func() {
+	var im *ifacemonitor.InterfaceMonitor
+	var recorder *testutils.Recorder
+	var resultsLock sync.Mutex
+	var results []ifacemonitor.CanaryResult
+	var doneC chan struct{}
+
+	getResults := func() []ifacemonitor.CanaryResult {
+		resultsLock.Lock()
+		defer resultsLock.Unlock()
+		return append([]ifacemonitor.CanaryResult(nil), results...)
+	}
+
+	BeforeEach(func() {
+		if os.Geteuid() != 0 {
+			Skip("Needs root to create the canary interface.")
+		}
+		probe := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "felixprobe0"}}
+		if err := netlink.LinkAdd(probe); err != nil {
+			Skip(fmt.Sprintf("Can't create dummy interfaces: %v", err))
+		}
+		Expect(netlink.LinkDel(probe)).To(Succeed())
+		results = nil
+		im = ifacemonitor.New(ifacemonitor.Config{
+			CanaryInterval: 200 * time.Millisecond,
+			CanaryTimeout:  2 * time.Second,
+		})
+		recorder = testutils.NewRecorder()
+		recorder.Attach(im)
+		im.CanaryCallback = func(result ifacemonitor.CanaryResult) {
+			resultsLock.Lock()
+			defer resultsLock.Unlock()
+			results = append(results, result)
+		}
+		doneC = make(chan struct{})
+		go func() {
+			defer close(doneC)
+			defer GinkgoRecover()
+			Expect(im.Run()).To(Succeed())
+		}()
+	})
+
+	AfterEach(func() {
+		if im == nil {
+			return
+		}
+		im.Stop()
+		Eventually(doneC, "5s").Should(BeClosed())
+		im = nil
+	})
+
+	It("should see its own events and then clean up", func() {
+		// Both directions of the toggle.
+		Eventually(getResults, "5s").Should(HaveLen(2))
+		Expect(getResults()).To(ConsistOf(ifacemonitor.CanaryOK, ifacemonitor.CanaryOK))
+		recorder.ExpectNoEventsFor(ifacemonitor.CanaryIfaceName)
+
+		im.Stop()
+		Eventually(doneC, "5s").Should(BeClosed())
+		im = nil
+		_, err := netlink.LinkByName(ifacemonitor.CanaryIfaceName)
+		Expect(err).To(HaveOccurred())
+	})
+})
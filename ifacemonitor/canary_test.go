@@ -0,0 +1,197 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ifacemonitor/testutils"
+	"github.com/projectcalico/felix/timeshim/mocktime"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// fakeCanary toggles the canary interface in the fake netlink.  If dropEvents is set, it
+// doesn't signal the change, as if netlink events had stopped flowing.
+type fakeCanary struct {
+	nl *netlinkTest
+
+	lock       sync.Mutex
+	err        error
+	dropEvents bool
+	toggles    int
+}
+
+func (c *fakeCanary) SetLinkUp(name string, up bool) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	c.toggles++
+	c.nl.linksMutex.Lock()
+	_, exists := c.nl.links[name]
+	c.nl.linksMutex.Unlock()
+	if !exists {
+		c.nl.addLinkNoSignal(name)
+	}
+	var flags uint32
+	if up {
+		flags = syscall.IFF_UP
+	}
+	if c.dropEvents {
+		c.nl.linksMutex.Lock()
+		link := c.nl.links[name]
+		link.extraFlags = flags
+		c.nl.links[name] = link
+		c.nl.linksMutex.Unlock()
+		return nil
+	}
+	c.nl.changeLinkFlags(name, flags, syscall.IFF_UP)
+	return nil
+}
+
+func (c *fakeCanary) DeleteLink(name string) error {
+	c.nl.linksMutex.Lock()
+	_, exists := c.nl.links[name]
+	c.nl.linksMutex.Unlock()
+	if exists {
+		c.nl.delLinkNoSignal(name)
+	}
+	return nil
+}
+
+func (c *fakeCanary) setErr(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.err = err
+}
+
+func (c *fakeCanary) setDropEvents(drop bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.dropEvents = drop
+}
+
+func (c *fakeCanary) getToggles() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.toggles
+}
+
+var _ = Describe("Canary self-test", func() {
+	var resyncC chan time.Time
+	var mockTime *mocktime.MockTime
+	var canary *fakeCanary
+	var im *ifacemonitor.InterfaceMonitor
+	var recorder *testutils.Recorder
+	var resultsLock sync.Mutex
+	var results []ifacemonitor.CanaryResult
+
+	getResults := func() []ifacemonitor.CanaryResult {
+		resultsLock.Lock()
+		defer resultsLock.Unlock()
+		return append([]ifacemonitor.CanaryResult(nil), results...)
+	}
+
+	BeforeEach(func() {
+		resyncC = make(chan time.Time)
+		mockTime = mocktime.New()
+		canary = &fakeCanary{}
+		resultsLock.Lock()
+		results = nil
+		resultsLock.Unlock()
+		config := ifacemonitor.Config{
+			CanaryInterval: 10 * time.Second,
+			CanaryTimeout:  2 * time.Second,
+		}
+		im, _, recorder = startMonitor(config, func(nl *netlinkTest, im *ifacemonitor.InterfaceMonitor) {
+			setLinkNoSignal(nl, "eth0", "up")
+			canary.nl = nl
+			im.CanaryCallback = func(result ifacemonitor.CanaryResult) {
+				resultsLock.Lock()
+				defer resultsLock.Unlock()
+				results = append(results, result)
+			}
+		}, withResyncC(resyncC), withMonitorOps(
+			ifacemonitor.WithMonitorTimeShim(mockTime),
+			ifacemonitor.WithCanaryStub(canary),
+		))
+		recorder.ExpectState("eth0", ifacemonitor.StateUp)
+		Eventually(mockTime.HasTimers).Should(BeTrue())
+	})
+
+	AfterEach(func() {
+		im.Stop()
+	})
+
+	It("should pass when the event arrives and fail when it doesn't", func() {
+		mockTime.IncrementTime(10 * time.Second)
+		Eventually(getResults).Should(Equal([]ifacemonitor.CanaryResult{ifacemonitor.CanaryOK}))
+
+		canary.setDropEvents(true)
+		mockTime.IncrementTime(10 * time.Second)
+		Eventually(canary.getToggles).Should(Equal(2))
+		mockTime.IncrementTime(time.Second)
+		Consistently(getResults, "100ms").Should(HaveLen(1))
+		mockTime.IncrementTime(time.Second)
+		Eventually(getResults).Should(Equal([]ifacemonitor.CanaryResult{
+			ifacemonitor.CanaryOK,
+			ifacemonitor.CanaryTimedOut,
+		}))
+
+		// Events flowing again.
+		canary.setDropEvents(false)
+		mockTime.IncrementTime(8 * time.Second)
+		Eventually(getResults).Should(Equal([]ifacemonitor.CanaryResult{
+			ifacemonitor.CanaryOK,
+			ifacemonitor.CanaryTimedOut,
+			ifacemonitor.CanaryOK,
+		}))
+	})
+
+	It("should hide the canary interface from the callbacks", func() {
+		mockTime.IncrementTime(10 * time.Second)
+		Eventually(getResults).Should(HaveLen(1))
+		mockTime.IncrementTime(10 * time.Second)
+		Eventually(getResults).Should(HaveLen(2))
+
+		// Resyncs find the canary too.
+		resyncC <- time.Now()
+		resyncC <- time.Now()
+		recorder.ExpectNoEventsFor(ifacemonitor.CanaryIfaceName)
+		for _, status := range im.Interfaces() {
+			Expect(status.Name).NotTo(Equal(ifacemonitor.CanaryIfaceName))
+		}
+	})
+
+	It("should disable itself if the canary is unavailable", func() {
+		canary.setErr(syscall.EPERM)
+		mockTime.IncrementTime(10 * time.Second)
+		Eventually(getResults).Should(Equal([]ifacemonitor.CanaryResult{ifacemonitor.CanaryUnavailable}))
+		Eventually(mockTime.HasTimers).Should(BeFalse())
+
+		canary.setErr(nil)
+		mockTime.IncrementTime(time.Minute)
+		Consistently(getResults, "100ms").Should(HaveLen(1))
+		Expect(canary.getToggles()).To(Equal(0))
+	})
+})
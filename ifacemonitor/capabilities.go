@@ -0,0 +1,80 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// KernelCapabilities records which optional kernel features the monitor found on the running
+// kernel.  Each feature that relies on one of these has a fallback path for older kernels.
+type KernelCapabilities struct {
+	// OperState is true if the kernel reports IFLA_OPERSTATE on links.  Detected from the first
+	// link dump.  With it, the detailed state of an interface that is down can be
+	// StateLowerLayerDown, StateDormant or StateMissingComponent; without it, we only have the
+	// flags, so those are all StateNoCarrier.
+	OperState bool
+	// StrictCheck is true if the kernel supports NETLINK_GET_STRICT_CHK, which makes it honour
+	// the filters in our route dump requests.  Probed with a socket option.  Without it, the
+	// kernel returns routes that don't match the requested table or interface, so we filter
+	// route listings ourselves.
+	StrictCheck bool
+}
+
+// probeCapabilities works out the kernel's capabilities.  Called once, with the links from the
+// start-of-day resync.
+func (m *InterfaceMonitor) probeCapabilities(links []netlink.Link) {
+	caps := m.netlinkStub.ProbeCapabilities()
+	for _, link := range links {
+		if attrs := link.Attrs(); attrs != nil && attrs.OperState != netlink.OperUnknown {
+			caps.OperState = true
+			break
+		}
+	}
+	log.WithField("capabilities", caps).Info("Detected kernel capabilities.")
+
+	m.capabilitiesLock.Lock()
+	defer m.capabilitiesLock.Unlock()
+	m.capabilities = caps
+	m.capabilitiesKnown = true
+}
+
+// Capabilities returns the kernel capabilities that the monitor detected at start of day, and
+// false if detection hasn't happened yet.  Safe to call from any goroutine.
+func (m *InterfaceMonitor) Capabilities() (KernelCapabilities, bool) {
+	m.capabilitiesLock.Lock()
+	defer m.capabilitiesLock.Unlock()
+	return m.capabilities, m.capabilitiesKnown
+}
+
+// filterLocalRoutes is the fallback for kernels without strict checking: it discards any routes
+// that the kernel returned despite them not matching the table and interface that we asked for.
+func (m *InterfaceMonitor) filterLocalRoutes(ifIndex int, routes []netlink.Route) []netlink.Route {
+	if m.capabilities.StrictCheck {
+		return routes
+	}
+	filtered := routes[:0]
+	for _, route := range routes {
+		if route.Table != unix.RT_TABLE_LOCAL || route.LinkIndex != ifIndex {
+			continue
+		}
+		filtered = append(filtered, route)
+	}
+	return filtered
+}
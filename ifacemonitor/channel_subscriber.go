@@ -0,0 +1,216 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+// IfaceSnapshotStart is sent by a ChannelSubscription at the start of a snapshot.  The consumer
+// should discard its interface state; the snapshot consists of *IfaceUpdate and
+// *IfaceAddrsUpdate messages for the matching interfaces that are up or have addresses and it
+// ends with an *IfaceSnapshotEnd.
+type IfaceSnapshotStart struct {
+	// Resync is true if the snapshot replaces updates that were dropped because the consumer
+	// fell behind; it's false for the initial snapshot.
+	Resync bool
+	// NumDropped is the total number of updates dropped so far.
+	NumDropped uint64
+}
+
+// IfaceSnapshotEnd marks the end of a snapshot.  Everything after it is a live update.
+type IfaceSnapshotEnd struct{}
+
+// ChannelSubscription is a filtered subscription that sends the same messages as a
+// DataplaneAdaptor to a channel, without ever blocking the monitor.  Messages are queued, up to
+// a limit, and forwarded from a separate goroutine.  If the queue overflows, the subscription
+// is desynced: further updates are dropped until the consumer has read everything that was
+// queued, after which the monitor sends a fresh snapshot and resumes sending updates.
+type ChannelSubscription struct {
+	m           *InterfaceMonitor
+	outC        chan<- interface{}
+	maxQueueLen int
+	sub         *subscription
+	unsubscribe func()
+
+	lock  sync.Mutex
+	queue []interface{}
+	// numQueuedUpdates counts the messages in the queue that aren't part of a snapshot.
+	numQueuedUpdates int
+	desynced         bool
+	inSnapshot       bool
+	numDropped       uint64
+	wakeC            chan struct{}
+
+	stopC    chan struct{}
+	stopOnce sync.Once
+}
+
+// SubscribeChannel adds a subscription that sends messages to outC, starting with a snapshot.
+// If more than maxQueueLen updates are queued, the subscription is desynced.  Snapshots are
+// always queued in full and don't count towards the limit.  The subscription should be closed when it's no longer needed.
+func (m *InterfaceMonitor) SubscribeChannel(
+	filter SubscriberFilter,
+	outC chan<- interface{},
+	maxQueueLen int,
+) *ChannelSubscription {
+	c := &ChannelSubscription{
+		m:           m,
+		outC:        outC,
+		maxQueueLen: maxQueueLen,
+		queue:       []interface{}{&IfaceSnapshotStart{}},
+		inSnapshot:  true,
+		wakeC:       make(chan struct{}, 1),
+		stopC:       make(chan struct{}),
+	}
+	c.sub = newSubscription(Subscriber{
+		Filter:               filter,
+		StateCallback:        c.onIfaceStateChange,
+		AddrCallback:         c.onIfaceAddrsChange,
+		SnapshotDoneCallback: c.onSnapshotDone,
+	})
+	go c.loopForwarding()
+	c.unsubscribe = m.addSubscription(c.sub, true)
+	return c
+}
+
+func (c *ChannelSubscription) onIfaceStateChange(ifaceName string, state State, ifIndex int) {
+	c.enqueue(&IfaceUpdate{
+		Name:  ifaceName,
+		State: state,
+		Index: ifIndex,
+	})
+}
+
+func (c *ChannelSubscription) onIfaceAddrsChange(ifaceName string, addrs set.Set) {
+	c.enqueue(&IfaceAddrsUpdate{
+		Name:  ifaceName,
+		Addrs: addrs,
+	})
+}
+
+func (c *ChannelSubscription) onSnapshotDone() {
+	c.lock.Lock()
+	c.inSnapshot = false
+	c.lock.Unlock()
+	c.enqueue(&IfaceSnapshotEnd{})
+}
+
+func (c *ChannelSubscription) enqueue(msg interface{}) {
+	c.lock.Lock()
+	if c.desynced {
+		c.numDropped++
+		c.lock.Unlock()
+		return
+	}
+	if !c.inSnapshot && c.numQueuedUpdates >= c.maxQueueLen {
+		log.WithField("maxQueueLen", c.maxQueueLen).Warn(
+			"Interface subscriber fell behind, dropping updates until it catches up.")
+		c.desynced = true
+		c.numDropped++
+		c.lock.Unlock()
+		return
+	}
+	c.queue = append(c.queue, msg)
+	if !c.inSnapshot {
+		c.numQueuedUpdates++
+	}
+	c.lock.Unlock()
+	select {
+	case c.wakeC <- struct{}{}:
+	default:
+		// Forwarding goroutine already has a wake-up pending.
+	}
+}
+
+// loopForwarding forwards queued messages to the consumer and triggers the resync once a
+// desynced consumer has caught up.
+func (c *ChannelSubscription) loopForwarding() {
+	for {
+		c.lock.Lock()
+		batch := c.queue
+		c.queue = nil
+		c.numQueuedUpdates = 0
+		desynced := c.desynced
+		c.lock.Unlock()
+
+		if len(batch) > 0 {
+			for _, msg := range batch {
+				select {
+				case c.outC <- msg:
+				case <-c.stopC:
+					return
+				}
+			}
+			continue
+		}
+
+		if desynced {
+			c.m.runOnMonitorLoop(c.resync)
+			c.lock.Lock()
+			desynced = c.desynced
+			c.lock.Unlock()
+			if !desynced {
+				continue
+			}
+			// Monitor has stopped so there's nothing to resync from.
+		}
+
+		select {
+		case <-c.wakeC:
+		case <-c.stopC:
+			return
+		}
+	}
+}
+
+// resync sends a fresh snapshot.  Called from the monitor's goroutine, once the consumer has
+// read everything that was queued.
+func (c *ChannelSubscription) resync() {
+	c.lock.Lock()
+	log.WithField("numDropped", c.numDropped).Info("Interface subscriber caught up, resyncing it.")
+	c.desynced = false
+	c.inSnapshot = true
+	c.queue = append(c.queue, &IfaceSnapshotStart{Resync: true, NumDropped: c.numDropped})
+	c.lock.Unlock()
+	c.m.sendSubscriptionSnapshot(c.sub)
+}
+
+// NumDropped returns the total number of updates that have been dropped because the consumer
+// fell behind.
+func (c *ChannelSubscription) NumDropped() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.numDropped
+}
+
+// Close removes the subscription and stops forwarding messages; any that are still queued are
+// dropped.  Safe to call more than once.
+func (c *ChannelSubscription) Close() {
+	c.stopOnce.Do(func() {
+		c.unsubscribe()
+		c.lock.Lock()
+		c.queue = nil
+		c.numQueuedUpdates = 0
+		c.lock.Unlock()
+		close(c.stopC)
+	})
+}
@@ -0,0 +1,146 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/timeshim/mocktime"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SubscribeChannel", func() {
+	var nl *netlinkTest
+	var im *ifacemonitor.InterfaceMonitor
+	var doneC chan struct{}
+	var callbackStateC chan string
+
+	BeforeEach(func() {
+		stateC := make(chan string, 100)
+		callbackStateC = stateC
+		im, nl, _ = startMonitor(ifacemonitor.Config{}, func(nl *netlinkTest, im *ifacemonitor.InterfaceMonitor) {
+			im.StateCallback = func(ifaceName string, state ifacemonitor.State, ifIndex int) {
+				select {
+				case stateC <- fmt.Sprintf("%s %s", ifaceName, state):
+				default:
+					// Not every spec reads these; don't block the monitor.
+				}
+			}
+			im.AddrCallback = func(ifaceName string, addrs set.Set) {}
+		}, withMonitorOps(ifacemonitor.WithMonitorTimeShim(mocktime.New())))
+		doneC = make(chan struct{})
+	})
+
+	AfterEach(func() {
+		close(doneC)
+		im.Stop()
+	})
+
+	// consume applies the messages from c to the view until the test finishes, passing the
+	// snapshot start messages to startC.
+	consume := func(c chan interface{}, view *subscriberView, startC chan *ifacemonitor.IfaceSnapshotStart) {
+		go func(doneC chan struct{}) {
+			for {
+				select {
+				case msg := <-c:
+					if start, ok := msg.(*ifacemonitor.IfaceSnapshotStart); ok {
+						startC <- start
+					}
+					view.apply(msg)
+				case <-doneC:
+					return
+				}
+			}
+		}(doneC)
+	}
+
+	It("should resync a subscriber that falls behind without affecting the others", func() {
+		filter := ifacemonitor.SubscriberFilter{NameRegexp: regexp.MustCompile("^cali")}
+		wedgedC := make(chan interface{})
+		wedged := im.SubscribeChannel(filter, wedgedC, 4)
+		defer wedged.Close()
+		liveC := make(chan interface{})
+		live := im.SubscribeChannel(filter, liveC, 100)
+		defer live.Close()
+		liveView := newSubscriberView()
+		liveStartC := make(chan *ifacemonitor.IfaceSnapshotStart, 10)
+		consume(liveC, liveView, liveStartC)
+		Eventually(liveStartC).Should(Receive(Equal(&ifacemonitor.IfaceSnapshotStart{})))
+
+		// Nothing is reading from the wedged subscriber's channel but the monitor keeps going.
+		for i := 0; i < 10; i++ {
+			name := fmt.Sprintf("cali%d", i)
+			nl.addLink(name)
+			nl.changeLinkState(name, "up")
+			nl.addAddr(name, fmt.Sprintf("10.0.0.%d/32", i))
+		}
+		Eventually(func() string {
+			return liveView.matchesKernel(nl)
+		}).Should(BeEmpty())
+		Expect(wedged.NumDropped()).To(BeNumerically(">", 0))
+		Expect(live.NumDropped()).To(BeZero())
+
+		// Once it's unwedged, the subscriber catches up with what was queued and then gets
+		// a fresh snapshot.
+		wedgedView := newSubscriberView()
+		wedgedStartC := make(chan *ifacemonitor.IfaceSnapshotStart, 10)
+		consume(wedgedC, wedgedView, wedgedStartC)
+		Eventually(wedgedStartC).Should(Receive(Equal(&ifacemonitor.IfaceSnapshotStart{})))
+		var resyncStart *ifacemonitor.IfaceSnapshotStart
+		Eventually(wedgedStartC).Should(Receive(&resyncStart))
+		Expect(resyncStart.Resync).To(BeTrue())
+		Expect(resyncStart.NumDropped).To(BeNumerically(">", 0))
+		Eventually(func() string {
+			return wedgedView.matchesKernel(nl)
+		}).Should(BeEmpty())
+
+		// After that, it gets incremental updates again.
+		nl.delLink("cali0")
+		for _, view := range []*subscriberView{liveView, wedgedView} {
+			Eventually(func() string {
+				return view.matchesKernel(nl)
+			}).Should(BeEmpty())
+			view.lock.Lock()
+			Expect(view.problems).To(BeEmpty())
+			Expect(view.snapshotDone).To(BeTrue())
+			view.lock.Unlock()
+		}
+		Consistently(wedgedStartC, "50ms", "5ms").ShouldNot(Receive())
+		Expect(live.NumDropped()).To(BeZero())
+	})
+
+	It("should keep making the callbacks for a channel subscriber's interfaces", func() {
+		subC := make(chan interface{})
+		sub := im.SubscribeChannel(ifacemonitor.SubscriberFilter{}, subC, 100)
+		defer sub.Close()
+		view := newSubscriberView()
+		consume(subC, view, make(chan *ifacemonitor.IfaceSnapshotStart, 10))
+
+		nl.addLink("cali1")
+		nl.changeLinkState("cali1", "up")
+		Eventually(callbackStateC).Should(Receive(Equal("cali1 up")))
+		Eventually(func() string {
+			return view.matchesKernel(nl)
+		}).Should(BeEmpty())
+	})
+})
@@ -0,0 +1,141 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ifacemonitor/testutils"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Interface churn", func() {
+	var nl *netlinkTest
+	var resyncC chan time.Time
+	var im *ifacemonitor.InterfaceMonitor
+	var recorder *testutils.Recorder
+
+	BeforeEach(func() {
+		resyncC = make(chan time.Time)
+		im, nl, recorder = startMonitor(ifacemonitor.Config{}, func(nl *netlinkTest, im *ifacemonitor.InterfaceMonitor) {
+			setLinkNoSignal(nl, "eth0", "up", "10.0.0.1/32")
+		}, withResyncC(resyncC))
+		recorder.ExpectAddrs("eth0", "10.0.0.1")
+	})
+
+	AfterEach(func() {
+		im.Stop()
+	})
+
+	interfaceNames := func() []string {
+		var names []string
+		for _, status := range im.Interfaces() {
+			names = append(names, status.Name)
+		}
+		return names
+	}
+
+	It("should forget interfaces that come and go", func() {
+		for i := 0; i < 20; i++ {
+			name := fmt.Sprintf("cali%d", i)
+			nl.addLink(name)
+			nl.addAddr(name, fmt.Sprintf("10.0.1.%d/32", i))
+			recorder.ExpectAddrs(name, fmt.Sprintf("10.0.1.%d", i))
+			nl.delLink(name)
+			recorder.ExpectAddrsGone(name)
+		}
+		Eventually(interfaceNames).Should(Equal([]string{"eth0"}))
+		for i := 0; i < 20; i++ {
+			Expect(im.InterfaceAddrs(fmt.Sprintf("cali%d", i))).To(BeNil())
+		}
+	})
+
+	It("should report a rename as exactly one interface going and another coming", func() {
+		nl.addLink("cali1")
+		nl.addAddr("cali1", "10.0.1.1/32")
+		nl.changeLinkState("cali1", "up")
+		recorder.ExpectState("cali1", ifacemonitor.StateUp)
+		recorder.ExpectAddrs("cali1", "10.0.1.1")
+		recorder.NewEvents()
+
+		nl.renameLink("cali1", "cali2")
+		recorder.ExpectSequence(
+			testutils.AddrsGoneEvent("cali1"),
+			testutils.StateEvent("cali1", ifacemonitor.StateDown),
+			testutils.StateEvent("cali2", ifacemonitor.StateUp),
+			testutils.AddrsEvent("cali2", "10.0.1.1"),
+		)
+		resyncC <- time.Time{}
+		resyncC <- time.Time{}
+		recorder.ExpectNoNewEvents()
+		Expect(interfaceNames()).To(Equal([]string{"eth0", "cali2"}))
+		// The old name isn't left behind as up.
+		Expect(im.UpInterfaces()).To(Equal([]string{"cali2", "eth0"}))
+	})
+
+	It("should report an address that the interface has twice only once", func() {
+		recorder.ExpectState("eth0", ifacemonitor.StateUp)
+		recorder.NewEvents()
+		// Same address with another prefix length, so the kernel lists it twice.
+		nl.addAddr("eth0", "10.0.0.1/24")
+		resyncC <- time.Time{}
+		resyncC <- time.Time{}
+		recorder.ExpectNoNewEvents()
+		Expect(im.InterfaceAddrs("eth0")).To(Equal([]string{"10.0.0.1"}))
+
+		nl.addAddr("eth0", "10.0.0.2/32")
+		recorder.ExpectSequence(testutils.AddrsEvent("eth0", "10.0.0.1", "10.0.0.2"))
+	})
+
+	It("should only report the addresses that changed on resync", func() {
+		for i := 0; i < 10; i++ {
+			name := fmt.Sprintf("cali%d", i)
+			nl.addLink(name)
+			nl.addAddr(name, fmt.Sprintf("10.0.1.%d/32", i))
+			recorder.ExpectAddrs(name, fmt.Sprintf("10.0.1.%d", i))
+		}
+		recorder.NewEvents()
+		resyncC <- time.Time{}
+		resyncC <- time.Time{}
+		recorder.ExpectNoNewEvents()
+
+		// A change that only the resync sees is reported for that interface alone.
+		nl.linksMutex.Lock()
+		nl.links["cali3"].addrs.Add("10.0.2.3/32")
+		nl.linksMutex.Unlock()
+		resyncC <- time.Time{}
+		recorder.ExpectSequence(testutils.AddrsEvent("cali3", "10.0.1.3", "10.0.2.3"))
+		resyncC <- time.Time{}
+		recorder.ExpectNoNewEvents()
+	})
+
+	It("should forget a down interface whose deletion was missed, on resync", func() {
+		nl.addLink("cali1")
+		nl.addAddr("cali1", "10.0.1.1/32")
+		recorder.ExpectAddrs("cali1", "10.0.1.1")
+
+		nl.delLinkNoSignal("cali1")
+		resyncC <- time.Time{}
+		recorder.ExpectAddrsGone("cali1")
+		Eventually(interfaceNames).Should(Equal([]string{"eth0"}))
+		Expect(im.InterfaceAddrs("cali1")).To(BeNil())
+	})
+})
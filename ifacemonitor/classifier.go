@@ -0,0 +1,181 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// ClassifierInput is the information about an interface that a Classifier can use.  The
+// classifier is re-run whenever any of it changes.
+type ClassifierInput struct {
+	Name string
+	// Kind is the netlink link type, for example "veth", "bridge" or "vxlan".
+	Kind string
+	// MasterIndex, MasterName and MasterKind describe the interface's master (for example, the
+	// bridge or bond that it is enslaved to).  MasterIndex is 0 if there's no master; the name
+	// and kind are empty if we don't know about the master (yet).
+	MasterIndex int
+	MasterName  string
+	MasterKind  string
+}
+
+// Classifier returns the class of an interface.  It is called from the monitor's goroutine so
+// it should be quick.
+type Classifier func(input ClassifierInput) InterfaceClass
+
+// ClassChangeCallback is called when an interface is first classified (with oldClass empty),
+// when it is reclassified and when it is removed (with newClass empty).
+type ClassChangeCallback func(ifaceName string, oldClass, newClass InterfaceClass)
+
+// ClassifierRule matches interfaces for a rules-based classifier.  All the non-zero fields must
+// match.
+type ClassifierRule struct {
+	NamePrefix string
+	NameRegexp *regexp.Regexp
+	Kind       string
+	// Enslaved matches interfaces that have a master.
+	Enslaved bool
+	// MasterKind matches interfaces whose master has the given kind.
+	MasterKind string
+
+	Class InterfaceClass
+}
+
+func (r *ClassifierRule) matches(input ClassifierInput) bool {
+	if r.NamePrefix != "" && !strings.HasPrefix(input.Name, r.NamePrefix) {
+		return false
+	}
+	if r.NameRegexp != nil && !r.NameRegexp.MatchString(input.Name) {
+		return false
+	}
+	if r.Kind != "" && r.Kind != input.Kind {
+		return false
+	}
+	if r.Enslaved && input.MasterIndex == 0 {
+		return false
+	}
+	if r.MasterKind != "" && r.MasterKind != input.MasterKind {
+		return false
+	}
+	return true
+}
+
+// NewRulesClassifier returns a Classifier that uses the class of the first matching rule, or
+// defaultClass if none match.
+func NewRulesClassifier(rules []ClassifierRule, defaultClass InterfaceClass) Classifier {
+	return func(input ClassifierInput) InterfaceClass {
+		for i := range rules {
+			if rules[i].matches(input) {
+				return rules[i].Class
+			}
+		}
+		return defaultClass
+	}
+}
+
+// DefaultClassifierRules follow Calico's conventions: "cali" interfaces are workloads, Calico's
+// IPIP, VXLAN and WireGuard devices are tunnels and interfaces that are enslaved to a bridge or
+// bond are ignored since it's the master that carries the traffic.  Everything else is a host
+// interface.
+var DefaultClassifierRules = []ClassifierRule{
+	{NameRegexp: regexp.MustCompile(`^(lo|kube-ipvs0)$`), Class: ClassIgnore},
+	{Kind: "ipip", Class: ClassTunnel},
+	{Kind: "vxlan", Class: ClassTunnel},
+	{Kind: "wireguard", Class: ClassTunnel},
+	{NamePrefix: "cali", Class: ClassWorkload},
+	{Enslaved: true, Class: ClassIgnore},
+}
+
+// DefaultClassifier classifies interfaces using the DefaultClassifierRules.
+var DefaultClassifier = NewRulesClassifier(DefaultClassifierRules, ClassHost)
+
+// classifyLink runs the Classifier for a link if its classification inputs have changed and
+// notifies the ClassChangeCallback if its class changed.
+func (m *InterfaceMonitor) classifyLink(ifaceName string, link netlink.Link) {
+	if m.Classifier == nil {
+		return
+	}
+	attrs := link.Attrs()
+	input := ClassifierInput{
+		Name:        ifaceName,
+		Kind:        link.Type(),
+		MasterIndex: attrs.MasterIndex,
+	}
+	m.classify(attrs.Index, input)
+}
+
+func (m *InterfaceMonitor) classify(ifIndex int, input ClassifierInput) {
+	input.MasterName = ""
+	input.MasterKind = ""
+	if input.MasterIndex != 0 {
+		if master, known := m.classInputs[input.MasterIndex]; known {
+			input.MasterName = master.Name
+			input.MasterKind = master.Kind
+		}
+	}
+	if old, known := m.classInputs[ifIndex]; known && old == input {
+		return
+	}
+	m.classInputs[ifIndex] = input
+	m.storeAndNotifyClass(ifIndex, input.Name, m.Classifier(input))
+}
+
+// refreshSlaveClasses reclassifies interfaces whose master has just appeared, changed or gone
+// away.
+func (m *InterfaceMonitor) refreshSlaveClasses(masterIdx int) {
+	for ifIndex, input := range m.classInputs {
+		if input.MasterIndex == masterIdx && ifIndex != masterIdx {
+			m.classify(ifIndex, input)
+		}
+	}
+}
+
+// forgetClass cleans up when an interface is removed.
+func (m *InterfaceMonitor) forgetClass(ifIndex int, ifaceName string) {
+	if m.Classifier == nil {
+		return
+	}
+	delete(m.classInputs, ifIndex)
+	m.storeAndNotifyClass(ifIndex, ifaceName, "")
+	m.refreshSlaveClasses(ifIndex)
+}
+
+func (m *InterfaceMonitor) storeAndNotifyClass(ifIndex int, ifaceName string, class InterfaceClass) {
+	oldClass := m.classes[ifIndex]
+	if class == oldClass {
+		return
+	}
+	if class == "" {
+		delete(m.classes, ifIndex)
+	} else {
+		m.classes[ifIndex] = class
+	}
+	log.WithFields(log.Fields{
+		"ifaceName": ifaceName,
+		"oldClass":  oldClass,
+		"newClass":  class,
+	}).Info("Interface class changed.")
+	if m.ClassChangeCallback != nil && !m.isExcludedInterface(ifaceName) {
+		m.ClassChangeCallback(ifaceName, oldClass, class)
+	}
+	m.refreshSubscriptions(ifIndex)
+}
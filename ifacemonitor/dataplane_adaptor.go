@@ -0,0 +1,163 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+// IfaceUpdate is the message that a DataplaneAdaptor sends when an interface's state changes.
+type IfaceUpdate struct {
+	Name  string
+	State State
+	Index int
+}
+
+// IfaceAddrsUpdate is the message that a DataplaneAdaptor sends when an interface's addresses
+// change.  Addrs is nil if the interface has gone.
+type IfaceAddrsUpdate struct {
+	Name  string
+	Addrs set.Set
+}
+
+// BackpressureMode controls what a DataplaneAdaptor does when its output channel is full.
+type BackpressureMode int
+
+const (
+	// BackpressureBlock sends each message from the monitor's goroutine, blocking the monitor
+	// until the consumer reads it.
+	BackpressureBlock BackpressureMode = iota
+	// BackpressureQueue queues messages, without limit, and forwards them from a separate
+	// goroutine so that the monitor never waits for the consumer.
+	BackpressureQueue
+)
+
+// DataplaneAdaptor converts the monitor's state and address callbacks into *IfaceUpdate and
+// *IfaceAddrsUpdate messages on a channel, in the same order as the callbacks.
+type DataplaneAdaptor struct {
+	outC chan<- interface{}
+	mode BackpressureMode
+
+	lock    sync.Mutex
+	queue   []interface{}
+	stopped bool
+	wakeC   chan struct{}
+
+	stopC    chan struct{}
+	stopOnce sync.Once
+}
+
+// NewDataplaneAdaptor sets the monitor's StateCallback and AddrCallback to send messages to outC.
+// It should be called before the monitor is started.
+func NewDataplaneAdaptor(m *InterfaceMonitor, outC chan<- interface{}, mode BackpressureMode) *DataplaneAdaptor {
+	a := &DataplaneAdaptor{
+		outC:  outC,
+		mode:  mode,
+		wakeC: make(chan struct{}, 1),
+		stopC: make(chan struct{}),
+	}
+	m.StateCallback = a.onIfaceStateChange
+	m.AddrCallback = a.onIfaceAddrsChange
+	if mode == BackpressureQueue {
+		go a.loopForwarding()
+	}
+	return a
+}
+
+func (a *DataplaneAdaptor) onIfaceStateChange(ifaceName string, state State, ifIndex int) {
+	a.send(&IfaceUpdate{
+		Name:  ifaceName,
+		State: state,
+		Index: ifIndex,
+	})
+}
+
+func (a *DataplaneAdaptor) onIfaceAddrsChange(ifaceName string, addrs set.Set) {
+	a.send(&IfaceAddrsUpdate{
+		Name:  ifaceName,
+		Addrs: addrs,
+	})
+}
+
+func (a *DataplaneAdaptor) send(msg interface{}) {
+	if a.mode == BackpressureBlock {
+		select {
+		case a.outC <- msg:
+		case <-a.stopC:
+			log.WithField("msg", msg).Debug("Adaptor stopped, dropping message.")
+		}
+		return
+	}
+
+	a.lock.Lock()
+	if a.stopped {
+		a.lock.Unlock()
+		log.WithField("msg", msg).Debug("Adaptor stopped, dropping message.")
+		return
+	}
+	a.queue = append(a.queue, msg)
+	a.lock.Unlock()
+	select {
+	case a.wakeC <- struct{}{}:
+	default:
+		// Forwarding goroutine already has a wake-up pending.
+	}
+}
+
+// loopForwarding forwards queued messages in BackpressureQueue mode.
+func (a *DataplaneAdaptor) loopForwarding() {
+	for {
+		a.lock.Lock()
+		batch := a.queue
+		a.queue = nil
+		a.lock.Unlock()
+
+		for _, msg := range batch {
+			select {
+			case a.outC <- msg:
+			case <-a.stopC:
+				return
+			}
+		}
+
+		select {
+		case <-a.wakeC:
+		case <-a.stopC:
+			return
+		}
+	}
+}
+
+// Stop stops the adaptor.  Subsequent callbacks are dropped, as are any messages that are still
+// queued.  A monitor that is blocked sending a message is released.  Stop doesn't stop the
+// monitor itself.
+func (a *DataplaneAdaptor) Stop() {
+	a.stopOnce.Do(func() {
+		a.lock.Lock()
+		a.stopped = true
+		if len(a.queue) > 0 {
+			log.WithField("numDropped", len(a.queue)).Info("Adaptor stopped with messages queued.")
+		}
+		a.queue = nil
+		a.lock.Unlock()
+		close(a.stopC)
+	})
+}
@@ -0,0 +1,148 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"time"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/timeshim/mocktime"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DataplaneAdaptor", func() {
+	var im *ifacemonitor.InterfaceMonitor
+	var adaptor *ifacemonitor.DataplaneAdaptor
+	var outC chan interface{}
+
+	BeforeEach(func() {
+		nl := &netlinkTest{
+			userSubscribed: make(chan int),
+			nextIndex:      10,
+		}
+		im = ifacemonitor.NewWithStubs(
+			ifacemonitor.Config{},
+			nl,
+			make(chan time.Time),
+			ifacemonitor.WithMonitorTimeShim(mocktime.New()),
+		)
+	})
+
+	AfterEach(func() {
+		adaptor.Stop()
+	})
+
+	// script drives the callbacks that the monitor would make, from a goroutine since they may
+	// block, and returns the messages that we expect.
+	script := func() []interface{} {
+		addrs := set.From("10.0.0.1")
+		go func() {
+			defer GinkgoRecover()
+			im.StateCallback("eth0", ifacemonitor.StateUp, 10)
+			im.AddrCallback("eth0", addrs)
+			im.StateCallback("eth1", ifacemonitor.StateUp, 11)
+			im.StateCallback("eth0", ifacemonitor.StateDown, 10)
+			im.AddrCallback("eth0", nil)
+		}()
+		return []interface{}{
+			&ifacemonitor.IfaceUpdate{Name: "eth0", State: ifacemonitor.StateUp, Index: 10},
+			&ifacemonitor.IfaceAddrsUpdate{Name: "eth0", Addrs: addrs},
+			&ifacemonitor.IfaceUpdate{Name: "eth1", State: ifacemonitor.StateUp, Index: 11},
+			&ifacemonitor.IfaceUpdate{Name: "eth0", State: ifacemonitor.StateDown, Index: 10},
+			&ifacemonitor.IfaceAddrsUpdate{Name: "eth0"},
+		}
+	}
+
+	receiveAll := func(n int) []interface{} {
+		var msgs []interface{}
+		for i := 0; i < n; i++ {
+			var msg interface{}
+			Eventually(outC).Should(Receive(&msg))
+			msgs = append(msgs, msg)
+		}
+		return msgs
+	}
+
+	Describe("in blocking mode", func() {
+		BeforeEach(func() {
+			outC = make(chan interface{})
+			adaptor = ifacemonitor.NewDataplaneAdaptor(im, outC, ifacemonitor.BackpressureBlock)
+		})
+
+		It("should send the messages in order", func() {
+			expected := script()
+			Expect(receiveAll(len(expected))).To(Equal(expected))
+			Consistently(outC, "50ms", "5ms").ShouldNot(Receive())
+		})
+
+		It("should release a blocked callback on Stop", func() {
+			blocked := make(chan struct{})
+			go func() {
+				im.StateCallback("eth0", ifacemonitor.StateUp, 10)
+				close(blocked)
+			}()
+			Consistently(blocked, "50ms", "5ms").ShouldNot(BeClosed())
+			adaptor.Stop()
+			Eventually(blocked).Should(BeClosed())
+
+			// Later callbacks are dropped without blocking.
+			im.AddrCallback("eth0", nil)
+			Consistently(outC, "50ms", "5ms").ShouldNot(Receive())
+		})
+	})
+
+	Describe("in queueing mode", func() {
+		BeforeEach(func() {
+			outC = make(chan interface{})
+			adaptor = ifacemonitor.NewDataplaneAdaptor(im, outC, ifacemonitor.BackpressureQueue)
+		})
+
+		It("should not block the monitor and should send the messages in order", func() {
+			// Nothing is reading yet but the callbacks all return.
+			addrs := set.From("10.0.0.1")
+			for i := 0; i < 100; i++ {
+				im.StateCallback("eth0", ifacemonitor.StateUp, 10)
+				im.AddrCallback("eth0", addrs)
+			}
+			msgs := receiveAll(200)
+			for i := 0; i < 100; i++ {
+				Expect(msgs[2*i]).To(Equal(&ifacemonitor.IfaceUpdate{Name: "eth0", State: ifacemonitor.StateUp, Index: 10}))
+				Expect(msgs[2*i+1]).To(Equal(&ifacemonitor.IfaceAddrsUpdate{Name: "eth0", Addrs: addrs}))
+			}
+
+			expected := script()
+			Expect(receiveAll(len(expected))).To(Equal(expected))
+			Consistently(outC, "50ms", "5ms").ShouldNot(Receive())
+		})
+
+		It("should drop queued messages on Stop", func() {
+			im.StateCallback("eth0", ifacemonitor.StateUp, 10)
+			im.StateCallback("eth1", ifacemonitor.StateUp, 11)
+			adaptor.Stop()
+			im.StateCallback("eth2", ifacemonitor.StateUp, 12)
+
+			// The forwarding goroutine may have picked up the first message before we stopped
+			// it, but nothing after the Stop gets through.
+			Consistently(outC, "50ms", "5ms").ShouldNot(Receive(Equal(
+				&ifacemonitor.IfaceUpdate{Name: "eth2", State: ifacemonitor.StateUp, Index: 12})))
+		})
+	})
+})
@@ -0,0 +1,230 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"context"
+	"net"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// DefaultRouteCallback is called with the sorted names of the interfaces that carry the default
+// route for the given family (netlink.FAMILY_V4 or netlink.FAMILY_V6).  With ECMP there may be
+// more than one; if there is no default route, ifaceNames is empty.
+type DefaultRouteCallback func(family int, ifaceNames []string)
+
+var defaultRouteFamilies = [2]int{netlink.FAMILY_V4, netlink.FAMILY_V6}
+
+// isDefaultRoute returns true if the route is a default route in the main routing table.
+func isDefaultRoute(route *netlink.Route) bool {
+	if route.Table != unix.RT_TABLE_MAIN {
+		return false
+	}
+	if route.Dst == nil {
+		return true
+	}
+	ones, _ := route.Dst.Mask.Size()
+	return ones == 0
+}
+
+// routeFamily works out the IP family of a route from whichever of its addresses are present.
+// Returns false if the route doesn't carry any addresses (for example, a default route via a
+// point-to-point device).
+func routeFamily(route *netlink.Route) (int, bool) {
+	ips := []net.IP{route.Gw, route.Src}
+	if route.Dst != nil {
+		ips = append(ips, route.Dst.IP)
+	}
+	for _, nh := range route.MultiPath {
+		ips = append(ips, nh.Gw)
+	}
+	for _, ip := range ips {
+		if ip == nil {
+			continue
+		}
+		if ip.To4() != nil {
+			return netlink.FAMILY_V4, true
+		}
+		return netlink.FAMILY_V6, true
+	}
+	return 0, false
+}
+
+// routeLinkIndexes returns the interface indexes that the route goes out of, taking ECMP routes
+// into account.
+func routeLinkIndexes(route *netlink.Route) []int {
+	if len(route.MultiPath) == 0 {
+		return []int{route.LinkIndex}
+	}
+	var idxs []int
+	for _, nh := range route.MultiPath {
+		idxs = append(idxs, nh.LinkIndex)
+	}
+	return idxs
+}
+
+// splitDefaultRouteUpdates sends default route updates from inC to defaultRouteOutC and passes
+// the other updates through to outC, in order.  Other route updates are dropped unless keepRoutes
+// is set.  It's needed because the update filter discards non-local routes.
+func splitDefaultRouteUpdates(
+	ctx context.Context,
+	inC <-chan NetlinkUpdate,
+	outC chan<- NetlinkUpdate,
+	defaultRouteOutC chan<- netlink.RouteUpdate,
+	keepRoutes bool,
+) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case upd, ok := <-inC:
+			if !ok {
+				close(outC)
+				return
+			}
+			if upd.Route != nil {
+				if isDefaultRoute(&upd.Route.Route) {
+					defaultRouteOutC <- *upd.Route
+					continue
+				}
+				if !keepRoutes {
+					continue
+				}
+			}
+			outC <- upd
+		}
+	}
+}
+
+func (m *InterfaceMonitor) handleDefaultRouteUpdate(update netlink.RouteUpdate) {
+	log.WithField("route", update.Route).Debug("Default route update")
+	if family, ok := routeFamily(&update.Route); ok {
+		m.resyncDefaultRoutes(family)
+		return
+	}
+	// Can't tell which family the route belongs to.  Default route changes are rare so just
+	// refresh both.
+	for _, family := range defaultRouteFamilies {
+		m.resyncDefaultRoutes(family)
+	}
+}
+
+// resyncDefaultRoutes re-lists the default routes for the given family and notifies the
+// DefaultRouteCallback if the set of interfaces has changed.  We re-list rather than trying to
+// apply the individual route updates because the updates don't reliably tell us the family and
+// ECMP routes can be added and removed one next hop at a time.  If listing fails, the next
+// resync tries again.
+func (m *InterfaceMonitor) resyncDefaultRoutes(family int) {
+	if m.DefaultRouteCallback == nil {
+		return
+	}
+	routes, err := m.netlinkStub.ListDefaultRoutes(family)
+	if err != nil {
+		log.WithError(err).WithField("family", family).Warn("Failed to list default routes.")
+		m.defaultRoutesStale = true
+		return
+	}
+	idxs := map[int]bool{}
+	for i := range routes {
+		for _, idx := range routeLinkIndexes(&routes[i]) {
+			if idx != 0 {
+				idxs[idx] = true
+			}
+		}
+	}
+	m.defaultRouteIdxs[family] = idxs
+	m.maybeNotifyDefaultRoutes(family)
+}
+
+// onLinkChangedForDefaultRoutes is called when an interface appears, is renamed, changes state
+// or is deleted.  If the interface carries a default route, it re-evaluates the set of default
+// route interfaces.  The kernel doesn't send route deletions for IPv4 routes that it flushes
+// when an interface goes down or is removed, so, if relist is true, we re-list the routes
+// rather than just refreshing the interface names.
+func (m *InterfaceMonitor) onLinkChangedForDefaultRoutes(ifIndex int, relist bool) {
+	if m.DefaultRouteCallback == nil {
+		return
+	}
+	for _, family := range defaultRouteFamilies {
+		if !m.defaultRouteIdxs[family][ifIndex] {
+			continue
+		}
+		if relist {
+			m.resyncDefaultRoutes(family)
+		} else {
+			m.maybeNotifyDefaultRoutes(family)
+		}
+	}
+}
+
+func (m *InterfaceMonitor) maybeNotifyDefaultRoutes(family int) {
+	var names []string
+	for idx := range m.defaultRouteIdxs[family] {
+		name, known := m.ifaceName[idx]
+		if !known {
+			log.WithField("ifIndex", idx).Debug("Default route via interface we haven't seen yet.")
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	m.defaultRouteLock.Lock()
+	oldNames, known := m.defaultRouteNames[family]
+	if known && stringSlicesEqual(oldNames, names) {
+		m.defaultRouteLock.Unlock()
+		return
+	}
+	m.defaultRouteNames[family] = names
+	m.defaultRouteLock.Unlock()
+
+	log.WithFields(log.Fields{
+		"family":     family,
+		"ifaceNames": names,
+	}).Info("Default route interfaces changed.")
+	m.DefaultRouteCallback(family, names)
+}
+
+// DefaultRouteIfaces returns the names of the interfaces that currently carry the default route
+// for the given family.  It returns false if the default route isn't known yet (or if the
+// DefaultRouteCallback isn't set, which disables default route tracking).  Safe to call from
+// any goroutine.
+func (m *InterfaceMonitor) DefaultRouteIfaces(family int) ([]string, bool) {
+	m.defaultRouteLock.Lock()
+	defer m.defaultRouteLock.Unlock()
+	names, known := m.defaultRouteNames[family]
+	if !known {
+		return nil, false
+	}
+	return append([]string(nil), names...), true
+}
+
+func stringSlicesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
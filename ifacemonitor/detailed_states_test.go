@@ -0,0 +1,283 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ifacemonitor/testutils"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = DescribeTable("State.Coarse",
+	func(state, expected ifacemonitor.State) {
+		Expect(state.Coarse()).To(Equal(expected))
+	},
+	Entry("unknown", ifacemonitor.State(ifacemonitor.StateUnknown), ifacemonitor.State(ifacemonitor.StateUnknown)),
+	Entry("up", ifacemonitor.State(ifacemonitor.StateUp), ifacemonitor.State(ifacemonitor.StateUp)),
+	Entry("down", ifacemonitor.State(ifacemonitor.StateDown), ifacemonitor.State(ifacemonitor.StateDown)),
+	Entry("not present", ifacemonitor.State(ifacemonitor.StateNotPresent), ifacemonitor.State(ifacemonitor.StateDown)),
+	Entry("admin down", ifacemonitor.State(ifacemonitor.StateAdminDown), ifacemonitor.State(ifacemonitor.StateDown)),
+	Entry("no carrier", ifacemonitor.State(ifacemonitor.StateNoCarrier), ifacemonitor.State(ifacemonitor.StateDown)),
+	Entry("held down", ifacemonitor.State(ifacemonitor.StateHeldDown), ifacemonitor.State(ifacemonitor.StateDown)),
+	Entry("lower layer down", ifacemonitor.State(ifacemonitor.StateLowerLayerDown), ifacemonitor.State(ifacemonitor.StateDown)),
+	Entry("dormant", ifacemonitor.State(ifacemonitor.StateDormant), ifacemonitor.State(ifacemonitor.StateDown)),
+	Entry("missing component", ifacemonitor.State(ifacemonitor.StateMissingComponent), ifacemonitor.State(ifacemonitor.StateDown)),
+)
+
+var _ = Describe("Detailed states", func() {
+	var nl *netlinkTest
+	var im *ifacemonitor.InterfaceMonitor
+	var recorder *testutils.Recorder
+	var config ifacemonitor.Config
+	var opts []ifacemonitor.InterfaceMonitorOp
+	// setupKernel, if set, prepares the fake kernel before the monitor starts.
+	var setupKernel func(nl *netlinkTest)
+
+	// setFlags sets the interface's flags to exactly rawFlags.
+	setFlags := func(name string, rawFlags uint32) {
+		nl.linksMutex.Lock()
+		link := nl.links[name]
+		link.state = "down"
+		link.extraFlags = rawFlags
+		nl.links[name] = link
+		nl.linksMutex.Unlock()
+		nl.signalLink(name, 0)
+	}
+
+	BeforeEach(func() {
+		config = ifacemonitor.Config{DetailedStates: true}
+		opts = nil
+		setupKernel = nil
+	})
+
+	JustBeforeEach(func() {
+		im, nl, recorder = startMonitor(config, func(nl *netlinkTest, im *ifacemonitor.InterfaceMonitor) {
+			if setupKernel != nil {
+				setupKernel(nl)
+			}
+		}, withMonitorOps(opts...))
+		nl.addLink("eth0")
+		recorder.ExpectAddrs("eth0")
+		recorder.NewEvents()
+	})
+
+	AfterEach(func() {
+		im.Stop()
+	})
+
+	DescribeTable("should classify an interface that goes down",
+		func(rawFlags uint32, expected ifacemonitor.State) {
+			setFlags("eth0", syscall.IFF_UP|syscall.IFF_RUNNING)
+			recorder.ExpectSequence(testutils.StateEvent("eth0", ifacemonitor.StateUp))
+			setFlags("eth0", rawFlags)
+			recorder.ExpectSequence(testutils.StateEvent("eth0", expected))
+			recorder.ExpectNoNewEvents()
+		},
+		Entry("no flags", uint32(0), ifacemonitor.State(ifacemonitor.StateAdminDown)),
+		Entry("up, not running", uint32(syscall.IFF_UP), ifacemonitor.State(ifacemonitor.StateNoCarrier)),
+		Entry("up and dormant", uint32(syscall.IFF_UP|iffDormant), ifacemonitor.State(ifacemonitor.StateNoCarrier)),
+		Entry("up, lower up but not running", uint32(syscall.IFF_UP|iffLowerUp), ifacemonitor.State(ifacemonitor.StateNoCarrier)),
+		Entry("disabled with other flags", uint32(syscall.IFF_BROADCAST|syscall.IFF_MULTICAST), ifacemonitor.State(ifacemonitor.StateAdminDown)),
+	)
+
+	Context("with a kernel that reports the oper state", func() {
+		BeforeEach(func() {
+			setupKernel = func(nl *netlinkTest) {
+				nl.addLinkNoSignal("lo")
+				nl.setLinkOperState("lo", netlink.OperUp)
+			}
+		})
+
+		DescribeTable("should say why an interface has no carrier",
+			func(rawFlags uint32, operState netlink.LinkOperState, expected ifacemonitor.State) {
+				setFlags("eth0", syscall.IFF_UP|syscall.IFF_RUNNING)
+				recorder.ExpectSequence(testutils.StateEvent("eth0", ifacemonitor.StateUp))
+				nl.setLinkOperState("eth0", operState)
+				setFlags("eth0", rawFlags)
+				recorder.ExpectSequence(testutils.StateEvent("eth0", expected))
+				recorder.ExpectNoNewEvents()
+			},
+			Entry("lower layer down", uint32(syscall.IFF_UP), netlink.LinkOperState(netlink.OperLowerLayerDown), ifacemonitor.State(ifacemonitor.StateLowerLayerDown)),
+			Entry("dormant", uint32(syscall.IFF_UP|iffDormant|iffLowerUp), netlink.LinkOperState(netlink.OperDormant), ifacemonitor.State(ifacemonitor.StateDormant)),
+			Entry("not present", uint32(syscall.IFF_UP), netlink.LinkOperState(netlink.OperNotPresent), ifacemonitor.State(ifacemonitor.StateMissingComponent)),
+			Entry("down", uint32(syscall.IFF_UP), netlink.LinkOperState(netlink.OperDown), ifacemonitor.State(ifacemonitor.StateNoCarrier)),
+			Entry("disabled", uint32(0), netlink.LinkOperState(netlink.OperDown), ifacemonitor.State(ifacemonitor.StateAdminDown)),
+		)
+
+		It("should report a change of oper state while the interface stays down", func() {
+			nl.setLinkOperState("eth0", netlink.OperDown)
+			setFlags("eth0", syscall.IFF_UP)
+			recorder.ExpectSequence(testutils.StateEvent("eth0", ifacemonitor.StateNoCarrier))
+			nl.setLinkOperState("eth0", netlink.OperLowerLayerDown)
+			nl.signalLink("eth0", 0)
+			recorder.ExpectSequence(testutils.StateEvent("eth0", ifacemonitor.StateLowerLayerDown))
+			recorder.ExpectNoNewEvents()
+		})
+	})
+
+	It("should report changes between the down states", func() {
+		// Not reported when it first appears, since it's down, as the StateCallback assumes.
+		recorder.ExpectNoNewEvents()
+
+		setFlags("eth0", syscall.IFF_UP)
+		recorder.ExpectSequence(testutils.StateEvent("eth0", ifacemonitor.StateNoCarrier))
+		setFlags("eth0", syscall.IFF_UP|syscall.IFF_RUNNING)
+		recorder.ExpectSequence(testutils.StateEvent("eth0", ifacemonitor.StateUp))
+		setFlags("eth0", syscall.IFF_UP)
+		recorder.ExpectSequence(testutils.StateEvent("eth0", ifacemonitor.StateNoCarrier))
+		setFlags("eth0", 0)
+		recorder.ExpectSequence(testutils.StateEvent("eth0", ifacemonitor.StateAdminDown))
+		recorder.ExpectNoNewEvents()
+
+		nl.delLink("eth0")
+		recorder.ExpectSequence(
+			testutils.AddrsGoneEvent("eth0"),
+			testutils.StateEvent("eth0", ifacemonitor.StateNotPresent),
+		)
+		recorder.ExpectNoNewEvents()
+	})
+
+	It("should report an interface that is deleted while up as not present", func() {
+		setFlags("eth0", syscall.IFF_UP|syscall.IFF_RUNNING)
+		recorder.ExpectSequence(testutils.StateEvent("eth0", ifacemonitor.StateUp))
+		nl.delLink("eth0")
+		recorder.ExpectSequence(
+			testutils.AddrsGoneEvent("eth0"),
+			testutils.StateEvent("eth0", ifacemonitor.StateNotPresent),
+		)
+		recorder.ExpectNoNewEvents()
+	})
+
+	It("should report the old name of a renamed interface as not present", func() {
+		setFlags("eth0", syscall.IFF_UP|syscall.IFF_RUNNING)
+		recorder.ExpectSequence(testutils.StateEvent("eth0", ifacemonitor.StateUp))
+		nl.renameLink("eth0", "eth1")
+		recorder.ExpectSequence(
+			testutils.AddrsGoneEvent("eth0"),
+			testutils.StateEvent("eth0", ifacemonitor.StateNotPresent),
+			testutils.StateEvent("eth1", ifacemonitor.StateUp),
+			testutils.AddrsEvent("eth1"),
+		)
+		recorder.ExpectNoNewEvents()
+	})
+
+	It("should not report the deletion of an interface that it never reported", func() {
+		nl.delLink("eth0")
+		recorder.ExpectSequence(testutils.AddrsGoneEvent("eth0"))
+		recorder.ExpectNoNewEvents()
+	})
+
+	It("should coalesce the down states while paused", func() {
+		setFlags("eth0", syscall.IFF_UP)
+		recorder.ExpectSequence(testutils.StateEvent("eth0", ifacemonitor.StateNoCarrier))
+
+		// mtu waits for the monitor to see an MTU change, so that we know that it has handled
+		// the updates before it.
+		mtu := func(mtu int) {
+			nl.changeLinkMTU("eth0", mtu)
+			Eventually(func() int {
+				return im.Interfaces()[0].MTU
+			}).Should(Equal(mtu))
+		}
+
+		im.Pause()
+		setFlags("eth0", 0)
+		setFlags("eth0", syscall.IFF_UP)
+		mtu(9000)
+		im.Resume()
+		// Back to where it was before the pause.
+		recorder.ExpectNoNewEvents()
+
+		im.Pause()
+		setFlags("eth0", syscall.IFF_UP|syscall.IFF_RUNNING)
+		setFlags("eth0", 0)
+		mtu(1500)
+		im.Resume()
+		recorder.ExpectSequence(testutils.StateEvent("eth0", ifacemonitor.StateAdminDown))
+		recorder.ExpectNoNewEvents()
+	})
+
+	It("should withdraw every interface that it reported", func() {
+		setFlags("eth0", syscall.IFF_UP)
+		recorder.ExpectSequence(testutils.StateEvent("eth0", ifacemonitor.StateNoCarrier))
+		nl.addLink("eth1")
+		nl.changeLinkState("eth1", "up")
+		recorder.ExpectState("eth1", ifacemonitor.StateUp)
+		nl.addLink("eth2")
+		recorder.ExpectAddrs("eth2")
+		recorder.NewEvents()
+
+		im.StopAndWithdraw()
+		recorder.ExpectSequence(
+			testutils.StateEvent("eth0", ifacemonitor.StateNotPresent),
+			testutils.AddrsGoneEvent("eth0"),
+			testutils.StateEvent("eth1", ifacemonitor.StateNotPresent),
+			testutils.AddrsGoneEvent("eth1"),
+			testutils.AddrsGoneEvent("eth2"),
+		)
+		recorder.ExpectNoNewEvents()
+	})
+
+	Describe("with ProtodownAsDown", func() {
+		var sysfs *mockSysfs
+
+		BeforeEach(func() {
+			config.TrackProtodown = true
+			config.ProtodownAsDown = true
+			sysfs = &mockSysfs{files: map[string]string{}}
+			sysfs.setFile("/sys/class/net/eth0/proto_down", "0\n")
+			opts = append(opts, ifacemonitor.WithSysfsStub(sysfs))
+		})
+
+		It("should report a running interface that is protodown as held down", func() {
+			setFlags("eth0", syscall.IFF_UP|syscall.IFF_RUNNING)
+			recorder.ExpectSequence(testutils.StateEvent("eth0", ifacemonitor.StateUp))
+			sysfs.setFile("/sys/class/net/eth0/proto_down", "1\n")
+			nl.signalLink("eth0", 0)
+			recorder.ExpectSequence(testutils.StateEvent("eth0", ifacemonitor.StateHeldDown))
+			// Losing carrier as well is a different reason.
+			setFlags("eth0", syscall.IFF_UP)
+			recorder.ExpectSequence(testutils.StateEvent("eth0", ifacemonitor.StateNoCarrier))
+			recorder.ExpectNoNewEvents()
+		})
+	})
+
+	Describe("without DetailedStates", func() {
+		BeforeEach(func() {
+			config.DetailedStates = false
+		})
+
+		It("should only report up and down", func() {
+			setFlags("eth0", syscall.IFF_UP)
+			setFlags("eth0", syscall.IFF_UP|syscall.IFF_RUNNING)
+			recorder.ExpectSequence(testutils.StateEvent("eth0", ifacemonitor.StateUp))
+			setFlags("eth0", syscall.IFF_UP)
+			recorder.ExpectSequence(testutils.StateEvent("eth0", ifacemonitor.StateDown))
+			setFlags("eth0", 0)
+			nl.delLink("eth0")
+			recorder.ExpectSequence(testutils.AddrsGoneEvent("eth0"))
+			recorder.ExpectNoNewEvents()
+		})
+	})
+})
@@ -0,0 +1,179 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"net"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+// DuplicateMACCallback is called when a MAC address becomes shared by unrelated interfaces,
+// with their names, when the set of interfaces that share it changes and, with nil, when it is
+// no longer shared.  Interfaces that are related through a master or parent, such as a bond and
+// its slaves or a VLAN and its parent, share their MAC legitimately so they don't count.
+type DuplicateMACCallback func(hardwareAddr string, ifaceNames []string)
+
+// macKey returns the key for a MAC address in our index; "" for a missing or all-zero address,
+// which some tunnel devices have and which we don't check.
+func macKey(hwAddr net.HardwareAddr) string {
+	for _, b := range hwAddr {
+		if b != 0 {
+			return hwAddr.String()
+		}
+	}
+	return ""
+}
+
+// storeMAC updates the MAC index for an interface and rechecks the affected MACs.
+// relationsChanged should be set if the interface's name, master or parent changed, since that
+// can change whether a shared MAC is a duplicate.
+func (m *InterfaceMonitor) storeMAC(ifIndex int, hwAddr net.HardwareAddr, relationsChanged bool) {
+	mac := macKey(hwAddr)
+	oldMAC := m.ifaceMACs[ifIndex]
+	if mac != oldMAC {
+		m.unindexMAC(ifIndex, oldMAC)
+		if mac != "" {
+			m.ifaceMACs[ifIndex] = mac
+			if m.macIfaces[mac] == nil {
+				m.macIfaces[mac] = set.New()
+			}
+			m.macIfaces[mac].Add(ifIndex)
+		}
+	}
+	if relationsChanged {
+		m.checkSharedMACs()
+		return
+	}
+	if mac != oldMAC {
+		m.checkDuplicateMAC(oldMAC)
+		m.checkDuplicateMAC(mac)
+	}
+}
+
+// forgetMAC is called when an interface is removed.
+func (m *InterfaceMonitor) forgetMAC(ifIndex int) {
+	m.unindexMAC(ifIndex, m.ifaceMACs[ifIndex])
+	m.checkSharedMACs()
+}
+
+func (m *InterfaceMonitor) unindexMAC(ifIndex int, mac string) {
+	delete(m.ifaceMACs, ifIndex)
+	if ifIndexes := m.macIfaces[mac]; ifIndexes != nil {
+		ifIndexes.Discard(ifIndex)
+		if ifIndexes.Len() == 0 {
+			delete(m.macIfaces, mac)
+		}
+	}
+}
+
+// checkSharedMACs rechecks all the MACs that are shared or flagged.
+func (m *InterfaceMonitor) checkSharedMACs() {
+	for mac, ifIndexes := range m.macIfaces {
+		if ifIndexes.Len() > 1 {
+			m.checkDuplicateMAC(mac)
+		}
+	}
+	for mac := range m.duplicateMACs {
+		m.checkDuplicateMAC(mac)
+	}
+}
+
+// checkDuplicateMAC works out whether a MAC is shared by unrelated interfaces and flags or
+// unflags it.
+func (m *InterfaceMonitor) checkDuplicateMAC(mac string) {
+	if mac == "" {
+		return
+	}
+	var ifIndexes []int
+	if m.macIfaces[mac] != nil {
+		m.macIfaces[mac].Iter(func(item interface{}) error {
+			ifIndex := item.(int)
+			if !m.isExcludedInterface(m.ifaceName[ifIndex]) {
+				ifIndexes = append(ifIndexes, ifIndex)
+			}
+			return nil
+		})
+	}
+	var names []string
+	if m.countUnrelatedGroups(ifIndexes) > 1 {
+		for _, ifIndex := range ifIndexes {
+			names = append(names, m.ifaceName[ifIndex])
+		}
+		sort.Strings(names)
+	}
+	if stringSlicesEqual(names, m.duplicateMACs[mac]) {
+		return
+	}
+	logCxt := log.WithField("mac", mac)
+	if names == nil {
+		logCxt.WithField("oldIfaceNames", m.duplicateMACs[mac]).Info("MAC address is no longer duplicated.")
+		delete(m.duplicateMACs, mac)
+	} else {
+		logCxt.WithField("ifaceNames", names).Warn(
+			"MAC address is shared by unrelated interfaces; this may cause connectivity problems.")
+		m.duplicateMACs[mac] = names
+	}
+	m.metrics.duplicateMACs.Set(float64(len(m.duplicateMACs)))
+	if m.DuplicateMACCallback != nil {
+		m.DuplicateMACCallback(mac, append([]string(nil), names...))
+	}
+}
+
+// countUnrelatedGroups splits the given interfaces into groups that are connected through
+// their masters and parents and returns the number of groups.  Two slaves of the same bond are
+// related even if we haven't seen the bond yet, which can happen during a resync.
+func (m *InterfaceMonitor) countUnrelatedGroups(ifIndexes []int) int {
+	groups := map[int]int{}
+	var root func(ifIndex int) int
+	root = func(ifIndex int) int {
+		parent, known := groups[ifIndex]
+		if !known || parent == ifIndex {
+			return ifIndex
+		}
+		r := root(parent)
+		groups[ifIndex] = r
+		return r
+	}
+	for _, ifIndex := range ifIndexes {
+		for _, relative := range []int{m.linkMasters[ifIndex], m.linkParents[ifIndex]} {
+			if relative != 0 {
+				groups[root(ifIndex)] = root(relative)
+			}
+		}
+	}
+	roots := set.New()
+	for _, ifIndex := range ifIndexes {
+		roots.Add(root(ifIndex))
+	}
+	return roots.Len()
+}
+
+// macSharedWith returns the names of the other interfaces that share an interface's MAC, if it
+// is flagged as a duplicate.
+func (m *InterfaceMonitor) macSharedWith(ifIndex int) (others []string) {
+	ifaceName := m.ifaceName[ifIndex]
+	for _, name := range m.duplicateMACs[m.ifaceMACs[ifIndex]] {
+		if name != ifaceName {
+			others = append(others, name)
+		}
+	}
+	return
+}
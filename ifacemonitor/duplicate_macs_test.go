@@ -0,0 +1,136 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ifacemonitor/testutils"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Duplicate MAC detection", func() {
+	var nl *netlinkTest
+	var im *ifacemonitor.InterfaceMonitor
+	var recorder *testutils.Recorder
+	var lock sync.Mutex
+	var reports []string
+
+	sharedMAC := net.HardwareAddr{0xee, 0xee, 0, 0, 0, 0xaa}
+
+	getReports := func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string(nil), reports...)
+	}
+	macSharedWith := func(name string) func() []string {
+		return func() []string {
+			for _, status := range im.Interfaces() {
+				if status.Name == name {
+					return status.MACSharedWith
+				}
+			}
+			return nil
+		}
+	}
+
+	BeforeEach(func() {
+		lock.Lock()
+		reports = nil
+		lock.Unlock()
+	})
+
+	// start runs the monitor with eth0 and eth1 up, and whatever else addLinks adds, in the
+	// start-of-day resync.
+	start := func(addLinks func(nl *netlinkTest)) {
+		im, nl, recorder = startMonitor(ifacemonitor.Config{}, func(nl *netlinkTest, im *ifacemonitor.InterfaceMonitor) {
+			setLinkNoSignal(nl, "eth0", "up")
+			setLinkNoSignal(nl, "eth1", "up")
+			if addLinks != nil {
+				addLinks(nl)
+			}
+			im.DuplicateMACCallback = func(hardwareAddr string, ifaceNames []string) {
+				lock.Lock()
+				defer lock.Unlock()
+				reports = append(reports, fmt.Sprintf("%s [%s]", hardwareAddr, strings.Join(ifaceNames, " ")))
+			}
+		})
+	}
+
+	AfterEach(func() {
+		im.Stop()
+	})
+
+	It("should flag a MAC shared by unrelated interfaces until it's resolved", func() {
+		start(nil)
+		recorder.ExpectState("eth1", ifacemonitor.StateUp)
+		nl.changeLinkMAC("eth0", sharedMAC)
+		nl.changeLinkMAC("eth1", sharedMAC)
+		Eventually(getReports).Should(Equal([]string{"ee:ee:00:00:00:aa [eth0 eth1]"}))
+		Expect(macSharedWith("eth0")()).To(Equal([]string{"eth1"}))
+
+		// A third interface joins in.
+		nl.addLink("eth2")
+		nl.changeLinkMAC("eth2", sharedMAC)
+		Eventually(getReports).Should(HaveLen(2))
+		Expect(getReports()[1]).To(Equal("ee:ee:00:00:00:aa [eth0 eth1 eth2]"))
+
+		nl.delLink("eth2")
+		nl.changeLinkMAC("eth1", net.HardwareAddr{0xee, 0xee, 0, 0, 0, 0xbb})
+		Eventually(getReports).Should(HaveLen(4))
+		Expect(getReports()[2:]).To(Equal([]string{
+			"ee:ee:00:00:00:aa [eth0 eth1]",
+			"ee:ee:00:00:00:aa []",
+		}))
+		Expect(macSharedWith("eth0")()).To(BeEmpty())
+	})
+
+	It("should not flag a bond and its slaves", func() {
+		// The slaves come before the bond in the start-of-day resync and take its MAC.
+		start(func(nl *netlinkTest) {
+			setLinkNoSignal(nl, "bond0", "up")
+			nl.linksMutex.Lock()
+			for _, name := range []string{"bond0", "eth0", "eth1"} {
+				link := nl.links[name]
+				link.mac = sharedMAC
+				if name != "bond0" {
+					link.masterIndex = nl.links["bond0"].index
+				}
+				nl.links[name] = link
+			}
+			nl.linksMutex.Unlock()
+		})
+		recorder.ExpectState("bond0", ifacemonitor.StateUp)
+		// A VLAN on the bond shares its MAC too.
+		nl.addSubDevice("bond0.100", "vlan", 0, "bond0")
+		nl.changeLinkMAC("bond0.100", sharedMAC)
+		Consistently(getReports, "100ms").Should(BeEmpty())
+
+		// Once it's released from the bond, eth1 shouldn't have the bond's MAC.
+		nl.setMaster("eth1", "")
+		Eventually(getReports).Should(Equal([]string{"ee:ee:00:00:00:aa [bond0 bond0.100 eth0 eth1]"}))
+		nl.changeLinkMAC("eth1", net.HardwareAddr{0xee, 0xee, 0, 0, 0, 0xbb})
+		Eventually(getReports).Should(HaveLen(2))
+		Expect(getReports()[1]).To(Equal("ee:ee:00:00:00:aa []"))
+	})
+})
@@ -0,0 +1,274 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+// EndpointIfaceStatus is the status-relevant view of a workload interface.
+type EndpointIfaceStatus struct {
+	Name  string
+	State State
+	// Addrs is a copy of the interface's current addresses; it may be empty but isn't nil.
+	Addrs      set.Set
+	LastChange time.Time
+}
+
+// EndpointIfaceTransition is the kind of change in an EndpointIfaceEvent.
+type EndpointIfaceTransition int
+
+const (
+	EndpointIfaceUp EndpointIfaceTransition = iota
+	EndpointIfaceDown
+	EndpointIfaceAddrAdded
+	EndpointIfaceAddrRemoved
+	// EndpointIfaceGone is sent when the interface has been removed; there are no more
+	// events for it unless it's recreated.
+	EndpointIfaceGone
+)
+
+func (t EndpointIfaceTransition) String() string {
+	switch t {
+	case EndpointIfaceUp:
+		return "up"
+	case EndpointIfaceDown:
+		return "down"
+	case EndpointIfaceAddrAdded:
+		return "addr-added"
+	case EndpointIfaceAddrRemoved:
+		return "addr-removed"
+	case EndpointIfaceGone:
+		return "gone"
+	}
+	return "unknown"
+}
+
+// EndpointIfaceEvent is a single transition of a workload interface.  Addr is set for the address
+// transitions.
+type EndpointIfaceEvent struct {
+	Name       string
+	Transition EndpointIfaceTransition
+	Addr       string
+}
+
+// EndpointStatusCallback receives EndpointIfaceEvents.  It is called with the feed's lock held
+// so it must not call back into the feed.
+type EndpointStatusCallback func(event EndpointIfaceEvent)
+
+// EndpointStatusFeed maintains the state and addresses of the workload interfaces (those whose
+// names start with one of the workload prefixes) for endpoint status reporting.  It can be
+// queried and subscribed to from any goroutine.
+type EndpointStatusFeed struct {
+	prefixes []string
+	now      func() time.Time
+
+	lock        sync.Mutex
+	ifaces      map[string]*EndpointIfaceStatus
+	subscribers map[int]EndpointStatusCallback
+	nextSubID   int
+}
+
+// NewEndpointStatusFeed creates a feed for the given monitor.  It wraps the monitor's current
+// StateCallback and AddrCallback, which are still called, so it should be created after those
+// are set and before the monitor is started.
+func NewEndpointStatusFeed(m *InterfaceMonitor, workloadPrefixes []string) *EndpointStatusFeed {
+	f := &EndpointStatusFeed{
+		prefixes:    workloadPrefixes,
+		now:         m.time.Now,
+		ifaces:      map[string]*EndpointIfaceStatus{},
+		subscribers: map[int]EndpointStatusCallback{},
+	}
+	prevStateCallback := m.StateCallback
+	m.StateCallback = func(ifaceName string, state State, ifIndex int) {
+		f.OnIfaceStateChanged(ifaceName, state)
+		if prevStateCallback != nil {
+			prevStateCallback(ifaceName, state, ifIndex)
+		}
+	}
+	prevAddrCallback := m.AddrCallback
+	m.AddrCallback = func(ifaceName string, addrs set.Set) {
+		f.OnIfaceAddrsChanged(ifaceName, addrs)
+		if prevAddrCallback != nil {
+			prevAddrCallback(ifaceName, addrs)
+		}
+	}
+	return f
+}
+
+func (f *EndpointStatusFeed) isWorkloadIface(ifaceName string) bool {
+	for _, prefix := range f.prefixes {
+		if strings.HasPrefix(ifaceName, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// OnIfaceStateChanged updates the feed with a change of interface state.
+func (f *EndpointStatusFeed) OnIfaceStateChanged(ifaceName string, state State) {
+	if !f.isWorkloadIface(ifaceName) {
+		return
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	status := f.getOrCreate(ifaceName)
+	if status.State == state {
+		return
+	}
+	status.State = state
+	status.LastChange = f.now()
+	switch state {
+	case StateUp:
+		f.publish(EndpointIfaceEvent{Name: ifaceName, Transition: EndpointIfaceUp})
+	case StateDown:
+		f.publish(EndpointIfaceEvent{Name: ifaceName, Transition: EndpointIfaceDown})
+	}
+}
+
+// OnIfaceAddrsChanged updates the feed with a change of interface addresses.  nil addrs means
+// that the interface has gone.
+func (f *EndpointStatusFeed) OnIfaceAddrsChanged(ifaceName string, addrs set.Set) {
+	if !f.isWorkloadIface(ifaceName) {
+		return
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if addrs == nil {
+		status, ok := f.ifaces[ifaceName]
+		if !ok {
+			return
+		}
+		for _, addr := range sortedAddrs(status.Addrs) {
+			f.publish(EndpointIfaceEvent{Name: ifaceName, Transition: EndpointIfaceAddrRemoved, Addr: addr})
+		}
+		delete(f.ifaces, ifaceName)
+		log.WithField("ifaceName", ifaceName).Debug("Workload interface gone.")
+		f.publish(EndpointIfaceEvent{Name: ifaceName, Transition: EndpointIfaceGone})
+		return
+	}
+
+	status := f.getOrCreate(ifaceName)
+	var removed, added []string
+	for _, addr := range sortedAddrs(status.Addrs) {
+		if !addrs.Contains(addr) {
+			removed = append(removed, addr)
+		}
+	}
+	for _, addr := range sortedAddrs(addrs) {
+		if !status.Addrs.Contains(addr) {
+			added = append(added, addr)
+		}
+	}
+	if len(removed) == 0 && len(added) == 0 {
+		return
+	}
+	status.Addrs = addrs.Copy()
+	status.LastChange = f.now()
+	for _, addr := range removed {
+		f.publish(EndpointIfaceEvent{Name: ifaceName, Transition: EndpointIfaceAddrRemoved, Addr: addr})
+	}
+	for _, addr := range added {
+		f.publish(EndpointIfaceEvent{Name: ifaceName, Transition: EndpointIfaceAddrAdded, Addr: addr})
+	}
+}
+
+func (f *EndpointStatusFeed) getOrCreate(ifaceName string) *EndpointIfaceStatus {
+	status, ok := f.ifaces[ifaceName]
+	if !ok {
+		status = &EndpointIfaceStatus{
+			Name:  ifaceName,
+			State: StateUnknown,
+			Addrs: set.New(),
+		}
+		f.ifaces[ifaceName] = status
+	}
+	return status
+}
+
+func (f *EndpointStatusFeed) publish(event EndpointIfaceEvent) {
+	for _, cb := range f.subscribers {
+		cb(event)
+	}
+}
+
+// Status returns the current status of the given workload interface.
+func (f *EndpointStatusFeed) Status(ifaceName string) (EndpointIfaceStatus, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	status, ok := f.ifaces[ifaceName]
+	if !ok {
+		return EndpointIfaceStatus{}, false
+	}
+	c := *status
+	c.Addrs = status.Addrs.Copy()
+	return c, true
+}
+
+// Subscribe registers a callback for future transitions.  The current state of every workload
+// interface is replayed to it first, as if each interface had just appeared.  The returned
+// function cancels the subscription.
+func (f *EndpointStatusFeed) Subscribe(cb EndpointStatusCallback) (unsubscribe func()) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	var names []string
+	for name := range f.ifaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		status := f.ifaces[name]
+		switch status.State {
+		case StateUp:
+			cb(EndpointIfaceEvent{Name: name, Transition: EndpointIfaceUp})
+		case StateDown:
+			cb(EndpointIfaceEvent{Name: name, Transition: EndpointIfaceDown})
+		}
+		for _, addr := range sortedAddrs(status.Addrs) {
+			cb(EndpointIfaceEvent{Name: name, Transition: EndpointIfaceAddrAdded, Addr: addr})
+		}
+	}
+
+	id := f.nextSubID
+	f.nextSubID++
+	f.subscribers[id] = cb
+	return func() {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		delete(f.subscribers, id)
+	}
+}
+
+func sortedAddrs(addrs set.Set) []string {
+	var sorted []string
+	addrs.Iter(func(item interface{}) error {
+		sorted = append(sorted, item.(string))
+		return nil
+	})
+	sort.Strings(sorted)
+	return sorted
+}
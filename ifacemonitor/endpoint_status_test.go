@@ -0,0 +1,184 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/timeshim/mocktime"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("EndpointStatusFeed", func() {
+	var im *ifacemonitor.InterfaceMonitor
+	var mockTime *mocktime.MockTime
+	var feed *ifacemonitor.EndpointStatusFeed
+	var chainedStates []string
+
+	BeforeEach(func() {
+		nl := &netlinkTest{
+			userSubscribed: make(chan int),
+			nextIndex:      10,
+		}
+		mockTime = mocktime.New()
+		im = ifacemonitor.NewWithStubs(
+			ifacemonitor.Config{},
+			nl,
+			make(chan time.Time),
+			ifacemonitor.WithMonitorTimeShim(mockTime),
+		)
+		chainedStates = nil
+		im.StateCallback = func(ifaceName string, state ifacemonitor.State, ifIndex int) {
+			chainedStates = append(chainedStates, ifaceName+"="+string(state))
+		}
+		im.AddrCallback = func(ifaceName string, addrs set.Set) {}
+		feed = ifacemonitor.NewEndpointStatusFeed(im, []string{"cali", "tap"})
+	})
+
+	It("should track workload interfaces only and chain the existing callbacks", func() {
+		im.StateCallback("eth0", ifacemonitor.StateUp, 9)
+		im.StateCallback("cali1", ifacemonitor.StateUp, 10)
+		Expect(chainedStates).To(Equal([]string{"eth0=up", "cali1=up"}))
+
+		_, ok := feed.Status("eth0")
+		Expect(ok).To(BeFalse())
+		status, ok := feed.Status("cali1")
+		Expect(ok).To(BeTrue())
+		Expect(status.State).To(Equal(ifacemonitor.State(ifacemonitor.StateUp)))
+		Expect(status.LastChange).To(Equal(mockTime.Now()))
+		Expect(status.Addrs.Len()).To(Equal(0))
+
+		mockTime.IncrementTime(time.Second)
+		im.AddrCallback("cali1", set.From("10.0.0.1"))
+		status, _ = feed.Status("cali1")
+		Expect(status.Addrs).To(Equal(set.From("10.0.0.1")))
+		Expect(status.LastChange).To(Equal(mockTime.Now()))
+	})
+
+	It("should replay current state to a new subscriber and then send transitions", func() {
+		im.StateCallback("cali1", ifacemonitor.StateUp, 10)
+		im.AddrCallback("cali1", set.From("10.0.0.2", "10.0.0.1"))
+		im.StateCallback("tap2", ifacemonitor.StateDown, 11)
+
+		var events []ifacemonitor.EndpointIfaceEvent
+		unsubscribe := feed.Subscribe(func(event ifacemonitor.EndpointIfaceEvent) {
+			events = append(events, event)
+		})
+		Expect(events).To(Equal([]ifacemonitor.EndpointIfaceEvent{
+			{Name: "cali1", Transition: ifacemonitor.EndpointIfaceUp},
+			{Name: "cali1", Transition: ifacemonitor.EndpointIfaceAddrAdded, Addr: "10.0.0.1"},
+			{Name: "cali1", Transition: ifacemonitor.EndpointIfaceAddrAdded, Addr: "10.0.0.2"},
+			{Name: "tap2", Transition: ifacemonitor.EndpointIfaceDown},
+		}))
+
+		events = nil
+		im.AddrCallback("cali1", set.From("10.0.0.2", "10.0.0.3"))
+		im.StateCallback("cali1", ifacemonitor.StateUp, 10) // No change.
+		im.StateCallback("cali1", ifacemonitor.StateDown, 10)
+		im.AddrCallback("cali1", nil)
+		Expect(events).To(Equal([]ifacemonitor.EndpointIfaceEvent{
+			{Name: "cali1", Transition: ifacemonitor.EndpointIfaceAddrRemoved, Addr: "10.0.0.1"},
+			{Name: "cali1", Transition: ifacemonitor.EndpointIfaceAddrAdded, Addr: "10.0.0.3"},
+			{Name: "cali1", Transition: ifacemonitor.EndpointIfaceDown},
+			{Name: "cali1", Transition: ifacemonitor.EndpointIfaceAddrRemoved, Addr: "10.0.0.2"},
+			{Name: "cali1", Transition: ifacemonitor.EndpointIfaceAddrRemoved, Addr: "10.0.0.3"},
+			{Name: "cali1", Transition: ifacemonitor.EndpointIfaceGone},
+		}))
+		_, ok := feed.Status("cali1")
+		Expect(ok).To(BeFalse())
+
+		events = nil
+		unsubscribe()
+		im.StateCallback("tap2", ifacemonitor.StateUp, 11)
+		Expect(events).To(BeEmpty())
+	})
+
+	It("should give a subscriber a consistent view despite churn during subscription", func() {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer GinkgoRecover()
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				name := fmt.Sprintf("cali%d", i%5)
+				im.StateCallback(name, ifacemonitor.StateUp, i%5)
+				im.AddrCallback(name, set.From(fmt.Sprintf("10.0.%d.1", i)))
+				if i%3 == 0 {
+					im.StateCallback(name, ifacemonitor.StateDown, i%5)
+				}
+				if i%7 == 0 {
+					im.AddrCallback(name, nil)
+				}
+			}
+		}()
+
+		// Rebuild the state from the events that we receive.
+		type view struct {
+			up    bool
+			addrs set.Set
+		}
+		var lock sync.Mutex
+		views := map[string]*view{}
+		getView := func(name string) *view {
+			if views[name] == nil {
+				views[name] = &view{addrs: set.New()}
+			}
+			return views[name]
+		}
+		feed.Subscribe(func(event ifacemonitor.EndpointIfaceEvent) {
+			lock.Lock()
+			defer lock.Unlock()
+			switch event.Transition {
+			case ifacemonitor.EndpointIfaceUp:
+				getView(event.Name).up = true
+			case ifacemonitor.EndpointIfaceDown:
+				getView(event.Name).up = false
+			case ifacemonitor.EndpointIfaceAddrAdded:
+				Expect(getView(event.Name).addrs.Contains(event.Addr)).To(BeFalse())
+				getView(event.Name).addrs.Add(event.Addr)
+			case ifacemonitor.EndpointIfaceAddrRemoved:
+				Expect(getView(event.Name).addrs.Contains(event.Addr)).To(BeTrue())
+				getView(event.Name).addrs.Discard(event.Addr)
+			case ifacemonitor.EndpointIfaceGone:
+				Expect(getView(event.Name).addrs.Len()).To(BeZero())
+				delete(views, event.Name)
+			}
+		})
+		wg.Wait()
+
+		lock.Lock()
+		defer lock.Unlock()
+		for i := 0; i < 5; i++ {
+			name := fmt.Sprintf("cali%d", i)
+			status, ok := feed.Status(name)
+			if !ok {
+				Expect(views).NotTo(HaveKey(name))
+				continue
+			}
+			Expect(views).To(HaveKey(name))
+			Expect(views[name].up).To(Equal(status.State == ifacemonitor.StateUp))
+			Expect(views[name].addrs).To(Equal(status.Addrs))
+		}
+	})
+})
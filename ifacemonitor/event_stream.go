@@ -0,0 +1,313 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+const defaultEventStreamQueueLen = 1000
+
+// StreamEvent is the JSON form of an event sent by the event stream server; each is sent on its
+// own line.  A connection starts with a snapshot: a "snapshot-start" event, "state" and "addrs"
+// events for the interfaces that are up or have addresses and then a "snapshot-end" event.
+// After that, the events are live updates.  If the client falls behind, the oldest queued events
+// are dropped and the next event is preceded by a "dropped" event with the number dropped.
+type StreamEvent struct {
+	Type  string    `json:"type"`
+	Time  time.Time `json:"time"`
+	Name  string    `json:"name,omitempty"`
+	Index int       `json:"index,omitempty"`
+	State State     `json:"state,omitempty"`
+	// Addrs holds the interface's addresses for "addrs" events; it's omitted if there are none.
+	// Gone is true instead if the interface has gone.
+	Addrs   []string `json:"addrs,omitempty"`
+	Gone    bool     `json:"gone,omitempty"`
+	Dropped uint64   `json:"dropped,omitempty"`
+	// Origin is set for "state" and "addrs" events.
+	Origin UpdateOrigin `json:"origin,omitempty"`
+}
+
+const (
+	StreamEventSnapshotStart = "snapshot-start"
+	StreamEventSnapshotEnd   = "snapshot-end"
+	StreamEventState         = "state"
+	StreamEventAddrs         = "addrs"
+	StreamEventDropped       = "dropped"
+)
+
+// eventStreamServer serves the EventStreamSocket.
+type eventStreamServer struct {
+	m        *InterfaceMonitor
+	path     string
+	listener *net.UnixListener
+
+	lock   sync.Mutex
+	conns  map[*eventStreamConn]bool
+	closed bool
+}
+
+// startEventStream starts listening on the EventStreamSocket, if configured.  The socket is
+// only accessible to our user.
+func (m *InterfaceMonitor) startEventStream() *eventStreamServer {
+	if m.EventStreamSocket == "" {
+		return nil
+	}
+	logCxt := log.WithField("socket", m.EventStreamSocket)
+	listener, err := listenUnixPrivate(m.EventStreamSocket)
+	if err != nil {
+		logCxt.WithError(err).Warn("Failed to set up socket, not serving the event stream.")
+		return nil
+	}
+	s := &eventStreamServer{
+		m:        m,
+		path:     m.EventStreamSocket,
+		listener: listener,
+		conns:    map[*eventStreamConn]bool{},
+	}
+	logCxt.Info("Serving interface event stream.")
+	go s.loopAccepting()
+	return s
+}
+
+// listenUnixPrivate listens on a unix socket at path, replacing any existing file there, that
+// only our user can connect to.  The socket is bound to a temporary name and only moved into
+// place once its permissions have been restricted, so that no one can connect in between.
+func listenUnixPrivate(path string) (*net.UnixListener, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove old socket: %w", err)
+	}
+	// In the same directory so that the rename can't cross filesystems.
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".sock-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary dir: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	tmpPath := filepath.Join(dir, "sock")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmpPath, Net: "unix"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+	listener.SetUnlinkOnClose(false)
+	if err := os.Chmod(tmpPath, 0600); err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		_ = listener.Close()
+		return nil, fmt.Errorf("failed to move socket into place: %w", err)
+	}
+	return listener, nil
+}
+
+func (s *eventStreamServer) loopAccepting() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			s.lock.Lock()
+			closed := s.closed
+			s.lock.Unlock()
+			if !closed {
+				log.WithError(err).Warn("Failed to accept event stream connection, no longer serving the event stream.")
+			}
+			return
+		}
+		s.serve(conn)
+	}
+}
+
+func (s *eventStreamServer) serve(conn net.Conn) {
+	maxQueueLen := s.m.EventStreamQueueLen
+	if maxQueueLen <= 0 {
+		maxQueueLen = defaultEventStreamQueueLen
+	}
+	c := &eventStreamConn{
+		m:           s.m,
+		conn:        conn,
+		maxQueueLen: maxQueueLen,
+		wakeC:       make(chan struct{}, 1),
+		stopC:       make(chan struct{}),
+	}
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		_ = conn.Close()
+		return
+	}
+	s.conns[c] = true
+	s.lock.Unlock()
+	log.Info("Event stream client connected.")
+
+	go func() {
+		// We don't expect the client to send anything; reading tells us when it goes away.
+		_, _ = io.Copy(ioutil.Discard, conn)
+		c.close()
+	}()
+	go func() {
+		c.loopWriting()
+		c.close()
+		s.lock.Lock()
+		delete(s.conns, c)
+		s.lock.Unlock()
+		log.Info("Event stream client disconnected.")
+	}()
+	// Since the subscriber's callbacks only start once it's registered, the snapshot-start
+	// event comes first.
+	c.enqueue(&StreamEvent{Type: StreamEventSnapshotStart})
+	unsubscribe := s.m.Subscribe(Subscriber{
+		StateOriginCallback: c.onIfaceStateChange,
+		AddrOriginCallback:  c.onIfaceAddrsChange,
+		SnapshotDoneCallback: func() {
+			c.enqueue(&StreamEvent{Type: StreamEventSnapshotEnd})
+		},
+	}, true)
+	go func() {
+		<-c.stopC
+		unsubscribe()
+	}()
+}
+
+// close stops serving the event stream and disconnects the clients.
+func (s *eventStreamServer) close() {
+	s.lock.Lock()
+	s.closed = true
+	conns := s.conns
+	s.conns = map[*eventStreamConn]bool{}
+	s.lock.Unlock()
+	_ = s.listener.Close()
+	if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+		log.WithError(err).WithField("socket", s.path).Warn("Failed to remove event stream socket.")
+	}
+	for c := range conns {
+		c.close()
+	}
+}
+
+// eventStreamConn is a connection to an event stream client.  Events are queued, up to
+// maxQueueLen, and written from a separate goroutine.  If the queue is full, the oldest event is
+// dropped.
+type eventStreamConn struct {
+	m           *InterfaceMonitor
+	conn        net.Conn
+	maxQueueLen int
+
+	lock       sync.Mutex
+	queue      []*StreamEvent
+	numDropped uint64
+	wakeC      chan struct{}
+
+	stopC    chan struct{}
+	stopOnce sync.Once
+}
+
+func (c *eventStreamConn) onIfaceStateChange(ifaceName string, state State, ifIndex int, origin UpdateOrigin) {
+	c.enqueue(&StreamEvent{
+		Type:   StreamEventState,
+		Name:   ifaceName,
+		Index:  ifIndex,
+		State:  state,
+		Origin: origin,
+	})
+}
+
+func (c *eventStreamConn) onIfaceAddrsChange(ifaceName string, addrs set.Set, origin UpdateOrigin) {
+	event := &StreamEvent{
+		Type:   StreamEventAddrs,
+		Name:   ifaceName,
+		Gone:   addrs == nil,
+		Origin: origin,
+	}
+	if addrs != nil {
+		addrs.Iter(func(item interface{}) error {
+			event.Addrs = append(event.Addrs, item.(string))
+			return nil
+		})
+		sort.Strings(event.Addrs)
+	}
+	c.enqueue(event)
+}
+
+func (c *eventStreamConn) enqueue(event *StreamEvent) {
+	event.Time = c.m.time.Now()
+	c.lock.Lock()
+	if len(c.queue) >= c.maxQueueLen {
+		c.queue = c.queue[1:]
+		c.numDropped++
+	}
+	c.queue = append(c.queue, event)
+	c.lock.Unlock()
+	select {
+	case c.wakeC <- struct{}{}:
+	default:
+		// Writer already has a wake-up pending.
+	}
+}
+
+func (c *eventStreamConn) loopWriting() {
+	enc := json.NewEncoder(c.conn)
+	for {
+		c.lock.Lock()
+		batch := c.queue
+		c.queue = nil
+		numDropped := c.numDropped
+		c.numDropped = 0
+		c.lock.Unlock()
+
+		if numDropped > 0 {
+			log.WithField("numDropped", numDropped).Warn("Event stream client fell behind, dropped events.")
+			batch = append([]*StreamEvent{{
+				Type:    StreamEventDropped,
+				Time:    c.m.time.Now(),
+				Dropped: numDropped,
+			}}, batch...)
+		}
+		for _, event := range batch {
+			if err := enc.Encode(event); err != nil {
+				log.WithError(err).Info("Failed to write to event stream client.")
+				return
+			}
+		}
+		if len(batch) > 0 {
+			continue
+		}
+
+		select {
+		case <-c.wakeC:
+		case <-c.stopC:
+			return
+		}
+	}
+}
+
+func (c *eventStreamConn) close() {
+	c.stopOnce.Do(func() {
+		close(c.stopC)
+		_ = c.conn.Close()
+	})
+}
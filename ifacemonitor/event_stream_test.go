@@ -0,0 +1,165 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/timeshim/mocktime"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Event stream", func() {
+	var nl *netlinkTest
+	var im *ifacemonitor.InterfaceMonitor
+	var dir, socketPath string
+	var addrsDone chan string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "ifacemonitor-test")
+		Expect(err).NotTo(HaveOccurred())
+		socketPath = filepath.Join(dir, "events.sock")
+
+		// The callback sends on its own channel, since the previous spec's monitor can still be
+		// calling back while we replace addrsDone.
+		done := make(chan string, 1000)
+		addrsDone = done
+		im, nl, _ = startMonitor(ifacemonitor.Config{
+			EventStreamSocket:   socketPath,
+			EventStreamQueueLen: 5,
+		}, func(nl *netlinkTest, im *ifacemonitor.InterfaceMonitor) {
+			setLinkNoSignal(nl, "eth0", "up", "10.0.0.1/32")
+			im.StateCallback = func(ifaceName string, state ifacemonitor.State, ifIndex int) {}
+			im.AddrCallback = func(ifaceName string, addrs set.Set) {
+				if addrs != nil {
+					done <- fmt.Sprintf("%s %d", ifaceName, addrs.Len())
+				}
+			}
+		}, withMonitorOps(ifacemonitor.WithMonitorTimeShim(mocktime.New())))
+	})
+
+	AfterEach(func() {
+		im.Stop()
+		Eventually(func() bool {
+			_, err := os.Stat(socketPath)
+			return os.IsNotExist(err)
+		}).Should(BeTrue(), "Socket should be removed when the monitor stops")
+		_ = os.RemoveAll(dir)
+	})
+
+	connect := func() (net.Conn, *bufio.Scanner) {
+		var conn net.Conn
+		Eventually(func() (err error) {
+			conn, err = net.Dial("unix", socketPath)
+			return
+		}).Should(Succeed())
+		scanner := bufio.NewScanner(conn)
+		scanner.Buffer(nil, 1<<20)
+		return conn, scanner
+	}
+
+	// nextEvent reads the next event, without its timestamp.
+	nextEvent := func(scanner *bufio.Scanner) ifacemonitor.StreamEvent {
+		ExpectWithOffset(1, scanner.Scan()).To(BeTrue(), fmt.Sprintf("Failed to read event: %v", scanner.Err()))
+		var event ifacemonitor.StreamEvent
+		ExpectWithOffset(1, json.Unmarshal(scanner.Bytes(), &event)).To(Succeed())
+		event.Time = time.Time{}
+		return event
+	}
+
+	It("should only be accessible to our user", func() {
+		Eventually(func() (os.FileMode, error) {
+			info, err := os.Stat(socketPath)
+			if err != nil {
+				return 0, err
+			}
+			return info.Mode().Perm(), nil
+		}).Should(Equal(os.FileMode(0600)))
+	})
+
+	It("should stream a snapshot followed by live updates", func() {
+		conn, scanner := connect()
+		defer conn.Close()
+		Expect(nextEvent(scanner)).To(Equal(ifacemonitor.StreamEvent{Type: "snapshot-start"}))
+		Expect(nextEvent(scanner)).To(Equal(ifacemonitor.StreamEvent{Type: "state", Name: "eth0", Index: 10, State: "up", Origin: "replay"}))
+		Expect(nextEvent(scanner)).To(Equal(ifacemonitor.StreamEvent{Type: "addrs", Name: "eth0", Addrs: []string{"10.0.0.1"}, Origin: "replay"}))
+		Expect(nextEvent(scanner)).To(Equal(ifacemonitor.StreamEvent{Type: "snapshot-end"}))
+
+		nl.addLink("cali1")
+		Expect(nextEvent(scanner)).To(Equal(ifacemonitor.StreamEvent{Type: "addrs", Name: "cali1", Origin: "event"}))
+		nl.changeLinkState("cali1", "up")
+		Expect(nextEvent(scanner)).To(Equal(ifacemonitor.StreamEvent{Type: "state", Name: "cali1", Index: 11, State: "up", Origin: "event"}))
+		nl.addAddr("cali1", "10.0.1.1/32")
+		Expect(nextEvent(scanner)).To(Equal(ifacemonitor.StreamEvent{Type: "addrs", Name: "cali1", Addrs: []string{"10.0.1.1"}, Origin: "event"}))
+		nl.delLink("cali1")
+		Expect(nextEvent(scanner)).To(Equal(ifacemonitor.StreamEvent{Type: "addrs", Name: "cali1", Gone: true, Origin: "event"}))
+		Expect(nextEvent(scanner)).To(Equal(ifacemonitor.StreamEvent{Type: "state", Name: "cali1", Index: 11, State: "down", Origin: "event"}))
+
+		// The stream is read-only; anything the client sends is ignored.
+		_, err := conn.Write([]byte("hello\n"))
+		Expect(err).NotTo(HaveOccurred())
+		nl.changeLinkState("eth0", "down")
+		Expect(nextEvent(scanner)).To(Equal(ifacemonitor.StreamEvent{Type: "state", Name: "eth0", Index: 10, State: "down", Origin: "event"}))
+	})
+
+	It("should drop the oldest events for a stalled client without holding up the monitor", func() {
+		stalledConn, stalledScanner := connect()
+		defer stalledConn.Close()
+		conn, scanner := connect()
+		defer conn.Close()
+		for nextEvent(scanner).Type != "snapshot-end" {
+		}
+
+		// Each update carries all the interface's addresses so the stalled client's socket
+		// buffer soon fills up.
+		const numAddrs = 500
+		for i := 0; i < numAddrs; i++ {
+			nl.addAddr("eth0", fmt.Sprintf("10.1.%d.%d/32", i/256, i%256))
+			Eventually(addrsDone).Should(Receive(Equal(fmt.Sprintf("eth0 %d", i+2))))
+			// The other client keeps up.
+			Expect(nextEvent(scanner).Addrs).To(HaveLen(i + 2))
+		}
+
+		// When the stalled client catches up, it's told that it missed some updates and the
+		// newest ones are still there.
+		var lastEvent ifacemonitor.StreamEvent
+		var numDropped uint64
+		for len(lastEvent.Addrs) < numAddrs+1 {
+			lastEvent = nextEvent(stalledScanner)
+			if lastEvent.Type == "dropped" {
+				numDropped += lastEvent.Dropped
+			}
+		}
+		Expect(numDropped).To(BeNumerically(">", 0))
+		Expect(lastEvent.Name).To(Equal("eth0"))
+		Expect(strings.Join(lastEvent.Addrs, ",")).To(ContainSubstring("10.1.1.243"))
+	})
+})
@@ -0,0 +1,245 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"regexp"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+const defaultExpectedIfaceTimeout = time.Minute
+
+// ExpectedIface declares an interface that should exist and be up, for example tunl0 when IPIP
+// is enabled; see SetExpectedIfaces.
+type ExpectedIface struct {
+	// Name identifies the declaration.  If Pattern is nil, it's also the name of the interface.
+	Name string
+	// Pattern, if non-nil, matches the names of the interfaces that satisfy the declaration;
+	// any one of them being up will do.
+	Pattern *regexp.Regexp
+	// Timeout is how long the interface has to come up, from the monitor's start-of-day resync
+	// or from the declaration, whichever is later, or from it going down.  If <=0, defaults to
+	// 1 minute.
+	Timeout time.Duration
+}
+
+func (e ExpectedIface) matches(ifaceName string) bool {
+	if e.Pattern == nil {
+		return ifaceName == e.Name
+	}
+	return e.Pattern.MatchString(ifaceName)
+}
+
+func (e ExpectedIface) timeout() time.Duration {
+	if e.Timeout <= 0 {
+		return defaultExpectedIfaceTimeout
+	}
+	return e.Timeout
+}
+
+func (e ExpectedIface) sameAs(other ExpectedIface) bool {
+	if (e.Pattern == nil) != (other.Pattern == nil) {
+		return false
+	}
+	if e.Pattern != nil && e.Pattern.String() != other.Pattern.String() {
+		return false
+	}
+	return e.Name == other.Name && e.timeout() == other.timeout()
+}
+
+// ExpectedIfaceCallback is called when an expected interface is found to be missing (missing is
+// true), that is, it didn't come up within its timeout, and again when it finally comes up.
+type ExpectedIfaceCallback func(name string, missing bool)
+
+type expectedIface struct {
+	ExpectedIface
+	// upNames holds the names of the up interfaces that satisfy the declaration.
+	upNames set.Set
+	// deadline is when we flag the interface as missing if it still isn't up.  Zero if it's up,
+	// or we haven't done the start-of-day resync yet.
+	deadline time.Time
+	missing  bool
+}
+
+// SetExpectedIfaces replaces the set of expected interfaces.  If an expected interface isn't up
+// within its timeout, it's logged, passed to the ExpectedIfaceCallback, counted in a gauge and
+// returned by MissingExpectedIfaces until it comes up.  Declarations that are unchanged keep
+// their state; the others start afresh.  Safe to call from any goroutine, before or after the
+// monitor starts.
+func (m *InterfaceMonitor) SetExpectedIfaces(expected []ExpectedIface) {
+	m.runOnMonitorLoop(func() {
+		now := m.time.Now()
+		old := m.expectedIfaces
+		m.expectedIfaces = map[string]*expectedIface{}
+		for _, decl := range expected {
+			if e := old[decl.Name]; e != nil && e.sameAs(decl) {
+				m.expectedIfaces[decl.Name] = e
+				delete(old, decl.Name)
+				continue
+			}
+			e := &expectedIface{ExpectedIface: decl, upNames: set.New()}
+			for ifaceName := range m.upIfaces {
+				if decl.matches(ifaceName) {
+					e.upNames.Add(ifaceName)
+				}
+			}
+			if e.upNames.Len() == 0 && m.startOfDayResyncDone {
+				e.deadline = now.Add(decl.timeout())
+			}
+			m.expectedIfaces[decl.Name] = e
+		}
+		for name, e := range old {
+			if e.missing {
+				log.WithField("name", name).Info("Missing interface is no longer expected.")
+			}
+		}
+		m.updateMissingExpectedIfaces()
+	})
+}
+
+// MissingExpectedIfaces returns the names of the expected interfaces (see SetExpectedIfaces)
+// that are missing, in order.  Safe to call from any goroutine.
+func (m *InterfaceMonitor) MissingExpectedIfaces() (names []string) {
+	m.runOnMonitorLoop(func() {
+		for name, e := range m.expectedIfaces {
+			if e.missing {
+				names = append(names, name)
+			}
+		}
+	})
+	sort.Strings(names)
+	return
+}
+
+// startExpectedIfaceTimeouts is called after the start-of-day resync to start the timeouts of
+// the expected interfaces that were declared before.
+func (m *InterfaceMonitor) startExpectedIfaceTimeouts() {
+	now := m.time.Now()
+	for _, e := range m.expectedIfaces {
+		if e.upNames.Len() == 0 && e.deadline.IsZero() {
+			e.deadline = now.Add(e.timeout())
+		}
+	}
+	m.scheduleExpectedIfaceTimer()
+}
+
+// onExpectedIfaceState is called for each state notification.
+func (m *InterfaceMonitor) onExpectedIfaceState(ifaceName string, state State) {
+	changed := false
+	for name, e := range m.expectedIfaces {
+		if !e.matches(ifaceName) {
+			continue
+		}
+		wasUp := e.upNames.Len() > 0
+		if state == StateUp {
+			e.upNames.Add(ifaceName)
+		} else {
+			e.upNames.Discard(ifaceName)
+		}
+		isUp := e.upNames.Len() > 0
+		if isUp == wasUp {
+			continue
+		}
+		changed = true
+		logCxt := log.WithFields(log.Fields{"name": name, "ifaceName": ifaceName})
+		if !isUp {
+			logCxt.Info("Expected interface went down, starting timeout.")
+			e.deadline = m.time.Now().Add(e.timeout())
+			continue
+		}
+		e.deadline = time.Time{}
+		if !e.missing {
+			continue
+		}
+		logCxt.Info("Missing expected interface has come up.")
+		e.missing = false
+		if m.ExpectedIfaceCallback != nil {
+			m.ExpectedIfaceCallback(name, false)
+		}
+	}
+	if changed && m.startOfDayResyncDone {
+		m.updateMissingExpectedIfaces()
+	}
+}
+
+// checkExpectedIfaces is called when the timer fires; it flags the expected interfaces whose
+// timeouts have expired.
+func (m *InterfaceMonitor) checkExpectedIfaces() {
+	now := m.time.Now()
+	var expired []string
+	for name, e := range m.expectedIfaces {
+		if !e.missing && !e.deadline.IsZero() && !e.deadline.After(now) {
+			expired = append(expired, name)
+		}
+	}
+	sort.Strings(expired)
+	for _, name := range expired {
+		e := m.expectedIfaces[name]
+		log.WithFields(log.Fields{
+			"name":    name,
+			"pattern": e.Pattern,
+			"timeout": e.timeout(),
+		}).Warn("Expected interface is missing or down.")
+		e.missing = true
+		e.deadline = time.Time{}
+		if m.ExpectedIfaceCallback != nil {
+			m.ExpectedIfaceCallback(name, true)
+		}
+	}
+	m.updateMissingExpectedIfaces()
+}
+
+// updateMissingExpectedIfaces updates the gauge and (re)schedules the timer.
+func (m *InterfaceMonitor) updateMissingExpectedIfaces() {
+	numMissing := 0
+	for _, e := range m.expectedIfaces {
+		if e.missing {
+			numMissing++
+		}
+	}
+	m.metrics.missingExpectedIfaces.Set(float64(numMissing))
+	m.scheduleExpectedIfaceTimer()
+}
+
+// scheduleExpectedIfaceTimer (re)starts the timer for the earliest deadline, or stops it if
+// there are none.
+func (m *InterfaceMonitor) scheduleExpectedIfaceTimer() {
+	if m.expectedIfaceTimer != nil {
+		m.expectedIfaceTimer.Stop()
+		m.expectedIfaceTimer = nil
+		m.expectedIfaceTimerC = nil
+	}
+	var earliest time.Time
+	for _, e := range m.expectedIfaces {
+		if e.deadline.IsZero() {
+			continue
+		}
+		if earliest.IsZero() || e.deadline.Before(earliest) {
+			earliest = e.deadline
+		}
+	}
+	if earliest.IsZero() {
+		return
+	}
+	m.expectedIfaceTimer = m.time.NewTimer(m.time.Until(earliest))
+	m.expectedIfaceTimerC = m.expectedIfaceTimer.Chan()
+}
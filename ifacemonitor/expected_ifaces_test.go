@@ -0,0 +1,142 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ifacemonitor/testutils"
+	"github.com/projectcalico/felix/timeshim/mocktime"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Expected interfaces", func() {
+	var nl *netlinkTest
+	var mockTime *mocktime.MockTime
+	var im *ifacemonitor.InterfaceMonitor
+	var recorder *testutils.Recorder
+	var lock sync.Mutex
+	var notifications []string
+
+	getNotifications := func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string(nil), notifications...)
+	}
+
+	BeforeEach(func() {
+		mockTime = mocktime.New()
+		lock.Lock()
+		notifications = nil
+		lock.Unlock()
+		im, nl, recorder = startMonitor(ifacemonitor.Config{}, func(nl *netlinkTest, im *ifacemonitor.InterfaceMonitor) {
+			setLinkNoSignal(nl, "eth0", "up")
+			im.ExpectedIfaceCallback = func(name string, missing bool) {
+				lock.Lock()
+				defer lock.Unlock()
+				notifications = append(notifications, fmt.Sprintf("%s missing=%v", name, missing))
+			}
+			im.SetExpectedIfaces([]ifacemonitor.ExpectedIface{
+				{Name: "tunl0", Timeout: 30 * time.Second},
+				{Name: "uplink", Pattern: regexp.MustCompile("^eth"), Timeout: 30 * time.Second},
+			})
+		}, withMonitorOps(ifacemonitor.WithMonitorTimeShim(mockTime)))
+		recorder.ExpectState("eth0", ifacemonitor.StateUp)
+		// The timeouts start after the start-of-day resync.
+		Eventually(mockTime.HasTimers).Should(BeTrue())
+	})
+
+	AfterEach(func() {
+		im.Stop()
+	})
+
+	It("should flag an interface that never arrives", func() {
+		mockTime.IncrementTime(29 * time.Second)
+		Consistently(getNotifications, "50ms").Should(BeEmpty())
+		Expect(im.MissingExpectedIfaces()).To(BeEmpty())
+
+		mockTime.IncrementTime(time.Second)
+		Eventually(getNotifications).Should(Equal([]string{"tunl0 missing=true"}))
+		Expect(im.MissingExpectedIfaces()).To(Equal([]string{"tunl0"}))
+
+		// Only flagged once.
+		mockTime.IncrementTime(time.Hour)
+		Consistently(getNotifications, "50ms").Should(HaveLen(1))
+	})
+
+	It("should notify when a missing interface arrives late", func() {
+		mockTime.IncrementTime(30 * time.Second)
+		Eventually(getNotifications).Should(Equal([]string{"tunl0 missing=true"}))
+
+		setLinkNoSignal(nl, "tunl0", "up")
+		nl.signalLink("tunl0", 0)
+		Eventually(getNotifications).Should(Equal([]string{"tunl0 missing=true", "tunl0 missing=false"}))
+		Expect(im.MissingExpectedIfaces()).To(BeEmpty())
+	})
+
+	It("should not flag an interface that arrives within its timeout", func() {
+		mockTime.IncrementTime(20 * time.Second)
+		setLinkNoSignal(nl, "tunl0", "up")
+		nl.signalLink("tunl0", 0)
+		recorder.ExpectState("tunl0", ifacemonitor.StateUp)
+		mockTime.IncrementTime(time.Hour)
+		Consistently(getNotifications, "50ms").Should(BeEmpty())
+	})
+
+	It("should flag an interface that appears and then disappears", func() {
+		nl.changeLinkState("eth0", "down")
+		recorder.ExpectState("eth0", ifacemonitor.StateDown)
+		setLinkNoSignal(nl, "tunl0", "up")
+		nl.signalLink("tunl0", 0)
+		recorder.ExpectState("tunl0", ifacemonitor.StateUp)
+
+		// The timeout runs from when eth0 went down.
+		mockTime.IncrementTime(30 * time.Second)
+		Eventually(getNotifications).Should(Equal([]string{"uplink missing=true"}))
+
+		nl.delLink("tunl0")
+		recorder.ExpectState("tunl0", ifacemonitor.StateDown)
+		mockTime.IncrementTime(30 * time.Second)
+		Eventually(getNotifications).Should(Equal([]string{"uplink missing=true", "tunl0 missing=true"}))
+		Expect(im.MissingExpectedIfaces()).To(Equal([]string{"tunl0", "uplink"}))
+	})
+
+	It("should handle declarations that change at runtime", func() {
+		mockTime.IncrementTime(20 * time.Second)
+		im.SetExpectedIfaces([]ifacemonitor.ExpectedIface{
+			// Unchanged, so the timeout still runs from start of day.
+			{Name: "tunl0", Timeout: 30 * time.Second},
+			{Name: "vxlan.calico", Timeout: 30 * time.Second},
+		})
+		mockTime.IncrementTime(10 * time.Second)
+		Eventually(getNotifications).Should(Equal([]string{"tunl0 missing=true"}))
+
+		// The new declaration's timeout runs from when it was made.
+		mockTime.IncrementTime(20 * time.Second)
+		Eventually(getNotifications).Should(HaveLen(2))
+		Expect(getNotifications()[1]).To(Equal("vxlan.calico missing=true"))
+
+		im.SetExpectedIfaces(nil)
+		Expect(im.MissingExpectedIfaces()).To(BeEmpty())
+	})
+})
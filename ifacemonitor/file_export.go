@@ -0,0 +1,314 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+const (
+	defaultExportCoalesceInterval = 500 * time.Millisecond
+
+	exportIfacePrefix = "iface-"
+	exportIfaceSuffix = ".json"
+	exportSummaryFile = "summary.json"
+	exportTmpPrefix   = ".tmp-"
+	exportFileMode    = 0644
+	exportDirFileMode = 0755
+)
+
+// ExportedIface is the contents of an interface's file in the Config.ExportDir.
+type ExportedIface struct {
+	Name  string `json:"name"`
+	Index int    `json:"index"`
+	State State  `json:"state"`
+	// Addrs is nil if we don't track the interface's addresses.
+	Addrs []string `json:"addrs"`
+	// StateChangedAt is when we first exported the interface's current state; UpdatedAt is
+	// when we last changed the file.
+	StateChangedAt time.Time `json:"state_changed_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// ExportSummary is the contents of the summary file in the Config.ExportDir.  It's rewritten
+// after each batch of changes to the interface files; Seq counts the rewrites.
+type ExportSummary struct {
+	Seq        uint64           `json:"seq"`
+	UpdatedAt  time.Time        `json:"updated_at"`
+	Interfaces map[string]State `json:"interfaces"`
+}
+
+// fileExporter maintains the ExportDir.  It subscribes to our updates just to find out when
+// something has changed; after waiting for the coalesce interval, it takes our view of the
+// interfaces from the monitor's goroutine and writes out the files that differ.
+type fileExporter struct {
+	m        *InterfaceMonitor
+	dir      string
+	interval time.Duration
+
+	// exported holds what we last wrote for each interface, by name.  Only accessed from the
+	// writing goroutine.
+	exported map[string]ExportedIface
+	// leftovers holds the names of the interface files that were in the directory when we
+	// started, until the first batch has been written.
+	leftovers set.Set
+	seq       uint64
+
+	// sub tells us when something has changed.
+	sub *subscription
+
+	wakeC chan struct{}
+	stopC chan struct{}
+	doneC chan struct{}
+}
+
+// startFileExporter starts maintaining the ExportDir, if configured.  Must be called from the
+// monitor's goroutine.
+func (m *InterfaceMonitor) startFileExporter() *fileExporter {
+	if m.ExportDir == "" {
+		return nil
+	}
+	logCxt := log.WithField("dir", m.ExportDir)
+	if err := os.MkdirAll(m.ExportDir, exportDirFileMode); err != nil {
+		logCxt.WithError(err).Warn("Failed to create interface export directory, not exporting.")
+		return nil
+	}
+	interval := m.ExportCoalesceInterval
+	if interval <= 0 {
+		interval = defaultExportCoalesceInterval
+	}
+	e := &fileExporter{
+		m:         m,
+		dir:       m.ExportDir,
+		interval:  interval,
+		exported:  map[string]ExportedIface{},
+		leftovers: set.New(),
+		wakeC:     make(chan struct{}, 1),
+		stopC:     make(chan struct{}),
+		doneC:     make(chan struct{}),
+	}
+	e.scanLeftovers()
+	// Make sure that we write out the first batch even if there are no interfaces.
+	e.wake()
+	go e.loopWriting()
+	e.sub = newSubscription(Subscriber{
+		StateCallback: func(ifaceName string, state State, ifIndex int) {
+			e.wake()
+		},
+		AddrCallback: func(ifaceName string, addrs set.Set) {
+			e.wake()
+		},
+	})
+	m.registerSubscription(e.sub, false)
+	logCxt.Info("Exporting interfaces to directory.")
+	return e
+}
+
+// scanLeftovers removes the temporary files from a previous run and notes its interface files.
+func (e *fileExporter) scanLeftovers() {
+	files, err := ioutil.ReadDir(e.dir)
+	if err != nil {
+		log.WithError(err).WithField("dir", e.dir).Warn("Failed to list interface export directory.")
+		return
+	}
+	for _, f := range files {
+		name := f.Name()
+		if strings.HasPrefix(name, exportTmpPrefix) {
+			e.removeFile(name)
+		} else if strings.HasPrefix(name, exportIfacePrefix) && strings.HasSuffix(name, exportIfaceSuffix) {
+			e.leftovers.Add(name)
+		}
+	}
+}
+
+func (e *fileExporter) wake() {
+	select {
+	case e.wakeC <- struct{}{}:
+	default:
+		// Writer already has a wake-up pending.
+	}
+}
+
+func (e *fileExporter) loopWriting() {
+	defer close(e.doneC)
+	for {
+		select {
+		case <-e.wakeC:
+		case <-e.stopC:
+			return
+		}
+		// Batch up any other changes that are on their way.
+		select {
+		case <-e.m.time.After(e.interval):
+		case <-e.stopC:
+			return
+		}
+		statuses, ok := e.readStatuses()
+		if !ok {
+			return
+		}
+		e.writeChanges(statuses)
+	}
+}
+
+// readStatuses gets our view of the interfaces from the monitor's goroutine.  Returns false if
+// the monitor or the exporter stops first.
+func (e *fileExporter) readStatuses() (statuses []InterfaceStatus, ok bool) {
+	doneC := make(chan struct{})
+	select {
+	case e.m.loopFuncC <- func() {
+		statuses = e.m.interfaceStatuses()
+		close(doneC)
+	}:
+		<-doneC
+		return statuses, true
+	case <-e.m.stopC:
+	case <-e.stopC:
+	}
+	return nil, false
+}
+
+// writeChanges writes the files for the interfaces that have changed since the last batch and
+// removes those for the interfaces that have gone, then updates the summary.
+func (e *fileExporter) writeChanges(statuses []InterfaceStatus) {
+	now := e.m.time.Now()
+	changed := false
+	present := set.New()
+	for _, status := range statuses {
+		if status.Excluded {
+			continue
+		}
+		present.Add(status.Name)
+		iface := ExportedIface{
+			Name:           status.Name,
+			Index:          status.Index,
+			State:          status.State,
+			Addrs:          status.Addrs,
+			StateChangedAt: now,
+			UpdatedAt:      now,
+		}
+		last, known := e.exported[status.Name]
+		if known && last.State == iface.State {
+			iface.StateChangedAt = last.StateChangedAt
+		}
+		if known && last.Index == iface.Index && last.State == iface.State &&
+			(last.Addrs == nil) == (iface.Addrs == nil) && stringSlicesEqual(last.Addrs, iface.Addrs) {
+			continue
+		}
+		if err := e.writeFile(exportIfaceFile(status.Name), &iface); err != nil {
+			// Leave e.exported alone so that we try again next time.
+			continue
+		}
+		e.exported[status.Name] = iface
+		changed = true
+	}
+	for name := range e.exported {
+		if !present.Contains(name) {
+			e.removeFile(exportIfaceFile(name))
+			delete(e.exported, name)
+			changed = true
+		}
+	}
+	if e.leftovers != nil {
+		e.leftovers.Iter(func(item interface{}) error {
+			file := item.(string)
+			ifaceName := strings.TrimSuffix(strings.TrimPrefix(file, exportIfacePrefix), exportIfaceSuffix)
+			if _, known := e.exported[ifaceName]; !known {
+				e.removeFile(file)
+			}
+			return nil
+		})
+		e.leftovers = nil
+		changed = true
+	}
+	if !changed {
+		return
+	}
+	summary := ExportSummary{
+		Seq:        e.seq + 1,
+		UpdatedAt:  now,
+		Interfaces: map[string]State{},
+	}
+	for name, iface := range e.exported {
+		summary.Interfaces[name] = iface.State
+	}
+	if err := e.writeFile(exportSummaryFile, &summary); err == nil {
+		e.seq++
+	}
+}
+
+func exportIfaceFile(ifaceName string) string {
+	return exportIfacePrefix + ifaceName + exportIfaceSuffix
+}
+
+// writeFile replaces a file in the directory atomically, by writing a temporary file and
+// renaming it into place, so that readers never see a partial file.
+func (e *fileExporter) writeFile(name string, v interface{}) error {
+	logCxt := log.WithField("file", filepath.Join(e.dir, name))
+	data, err := json.Marshal(v)
+	if err != nil {
+		logCxt.WithError(err).Warn("Failed to serialize exported interface file.")
+		return err
+	}
+	f, err := ioutil.TempFile(e.dir, exportTmpPrefix)
+	if err != nil {
+		logCxt.WithError(err).Warn("Failed to create temporary file for exported interface file.")
+		return err
+	}
+	tmpName := f.Name()
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpName, exportFileMode)
+	}
+	if err == nil {
+		err = os.Rename(tmpName, filepath.Join(e.dir, name))
+	}
+	if err != nil {
+		logCxt.WithError(err).Warn("Failed to write exported interface file.")
+		_ = os.Remove(tmpName)
+		return err
+	}
+	logCxt.Debug("Wrote exported interface file.")
+	return nil
+}
+
+func (e *fileExporter) removeFile(name string) {
+	path := filepath.Join(e.dir, name)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.WithError(err).WithField("file", path).Warn("Failed to remove exported interface file.")
+	}
+}
+
+// close stops maintaining the directory; the files are left as they are.  Must be called from
+// the monitor's goroutine.
+func (e *fileExporter) close() {
+	e.m.unregisterSubscription(e.sub)
+	close(e.stopC)
+	<-e.doneC
+}
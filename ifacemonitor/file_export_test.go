@@ -0,0 +1,214 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Exporting to files", func() {
+	var dir string
+	var nl *netlinkTest
+	var resyncC chan time.Time
+	var im *ifacemonitor.InterfaceMonitor
+	var doneC chan struct{}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "ifacemonitor-export")
+		Expect(err).NotTo(HaveOccurred())
+		resyncC = make(chan time.Time)
+	})
+
+	// start runs the monitor with eth0 and cali1, and whatever else addLinks adds, in the
+	// start-of-day resync.
+	start := func(coalesceInterval time.Duration, addLinks func(nl *netlinkTest)) {
+		doneC = make(chan struct{})
+		im, nl, _ = startMonitor(ifacemonitor.Config{
+			InterfaceExcludes:      []*regexp.Regexp{regexp.MustCompile("^kube-ipvs0$")},
+			ExportDir:              dir,
+			ExportCoalesceInterval: coalesceInterval,
+		}, func(nl *netlinkTest, im *ifacemonitor.InterfaceMonitor) {
+			setLinkNoSignal(nl, "eth0", "up", "10.0.0.1/32")
+			setLinkNoSignal(nl, "cali1", "down")
+			if addLinks != nil {
+				addLinks(nl)
+			}
+		}, withResyncC(resyncC), withDoneC(doneC))
+	}
+
+	AfterEach(func() {
+		im.Stop()
+		Eventually(doneC).Should(BeClosed())
+		_ = os.RemoveAll(dir)
+	})
+
+	readIface := func(name string) (iface ifacemonitor.ExportedIface, err error) {
+		data, err := ioutil.ReadFile(filepath.Join(dir, "iface-"+name+".json"))
+		if err != nil {
+			return
+		}
+		err = json.Unmarshal(data, &iface)
+		return
+	}
+	ifaceState := func(name string) func() string {
+		return func() string {
+			iface, err := readIface(name)
+			if err != nil {
+				return err.Error()
+			}
+			return fmt.Sprintf("%s %d %s %v", iface.Name, iface.Index, iface.State, iface.Addrs)
+		}
+	}
+	readSummary := func() (summary ifacemonitor.ExportSummary, err error) {
+		data, err := ioutil.ReadFile(filepath.Join(dir, "summary.json"))
+		if err != nil {
+			return
+		}
+		err = json.Unmarshal(data, &summary)
+		return
+	}
+	summarySeq := func() uint64 {
+		summary, _ := readSummary()
+		return summary.Seq
+	}
+	files := func() (names []string) {
+		infos, err := ioutil.ReadDir(dir)
+		Expect(err).NotTo(HaveOccurred())
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+		sort.Strings(names)
+		return
+	}
+
+	It("should write a file for each interface and remove it when the interface goes", func() {
+		start(10*time.Millisecond, func(nl *netlinkTest) {
+			setLinkNoSignal(nl, "kube-ipvs0", "up", "10.96.0.1/32")
+		})
+		Eventually(ifaceState("eth0")).Should(Equal("eth0 10 up [10.0.0.1]"))
+		Eventually(ifaceState("cali1")).Should(Equal("cali1 11 down []"))
+		Eventually(summarySeq).Should(BeNumerically(">", 0))
+		Expect(files()).To(Equal([]string{"iface-cali1.json", "iface-eth0.json", "summary.json"}))
+		summary, err := readSummary()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(summary.Interfaces).To(Equal(map[string]ifacemonitor.State{
+			"eth0":  ifacemonitor.StateUp,
+			"cali1": ifacemonitor.StateDown,
+		}))
+
+		nl.changeLinkState("cali1", "up")
+		Eventually(ifaceState("cali1")).Should(Equal("cali1 11 up []"))
+		cali1, err := readIface("cali1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cali1.StateChangedAt).To(Equal(cali1.UpdatedAt))
+		nl.addAddr("cali1", "10.0.1.1/32")
+		Eventually(ifaceState("cali1")).Should(Equal("cali1 11 up [10.0.1.1]"))
+		updated, err := readIface("cali1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(updated.StateChangedAt).To(Equal(cali1.StateChangedAt))
+		Expect(updated.UpdatedAt).To(BeTemporally(">", cali1.UpdatedAt))
+
+		nl.delLink("cali1")
+		Eventually(files).Should(Equal([]string{"iface-eth0.json", "summary.json"}))
+		Eventually(func() map[string]ifacemonitor.State {
+			summary, _ := readSummary()
+			return summary.Interfaces
+		}).Should(Equal(map[string]ifacemonitor.State{"eth0": ifacemonitor.StateUp}))
+	})
+
+	It("should clean up the files left by a previous run", func() {
+		for _, name := range []string{"iface-eth0.json", "iface-cali9.json", ".tmp-123", "other.txt"} {
+			Expect(ioutil.WriteFile(filepath.Join(dir, name), []byte("{}"), 0644)).To(Succeed())
+		}
+		start(10*time.Millisecond, nil)
+		Eventually(files).Should(Equal([]string{"iface-cali1.json", "iface-eth0.json", "other.txt", "summary.json"}))
+		Expect(ifaceState("eth0")()).To(Equal("eth0 10 up [10.0.0.1]"))
+	})
+
+	It("should coalesce bursts and only rewrite files that change", func() {
+		start(200*time.Millisecond, nil)
+		Eventually(summarySeq).Should(Equal(uint64(1)))
+		cali1, err := readIface("cali1")
+		Expect(err).NotTo(HaveOccurred())
+
+		for i := 1; i <= 20; i++ {
+			nl.addAddr("eth0", fmt.Sprintf("10.0.0.%d/32", i+1))
+		}
+		Eventually(ifaceState("eth0"), "2s").Should(ContainSubstring("10.0.0.21"))
+		Eventually(summarySeq).Should(BeNumerically(">", 1))
+		Consistently(summarySeq, "500ms").Should(BeNumerically("<=", 3))
+		unchanged, err := readIface("cali1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(unchanged).To(Equal(cali1))
+
+		// A resync that finds nothing new doesn't rewrite anything.
+		seq := summarySeq()
+		resyncC <- time.Now()
+		Consistently(summarySeq, "500ms").Should(Equal(seq))
+	})
+
+	It("should never expose partially-written files", func() {
+		start(time.Millisecond, nil)
+		Eventually(ifaceState("eth0")).Should(Equal("eth0 10 up [10.0.0.1]"))
+
+		var wg sync.WaitGroup
+		stopC := make(chan struct{})
+		var numBadReads, numReads int
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stopC:
+					return
+				default:
+				}
+				numReads++
+				if _, err := readIface("eth0"); err != nil {
+					numBadReads++
+				}
+				if _, err := readSummary(); err != nil {
+					numBadReads++
+				}
+			}
+		}()
+		for i := 1; i <= 50; i++ {
+			nl.addAddr("eth0", fmt.Sprintf("10.0.%d.1/32", i))
+			nl.delAddr("eth0", fmt.Sprintf("10.0.%d.1/32", i))
+		}
+		nl.addAddr("eth0", "10.0.0.2/32")
+		Eventually(ifaceState("eth0")).Should(Equal("eth0 10 up [10.0.0.1 10.0.0.2]"))
+		close(stopC)
+		wg.Wait()
+		Expect(numReads).To(BeNumerically(">", 0))
+		Expect(numBadReads).To(BeZero())
+	})
+})
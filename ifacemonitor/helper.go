@@ -0,0 +1,284 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+// HelperCommand is the argument that makes the Felix binary run as the interface monitor
+// helper: on its own, by calling HelperMain (see ExecHelper); followed by a socket path, by
+// calling HelperListenMain (see DialHelper).
+const HelperCommand = "interface-monitor-helper"
+
+// helperFD is the helper's end of the socket pair; the first of cmd.ExtraFiles.
+const helperFD = 3
+
+// helperMaxQueueLen is the number of updates that the helper queues for a slow client before
+// it drops them and resyncs the client instead.
+const helperMaxQueueLen = 1000
+
+// HelperMain is the entrypoint of the helper process started by ExecHelper.  It runs an
+// InterfaceMonitor, configured by the client, and streams its updates over the socket that
+// ExecHelper passed in.  It returns when the client closes the socket or on error.
+func HelperMain() error {
+	f := os.NewFile(helperFD, "interface-monitor-helper")
+	conn, err := net.FileConn(f)
+	_ = f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to open helper socket: %w", err)
+	}
+	return ServeHelper(conn, New)
+}
+
+// HelperListenMain is the entrypoint of a helper that is started separately from its client,
+// with its own privileges.  It listens on a unix socket at path, which only its own user can
+// connect to, and serves each client that connects (see DialHelper) with its own monitor.  It
+// only returns if it can't listen or accept connections.
+//
+// This is how the privileges are separated: the helper is started with whatever privileges the
+// monitor needs and its client can run without them.  A helper started by ExecHelper has the
+// same privileges as its client.
+func HelperListenMain(path string) error {
+	listener, err := ListenHelper(path)
+	if err != nil {
+		return err
+	}
+	log.WithField("socket", path).Info("Interface monitor helper listening for clients.")
+	return ServeHelpers(listener, New)
+}
+
+// ListenHelper listens on a unix socket at path for helper clients, replacing any existing file
+// there.  Only our own user can connect to the socket.
+func ListenHelper(path string) (net.Listener, error) {
+	listener, err := listenUnixPrivate(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on helper socket %s: %w", path, err)
+	}
+	return listener, nil
+}
+
+// ServeHelpers accepts connections on listener and serves each one with ServeHelper, in the
+// background.  It returns once accepting fails, for example because the listener was closed.
+func ServeHelpers(listener net.Listener, newMonitor func(config Config) *InterfaceMonitor) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return fmt.Errorf("failed to accept helper client: %w", err)
+		}
+		go func() {
+			if err := ServeHelper(conn, newMonitor); err != nil {
+				log.WithError(err).Warn("Interface monitor helper failed to serve client.")
+			}
+		}()
+	}
+}
+
+// ServeHelper implements the helper side of the protocol over conn: it reads the client's
+// hello, creates a monitor with newMonitor and the client's config and then sends a snapshot of
+// the interface state, followed by the live updates.  If the client falls behind, it gets a
+// fresh snapshot.  Returns nil once the client closes the connection.
+func ServeHelper(conn io.ReadWriteCloser, newMonitor func(config Config) *InterfaceMonitor) error {
+	defer conn.Close()
+
+	hello, err := readHelperHello(conn)
+	// Reply even if the client's version is wrong, so that it can report the mismatch.
+	if werr := writeHelperMsg(conn, &helperMsg{
+		Type:    helperMsgHello,
+		Version: helperProtocolVersion,
+	}); werr != nil && err == nil {
+		err = werr
+	}
+	if err != nil {
+		return err
+	}
+	if hello.Config == nil {
+		return errors.New("client's hello is missing the config")
+	}
+	config, err := hello.Config.config()
+	if err != nil {
+		return err
+	}
+
+	m := newMonitor(config)
+	m.SetCallbacks(
+		func(ifaceName string, ifaceState State, ifIndex int) {},
+		func(ifaceName string, addrs set.Set) {},
+	)
+	// Wait for the start-of-day resync before we subscribe so that the client's first snapshot
+	// is complete; otherwise a client that has restarted its helper would briefly see all its
+	// interfaces disappear.
+	resyncDoneC := make(chan struct{})
+	var resyncDoneOnce sync.Once
+	m.HeartbeatCallback = func(heartbeat Heartbeat) {
+		resyncDoneOnce.Do(func() {
+			close(resyncDoneC)
+		})
+	}
+	go m.MonitorInterfaces()
+	defer m.Stop()
+
+	// The client doesn't send anything after its hello; it closes the connection to stop us.
+	clientDoneC := make(chan error, 1)
+	go func() {
+		_, err := readHelperMsg(conn)
+		clientDoneC <- err
+	}()
+
+	select {
+	case <-resyncDoneC:
+	case err := <-clientDoneC:
+		return clientDoneErr(err)
+	}
+
+	msgC := make(chan interface{})
+	sub := m.SubscribeChannel(SubscriberFilter{}, msgC, helperMaxQueueLen)
+	defer sub.Close()
+	log.Info("Interface monitor helper sending updates to client.")
+	for {
+		select {
+		case msg := <-msgC:
+			if err := writeHelperMsg(conn, toHelperMsg(msg)); err != nil {
+				return fmt.Errorf("failed to write to client: %w", err)
+			}
+		case err := <-clientDoneC:
+			return clientDoneErr(err)
+		}
+	}
+}
+
+func clientDoneErr(err error) error {
+	if err == io.EOF {
+		log.Info("Interface monitor helper's client closed the connection.")
+		return nil
+	}
+	if err == nil {
+		return errors.New("unexpected message from client")
+	}
+	return fmt.Errorf("failed to read from client: %w", err)
+}
+
+// toHelperMsg converts a message from a ChannelSubscription to its wire form.
+func toHelperMsg(msg interface{}) *helperMsg {
+	switch msg := msg.(type) {
+	case *IfaceSnapshotStart:
+		return &helperMsg{Type: helperMsgSnapshotStart}
+	case *IfaceSnapshotEnd:
+		return &helperMsg{Type: helperMsgSnapshotEnd}
+	case *IfaceUpdate:
+		return &helperMsg{
+			Type:  helperMsgIfaceState,
+			Name:  msg.Name,
+			State: msg.State,
+			Index: msg.Index,
+		}
+	case *IfaceAddrsUpdate:
+		hm := &helperMsg{
+			Type: helperMsgIfaceAddrs,
+			Name: msg.Name,
+		}
+		if msg.Addrs != nil {
+			hm.HasAddrs = true
+			msg.Addrs.Iter(func(item interface{}) error {
+				hm.Addrs = append(hm.Addrs, item.(string))
+				return nil
+			})
+			sort.Strings(hm.Addrs)
+		}
+		return hm
+	}
+	log.WithField("msg", msg).Panic("Unexpected message from subscription.")
+	return nil
+}
+
+// helperProcess is a connection to a helper started by ExecHelper.  Closing it kills the helper.
+type helperProcess struct {
+	net.Conn
+	cmd *exec.Cmd
+}
+
+func (p *helperProcess) Close() error {
+	err := p.Conn.Close()
+	// The helper exits when it sees the connection close but it may be wedged.
+	_ = p.cmd.Process.Kill()
+	return err
+}
+
+// ExecHelper returns a HelperStarter that runs this binary, with the HelperCommand argument,
+// as the helper.  The helper's end of a unix socket pair is passed to it as fd 3.  The helper
+// is killed if we exit.  It runs with our own credentials, so it keeps the netlink code out of
+// our process but doesn't separate privileges; for that, use DialHelper.
+func ExecHelper() HelperStarter {
+	return func() (io.ReadWriteCloser, error) {
+		fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create socket pair: %w", err)
+		}
+		ourFile := os.NewFile(uintptr(fds[0]), "interface-monitor-client")
+		helperFile := os.NewFile(uintptr(fds[1]), "interface-monitor-helper")
+		defer ourFile.Close()
+
+		cmd := exec.Command("/proc/self/exe", HelperCommand)
+		cmd.ExtraFiles = []*os.File{helperFile}
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.SysProcAttr = &syscall.SysProcAttr{Pdeathsig: syscall.SIGKILL}
+		err = cmd.Start()
+		_ = helperFile.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to start helper: %w", err)
+		}
+		log.WithField("pid", cmd.Process.Pid).Info("Started interface monitor helper.")
+		go func() {
+			err := cmd.Wait()
+			log.WithError(err).WithField("pid", cmd.Process.Pid).Info("Interface monitor helper exited.")
+		}()
+
+		conn, err := net.FileConn(ourFile)
+		if err != nil {
+			_ = cmd.Process.Kill()
+			return nil, fmt.Errorf("failed to open helper socket: %w", err)
+		}
+		return &helperProcess{Conn: conn, cmd: cmd}, nil
+	}
+}
+
+// DialHelper returns a HelperStarter that connects to a helper that was started separately and
+// is listening on the unix socket at path; see HelperListenMain.  Closing the connection ends
+// that client's session and the helper carries on listening for the next one.
+func DialHelper(path string) HelperStarter {
+	return func() (io.ReadWriteCloser, error) {
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to helper: %w", err)
+		}
+		return conn, nil
+	}
+}
@@ -0,0 +1,250 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+const defaultHelperRestartDelay = time.Second
+
+// HelperStarter starts an interface monitor helper, or connects to one, and returns a connection
+// to it.  Closing the connection should stop the helper, or end the session.
+type HelperStarter func() (io.ReadWriteCloser, error)
+
+// HelperClient runs the interface monitor in a helper process and makes the same StateCallback
+// and AddrCallback calls as an InterfaceMonitor.  With DialHelper, the helper is started
+// separately, with the privileges to talk netlink, so that the client's process doesn't need
+// them; with ExecHelper, the helper shares the client's privileges.  If the helper fails, the client starts a new one and uses its initial
+// snapshot to resynchronise: the consumer only gets callbacks for the interfaces that changed
+// in the meantime.
+type HelperClient struct {
+	Config
+	StateCallback InterfaceStateCallback
+	AddrCallback  AddrStateCallback
+	// RestartDelay is the delay before restarting a helper that has failed.  If <=0, defaults
+	// to 1s.
+	RestartDelay time.Duration
+
+	startHelper HelperStarter
+
+	// upIfaces and ifaceAddrs record what we've told the consumer, by interface name, so that
+	// we can work out what has changed when we get a snapshot.  Only accessed from the
+	// MonitorInterfaces goroutine.
+	upIfaces   map[string]int
+	ifaceAddrs map[string]set.Set
+	// inSnapshot is true while we're receiving a snapshot into snapshotUp and snapshotAddrs.
+	inSnapshot    bool
+	snapshotUp    map[string]int
+	snapshotAddrs map[string]set.Set
+
+	stopC    chan struct{}
+	stopOnce sync.Once
+}
+
+func NewHelperClient(config Config, startHelper HelperStarter) *HelperClient {
+	return &HelperClient{
+		Config:      config,
+		startHelper: startHelper,
+		upIfaces:    map[string]int{},
+		ifaceAddrs:  map[string]set.Set{},
+		stopC:       make(chan struct{}),
+	}
+}
+
+// SetCallbacks sets the StateCallback and AddrCallback.  Must be called before
+// MonitorInterfaces.
+func (c *HelperClient) SetCallbacks(stateCallback InterfaceStateCallback, addrCallback AddrStateCallback) {
+	c.StateCallback = stateCallback
+	c.AddrCallback = addrCallback
+}
+
+// MonitorInterfaces starts the helper and makes callbacks for its updates, restarting the
+// helper if it fails, until Stop is called.
+func (c *HelperClient) MonitorInterfaces() {
+	log.Info("Interface monitor helper client started.")
+	restartDelay := c.RestartDelay
+	if restartDelay <= 0 {
+		restartDelay = defaultHelperRestartDelay
+	}
+	for {
+		err := c.runHelper()
+		select {
+		case <-c.stopC:
+			log.Info("Interface monitor helper client stopping.")
+			return
+		default:
+		}
+		log.WithError(err).WithField("delay", restartDelay).Warn(
+			"Interface monitor helper failed, restarting it.")
+		select {
+		case <-time.After(restartDelay):
+		case <-c.stopC:
+			log.Info("Interface monitor helper client stopping.")
+			return
+		}
+	}
+}
+
+// Stop stops the client and its helper.  Safe to call more than once and from any goroutine.
+func (c *HelperClient) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.stopC)
+	})
+}
+
+// runHelper starts a helper and processes its updates until it fails or we're stopped.
+func (c *HelperClient) runHelper() error {
+	conn, err := c.startHelper()
+	if err != nil {
+		return err
+	}
+	connDoneC := make(chan struct{})
+	defer close(connDoneC)
+	go func() {
+		// Closing the connection unblocks our reads if we're stopped.
+		select {
+		case <-c.stopC:
+		case <-connDoneC:
+		}
+		_ = conn.Close()
+	}()
+
+	if err := writeHelperMsg(conn, &helperMsg{
+		Type:    helperMsgHello,
+		Version: helperProtocolVersion,
+		Config:  newHelperConfig(c.Config),
+	}); err != nil {
+		return err
+	}
+	if _, err := readHelperHello(conn); err != nil {
+		return err
+	}
+	// Whatever the previous helper was in the middle of is superseded by the new helper's
+	// snapshot.
+	c.inSnapshot = false
+	for {
+		msg, err := readHelperMsg(conn)
+		if err != nil {
+			return err
+		}
+		c.handleHelperMsg(msg)
+	}
+}
+
+func (c *HelperClient) handleHelperMsg(msg *helperMsg) {
+	switch msg.Type {
+	case helperMsgSnapshotStart:
+		c.inSnapshot = true
+		c.snapshotUp = map[string]int{}
+		c.snapshotAddrs = map[string]set.Set{}
+	case helperMsgSnapshotEnd:
+		c.inSnapshot = false
+		c.applySnapshot()
+		c.snapshotUp = nil
+		c.snapshotAddrs = nil
+	case helperMsgIfaceState:
+		if !c.inSnapshot {
+			c.setState(msg.Name, msg.State, msg.Index)
+		} else if msg.State == StateUp {
+			c.snapshotUp[msg.Name] = msg.Index
+		} else {
+			delete(c.snapshotUp, msg.Name)
+		}
+	case helperMsgIfaceAddrs:
+		var addrs set.Set
+		if msg.HasAddrs {
+			addrs = set.FromArray(msg.Addrs)
+		}
+		if !c.inSnapshot {
+			c.setAddrs(msg.Name, addrs)
+		} else if addrs != nil {
+			c.snapshotAddrs[msg.Name] = addrs
+		} else {
+			delete(c.snapshotAddrs, msg.Name)
+		}
+	default:
+		log.WithField("type", msg.Type).Warn("Ignoring unknown message from interface monitor helper.")
+	}
+}
+
+// applySnapshot makes the callbacks that take the consumer from what we've told it to the
+// state in the snapshot.
+func (c *HelperClient) applySnapshot() {
+	seen := map[string]bool{}
+	var names []string
+	for _, m := range []map[string]int{c.upIfaces, c.snapshotUp} {
+		for name := range m {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	for _, m := range []map[string]set.Set{c.ifaceAddrs, c.snapshotAddrs} {
+		for name := range m {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		oldIdx, wasUp := c.upIfaces[name]
+		newIdx, isUp := c.snapshotUp[name]
+		if wasUp && (!isUp || oldIdx != newIdx) {
+			c.setState(name, StateDown, oldIdx)
+		}
+		if isUp && (!wasUp || oldIdx != newIdx) {
+			c.setState(name, StateUp, newIdx)
+		}
+		oldAddrs, newAddrs := c.ifaceAddrs[name], c.snapshotAddrs[name]
+		if newAddrs == nil && oldAddrs != nil {
+			c.setAddrs(name, nil)
+		} else if newAddrs != nil && (oldAddrs == nil || !oldAddrs.Equals(newAddrs)) {
+			c.setAddrs(name, newAddrs)
+		}
+	}
+}
+
+func (c *HelperClient) setState(ifaceName string, state State, ifIndex int) {
+	if state == StateUp {
+		c.upIfaces[ifaceName] = ifIndex
+	} else {
+		delete(c.upIfaces, ifaceName)
+	}
+	c.StateCallback(ifaceName, state, ifIndex)
+}
+
+func (c *HelperClient) setAddrs(ifaceName string, addrs set.Set) {
+	if addrs != nil {
+		c.ifaceAddrs[ifaceName] = addrs
+		addrs = addrs.Copy()
+	} else {
+		delete(c.ifaceAddrs, ifaceName)
+	}
+	c.AddrCallback(ifaceName, addrs)
+}
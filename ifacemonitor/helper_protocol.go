@@ -0,0 +1,285 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+)
+
+// helperProtocolVersion is the version of the protocol spoken between the HelperClient and the
+// helper process.  It must be bumped whenever helperMsg or helperConfig changes incompatibly.
+const helperProtocolVersion = 1
+
+// maxHelperMsgLen limits the size of a message so that a corrupt length prefix can't make us
+// allocate an arbitrary amount of memory.
+const maxHelperMsgLen = 1 << 20
+
+type helperMsgType int
+
+const (
+	// helperMsgHello is the first message in each direction.  The client's hello carries the
+	// monitor's config.
+	helperMsgHello helperMsgType = iota
+	helperMsgSnapshotStart
+	helperMsgSnapshotEnd
+	helperMsgIfaceState
+	helperMsgIfaceAddrs
+)
+
+// helperMsg is the single message type of the helper protocol; the fields that are used depend
+// on the Type.
+type helperMsg struct {
+	Type    helperMsgType
+	Version int
+	Config  *helperConfig
+
+	Name  string
+	State State
+	Index int
+	Addrs []string
+	// HasAddrs is false for a helperMsgIfaceAddrs that means the interface has gone.  gob
+	// doesn't distinguish between nil and empty slices so Addrs alone can't tell us.
+	HasAddrs bool
+}
+
+// helperConfig is the monitor's Config in a form that gob can encode: the regexps are sent as
+// strings.  Every field of the Config must be here, so that the helper's monitor behaves like
+// an in-process one, apart from the Registerer, which can't be sent; see also the checks in
+// config.Validate for options that can't work across the process boundary.
+type helperConfig struct {
+	InterfaceExcludes         []string
+	InterfaceIncludes         []string
+	IPv4OnlyInterfaces        []string
+	IPv6OnlyInterfaces        []string
+	ResyncInterval            time.Duration
+	TeardownWindow            time.Duration
+	AddrAnnounceInterval      time.Duration
+	SysfsOperStateCheck       bool
+	DisableAddrMonitoring     bool
+	TrackProtodown            bool
+	ProtodownAsDown           bool
+	DetailedStates            bool
+	MatchAltNames             bool
+	StateFile                 string
+	StateFileWriteInterval    time.Duration
+	StateFileMaxAge           time.Duration
+	EventStreamSocket         string
+	EventStreamQueueLen       int
+	RecordFile                string
+	CallbackRetryAttempts     int
+	CallbackRetryInterval     time.Duration
+	ResyncRetryAttempts       int
+	ResyncRetryInterval       time.Duration
+	MaxPauseDuration          time.Duration
+	BatchDelay                time.Duration
+	MaxUpdateBatch            int
+	FlushAddrs                bool
+	FlushAddrsOnDown          bool
+	LinkLocalAddrZones        bool
+	ExcludeLinkLocalAddrs     bool
+	ExcludeLoopbackAddrs      bool
+	CanaryInterval            time.Duration
+	CanaryTimeout             time.Duration
+	UnclaimedIfaceGracePeriod time.Duration
+	ExportDir                 string
+	ExportCoalesceInterval    time.Duration
+	AddrCountThreshold        int
+	AddrCountWarnInterval     time.Duration
+	EmptyMasterDown           bool
+}
+
+func newHelperConfig(config Config) *helperConfig {
+	hc := &helperConfig{
+		ResyncInterval:            config.ResyncInterval,
+		TeardownWindow:            config.TeardownWindow,
+		AddrAnnounceInterval:      config.AddrAnnounceInterval,
+		SysfsOperStateCheck:       config.SysfsOperStateCheck,
+		DisableAddrMonitoring:     config.DisableAddrMonitoring,
+		TrackProtodown:            config.TrackProtodown,
+		ProtodownAsDown:           config.ProtodownAsDown,
+		DetailedStates:            config.DetailedStates,
+		MatchAltNames:             config.MatchAltNames,
+		StateFile:                 config.StateFile,
+		StateFileWriteInterval:    config.StateFileWriteInterval,
+		StateFileMaxAge:           config.StateFileMaxAge,
+		EventStreamSocket:         config.EventStreamSocket,
+		EventStreamQueueLen:       config.EventStreamQueueLen,
+		RecordFile:                config.RecordFile,
+		CallbackRetryAttempts:     config.CallbackRetryAttempts,
+		CallbackRetryInterval:     config.CallbackRetryInterval,
+		ResyncRetryAttempts:       config.ResyncRetryAttempts,
+		ResyncRetryInterval:       config.ResyncRetryInterval,
+		MaxPauseDuration:          config.MaxPauseDuration,
+		BatchDelay:                config.BatchDelay,
+		MaxUpdateBatch:            config.MaxUpdateBatch,
+		FlushAddrs:                config.FlushAddrs,
+		FlushAddrsOnDown:          config.FlushAddrsOnDown,
+		LinkLocalAddrZones:        config.LinkLocalAddrZones,
+		ExcludeLinkLocalAddrs:     config.ExcludeLinkLocalAddrs,
+		ExcludeLoopbackAddrs:      config.ExcludeLoopbackAddrs,
+		CanaryInterval:            config.CanaryInterval,
+		CanaryTimeout:             config.CanaryTimeout,
+		UnclaimedIfaceGracePeriod: config.UnclaimedIfaceGracePeriod,
+		ExportDir:                 config.ExportDir,
+		ExportCoalesceInterval:    config.ExportCoalesceInterval,
+		AddrCountThreshold:        config.AddrCountThreshold,
+		AddrCountWarnInterval:     config.AddrCountWarnInterval,
+		EmptyMasterDown:           config.EmptyMasterDown,
+	}
+	hc.InterfaceExcludes = regexpStrings(config.InterfaceExcludes)
+	hc.InterfaceIncludes = regexpStrings(config.InterfaceIncludes)
+	hc.IPv4OnlyInterfaces = regexpStrings(config.IPv4OnlyInterfaces)
+	hc.IPv6OnlyInterfaces = regexpStrings(config.IPv6OnlyInterfaces)
+	return hc
+}
+
+func (hc *helperConfig) config() (config Config, err error) {
+	config = Config{
+		ResyncInterval:            hc.ResyncInterval,
+		TeardownWindow:            hc.TeardownWindow,
+		AddrAnnounceInterval:      hc.AddrAnnounceInterval,
+		SysfsOperStateCheck:       hc.SysfsOperStateCheck,
+		DisableAddrMonitoring:     hc.DisableAddrMonitoring,
+		TrackProtodown:            hc.TrackProtodown,
+		ProtodownAsDown:           hc.ProtodownAsDown,
+		DetailedStates:            hc.DetailedStates,
+		MatchAltNames:             hc.MatchAltNames,
+		StateFile:                 hc.StateFile,
+		StateFileWriteInterval:    hc.StateFileWriteInterval,
+		StateFileMaxAge:           hc.StateFileMaxAge,
+		EventStreamSocket:         hc.EventStreamSocket,
+		EventStreamQueueLen:       hc.EventStreamQueueLen,
+		RecordFile:                hc.RecordFile,
+		CallbackRetryAttempts:     hc.CallbackRetryAttempts,
+		CallbackRetryInterval:     hc.CallbackRetryInterval,
+		ResyncRetryAttempts:       hc.ResyncRetryAttempts,
+		ResyncRetryInterval:       hc.ResyncRetryInterval,
+		MaxPauseDuration:          hc.MaxPauseDuration,
+		BatchDelay:                hc.BatchDelay,
+		MaxUpdateBatch:            hc.MaxUpdateBatch,
+		FlushAddrs:                hc.FlushAddrs,
+		FlushAddrsOnDown:          hc.FlushAddrsOnDown,
+		LinkLocalAddrZones:        hc.LinkLocalAddrZones,
+		ExcludeLinkLocalAddrs:     hc.ExcludeLinkLocalAddrs,
+		ExcludeLoopbackAddrs:      hc.ExcludeLoopbackAddrs,
+		CanaryInterval:            hc.CanaryInterval,
+		CanaryTimeout:             hc.CanaryTimeout,
+		UnclaimedIfaceGracePeriod: hc.UnclaimedIfaceGracePeriod,
+		ExportDir:                 hc.ExportDir,
+		ExportCoalesceInterval:    hc.ExportCoalesceInterval,
+		AddrCountThreshold:        hc.AddrCountThreshold,
+		AddrCountWarnInterval:     hc.AddrCountWarnInterval,
+		EmptyMasterDown:           hc.EmptyMasterDown,
+	}
+	if config.InterfaceExcludes, err = compileRegexps("interface exclude", hc.InterfaceExcludes); err != nil {
+		return Config{}, err
+	}
+	if config.InterfaceIncludes, err = compileRegexps("interface include", hc.InterfaceIncludes); err != nil {
+		return Config{}, err
+	}
+	if config.IPv4OnlyInterfaces, err = compileRegexps("IPv4-only interface", hc.IPv4OnlyInterfaces); err != nil {
+		return Config{}, err
+	}
+	if config.IPv6OnlyInterfaces, err = compileRegexps("IPv6-only interface", hc.IPv6OnlyInterfaces); err != nil {
+		return Config{}, err
+	}
+	return config, nil
+}
+
+func regexpStrings(res []*regexp.Regexp) []string {
+	var exprs []string
+	for _, re := range res {
+		exprs = append(exprs, re.String())
+	}
+	return exprs
+}
+
+func compileRegexps(what string, exprs []string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, expr := range exprs {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("bad %s %q: %w", what, expr, err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// writeHelperMsg writes a message as a 4-byte big-endian length followed by the gob encoding
+// of the message.  Each message is encoded on its own so that the stream has no state that
+// would need to be recovered after an error.
+func writeHelperMsg(w io.Writer, msg *helperMsg) error {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 4))
+	if err := gob.NewEncoder(&buf).Encode(msg); err != nil {
+		return err
+	}
+	data := buf.Bytes()
+	if len(data)-4 > maxHelperMsgLen {
+		return fmt.Errorf("message too long (%d bytes)", len(data)-4)
+	}
+	binary.BigEndian.PutUint32(data, uint32(len(data)-4))
+	_, err := w.Write(data)
+	return err
+}
+
+// readHelperMsg reads a message written by writeHelperMsg.
+func readHelperMsg(r io.Reader) (*helperMsg, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	msgLen := binary.BigEndian.Uint32(lenBuf[:])
+	if msgLen > maxHelperMsgLen {
+		return nil, fmt.Errorf("message too long (%d bytes)", msgLen)
+	}
+	data := make([]byte, msgLen)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	var msg helperMsg
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// readHelperHello reads the other side's hello and checks its protocol version.
+func readHelperHello(r io.Reader) (*helperMsg, error) {
+	msg, err := readHelperMsg(r)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Type != helperMsgHello {
+		return nil, fmt.Errorf("expected hello, got message of type %d", msg.Type)
+	}
+	if msg.Version != helperProtocolVersion {
+		return nil, fmt.Errorf("unsupported interface monitor helper protocol version %d (we speak %d)",
+			msg.Version, helperProtocolVersion)
+	}
+	return msg, nil
+}
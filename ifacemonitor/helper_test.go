@@ -0,0 +1,425 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/timeshim/mocktime"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// socketPair returns the two ends of a unix socket pair.
+func socketPair() (net.Conn, net.Conn, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var conns []net.Conn
+	for _, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socketpair")
+		conn, err := net.FileConn(f)
+		_ = f.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		conns = append(conns, conn)
+	}
+	return conns[0], conns[1], nil
+}
+
+// setLinkNoSignal sets the state and addresses of a link in the fake kernel, adding the link if
+// needed, without signalling.
+func setLinkNoSignal(nl *netlinkTest, name, state string, addrs ...string) {
+	nl.linksMutex.Lock()
+	_, exists := nl.links[name]
+	nl.linksMutex.Unlock()
+	if !exists {
+		nl.addLinkNoSignal(name)
+	}
+	nl.linksMutex.Lock()
+	defer nl.linksMutex.Unlock()
+	link := nl.links[name]
+	link.state = state
+	link.addrs = set.New()
+	for _, addr := range addrs {
+		link.addrs.Add(addr)
+	}
+	nl.links[name] = link
+}
+
+var _ = Describe("HelperClient", func() {
+	var client *ifacemonitor.HelperClient
+	var updates chan string
+	var clientDoneC chan struct{}
+
+	startClientWithConfig := func(config ifacemonitor.Config, startHelper ifacemonitor.HelperStarter) {
+		client = ifacemonitor.NewHelperClient(config, startHelper)
+		client.RestartDelay = 10 * time.Millisecond
+		updates = make(chan string, 100)
+		client.SetCallbacks(
+			func(ifaceName string, state ifacemonitor.State, ifIndex int) {
+				updates <- fmt.Sprintf("%s %s", ifaceName, state)
+			},
+			func(ifaceName string, addrs set.Set) {
+				if addrs == nil {
+					updates <- fmt.Sprintf("%s gone", ifaceName)
+					return
+				}
+				var sorted []string
+				addrs.Iter(func(item interface{}) error {
+					sorted = append(sorted, item.(string))
+					return nil
+				})
+				sort.Strings(sorted)
+				updates <- fmt.Sprintf("%s addrs=%v", ifaceName, sorted)
+			},
+		)
+		clientDoneC = make(chan struct{})
+		go func() {
+			defer close(clientDoneC)
+			client.MonitorInterfaces()
+		}()
+	}
+
+	startClient := func(startHelper ifacemonitor.HelperStarter) {
+		startClientWithConfig(ifacemonitor.Config{}, startHelper)
+	}
+
+	AfterEach(func() {
+		client.Stop()
+		Eventually(clientDoneC).Should(BeClosed())
+	})
+
+	It("should pass the whole config to the helper", func() {
+		// Give every field a distinct non-zero value, so that any field that the protocol
+		// drops shows up.
+		var config ifacemonitor.Config
+		configValue := reflect.ValueOf(&config).Elem()
+		for i := 0; i < configValue.NumField(); i++ {
+			field := configValue.Field(i)
+			name := configValue.Type().Field(i).Name
+			if name == "Registerer" {
+				// The helper has no way to export metrics so this stays behind.
+				continue
+			}
+			switch field.Interface().(type) {
+			case []*regexp.Regexp:
+				field.Set(reflect.ValueOf([]*regexp.Regexp{regexp.MustCompile("^" + name + "$")}))
+			case time.Duration:
+				field.Set(reflect.ValueOf(time.Duration(i+1) * time.Second))
+			case int:
+				field.SetInt(int64(i + 1))
+			case bool:
+				field.SetBool(true)
+			case string:
+				field.SetString("/nonexistent/" + name)
+			default:
+				Fail(fmt.Sprintf("Don't know how to fill in Config.%s; does the helper protocol handle it?", name))
+			}
+		}
+
+		configC := make(chan ifacemonitor.Config, 1)
+		startClientWithConfig(config, func() (io.ReadWriteCloser, error) {
+			clientConn, helperConn, err := socketPair()
+			if err != nil {
+				return nil, err
+			}
+			go func() {
+				_ = ifacemonitor.ServeHelper(helperConn, func(config ifacemonitor.Config) *ifacemonitor.InterfaceMonitor {
+					configC <- config
+					// Don't act on the config; it's full of made-up paths.
+					return ifacemonitor.NewWithStubs(
+						ifacemonitor.Config{},
+						&netlinkTest{userSubscribed: make(chan int, 10)},
+						make(chan time.Time),
+					)
+				})
+			}()
+			return clientConn, nil
+		})
+		var helperConfig ifacemonitor.Config
+		Eventually(configC).Should(Receive(&helperConfig))
+
+		helperValue := reflect.ValueOf(helperConfig)
+		var differences []string
+		for i := 0; i < configValue.NumField(); i++ {
+			want, got := configValue.Field(i).Interface(), helperValue.Field(i).Interface()
+			if res, ok := want.([]*regexp.Regexp); ok {
+				want, got = fmt.Sprint(res), fmt.Sprint(got)
+			}
+			if !reflect.DeepEqual(want, got) {
+				differences = append(differences, fmt.Sprintf("%s: sent %v, helper got %v",
+					configValue.Type().Field(i).Name, want, got))
+			}
+		}
+		Expect(differences).To(BeEmpty())
+	})
+
+	Describe("with in-process helpers", func() {
+		// Each helper gets a copy of baseKernel, as if the interfaces had changed while the
+		// previous helper was down.
+		var baseKernel *netlinkTest
+		var baseKernelLock sync.Mutex
+		type helper struct {
+			kernel *netlinkTest
+			conn   net.Conn
+			doneC  chan error
+		}
+		var helpers chan *helper
+
+		BeforeEach(func() {
+			baseKernel = &netlinkTest{userSubscribed: make(chan int)}
+			setLinkNoSignal(baseKernel, "eth0", "up", "10.0.0.1/32")
+			setLinkNoSignal(baseKernel, "eth1", "down")
+			helpers = make(chan *helper, 10)
+			startClient(func() (io.ReadWriteCloser, error) {
+				clientConn, helperConn, err := socketPair()
+				if err != nil {
+					return nil, err
+				}
+				baseKernelLock.Lock()
+				h := &helper{
+					kernel: baseKernel.clone(),
+					conn:   helperConn,
+					doneC:  make(chan error, 1),
+				}
+				baseKernelLock.Unlock()
+				go func() {
+					h.doneC <- ifacemonitor.ServeHelper(h.conn, func(config ifacemonitor.Config) *ifacemonitor.InterfaceMonitor {
+						return ifacemonitor.NewWithStubs(
+							config,
+							h.kernel,
+							make(chan time.Time),
+							ifacemonitor.WithMonitorTimeShim(mocktime.New()),
+						)
+					})
+				}()
+				helpers <- h
+				return clientConn, nil
+			})
+		})
+
+		nextHelper := func() *helper {
+			var h *helper
+			Eventually(helpers).Should(Receive(&h))
+			Eventually(h.kernel.userSubscribed).Should(Receive())
+			return h
+		}
+
+		It("should pass on updates and resync with a new helper after the old one is killed", func() {
+			h := nextHelper()
+			Eventually(updates).Should(Receive(Equal("eth0 up")))
+			Eventually(updates).Should(Receive(Equal("eth0 addrs=[10.0.0.1]")))
+			Eventually(updates).Should(Receive(Equal("eth1 addrs=[]")))
+			Consistently(updates, "50ms", "5ms").ShouldNot(Receive())
+
+			h.kernel.changeLinkState("eth1", "up")
+			Eventually(updates).Should(Receive(Equal("eth1 up")))
+
+			// Change the interfaces while there's no helper and then kill it mid-stream.
+			newKernel := h.kernel.clone()
+			setLinkNoSignal(newKernel, "eth0", "down", "10.0.0.1/32")
+			newKernel.delLinkNoSignal("eth1")
+			setLinkNoSignal(newKernel, "cali1", "up", "10.0.1.1/32")
+			baseKernelLock.Lock()
+			baseKernel = newKernel
+			baseKernelLock.Unlock()
+			Expect(h.conn.Close()).To(Succeed())
+			Eventually(h.doneC).Should(Receive())
+
+			// The new helper's snapshot is translated into the changes.  eth0's addresses
+			// haven't changed so there's no update for them.
+			h = nextHelper()
+			Eventually(updates).Should(Receive(Equal("cali1 up")))
+			Eventually(updates).Should(Receive(Equal("cali1 addrs=[10.0.1.1]")))
+			Eventually(updates).Should(Receive(Equal("eth0 down")))
+			Eventually(updates).Should(Receive(Equal("eth1 down")))
+			Eventually(updates).Should(Receive(Equal("eth1 gone")))
+			Consistently(updates, "50ms", "5ms").ShouldNot(Receive())
+
+			// Live updates carry on from the new helper.
+			h.kernel.delLink("cali1")
+			Eventually(updates).Should(Receive(Equal("cali1 gone")))
+			Eventually(updates).Should(Receive(Equal("cali1 down")))
+		})
+
+		It("should stop the helper when stopped", func() {
+			h := nextHelper()
+			Eventually(updates).Should(Receive(Equal("eth0 up")))
+			client.Stop()
+			Eventually(h.doneC).Should(Receive(BeNil()))
+			Eventually(clientDoneC).Should(BeClosed())
+			Consistently(helpers, "50ms", "5ms").ShouldNot(Receive())
+		})
+	})
+
+	Describe("with a helper listening on a socket", func() {
+		// The helper is started separately, with its own privileges, and serves each client
+		// that connects to it.
+		var dir string
+		var kernel *netlinkTest
+		var listener *acceptedConnsListener
+		var serveDoneC chan error
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "helper-test")
+			Expect(err).NotTo(HaveOccurred())
+			kernel = &netlinkTest{userSubscribed: make(chan int, 10)}
+			setLinkNoSignal(kernel, "eth0", "up", "10.0.0.1/32")
+			l, err := ifacemonitor.ListenHelper(dir + "/helper.sock")
+			Expect(err).NotTo(HaveOccurred())
+			listener = &acceptedConnsListener{Listener: l, conns: make(chan net.Conn, 10)}
+			serveDoneC = make(chan error, 1)
+			go func() {
+				serveDoneC <- ifacemonitor.ServeHelpers(listener, func(config ifacemonitor.Config) *ifacemonitor.InterfaceMonitor {
+					return ifacemonitor.NewWithStubs(
+						config,
+						kernel,
+						make(chan time.Time),
+						ifacemonitor.WithMonitorTimeShim(mocktime.New()),
+					)
+				})
+			}()
+			startClient(ifacemonitor.DialHelper(dir + "/helper.sock"))
+		})
+
+		AfterEach(func() {
+			Expect(listener.Close()).To(Succeed())
+			Eventually(serveDoneC).Should(Receive(HaveOccurred()))
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		})
+
+		It("should only let our own user connect", func() {
+			info, err := os.Stat(dir + "/helper.sock")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Mode() & os.ModeSocket).NotTo(BeZero())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+		})
+
+		It("should pass on updates and reconnect if the connection fails", func() {
+			var conn net.Conn
+			Eventually(listener.conns).Should(Receive(&conn))
+			Eventually(updates).Should(Receive(Equal("eth0 up")))
+			Eventually(updates).Should(Receive(Equal("eth0 addrs=[10.0.0.1]")))
+
+			// Drop the connection mid-stream; the client connects again and resyncs from the
+			// new session's snapshot.
+			setLinkNoSignal(kernel, "cali1", "up", "10.0.1.1/32")
+			Expect(conn.Close()).To(Succeed())
+			Eventually(listener.conns).Should(Receive(&conn))
+			Eventually(updates).Should(Receive(Equal("cali1 up")))
+			Eventually(updates).Should(Receive(Equal("cali1 addrs=[10.0.1.1]")))
+			Consistently(updates, "50ms", "5ms").ShouldNot(Receive())
+
+			// The helper keeps listening after the client stops.
+			client.Stop()
+			Eventually(clientDoneC).Should(BeClosed())
+			otherConn, err := net.Dial("unix", dir+"/helper.sock")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(otherConn.Close()).To(Succeed())
+		})
+	})
+
+	It("should refuse to talk to a helper that speaks another protocol version", func() {
+		numStarts := 0
+		var numStartsLock sync.Mutex
+		startClient(func() (io.ReadWriteCloser, error) {
+			clientConn, helperConn, err := socketPair()
+			if err != nil {
+				return nil, err
+			}
+			numStartsLock.Lock()
+			numStarts++
+			numStartsLock.Unlock()
+			go func() {
+				defer helperConn.Close()
+				// Skip the client's hello and reply with a hello from the future.
+				var lenBuf [4]byte
+				if _, err := io.ReadFull(helperConn, lenBuf[:]); err != nil {
+					return
+				}
+				if _, err := io.CopyN(ioutil.Discard, helperConn, int64(binary.BigEndian.Uint32(lenBuf[:]))); err != nil {
+					return
+				}
+				var buf bytes.Buffer
+				buf.Write(make([]byte, 4))
+				_ = gob.NewEncoder(&buf).Encode(&struct {
+					Type    int
+					Version int
+				}{Version: 2})
+				data := buf.Bytes()
+				binary.BigEndian.PutUint32(data, uint32(len(data)-4))
+				_, _ = helperConn.Write(data)
+				// Then an update, which the client must ignore.
+				buf.Reset()
+				buf.Write(make([]byte, 4))
+				_ = gob.NewEncoder(&buf).Encode(&struct {
+					Type  int
+					Name  string
+					State ifacemonitor.State
+				}{Type: 3, Name: "eth0", State: ifacemonitor.StateUp})
+				data = buf.Bytes()
+				binary.BigEndian.PutUint32(data, uint32(len(data)-4))
+				_, _ = helperConn.Write(data)
+			}()
+			return clientConn, nil
+		})
+
+		// The client gives up on each helper and starts another.
+		Eventually(func() int {
+			numStartsLock.Lock()
+			defer numStartsLock.Unlock()
+			return numStarts
+		}).Should(BeNumerically(">", 2))
+		Consistently(updates, "50ms", "5ms").ShouldNot(Receive())
+	})
+})
+
+// acceptedConnsListener passes on the connections that it accepts, so that a test can break
+// them.
+type acceptedConnsListener struct {
+	net.Listener
+	conns chan net.Conn
+}
+
+func (l *acceptedConnsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.conns <- conn
+	}
+	return conn, err
+}
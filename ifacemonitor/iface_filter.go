@@ -0,0 +1,29 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+// InterfaceFilter returns true if the monitor should track the named interface.  Unlike an
+// interface that matches Config.InterfaceExcludes, whose state is still tracked and reported,
+// an interface that the filter rejects is ignored entirely: the monitor keeps nothing for it
+// and makes no callbacks about it.  It is called from the monitor's goroutine so it should be
+// quick.
+type InterfaceFilter func(ifaceName string) bool
+
+// isFilteredOut returns true if the InterfaceFilter rejects the named interface.
+func (m *InterfaceMonitor) isFilteredOut(ifaceName string) bool {
+	return m.InterfaceFilter != nil && !m.InterfaceFilter(ifaceName)
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"strings"
+	"time"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ifacemonitor/testutils"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Interface filter", func() {
+	var nl *netlinkTest
+	var resyncC chan time.Time
+	var im *ifacemonitor.InterfaceMonitor
+	var recorder *testutils.Recorder
+
+	BeforeEach(func() {
+		resyncC = make(chan time.Time)
+		im, nl, recorder = startMonitor(ifacemonitor.Config{}, func(nl *netlinkTest, im *ifacemonitor.InterfaceMonitor) {
+			setLinkNoSignal(nl, "eth0", "up", "10.0.0.1/32")
+			setLinkNoSignal(nl, "docker0", "up", "172.17.0.1/16")
+			im.InterfaceFilter = func(ifaceName string) bool {
+				return ifaceName == "eth0" || strings.HasPrefix(ifaceName, "cali")
+			}
+		}, withResyncC(resyncC))
+		recorder.ExpectSequence(
+			testutils.StateEvent("eth0", ifacemonitor.StateUp),
+			testutils.AddrsEvent("eth0", "10.0.0.1"),
+		)
+	})
+
+	AfterEach(func() {
+		im.Stop()
+	})
+
+	interfaceNames := func() []string {
+		var names []string
+		for _, status := range im.Interfaces() {
+			names = append(names, status.Name)
+		}
+		return names
+	}
+
+	It("should ignore rejected interfaces entirely", func() {
+		nl.addLink("veth1")
+		nl.changeLinkState("veth1", "up")
+		nl.addAddr("veth1", "10.0.2.1/32")
+		nl.addLink("cali1")
+		nl.changeLinkState("cali1", "up")
+		recorder.ExpectState("cali1", ifacemonitor.StateUp)
+		resyncC <- time.Time{}
+		resyncC <- time.Time{}
+		recorder.ExpectNoEventsFor("docker0")
+		recorder.ExpectNoEventsFor("veth1")
+		Expect(interfaceNames()).To(Equal([]string{"eth0", "cali1"}))
+	})
+
+	It("should report an interface that is renamed out of the filter as deleted", func() {
+		nl.addLink("cali1")
+		nl.addAddr("cali1", "10.0.1.1/32")
+		nl.changeLinkState("cali1", "up")
+		recorder.ExpectState("cali1", ifacemonitor.StateUp)
+		recorder.ExpectAddrs("cali1", "10.0.1.1")
+
+		nl.renameLink("cali1", "veth1")
+		recorder.ExpectAddrsGone("cali1")
+		recorder.ExpectState("cali1", ifacemonitor.StateDown)
+		recorder.ExpectNoEventsFor("veth1")
+		Eventually(interfaceNames).Should(Equal([]string{"eth0"}))
+
+		nl.renameLink("veth1", "cali2")
+		recorder.ExpectState("cali2", ifacemonitor.StateUp)
+		recorder.ExpectAddrs("cali2", "10.0.1.1")
+	})
+})
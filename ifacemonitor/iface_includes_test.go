@@ -0,0 +1,98 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"regexp"
+	"time"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ifacemonitor/testutils"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Interface includes", func() {
+	var nl *netlinkTest
+	var resyncC chan time.Time
+	var im *ifacemonitor.InterfaceMonitor
+	var recorder *testutils.Recorder
+
+	BeforeEach(func() {
+		resyncC = make(chan time.Time)
+		im, nl, recorder = startMonitor(ifacemonitor.Config{
+			InterfaceIncludes: []*regexp.Regexp{
+				regexp.MustCompile("^cali"),
+				regexp.MustCompile("^eth0$"),
+			},
+		}, func(nl *netlinkTest, im *ifacemonitor.InterfaceMonitor) {
+			setLinkNoSignal(nl, "eth0", "up", "10.0.0.1/32")
+			setLinkNoSignal(nl, "docker0", "up", "172.17.0.1/16")
+		}, withResyncC(resyncC))
+		recorder.ExpectAddrs("eth0", "10.0.0.1")
+	})
+
+	AfterEach(func() {
+		im.Stop()
+	})
+
+	expectNoAddrs := func(ifaceName string) {
+		ConsistentlyWithOffset(1, func() string {
+			return recorder.Addrs(ifaceName)
+		}, "50ms", "5ms").Should(BeEmpty())
+	}
+
+	It("should only report the addresses of matching interfaces", func() {
+		expectNoAddrs("docker0")
+		nl.addLink("cali1")
+		nl.addAddr("cali1", "10.0.1.1/32")
+		recorder.ExpectAddrs("cali1", "10.0.1.1")
+		nl.addLink("tap1")
+		nl.addAddr("tap1", "10.0.2.1/32")
+		expectNoAddrs("tap1")
+
+		// Resyncs see the same.
+		resyncC <- time.Time{}
+		resyncC <- time.Time{}
+		expectNoAddrs("docker0")
+		expectNoAddrs("tap1")
+
+		excluded := map[string]bool{}
+		for _, status := range im.Interfaces() {
+			excluded[status.Name] = status.Excluded
+		}
+		Expect(excluded).To(Equal(map[string]bool{
+			"eth0":    false,
+			"docker0": true,
+			"cali1":   false,
+			"tap1":    true,
+		}))
+	})
+
+	It("should handle renames into and out of the set", func() {
+		nl.addLink("tap1")
+		nl.addAddr("tap1", "10.0.2.1/32")
+		nl.renameLink("tap1", "cali2")
+		recorder.ExpectAddrs("cali2", "10.0.2.1")
+		expectNoAddrs("tap1")
+
+		nl.renameLink("cali2", "tap2")
+		recorder.ExpectAddrsGone("cali2")
+		expectNoAddrs("tap2")
+	})
+})
@@ -0,0 +1,223 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"bytes"
+	"net"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// InterfaceInfo is the monitor's view of an interface, as passed to the InfoCallback.
+type InterfaceInfo struct {
+	// ID is a monitor-assigned identifier for the interface.  It is allocated when the
+	// interface is first seen and stays the same if the interface is renamed, allowing
+	// consumers to correlate the old and new names.  IDs are never reused.
+	ID    uint64
+	Name  string
+	Index int
+	State State
+	// HardwareAddr is the interface's MAC; nil for interfaces that don't have one, such as
+	// tunnels.  A change of MAC is reported even if the state stays the same.
+	HardwareAddr net.HardwareAddr
+	// VethPeer is set if the interface is a veth.
+	VethPeer *VethPeer
+	// SubDevice is set if the interface is a macvlan or ipvlan.
+	SubDevice *SubDevice
+	// ParentChain is set if the interface is a stacked device.
+	ParentChain *ParentChain
+	// Class is the interface's class, if there is a Classifier.
+	Class InterfaceClass
+	// AdminUp is the interface's admin state (IFF_UP).
+	AdminUp bool
+	// DetailedState is StateUp or, for an interface that is down, one of the detailed down
+	// states, saying why.  Changes to the DetailedState of an interface that stays down are
+	// reported too.
+	DetailedState State
+	// MTU, RawFlags and Kind are the interface's MTU, netlink flags and link type (such as
+	// "veth"), so that consumers don't need to look them up.  They are zero when the interface
+	// has been deleted; Index is still set.  Like a change of MAC, a change of MTU is reported
+	// even if the state stays the same.
+	MTU      int
+	RawFlags uint32
+	Kind     string
+	// Protodown is only set if Config.TrackProtodown is enabled.
+	Protodown bool
+	// Origin says whether the notification was caused by an event or a resync.
+	Origin UpdateOrigin
+}
+
+type InterfaceInfoCallback func(info InterfaceInfo)
+
+// StateFromFlags classifies an interface from its netlink flags, giving StateUp or one of the
+// detailed down states.  As for State, an interface is up if it is running (IFF_RUNNING);
+// otherwise, it is admin down if IFF_UP is clear, or has no carrier if it is set.
+func StateFromFlags(rawFlags uint32) State {
+	switch {
+	case rawFlags&syscall.IFF_RUNNING != 0:
+		return StateUp
+	case rawFlags&syscall.IFF_UP == 0:
+		return StateAdminDown
+	}
+	return StateNoCarrier
+}
+
+// StateFromOperState is StateFromFlags for kernels that report the oper state: an interface
+// that has no carrier according to its flags is StateLowerLayerDown, StateDormant or
+// StateMissingComponent if its oper state says so.
+func StateFromOperState(rawFlags uint32, operState netlink.LinkOperState) State {
+	state := StateFromFlags(rawFlags)
+	if state != StateNoCarrier {
+		return state
+	}
+	switch operState {
+	case netlink.OperLowerLayerDown:
+		return StateLowerLayerDown
+	case netlink.OperDormant:
+		return StateDormant
+	case netlink.OperNotPresent:
+		return StateMissingComponent
+	}
+	return state
+}
+
+// downState returns the detailed State of an interface, with the given attributes, that we're
+// reporting as down.
+func (m *InterfaceMonitor) downState(attrs trackedLinkAttrs) State {
+	state := StateFromFlags(attrs.rawFlags)
+	if m.capabilities.OperState {
+		state = StateFromOperState(attrs.rawFlags, attrs.operState)
+	}
+	if state == StateUp {
+		return StateHeldDown
+	}
+	return state
+}
+
+// detailedState returns the detailed State of an interface for which we're reporting the given
+// State.
+func (m *InterfaceMonitor) detailedState(ifIndex int, state State) State {
+	if state == StateUp {
+		return StateUp
+	}
+	attrs, known := m.linkAttrs[ifIndex]
+	if !known {
+		return StateNotPresent
+	}
+	return m.downState(attrs)
+}
+
+// ifaceIdentity records the ID that we allocated to an interface, along with the name and MAC
+// that we last saw for it.
+type ifaceIdentity struct {
+	id           uint64
+	name         string
+	hardwareAddr net.HardwareAddr
+}
+
+// ensureIfaceID makes sure that we have an ID for the interface with the given index,
+// allocating one if this is the first time we've seen it.  An interface is identified by its index plus its MAC; if
+// we see a known index with both a different name and a different MAC then we assume that we
+// missed the deletion of the old interface and that the kernel has reused the index, so we
+// allocate a new ID.  A change to only one of name or MAC (a rename, or a MAC change on a bond)
+// keeps the ID.
+func (m *InterfaceMonitor) ensureIfaceID(ifIndex int, name string, hardwareAddr net.HardwareAddr) {
+	identity, known := m.ifaceIDs[ifIndex]
+	if known && identity.name != name && !bytes.Equal(identity.hardwareAddr, hardwareAddr) {
+		log.WithFields(log.Fields{
+			"ifIndex": ifIndex,
+			"oldName": identity.name,
+			"newName": name,
+		}).Info("Interface index reused by a different interface.")
+		known = false
+	}
+	if !known {
+		m.nextIfaceID++
+		identity.id = m.nextIfaceID
+	}
+	identity.name = name
+	identity.hardwareAddr = hardwareAddr
+	m.ifaceIDs[ifIndex] = identity
+}
+
+// releaseIfaceID forgets the ID for an interface that has been removed.
+func (m *InterfaceMonitor) releaseIfaceID(ifIndex int) {
+	delete(m.ifaceIDs, ifIndex)
+}
+
+// notifyIfaceState calls the StateCallback and, if set, the InfoCallback for an interface state
+// transition.
+func (m *InterfaceMonitor) notifyIfaceState(ifaceName string, state State, ifIndex int, hardwareAddr net.HardwareAddr) {
+	m.recordIfaceStateForWaiters(ifaceName, state)
+	m.countUpIface(ifaceName, state)
+	m.onExpectedIfaceState(ifaceName, state)
+	delete(m.restoredIfaces, ifIndex)
+	m.metrics.notifications.WithLabelValues("state", string(m.origin)).Inc()
+	m.deliverState(ifaceName, m.callbackState(ifIndex, state), ifIndex)
+	m.notifySubscribersState(ifaceName, state, ifIndex)
+	m.notifyIfaceInfo(ifaceName, state, ifIndex, hardwareAddr)
+}
+
+// notifyDownReasonChanged is called when an interface that is down changes detailed State.  Only
+// the InfoCallback and, with Config.DetailedStates, the StateCallback care.
+func (m *InterfaceMonitor) notifyDownReasonChanged(ifaceName string, ifIndex int, hardwareAddr net.HardwareAddr) {
+	if m.DetailedStates {
+		m.metrics.notifications.WithLabelValues("state", string(m.origin)).Inc()
+		m.deliverState(ifaceName, m.callbackState(ifIndex, StateDown), ifIndex)
+	}
+	m.notifyIfaceInfo(ifaceName, StateDown, ifIndex, hardwareAddr)
+}
+
+// callbackState returns the state to give the StateCallback for an interface for which we're
+// reporting the given State.
+func (m *InterfaceMonitor) callbackState(ifIndex int, state State) State {
+	if !m.DetailedStates {
+		return state
+	}
+	if m.withdrawing {
+		return StateNotPresent
+	}
+	return m.detailedState(ifIndex, state)
+}
+
+// notifyIfaceInfo calls the InfoCallback, if set.
+func (m *InterfaceMonitor) notifyIfaceInfo(ifaceName string, state State, ifIndex int, hardwareAddr net.HardwareAddr) {
+	if m.InfoCallback == nil {
+		return
+	}
+	m.InfoCallback(InterfaceInfo{
+		ID:            m.ifaceIDs[ifIndex].id,
+		Name:          ifaceName,
+		Index:         ifIndex,
+		State:         state,
+		AdminUp:       m.linkAttrs[ifIndex].rawFlags&syscall.IFF_UP != 0,
+		DetailedState: m.detailedState(ifIndex, state),
+		MTU:           m.linkAttrs[ifIndex].mtu,
+		RawFlags:      m.linkAttrs[ifIndex].rawFlags,
+		Kind:          m.linkKinds[ifIndex],
+		HardwareAddr:  hardwareAddr,
+		VethPeer:      m.vethPeer(ifIndex),
+		SubDevice:     m.subDevice(ifIndex),
+		ParentChain:   m.parentChains[ifIndex].copy(),
+		Class:         m.classes[ifIndex],
+		Protodown:     m.linkAttrs[ifIndex].protodown,
+		Origin:        m.origin,
+	})
+}
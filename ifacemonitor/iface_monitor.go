@@ -12,11 +12,18 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+// +build !darwin
+
 package ifacemonitor
 
 import (
+	"bytes"
 	"context"
+	"fmt"
 	"regexp"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -25,67 +32,446 @@ import (
 	"golang.org/x/sys/unix"
 
 	"github.com/projectcalico/libcalico-go/lib/set"
+
+	"github.com/projectcalico/felix/timeshim"
 )
 
 type netlinkStub interface {
-	Subscribe(
-		linkUpdates chan netlink.LinkUpdate,
-		routeUpdates chan netlink.RouteUpdate,
-	) error
+	// Subscribe subscribes to the given groups, sending the updates for all of them to updates
+	// in the order that the kernel sent them.  The subscription is torn down when done is
+	// closed.  If the subscription fails later, updates is closed.
+	Subscribe(groups NetlinkGroups, updates chan<- NetlinkUpdate, done <-chan struct{}) error
 	LinkList() ([]netlink.Link, error)
 	ListLocalRoutes(link netlink.Link, family int) ([]netlink.Route, error)
+	ListDefaultRoutes(family int) ([]netlink.Route, error)
+	AddrList(link netlink.Link, family int) ([]netlink.Addr, error)
+	// LinkAltNames returns the alternative names (IFLA_ALT_IFNAME) of the given interface.
+	LinkAltNames(ifIndex int) ([]string, error)
+	// ProbeCapabilities probes for the kernel capabilities that can be detected with harmless
+	// requests.  Capabilities that need a link dump are filled in by the monitor.
+	ProbeCapabilities() KernelCapabilities
 }
 
-type State string
-
+// iffLowerUp and iffDormant are the IFF_LOWER_UP and IFF_DORMANT flags from linux/if.h.
 const (
-	StateUnknown = ""
-	StateUp      = "up"
-	StateDown    = "down"
+	iffLowerUp = 0x10000
+	iffDormant = 0x20000
 )
 
-type InterfaceStateCallback func(ifaceName string, ifaceState State, ifIndex int)
-type AddrStateCallback func(ifaceName string, addrs set.Set)
-
-type Config struct {
-	// InterfaceExcludes is a list of interface names that we don't want callbacks for.
-	InterfaceExcludes []*regexp.Regexp
-	// ResyncInterval is the interval at which we rescan all the interfaces.  If <0 rescan is disabled.
-	ResyncInterval time.Duration
-}
 type InterfaceMonitor struct {
 	Config
 
-	netlinkStub   netlinkStub
-	resyncC       <-chan time.Time
-	upIfaces      map[string]int // Map from interface name to index.
-	StateCallback InterfaceStateCallback
-	AddrCallback  AddrStateCallback
-	ifaceName     map[int]string
-	ifaceAddrs    map[int]set.Set
+	netlinkStub netlinkStub
+	resyncC     <-chan time.Time
+	time        timeshim.Interface
+	// subscribedGroups is the set of netlink groups that we subscribe to, calculated from the
+	// config on first subscription.
+	subscribedGroups NetlinkGroups
+	sysfs            sysfsStub
+	upIfaces         map[string]int // Map from interface name to index.
+	StateCallback    InterfaceStateCallback
+	AddrCallback     AddrStateCallback
+	// addedStateCallbacks and addedAddrCallbacks are the callbacks registered with AddCallback
+	// and AddAddrCallback, in registration order.
+	addedStateCallbacks []InterfaceStateCallback
+	addedAddrCallbacks  []AddrStateCallback
+	// LinkAttrsCallback, if non-nil, is called when the tracked attributes (flags, MTU, MAC) of
+	// a non-excluded interface change.
+	LinkAttrsCallback LinkAttrsCallback
+	// InfoCallback, if non-nil, is called alongside the StateCallback with more detail about
+	// the interface, including its stable ID and detailed State, and when the detailed State
+	// of an interface that is down changes.
+	InfoCallback InterfaceInfoCallback
+	// DefaultRouteCallback, if non-nil, enables tracking of which interfaces carry the default
+	// route.  It is called once per family after the initial resync and then whenever the set
+	// of interfaces changes.
+	DefaultRouteCallback DefaultRouteCallback
+	// AddrAnnouncer, if non-nil, is used to announce new addresses to the interface's
+	// neighbours.
+	AddrAnnouncer AddrAnnouncer
+	// UnexpectedAddrFamilyCallback, if non-nil, is called when an interface gets an address of a
+	// family that isn't expected for it.
+	UnexpectedAddrFamilyCallback UnexpectedAddrFamilyCallback
+	// HeartbeatCallback, if non-nil, is called at the end of every resync, even if nothing
+	// changed.  Consumers can use it as a liveness signal, for example to refresh TTL-based
+	// caches.
+	HeartbeatCallback HeartbeatCallback
+	// InSyncCallback, if non-nil, is called once, after the start-of-day resync, when the
+	// StateCallback and AddrCallback have been told about every interface that already
+	// existed.  Consumers can then clean up anything left over for interfaces that weren't
+	// reported.  It isn't called again on later resyncs.
+	InSyncCallback InSyncCallback
+	// PeerAddrCallback, if non-nil, is called when the peer addresses of a point-to-point
+	// interface change.
+	PeerAddrCallback PeerAddrCallback
+	// AddrPrefixCallback, if non-nil, is called when the addresses of an interface, in CIDR
+	// form, change.
+	AddrPrefixCallback AddrPrefixCallback
+	// familyAddrs holds the addresses that we last passed to the FamilyAddrCallback, by
+	// interface name and then family; see SetFamilyAddrCallback.
+	familyAddrs map[string]map[int]set.Set
+	// AddrDeltaCallback, if non-nil, is called, after the AddrCallback, with the addresses that
+	// each update added to and removed from an interface.
+	AddrDeltaCallback AddrDeltaCallback
+	// deltaAddrs holds the addresses that the AddrDeltaCallback knows about, by interface name.
+	deltaAddrs map[string]set.Set
+	// VFCallback, if non-nil, is called when the SR-IOV virtual functions of a physical NIC
+	// change.  VF changes are only picked up on resync.
+	VFCallback VFCallback
+	// BondActiveSlaveCallback, if non-nil, is called when the active slave of a bond changes.
+	BondActiveSlaveCallback BondActiveSlaveCallback
+	// SubDeviceCallback, if non-nil, is called when a macvlan or ipvlan interface appears,
+	// changes mode or parent, or is removed.
+	SubDeviceCallback SubDeviceCallback
+	// ParentChainCallback, if non-nil, is called when the parent chain of a stacked device
+	// changes.
+	ParentChainCallback ParentChainCallback
+	// UnchangedIfaceCallback, if non-nil, is called after the start-of-day resync for each
+	// interface that was restored from a snapshot or the StateFile and whose state and
+	// addresses haven't changed, since we don't make the usual callbacks for those.
+	UnchangedIfaceCallback UnchangedIfaceCallback
+	// Classifier, if non-nil, is used to classify interfaces when they are first seen and when
+	// the ClassifierInput changes.  The class is included in the InterfaceInfo.
+	Classifier Classifier
+	// ClassChangeCallback, if non-nil, is called when an interface's class changes.
+	ClassChangeCallback ClassChangeCallback
+	// ClaimFunc, if non-nil, enables checking for leaked workload interfaces: the ones that the
+	// Classifier (which must be set) puts in ClassWorkload but that the ClaimFunc disowns for
+	// longer than Config.UnclaimedIfaceGracePeriod.  They are passed to the
+	// UnclaimedIfaceCallback, if non-nil, and counted in a gauge.  Checked after each resync.
+	ClaimFunc              IfaceClaimFunc
+	UnclaimedIfaceCallback UnclaimedIfaceCallback
+	// DuplicateMACCallback, if non-nil, is called when a MAC address becomes, or stops being,
+	// shared by unrelated interfaces.  Duplicates are also logged and reported by Interfaces.
+	DuplicateMACCallback DuplicateMACCallback
+	// MasterStateCallback, if non-nil, is called when the effective state of a bridge or bond
+	// master, derived from its members' states, changes.
+	MasterStateCallback MasterStateCallback
+	// ExpectedIfaceCallback, if non-nil, is called when an expected interface goes missing or
+	// comes back; see SetExpectedIfaces.
+	ExpectedIfaceCallback ExpectedIfaceCallback
+	// InterfaceFilter, if non-nil, restricts the monitor to the interfaces that it accepts; the
+	// others are ignored.  An interface that is renamed so that the filter rejects it is
+	// reported as deleted.
+	InterfaceFilter InterfaceFilter
+	ifaceName       map[int]string
+	ifaceAddrs      map[int]set.Set
+	// addrsFlushed holds the indexes of the interfaces whose addresses we've flushed because
+	// they went down.  Only populated if FlushAddrsOnDown is set.
+	addrsFlushed map[int]bool
+	peerAddrs    map[int]map[string]string
+	addrPrefixes map[int]set.Set
+	// v4AddrFlags maps from interface index to the IFA_F_* flags of its IPv4 addresses.  Only
+	// populated for interfaces with more than one IPv4 address; see secondary_addrs.go.
+	v4AddrFlags map[int]map[string]int
+	// tooManyAddrs holds the indexes of the interfaces that we've flagged for having more
+	// than Config.AddrCountThreshold addresses.  addrCountWarnedAt maps from interface index
+	// to when we last warned about it, for rate limiting.
+	tooManyAddrs      map[int]bool
+	addrCountWarnedAt map[int]time.Time
+	// vethPeerIdxs maps from the index of a veth to the index of its peer.
+	vethPeerIdxs map[int]int
+	// vfs maps from the index of an SR-IOV physical function to its virtual functions.
+	vfs map[int][]VFInfo
+	// bonds maps from the index of a bond to its tracked active slave.
+	bonds map[int]trackedBond
+	// subDevices maps from the index of a macvlan or ipvlan interface to its mode and parent.
+	subDevices map[int]*SubDevice
+	// classInputs and classes record the input to and output of the Classifier for each
+	// interface.
+	classInputs map[int]ClassifierInput
+	classes     map[int]InterfaceClass
+	// unclaimedSince maps from interface index to when we first saw a workload interface
+	// unclaimed.  unclaimedFlagged holds the ones that we've flagged.
+	unclaimedSince   map[int]time.Time
+	unclaimedFlagged map[int]bool
+	// altNames maps from interface name to the interface's alternative names, if
+	// MatchAltNames is enabled.
+	altNames map[string][]string
+	// linkParents and linkMasters map from interface index to the index of the interface's
+	// parent (IFLA_LINK) and master.  parentChains caches the resulting chains.
+	linkParents  map[int]int
+	linkMasters  map[int]int
+	parentChains map[int]*ParentChain
+	// masterIdxs holds the indexes of the bridges and bonds.  masterStates maps from the index
+	// of each master to the effective state that we last notified.
+	masterIdxs   map[int]bool
+	masterStates map[int]State
+	linkAttrs    map[int]trackedLinkAttrs
+	// linkKinds maps from interface index to netlink link type, for the InfoCallback.
+	linkKinds map[int]string
+	// ifaceMACs maps from interface index to MAC and macIfaces is the reverse index.
+	// duplicateMACs maps from each MAC that we've flagged as duplicated to the names of the
+	// interfaces that share it.
+	ifaceMACs     map[int]string
+	macIfaces     map[string]set.Set
+	duplicateMACs map[string][]string
+	ifaceIDs      map[int]ifaceIdentity
+	nextIfaceID   uint64
+	// teardownDeadlines maps from interface index to the end of the teardown window for
+	// interfaces that we've seen being deleted.  Only populated if TeardownWindow > 0.
+	// teardownLinks holds the latest link seen for each of those indexes since, if the index
+	// has come back, so that we can re-evaluate it when teardownTimer fires at the end of its
+	// window.
+	teardownDeadlines map[int]time.Time
+	teardownLinks     map[int]netlink.Link
+	teardownTimer     timeshim.Timer
+	teardownTimerC    <-chan time.Time
+
+	// defaultRouteIdxs maps from IP family to the set of interface indexes that carry a default
+	// route.
+	defaultRouteIdxs map[int]map[int]bool
+	// defaultRoutesStale is set when we may have missed default route updates, because we've
+	// (re)subscribed or failed to list the routes, so that the next resync re-lists them.
+	// Otherwise the updates keep defaultRouteIdxs current.
+	defaultRoutesStale bool
+	// defaultRouteNames maps from IP family to the names of the interfaces that we last
+	// reported as carrying the default route.  Protected by defaultRouteLock since it can be
+	// queried from other goroutines.
+	defaultRouteNames map[int][]string
+	defaultRouteLock  sync.Mutex
+
+	// lastAddrAnnounce maps from address to the time that we last announced it, for rate
+	// limiting.
+	lastAddrAnnounce     map[string]time.Time
+	startOfDayResyncDone bool
+	inResync             bool
+	// origin is the origin of the notifications that we're currently making.
+	origin UpdateOrigin
+	// metrics are this monitor's Prometheus collectors; see Config.Registerer.
+	metrics *monitorMetrics
+
+	// capabilities is written once, during the start-of-day resync.  The lock is only needed
+	// for access from other goroutines.
+	capabilities      KernelCapabilities
+	capabilitiesKnown bool
+	capabilitiesLock  sync.Mutex
+
+	// loopRunning is set (atomically) to 1 when MonitorInterfaces starts; after that, snapshot
+	// requests are passed to the main loop over snapshotReqC.  loopDoneC is closed once the
+	// main loop has exited, for whatever reason; after that, nothing reads snapshotReqC.
+	loopRunning  int32
+	snapshotReqC chan chan snapshotResponse
+	loopDoneC    chan struct{}
+	// inSync is set (atomically) to 1 once the start-of-day resync has been reported; see
+	// InSync.
+	inSync int32
+
+	// upNames is the set of interfaces that we've reported as up and upWaiters holds the
+	// channels of the WaitForIfaceUp calls that are waiting for each interface.  Protected by
+	// upWaitersLock since they're accessed from other goroutines.
+	upNames       map[string]bool
+	upWaiters     map[string][]chan struct{}
+	upWaitersLock sync.Mutex
+
+	// reportedAddrNames maps from interface name to the addresses that we last reported for
+	// it, sorted, for InterfaceAddrs.  Protected by reportedAddrsLock.
+	reportedAddrNames map[string][]string
+	reportedAddrsLock sync.Mutex
+
+	// upCountWatches holds the watches added by WatchUpCount, by name.
+	upCountWatches map[string]*upCountWatch
+	// expectedIfaces holds the declarations made by SetExpectedIfaces, by name, and
+	// expectedIfaceTimer fires when the earliest of their timeouts expires.
+	expectedIfaces      map[string]*expectedIface
+	expectedIfaceTimer  timeshim.Timer
+	expectedIfaceTimerC <-chan time.Time
+
+	// restoredIfaces holds the indexes of the interfaces restored from a snapshot that we
+	// haven't made any callbacks for since.  Emptied after the start-of-day resync.
+	restoredIfaces map[int]bool
+
+	// subscriptions holds the filtered subscribers added by AddSubscriber.  Only accessed from
+	// the main loop once it is running; other goroutines pass their changes over loopFuncC.
+	subscriptions []*subscription
+	loopFuncC     chan func()
+	// resyncReqC holds a pending RequestResync, if any.
+	resyncReqC chan struct{}
+
+	// withdrawn is set by StopAndWithdraw once it has withdrawn all the interfaces;
+	// withdrawing while it's doing so.
+	withdrawn   bool
+	withdrawing bool
+
+	// stopC is closed by Stop().
+	stopC    chan struct{}
+	stopOnce sync.Once
+
+	// resyncInterval is the nominal interval between periodic resyncs, or 0 if they're disabled
+	// (in which case we only resync when resyncC fires).  resyncTimer fires when the next one is
+	// due.
+	resyncInterval time.Duration
+	resyncTimer    timeshim.Timer
+	resyncTimerC   <-chan time.Time
+
+	// recorder is non-nil if we're recording to the RecordFile.
+	recorder *recorder
+	// replayer is non-nil if we're being driven by a Replayer.
+	replayer *Replayer
+
+	// CallbackGiveUpCallback, if non-nil, is called when we give up on a notification that a
+	// callback set with SetFallibleCallbacks keeps failing.
+	CallbackGiveUpCallback CallbackGiveUpCallback
+	fallibleStateCallback  FallibleStateCallback
+	fallibleAddrCallback   FallibleAddrCallback
+
+	// Middleware, if set, is run, in order, on each state and address update before it is
+	// delivered to the StateCallback, AddrCallback or a subscriber.  Must be set before
+	// MonitorInterfaces.
+	Middleware []Middleware
+	// pendingRetries holds the failed notifications that are waiting to be retried, and
+	// retryTimer fires when the earliest of them is due.
+	pendingRetries map[retryKey]*pendingRetry
+	retryTimer     timeshim.Timer
+	retryTimerC    <-chan time.Time
+	// resyncFailures counts the resyncs in a row that have failed, and resyncRetryTimer fires
+	// when the next retry is due.
+	resyncFailures    int
+	resyncRetryTimer  timeshim.Timer
+	resyncRetryTimerC <-chan time.Time
+	// resubscribeFailures counts the attempts in a row to re-subscribe to netlink that have
+	// failed, and resubscribeTimer fires when the next attempt is due.
+	resubscribeFailures int
+	resubscribeTimer    timeshim.Timer
+	resubscribeTimerC   <-chan time.Time
+
+	// paused is set by Pause; while it's set, heldNotifications holds the latest StateCallback
+	// and AddrCallback notifications for each interface.  deliveredStates and deliveredAddrs
+	// record what we last told those callbacks, so that Resume can skip notifications that
+	// came to nothing.  Interfaces that are down (with Config.DetailedStates, gone), or whose
+	// addresses have gone, are omitted.
+	paused            bool
+	heldNotifications map[string]*heldNotification
+	deliveredStates   map[string]State
+	deliveredAddrs    map[string]set.Set
+	pauseTimer        timeshim.Timer
+	pauseTimerC       <-chan time.Time
+	// batchTimer fires at the end of the current batch of notifications; see
+	// Config.BatchDelay.  The held notifications are in heldNotifications, as for a pause.
+	batchTimer  timeshim.Timer
+	batchTimerC <-chan time.Time
+
+	// CanaryCallback, if non-nil, is called with the result of each self-test; see
+	// Config.CanaryInterval.
+	CanaryCallback CanaryCallback
+	canary         canaryStub
+	// canaryTimer fires when the next self-test is due.  While canaryPending is set, we're
+	// waiting for the netlink update that shows the canary interface with the admin state
+	// canaryWantUp, until canaryDeadline fires.
+	canaryTimer       timeshim.Timer
+	canaryTimerC      <-chan time.Time
+	canaryPending     bool
+	canaryWantUp      bool
+	canaryStart       time.Time
+	canaryDeadline    timeshim.Timer
+	canaryDeadlineC   <-chan time.Time
+	canaryUnavailable bool
+
+	// ownedNetns is the network namespace that NewInNamespacePath opened for us, if any; we
+	// close it once Run returns.
+	ownedNetns *targetNetns
+}
+
+type InterfaceMonitorOp func(m *InterfaceMonitor)
+
+func WithMonitorTimeShim(t timeshim.Interface) InterfaceMonitorOp {
+	return func(m *InterfaceMonitor) {
+		m.time = t
+	}
 }
 
+const defaultResyncInterval = 10 * time.Second
+
 func New(config Config) *InterfaceMonitor {
-	// Interface monitor using the real netlink, and resyncing every 10 seconds.
-	var resyncC <-chan time.Time
-	if config.ResyncInterval > 0 {
-		log.WithField("interval", config.ResyncInterval).Info(
+	return newWithRealNetlink(config, &netlinkReal{})
+}
+
+// newWithRealNetlink creates an interface monitor using the real netlink, and resyncing every
+// ResyncInterval.
+func newWithRealNetlink(config Config, netlinkStub *netlinkReal, options ...InterfaceMonitorOp) *InterfaceMonitor {
+	resyncInterval := config.ResyncInterval
+	if resyncInterval == 0 {
+		resyncInterval = defaultResyncInterval
+	}
+	if resyncInterval > 0 {
+		log.WithField("interval", resyncInterval).Info(
 			"configured to periodically rescan interfaces.")
-		resyncTicker := time.NewTicker(config.ResyncInterval)
-		resyncC = resyncTicker.C
 	}
-	return NewWithStubs(config, &netlinkReal{}, resyncC)
+	options = append([]InterfaceMonitorOp{WithPeriodicResync(resyncInterval)}, options...)
+	return NewWithStubs(config, netlinkStub, nil, options...)
 }
 
-func NewWithStubs(config Config, netlinkStub netlinkStub, resyncC <-chan time.Time) *InterfaceMonitor {
-	return &InterfaceMonitor{
-		Config:      config,
-		netlinkStub: netlinkStub,
-		resyncC:     resyncC,
-		upIfaces:    map[string]int{},
-		ifaceName:   map[int]string{},
-		ifaceAddrs:  map[int]set.Set{},
+func NewWithStubs(
+	config Config,
+	netlinkStub netlinkStub,
+	resyncC <-chan time.Time,
+	options ...InterfaceMonitorOp,
+) *InterfaceMonitor {
+	m := &InterfaceMonitor{
+		Config:            config,
+		netlinkStub:       netlinkStub,
+		resyncC:           resyncC,
+		time:              timeshim.RealTime(),
+		origin:            OriginEvent,
+		metrics:           newMonitorMetrics(config.Registerer),
+		sysfs:             &sysfsReal{},
+		canary:            &canaryReal{},
+		upIfaces:          map[string]int{},
+		ifaceName:         map[int]string{},
+		ifaceAddrs:        map[int]set.Set{},
+		addrsFlushed:      map[int]bool{},
+		peerAddrs:         map[int]map[string]string{},
+		addrPrefixes:      map[int]set.Set{},
+		familyAddrs:       map[string]map[int]set.Set{},
+		deltaAddrs:        map[string]set.Set{},
+		v4AddrFlags:       map[int]map[string]int{},
+		tooManyAddrs:      map[int]bool{},
+		addrCountWarnedAt: map[int]time.Time{},
+		vethPeerIdxs:      map[int]int{},
+		vfs:               map[int][]VFInfo{},
+		bonds:             map[int]trackedBond{},
+		subDevices:        map[int]*SubDevice{},
+		classInputs:       map[int]ClassifierInput{},
+		classes:           map[int]InterfaceClass{},
+		unclaimedSince:    map[int]time.Time{},
+		unclaimedFlagged:  map[int]bool{},
+		altNames:          map[string][]string{},
+		linkParents:       map[int]int{},
+		linkMasters:       map[int]int{},
+		parentChains:      map[int]*ParentChain{},
+		masterIdxs:        map[int]bool{},
+		masterStates:      map[int]State{},
+		linkAttrs:         map[int]trackedLinkAttrs{},
+		linkKinds:         map[int]string{},
+		ifaceMACs:         map[int]string{},
+		macIfaces:         map[string]set.Set{},
+		duplicateMACs:     map[string][]string{},
+		ifaceIDs:          map[int]ifaceIdentity{},
+		teardownDeadlines: map[int]time.Time{},
+		teardownLinks:     map[int]netlink.Link{},
+		defaultRouteIdxs:  map[int]map[int]bool{},
+		defaultRouteNames: map[int][]string{},
+		lastAddrAnnounce:  map[string]time.Time{},
+		snapshotReqC:      make(chan chan snapshotResponse),
+		loopDoneC:         make(chan struct{}),
+		upNames:           map[string]bool{},
+		upWaiters:         map[string][]chan struct{}{},
+		reportedAddrNames: map[string][]string{},
+		loopFuncC:         make(chan func()),
+		resyncReqC:        make(chan struct{}, 1),
+		restoredIfaces:    map[int]bool{},
+		upCountWatches:    map[string]*upCountWatch{},
+		expectedIfaces:    map[string]*expectedIface{},
+		pendingRetries:    map[retryKey]*pendingRetry{},
+		heldNotifications: map[string]*heldNotification{},
+		deliveredStates:   map[string]State{},
+		deliveredAddrs:    map[string]set.Set{},
+		stopC:             make(chan struct{}),
+	}
+	for _, op := range options {
+		op(m)
 	}
+	return m
 }
 
 func IsInterfacePresent(name string) bool {
@@ -93,65 +479,278 @@ func IsInterfacePresent(name string) bool {
 	return link != nil
 }
 
+// MonitorInterfaces runs the monitor until Stop is called.  It panics if netlink fails; see Run.
 func (m *InterfaceMonitor) MonitorInterfaces() {
+	if err := m.Run(); err != nil {
+		log.WithError(err).Panic("Interface monitor failed.")
+	}
+}
+
+// Run is MonitorInterfaces for callers that want to handle failures themselves: it returns an
+// error if netlink fails, instead of panicking, or nil once the monitor is stopped.  The error
+// can be passed to IsPermissionError.
+func (m *InterfaceMonitor) Run() error {
 	log.Info("Interface monitoring thread started.")
+	m.loadStateFile()
+	atomic.StoreInt32(&m.loopRunning, 1)
+	// Deferred first so that it runs last, once we've finished with our state.
+	defer close(m.loopDoneC)
+	defer m.metrics.withdrawGauges()
+	if rec := m.startRecording(); rec != nil {
+		defer rec.close()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	updates := make(chan netlink.LinkUpdate, 10)
-	routeUpdates := make(chan netlink.RouteUpdate, 10)
-	if err := m.netlinkStub.Subscribe(updates, routeUpdates); err != nil {
-		log.WithError(err).Panic("Failed to subscribe to netlink stub")
+	filteredUpdates, defaultRouteUpdates, err := m.subscribeUpdates(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to netlink: %w", err)
 	}
-	filteredUpdates := make(chan netlink.LinkUpdate, 10)
-	filteredRouteUpdates := make(chan netlink.RouteUpdate, 10)
-	go FilterUpdates(context.Background(), filteredRouteUpdates, routeUpdates, filteredUpdates, updates)
-	log.Info("Subscribed to netlink updates.")
 
 	// Start of day, do a resync to notify all our existing interfaces.  We also do periodic
 	// resyncs because it's not clear what the ordering guarantees are for our netlink
-	// subscription vs a list operation as used by resync().
-	err := m.resync()
+	// subscription vs a list operation as used by resync().  It satisfies any RequestResync
+	// made before now.
+	m.clearResyncRequest()
+	err = m.resync()
 	if err != nil {
-		log.WithError(err).Panic("Failed to read link states from netlink.")
+		return fmt.Errorf("failed to read link states from netlink: %w", err)
 	}
+	m.startOfDayResyncDone = true
+	m.notifyUnchangedIfaces()
+	m.notifyInSync()
+	m.startExpectedIfaceTimeouts()
+	m.scheduleResync()
+	if eventStream := m.startEventStream(); eventStream != nil {
+		defer eventStream.close()
+	}
+	if exporter := m.startFileExporter(); exporter != nil {
+		defer exporter.close()
+	}
+	m.initCanary()
+	defer m.stopCanary()
+
+	var stateFileTimer timeshim.Timer
+	var stateFileTimerC <-chan time.Time
+	if m.StateFile != "" && m.StateFileWriteInterval > 0 {
+		stateFileTimer = m.time.NewTimer(m.StateFileWriteInterval)
+		defer stateFileTimer.Stop()
+		stateFileTimerC = stateFileTimer.Chan()
+	}
+	defer func() {
+		if m.retryTimer != nil {
+			m.retryTimer.Stop()
+		}
+		if m.pauseTimer != nil {
+			m.pauseTimer.Stop()
+		}
+		m.stopBatchTimer()
+		if m.expectedIfaceTimer != nil {
+			m.expectedIfaceTimer.Stop()
+		}
+		if m.teardownTimer != nil {
+			m.teardownTimer.Stop()
+		}
+		if m.resyncTimer != nil {
+			m.resyncTimer.Stop()
+		}
+		if m.resyncRetryTimer != nil {
+			m.resyncRetryTimer.Stop()
+		}
+		if m.resubscribeTimer != nil {
+			m.resubscribeTimer.Stop()
+		}
+		m.ownedNetns.close()
+	}()
 
-readLoop:
 	for {
 		log.WithFields(log.Fields{
-			"updates":      filteredUpdates,
-			"routeUpdates": filteredRouteUpdates,
-			"resyncC":      m.resyncC,
+			"updates": filteredUpdates,
+			"resyncC": m.resyncC,
 		}).Debug("About to select on possible triggers")
 		select {
 		case update, ok := <-filteredUpdates:
-			log.WithField("update", update).Debug("Link update")
-			if !ok {
-				log.Warn("Failed to read a link update")
-				break readLoop
+			closed := !ok
+			if ok {
+				// Under a storm of updates, handle them in batches rather than going
+				// round the loop for each one.
+				var batch []NetlinkUpdate
+				batch, closed = m.readUpdateBatch(update, filteredUpdates)
+				m.handleUpdateBatch(batch)
 			}
-			m.handleNetlinkUpdate(update)
-		case routeUpdate, ok := <-filteredRouteUpdates:
-			log.WithField("addrUpdate", routeUpdate).Debug("Address update")
-			if !ok {
-				log.Warn("Failed to read an address update")
-				break readLoop
+			if closed {
+				log.Warn("Netlink subscription closed, re-subscribing.")
+				if filteredUpdates, defaultRouteUpdates, err = m.resubscribe(ctx); err != nil {
+					return err
+				}
+			}
+		case routeUpdate := <-defaultRouteUpdates:
+			m.recordRouteUpdate(recordedDefaultRouteUpdate, routeUpdate)
+			m.handleDefaultRouteUpdate(routeUpdate)
+			m.replayEventHandled()
+		case respC := <-m.snapshotReqC:
+			data, err := m.snapshot()
+			respC <- snapshotResponse{data: data, err: err}
+		case fn := <-m.loopFuncC:
+			fn()
+			if m.withdrawn {
+				// StopAndWithdraw; make sure that we don't process any more updates.
+				m.shutDown()
+				return nil
 			}
-			m.handleNetlinkRouteUpdate(routeUpdate)
+		case <-m.retryTimerC:
+			m.retryNotifications()
+		case <-m.canaryTimerC:
+			m.startCanary()
+		case <-m.canaryDeadlineC:
+			m.onCanaryDeadline()
+		case <-m.expectedIfaceTimerC:
+			m.checkExpectedIfaces()
+		case <-m.teardownTimerC:
+			m.expireTeardownWindows()
+		case <-m.pauseTimerC:
+			log.WithField("maxPause", m.maxPauseDuration()).Warn(
+				"Monitor paused for too long, resuming.")
+			m.resume()
+		case <-m.batchTimerC:
+			m.endBatch()
+		case <-stateFileTimerC:
+			m.writeStateFile()
+			stateFileTimer.Reset(m.StateFileWriteInterval)
+		case <-m.stopC:
+			m.shutDown()
+			return nil
 		case <-m.resyncC:
 			log.Debug("Resync trigger")
-			err := m.resync()
+			m.recordResync()
+			err := m.resyncWithRetry()
 			if err != nil {
-				log.WithError(err).Panic("Failed to read link states from netlink.")
+				return fmt.Errorf("failed to read link states from netlink: %w", err)
+			}
+			m.replayEventHandled()
+		case <-m.resyncReqC:
+			log.Info("Resync requested")
+			m.recordResync()
+			if err := m.resyncWithRetry(); err != nil {
+				return fmt.Errorf("failed to read link states from netlink: %w", err)
+			}
+		case <-m.resyncTimerC:
+			log.Debug("Periodic resync")
+			m.scheduleResync()
+			m.recordResync()
+			if err := m.resyncWithRetry(); err != nil {
+				return fmt.Errorf("failed to read link states from netlink: %w", err)
+			}
+		case <-m.resyncRetryTimerC:
+			log.Info("Retrying failed resync")
+			m.resyncRetryTimer = nil
+			m.resyncRetryTimerC = nil
+			m.recordResync()
+			if err := m.resyncWithRetry(); err != nil {
+				return fmt.Errorf("failed to read link states from netlink: %w", err)
+			}
+		case <-m.resubscribeTimerC:
+			m.resubscribeTimer = nil
+			m.resubscribeTimerC = nil
+			if filteredUpdates, defaultRouteUpdates, err = m.resubscribe(ctx); err != nil {
+				return err
 			}
 		}
 	}
-	log.Panic("Failed to read events from Netlink.")
+}
+
+// Stop stops the monitor; MonitorInterfaces returns soon after and the netlink subscriptions are
+// torn down.  Pending WaitForIfaceUp calls return ErrMonitorStopped.  Safe to call more than once
+// and from any goroutine.
+func (m *InterfaceMonitor) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.stopC)
+	})
+}
+
+// SetCallbacks sets the StateCallback and AddrCallback.  Must be called before
+// MonitorInterfaces.
+func (m *InterfaceMonitor) SetCallbacks(stateCallback InterfaceStateCallback, addrCallback AddrStateCallback) {
+	m.StateCallback = stateCallback
+	m.AddrCallback = addrCallback
+}
+
+// AddCallback registers another state callback, which is called after the StateCallback (if
+// any) and any callbacks added before it, with the same updates.  Must be called before
+// MonitorInterfaces; use Subscribe to add a listener to a running monitor.
+func (m *InterfaceMonitor) AddCallback(callback InterfaceStateCallback) {
+	m.addedStateCallbacks = append(m.addedStateCallbacks, callback)
+}
+
+// AddAddrCallback is the equivalent of AddCallback for the AddrCallback.  Each added callback
+// gets its own copy of the addresses, so it may keep or modify them.
+func (m *InterfaceMonitor) AddAddrCallback(callback AddrStateCallback) {
+	m.addedAddrCallbacks = append(m.addedAddrCallbacks, callback)
+}
+
+// StopAndWithdraw is like Stop except that, first, it tells the consumers that every interface
+// has gone: for each interface, in index order, it reports the interface as down (if it's up;
+// with Config.DetailedStates, as StateNotPresent, if it has reported any state for it) and then
+// makes the address callback with nil addrs (if we've reported addresses for it).  It
+// returns once those callbacks have been made and no further callbacks follow them.  Since the
+// consumers no longer know about any interfaces, the StateFile (if any) is removed rather than
+// updated.  If the monitor has already been stopped, StopAndWithdraw does nothing.
+func (m *InterfaceMonitor) StopAndWithdraw() {
+	m.runOnMonitorLoop(func() {
+		log.Info("Interface monitor withdrawing all interfaces before stopping.")
+		// Bring the consumers up to date first so that the withdrawals aren't held back.  We're
+		// stopping, so there's no need to batch the withdrawals themselves; they go out
+		// straight away, in the order described above.
+		m.resume()
+		m.endBatch()
+		m.BatchDelay = 0
+		m.withdrawing = true
+		for _, ifIndex := range m.sortedIfIndexes() {
+			ifaceName := m.ifaceName[ifIndex]
+			if m.isReportedUp(ifIndex, ifaceName) {
+				m.notifyIfaceState(ifaceName, StateDown, ifIndex, m.ifaceIDs[ifIndex].hardwareAddr)
+			} else if m.DetailedStates {
+				// Does nothing unless we've told the StateCallback why the interface is down.
+				m.deliverState(ifaceName, StateNotPresent, ifIndex)
+			}
+			if m.reportedAddrs(ifIndex, ifaceName) != nil {
+				m.notifyAddrs(ifaceName, ifIndex, nil)
+			}
+		}
+		m.withdrawing = false
+		m.withdrawn = true
+		m.removeStateFile()
+		m.Stop()
+	})
+}
+
+// shutDown is called from the main loop when it exits after Stop or StopAndWithdraw.
+func (m *InterfaceMonitor) shutDown() {
+	log.Info("Interface monitor stopping.")
+	if !m.withdrawn {
+		m.writeStateFile()
+	}
 }
 
 func (m *InterfaceMonitor) isExcludedInterface(ifName string) bool {
-	for _, nameExp := range m.InterfaceExcludes {
+	if len(m.InterfaceIncludes) > 0 && !m.ifaceNameMatches(m.InterfaceIncludes, ifName) {
+		return true
+	}
+	return m.ifaceNameMatches(m.InterfaceExcludes, ifName)
+}
+
+// ifaceNameMatches returns true if the interface's name, or one of its altnames, matches one of
+// the expressions.
+func (m *InterfaceMonitor) ifaceNameMatches(nameExps []*regexp.Regexp, ifName string) bool {
+	for _, nameExp := range nameExps {
 		if nameExp.Match([]byte(ifName)) {
 			return true
 		}
+		for _, altName := range m.altNames[ifName] {
+			if nameExp.MatchString(altName) {
+				return true
+			}
+		}
 	}
 	return false
 }
@@ -164,13 +763,41 @@ func (m *InterfaceMonitor) handleNetlinkUpdate(update netlink.LinkUpdate) {
 		log.WithField("update", update).Warn("Missing attributes on netlink update.")
 		return
 	}
+	m.metrics.linkUpdates.Inc()
 
 	msgType := update.Header.Type
 	ifaceExists := msgType == syscall.RTM_NEWLINK // Alternative is an RTM_DELLINK
-	m.storeAndNotifyLink(ifaceExists, update.Link)
+	if m.isCanary(linkAttrs.Name) {
+		m.checkCanaryUpdate(ifaceExists, linkAttrs)
+		return
+	}
+	if _, known := m.ifaceName[linkAttrs.Index]; !known && m.isFilteredOut(linkAttrs.Name) {
+		log.WithField("ifaceName", linkAttrs.Name).Debug("Ignoring update for filtered interface.")
+		return
+	}
+	if !ifaceExists {
+		m.startTeardownWindow(linkAttrs.Index)
+	}
+	changeMask := update.IfInfomsg.Change
+	if ifaceExists && m.canSkipLinkUpdate(linkAttrs, changeMask) {
+		// The kernel told us exactly which flags changed and none of them affect the
+		// interface's state, so there's no need to recalculate it or re-list addresses.
+		log.WithFields(log.Fields{
+			"ifaceName":  linkAttrs.Name,
+			"changeMask": changeMask,
+		}).Debug("Link update doesn't affect interface state.")
+		m.storeAndNotifyLinkAttrs(linkAttrs.Name, linkAttrs, m.linkAttrs[linkAttrs.Index].protodown, changeMask)
+		return
+	}
+	m.storeAndNotifyLink(ifaceExists, update.Link, changeMask)
+	if !ifaceExists {
+		m.releaseIfaceID(linkAttrs.Index)
+		m.onLinkChangedForDefaultRoutes(linkAttrs.Index, true)
+	}
 }
 
 func (m *InterfaceMonitor) handleNetlinkRouteUpdate(update netlink.RouteUpdate) {
+	m.metrics.addrUpdates.Inc()
 	ifIndex := update.LinkIndex
 	if ifName, known := m.ifaceName[ifIndex]; known {
 		if m.isExcludedInterface(ifName) {
@@ -178,7 +805,12 @@ func (m *InterfaceMonitor) handleNetlinkRouteUpdate(update netlink.RouteUpdate)
 		}
 	}
 
+	if m.isExcludedAddr(update.Dst.IP) {
+		log.WithField("addr", update.Dst.IP).Debug("Ignoring update for excluded address.")
+		return
+	}
 	addr := update.Dst.IP.String()
+	isV4 := addrFamily(update.Dst.IP) == netlink.FAMILY_V4
 	exists := update.Type == unix.RTM_NEWROUTE
 	log.WithFields(log.Fields{
 		"addr":    addr,
@@ -189,8 +821,9 @@ func (m *InterfaceMonitor) handleNetlinkRouteUpdate(update netlink.RouteUpdate)
 	// notifyIfaceAddrs needs m.ifaceName[ifIndex] - because we can only notify when we know the
 	// interface name - so check that we have that.
 	if _, known := m.ifaceName[ifIndex]; !known {
-		// We think this interface does not exist - indicates a race between the link and
-		// address update channels.  Addresses will be notified when we process the link
+		// We think this interface does not exist.  Since we see link and address updates in
+		// order, that should only happen if the link update was filtered or the interface has
+		// since been deleted.  In any case, addresses are notified when we process the link
 		// update.
 		log.WithField("ifIndex", ifIndex).Debug("Link not notified yet.")
 		return
@@ -208,30 +841,54 @@ func (m *InterfaceMonitor) handleNetlinkRouteUpdate(update netlink.RouteUpdate)
 		if !m.ifaceAddrs[ifIndex].Contains(addr) {
 			m.ifaceAddrs[ifIndex].Add(addr)
 			m.notifyIfaceAddrs(ifIndex)
+			m.onAddrAdded(ifIndex, addr)
+			if isV4 {
+				m.refreshV4AddrFlags(ifIndex)
+			}
 		}
 	} else {
 		if m.ifaceAddrs[ifIndex].Contains(addr) {
+			wasPrimary := m.isPrimaryV4Addr(ifIndex, addr)
 			m.ifaceAddrs[ifIndex].Discard(addr)
 			m.notifyIfaceAddrs(ifIndex)
+			if wasPrimary {
+				m.onPrimaryV4AddrDeleted(ifIndex)
+			} else if isV4 {
+				m.refreshV4AddrFlags(ifIndex)
+			}
 		}
 	}
 }
 
+// onAddrAdded is called, after the AddrCallback, for each address that appears on a
+// non-excluded interface.
+func (m *InterfaceMonitor) onAddrAdded(ifIndex int, addr string) {
+	m.checkAddrFamily(ifIndex, addr)
+	m.maybeAnnounceAddr(ifIndex, addr)
+}
+
 func (m *InterfaceMonitor) notifyIfaceAddrs(ifIndex int) {
 	log.WithField("ifIndex", ifIndex).Debug("notifyIfaceAddrs")
+	m.checkAddrCount(ifIndex)
 	if name, known := m.ifaceName[ifIndex]; known {
 		log.WithField("ifIndex", ifIndex).Debug("Known interface")
 		addrs := m.ifaceAddrs[ifIndex]
+		if addrs != nil && m.addrsFlushed[ifIndex] {
+			log.WithField("ifIndex", ifIndex).Debug("Addresses flushed while down, not notifying.")
+			return
+		}
 		if addrs != nil {
 			// Take a copy, so that the dataplane's set of addresses is independent of
 			// ours.
-			addrs = addrs.Copy()
+			addrs = m.addrsForReport(name, addrs.Copy())
 		}
-		m.AddrCallback(name, addrs)
+		m.notifyAddrs(name, ifIndex, addrs)
+		m.refreshPeerAddrs(ifIndex)
+		m.refreshAddrPrefixes(ifIndex)
 	}
 }
 
-func (m *InterfaceMonitor) storeAndNotifyLink(ifaceExists bool, link netlink.Link) {
+func (m *InterfaceMonitor) storeAndNotifyLink(ifaceExists bool, link netlink.Link, changeMask uint32) {
 	attrs := link.Attrs()
 	ifIndex := attrs.Index
 	newName := attrs.Name
@@ -239,17 +896,30 @@ func (m *InterfaceMonitor) storeAndNotifyLink(ifaceExists bool, link netlink.Lin
 		"ifaceExists": ifaceExists,
 		"link":        link,
 	}).Debug("storeAndNotifyLink called")
+	if m.isCanary(newName) {
+		return
+	}
 
 	oldName := m.ifaceName[ifIndex]
+	if m.isFilteredOut(newName) {
+		if oldName != "" {
+			log.WithFields(log.Fields{
+				"oldName": oldName,
+				"newName": newName,
+			}).Info("Interface renamed to a filtered name, simulating deletion.")
+			m.storeAndNotifyLinkInner(false, oldName, link, changeMask)
+		}
+		return
+	}
 	if oldName != "" && oldName != newName {
 		log.WithFields(log.Fields{
 			"oldName": oldName,
 			"newName": newName,
 		}).Info("Interface renamed, simulating deletion of old copy.")
-		m.storeAndNotifyLinkInner(false, oldName, link)
+		m.storeAndNotifyLinkInner(false, oldName, link, changeMask)
 	}
 
-	m.storeAndNotifyLinkInner(ifaceExists, newName, link)
+	m.storeAndNotifyLinkInner(ifaceExists, newName, link, changeMask)
 }
 
 func linkIsOperUp(link netlink.Link) bool {
@@ -265,7 +935,87 @@ func linkIsOperUp(link netlink.Link) bool {
 	return ifaceIsUp
 }
 
-func (m *InterfaceMonitor) storeAndNotifyLinkInner(ifaceExists bool, ifaceName string, link netlink.Link) {
+// startTeardownWindow records that the interface with the given index has been deleted.  Until
+// the window expires, we won't report an interface with that index as up.
+func (m *InterfaceMonitor) startTeardownWindow(ifIndex int) {
+	if m.TeardownWindow <= 0 {
+		return
+	}
+	log.WithField("ifIndex", ifIndex).Debug("Interface tearing down, starting suppression window.")
+	m.teardownDeadlines[ifIndex] = m.time.Now().Add(m.TeardownWindow)
+	delete(m.teardownLinks, ifIndex)
+	m.scheduleTeardownTimer()
+}
+
+// isTearingDown returns true if the interface with the given index is within its teardown
+// window.  Expired entries are cleaned up as a side effect.
+func (m *InterfaceMonitor) isTearingDown(ifIndex int) bool {
+	deadline, ok := m.teardownDeadlines[ifIndex]
+	if !ok {
+		return false
+	}
+	if m.time.Now().Before(deadline) {
+		return true
+	}
+	log.WithField("ifIndex", ifIndex).Debug("Interface teardown window expired.")
+	delete(m.teardownDeadlines, ifIndex)
+	delete(m.teardownLinks, ifIndex)
+	return false
+}
+
+// expireTeardownWindows re-evaluates the interfaces whose teardown windows have expired, so
+// that one that is really up gets reported without waiting for another update or a resync
+// (which may be disabled).
+func (m *InterfaceMonitor) expireTeardownWindows() {
+	now := m.time.Now()
+	var expired []int
+	for ifIndex, deadline := range m.teardownDeadlines {
+		if !now.Before(deadline) {
+			expired = append(expired, ifIndex)
+		}
+	}
+	sort.Ints(expired)
+	for _, ifIndex := range expired {
+		link := m.teardownLinks[ifIndex]
+		delete(m.teardownDeadlines, ifIndex)
+		delete(m.teardownLinks, ifIndex)
+		if link == nil {
+			// Still gone.
+			continue
+		}
+		log.WithField("ifIndex", ifIndex).Debug("Teardown window expired, re-evaluating interface.")
+		m.storeAndNotifyLink(true, link, 0)
+	}
+	m.scheduleTeardownTimer()
+}
+
+// scheduleTeardownTimer (re)starts the timer for the earliest teardown deadline, or stops it if
+// there are none.
+func (m *InterfaceMonitor) scheduleTeardownTimer() {
+	if m.teardownTimer != nil {
+		m.teardownTimer.Stop()
+		m.teardownTimer = nil
+		m.teardownTimerC = nil
+	}
+	var earliest time.Time
+	for _, deadline := range m.teardownDeadlines {
+		if earliest.IsZero() || deadline.Before(earliest) {
+			earliest = deadline
+		}
+	}
+	if earliest.IsZero() {
+		return
+	}
+	m.teardownTimer = m.time.NewTimer(m.time.Until(earliest))
+	m.teardownTimerC = m.teardownTimer.Chan()
+}
+
+func (m *InterfaceMonitor) storeAndNotifyLinkInner(
+	ifaceExists bool,
+	ifaceName string,
+	link netlink.Link,
+	changeMask uint32,
+) {
 	log.WithFields(log.Fields{
 		"ifaceExists": ifaceExists,
 		"ifaceName":   ifaceName,
@@ -275,16 +1025,42 @@ func (m *InterfaceMonitor) storeAndNotifyLinkInner(ifaceExists bool, ifaceName s
 	// Store or remove mapping between this interface's index and name.
 	attrs := link.Attrs()
 	ifIndex := attrs.Index
+	oldAttrs, hadAttrs := m.linkAttrs[ifIndex]
 	if ifaceExists {
+		m.updateAltNames(ifIndex, m.ifaceName[ifIndex], ifaceName)
+		nameChanged := m.ifaceName[ifIndex] != ifaceName
 		m.ifaceName[ifIndex] = ifaceName
+		m.ensureIfaceID(ifIndex, ifaceName, attrs.HardwareAddr)
+		topologyChanged := m.storeLinkTopology(link)
+		m.storeVethPeer(link)
+		m.storeBondActiveSlave(link)
+		m.storeMasterKind(link)
+		m.linkKinds[ifIndex] = link.Type()
+		m.notifyBondActiveSlaves()
+		m.storeSubDevice(ifaceName, link)
+		m.refreshSubDeviceParents()
+		m.classifyLink(ifaceName, link)
+		m.refreshSlaveClasses(ifIndex)
+		m.storeAndNotifyLinkAttrs(ifaceName, attrs, m.readProtodown(ifaceName), changeMask)
+		m.storeMAC(ifIndex, attrs.HardwareAddr, nameChanged || topologyChanged)
+		if m.inResync {
+			// Only link dumps carry the VF list.
+			m.storeAndNotifyVFs(ifIndex, ifaceName, vfInfosFromAttrs(attrs))
+		}
+		if nameChanged || topologyChanged {
+			m.refreshParentChains()
+		}
+		if nameChanged {
+			m.onLinkChangedForDefaultRoutes(ifIndex, false)
+		}
 	} else {
-		if !m.isExcludedInterface(ifaceName) {
+		if !m.isExcludedInterface(ifaceName) && !m.DisableAddrMonitoring {
 			// for excluded interfaces, e.g. kube-ipvs0, we ignore all ip address changes.
 			log.Debug("Notify link non-existence to address callback consumers")
 			delete(m.ifaceAddrs, ifIndex)
 			m.notifyIfaceAddrs(ifIndex)
 		}
-		delete(m.ifaceName, ifIndex)
+		m.forgetLink(ifIndex, ifaceName)
 	}
 
 	// We need the operstate of the interface; this is carried in the IFF_RUNNING flag.  The
@@ -292,59 +1068,177 @@ func (m *InterfaceMonitor) storeAndNotifyLinkInner(ifaceExists bool, ifaceName s
 	// etc.
 	ifaceIsUp := ifaceExists && linkIsOperUp(link)
 	oldIfIndex, ifaceWasUp := m.upIfaces[ifaceName]
+	if ifaceExists && m.SysfsOperStateCheck && (m.inResync || ifaceIsUp != ifaceWasUp) {
+		ifaceIsUp = m.verifyOperStateWithSysfs(ifaceName, ifaceIsUp)
+	}
+	if ifaceIsUp && m.ProtodownAsDown && m.linkAttrs[ifIndex].protodown {
+		log.WithField("ifaceName", ifaceName).Debug("Interface is protodown, treating as down.")
+		ifaceIsUp = false
+	}
+	if _, ok := m.teardownDeadlines[ifIndex]; ok && ifaceExists {
+		m.teardownLinks[ifIndex] = link
+	}
+	if ifaceIsUp && m.isTearingDown(ifIndex) {
+		// An interface with this index was recently deleted, so this may be a stale update;
+		// don't report it as up.  Down transitions are still reported since they're safe.
+		// If the interface really is up, we'll report that when the window expires.
+		log.WithField("ifaceName", ifaceName).Debug("Suppressing up state for tearing-down interface.")
+		ifaceIsUp = false
+	}
 	logCxt := log.WithField("ifaceName", ifaceName)
 	if ifaceIsUp && !ifaceWasUp {
 		logCxt.Debug("Interface now up")
 		m.upIfaces[ifaceName] = ifIndex
-		m.StateCallback(ifaceName, StateUp, ifIndex)
+		m.metrics.upIfaces.Set(float64(len(m.upIfaces)))
+		m.notifyIfaceState(ifaceName, StateUp, ifIndex, attrs.HardwareAddr)
+		m.unflushAddrs(ifIndex)
+		m.onLinkChangedForDefaultRoutes(ifIndex, true)
 	} else if ifaceWasUp && !ifaceIsUp {
 		logCxt.Debug("Interface now down")
 		delete(m.upIfaces, ifaceName)
-		m.StateCallback(ifaceName, StateDown, oldIfIndex)
+		m.metrics.upIfaces.Set(float64(len(m.upIfaces)))
+		m.notifyIfaceState(ifaceName, StateDown, oldIfIndex, attrs.HardwareAddr)
+		if ifaceExists {
+			m.flushAddrsOnDown(oldIfIndex)
+		}
+		m.onLinkChangedForDefaultRoutes(oldIfIndex, true)
+	} else if ifaceExists && !ifaceIsUp && hadAttrs &&
+		m.downState(trackedLinkAttrs{rawFlags: attrs.RawFlags, operState: attrs.OperState}) !=
+			m.downState(oldAttrs) {
+		// Still down, but for a different reason.
+		logCxt.Debug("Interface link state changed")
+		m.notifyDownReasonChanged(ifaceName, ifIndex, attrs.HardwareAddr)
+	} else if !ifaceExists && hadAttrs && m.DetailedStates {
+		// Gone while down.  The StateCallback needs to know if we told it why it was down.
+		logCxt.Debug("Down interface deleted")
+		m.deliverState(ifaceName, StateNotPresent, ifIndex)
+	} else if ifaceExists && hadAttrs && (attrs.MTU != oldAttrs.mtu ||
+		!bytes.Equal(attrs.HardwareAddr, oldAttrs.hardwareAddr)) {
+		// Same state, new MTU or MAC; for example, after a bond failover or "ip link set
+		// address".
+		logCxt.WithFields(log.Fields{
+			"mtu": attrs.MTU,
+			"mac": attrs.HardwareAddr,
+		}).Debug("Interface MTU or MAC changed")
+		state := State(StateDown)
+		if ifaceIsUp {
+			state = StateUp
+		}
+		m.notifyIfaceInfo(ifaceName, state, ifIndex, attrs.HardwareAddr)
 	} else {
 		logCxt.WithField("ifaceIsUp", ifaceIsUp).Debug("Nothing to notify")
 	}
+	if !m.inResync {
+		// A resync re-derives the master states once it has seen all the links.
+		m.refreshMasterStates()
+	}
 
 	// If the link now exists, get addresses for the link and store and notify those too; then
 	// we don't have to worry about a possible race between the link and address update
 	// channels.  We deliberately do this regardless of the link state, as in some cases this
 	// will allow us to secure a Host Endpoint interface _before_ it comes up, and so eliminate
 	// a small window of insecurity.
-	if ifaceExists && !m.isExcludedInterface(ifaceName) {
+	if ifaceExists && !m.isExcludedInterface(ifaceName) && !m.DisableAddrMonitoring {
 		// Notify address changes for non excluded interfaces.
-		newAddrs := set.New()
-		for _, family := range [2]int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
-			routes, err := m.netlinkStub.ListLocalRoutes(link, family)
-			if err != nil {
-				log.WithError(err).Warn("Netlink route list operation failed.")
-			}
-			for _, route := range routes {
-				if route.Type != unix.RTN_LOCAL {
-					continue
-				}
-				newAddrs.Add(route.Dst.IP.String())
+		m.listAndNotifyAddrs(ifIndex, link)
+	}
+}
+
+// listAndNotifyAddrs lists the addresses of an interface and stores and notifies them, if they
+// have changed.  Returns true if they had.
+func (m *InterfaceMonitor) listAndNotifyAddrs(ifIndex int, link netlink.Link) (changed bool) {
+	newAddrs := set.New()
+	for _, family := range [2]int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		routes, err := m.netlinkStub.ListLocalRoutes(link, family)
+		if err != nil {
+			log.WithError(err).Warn("Netlink route list operation failed.")
+		}
+		routes = m.filterLocalRoutes(ifIndex, routes)
+		for _, route := range routes {
+			if route.Type != unix.RTN_LOCAL || m.isExcludedAddr(route.Dst.IP) {
+				continue
 			}
+			newAddrs.Add(route.Dst.IP.String())
 		}
-		if (m.ifaceAddrs[ifIndex] == nil) || !m.ifaceAddrs[ifIndex].Equals(newAddrs) {
-			log.WithFields(log.Fields{
-				"old": m.ifaceAddrs[ifIndex],
-				"new": newAddrs,
-			}).Debug("Detected interface address change while notifying link")
-			m.ifaceAddrs[ifIndex] = newAddrs
+	}
+	if (m.ifaceAddrs[ifIndex] == nil) || !m.ifaceAddrs[ifIndex].Equals(newAddrs) {
+		log.WithFields(log.Fields{
+			"old": m.ifaceAddrs[ifIndex],
+			"new": newAddrs,
+		}).Debug("Detected interface address change while notifying link")
+		oldAddrs := m.ifaceAddrs[ifIndex]
+		m.ifaceAddrs[ifIndex] = newAddrs
 
-			m.notifyIfaceAddrs(ifIndex)
-		}
+		m.notifyIfaceAddrs(ifIndex)
+		newAddrs.Iter(func(item interface{}) error {
+			if oldAddrs == nil || !oldAddrs.Contains(item) {
+				m.onAddrAdded(ifIndex, item.(string))
+			}
+			return nil
+		})
+		m.refreshV4AddrFlags(ifIndex)
+		return true
 	}
+	// Addresses are unchanged but the link may have become (or stopped being)
+	// point-to-point, or an address may have gained another prefix length.
+	m.refreshPeerAddrs(ifIndex)
+	m.refreshAddrPrefixes(ifIndex)
+	return false
+}
+
+// forgetLink cleans up the per-link state for an interface that has been removed, notifying
+// the optional callbacks as needed.
+func (m *InterfaceMonitor) forgetLink(ifIndex int, ifaceName string) {
+	m.storeAndNotifyVFs(ifIndex, ifaceName, nil)
+	delete(m.ifaceName, ifIndex)
+	delete(m.addrsFlushed, ifIndex)
+	delete(m.v4AddrFlags, ifIndex)
+	delete(m.addrPrefixes, ifIndex)
+	m.forgetAddrCount(ifIndex)
+	delete(m.linkAttrs, ifIndex)
+	delete(m.linkKinds, ifIndex)
+	delete(m.vethPeerIdxs, ifIndex)
+	delete(m.bonds, ifIndex)
+	m.storeAndNotifySubDevice(ifIndex, ifaceName, nil)
+	m.refreshSubDeviceParents()
+	m.forgetClass(ifIndex, ifaceName)
+	m.forgetUnclaimedIface(ifIndex)
+	delete(m.altNames, ifaceName)
+	m.forgetLinkTopology(ifIndex)
+	delete(m.masterIdxs, ifIndex)
+	m.refreshParentChains()
+	m.forgetMAC(ifIndex)
+	m.forgetSubscriptions(ifIndex)
+	delete(m.restoredIfaces, ifIndex)
 }
 
 func (m *InterfaceMonitor) resync() error {
 	log.Debug("Resyncing interface state.")
+	m.metrics.resyncs.Inc()
+	startTime := m.time.Now()
+	defer func() {
+		m.metrics.resyncTime.Observe(m.time.Since(startTime).Seconds())
+	}()
+	m.inResync = true
+	origin := OriginResync
+	if !m.startOfDayResyncDone {
+		origin = OriginReplay
+	}
+	defer m.setOrigin(origin)()
+	defer func() {
+		m.inResync = false
+	}()
 	links, err := m.netlinkStub.LinkList()
 	if err != nil {
 		log.WithError(err).Warn("Netlink list operation failed.")
 		return err
 	}
+	if !m.startOfDayResyncDone {
+		m.probeCapabilities(links)
+	}
 	currentIfaces := set.New()
+	currentIdxs := set.New()
+	var currentLinks []netlink.Link
 	for _, link := range links {
 		attrs := link.Attrs()
 		if attrs == nil {
@@ -354,19 +1248,78 @@ func (m *InterfaceMonitor) resync() error {
 			continue
 		}
 		currentIfaces.Add(attrs.Name)
-		m.storeAndNotifyLink(true, link)
+		currentIdxs.Add(attrs.Index)
+		currentLinks = append(currentLinks, link)
+	}
+	// Clean up the interfaces that have gone before looking at the ones that are there, in
+	// the same order as the kernel would have told us.  Otherwise, if an interface was
+	// recreated with a new index while we weren't listening, removing the old index would
+	// take its name down with it.
+	m.resyncRemovedIfaces(currentIdxs)
+	for _, link := range currentLinks {
+		m.storeAndNotifyLink(true, link, 0)
 	}
 	for name, ifIndex := range m.upIfaces {
 		if currentIfaces.Contains(name) {
 			continue
 		}
 		log.WithField("ifaceName", name).Info("Spotted interface removal on resync.")
-		m.StateCallback(name, StateDown, ifIndex)
-		m.AddrCallback(name, nil)
+		m.notifyIfaceState(name, StateDown, ifIndex, m.ifaceIDs[ifIndex].hardwareAddr)
+		if !m.DisableAddrMonitoring {
+			m.notifyAddrs(name, ifIndex, nil)
+			m.storeAndNotifyPeerAddrs(ifIndex, name, nil)
+			m.storeAndNotifyAddrPrefixes(ifIndex, name, nil)
+		}
 		delete(m.upIfaces, name)
+		m.metrics.upIfaces.Set(float64(len(m.upIfaces)))
 		delete(m.ifaceAddrs, ifIndex)
-		delete(m.ifaceName, ifIndex)
+		m.forgetLink(ifIndex, name)
+		m.releaseIfaceID(ifIndex)
+		m.startTeardownWindow(ifIndex)
+	}
+	m.refreshMasterStates()
+	for ifIndex := range m.teardownDeadlines {
+		// Called for its side-effect of cleaning up expired entries.
+		m.isTearingDown(ifIndex)
+	}
+	m.cleanUpAddrAnnounceHistory()
+	if m.defaultRoutesStale {
+		m.defaultRoutesStale = false
+		for _, family := range defaultRouteFamilies {
+			m.resyncDefaultRoutes(family)
+		}
 	}
+	m.checkUnclaimedIfaces()
+	m.updateAddrsGauge()
+	m.sendHeartbeat()
 	log.Debug("Resync complete")
 	return nil
 }
+
+// notifyInSync calls the InSyncCallback after the start-of-day resync.  Any notifications that
+// are being held for a batch go out first, cutting the batch short.
+func (m *InterfaceMonitor) notifyInSync() {
+	atomic.StoreInt32(&m.inSync, 1)
+	if m.InSyncCallback == nil {
+		return
+	}
+	m.endBatch()
+	log.Info("Interface monitor in sync.")
+	m.InSyncCallback()
+}
+
+func (m *InterfaceMonitor) sendHeartbeat() {
+	if m.HeartbeatCallback == nil {
+		return
+	}
+	numIfaces := 0
+	for _, name := range m.ifaceName {
+		if !m.isExcludedInterface(name) {
+			numIfaces++
+		}
+	}
+	m.HeartbeatCallback(Heartbeat{
+		NumInterfaces: numIfaces,
+		Timestamp:     m.time.Now(),
+	})
+}
@@ -0,0 +1,474 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ifacemonitor
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+// This is a best-effort implementation of the monitor for macOS.  It is a development aid, so
+// that code that uses the monitor can be run and debugged on a Mac; it is not supported for
+// production use.
+//
+// There's no netlink on macOS so the interfaces and addresses are listed with getifaddrs (via
+// the net package) and any interface or address message on a routing socket triggers a full
+// resync.  Only the core callbacks are supported: StateCallback, AddrCallback and
+// HeartbeatCallback.  Of the Config, only InterfaceExcludes, InterfaceIncludes, ResyncInterval
+// and DisableAddrMonitoring are used.  An interface is reported up if it is administratively up;
+// the BSD interfaces don't have a Linux-style oper state.
+
+const darwinDefaultResyncInterval = 10 * time.Second
+
+type InterfaceMonitor struct {
+	Config
+
+	StateCallback     InterfaceStateCallback
+	AddrCallback      AddrStateCallback
+	HeartbeatCallback HeartbeatCallback
+
+	// lock protects the fields below, which are read by Interfaces.
+	lock       sync.Mutex
+	ifaceName  map[int]string
+	upIfaces   map[string]int // Map from interface name to index.
+	ifaceAddrs map[int]set.Set
+	mtus       map[int]int
+	hwAddrs    map[int]string
+
+	// resynced is set once the first resync is done; the notifications that it makes are
+	// OriginReplay and later ones are OriginResync.
+	resynced bool
+
+	stopC    chan struct{}
+	stopOnce sync.Once
+}
+
+func New(config Config) *InterfaceMonitor {
+	return &InterfaceMonitor{
+		Config:     config,
+		ifaceName:  map[int]string{},
+		upIfaces:   map[string]int{},
+		ifaceAddrs: map[int]set.Set{},
+		mtus:       map[int]int{},
+		hwAddrs:    map[int]string{},
+		stopC:      make(chan struct{}),
+	}
+}
+
+// SetCallbacks sets the StateCallback and AddrCallback.
+func (m *InterfaceMonitor) SetCallbacks(stateCallback InterfaceStateCallback, addrCallback AddrStateCallback) {
+	m.StateCallback = stateCallback
+	m.AddrCallback = addrCallback
+}
+
+// SetOriginCallbacks sets callbacks that are told the origin of each notification, in place of
+// the StateCallback and AddrCallback.  Since this monitor polls, there are no OriginEvent
+// notifications.
+func (m *InterfaceMonitor) SetOriginCallbacks(stateCallback InterfaceStateOriginCallback, addrCallback AddrStateOriginCallback) {
+	m.StateCallback = func(ifaceName string, ifaceState State, ifIndex int) {
+		stateCallback(ifaceName, ifaceState, ifIndex, m.origin())
+	}
+	m.AddrCallback = func(ifaceName string, addrs set.Set) {
+		addrCallback(ifaceName, addrs, m.origin())
+	}
+}
+
+func (m *InterfaceMonitor) origin() UpdateOrigin {
+	if m.resynced {
+		return OriginResync
+	}
+	return OriginReplay
+}
+
+func (m *InterfaceMonitor) MonitorInterfaces() {
+	if err := m.Run(); err != nil {
+		log.WithError(err).Panic("Interface monitor failed.")
+	}
+}
+
+// Run monitors the interfaces until Stop is called.
+func (m *InterfaceMonitor) Run() error {
+	log.Warn("Running the development-only macOS interface monitor.")
+	fd, err := unix.Socket(unix.AF_ROUTE, unix.SOCK_RAW, unix.AF_UNSPEC)
+	if err != nil {
+		return fmt.Errorf("failed to open routing socket: %w", err)
+	}
+	// Make the socket non-blocking so that the os.File uses the poller and closing it unblocks
+	// the reader.
+	if err := unix.SetNonblock(fd, true); err != nil {
+		_ = unix.Close(fd)
+		return fmt.Errorf("failed to set up routing socket: %w", err)
+	}
+	routeSocket := os.NewFile(uintptr(fd), "route")
+	defer routeSocket.Close()
+
+	triggerC := make(chan struct{}, 1)
+	readErrC := make(chan error, 1)
+	go m.readRoutingSocket(routeSocket, triggerC, readErrC)
+
+	resyncInterval := m.ResyncInterval
+	if resyncInterval == 0 {
+		resyncInterval = darwinDefaultResyncInterval
+	}
+	var resyncC <-chan time.Time
+	if resyncInterval > 0 {
+		ticker := time.NewTicker(resyncInterval)
+		defer ticker.Stop()
+		resyncC = ticker.C
+	}
+
+	if err := m.ResyncOnce(); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-triggerC:
+		case <-resyncC:
+		case err := <-readErrC:
+			select {
+			case <-m.stopC:
+				return nil
+			default:
+			}
+			return fmt.Errorf("failed to read from routing socket: %w", err)
+		case <-m.stopC:
+			return nil
+		}
+		if err := m.resync(); err != nil {
+			return err
+		}
+	}
+}
+
+// readRoutingSocket reads messages from the routing socket and signals triggerC when one
+// might mean that the interfaces have changed.  Signals are coalesced, since each one triggers
+// a full resync.
+func (m *InterfaceMonitor) readRoutingSocket(routeSocket *os.File, triggerC chan<- struct{}, errC chan<- error) {
+	buf := make([]byte, os.Getpagesize())
+	for {
+		n, err := routeSocket.Read(buf)
+		if err != nil {
+			errC <- err
+			return
+		}
+		// The message type follows the 2-byte length and 1-byte version.
+		if n < 4 {
+			continue
+		}
+		switch buf[3] {
+		case unix.RTM_IFINFO, unix.RTM_NEWADDR, unix.RTM_DELADDR:
+		default:
+			continue
+		}
+		select {
+		case triggerC <- struct{}{}:
+		default:
+			// Resync already pending.
+		}
+	}
+}
+
+// Stop stops the monitor.  Run returns nil once it has noticed.
+func (m *InterfaceMonitor) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.stopC)
+	})
+}
+
+// ListInterfaces lists the interfaces once and returns what it found, as Interfaces would.
+func ListInterfaces(config Config) ([]InterfaceStatus, error) {
+	m := New(config)
+	if err := m.ResyncOnce(); err != nil {
+		return nil, err
+	}
+	return m.Interfaces(), nil
+}
+
+// ResyncOnce lists the interfaces and their addresses, making the usual callbacks (if set).
+// Interfaces then returns what was found.
+func (m *InterfaceMonitor) ResyncOnce() error {
+	if m.StateCallback == nil {
+		m.StateCallback = func(ifaceName string, ifaceState State, ifIndex int) {}
+	}
+	if m.AddrCallback == nil {
+		m.AddrCallback = func(ifaceName string, addrs set.Set) {}
+	}
+	return m.resync()
+}
+
+// Interfaces returns the monitor's view of all the interfaces, in index order.  Safe to call
+// from any goroutine.  Interface classes and altnames aren't supported.
+func (m *InterfaceMonitor) Interfaces() []InterfaceStatus {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var ifIndexes []int
+	for ifIndex := range m.ifaceName {
+		ifIndexes = append(ifIndexes, ifIndex)
+	}
+	sort.Ints(ifIndexes)
+	var statuses []InterfaceStatus
+	for _, ifIndex := range ifIndexes {
+		name := m.ifaceName[ifIndex]
+		status := InterfaceStatus{
+			Index:        ifIndex,
+			Name:         name,
+			Excluded:     m.isExcludedInterface(name),
+			MTU:          m.mtus[ifIndex],
+			HardwareAddr: m.hwAddrs[ifIndex],
+		}
+		if !status.Excluded {
+			status.State = StateDown
+			if _, up := m.upIfaces[name]; up {
+				status.State = StateUp
+			}
+			if addrs := m.ifaceAddrs[ifIndex]; addrs != nil {
+				status.Addrs = setToSortedSlice(addrs)
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// UpInterfaces returns the names of the interfaces that the monitor has reported as up, sorted.
+// Safe to call from any goroutine, including from within the callbacks.
+func (m *InterfaceMonitor) UpInterfaces() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	names := []string{}
+	for name := range m.upIfaces {
+		if !m.isExcludedInterface(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// IsUp returns true if the named interface is up.  Safe to call from any goroutine.
+func (m *InterfaceMonitor) IsUp(ifaceName string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	_, up := m.upIfaces[ifaceName]
+	return up && !m.isExcludedInterface(ifaceName)
+}
+
+// InSync returns true once the first resync is done.  Safe to call from any goroutine.
+func (m *InterfaceMonitor) InSync() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.resynced
+}
+
+// InterfaceAddrs returns the addresses of the named interface, sorted, or nil if they aren't
+// known.  Safe to call from any goroutine, including from within the callbacks.
+func (m *InterfaceMonitor) InterfaceAddrs(ifaceName string) []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for ifIndex, name := range m.ifaceName {
+		if name != ifaceName || m.isExcludedInterface(name) {
+			continue
+		}
+		if addrs := m.ifaceAddrs[ifIndex]; addrs != nil {
+			return setToSortedSlice(addrs)
+		}
+	}
+	return nil
+}
+
+func (m *InterfaceMonitor) isExcludedInterface(ifName string) bool {
+	if len(m.InterfaceIncludes) > 0 && !ifaceNameMatches(m.InterfaceIncludes, ifName) {
+		return true
+	}
+	return ifaceNameMatches(m.InterfaceExcludes, ifName)
+}
+
+func ifaceNameMatches(nameExps []*regexp.Regexp, ifName string) bool {
+	for _, nameExp := range nameExps {
+		if nameExp.Match([]byte(ifName)) {
+			return true
+		}
+	}
+	return false
+}
+
+// resync lists the interfaces and their addresses and makes callbacks for anything that has
+// changed since the last resync.
+func (m *InterfaceMonitor) resync() error {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return fmt.Errorf("failed to list interfaces: %w", err)
+	}
+
+	seenIdxs := map[int]bool{}
+	for _, iface := range ifaces {
+		seenIdxs[iface.Index] = true
+		var addrs set.Set
+		if !m.DisableAddrMonitoring && !m.isExcludedInterface(iface.Name) {
+			addrs, err = listAddrs(iface)
+			if err != nil {
+				// The interface may have just gone; we'll resync again when we get the
+				// message.
+				log.WithError(err).WithField("ifaceName", iface.Name).Warn("Failed to list addresses.")
+				continue
+			}
+			if m.LinkLocalAddrZones {
+				addrs = zoneLinkLocalAddrs(iface.Name, addrs)
+			}
+		}
+		m.storeAndNotifyIface(iface, addrs)
+	}
+
+	for ifIndex, name := range m.ifaceNameCopy() {
+		if !seenIdxs[ifIndex] {
+			m.notifyIfaceGone(ifIndex, name)
+		}
+	}
+	m.lock.Lock()
+	m.resynced = true
+	m.lock.Unlock()
+
+	if m.HeartbeatCallback != nil {
+		numIfaces := 0
+		for _, name := range m.ifaceNameCopy() {
+			if !m.isExcludedInterface(name) {
+				numIfaces++
+			}
+		}
+		m.HeartbeatCallback(Heartbeat{
+			NumInterfaces: numIfaces,
+			Timestamp:     time.Now(),
+		})
+	}
+	return nil
+}
+
+func listAddrs(iface net.Interface) (set.Set, error) {
+	ifaceAddrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	addrs := set.New()
+	for _, addr := range ifaceAddrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			addrs.Add(ipNet.IP.String())
+		}
+	}
+	return addrs, nil
+}
+
+func (m *InterfaceMonitor) ifaceNameCopy() map[int]string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	names := map[int]string{}
+	for ifIndex, name := range m.ifaceName {
+		names[ifIndex] = name
+	}
+	return names
+}
+
+// storeAndNotifyIface records the interface's state and addresses and makes the callbacks for
+// any changes.  addrs is nil if we don't track the interface's addresses.
+func (m *InterfaceMonitor) storeAndNotifyIface(iface net.Interface, addrs set.Set) {
+	ifIndex := iface.Index
+	name := iface.Name
+	up := iface.Flags&net.FlagUp != 0
+
+	m.lock.Lock()
+	oldName, known := m.ifaceName[ifIndex]
+	m.lock.Unlock()
+	if known && oldName != name {
+		// Renamed; treat it as the old interface going and a new one appearing.
+		m.notifyIfaceGone(ifIndex, oldName)
+		known = false
+	}
+
+	m.lock.Lock()
+	m.ifaceName[ifIndex] = name
+	m.mtus[ifIndex] = iface.MTU
+	m.hwAddrs[ifIndex] = iface.HardwareAddr.String()
+	_, wasUp := m.upIfaces[name]
+	if up {
+		m.upIfaces[name] = ifIndex
+	} else {
+		delete(m.upIfaces, name)
+	}
+	oldAddrs := m.ifaceAddrs[ifIndex]
+	if addrs != nil {
+		m.ifaceAddrs[ifIndex] = addrs
+	}
+	m.lock.Unlock()
+
+	if m.isExcludedInterface(name) {
+		return
+	}
+	if up != wasUp {
+		state := State(StateDown)
+		if up {
+			state = StateUp
+		}
+		log.WithFields(log.Fields{"ifaceName": name, "state": state}).Info("Interface state changed.")
+		m.StateCallback(name, state, ifIndex)
+	}
+	if addrs != nil && (!known || oldAddrs == nil || !oldAddrs.Equals(addrs)) {
+		log.WithFields(log.Fields{"ifaceName": name, "addrs": addrs}).Info("Interface addresses changed.")
+		m.AddrCallback(name, addrs.Copy())
+	}
+}
+
+// notifyIfaceGone forgets the interface and reports that its addresses have gone and that it
+// is down, in the same order as the netlink implementation.
+func (m *InterfaceMonitor) notifyIfaceGone(ifIndex int, name string) {
+	m.lock.Lock()
+	_, wasUp := m.upIfaces[name]
+	hadAddrs := m.ifaceAddrs[ifIndex] != nil
+	delete(m.ifaceName, ifIndex)
+	delete(m.upIfaces, name)
+	delete(m.ifaceAddrs, ifIndex)
+	delete(m.mtus, ifIndex)
+	delete(m.hwAddrs, ifIndex)
+	m.lock.Unlock()
+
+	if m.isExcludedInterface(name) {
+		return
+	}
+	log.WithField("ifaceName", name).Info("Interface gone.")
+	if hadAddrs {
+		m.AddrCallback(name, nil)
+	}
+	if wasUp {
+		m.StateCallback(name, StateDown, ifIndex)
+	}
+}
+
+func setToSortedSlice(s set.Set) []string {
+	items := []string{}
+	s.Iter(func(item interface{}) error {
+		items = append(items, item.(string))
+		return nil
+	})
+	sort.Strings(items)
+	return items
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ifacemonitor_test
+
+import (
+	"regexp"
+	"sync"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// These tests run against the local machine's interfaces; every Mac has lo0.
+var _ = Describe("macOS interface monitor", func() {
+	findLo0 := func(statuses []ifacemonitor.InterfaceStatus) *ifacemonitor.InterfaceStatus {
+		for i := range statuses {
+			if statuses[i].Name == "lo0" {
+				return &statuses[i]
+			}
+		}
+		return nil
+	}
+
+	It("should find the loopback interface on resync", func() {
+		m := ifacemonitor.New(ifacemonitor.Config{})
+		Expect(m.ResyncOnce()).To(Succeed())
+		lo0 := findLo0(m.Interfaces())
+		Expect(lo0).NotTo(BeNil())
+		Expect(lo0.State).To(Equal(ifacemonitor.State(ifacemonitor.StateUp)))
+		Expect(lo0.Addrs).To(ContainElement("127.0.0.1"))
+	})
+
+	It("should not report excluded interfaces", func() {
+		m := ifacemonitor.New(ifacemonitor.Config{
+			InterfaceExcludes: []*regexp.Regexp{regexp.MustCompile("^lo0$")},
+		})
+		var lock sync.Mutex
+		var reported []string
+		m.SetCallbacks(
+			func(ifaceName string, state ifacemonitor.State, ifIndex int) {
+				lock.Lock()
+				defer lock.Unlock()
+				reported = append(reported, ifaceName)
+			},
+			func(ifaceName string, addrs set.Set) {
+				lock.Lock()
+				defer lock.Unlock()
+				reported = append(reported, ifaceName)
+			},
+		)
+		Expect(m.ResyncOnce()).To(Succeed())
+		Expect(reported).NotTo(ContainElement("lo0"))
+		lo0 := findLo0(m.Interfaces())
+		Expect(lo0).NotTo(BeNil())
+		Expect(lo0.Excluded).To(BeTrue())
+		Expect(lo0.Addrs).To(BeNil())
+	})
+
+	It("should make callbacks from Run and return when stopped", func() {
+		m := ifacemonitor.New(ifacemonitor.Config{})
+		updates := make(chan string, 100)
+		m.SetCallbacks(
+			func(ifaceName string, state ifacemonitor.State, ifIndex int) {
+				updates <- ifaceName + " " + string(state)
+			},
+			func(ifaceName string, addrs set.Set) {},
+		)
+		doneC := make(chan error, 1)
+		go func() {
+			doneC <- m.Run()
+		}()
+		Eventually(updates).Should(Receive(Equal("lo0 up")))
+		m.Stop()
+		Eventually(doneC).Should(Receive(BeNil()))
+	})
+})
@@ -12,11 +12,20 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+// +build !darwin
+
 package ifacemonitor_test
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
@@ -30,25 +39,76 @@ import (
 	"github.com/projectcalico/libcalico-go/lib/set"
 
 	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ifacemonitor/testutils"
+	"github.com/projectcalico/felix/timeshim/mocktime"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
 
 type linkModel struct {
-	index int
-	state string
-	addrs set.Set
+	index      int
+	state      string
+	mtu        int
+	mac        net.HardwareAddr
+	extraFlags uint32
+	addrs      set.Set
+	tentative  set.Set
+	// secondary holds the IPv4 addresses that are secondary to another address in the same
+	// subnet.
+	secondary set.Set
+	// peers maps from address to peer address, for point-to-point links.
+	peers     map[string]string
+	operState netlink.LinkOperState
+	// linkType is the netlink link type, for example "veth"; "dummy" if empty.
+	linkType string
+	// parentIndex is the IFLA_LINK attribute; for a veth, the index of its peer.
+	parentIndex int
+	// vfs is the SR-IOV VF list of a physical function.
+	vfs []netlink.VfInfo
+	// activeSlave is the index of a bond's active slave; 0 if none.
+	activeSlave int
+	// mode is the macvlan or ipvlan mode.
+	mode int
+	// masterIndex is the index of the link's master; 0 if none.
+	masterIndex int
+	altNames    []string
 }
 
 type netlinkTest struct {
-	linkUpdates    chan netlink.LinkUpdate
-	routeUpdates   chan netlink.RouteUpdate
+	updates        chan<- ifacemonitor.NetlinkUpdate
 	userSubscribed chan int
 
+	// subscribedGroups records the groups that the monitor asked for.  Written before
+	// userSubscribed is signalled.
+	subscribedGroups ifacemonitor.NetlinkGroups
+	// done is the channel that the monitor passed to Subscribe; closed when it stops.
+	done <-chan struct{}
+
 	nextIndex int
 	links     map[string]linkModel
 
+	// numListRoutesCalls counts calls to ListLocalRoutes.
+	numListRoutesCalls int
+	// numLinkListCalls counts calls to LinkList.
+	numLinkListCalls int
+	// numListDefaultRoutesCalls counts calls to ListDefaultRoutes.
+	numListDefaultRoutesCalls int
+
+	// capabilities is returned from ProbeCapabilities.
+	capabilities ifacemonitor.KernelCapabilities
+	// subscribeErr, if set, is returned from Subscribe.
+	subscribeErr error
+	// linkListErr, if set, is returned from LinkList.  Protected by linksMutex.
+	linkListErr error
+	// ignoreRouteFilters simulates an old kernel that ignores the filters in route dump
+	// requests; ListLocalRoutes returns the local routes for all links.
+	ignoreRouteFilters bool
+
+	// defaultRoutes maps from IP family to the names of the interfaces that carry the default
+	// route.
+	defaultRoutes map[int][]string
+
 	// Mutex protecting the two items above.  Note that in many cases we unlock as soon as
 	// possible after we've read and/or written that data - instead of using defer - because we
 	// don't want to hold the mutex when writing to a channel (which is often what happens next
@@ -67,9 +127,109 @@ type linkUpdate struct {
 	index int
 }
 
+type linkAttrsUpdate struct {
+	name  string
+	index int
+	delta ifacemonitor.LinkAttrsDelta
+}
+
+type defaultRouteUpdate struct {
+	family int
+	names  []string
+}
+
+type announcement struct {
+	ifaceName string
+	index     int
+	mac       net.HardwareAddr
+	addr      string
+}
+
+type mockAnnouncer struct {
+	C   chan announcement
+	err error
+}
+
+func (a *mockAnnouncer) Announce(ifaceName string, ifIndex int, hardwareAddr net.HardwareAddr, addr net.IP) error {
+	log.WithFields(log.Fields{"ifaceName": ifaceName, "addr": addr}).Info("ANNOUNCE")
+	a.C <- announcement{ifaceName: ifaceName, index: ifIndex, mac: hardwareAddr, addr: addr.String()}
+	return a.err
+}
+
+// mockSysfs is a fake /sys filesystem, mapping from path to contents.
+type mockSysfs struct {
+	lock  sync.Mutex
+	files map[string]string
+}
+
+func (s *mockSysfs) setFile(path, contents string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.files[path] = contents
+}
+
+func (s *mockSysfs) ReadFile(path string) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	contents, ok := s.files[path]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return []byte(contents), nil
+}
+
 type mockDataplane struct {
-	linkC chan linkUpdate
-	addrC chan addrState
+	linkC         chan linkUpdate
+	addrC         chan addrState
+	attrsC        chan linkAttrsUpdate
+	infoC         chan ifacemonitor.InterfaceInfo
+	defaultRouteC chan defaultRouteUpdate
+	familyC       chan addrFamilyUpdate
+	heartbeatC    chan ifacemonitor.Heartbeat
+	peersC        chan peerAddrsUpdate
+	vfsC          chan vfsUpdate
+	bondC         chan bondUpdate
+	subDevC       chan subDevUpdate
+	classC        chan classUpdate
+	chainC        chan parentChainUpdate
+}
+
+type parentChainUpdate struct {
+	name  string
+	chain *ifacemonitor.ParentChain
+}
+
+type classUpdate struct {
+	name     string
+	oldClass ifacemonitor.InterfaceClass
+	newClass ifacemonitor.InterfaceClass
+}
+
+type subDevUpdate struct {
+	name      string
+	subDevice *ifacemonitor.SubDevice
+}
+
+type bondUpdate struct {
+	bond     string
+	oldSlave string
+	newSlave string
+}
+
+type vfsUpdate struct {
+	name string
+	vfs  []ifacemonitor.VFInfo
+}
+
+type peerAddrsUpdate struct {
+	name  string
+	peers map[string]string
+}
+
+type addrFamilyUpdate struct {
+	name   string
+	addr   string
+	family int
 }
 
 func (nl *netlinkTest) addLink(name string) {
@@ -85,9 +245,14 @@ func (nl *netlinkTest) addLinkNoSignal(name string) {
 		nl.nextIndex = 10
 	}
 	nl.links[name] = linkModel{
-		index: nl.nextIndex,
-		state: "down",
-		addrs: set.New(),
+		index:     nl.nextIndex,
+		state:     "down",
+		mtu:       1500,
+		mac:       net.HardwareAddr{0xee, 0xee, 0, 0, 0, byte(nl.nextIndex)},
+		addrs:     set.New(),
+		tentative: set.New(),
+		secondary: set.New(),
+		peers:     map[string]string{},
 	}
 	nl.nextIndex++
 	nl.linksMutex.Unlock()
@@ -113,6 +278,227 @@ func (nl *netlinkTest) changeLinkState(name string, state string) {
 	nl.signalLink(name, 0)
 }
 
+// clone returns a copy of the fake with the same links, but not subscribed to anything, as if
+// the monitor had been restarted.
+func (nl *netlinkTest) clone() *netlinkTest {
+	nl.linksMutex.Lock()
+	defer nl.linksMutex.Unlock()
+	nl2 := &netlinkTest{
+		userSubscribed: make(chan int),
+		nextIndex:      nl.nextIndex,
+		links:          map[string]linkModel{},
+		capabilities:   nl.capabilities,
+	}
+	for name, link := range nl.links {
+		link.addrs = link.addrs.Copy()
+		link.tentative = link.tentative.Copy()
+		link.secondary = link.secondary.Copy()
+		peers := map[string]string{}
+		for addr, peer := range link.peers {
+			peers[addr] = peer
+		}
+		link.peers = peers
+		nl2.links[name] = link
+	}
+	return nl2
+}
+
+// addVethPairNoSignal adds both ends of a veth, without signalling.
+func (nl *netlinkTest) addVethPairNoSignal(name, peerName string) {
+	nl.addLinkNoSignal(name)
+	nl.addLinkNoSignal(peerName)
+	nl.linksMutex.Lock()
+	defer nl.linksMutex.Unlock()
+	link := nl.links[name]
+	peer := nl.links[peerName]
+	link.linkType = "veth"
+	link.parentIndex = peer.index
+	peer.linkType = "veth"
+	peer.parentIndex = link.index
+	nl.links[name] = link
+	nl.links[peerName] = peer
+}
+
+// setLinkOperState sets the IFLA_OPERSTATE reported for the link, without signalling.
+// setBondActiveSlave makes the named link a bond, with the given active slave (none if empty),
+// and signals it.
+func (nl *netlinkTest) setBondActiveSlave(name, slave string) {
+	log.WithFields(log.Fields{"name": name, "slave": slave}).Info("SETBONDACTIVESLAVE")
+	nl.linksMutex.Lock()
+	link := nl.links[name]
+	link.linkType = "bond"
+	link.activeSlave = 0
+	if slave != "" {
+		link.activeSlave = nl.links[slave].index
+	}
+	nl.links[name] = link
+	nl.linksMutex.Unlock()
+	nl.signalLink(name, 0)
+}
+
+// addSubDevice adds a macvlan, ipvlan or VLAN link on the given parent and signals it.  For a
+// VLAN, mode is the VLAN ID.
+func (nl *netlinkTest) addSubDevice(name, kind string, mode int, parent string) {
+	nl.addLinkNoSignal(name)
+	nl.linksMutex.Lock()
+	link := nl.links[name]
+	link.linkType = kind
+	link.mode = mode
+	link.parentIndex = nl.links[parent].index
+	nl.links[name] = link
+	nl.linksMutex.Unlock()
+	nl.signalLink(name, 0)
+}
+
+// setAltNames sets the altnames of a link and signals it.
+func (nl *netlinkTest) setAltNames(name string, altNames ...string) {
+	log.WithFields(log.Fields{"name": name, "altNames": altNames}).Info("SETALTNAMES")
+	nl.linksMutex.Lock()
+	link := nl.links[name]
+	link.altNames = altNames
+	nl.links[name] = link
+	nl.linksMutex.Unlock()
+	nl.signalLink(name, 0)
+}
+
+// setMaster enslaves the named link to the given master (or frees it, if master is empty) and
+// signals it.
+func (nl *netlinkTest) setMaster(name, master string) {
+	log.WithFields(log.Fields{"name": name, "master": master}).Info("SETMASTER")
+	nl.linksMutex.Lock()
+	link := nl.links[name]
+	link.masterIndex = 0
+	if master != "" {
+		link.masterIndex = nl.links[master].index
+	}
+	nl.links[name] = link
+	nl.linksMutex.Unlock()
+	nl.signalLink(name, 0)
+}
+
+// setVFsNoSignal sets the SR-IOV VF list of a link, without signalling (the kernel doesn't send
+// link notifications for VF changes).
+func (nl *netlinkTest) setVFsNoSignal(name string, vfs ...netlink.VfInfo) {
+	nl.linksMutex.Lock()
+	defer nl.linksMutex.Unlock()
+	link := nl.links[name]
+	link.vfs = vfs
+	nl.links[name] = link
+}
+
+func (nl *netlinkTest) setLinkOperState(name string, operState netlink.LinkOperState) {
+	nl.linksMutex.Lock()
+	link := nl.links[name]
+	link.operState = operState
+	nl.links[name] = link
+	nl.linksMutex.Unlock()
+}
+
+func (nl *netlinkTest) changeLinkMTU(name string, mtu int) {
+	log.WithFields(log.Fields{"name": name, "mtu": mtu}).Info("CHANGELINKMTU")
+	nl.linksMutex.Lock()
+	link := nl.links[name]
+	link.mtu = mtu
+	nl.links[name] = link
+	nl.linksMutex.Unlock()
+	nl.signalLink(name, 0)
+}
+
+func (nl *netlinkTest) changeLinkMAC(name string, mac net.HardwareAddr) {
+	log.WithFields(log.Fields{"name": name, "mac": mac}).Info("CHANGELINKMAC")
+	nl.linksMutex.Lock()
+	link := nl.links[name]
+	link.mac = mac
+	nl.links[name] = link
+	nl.linksMutex.Unlock()
+	nl.signalLink(name, 0)
+}
+
+// changeLinkFlags sets flags on the link, over and above those implied by its state, and
+// signals the change with the given ifi_change mask.
+func (nl *netlinkTest) changeLinkFlags(name string, flags uint32, changeMask uint32) {
+	log.WithFields(log.Fields{"name": name, "flags": flags, "mask": changeMask}).Info("CHANGELINKFLAGS")
+	nl.linksMutex.Lock()
+	link := nl.links[name]
+	link.extraFlags = flags
+	nl.links[name] = link
+	nl.linksMutex.Unlock()
+	nl.signalLinkWithChangeMask(name, 0, changeMask)
+}
+
+// setDefaultRoute replaces the default route for the given family with one via the given
+// interfaces (ECMP if there's more than one) and signals the change.
+func (nl *netlinkTest) setDefaultRoute(family int, names ...string) {
+	log.WithFields(log.Fields{"family": family, "names": names}).Info("SETDEFAULTROUTE")
+	nl.linksMutex.Lock()
+	if nl.defaultRoutes == nil {
+		nl.defaultRoutes = map[int][]string{}
+	}
+	nl.defaultRoutes[family] = names
+	route := nl.defaultRouteLockHeld(family)
+	nl.linksMutex.Unlock()
+
+	routeUpd := netlink.RouteUpdate{Route: route}
+	routeUpd.Type = unix.RTM_NEWROUTE
+	if len(names) == 0 {
+		routeUpd.Type = unix.RTM_DELROUTE
+	}
+	nl.updates <- ifacemonitor.NetlinkUpdate{Route: &routeUpd}
+}
+
+func (nl *netlinkTest) defaultRouteLockHeld(family int) netlink.Route {
+	route := netlink.Route{
+		Table: unix.RT_TABLE_MAIN,
+		Type:  unix.RTN_UNICAST,
+	}
+	if family == netlink.FAMILY_V4 {
+		route.Gw = net.ParseIP("10.0.0.1")
+	} else {
+		route.Gw = net.ParseIP("fd00::1")
+	}
+	names := nl.defaultRoutes[family]
+	if len(names) == 1 {
+		route.LinkIndex = nl.links[names[0]].index
+	} else {
+		for _, name := range names {
+			route.MultiPath = append(route.MultiPath, &netlink.NexthopInfo{
+				LinkIndex: nl.links[name].index,
+				Gw:        route.Gw,
+			})
+		}
+		route.Gw = nil
+	}
+	return route
+}
+
+func (nl *netlinkTest) ListDefaultRoutes(family int) ([]netlink.Route, error) {
+	nl.linksMutex.Lock()
+	defer nl.linksMutex.Unlock()
+	nl.numListDefaultRoutesCalls++
+	if len(nl.defaultRoutes[family]) == 0 {
+		return nil, nil
+	}
+	return []netlink.Route{nl.defaultRouteLockHeld(family)}, nil
+}
+
+func (nl *netlinkTest) getNumListRoutesCalls() int {
+	nl.linksMutex.Lock()
+	defer nl.linksMutex.Unlock()
+	return nl.numListRoutesCalls
+}
+
+func (nl *netlinkTest) getNumListDefaultRoutesCalls() int {
+	nl.linksMutex.Lock()
+	defer nl.linksMutex.Unlock()
+	return nl.numListDefaultRoutesCalls
+}
+
+func (nl *netlinkTest) getNumLinkListCalls() int {
+	nl.linksMutex.Lock()
+	defer nl.linksMutex.Unlock()
+	return nl.numLinkListCalls
+}
+
 func (nl *netlinkTest) delLink(name string) {
 	oldIndex := nl.delLinkNoSignal(name)
 	nl.signalLink(name, oldIndex)
@@ -133,20 +519,27 @@ func (nl *netlinkTest) delLinkNoSignal(name string) (oldIndex int) {
 }
 
 func (nl *netlinkTest) signalLink(name string, oldIndex int) {
+	nl.signalLinkWithChangeMask(name, oldIndex, 0)
+}
+
+func (nl *netlinkTest) signalLinkWithChangeMask(name string, oldIndex int, changeMask uint32) {
 	// Values for a link that does not exist...
-	index := oldIndex
-	var rawFlags uint32 = 0
 	var msgType uint16 = syscall.RTM_DELLINK
+	var link netlink.Link = &netlink.Dummy{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:  name,
+			Index: oldIndex,
+		},
+	}
 
 	// If the link does exist, overwrite appropriately.
 	nl.linksMutex.Lock()
-	link, prs := nl.links[name]
+	model, prs := nl.links[name]
 	if prs {
 		msgType = syscall.RTM_NEWLINK
-		index = link.index
-		if link.state == "up" {
-			rawFlags = syscall.IFF_RUNNING
-		}
+		link = model.toLink(name)
+		// The kernel only reports VFs in dumps, not in notifications.
+		link.Attrs().Vfs = nil
 	}
 	nl.linksMutex.Unlock()
 
@@ -155,21 +548,56 @@ func (nl *netlinkTest) signalLink(name string, oldIndex int) {
 		Header: unix.NlMsghdr{
 			Type: msgType,
 		},
-		Link: &netlink.Dummy{
-			LinkAttrs: netlink.LinkAttrs{
-				Name:     name,
-				Index:    index,
-				RawFlags: rawFlags,
-			},
-		},
+		Link: link,
 	}
+	update.Change = changeMask
 
 	// Send it.
-	log.WithField("channel", nl.linkUpdates).Info("Test code signaling a link update")
-	nl.linkUpdates <- update
+	log.WithField("channel", nl.updates).Info("Test code signaling a link update")
+	nl.updates <- ifacemonitor.NetlinkUpdate{Link: &update}
 	log.Info("Test code signaled a link update")
 }
 
+// toLink converts the model to the netlink.Link that the kernel would report for it.
+func (l linkModel) toLink(name string) netlink.Link {
+	attrs := netlink.LinkAttrs{
+		Name:         name,
+		Index:        l.index,
+		RawFlags:     rawFlagsForState(l.state) | l.extraFlags,
+		MTU:          l.mtu,
+		HardwareAddr: l.mac,
+		OperState:    l.operState,
+		ParentIndex:  l.parentIndex,
+		MasterIndex:  l.masterIndex,
+		Vfs:          l.vfs,
+	}
+	switch l.linkType {
+	case "veth":
+		return &netlink.Veth{LinkAttrs: attrs}
+	case "bridge":
+		return &netlink.Bridge{LinkAttrs: attrs}
+	case "bond":
+		return &netlink.Bond{LinkAttrs: attrs, ActiveSlave: l.activeSlave}
+	case "macvlan":
+		return &netlink.Macvlan{LinkAttrs: attrs, Mode: netlink.MacvlanMode(l.mode)}
+	case "ipvlan":
+		return &netlink.IPVlan{LinkAttrs: attrs, Mode: netlink.IPVlanMode(l.mode)}
+	case "vlan":
+		return &netlink.Vlan{LinkAttrs: attrs, VlanId: l.mode}
+	}
+	return &netlink.Dummy{LinkAttrs: attrs}
+}
+
+func rawFlagsForState(state string) uint32 {
+	switch state {
+	case "up":
+		return syscall.IFF_RUNNING
+	case "dormant":
+		return 0x20000 // IFF_DORMANT
+	}
+	return 0
+}
+
 func (nl *netlinkTest) addAddr(name string, addr string) {
 	log.WithFields(log.Fields{"name": name, "addr": addr}).Info("ADDADDR")
 	nl.linksMutex.Lock()
@@ -180,6 +608,57 @@ func (nl *netlinkTest) addAddr(name string, addr string) {
 	nl.signalAddr(name, addr, true)
 }
 
+// addTentativeAddr adds an address that is still undergoing duplicate address detection.
+func (nl *netlinkTest) addTentativeAddr(name string, addr string) {
+	nl.linksMutex.Lock()
+	nl.links[name].tentative.Add(addr)
+	nl.linksMutex.Unlock()
+	nl.addAddr(name, addr)
+}
+
+// addSecondaryAddr adds an IPv4 address that is secondary to one that the link already has.
+func (nl *netlinkTest) addSecondaryAddr(name string, addr string) {
+	nl.linksMutex.Lock()
+	nl.links[name].secondary.Add(addr)
+	nl.linksMutex.Unlock()
+	nl.addAddr(name, addr)
+}
+
+// delPrimaryAddr deletes a primary IPv4 address as the kernel does.  If promoteSecondaries is
+// false, its secondaries are deleted silently with it; otherwise the first of them is promoted.
+func (nl *netlinkTest) delPrimaryAddr(name string, addr string, promoteSecondaries bool) {
+	log.WithFields(log.Fields{"name": name, "addr": addr, "promote": promoteSecondaries}).Info("DELPRIMARYADDR")
+	nl.linksMutex.Lock()
+	link := nl.links[name]
+	link.addrs.Discard(addr)
+	var secondaries []string
+	link.secondary.Iter(func(item interface{}) error {
+		secondaries = append(secondaries, item.(string))
+		return nil
+	})
+	sort.Strings(secondaries)
+	for i, secondary := range secondaries {
+		if promoteSecondaries {
+			if i == 0 {
+				link.secondary.Discard(secondary)
+			}
+			continue
+		}
+		link.addrs.Discard(secondary)
+		link.secondary.Discard(secondary)
+	}
+	nl.linksMutex.Unlock()
+	nl.signalAddr(name, addr, false)
+}
+
+// addPeerAddr adds a point-to-point address with the given peer.
+func (nl *netlinkTest) addPeerAddr(name string, addr string, peer string) {
+	nl.linksMutex.Lock()
+	nl.links[name].peers[addr] = peer
+	nl.linksMutex.Unlock()
+	nl.addAddr(name, addr)
+}
+
 func (nl *netlinkTest) delAddr(name string, addr string) {
 	log.WithFields(log.Fields{"name": name, "addr": addr}).Info("DELADDR")
 	nl.linksMutex.Lock()
@@ -214,17 +693,22 @@ func (nl *netlinkTest) signalAddr(name string, addr string, exists bool) {
 	nl.linksMutex.Unlock()
 
 	// Send it.
-	log.WithField("channel", nl.linkUpdates).Info("Test code signaling an addr update")
-	nl.routeUpdates <- routeUpd
+	log.WithField("channel", nl.updates).Info("Test code signaling an addr update")
+	nl.updates <- ifacemonitor.NetlinkUpdate{Route: &routeUpd}
 	log.Info("Test code signaled an addr update")
 }
 
 func (nl *netlinkTest) Subscribe(
-	linkUpdates chan netlink.LinkUpdate,
-	routeUpdates chan netlink.RouteUpdate,
+	groups ifacemonitor.NetlinkGroups,
+	updates chan<- ifacemonitor.NetlinkUpdate,
+	done <-chan struct{},
 ) error {
-	nl.linkUpdates = linkUpdates
-	nl.routeUpdates = routeUpdates
+	if nl.subscribeErr != nil {
+		return nl.subscribeErr
+	}
+	nl.subscribedGroups = groups
+	nl.done = done
+	nl.updates = updates
 	nl.userSubscribed <- 1
 	return nil
 }
@@ -232,18 +716,13 @@ func (nl *netlinkTest) Subscribe(
 func (nl *netlinkTest) LinkList() ([]netlink.Link, error) {
 	links := []netlink.Link{}
 	nl.linksMutex.Lock()
+	nl.numLinkListCalls++
+	if nl.linkListErr != nil {
+		defer nl.linksMutex.Unlock()
+		return nil, nl.linkListErr
+	}
 	for name, link := range nl.links {
-		var rawFlags uint32 = 0
-		if link.state == "up" {
-			rawFlags = syscall.IFF_RUNNING
-		}
-		links = append(links, &netlink.Dummy{
-			LinkAttrs: netlink.LinkAttrs{
-				Name:     name,
-				Index:    link.index,
-				RawFlags: rawFlags,
-			},
-		})
+		links = append(links, link.toLink(name))
 	}
 	nl.linksMutex.Unlock()
 	return links, nil
@@ -253,28 +732,31 @@ func (nl *netlinkTest) ListLocalRoutes(link netlink.Link, family int) ([]netlink
 	name := link.Attrs().Name
 	nl.linksMutex.Lock()
 	defer nl.linksMutex.Unlock()
-	model, prs := nl.links[name]
+	nl.numListRoutesCalls++
 	var routes []netlink.Route
-	if prs {
+	for modelName, model := range nl.links {
+		if modelName != name && !nl.ignoreRouteFilters {
+			continue
+		}
 		model.addrs.Iter(func(item interface{}) error {
 			addr := item.(string)
 			net, err := netlink.ParseIPNet(addr)
 			if err != nil {
 				panic("Address parsing failed")
 			}
+			route := netlink.Route{
+				Type:      unix.RTN_LOCAL,
+				Table:     unix.RT_TABLE_LOCAL,
+				LinkIndex: model.index,
+				Dst:       net,
+			}
 			if strings.ContainsRune(addr, ':') {
 				if family == netlink.FAMILY_V6 {
-					routes = append(routes, netlink.Route{
-						Type: unix.RTN_LOCAL,
-						Dst:  net,
-					})
+					routes = append(routes, route)
 				}
 			} else {
 				if family == netlink.FAMILY_V4 {
-					routes = append(routes, netlink.Route{
-						Type: unix.RTN_LOCAL,
-						Dst:  net,
-					})
+					routes = append(routes, route)
 				}
 			}
 			return nil
@@ -283,6 +765,32 @@ func (nl *netlinkTest) ListLocalRoutes(link netlink.Link, family int) ([]netlink
 	return routes, nil
 }
 
+func (nl *netlinkTest) LinkAltNames(ifIndex int) ([]string, error) {
+	nl.linksMutex.Lock()
+	defer nl.linksMutex.Unlock()
+	for _, link := range nl.links {
+		if link.index == ifIndex {
+			return link.altNames, nil
+		}
+	}
+	return nil, errors.New("no such link")
+}
+
+func (nl *netlinkTest) ProbeCapabilities() ifacemonitor.KernelCapabilities {
+	return nl.capabilities
+}
+
+func peerNet(peer string) *net.IPNet {
+	if peer == "" {
+		return nil
+	}
+	peerNet, err := netlink.ParseIPNet(peer)
+	if err != nil {
+		panic("Address parsing failed")
+	}
+	return peerNet
+}
+
 func (nl *netlinkTest) AddrList(link netlink.Link, family int) ([]netlink.Addr, error) {
 	name := link.Attrs().Name
 	nl.linksMutex.Lock()
@@ -298,14 +806,26 @@ func (nl *netlinkTest) AddrList(link netlink.Link, family int) ([]netlink.Addr,
 			}
 			if strings.ContainsRune(addr, ':') {
 				if family == netlink.FAMILY_V6 {
+					var flags int
+					if model.tentative.Contains(addr) {
+						flags = unix.IFA_F_TENTATIVE
+					}
 					addrs = append(addrs, netlink.Addr{
 						IPNet: net,
+						Flags: flags,
+						Peer:  peerNet(model.peers[addr]),
 					})
 				}
 			} else {
 				if family == netlink.FAMILY_V4 {
+					var flags int
+					if model.secondary.Contains(addr) {
+						flags = unix.IFA_F_SECONDARY
+					}
 					addrs = append(addrs, netlink.Addr{
 						IPNet: net,
+						Flags: flags,
+						Peer:  peerNet(model.peers[addr]),
 					})
 				}
 			}
@@ -315,6 +835,106 @@ func (nl *netlinkTest) AddrList(link netlink.Link, family int) ([]netlink.Addr,
 	return addrs, nil
 }
 
+// startOp customises startMonitor.
+type startOp func(s *monitorStart)
+
+type monitorStart struct {
+	resyncC     chan time.Time
+	doneC       chan struct{}
+	errC        chan<- error
+	monitorOps  []ifacemonitor.InterfaceMonitorOp
+	recorder    *testutils.Recorder
+	recorderOps []testutils.RecorderOp
+}
+
+// withResyncC gives the monitor a resync channel that the spec can send on.  By default, the
+// monitor has one that nothing sends on.
+func withResyncC(resyncC chan time.Time) startOp {
+	return func(s *monitorStart) {
+		s.resyncC = resyncC
+	}
+}
+
+// withDoneC has startMonitor close doneC once MonitorInterfaces returns.
+func withDoneC(doneC chan struct{}) startOp {
+	return func(s *monitorStart) {
+		s.doneC = doneC
+	}
+}
+
+// withErrC has startMonitor run the monitor with Run, rather than MonitorInterfaces, and send
+// the error that it returns on errC.
+func withErrC(errC chan<- error) startOp {
+	return func(s *monitorStart) {
+		s.errC = errC
+	}
+}
+
+// withMonitorOps passes options, such as a time shim, to NewWithStubs.
+func withMonitorOps(ops ...ifacemonitor.InterfaceMonitorOp) startOp {
+	return func(s *monitorStart) {
+		s.monitorOps = append(s.monitorOps, ops...)
+	}
+}
+
+// withRecorder has startMonitor attach the given Recorder rather than a new one, so that the
+// setup function can record the monitor's other callbacks on it too.
+func withRecorder(recorder *testutils.Recorder) startOp {
+	return func(s *monitorStart) {
+		s.recorder = recorder
+	}
+}
+
+// withRecorderOps passes options to the new Recorder.
+func withRecorderOps(ops ...testutils.RecorderOp) startOp {
+	return func(s *monitorStart) {
+		s.recorderOps = append(s.recorderOps, ops...)
+	}
+}
+
+// startMonitor creates a monitor with the given config on a new netlinkTest, attaches a Recorder
+// to it and runs it, returning once the monitor has subscribed to netlink.  setup, if non-nil, is
+// called just before the monitor starts; it can add the links for the start-of-day resync and set
+// the monitor's other callbacks, including ones that replace the Recorder's.
+func startMonitor(
+	config ifacemonitor.Config,
+	setup func(nl *netlinkTest, im *ifacemonitor.InterfaceMonitor),
+	opts ...startOp,
+) (*ifacemonitor.InterfaceMonitor, *netlinkTest, *testutils.Recorder) {
+	var s monitorStart
+	for _, op := range opts {
+		op(&s)
+	}
+	if s.resyncC == nil {
+		s.resyncC = make(chan time.Time)
+	}
+	nl := &netlinkTest{
+		userSubscribed: make(chan int),
+		nextIndex:      10,
+	}
+	im := ifacemonitor.NewWithStubs(config, nl, s.resyncC, s.monitorOps...)
+	recorder := s.recorder
+	if recorder == nil {
+		recorder = testutils.NewRecorder(s.recorderOps...)
+	}
+	recorder.Attach(im)
+	if setup != nil {
+		setup(nl, im)
+	}
+	go func(doneC chan struct{}, errC chan<- error) {
+		if doneC != nil {
+			defer close(doneC)
+		}
+		if errC != nil {
+			errC <- im.Run()
+			return
+		}
+		im.MonitorInterfaces()
+	}(s.doneC, s.errC)
+	<-nl.userSubscribed
+	return im, nl, recorder
+}
+
 func (dp *mockDataplane) linkStateCallback(ifaceName string, ifaceState ifacemonitor.State, idx int) {
 	log.WithFields(log.Fields{"name": ifaceName, "state": ifaceState}).Info("CALLBACK LINK")
 	dp.linkC <- linkUpdate{
@@ -348,17 +968,110 @@ func (dp *mockDataplane) addrStateCallback(ifaceName string, addrs set.Set) {
 	log.Info("mock dataplane reported address callback")
 }
 
-func (dp *mockDataplane) notExpectAddrStateCb() {
-	Consistently(dp.addrC, "50ms", "5ms").ShouldNot(Receive())
+func (dp *mockDataplane) linkAttrsCallback(ifaceName string, idx int, delta ifacemonitor.LinkAttrsDelta) {
+	log.WithFields(log.Fields{"name": ifaceName, "delta": delta}).Info("CALLBACK LINK ATTRS")
+	dp.attrsC <- linkAttrsUpdate{
+		name:  ifaceName,
+		index: idx,
+		delta: delta,
+	}
 }
 
-func (dp *mockDataplane) expectAddrStateCb(ifaceName string, addr string, present bool) {
-	var cbIface addrState
-	log.WithFields(log.Fields{
-		"ifaceName": ifaceName,
-		"addr":      addr,
-		"present":   present,
-	}).Debug("expectAddrStateCb")
+func (dp *mockDataplane) expectLinkAttrsCb(ifaceName string) ifacemonitor.LinkAttrsDelta {
+	var upd linkAttrsUpdate
+	Eventually(dp.attrsC).Should(Receive(&upd))
+	ExpectWithOffset(1, upd.name).To(Equal(ifaceName), "Received link attrs callback for unexpected interface.")
+	return upd.delta
+}
+
+func (dp *mockDataplane) infoCallback(info ifacemonitor.InterfaceInfo) {
+	log.WithField("info", info).Info("CALLBACK INFO")
+	dp.infoC <- info
+}
+
+func (dp *mockDataplane) expectInfoCb(ifaceName string, state ifacemonitor.State) ifacemonitor.InterfaceInfo {
+	var info ifacemonitor.InterfaceInfo
+	Eventually(dp.infoC).Should(Receive(&info))
+	ExpectWithOffset(1, info.Name).To(Equal(ifaceName), "Received info callback for unexpected interface.")
+	ExpectWithOffset(1, info.State).To(Equal(state), "Received info callback with unexpected state.")
+	return info
+}
+
+func (dp *mockDataplane) defaultRouteCallback(family int, names []string) {
+	log.WithFields(log.Fields{"family": family, "names": names}).Info("CALLBACK DEFAULT ROUTE")
+	dp.defaultRouteC <- defaultRouteUpdate{family: family, names: names}
+}
+
+func (dp *mockDataplane) expectDefaultRouteCb(family int, names ...string) {
+	var upd defaultRouteUpdate
+	Eventually(dp.defaultRouteC).Should(Receive(&upd))
+	ExpectWithOffset(1, upd.family).To(Equal(family), "Received default route callback for unexpected family.")
+	if len(names) == 0 {
+		ExpectWithOffset(1, upd.names).To(BeEmpty())
+	} else {
+		ExpectWithOffset(1, upd.names).To(Equal(names))
+	}
+}
+
+func (dp *mockDataplane) unexpectedAddrFamilyCallback(ifaceName string, addr string, family int) {
+	log.WithFields(log.Fields{"ifaceName": ifaceName, "addr": addr}).Info("CALLBACK UNEXPECTED FAMILY")
+	dp.familyC <- addrFamilyUpdate{name: ifaceName, addr: addr, family: family}
+}
+
+func (dp *mockDataplane) heartbeatCallback(heartbeat ifacemonitor.Heartbeat) {
+	log.WithField("heartbeat", heartbeat).Info("CALLBACK HEARTBEAT")
+	dp.heartbeatC <- heartbeat
+}
+
+func (dp *mockDataplane) peerAddrCallback(ifaceName string, peers map[string]string) {
+	log.WithFields(log.Fields{"ifaceName": ifaceName, "peers": peers}).Info("CALLBACK PEER ADDRS")
+	dp.peersC <- peerAddrsUpdate{name: ifaceName, peers: peers}
+}
+
+func (dp *mockDataplane) vfCallback(pfName string, vfs []ifacemonitor.VFInfo) {
+	log.WithFields(log.Fields{"pfName": pfName, "vfs": vfs}).Info("CALLBACK VFS")
+	dp.vfsC <- vfsUpdate{name: pfName, vfs: vfs}
+}
+
+func (dp *mockDataplane) bondActiveSlaveCallback(bondName, oldSlave, newSlave string) {
+	log.WithFields(log.Fields{
+		"bond":     bondName,
+		"oldSlave": oldSlave,
+		"newSlave": newSlave,
+	}).Info("CALLBACK BOND ACTIVE SLAVE")
+	dp.bondC <- bondUpdate{bond: bondName, oldSlave: oldSlave, newSlave: newSlave}
+}
+
+func (dp *mockDataplane) subDeviceCallback(ifaceName string, subDevice *ifacemonitor.SubDevice) {
+	log.WithFields(log.Fields{"ifaceName": ifaceName, "subDevice": subDevice}).Info("CALLBACK SUB-DEVICE")
+	dp.subDevC <- subDevUpdate{name: ifaceName, subDevice: subDevice}
+}
+
+func (dp *mockDataplane) classChangeCallback(ifaceName string, oldClass, newClass ifacemonitor.InterfaceClass) {
+	log.WithFields(log.Fields{
+		"ifaceName": ifaceName,
+		"oldClass":  oldClass,
+		"newClass":  newClass,
+	}).Info("CALLBACK CLASS")
+	dp.classC <- classUpdate{name: ifaceName, oldClass: oldClass, newClass: newClass}
+}
+
+func (dp *mockDataplane) parentChainCallback(ifaceName string, chain *ifacemonitor.ParentChain) {
+	log.WithFields(log.Fields{"ifaceName": ifaceName, "chain": chain}).Info("CALLBACK PARENT CHAIN")
+	dp.chainC <- parentChainUpdate{name: ifaceName, chain: chain}
+}
+
+func (dp *mockDataplane) notExpectAddrStateCb() {
+	Consistently(dp.addrC, "50ms", "5ms").ShouldNot(Receive())
+}
+
+func (dp *mockDataplane) expectAddrStateCb(ifaceName string, addr string, present bool) {
+	var cbIface addrState
+	log.WithFields(log.Fields{
+		"ifaceName": ifaceName,
+		"addr":      addr,
+		"present":   present,
+	}).Debug("expectAddrStateCb")
 
 	Eventually(dp.addrC).Should(Receive(&cbIface))
 	log.WithFields(log.Fields{
@@ -388,6 +1101,14 @@ var _ = Describe("ifacemonitor", func() {
 	var resyncC chan time.Time
 	var im *ifacemonitor.InterfaceMonitor
 	var dp *mockDataplane
+	var config ifacemonitor.Config
+	var mockTime *mocktime.MockTime
+	var announcer *mockAnnouncer
+	var extraOpts []ifacemonitor.InterfaceMonitorOp
+	var classifier ifacemonitor.Classifier
+	// recorder, if set in a nested BeforeEach, takes the state and address callbacks instead
+	// of dp.
+	var recorder *testutils.Recorder
 
 	BeforeEach(func() {
 		// Make an Interface Monitor that uses a test netlink stub implementation and resync
@@ -397,7 +1118,7 @@ var _ = Describe("ifacemonitor", func() {
 			nextIndex:      10,
 		}
 		resyncC = make(chan time.Time)
-		config := ifacemonitor.Config{
+		config = ifacemonitor.Config{
 			// Test the regexp ability of interface excludes
 			InterfaceExcludes: []*regexp.Regexp{
 				regexp.MustCompile("^kube-ipvs.*"),
@@ -405,22 +1126,72 @@ var _ = Describe("ifacemonitor", func() {
 				regexp.MustCompile("dummy"),
 			},
 		}
-		im = ifacemonitor.NewWithStubs(config, nl, resyncC)
-
-		// Register this test code's callbacks, which (a) log; and (b) send to a 1- or
-		// 2-buffered channel, so that the test code _must_ explicitly indicate when it
-		// expects those callbacks to have occurred.  For the link channel a buffer of 1 is
-		// enough, because link callbacks only result from link updates from the netlink
-		// stub.  For the address channel we sometimes need a buffer of 2 because both link
-		// and address updates from the stub can generate address callbacks.
-		// expectAddrStateCb takes care to check that we eventually get the callback that we
-		// expect.
+		mockTime = mocktime.New()
+		announcer = nil
+		extraOpts = nil
+		classifier = nil
+		recorder = nil
+
+		// This test code's callbacks (a) log; and (b) send to a 1- or 2-buffered channel, so
+		// that the test code _must_ explicitly indicate when it expects those callbacks to
+		// have occurred.  For the link channel a buffer of 1 is enough, because link
+		// callbacks only result from link updates from the netlink stub.  For the address
+		// channel we sometimes need a buffer of 2 because both link and address updates from
+		// the stub can generate address callbacks.  expectAddrStateCb takes care to check
+		// that we eventually get the callback that we expect.  Tests that want the optional
+		// callbacks create their channels in a nested BeforeEach.
 		dp = &mockDataplane{
 			linkC: make(chan linkUpdate, 1),
 			addrC: make(chan addrState, 2),
 		}
-		im.StateCallback = dp.linkStateCallback
-		im.AddrCallback = dp.addrStateCallback
+	})
+
+	JustBeforeEach(func() {
+		opts := append([]ifacemonitor.InterfaceMonitorOp{ifacemonitor.WithMonitorTimeShim(mockTime)}, extraOpts...)
+		im = ifacemonitor.NewWithStubs(config, nl, resyncC, opts...)
+		if recorder != nil {
+			recorder.Attach(im)
+		} else {
+			im.StateCallback = dp.linkStateCallback
+			im.AddrCallback = dp.addrStateCallback
+		}
+		if dp.attrsC != nil {
+			im.LinkAttrsCallback = dp.linkAttrsCallback
+		}
+		if dp.infoC != nil {
+			im.InfoCallback = dp.infoCallback
+		}
+		if dp.defaultRouteC != nil {
+			im.DefaultRouteCallback = dp.defaultRouteCallback
+		}
+		if announcer != nil {
+			im.AddrAnnouncer = announcer
+		}
+		if dp.familyC != nil {
+			im.UnexpectedAddrFamilyCallback = dp.unexpectedAddrFamilyCallback
+		}
+		if dp.heartbeatC != nil {
+			im.HeartbeatCallback = dp.heartbeatCallback
+		}
+		if dp.peersC != nil {
+			im.PeerAddrCallback = dp.peerAddrCallback
+		}
+		if dp.vfsC != nil {
+			im.VFCallback = dp.vfCallback
+		}
+		if dp.bondC != nil {
+			im.BondActiveSlaveCallback = dp.bondActiveSlaveCallback
+		}
+		if dp.subDevC != nil {
+			im.SubDeviceCallback = dp.subDeviceCallback
+		}
+		if dp.chainC != nil {
+			im.ParentChainCallback = dp.parentChainCallback
+		}
+		if classifier != nil {
+			im.Classifier = classifier
+			im.ClassChangeCallback = dp.classChangeCallback
+		}
 
 		// Start the monitor running, and wait until it has subscribed to our test netlink
 		// stub.
@@ -428,180 +1199,1905 @@ var _ = Describe("ifacemonitor", func() {
 		<-nl.userSubscribed
 	})
 
-	It("should skip netlink address updates for ipvs", func() {
-		var netlinkUpdates = func(iface string) {
-			// Should not receive any address callbacks.
+	Describe("with a recorder for state and address callbacks", func() {
+		BeforeEach(func() {
+			recorder = testutils.NewRecorder(testutils.WithTimeShim(mockTime))
+			recorder.QuietPeriod = 50 * time.Millisecond
+		})
+
+		It("should skip netlink address updates for ipvs", func() {
+			var netlinkUpdates = func(iface string) {
+				// Should not receive any address callbacks.
+				idx := nl.nextIndex
+
+				nl.addLink(iface)
+				resyncC <- time.Time{}
+				nl.addAddr(iface, "10.100.0.1/32")
+				recorder.ExpectNoNewEvents()
+
+				nl.changeLinkState(iface, "up")
+				recorder.ExpectSequence(testutils.StateEvent(iface, ifacemonitor.StateUp))
+				Expect(recorder.Events()[len(recorder.Events())-1].IfIndex).To(Equal(idx))
+				nl.changeLinkState(iface, "down")
+				recorder.ExpectSequence(testutils.StateEvent(iface, ifacemonitor.StateDown))
+
+				// Should notify down from up on deletion.
+				nl.changeLinkState(iface, "up")
+				recorder.ExpectSequence(testutils.StateEvent(iface, ifacemonitor.StateUp))
+				nl.delLink(iface)
+				recorder.ExpectSequence(testutils.StateEvent(iface, ifacemonitor.StateDown))
+				recorder.ExpectNoNewEvents()
+
+				// Check it can be added again.
+				nl.addLink(iface)
+				resyncC <- time.Time{}
+				recorder.ExpectNoNewEvents()
+
+				// Clean it.
+				nl.delLink(iface)
+				recorder.ExpectNoNewEvents()
+			}
+
+			// Repeat for 3 different interfaces (to test regexp of interface excludes)
+			for index := 0; index < 3; index++ {
+				interfaceName := fmt.Sprintf("kube-ipvs%d", index)
+				netlinkUpdates(interfaceName)
+			}
+
+			// Repeat test for second interface exclude entry
+			netlinkUpdates("veth1")
+
+			// Repeat test for third interface exclude entry
+			netlinkUpdates("0dummy1")
+		})
+
+		It("should handle mainline netlink updates", func() {
+			// Add a link and an address.  No link callback expected because the link is not up
+			// yet.  But we do get an address callback because those are independent of link
+			// state.  (Note that if the monitor's initial resync runs slowly enough, it might
+			// see the new link and addr as part of that resync - whereas normally what happens
+			// is that the resync completes as a no-op first, and the addLink causes a
+			// notification afterwards.  But either way we expect to get the same callbacks to
+			// the dataplane, so we don't need to distinguish between these two possibilities.
+			nl.addLink("eth0")
+			resyncC <- time.Time{}
+			recorder.ExpectSequence(testutils.AddrsEvent("eth0"))
+			nl.addAddr("eth0", "10.0.240.10/24")
+			recorder.ExpectSequence(testutils.AddrsEvent("eth0", "10.0.240.10"))
+
+			// Set the link up, and expect a link callback.  Addresses are unchanged, so there
+			// is no address callback.
+			nl.changeLinkState("eth0", "up")
+			recorder.ExpectSequence(testutils.StateEvent("eth0", ifacemonitor.StateUp))
+
+			// Add an address.
+			nl.addAddr("eth0", "172.19.34.1/27")
+			recorder.ExpectSequence(testutils.AddrsEvent("eth0", "10.0.240.10", "172.19.34.1"))
+
+			// Delete that address.
+			nl.delAddr("eth0", "172.19.34.1/27")
+			recorder.ExpectSequence(testutils.AddrsEvent("eth0", "10.0.240.10"))
+
+			// Add address again.
+			nl.addAddr("eth0", "172.19.34.1/27")
+			recorder.ExpectSequence(testutils.AddrsEvent("eth0", "10.0.240.10", "172.19.34.1"))
+
+			// Delete an address that wasn't actually there - no callback.
+			nl.delAddr("eth0", "8.8.8.8/32")
+			recorder.ExpectNoNewEvents()
+
+			// Set link down.
+			nl.changeLinkState("eth0", "down")
+			recorder.ExpectSequence(testutils.StateEvent("eth0", ifacemonitor.StateDown))
+
+			// Set link up again.
+			nl.changeLinkState("eth0", "up")
+			recorder.ExpectSequence(testutils.StateEvent("eth0", ifacemonitor.StateUp))
+
+			// Test when a deleted link is detected in a resync.  The monitor should report
+			// "Spotted interface removal on resync" and make link and address callbacks
+			// accordingly.
+			nl.delLinkNoSignal("eth0")
+			resyncC <- time.Time{}
+			recorder.ExpectSequence(
+				testutils.AddrsGoneEvent("eth0"),
+				testutils.StateEvent("eth0", ifacemonitor.StateDown),
+			)
+
+			// Trigger another resync.  Nothing is expected.
+			resyncC <- time.Time{}
+			recorder.ExpectNoNewEvents()
+		})
+
+		It("should only report addresses from a resync when they have changed", func() {
+			nl.addLink("eth0")
+			recorder.ExpectSequence(testutils.AddrsEvent("eth0"))
+			nl.addAddr("eth0", "10.0.240.10/24")
+			recorder.ExpectSequence(testutils.AddrsEvent("eth0", "10.0.240.10"))
+			nl.addAddr("eth0", "10.0.240.11/24")
+			recorder.ExpectSequence(testutils.AddrsEvent("eth0", "10.0.240.10", "10.0.240.11"))
+
+			// Resyncs that find the same addresses, in whatever order, are silent.
+			resyncC <- time.Time{}
+			resyncC <- time.Time{}
+			recorder.ExpectNoNewEvents()
+
+			// A resync that finds that all the addresses have gone reports the empty set, once.
+			nl.linksMutex.Lock()
+			nl.links["eth0"].addrs.Clear()
+			nl.linksMutex.Unlock()
+			resyncC <- time.Time{}
+			recorder.ExpectSequence(testutils.AddrsEvent("eth0"))
+			resyncC <- time.Time{}
+			resyncC <- time.Time{}
+			recorder.ExpectNoNewEvents()
+		})
+
+		It("should handle an interface rename", func() {
+			// Add a link and an address, and set the link up.
+			idx := nl.nextIndex
+			nl.addLink("eth0")
+			resyncC <- time.Time{}
+			recorder.ExpectSequence(testutils.AddrsEvent("eth0"))
+			nl.addAddr("eth0", "10.0.240.10/24")
+			recorder.ExpectSequence(testutils.AddrsEvent("eth0", "10.0.240.10"))
+			nl.changeLinkState("eth0", "up")
+			recorder.ExpectSequence(testutils.StateEvent("eth0", ifacemonitor.StateUp))
+
+			// Rename the interface, address and old name should be signalled as gone.
+			nl.renameLink("eth0", "eth1")
+			recorder.ExpectSequence(
+				testutils.AddrsGoneEvent("eth0"),
+				testutils.StateEvent("eth0", ifacemonitor.StateDown),
+				testutils.StateEvent("eth1", ifacemonitor.StateUp),
+				testutils.AddrsEvent("eth1", "10.0.240.10"),
+			)
+			events := recorder.Events()
+			Expect(events[len(events)-2].IfIndex).To(Equal(idx), "eth1 should keep eth0's index")
+
+			// Trigger another resync.  Nothing is expected.
+			resyncC <- time.Time{}
+			recorder.ExpectNoNewEvents()
+		})
+
+		It("should handle link flap", func() {
+			// Add a link and an address, and set the link up.
+			nl.addLink("eth0")
+			resyncC <- time.Time{}
+			recorder.ExpectSequence(testutils.AddrsEvent("eth0"))
+			nl.addAddr("eth0", "10.0.240.10/24")
+			recorder.ExpectSequence(testutils.AddrsEvent("eth0", "10.0.240.10"))
+			nl.changeLinkState("eth0", "up")
+			recorder.ExpectSequence(testutils.StateEvent("eth0", ifacemonitor.StateUp))
+
+			// Delete the link, and have that picked up by resync.  For this scenario we have to
+			// assume that there is never any Netlink signal for the link deletion.
+			_ = nl.delLinkNoSignal("eth0")
+			resyncC <- time.Time{}
+			recorder.ExpectSequence(
+				testutils.AddrsGoneEvent("eth0"),
+				testutils.StateEvent("eth0", ifacemonitor.StateDown),
+			)
+
+			// Add the link again, with the same ifIndex, but hold the signal through Netlink.
+			nl.nextIndex--
+			nl.addLinkNoSignal("eth0")
+			// Add the address, and let that go through Netlink.
+			nl.addAddr("eth0", "10.0.240.10/24")
+			// Now signal the link.
+			nl.signalLink("eth0", 0)
+
+			// Now we should see an address callback again.
+			recorder.ExpectSequence(testutils.AddrsEvent("eth0", "10.0.240.10"))
+			recorder.ExpectNoNewEvents()
+		})
+	})
+	Describe("with a teardown window", func() {
+		BeforeEach(func() {
+			config.TeardownWindow = 5 * time.Second
+		})
+
+		It("should not treat a dormant interface as tearing down", func() {
 			idx := nl.nextIndex
+			nl.addLink("eth0")
+			resyncC <- time.Time{}
+			dp.expectAddrStateCb("eth0", "", true)
+			nl.changeLinkState("eth0", "up")
+			dp.expectLinkStateCb("eth0", ifacemonitor.StateUp, idx)
+
+			// Dormant is a normal state for some links, for example while 802.1X
+			// authentication is in progress.
+			nl.changeLinkState("eth0", "dormant")
+			dp.expectLinkStateCb("eth0", ifacemonitor.StateDown, idx)
+			nl.changeLinkState("eth0", "up")
+			dp.expectLinkStateCb("eth0", ifacemonitor.StateUp, idx)
+		})
 
-			nl.addLink(iface)
+		It("should suppress a stale up for a deleted interface's index until the window expires", func() {
+			idx := nl.nextIndex
+			nl.addLink("eth0")
+			resyncC <- time.Time{}
+			dp.expectAddrStateCb("eth0", "", true)
+			nl.changeLinkState("eth0", "up")
+			dp.expectLinkStateCb("eth0", ifacemonitor.StateUp, idx)
+
+			nl.delLink("eth0")
+			dp.expectLinkStateCb("eth0", ifacemonitor.StateDown, idx)
+			dp.expectAddrStateCb("eth0", "", false)
+
+			// Simulate a stale NEWLINK for the same index arriving after the deletion.
+			nl.nextIndex--
+			nl.addLinkNoSignal("eth0")
+			nl.changeLinkState("eth0", "up")
+			dp.expectAddrStateCb("eth0", "", true)
+			dp.notExpectLinkStateCb()
 			resyncC <- time.Time{}
-			dp.notExpectAddrStateCb()
 			dp.notExpectLinkStateCb()
-			nl.addAddr(iface, "10.100.0.1/32")
-			dp.notExpectAddrStateCb()
 
-			nl.changeLinkState(iface, "up")
-			dp.expectLinkStateCb(iface, ifacemonitor.StateUp, idx)
-			nl.changeLinkState(iface, "down")
-			dp.expectLinkStateCb(iface, ifacemonitor.StateDown, idx)
+			// The interface really is up so, once the window expires, it's reported without
+			// waiting for another update or resync.
+			mockTime.IncrementTime(6 * time.Second)
+			dp.expectLinkStateCb("eth0", ifacemonitor.StateUp, idx)
+		})
+
+		It("should report nothing when the window expires for an interface that has gone again", func() {
+			idx := nl.nextIndex
+			nl.addLink("eth0")
+			resyncC <- time.Time{}
+			dp.expectAddrStateCb("eth0", "", true)
+			nl.changeLinkState("eth0", "up")
+			dp.expectLinkStateCb("eth0", ifacemonitor.StateUp, idx)
+
+			nl.delLink("eth0")
+			dp.expectLinkStateCb("eth0", ifacemonitor.StateDown, idx)
+			dp.expectAddrStateCb("eth0", "", false)
+			nl.nextIndex--
+			nl.addLinkNoSignal("eth0")
+			nl.changeLinkState("eth0", "up")
+			dp.expectAddrStateCb("eth0", "", true)
+			nl.delLink("eth0")
+			dp.expectAddrStateCb("eth0", "", false)
+
+			mockTime.IncrementTime(6 * time.Second)
+			dp.notExpectLinkStateCb()
+		})
+	})
+
+	Describe("without a teardown window", func() {
+		It("should report a dormant interface coming back up immediately", func() {
+			idx := nl.nextIndex
+			nl.addLink("eth0")
+			resyncC <- time.Time{}
+			dp.expectAddrStateCb("eth0", "", true)
+			nl.changeLinkState("eth0", "up")
+			dp.expectLinkStateCb("eth0", ifacemonitor.StateUp, idx)
+			nl.changeLinkState("eth0", "dormant")
+			dp.expectLinkStateCb("eth0", ifacemonitor.StateDown, idx)
+			nl.changeLinkState("eth0", "up")
+			dp.expectLinkStateCb("eth0", ifacemonitor.StateUp, idx)
+		})
+	})
+	Describe("with a link attributes callback", func() {
+		var idx int
+
+		BeforeEach(func() {
+			dp.attrsC = make(chan linkAttrsUpdate, 1)
+		})
+
+		JustBeforeEach(func() {
+			idx = nl.nextIndex
+			nl.addLink("eth0")
+			resyncC <- time.Time{}
+			dp.expectAddrStateCb("eth0", "", true)
+			delta := dp.expectLinkAttrsCb("eth0")
+			Expect(delta.ChangedFlags).To(Equal(uint32(0xffffffff)))
+			Expect(delta.MTUChanged).To(BeTrue())
+			Expect(delta.MTU).To(Equal(1500))
+
+			nl.changeLinkState("eth0", "up")
+			delta = dp.expectLinkAttrsCb("eth0")
+			Expect(delta.ChangedFlags).To(Equal(uint32(syscall.IFF_RUNNING)))
+			Expect(delta.MTUChanged).To(BeFalse())
+			dp.expectLinkStateCb("eth0", ifacemonitor.StateUp, idx)
+		})
+
+		It("should fall back to comparison for an MTU change with no change mask", func() {
+			nl.changeLinkMTU("eth0", 1400)
+			delta := dp.expectLinkAttrsCb("eth0")
+			Expect(delta.ChangedFlags).To(BeZero())
+			Expect(delta.MTUChanged).To(BeTrue())
+			Expect(delta.MTU).To(Equal(1400))
+			dp.notExpectLinkStateCb()
+		})
+
+		It("should pick up an MTU change that we only see on resync", func() {
+			nl.linksMutex.Lock()
+			link := nl.links["eth0"]
+			link.mtu = 1400
+			nl.links["eth0"] = link
+			nl.linksMutex.Unlock()
+			Consistently(dp.attrsC, "50ms", "5ms").ShouldNot(Receive())
+
+			resyncC <- time.Time{}
+			delta := dp.expectLinkAttrsCb("eth0")
+			Expect(delta.ChangedFlags).To(BeZero())
+			Expect(delta.MTUChanged).To(BeTrue())
+			Expect(delta.MTU).To(Equal(1400))
+			dp.notExpectLinkStateCb()
+		})
+
+		It("should report nothing for a resync with no changes", func() {
+			resyncC <- time.Time{}
+			Consistently(dp.attrsC, "50ms", "5ms").ShouldNot(Receive())
+		})
+
+		It("should short-circuit an update whose mask only covers non-state flags", func() {
+			numLists := nl.getNumListRoutesCalls()
+			nl.changeLinkFlags("eth0", syscall.IFF_PROMISC, syscall.IFF_PROMISC)
+			delta := dp.expectLinkAttrsCb("eth0")
+			Expect(delta.ChangedFlags).To(Equal(uint32(syscall.IFF_PROMISC)))
+			Expect(delta.RawFlags & syscall.IFF_PROMISC).NotTo(BeZero())
+			Expect(delta.MTUChanged).To(BeFalse())
+			dp.notExpectLinkStateCb()
+			Expect(nl.getNumListRoutesCalls()).To(Equal(numLists),
+				"Short-circuited update shouldn't re-list addresses")
+		})
+
+		It("should fully process an update whose mask covers a state flag", func() {
+			nl.linksMutex.Lock()
+			link := nl.links["eth0"]
+			link.state = "down"
+			nl.links["eth0"] = link
+			nl.linksMutex.Unlock()
+			nl.signalLinkWithChangeMask("eth0", 0, syscall.IFF_RUNNING)
+			delta := dp.expectLinkAttrsCb("eth0")
+			Expect(delta.ChangedFlags).To(Equal(uint32(syscall.IFF_RUNNING)))
+			dp.expectLinkStateCb("eth0", ifacemonitor.StateDown, idx)
+		})
+	})
+	Describe("with an info callback", func() {
+		BeforeEach(func() {
+			dp.infoC = make(chan ifacemonitor.InterfaceInfo, 1)
+		})
+
+		It("should keep an interface's ID across a rename and allocate a new one on re-creation", func() {
+			idx := nl.nextIndex
+			nl.addLink("eth0")
+			resyncC <- time.Time{}
+			dp.expectAddrStateCb("eth0", "", true)
+			nl.changeLinkState("eth0", "up")
+			dp.expectLinkStateCb("eth0", ifacemonitor.StateUp, idx)
+			info := dp.expectInfoCb("eth0", ifacemonitor.StateUp)
+			Expect(info.Index).To(Equal(idx))
+			Expect(info.HardwareAddr).To(Equal(net.HardwareAddr{0xee, 0xee, 0, 0, 0, byte(idx)}))
+			id := info.ID
+			Expect(id).NotTo(BeZero())
+
+			nl.renameLink("eth0", "eth1")
+			dp.expectLinkStateCb("eth0", ifacemonitor.StateDown, idx)
+			Expect(dp.expectInfoCb("eth0", ifacemonitor.StateDown).ID).To(Equal(id))
+			dp.expectAddrStateCb("eth0", "", false)
+			dp.expectLinkStateCb("eth1", ifacemonitor.StateUp, idx)
+			Expect(dp.expectInfoCb("eth1", ifacemonitor.StateUp).ID).To(Equal(id))
+			dp.expectAddrStateCb("eth1", "", true)
+
+			nl.delLink("eth1")
+			dp.expectLinkStateCb("eth1", ifacemonitor.StateDown, idx)
+			Expect(dp.expectInfoCb("eth1", ifacemonitor.StateDown).ID).To(Equal(id))
+			dp.expectAddrStateCb("eth1", "", false)
+
+			idx = nl.nextIndex
+			nl.addLink("eth1")
+			dp.expectAddrStateCb("eth1", "", true)
+			nl.changeLinkState("eth1", "up")
+			dp.expectLinkStateCb("eth1", ifacemonitor.StateUp, idx)
+			newID := dp.expectInfoCb("eth1", ifacemonitor.StateUp).ID
+			Expect(newID).NotTo(Equal(id))
+		})
+
+		It("should distinguish a disabled interface from one without carrier", func() {
+			idx := nl.nextIndex
+			nl.addLink("eth0")
+			resyncC <- time.Time{}
+			dp.expectAddrStateCb("eth0", "", true)
+
+			expectInfo := func(state ifacemonitor.State, adminUp bool, detailedState ifacemonitor.State) {
+				info := dp.expectInfoCb("eth0", state)
+				ExpectWithOffset(1, info.AdminUp).To(Equal(adminUp))
+				ExpectWithOffset(1, info.DetailedState).To(Equal(detailedState))
+			}
+
+			// Enabled, but no carrier; still down.
+			nl.changeLinkFlags("eth0", syscall.IFF_UP, syscall.IFF_UP)
+			expectInfo(ifacemonitor.StateDown, true, ifacemonitor.StateNoCarrier)
+			nl.changeLinkState("eth0", "up")
+			dp.expectLinkStateCb("eth0", ifacemonitor.StateUp, idx)
+			expectInfo(ifacemonitor.StateUp, true, ifacemonitor.StateUp)
+
+			// Carrier lost, then disabled.
+			nl.changeLinkState("eth0", "down")
+			dp.expectLinkStateCb("eth0", ifacemonitor.StateDown, idx)
+			expectInfo(ifacemonitor.StateDown, true, ifacemonitor.StateNoCarrier)
+			nl.changeLinkFlags("eth0", 0, syscall.IFF_UP)
+			expectInfo(ifacemonitor.StateDown, false, ifacemonitor.StateAdminDown)
+
+			// Nothing more on resync.
+			resyncC <- time.Time{}
+			resyncC <- time.Time{}
+			Consistently(dp.infoC, "50ms", "5ms").ShouldNot(Receive())
+
+			// Deleted while up.
+			nl.changeLinkFlags("eth0", syscall.IFF_UP, syscall.IFF_UP)
+			expectInfo(ifacemonitor.StateDown, true, ifacemonitor.StateNoCarrier)
+			nl.changeLinkState("eth0", "up")
+			dp.expectLinkStateCb("eth0", ifacemonitor.StateUp, idx)
+			expectInfo(ifacemonitor.StateUp, true, ifacemonitor.StateUp)
+			nl.delLink("eth0")
+			dp.expectLinkStateCb("eth0", ifacemonitor.StateDown, idx)
+			expectInfo(ifacemonitor.StateDown, false, ifacemonitor.StateNotPresent)
+		})
+
+		It("should include the index, MTU and flags", func() {
+			idx := nl.nextIndex
+			nl.addLink("eth0")
+			resyncC <- time.Time{}
+			dp.expectAddrStateCb("eth0", "", true)
+			nl.changeLinkMTU("eth0", 9000)
+			Expect(dp.expectInfoCb("eth0", ifacemonitor.StateDown).MTU).To(Equal(9000))
+			nl.changeLinkState("eth0", "up")
+			dp.expectLinkStateCb("eth0", ifacemonitor.StateUp, idx)
+			info := dp.expectInfoCb("eth0", ifacemonitor.StateUp)
+			Expect(info.Index).To(Equal(idx))
+			Expect(info.MTU).To(Equal(9000))
+			Expect(info.RawFlags & syscall.IFF_RUNNING).NotTo(BeZero())
+
+			nl.delLink("eth0")
+			dp.expectLinkStateCb("eth0", ifacemonitor.StateDown, idx)
+			info = dp.expectInfoCb("eth0", ifacemonitor.StateDown)
+			Expect(info.Index).To(Equal(idx))
+			Expect(info.MTU).To(BeZero())
+			Expect(info.RawFlags).To(BeZero())
+		})
+
+		It("should report a change of MAC", func() {
+			idx := nl.nextIndex
+			nl.addLink("eth0")
+			resyncC <- time.Time{}
+			dp.expectAddrStateCb("eth0", "", true)
+			nl.changeLinkState("eth0", "up")
+			dp.expectLinkStateCb("eth0", ifacemonitor.StateUp, idx)
+			dp.expectInfoCb("eth0", ifacemonitor.StateUp)
+
+			newMAC := net.HardwareAddr{0xee, 0xee, 0, 0, 0, 0xaa}
+			nl.changeLinkMAC("eth0", newMAC)
+			Expect(dp.expectInfoCb("eth0", ifacemonitor.StateUp).HardwareAddr).To(Equal(newMAC))
+			dp.notExpectLinkStateCb()
+
+			// Including while the interface is down, and when it loses its MAC altogether.
+			nl.changeLinkState("eth0", "down")
+			dp.expectLinkStateCb("eth0", ifacemonitor.StateDown, idx)
+			dp.expectInfoCb("eth0", ifacemonitor.StateDown)
+			nl.changeLinkMAC("eth0", nil)
+			info := dp.expectInfoCb("eth0", ifacemonitor.StateDown)
+			Expect(info.HardwareAddr).To(BeEmpty())
+			Expect(info.HardwareAddr.String()).To(Equal(""))
+
+			resyncC <- time.Time{}
+			resyncC <- time.Time{}
+			Consistently(dp.infoC, "50ms", "5ms").ShouldNot(Receive())
+		})
+	})
+	Describe("with a default route callback", func() {
+		BeforeEach(func() {
+			dp.defaultRouteC = make(chan defaultRouteUpdate, 2)
+		})
+
+		JustBeforeEach(func() {
+			// Initial resync should report that there are no default routes.
+			dp.expectDefaultRouteCb(netlink.FAMILY_V4)
+			dp.expectDefaultRouteCb(netlink.FAMILY_V6)
+
+			nl.addLink("eth0")
+			dp.expectAddrStateCb("eth0", "", true)
+			nl.addLink("eth1")
+			dp.expectAddrStateCb("eth1", "", true)
+		})
+
+		It("should track v4 and v6 default routes independently", func() {
+			nl.setDefaultRoute(netlink.FAMILY_V4, "eth0")
+			dp.expectDefaultRouteCb(netlink.FAMILY_V4, "eth0")
+			nl.setDefaultRoute(netlink.FAMILY_V6, "eth1")
+			dp.expectDefaultRouteCb(netlink.FAMILY_V6, "eth1")
+
+			names, known := im.DefaultRouteIfaces(netlink.FAMILY_V4)
+			Expect(known).To(BeTrue())
+			Expect(names).To(Equal([]string{"eth0"}))
+			names, known = im.DefaultRouteIfaces(netlink.FAMILY_V6)
+			Expect(known).To(BeTrue())
+			Expect(names).To(Equal([]string{"eth1"}))
+
+			// Move the v4 default route; v6 should be unaffected.
+			nl.setDefaultRoute(netlink.FAMILY_V4, "eth1")
+			dp.expectDefaultRouteCb(netlink.FAMILY_V4, "eth1")
+			Consistently(dp.defaultRouteC, "50ms", "5ms").ShouldNot(Receive())
+
+			// Resync with no changes should be a no-op.
+			resyncC <- time.Time{}
+			Consistently(dp.defaultRouteC, "50ms", "5ms").ShouldNot(Receive())
+
+			nl.setDefaultRoute(netlink.FAMILY_V6)
+			dp.expectDefaultRouteCb(netlink.FAMILY_V6)
+			names, known = im.DefaultRouteIfaces(netlink.FAMILY_V6)
+			Expect(known).To(BeTrue())
+			Expect(names).To(BeEmpty())
+		})
+
+		It("should only re-list the default routes after a default route update", func() {
+			numCalls := nl.getNumListDefaultRoutesCalls()
+			resyncC <- time.Time{}
+			// Once the second resync has been picked up, the first has finished.
+			resyncC <- time.Time{}
+			Expect(nl.getNumListDefaultRoutesCalls()).To(Equal(numCalls))
+
+			nl.setDefaultRoute(netlink.FAMILY_V4, "eth0")
+			dp.expectDefaultRouteCb(netlink.FAMILY_V4, "eth0")
+			Expect(nl.getNumListDefaultRoutesCalls()).To(Equal(numCalls + 1))
+		})
+
+		It("should report all interfaces of an ECMP default route", func() {
+			nl.setDefaultRoute(netlink.FAMILY_V4, "eth1", "eth0")
+			dp.expectDefaultRouteCb(netlink.FAMILY_V4, "eth0", "eth1")
+			nl.setDefaultRoute(netlink.FAMILY_V4, "eth1")
+			dp.expectDefaultRouteCb(netlink.FAMILY_V4, "eth1")
+		})
+
+		It("should follow a rename of the default route interface", func() {
+			nl.setDefaultRoute(netlink.FAMILY_V4, "eth0")
+			dp.expectDefaultRouteCb(netlink.FAMILY_V4, "eth0")
+			nl.renameLink("eth0", "eth2")
+			dp.expectDefaultRouteCb(netlink.FAMILY_V4, "eth2")
+		})
+	})
+	Describe("with an address announcer", func() {
+		var idx int
+
+		BeforeEach(func() {
+			config.AddrAnnounceInterval = 5 * time.Second
+			announcer = &mockAnnouncer{C: make(chan announcement, 1)}
+		})
+
+		JustBeforeEach(func() {
+			idx = nl.nextIndex
+			nl.addLink("eth0")
+			resyncC <- time.Time{}
+			dp.expectAddrStateCb("eth0", "", true)
+			nl.changeLinkState("eth0", "up")
+			dp.expectLinkStateCb("eth0", ifacemonitor.StateUp, idx)
+		})
+
+		It("should announce new global addresses", func() {
+			nl.addAddr("eth0", "10.0.240.10/24")
+			dp.expectAddrStateCb("eth0", "10.0.240.10", true)
+			var a announcement
+			Eventually(announcer.C).Should(Receive(&a))
+			Expect(a).To(Equal(announcement{
+				ifaceName: "eth0",
+				index:     idx,
+				mac:       net.HardwareAddr{0xee, 0xee, 0, 0, 0, byte(idx)},
+				addr:      "10.0.240.10",
+			}))
+
+			nl.addAddr("eth0", "fd00::10/128")
+			dp.expectAddrStateCb("eth0", "fd00::10", true)
+			Eventually(announcer.C).Should(Receive(&a))
+			Expect(a.addr).To(Equal("fd00::10"))
+		})
+
+		It("should rate limit announcements of the same address", func() {
+			nl.addAddr("eth0", "10.0.240.10/24")
+			dp.expectAddrStateCb("eth0", "10.0.240.10", true)
+			Eventually(announcer.C).Should(Receive())
+
+			nl.delAddr("eth0", "10.0.240.10/24")
+			dp.expectAddrStateCb("eth0", "10.0.240.10", false)
+			nl.addAddr("eth0", "10.0.240.10/24")
+			dp.expectAddrStateCb("eth0", "10.0.240.10", true)
+			Consistently(announcer.C, "50ms", "5ms").ShouldNot(Receive())
+
+			mockTime.IncrementTime(6 * time.Second)
+			nl.delAddr("eth0", "10.0.240.10/24")
+			dp.expectAddrStateCb("eth0", "10.0.240.10", false)
+			nl.addAddr("eth0", "10.0.240.10/24")
+			dp.expectAddrStateCb("eth0", "10.0.240.10", true)
+			Eventually(announcer.C).Should(Receive())
+		})
+
+		It("should not announce link-local or tentative addresses", func() {
+			nl.addAddr("eth0", "fe80::10/128")
+			dp.expectAddrStateCb("eth0", "fe80::10", true)
+			nl.addTentativeAddr("eth0", "fd00::10/128")
+			dp.expectAddrStateCb("eth0", "fd00::10", true)
+			Consistently(announcer.C, "50ms", "5ms").ShouldNot(Receive())
+		})
+
+		It("should not announce addresses on down interfaces", func() {
+			nl.changeLinkState("eth0", "down")
+			dp.expectLinkStateCb("eth0", ifacemonitor.StateDown, idx)
+			nl.addAddr("eth0", "10.0.240.10/24")
+			dp.expectAddrStateCb("eth0", "10.0.240.10", true)
+			Consistently(announcer.C, "50ms", "5ms").ShouldNot(Receive())
+		})
+
+		Describe("with a failing announcer", func() {
+			BeforeEach(func() {
+				announcer.err = errors.New("dummy error")
+			})
+
+			It("should carry on monitoring", func() {
+				nl.addAddr("eth0", "10.0.240.10/24")
+				dp.expectAddrStateCb("eth0", "10.0.240.10", true)
+				Eventually(announcer.C).Should(Receive())
+				nl.addAddr("eth0", "10.0.240.11/24")
+				dp.expectAddrStateCb("eth0", "10.0.240.11", true)
+				Eventually(announcer.C).Should(Receive())
+			})
+		})
+	})
+	Describe("with interface family expectations", func() {
+		BeforeEach(func() {
+			config.IPv4OnlyInterfaces = []*regexp.Regexp{regexp.MustCompile("^eth")}
+			config.IPv6OnlyInterfaces = []*regexp.Regexp{regexp.MustCompile("^v6only$")}
+			dp.familyC = make(chan addrFamilyUpdate, 1)
+		})
+
+		It("should flag addresses of unexpected families", func() {
+			nl.addLink("eth0")
+			resyncC <- time.Time{}
+			dp.expectAddrStateCb("eth0", "", true)
+
+			// Expected family and IPv6 link-local: no complaints.
+			nl.addAddr("eth0", "10.0.240.10/24")
+			dp.expectAddrStateCb("eth0", "10.0.240.10", true)
+			nl.addAddr("eth0", "fe80::10/128")
+			dp.expectAddrStateCb("eth0", "fe80::10", true)
+			Consistently(dp.familyC, "50ms", "5ms").ShouldNot(Receive())
+
+			// Unexpected family gets flagged but still passed through.
+			nl.addAddr("eth0", "fd00::10/128")
+			dp.expectAddrStateCb("eth0", "fd00::10", true)
+			Eventually(dp.familyC).Should(Receive(Equal(addrFamilyUpdate{
+				name:   "eth0",
+				addr:   "fd00::10",
+				family: netlink.FAMILY_V6,
+			})))
+
+			nl.addLink("v6only")
+			dp.expectAddrStateCb("v6only", "", true)
+			nl.addAddr("v6only", "10.0.240.11/24")
+			dp.expectAddrStateCb("v6only", "10.0.240.11", true)
+			Eventually(dp.familyC).Should(Receive(Equal(addrFamilyUpdate{
+				name:   "v6only",
+				addr:   "10.0.240.11",
+				family: netlink.FAMILY_V4,
+			})))
+
+			// Interfaces without an expectation can have either family.
+			nl.addLink("other")
+			dp.expectAddrStateCb("other", "", true)
+			nl.addAddr("other", "fd00::11/128")
+			dp.expectAddrStateCb("other", "fd00::11", true)
+			Consistently(dp.familyC, "50ms", "5ms").ShouldNot(Receive())
+		})
+	})
+	Describe("with a heartbeat callback", func() {
+		BeforeEach(func() {
+			dp.heartbeatC = make(chan ifacemonitor.Heartbeat, 1)
+		})
+
+		It("should send a heartbeat after every resync", func() {
+			// Start of day resync.
+			Eventually(dp.heartbeatC).Should(Receive(Equal(ifacemonitor.Heartbeat{
+				NumInterfaces: 0,
+				Timestamp:     mockTime.Now(),
+			})))
+
+			nl.addLink("eth0")
+			dp.expectAddrStateCb("eth0", "", true)
+			nl.addLink("kube-ipvs0")
+
+			mockTime.IncrementTime(time.Second)
+			resyncC <- time.Time{}
+			Eventually(dp.heartbeatC).Should(Receive(Equal(ifacemonitor.Heartbeat{
+				NumInterfaces: 1,
+				Timestamp:     mockTime.Now(),
+			})))
+
+			// Nothing changed but we should still get a heartbeat.
+			resyncC <- time.Time{}
+			Eventually(dp.heartbeatC).Should(Receive())
+		})
+	})
+	Describe("with the sysfs oper state check", func() {
+		var sysfs *mockSysfs
+
+		BeforeEach(func() {
+			config.SysfsOperStateCheck = true
+			sysfs = &mockSysfs{files: map[string]string{}}
+			extraOpts = append(extraOpts, ifacemonitor.WithSysfsStub(sysfs))
+		})
+
+		It("should prefer the /sys oper state", func() {
+			idx := nl.nextIndex
+			nl.addLink("eth0")
+			resyncC <- time.Time{}
+			dp.expectAddrStateCb("eth0", "", true)
+
+			// Netlink says down but /sys says up; picked up on resync.
+			sysfs.setFile("/sys/class/net/eth0/operstate", "up\n")
+			resyncC <- time.Time{}
+			dp.expectLinkStateCb("eth0", ifacemonitor.StateUp, idx)
+
+			// Netlink goes up, no transition.
+			nl.changeLinkState("eth0", "up")
+			dp.notExpectLinkStateCb()
+
+			// /sys says down, netlink says up.
+			sysfs.setFile("/sys/class/net/eth0/operstate", "down\n")
+			resyncC <- time.Time{}
+			dp.expectLinkStateCb("eth0", ifacemonitor.StateDown, idx)
+
+			// Unknown operstate falls back to the carrier.
+			sysfs.setFile("/sys/class/net/eth0/operstate", "unknown\n")
+			sysfs.setFile("/sys/class/net/eth0/carrier", "1\n")
+			resyncC <- time.Time{}
+			dp.expectLinkStateCb("eth0", ifacemonitor.StateUp, idx)
+		})
+
+		It("should use the netlink state if /sys can't be read", func() {
+			idx := nl.nextIndex
+			nl.addLink("eth0")
+			resyncC <- time.Time{}
+			dp.expectAddrStateCb("eth0", "", true)
+			nl.changeLinkState("eth0", "up")
+			dp.expectLinkStateCb("eth0", ifacemonitor.StateUp, idx)
+		})
+	})
+	Describe("with protodown tracking", func() {
+		var sysfs *mockSysfs
+		var idx int
+
+		BeforeEach(func() {
+			config.TrackProtodown = true
+			sysfs = &mockSysfs{files: map[string]string{}}
+			sysfs.setFile("/sys/class/net/eth0/proto_down", "0\n")
+			extraOpts = append(extraOpts, ifacemonitor.WithSysfsStub(sysfs))
+			dp.attrsC = make(chan linkAttrsUpdate, 1)
+			dp.infoC = make(chan ifacemonitor.InterfaceInfo, 1)
+		})
+
+		JustBeforeEach(func() {
+			idx = nl.nextIndex
+			nl.addLink("eth0")
+			dp.expectAddrStateCb("eth0", "", true)
+			delta := dp.expectLinkAttrsCb("eth0")
+			Expect(delta.ProtodownChanged).To(BeTrue())
+			Expect(delta.Protodown).To(BeFalse())
+		})
+
+		It("should report protodown transitions", func() {
+			nl.changeLinkState("eth0", "up")
+			dp.expectLinkAttrsCb("eth0")
+			dp.expectLinkStateCb("eth0", ifacemonitor.StateUp, idx)
+			Expect(dp.expectInfoCb("eth0", ifacemonitor.StateUp).Protodown).To(BeFalse())
+
+			// Picked up on resync.
+			sysfs.setFile("/sys/class/net/eth0/proto_down", "1\n")
+			resyncC <- time.Time{}
+			delta := dp.expectLinkAttrsCb("eth0")
+			Expect(delta.ProtodownChanged).To(BeTrue())
+			Expect(delta.Protodown).To(BeTrue())
+			Expect(delta.ChangedFlags).To(BeZero())
+			dp.notExpectLinkStateCb()
+
+			// And on a link update.
+			sysfs.setFile("/sys/class/net/eth0/proto_down", "0\n")
+			nl.signalLink("eth0", 0)
+			delta = dp.expectLinkAttrsCb("eth0")
+			Expect(delta.ProtodownChanged).To(BeTrue())
+			Expect(delta.Protodown).To(BeFalse())
+			dp.notExpectLinkStateCb()
+		})
+
+		Describe("with ProtodownAsDown", func() {
+			BeforeEach(func() {
+				config.ProtodownAsDown = true
+			})
+
+			It("should report protodown interfaces as down", func() {
+				sysfs.setFile("/sys/class/net/eth0/proto_down", "1\n")
+				nl.changeLinkState("eth0", "up")
+				dp.expectLinkAttrsCb("eth0")
+				dp.notExpectLinkStateCb()
+				// Still down, but now because it's held down.
+				info := dp.expectInfoCb("eth0", ifacemonitor.StateDown)
+				Expect(info.DetailedState).To(Equal(ifacemonitor.State(ifacemonitor.StateHeldDown)))
+
+				sysfs.setFile("/sys/class/net/eth0/proto_down", "0\n")
+				resyncC <- time.Time{}
+				dp.expectLinkAttrsCb("eth0")
+				dp.expectLinkStateCb("eth0", ifacemonitor.StateUp, idx)
+				Expect(dp.expectInfoCb("eth0", ifacemonitor.StateUp).Protodown).To(BeFalse())
+
+				sysfs.setFile("/sys/class/net/eth0/proto_down", "1\n")
+				nl.signalLink("eth0", 0)
+				dp.expectLinkAttrsCb("eth0")
+				dp.expectLinkStateCb("eth0", ifacemonitor.StateDown, idx)
+				Expect(dp.expectInfoCb("eth0", ifacemonitor.StateDown).Protodown).To(BeTrue())
+			})
+		})
+	})
+
+	Describe("with address monitoring disabled", func() {
+		BeforeEach(func() {
+			config.DisableAddrMonitoring = true
+		})
+
+		It("should only report link state", func() {
+			Expect(nl.subscribedGroups).To(Equal(ifacemonitor.NetlinkGroupLink))
+
+			idx := nl.nextIndex
+			nl.addLink("eth0")
+			resyncC <- time.Time{}
+			nl.changeLinkState("eth0", "up")
+			dp.expectLinkStateCb("eth0", ifacemonitor.StateUp, idx)
+
+			// Interface removal spotted on resync.
+			nl.delLinkNoSignal("eth0")
+			resyncC <- time.Time{}
+			dp.expectLinkStateCb("eth0", ifacemonitor.StateDown, idx)
 
-			// Should notify down from up on deletion.
-			nl.changeLinkState(iface, "up")
-			dp.expectLinkStateCb(iface, ifacemonitor.StateUp, idx)
-			nl.delLink(iface)
 			dp.notExpectAddrStateCb()
-			dp.expectLinkStateCb(iface, ifacemonitor.StateDown, idx)
+			Expect(nl.getNumListRoutesCalls()).To(BeZero())
+		})
+	})
+	Describe("netlink subscription", func() {
+		Context("with default config", func() {
+			It("should subscribe to links and routes", func() {
+				Expect(nl.subscribedGroups).To(Equal(ifacemonitor.NetlinkGroupLink | ifacemonitor.NetlinkGroupRoute))
+				Expect(nl.updates).NotTo(BeNil())
+			})
+		})
+
+		Context("with address monitoring disabled", func() {
+			BeforeEach(func() {
+				config.DisableAddrMonitoring = true
+			})
+
+			It("should subscribe to links only", func() {
+				Expect(nl.subscribedGroups).To(Equal(ifacemonitor.NetlinkGroupLink))
+			})
+
+			Context("with a default route callback", func() {
+				BeforeEach(func() {
+					dp.defaultRouteC = make(chan defaultRouteUpdate, 2)
+				})
 
-			// Check it can be added again.
-			nl.addLink(iface)
+				It("should subscribe to links and routes", func() {
+					Expect(nl.subscribedGroups).To(Equal(ifacemonitor.NetlinkGroupLink | ifacemonitor.NetlinkGroupRoute))
+				})
+			})
+		})
+	})
+	Describe("with a peer address callback", func() {
+		BeforeEach(func() {
+			dp.peersC = make(chan peerAddrsUpdate, 1)
+		})
+
+		It("should report peer addresses of point-to-point interfaces", func() {
+			nl.addLink("tun0")
+			resyncC <- time.Time{}
+			dp.expectAddrStateCb("tun0", "", true)
+			nl.changeLinkFlags("tun0", syscall.IFF_POINTOPOINT, 0)
+
+			nl.addPeerAddr("tun0", "10.0.0.1/32", "10.0.0.2/32")
+			dp.expectAddrStateCb("tun0", "10.0.0.1", true)
+			Eventually(dp.peersC).Should(Receive(Equal(peerAddrsUpdate{
+				name:  "tun0",
+				peers: map[string]string{"10.0.0.1": "10.0.0.2"},
+			})))
+
+			// Adding an address with no peer doesn't change the peers.
+			nl.addAddr("tun0", "10.0.0.5/32")
+			dp.expectAddrStateCb("tun0", "10.0.0.5", true)
+			Consistently(dp.peersC, "50ms", "5ms").ShouldNot(Receive())
+
+			nl.delAddr("tun0", "10.0.0.1/32")
+			dp.expectAddrStateCb("tun0", "10.0.0.1", false)
+			Eventually(dp.peersC).Should(Receive(Equal(peerAddrsUpdate{
+				name:  "tun0",
+				peers: map[string]string{},
+			})))
+		})
+
+		It("should ignore peer addresses on other interfaces", func() {
+			nl.addLink("eth0")
 			resyncC <- time.Time{}
+			dp.expectAddrStateCb("eth0", "", true)
+			nl.addPeerAddr("eth0", "10.0.0.1/32", "10.0.0.2/32")
+			dp.expectAddrStateCb("eth0", "10.0.0.1", true)
+			Consistently(dp.peersC, "50ms", "5ms").ShouldNot(Receive())
+		})
+	})
+	Describe("with macvlan and ipvlan interfaces", func() {
+		var parentIdx int
+
+		BeforeEach(func() {
+			dp.subDevC = make(chan subDevUpdate, 1)
+		})
+
+		JustBeforeEach(func() {
+			parentIdx = nl.nextIndex
+			nl.addLink("eth0")
+			dp.expectAddrStateCb("eth0", "", true)
+		})
+
+		It("should report creation and recreation with a different mode", func() {
+			nl.addSubDevice("mv0", "macvlan", int(netlink.MACVLAN_MODE_BRIDGE), "eth0")
+			Eventually(dp.subDevC).Should(Receive(Equal(subDevUpdate{
+				name: "mv0",
+				subDevice: &ifacemonitor.SubDevice{
+					Kind:        "macvlan",
+					Mode:        "bridge",
+					ParentIndex: parentIdx,
+					ParentName:  "eth0",
+				},
+			})))
+			dp.expectAddrStateCb("mv0", "", true)
+
+			data, err := im.Snapshot()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).To(ContainSubstring(
+				`"sub_device":{"kind":"macvlan","mode":"bridge","parent_index":%d,"parent_name":"eth0"}`, parentIdx))
+
+			// The mode can't be changed in place; the interface has to be recreated.
+			nl.delLink("mv0")
+			dp.expectAddrStateCb("mv0", "", false)
+			Eventually(dp.subDevC).Should(Receive(Equal(subDevUpdate{name: "mv0"})))
+			nl.addSubDevice("mv0", "macvlan", int(netlink.MACVLAN_MODE_PRIVATE), "eth0")
+			var upd subDevUpdate
+			Eventually(dp.subDevC).Should(Receive(&upd))
+			Expect(upd.subDevice.Mode).To(Equal("private"))
+			Expect(upd.subDevice.String()).To(Equal("macvlan private on eth0"))
+			dp.expectAddrStateCb("mv0", "", true)
+		})
+
+		It("should report the parent going away", func() {
+			nl.addSubDevice("ipvl0", "ipvlan", int(netlink.IPVLAN_MODE_L3), "eth0")
+			var upd subDevUpdate
+			Eventually(dp.subDevC).Should(Receive(&upd))
+			Expect(*upd.subDevice).To(Equal(ifacemonitor.SubDevice{
+				Kind:        "ipvlan",
+				Mode:        "l3",
+				ParentIndex: parentIdx,
+				ParentName:  "eth0",
+			}))
+			dp.expectAddrStateCb("ipvl0", "", true)
+
+			nl.delLink("eth0")
+			dp.expectAddrStateCb("eth0", "", false)
+			Eventually(dp.subDevC).Should(Receive(&upd))
+			Expect(upd.name).To(Equal("ipvl0"))
+			Expect(*upd.subDevice).To(Equal(ifacemonitor.SubDevice{
+				Kind:        "ipvlan",
+				Mode:        "l3",
+				ParentIndex: parentIdx,
+			}))
+			Expect(upd.subDevice.String()).To(Equal(fmt.Sprintf("ipvlan l3 on unknown parent (index %d)", parentIdx)))
+		})
+
+		It("should not report other interfaces", func() {
+			nl.addLink("eth1")
+			dp.expectAddrStateCb("eth1", "", true)
+			Consistently(dp.subDevC, "50ms", "5ms").ShouldNot(Receive())
+		})
+	})
+
+	Describe("with a parent chain callback", func() {
+		BeforeEach(func() {
+			dp.chainC = make(chan parentChainUpdate, 1)
+		})
+
+		It("should report the chain of a VLAN on a bond", func() {
+			for _, name := range []string{"eno1", "eno2", "bond0"} {
+				nl.addLink(name)
+				dp.expectAddrStateCb(name, "", true)
+			}
+			Consistently(dp.chainC, "50ms", "5ms").ShouldNot(Receive())
+
+			nl.setMaster("eno1", "bond0")
+			Eventually(dp.chainC).Should(Receive(Equal(parentChainUpdate{
+				name:  "bond0",
+				chain: &ifacemonitor.ParentChain{Levels: [][]string{{"eno1"}}},
+			})))
+			nl.setMaster("eno2", "bond0")
+			Eventually(dp.chainC).Should(Receive(Equal(parentChainUpdate{
+				name:  "bond0",
+				chain: &ifacemonitor.ParentChain{Levels: [][]string{{"eno1", "eno2"}}},
+			})))
+
+			nl.addSubDevice("bond0.100", "vlan", 100, "bond0")
+			var upd parentChainUpdate
+			Eventually(dp.chainC).Should(Receive(&upd))
+			Expect(upd.name).To(Equal("bond0.100"))
+			Expect(upd.chain.String()).To(Equal("bond0 -> eno1,eno2"))
+			dp.expectAddrStateCb("bond0.100", "", true)
+
+			data, err := im.Snapshot()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).To(ContainSubstring(`"parent_chain":{"levels":[["bond0"],["eno1","eno2"]]}`))
+
+			// Removing the bond leaves the VLAN dangling.
+			nl.delLink("bond0")
+			dp.expectAddrStateCb("bond0", "", false)
+			Eventually(dp.chainC).Should(Receive(Equal(parentChainUpdate{
+				name:  "bond0.100",
+				chain: &ifacemonitor.ParentChain{Incomplete: true},
+			})))
+			Consistently(dp.chainC, "50ms", "5ms").ShouldNot(Receive())
+		})
+	})
+
+	Describe("WaitForIfaceUp", func() {
+		waitInBackground := func(ctx context.Context, name string) chan error {
+			errC := make(chan error, 1)
+			go func() {
+				errC <- im.WaitForIfaceUp(ctx, name)
+			}()
+			return errC
+		}
+
+		It("should return immediately if the interface is already up", func() {
+			idx := nl.nextIndex
+			nl.addLink("eth0")
+			dp.expectAddrStateCb("eth0", "", true)
+			nl.changeLinkState("eth0", "up")
+			dp.expectLinkStateCb("eth0", ifacemonitor.StateUp, idx)
+			Expect(im.WaitForIfaceUp(context.Background(), "eth0")).To(Succeed())
+		})
+
+		It("should wake up all the waiters when their interface comes up", func() {
+			tunlC1 := waitInBackground(context.Background(), "tunl0")
+			tunlC2 := waitInBackground(context.Background(), "tunl0")
+			vethC := waitInBackground(context.Background(), "veth0")
+
+			idx := nl.nextIndex
+			nl.addLink("tunl0")
+			dp.expectAddrStateCb("tunl0", "", true)
+			Consistently(tunlC1, "50ms", "5ms").ShouldNot(Receive())
+			nl.changeLinkState("tunl0", "up")
+			dp.expectLinkStateCb("tunl0", ifacemonitor.StateUp, idx)
+			Eventually(tunlC1).Should(Receive(BeNil()))
+			Eventually(tunlC2).Should(Receive(BeNil()))
+			Consistently(vethC, "50ms", "5ms").ShouldNot(Receive())
+
+			// Going down again means that new waiters block.
+			nl.changeLinkState("tunl0", "down")
+			dp.expectLinkStateCb("tunl0", ifacemonitor.StateDown, idx)
+			tunlC3 := waitInBackground(context.Background(), "tunl0")
+			Consistently(tunlC3, "50ms", "5ms").ShouldNot(Receive())
+
+			idx = nl.nextIndex
+			nl.addLink("veth0")
+			dp.expectAddrStateCb("veth0", "", true)
+			nl.changeLinkState("veth0", "up")
+			dp.expectLinkStateCb("veth0", ifacemonitor.StateUp, idx)
+			Eventually(vethC).Should(Receive(BeNil()))
+			Consistently(tunlC3, "50ms", "5ms").ShouldNot(Receive())
+			im.Stop()
+			Eventually(tunlC3).Should(Receive(Equal(ifacemonitor.ErrMonitorStopped)))
+		})
+
+		It("should time out", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			Expect(im.WaitForIfaceUp(ctx, "tunl0")).To(Equal(context.DeadlineExceeded))
+		})
+
+		It("should release waiters when the monitor is stopped", func() {
+			errC := waitInBackground(context.Background(), "tunl0")
+			Consistently(errC, "50ms", "5ms").ShouldNot(Receive())
+			im.Stop()
+			Eventually(errC).Should(Receive(Equal(ifacemonitor.ErrMonitorStopped)))
+			Expect(im.WaitForIfaceUp(context.Background(), "tunl0")).To(Equal(ifacemonitor.ErrMonitorStopped))
+		})
+	})
+
+	Describe("stopping", func() {
+		var updates chan string
+
+		BeforeEach(func() {
+			dp.linkC = make(chan linkUpdate, 10)
+			dp.addrC = make(chan addrState, 10)
+		})
+
+		JustBeforeEach(func() {
+			nl.addLink("eth0")
+			nl.addAddr("eth0", "10.0.240.10/24")
+			nl.changeLinkState("eth0", "up")
+			nl.addLink("eth1")
+			nl.addLink("kube-ipvs0")
+			nl.changeLinkState("kube-ipvs0", "up")
+			nl.addLink("cali1")
+			nl.changeLinkState("cali1", "up")
+			resyncC <- time.Time{}
+
+			// Record the callbacks, in order, with a subscriber.
+			updates = make(chan string, 20)
+			im.Subscribe(ifacemonitor.Subscriber{
+				StateCallback: func(ifaceName string, state ifacemonitor.State, ifIndex int) {
+					updates <- fmt.Sprintf("%s %s", ifaceName, state)
+				},
+				AddrCallback: func(ifaceName string, addrs set.Set) {
+					if addrs == nil {
+						updates <- fmt.Sprintf("%s gone", ifaceName)
+						return
+					}
+					updates <- fmt.Sprintf("%s addrs=%d", ifaceName, addrs.Len())
+				},
+			}, false)
+		})
+
+		It("should stop silently by default", func() {
+			im.Stop()
+			Consistently(updates, "50ms", "5ms").ShouldNot(Receive())
+		})
+
+		It("should withdraw every interface before stopping", func() {
+			im.StopAndWithdraw()
+			var got []string
+			for len(updates) > 0 {
+				got = append(got, <-updates)
+			}
+			Expect(got).To(Equal([]string{
+				"eth0 down",
+				"eth0 gone",
+				"eth1 gone",
+				"kube-ipvs0 down",
+				"cali1 down",
+				"cali1 gone",
+			}))
+			Consistently(updates, "50ms", "5ms").ShouldNot(Receive())
+
+			// No-op once stopped.
+			im.StopAndWithdraw()
+			Consistently(updates, "50ms", "5ms").ShouldNot(Receive())
+		})
+	})
+
+	Describe("with altname matching", func() {
+		BeforeEach(func() {
+			config.MatchAltNames = true
+		})
+
+		It("should exclude an interface purely via its altname", func() {
+			nl.addLinkNoSignal("enp1s0")
+			nl.linksMutex.Lock()
+			link := nl.links["enp1s0"]
+			link.altNames = []string{"kube-ipvs-alt"}
+			nl.links["enp1s0"] = link
+			nl.linksMutex.Unlock()
+			nl.signalLink("enp1s0", 0)
 			dp.notExpectAddrStateCb()
-			dp.notExpectLinkStateCb()
+			nl.addAddr("enp1s0", "10.0.0.1/32")
+			dp.notExpectAddrStateCb()
+
+			// The link update isn't reported, so wait for it to show up in the snapshot.
+			Eventually(func() string {
+				data, err := im.Snapshot()
+				Expect(err).NotTo(HaveOccurred())
+				return string(data)
+			}).Should(ContainSubstring(`"alt_names":["kube-ipvs-alt"]`))
+		})
 
-			// Clean it.
-			nl.delLink(iface)
+		It("should re-evaluate the filters when the altnames change", func() {
+			nl.addLink("enp1s0")
+			dp.expectAddrStateCb("enp1s0", "", true)
+			nl.addAddr("enp1s0", "10.0.0.1/32")
+			dp.expectAddrStateCb("enp1s0", "10.0.0.1", true)
+
+			// Adding a matching altname looks like the interface going away.
+			nl.setAltNames("enp1s0", "dummy-alt")
+			dp.expectAddrStateCb("enp1s0", "", false)
+			nl.addAddr("enp1s0", "10.0.0.2/32")
 			dp.notExpectAddrStateCb()
-			dp.notExpectLinkStateCb()
+
+			// A non-matching altname doesn't change anything.
+			nl.setAltNames("enp1s0", "dummy-alt", "other")
+			dp.notExpectAddrStateCb()
+
+			// Removing it looks like the interface being added.
+			nl.setAltNames("enp1s0", "other")
+			dp.expectAddrStateCb("enp1s0", "10.0.0.2", true)
+		})
+	})
+
+	Describe("with a classifier", func() {
+		BeforeEach(func() {
+			classifier = ifacemonitor.DefaultClassifier
+			dp.classC = make(chan classUpdate, 1)
+			dp.infoC = make(chan ifacemonitor.InterfaceInfo, 1)
+		})
+
+		expectClassCb := func(name string, oldClass, newClass ifacemonitor.InterfaceClass) {
+			EventuallyWithOffset(1, dp.classC).Should(Receive(Equal(classUpdate{
+				name:     name,
+				oldClass: oldClass,
+				newClass: newClass,
+			})))
 		}
 
-		// Repeat for 3 different interfaces (to test regexp of interface excludes)
-		for index := 0; index < 3; index++ {
-			interfaceName := fmt.Sprintf("kube-ipvs%d", index)
-			netlinkUpdates(interfaceName)
+		It("should classify interfaces and report reclassification", func() {
+			nl.addLink("eth0")
+			expectClassCb("eth0", "", ifacemonitor.ClassHost)
+			dp.expectAddrStateCb("eth0", "", true)
+			nl.addLink("cali1234")
+			expectClassCb("cali1234", "", ifacemonitor.ClassWorkload)
+			dp.expectAddrStateCb("cali1234", "", true)
+			nl.addLinkNoSignal("br0")
+			nl.linksMutex.Lock()
+			br := nl.links["br0"]
+			br.linkType = "bridge"
+			nl.links["br0"] = br
+			nl.linksMutex.Unlock()
+			nl.signalLink("br0", 0)
+			expectClassCb("br0", "", ifacemonitor.ClassHost)
+			dp.expectAddrStateCb("br0", "", true)
+
+			// The class is attached to subsequent updates.
+			nl.changeLinkState("cali1234", "up")
+			Expect(dp.expectInfoCb("cali1234", ifacemonitor.StateUp).Class).To(Equal(ifacemonitor.ClassWorkload))
+			dp.expectLinkStateCb("cali1234", ifacemonitor.StateUp, nl.links["cali1234"].index)
+			data, err := im.Snapshot()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).To(ContainSubstring(`"name":"cali1234","id":2,"up":true,"class":"workload"`))
+
+			// Enslaving eth0 to the bridge reclassifies it, and so does freeing it.
+			nl.setMaster("eth0", "br0")
+			expectClassCb("eth0", ifacemonitor.ClassHost, ifacemonitor.ClassIgnore)
+			nl.setMaster("eth0", "")
+			expectClassCb("eth0", ifacemonitor.ClassIgnore, ifacemonitor.ClassHost)
+
+			// Updates that don't change the inputs don't rerun the classifier.
+			nl.changeLinkMTU("eth0", 9000)
+			Consistently(dp.classC, "50ms", "5ms").ShouldNot(Receive())
+
+			nl.delLink("eth0")
+			expectClassCb("eth0", ifacemonitor.ClassHost, "")
+			dp.expectAddrStateCb("eth0", "", false)
+		})
+
+		Describe("with filtered subscribers", func() {
+			subscribe := func(filter ifacemonitor.SubscriberFilter) (chan string, func()) {
+				c := make(chan string, 10)
+				unsubscribe := im.AddSubscriber(ifacemonitor.Subscriber{
+					Filter: filter,
+					StateCallback: func(ifaceName string, state ifacemonitor.State, ifIndex int) {
+						c <- fmt.Sprintf("%s %s", ifaceName, state)
+					},
+					AddrCallback: func(ifaceName string, addrs set.Set) {
+						if addrs == nil {
+							c <- fmt.Sprintf("%s gone", ifaceName)
+							return
+						}
+						c <- fmt.Sprintf("%s addrs=%v", ifaceName, addrs.Len())
+					},
+				})
+				return c, unsubscribe
+			}
+			expectSubUpdates := func(c chan string, updates ...string) {
+				for _, upd := range updates {
+					EventuallyWithOffset(1, c).Should(Receive(Equal(upd)))
+				}
+				ConsistentlyWithOffset(1, c, "50ms", "5ms").ShouldNot(Receive())
+			}
+
+			It("should only send matching updates to each subscriber", func() {
+				eth0Idx := nl.nextIndex
+				nl.addLink("eth0")
+				expectClassCb("eth0", "", ifacemonitor.ClassHost)
+				dp.expectAddrStateCb("eth0", "", true)
+				nl.changeLinkState("eth0", "up")
+				dp.expectInfoCb("eth0", ifacemonitor.StateUp)
+				dp.expectLinkStateCb("eth0", ifacemonitor.StateUp, eth0Idx)
+				nl.addLink("cali1")
+				expectClassCb("cali1", "", ifacemonitor.ClassWorkload)
+				dp.expectAddrStateCb("cali1", "", true)
+				nl.changeLinkState("cali1", "up")
+				dp.expectInfoCb("cali1", ifacemonitor.StateUp)
+				dp.expectLinkStateCb("cali1", ifacemonitor.StateUp, nl.links["cali1"].index)
+
+				// The current state is replayed to each subscriber.
+				workloadC, unsubscribeWorkloads := subscribe(ifacemonitor.SubscriberFilter{
+					NameRegexp: regexp.MustCompile("^cali"),
+				})
+				expectSubUpdates(workloadC, "cali1 up", "cali1 addrs=0")
+				hostC, _ := subscribe(ifacemonitor.SubscriberFilter{
+					Classes: []ifacemonitor.InterfaceClass{ifacemonitor.ClassHost},
+				})
+				expectSubUpdates(hostC, "eth0 up", "eth0 addrs=0")
+
+				// New interfaces only go to the matching subscriber.
+				nl.addLink("cali2")
+				expectClassCb("cali2", "", ifacemonitor.ClassWorkload)
+				dp.expectAddrStateCb("cali2", "", true)
+				expectSubUpdates(workloadC, "cali2 addrs=0")
+				expectSubUpdates(hostC)
+				nl.addAddr("eth0", "10.0.0.1/32")
+				dp.expectAddrStateCb("eth0", "10.0.0.1", true)
+				expectSubUpdates(hostC, "eth0 addrs=1")
+				expectSubUpdates(workloadC)
+
+				// Enslaving eth0 to a bridge reclassifies it so, as far as the host subscriber
+				// is concerned, it goes away.
+				nl.addLinkNoSignal("br0")
+				nl.linksMutex.Lock()
+				br := nl.links["br0"]
+				br.linkType = "bridge"
+				nl.links["br0"] = br
+				nl.linksMutex.Unlock()
+				nl.signalLink("br0", 0)
+				expectClassCb("br0", "", ifacemonitor.ClassHost)
+				dp.expectAddrStateCb("br0", "", true)
+				expectSubUpdates(hostC, "br0 addrs=0")
+				nl.setMaster("eth0", "br0")
+				expectClassCb("eth0", ifacemonitor.ClassHost, ifacemonitor.ClassIgnore)
+				expectSubUpdates(hostC, "eth0 down", "eth0 gone")
+				expectSubUpdates(workloadC)
+
+				// Freeing it brings it back.
+				nl.setMaster("eth0", "")
+				expectClassCb("eth0", ifacemonitor.ClassIgnore, ifacemonitor.ClassHost)
+				expectSubUpdates(hostC, "eth0 up", "eth0 addrs=1")
+
+				// No more updates after unsubscribing.
+				unsubscribeWorkloads()
+				nl.delLink("cali2")
+				expectClassCb("cali2", ifacemonitor.ClassWorkload, "")
+				dp.expectAddrStateCb("cali2", "", false)
+				expectSubUpdates(workloadC)
+				expectSubUpdates(hostC)
+			})
+		})
+
+		Describe("that looks at the master's kind", func() {
+			BeforeEach(func() {
+				classifier = ifacemonitor.NewRulesClassifier([]ifacemonitor.ClassifierRule{
+					{MasterKind: "bridge", Class: ifacemonitor.ClassIgnore},
+				}, ifacemonitor.ClassHost)
+			})
+
+			It("should reclassify slaves when the master appears and goes away", func() {
+				nl.addLinkNoSignal("eth0")
+				nl.linksMutex.Lock()
+				brIdx := nl.nextIndex
+				nl.nextIndex++
+				eth0 := nl.links["eth0"]
+				eth0.masterIndex = brIdx
+				nl.links["eth0"] = eth0
+				nl.links["br0"] = linkModel{index: brIdx, state: "up", linkType: "bridge", addrs: set.New()}
+				nl.linksMutex.Unlock()
+
+				// Slave first; we don't know its master's kind yet.
+				nl.signalLink("eth0", 0)
+				expectClassCb("eth0", "", ifacemonitor.ClassHost)
+				dp.expectAddrStateCb("eth0", "", true)
+
+				nl.signalLink("br0", 0)
+				var upds []classUpdate
+				for i := 0; i < 2; i++ {
+					var upd classUpdate
+					Eventually(dp.classC).Should(Receive(&upd))
+					upds = append(upds, upd)
+				}
+				Expect(upds).To(ConsistOf(
+					classUpdate{name: "br0", newClass: ifacemonitor.ClassHost},
+					classUpdate{name: "eth0", oldClass: ifacemonitor.ClassHost, newClass: ifacemonitor.ClassIgnore},
+				))
+
+				nl.delLink("br0")
+				upds = nil
+				for i := 0; i < 2; i++ {
+					var upd classUpdate
+					Eventually(dp.classC).Should(Receive(&upd))
+					upds = append(upds, upd)
+				}
+				Expect(upds).To(ConsistOf(
+					classUpdate{name: "br0", oldClass: ifacemonitor.ClassHost},
+					classUpdate{name: "eth0", oldClass: ifacemonitor.ClassIgnore, newClass: ifacemonitor.ClassHost},
+				))
+			})
+		})
+	})
+
+	Describe("with SR-IOV VFs", func() {
+		BeforeEach(func() {
+			dp.vfsC = make(chan vfsUpdate, 1)
+		})
+
+		vf := func(id int, state uint32, mac byte) netlink.VfInfo {
+			return netlink.VfInfo{
+				ID:        id,
+				LinkState: state,
+				Mac:       net.HardwareAddr{0x02, 0, 0, 0, 0, mac},
+				Spoofchk:  true,
+			}
+		}
+		vfInfo := func(id int, state ifacemonitor.VFLinkState, mac string) ifacemonitor.VFInfo {
+			return ifacemonitor.VFInfo{ID: id, MAC: mac, LinkState: state, SpoofCheck: true}
 		}
 
-		// Repeat test for second interface exclude entry
-		netlinkUpdates("veth1")
+		It("should track VF state changes on resync", func() {
+			nl.addLinkNoSignal("ens1f0")
+			nl.setVFsNoSignal("ens1f0",
+				vf(2, 0, 0x12),
+				vf(0, 1, 0x10),
+				vf(1, 2, 0x11),
+			)
+			resyncC <- time.Time{}
+			dp.expectAddrStateCb("ens1f0", "", true)
+			Eventually(dp.vfsC).Should(Receive(Equal(vfsUpdate{
+				name: "ens1f0",
+				vfs: []ifacemonitor.VFInfo{
+					vfInfo(0, ifacemonitor.VFLinkStateEnable, "02:00:00:00:00:10"),
+					vfInfo(1, ifacemonitor.VFLinkStateDisable, "02:00:00:00:00:11"),
+					vfInfo(2, ifacemonitor.VFLinkStateAuto, "02:00:00:00:00:12"),
+				},
+			})))
+
+			// No change, no callback.
+			resyncC <- time.Time{}
+			Consistently(dp.vfsC, "50ms", "5ms").ShouldNot(Receive())
+
+			// Enable VF 1.  Link notifications don't carry the VFs so we only spot it on
+			// resync.
+			nl.setVFsNoSignal("ens1f0",
+				vf(0, 1, 0x10),
+				vf(1, 1, 0x11),
+				vf(2, 0, 0x12),
+			)
+			nl.changeLinkMTU("ens1f0", 9000)
+			Consistently(dp.vfsC, "50ms", "5ms").ShouldNot(Receive())
+			resyncC <- time.Time{}
+			Eventually(dp.vfsC).Should(Receive(Equal(vfsUpdate{
+				name: "ens1f0",
+				vfs: []ifacemonitor.VFInfo{
+					vfInfo(0, ifacemonitor.VFLinkStateEnable, "02:00:00:00:00:10"),
+					vfInfo(1, ifacemonitor.VFLinkStateEnable, "02:00:00:00:00:11"),
+					vfInfo(2, ifacemonitor.VFLinkStateAuto, "02:00:00:00:00:12"),
+				},
+			})))
+
+			// Change VF 2's MAC.
+			nl.setVFsNoSignal("ens1f0",
+				vf(0, 1, 0x10),
+				vf(1, 1, 0x11),
+				vf(2, 0, 0x22),
+			)
+			resyncC <- time.Time{}
+			var update vfsUpdate
+			Eventually(dp.vfsC).Should(Receive(&update))
+			Expect(update.vfs[2].MAC).To(Equal("02:00:00:00:00:22"))
+
+			data, err := im.Snapshot()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).To(ContainSubstring(
+				`"vfs":[{"id":0,"mac":"02:00:00:00:00:10","link_state":1,"spoof_check":true},`))
+
+			// Removing the PF clears its VFs.
+			nl.delLink("ens1f0")
+			dp.expectAddrStateCb("ens1f0", "", false)
+			Eventually(dp.vfsC).Should(Receive(Equal(vfsUpdate{
+				name: "ens1f0",
+				vfs:  []ifacemonitor.VFInfo{},
+			})))
+		})
+
+		It("should not report interfaces without VFs", func() {
+			nl.addLink("eth0")
+			resyncC <- time.Time{}
+			dp.expectAddrStateCb("eth0", "", true)
+			nl.delLink("eth0")
+			dp.expectAddrStateCb("eth0", "", false)
+			Consistently(dp.vfsC, "50ms", "5ms").ShouldNot(Receive())
+		})
+	})
+	Describe("with bonds", func() {
+		BeforeEach(func() {
+			dp.bondC = make(chan bondUpdate, 1)
+		})
+
+		It("should report failover exactly once per change", func() {
+			nl.addLink("eth0")
+			dp.expectAddrStateCb("eth0", "", true)
+			nl.addLink("eth1")
+			dp.expectAddrStateCb("eth1", "", true)
+			nl.addLink("bond0")
+			dp.expectAddrStateCb("bond0", "", true)
+			Consistently(dp.bondC, "50ms", "5ms").ShouldNot(Receive())
+
+			nl.setBondActiveSlave("bond0", "eth0")
+			Eventually(dp.bondC).Should(Receive(Equal(bondUpdate{bond: "bond0", newSlave: "eth0"})))
+			Consistently(dp.bondC, "50ms", "5ms").ShouldNot(Receive())
+
+			// Failover.
+			nl.setBondActiveSlave("bond0", "eth1")
+			Eventually(dp.bondC).Should(Receive(Equal(bondUpdate{bond: "bond0", oldSlave: "eth0", newSlave: "eth1"})))
+			Consistently(dp.bondC, "50ms", "5ms").ShouldNot(Receive())
+
+			// Repeated updates and resyncs don't re-notify.
+			nl.setBondActiveSlave("bond0", "eth1")
+			resyncC <- time.Time{}
+			Consistently(dp.bondC, "50ms", "5ms").ShouldNot(Receive())
+
+			// All links down.
+			nl.setBondActiveSlave("bond0", "")
+			Eventually(dp.bondC).Should(Receive(Equal(bondUpdate{bond: "bond0", oldSlave: "eth1"})))
+
+			// And back again.
+			nl.setBondActiveSlave("bond0", "eth0")
+			Eventually(dp.bondC).Should(Receive(Equal(bondUpdate{bond: "bond0", newSlave: "eth0"})))
+			Consistently(dp.bondC, "50ms", "5ms").ShouldNot(Receive())
+		})
 
-		// Repeat test for third interface exclude entry
-		netlinkUpdates("0dummy1")
+		It("should defer the notification until the slave is known", func() {
+			nl.addLinkNoSignal("bond0")
+			nl.linksMutex.Lock()
+			bond := nl.links["bond0"]
+			bond.linkType = "bond"
+			bond.activeSlave = nl.nextIndex
+			nl.links["bond0"] = bond
+			nl.linksMutex.Unlock()
+			nl.signalLink("bond0", 0)
+			dp.expectAddrStateCb("bond0", "", true)
+			Consistently(dp.bondC, "50ms", "5ms").ShouldNot(Receive())
+
+			nl.addLink("eth0")
+			Eventually(dp.bondC).Should(Receive(Equal(bondUpdate{bond: "bond0", newSlave: "eth0"})))
+			dp.expectAddrStateCb("eth0", "", true)
+		})
 	})
+	Describe("kernel capabilities", func() {
+		Context("with a kernel that reports operstate and supports strict checking", func() {
+			BeforeEach(func() {
+				nl.capabilities.StrictCheck = true
+				nl.addLinkNoSignal("lo")
+				nl.setLinkOperState("lo", netlink.OperUp)
+			})
+
+			It("should detect the capabilities", func() {
+				Eventually(func() bool {
+					_, known := im.Capabilities()
+					return known
+				}).Should(BeTrue())
+				caps, _ := im.Capabilities()
+				Expect(caps).To(Equal(ifacemonitor.KernelCapabilities{
+					OperState:   true,
+					StrictCheck: true,
+				}))
+			})
+		})
 
-	It("should handle mainline netlink updates", func() {
-		// Add a link and an address.  No link callback expected because the link is not up
-		// yet.  But we do get an address callback because those are independent of link
-		// state.  (Note that if the monitor's initial resync runs slowly enough, it might
-		// see the new link and addr as part of that resync - whereas normally what happens
-		// is that the resync completes as a no-op first, and the addLink causes a
-		// notification afterwards.  But either way we expect to get the same callbacks to
-		// the dataplane, so we don't need to distinguish between these two possibilities.
-		idx := nl.nextIndex
-		nl.addLink("eth0")
-		resyncC <- time.Time{}
-		dp.expectAddrStateCb("eth0", "", true)
-		nl.addAddr("eth0", "10.0.240.10/24")
-		dp.expectAddrStateCb("eth0", "10.0.240.10", true)
-
-		// Set the link up, and expect a link callback.  Addresses are unchanged, so there
-		// is no address callback.
-		nl.changeLinkState("eth0", "up")
-		dp.expectLinkStateCb("eth0", ifacemonitor.StateUp, idx)
-
-		// Add an address.
-		nl.addAddr("eth0", "172.19.34.1/27")
-		dp.expectAddrStateCb("eth0", "172.19.34.1", true)
-
-		// Delete that address.
-		nl.delAddr("eth0", "172.19.34.1/27")
-		dp.expectAddrStateCb("eth0", "172.19.34.1", false)
-
-		// Add address again.
-		nl.addAddr("eth0", "172.19.34.1/27")
-		dp.expectAddrStateCb("eth0", "172.19.34.1", true)
-
-		// Delete an address that wasn't actually there - no callback.
-		nl.delAddr("eth0", "8.8.8.8/32")
-
-		// Set link down.
-		nl.changeLinkState("eth0", "down")
-		dp.expectLinkStateCb("eth0", ifacemonitor.StateDown, idx)
-
-		// Set link up again.
-		nl.changeLinkState("eth0", "up")
-		dp.expectLinkStateCb("eth0", ifacemonitor.StateUp, idx)
-
-		// Test when a deleted link is detected in a resync.  The monitor should report
-		// "Spotted interface removal on resync" and make link and address callbacks
-		// accordingly.
-		nl.delLinkNoSignal("eth0")
-		resyncC <- time.Time{}
-		dp.expectLinkStateCb("eth0", ifacemonitor.StateDown, idx)
-		dp.expectAddrStateCb("eth0", "", false)
-
-		// Trigger another resync.  Nothing is expected.  We ensure that the resync
-		// processing completes, before exiting from this test, by sending a further resync
-		// trigger.  (This would block if the interface monitor's main loop was not yet
-		// ready to read it.)
-		resyncC <- time.Time{}
-		resyncC <- time.Time{}
+		Context("with an old kernel", func() {
+			BeforeEach(func() {
+				nl.ignoreRouteFilters = true
+			})
+
+			It("should detect the lack of capabilities", func() {
+				Eventually(func() bool {
+					_, known := im.Capabilities()
+					return known
+				}).Should(BeTrue())
+				caps, _ := im.Capabilities()
+				Expect(caps).To(Equal(ifacemonitor.KernelCapabilities{}))
+			})
+
+			It("should ignore the operstate", func() {
+				idx := nl.nextIndex
+				nl.addLinkNoSignal("eth0")
+				nl.setLinkOperState("eth0", netlink.OperDormant)
+				nl.changeLinkState("eth0", "up")
+				dp.expectLinkStateCb("eth0", ifacemonitor.StateUp, idx)
+				dp.expectAddrStateCb("eth0", "", true)
+			})
+
+			It("should filter out other interfaces' routes", func() {
+				nl.addLink("eth0")
+				resyncC <- time.Time{}
+				dp.expectAddrStateCb("eth0", "", true)
+				nl.addAddr("eth0", "10.0.240.10/24")
+				dp.expectAddrStateCb("eth0", "10.0.240.10", true)
+
+				// The kernel would return eth0's route when listing eth1's.
+				nl.addLink("eth1")
+				dp.expectAddrStateCb("eth1", "10.0.240.10", false)
+			})
+		})
 	})
+	Describe("snapshot and restore", func() {
+		It("should only notify changes made since the snapshot", func() {
+			idx := nl.nextIndex
+			nl.addLink("eth0")
+			resyncC <- time.Time{}
+			dp.expectAddrStateCb("eth0", "", true)
+			nl.addAddr("eth0", "10.0.240.10/24")
+			dp.expectAddrStateCb("eth0", "10.0.240.10", true)
+			nl.changeLinkState("eth0", "up")
+			dp.expectLinkStateCb("eth0", ifacemonitor.StateUp, idx)
+			nl.addLink("eth1")
+			dp.expectAddrStateCb("eth1", "", true)
+
+			data, err := im.Snapshot()
+			Expect(err).NotTo(HaveOccurred())
+
+			// Simulate a restart, with some changes while we weren't running.
+			nl2 := nl.clone()
+			nl2.delLinkNoSignal("eth1")
+			nl2.links["eth0"].addrs.Add("10.0.240.11/24")
+
+			resyncC2 := make(chan time.Time)
+			im2 := ifacemonitor.NewWithStubs(config, nl2, resyncC2, ifacemonitor.WithMonitorTimeShim(mockTime))
+			im2.StateCallback = dp.linkStateCallback
+			im2.AddrCallback = dp.addrStateCallback
+			Expect(im2.Restore(data)).To(Succeed())
+			go im2.MonitorInterfaces()
+			<-nl2.userSubscribed
+
+			// Removals are handled first.
+			dp.expectAddrStateCb("eth1", "", false)
+			dp.expectAddrStateCb("eth0", "10.0.240.11", true)
+			dp.notExpectLinkStateCb()
 
-	It("should handle an interface rename", func() {
-		defer log.Info("Exiting...")
-		// Add a link and an address.  No link callback expected because the link is not up
-		// yet.  But we do get an address callback because those are independent of link
-		// state.  (Note that if the monitor's initial resync runs slowly enough, it might
-		// see the new link and addr as part of that resync - whereas normally what happens
-		// is that the resync completes as a no-op first, and the addLink causes a
-		// notification afterwards.  But either way we expect to get the same callbacks to
-		// the dataplane, so we don't need to distinguish between these two possibilities.
-		idx := nl.nextIndex
-		nl.addLink("eth0")
-		resyncC <- time.Time{}
-		dp.expectAddrStateCb("eth0", "", true)
-		nl.addAddr("eth0", "10.0.240.10/24")
-		dp.expectAddrStateCb("eth0", "10.0.240.10", true)
-
-		// Set the link up, and expect a link callback.  Addresses are unchanged, so there
-		// is no address callback.
-		nl.changeLinkState("eth0", "up")
-		dp.expectLinkStateCb("eth0", ifacemonitor.StateUp, idx)
-
-		// Rename the interface, address and old name should be signalled as gone.
-		nl.renameLink("eth0", "eth1")
-		dp.expectLinkStateCb("eth0", ifacemonitor.StateDown, idx)
-		dp.expectAddrStateCb("eth0", "10.0.240.10", false)
-		dp.expectLinkStateCb("eth1", ifacemonitor.StateUp, idx)
-		dp.expectAddrStateCb("eth1", "10.0.240.10", true)
-
-		// Trigger another resync.  Nothing is expected.  We ensure that the resync
-		// processing completes, before exiting from this test, by sending a further resync
-		// trigger.  (This would block if the interface monitor's main loop was not yet
-		// ready to read it.)
-		resyncC <- time.Time{}
-		resyncC <- time.Time{}
+			// Another resync should be a no-op.
+			resyncC2 <- time.Time{}
+			dp.notExpectAddrStateCb()
+			dp.notExpectLinkStateCb()
+		})
+
+		Describe("with a state file", func() {
+			var stateDir string
+			var unchangedC chan string
+
+			BeforeEach(func() {
+				var err error
+				stateDir, err = ioutil.TempDir("", "ifacemonitor")
+				Expect(err).NotTo(HaveOccurred())
+				config.StateFile = filepath.Join(stateDir, "state.json")
+				config.StateFileWriteInterval = 30 * time.Second
+				unchangedC = make(chan string, 10)
+			})
+
+			AfterEach(func() {
+				_ = os.RemoveAll(stateDir)
+			})
+
+			// restart starts a new monitor on a copy of the fake kernel, as if Felix had
+			// restarted.
+			restart := func() *netlinkTest {
+				nl2 := nl.clone()
+				im2 := ifacemonitor.NewWithStubs(config, nl2, make(chan time.Time), ifacemonitor.WithMonitorTimeShim(mockTime))
+				im2.StateCallback = dp.linkStateCallback
+				im2.AddrCallback = dp.addrStateCallback
+				im2.UnchangedIfaceCallback = func(ifaceName string, state ifacemonitor.State, ifIndex int, addrs set.Set) {
+					var addrList []string
+					addrs.Iter(func(item interface{}) error {
+						addrList = append(addrList, item.(string))
+						return nil
+					})
+					sort.Strings(addrList)
+					unchangedC <- fmt.Sprintf("%s %s %d %v", ifaceName, state, ifIndex, addrList)
+				}
+				go im2.MonitorInterfaces()
+				<-nl2.userSubscribed
+				return nl2
+			}
+
+			setUpIfaces := func() {
+				nl.addLink("eth0")
+				resyncC <- time.Time{}
+				dp.expectAddrStateCb("eth0", "", true)
+				nl.addAddr("eth0", "10.0.240.10/24")
+				dp.expectAddrStateCb("eth0", "10.0.240.10", true)
+				nl.changeLinkState("eth0", "up")
+				dp.expectLinkStateCb("eth0", ifacemonitor.StateUp, 10)
+				nl.addLink("eth1")
+				dp.expectAddrStateCb("eth1", "", true)
+			}
+
+			It("should save the state periodically and on shutdown", func() {
+				mockTime.IncrementTime(30 * time.Second)
+				Eventually(config.StateFile).Should(BeAnExistingFile())
+				data, err := ioutil.ReadFile(config.StateFile)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(data)).NotTo(ContainSubstring("eth0"))
+
+				setUpIfaces()
+				im.Stop()
+				Eventually(func() string {
+					data, _ := ioutil.ReadFile(config.StateFile)
+					return string(data)
+				}).Should(ContainSubstring(`"name":"eth0"`))
+			})
+
+			It("should only mark unchanged interfaces after a clean restart", func() {
+				setUpIfaces()
+				im.Stop()
+				Eventually(func() string {
+					data, _ := ioutil.ReadFile(config.StateFile)
+					return string(data)
+				}).Should(ContainSubstring(`"name":"eth1"`))
+
+				restart()
+				Eventually(unchangedC).Should(Receive(Equal("eth0 up 10 [10.0.240.10]")))
+				Eventually(unchangedC).Should(Receive(Equal("eth1 down 11 []")))
+				dp.notExpectLinkStateCb()
+				dp.notExpectAddrStateCb()
+				Consistently(unchangedC, "50ms", "5ms").ShouldNot(Receive())
+			})
+
+			It("should only notify changes made while stopped", func() {
+				setUpIfaces()
+				im.Stop()
+				Eventually(func() string {
+					data, _ := ioutil.ReadFile(config.StateFile)
+					return string(data)
+				}).Should(ContainSubstring(`"name":"eth1"`))
+
+				nl.delLinkNoSignal("eth1")
+				restart()
+				dp.expectAddrStateCb("eth1", "", false)
+				Eventually(unchangedC).Should(Receive(HavePrefix("eth0 up 10")))
+				dp.notExpectLinkStateCb()
+				Consistently(unchangedC, "50ms", "5ms").ShouldNot(Receive())
+			})
+
+			It("should ignore a stale state file", func() {
+				setUpIfaces()
+				im.Stop()
+				Eventually(func() string {
+					data, _ := ioutil.ReadFile(config.StateFile)
+					return string(data)
+				}).Should(ContainSubstring(`"name":"eth1"`))
+
+				mockTime.IncrementTime(11 * time.Minute)
+				restart()
+				dp.expectLinkStateCb("eth0", ifacemonitor.StateUp, 10)
+				Consistently(unchangedC, "50ms", "5ms").ShouldNot(Receive())
+			})
+
+			It("should ignore a corrupt state file", func() {
+				setUpIfaces()
+				im.Stop()
+				Eventually(config.StateFile).Should(BeAnExistingFile())
+				Expect(ioutil.WriteFile(config.StateFile, []byte(`{"written_at": "garbage`), 0600)).To(Succeed())
+
+				restart()
+				dp.expectLinkStateCb("eth0", ifacemonitor.StateUp, 10)
+				Consistently(unchangedC, "50ms", "5ms").ShouldNot(Receive())
+			})
+		})
+
+		It("should reject snapshots that it doesn't understand", func() {
+			im2 := ifacemonitor.NewWithStubs(config, nl, resyncC)
+			Expect(im2.Restore([]byte(`{"version": 99}`))).To(MatchError(ContainSubstring("version 99")))
+			Expect(im2.Restore([]byte(`garbage`))).NotTo(Succeed())
+		})
+
+		It("should refuse to restore while running", func() {
+			data, err := im.Snapshot()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(im.Restore(data)).NotTo(Succeed())
+		})
+
+		Describe("once the main loop has exited", func() {
+			// snapshotAsync takes a snapshot on another goroutine so that a hang fails the
+			// test rather than blocking it.
+			snapshotAsync := func(im *ifacemonitor.InterfaceMonitor) chan []byte {
+				dataC := make(chan []byte, 1)
+				go func() {
+					defer GinkgoRecover()
+					data, err := im.Snapshot()
+					Expect(err).NotTo(HaveOccurred())
+					dataC <- data
+				}()
+				return dataC
+			}
+
+			It("should return the final state after Stop", func() {
+				nl2 := nl.clone()
+				setLinkNoSignal(nl2, "eth0", "up", "10.0.240.10/32")
+				im2 := ifacemonitor.NewWithStubs(config, nl2, make(chan time.Time))
+				recorder2 := testutils.NewRecorder()
+				recorder2.Attach(im2)
+				errC := make(chan error, 1)
+				go func() {
+					errC <- im2.Run()
+				}()
+				<-nl2.userSubscribed
+				recorder2.ExpectAddrs("eth0", "10.0.240.10")
+				im2.Stop()
+				Eventually(errC).Should(Receive(BeNil()))
+
+				var data []byte
+				Eventually(snapshotAsync(im2)).Should(Receive(&data))
+				Expect(string(data)).To(ContainSubstring(`"eth0"`))
+			})
+
+			It("should not hang after Run has failed", func() {
+				nl2 := nl.clone()
+				nl2.subscribeErr = syscall.EPERM
+				im2 := ifacemonitor.NewWithStubs(config, nl2, make(chan time.Time))
+				Expect(im2.Run()).NotTo(Succeed())
+
+				Eventually(snapshotAsync(im2)).Should(Receive())
+			})
+		})
 	})
+	Describe("with veths", func() {
+		BeforeEach(func() {
+			dp.infoC = make(chan ifacemonitor.InterfaceInfo, 1)
+		})
+
+		It("should report the veth peer", func() {
+			caliIdx := nl.nextIndex
+			peerIdx := caliIdx + 1
+			nl.addVethPairNoSignal("cali1234", "peer1234")
+			nl.signalLink("peer1234", 0)
+			dp.expectAddrStateCb("peer1234", "", true)
+			nl.signalLink("cali1234", 0)
+			dp.expectAddrStateCb("cali1234", "", true)
+
+			nl.changeLinkState("cali1234", "up")
+			dp.expectLinkStateCb("cali1234", ifacemonitor.StateUp, caliIdx)
+			info := dp.expectInfoCb("cali1234", ifacemonitor.StateUp)
+			Expect(info.VethPeer).To(Equal(&ifacemonitor.VethPeer{Index: peerIdx, Name: "peer1234"}))
+			Expect(info.Kind).To(Equal("veth"))
+
+			// Move the peer to another namespace.  From our point of view, it's deleted
+			// and the cali end keeps the peer index.
+			nl.delLink("peer1234")
+			dp.expectAddrStateCb("peer1234", "", false)
+
+			nl.changeLinkState("cali1234", "down")
+			dp.expectLinkStateCb("cali1234", ifacemonitor.StateDown, caliIdx)
+			info = dp.expectInfoCb("cali1234", ifacemonitor.StateDown)
+			Expect(info.VethPeer).To(Equal(&ifacemonitor.VethPeer{Index: peerIdx, InOtherNetns: true}))
+			Expect(info.VethPeer.String()).To(Equal(fmt.Sprintf("peer index %d in other netns", peerIdx)))
+
+			data, err := im.Snapshot()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).To(ContainSubstring(`"veth_peer":{"index":%d,"in_other_netns":true}`, peerIdx))
+		})
 
-	It("should handle link flap", func() {
-		// Add a link and an address.
-		idx := nl.nextIndex
-		nl.addLink("eth0")
-		resyncC <- time.Time{}
-		dp.expectAddrStateCb("eth0", "", true)
-		nl.addAddr("eth0", "10.0.240.10/24")
-		dp.expectAddrStateCb("eth0", "10.0.240.10", true)
-
-		// Set the link up, and expect a link callback.  Addresses are unchanged, so there
-		// is no address callback.
-		nl.changeLinkState("eth0", "up")
-		dp.expectLinkStateCb("eth0", ifacemonitor.StateUp, idx)
-
-		// Delete the link, and have that picked up by resync.  For this scenario we have to
-		// assume that there is never any Netlink signal for the link deletion.
-		_ = nl.delLinkNoSignal("eth0")
-		resyncC <- time.Time{}
-		dp.expectLinkStateCb("eth0", ifacemonitor.StateDown, idx)
-		dp.expectAddrStateCb("eth0", "", false)
-
-		// Add the link again, with the same ifIndex, but hold the signal through Netlink.
-		nl.nextIndex--
-		nl.addLinkNoSignal("eth0")
-		// Add the address, and let that go through Netlink.
-		nl.addAddr("eth0", "10.0.240.10/24")
-		// Now signal the link.
-		nl.signalLink("eth0", 0)
-
-		// Now we should see an address callback again.
-		dp.expectAddrStateCb("eth0", "10.0.240.10", true)
+		It("should not resolve a peer index that belongs to another namespace", func() {
+			// A host interface that happens to have the same index as the pod end.
+			hostIdx := nl.nextIndex
+			nl.addLink("eth0")
+			resyncC <- time.Time{}
+			dp.expectAddrStateCb("eth0", "", true)
+
+			caliIdx := nl.nextIndex
+			nl.addLinkNoSignal("cali1234")
+			nl.linksMutex.Lock()
+			link := nl.links["cali1234"]
+			link.linkType = "veth"
+			link.parentIndex = hostIdx
+			nl.links["cali1234"] = link
+			nl.linksMutex.Unlock()
+			nl.changeLinkState("cali1234", "up")
+			dp.expectLinkStateCb("cali1234", ifacemonitor.StateUp, caliIdx)
+			dp.expectAddrStateCb("cali1234", "", true)
+			info := dp.expectInfoCb("cali1234", ifacemonitor.StateUp)
+			Expect(info.VethPeer).To(Equal(&ifacemonitor.VethPeer{Index: hostIdx, InOtherNetns: true}))
+		})
 	})
 })
@@ -0,0 +1,103 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/timeshim/mocktime"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("In-sync callback", func() {
+	var nl *netlinkTest
+	var resyncC chan time.Time
+	var im *ifacemonitor.InterfaceMonitor
+	var updates chan string
+
+	start := func(config ifacemonitor.Config) {
+		updates = make(chan string, 100)
+		im, nl, _ = startMonitor(config, func(nl *netlinkTest, im *ifacemonitor.InterfaceMonitor) {
+			setLinkNoSignal(nl, "eth0", "up", "10.0.0.1/32", "10.0.0.2/32")
+			setLinkNoSignal(nl, "eth1", "down")
+			im.StateCallback = func(ifaceName string, state ifacemonitor.State, ifIndex int) {
+				updates <- fmt.Sprintf("%s %s", ifaceName, state)
+			}
+			im.AddrCallback = func(ifaceName string, addrs set.Set) {
+				updates <- fmt.Sprintf("%s addrs=%d", ifaceName, addrs.Len())
+			}
+			im.InSyncCallback = func() {
+				updates <- "in sync"
+			}
+		}, withResyncC(resyncC), withMonitorOps(ifacemonitor.WithMonitorTimeShim(mocktime.New())))
+	}
+
+	// receiveUntilInSync returns the updates before the in-sync callback, sorted since the
+	// start-of-day resync reports the interfaces in no particular order.
+	receiveUntilInSync := func() []string {
+		var received []string
+		for {
+			var update string
+			Eventually(updates).Should(Receive(&update))
+			if update == "in sync" {
+				sort.Strings(received)
+				return received
+			}
+			received = append(received, update)
+		}
+	}
+
+	BeforeEach(func() {
+		resyncC = make(chan time.Time)
+	})
+
+	AfterEach(func() {
+		im.Stop()
+	})
+
+	It("should be called once, after the initial notifications", func() {
+		start(ifacemonitor.Config{})
+		Expect(receiveUntilInSync()).To(Equal([]string{
+			"eth0 addrs=2",
+			"eth0 up",
+			"eth1 addrs=0",
+		}))
+
+		// Not again on a later resync or update.
+		nl.addLink("eth2")
+		Eventually(updates).Should(Receive(Equal("eth2 addrs=0")))
+		resyncC <- time.Time{}
+		resyncC <- time.Time{}
+		Consistently(updates, "50ms", "5ms").ShouldNot(Receive())
+	})
+
+	It("should follow the notifications that are held for a batch", func() {
+		start(ifacemonitor.Config{BatchDelay: time.Minute})
+		Expect(receiveUntilInSync()).To(Equal([]string{
+			"eth0 addrs=2",
+			"eth0 up",
+			"eth1 addrs=0",
+		}))
+	})
+})
@@ -0,0 +1,152 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"bytes"
+	"net"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// changeMaskAll is the ifi_change value that the kernel uses for newly-created links and for
+// messages where it doesn't know what changed.
+const changeMaskAll = 0xffffffff
+
+// stateFlagsMask is the set of IFF_* flags that feed into our interface state calculation.  A
+// link update whose change mask doesn't intersect these flags can't change the interface's
+// state.
+const stateFlagsMask = syscall.IFF_UP | syscall.IFF_RUNNING | iffLowerUp | iffDormant
+
+// LinkAttrsDelta describes a change to the subset of link attributes that the monitor tracks.
+type LinkAttrsDelta struct {
+	// ChangedFlags is the set of IFF_* flags that changed.  When an interface is first seen,
+	// all bits are set, following the kernel's convention for newly-created links.
+	ChangedFlags uint32
+	RawFlags     uint32
+
+	MTUChanged bool
+	MTU        int
+
+	HardwareAddrChanged bool
+	HardwareAddr        net.HardwareAddr
+
+	// ProtodownChanged and Protodown are only set if Config.TrackProtodown is enabled.
+	ProtodownChanged bool
+	Protodown        bool
+}
+
+func (d *LinkAttrsDelta) isEmpty() bool {
+	return d.ChangedFlags == 0 && !d.MTUChanged && !d.HardwareAddrChanged && !d.ProtodownChanged
+}
+
+type LinkAttrsCallback func(ifaceName string, ifIndex int, delta LinkAttrsDelta)
+
+// trackedLinkAttrs holds the last-seen values of the link attributes that we report deltas for.
+// We deliberately don't store the whole netlink.Link.
+type trackedLinkAttrs struct {
+	rawFlags     uint32
+	mtu          int
+	hardwareAddr net.HardwareAddr
+	protodown    bool
+	operState    netlink.LinkOperState
+}
+
+// changeMaskIsPrecise returns true if the ifi_change mask from an RTM_NEWLINK tells us exactly
+// which flags changed.  The kernel only sends a partial mask for pure flag changes; changes to
+// other attributes (MTU, MAC, etc.) arrive with a zero mask, and new links with all bits set.
+// In those cases, we fall back to comparing against our stored attributes.
+func changeMaskIsPrecise(changeMask uint32) bool {
+	return changeMask != 0 && changeMask != changeMaskAll
+}
+
+// canSkipLinkUpdate returns true if the change mask on a link update tells us that nothing
+// that affects the interface's state changed, so there's no need to recalculate state or
+// re-list the interface's addresses.
+func (m *InterfaceMonitor) canSkipLinkUpdate(attrs *netlink.LinkAttrs, changeMask uint32) bool {
+	if !changeMaskIsPrecise(changeMask) {
+		return false
+	}
+	if changeMask&stateFlagsMask != 0 {
+		return false
+	}
+	if name, known := m.ifaceName[attrs.Index]; !known || name != attrs.Name {
+		// New or renamed interface; needs full processing.
+		return false
+	}
+	if _, known := m.linkAttrs[attrs.Index]; !known {
+		return false
+	}
+	return true
+}
+
+// storeAndNotifyLinkAttrs updates our stored link attributes for the given link and, if they
+// changed, calls the LinkAttrsCallback.  If the change mask is precise, it is trusted in
+// preference to comparing the flags and the MTU and MAC are known to be unchanged.  The
+// protodown state isn't part of the netlink attributes so it is passed in separately.
+func (m *InterfaceMonitor) storeAndNotifyLinkAttrs(
+	ifaceName string,
+	attrs *netlink.LinkAttrs,
+	protodown bool,
+	changeMask uint32,
+) {
+	ifIndex := attrs.Index
+	old, known := m.linkAttrs[ifIndex]
+	var delta LinkAttrsDelta
+	if !known {
+		delta.ChangedFlags = changeMaskAll
+		delta.MTUChanged = true
+		delta.HardwareAddrChanged = true
+		delta.ProtodownChanged = m.TrackProtodown
+	} else if changeMaskIsPrecise(changeMask) {
+		delta.ChangedFlags = changeMask
+	} else {
+		delta.ChangedFlags = old.rawFlags ^ attrs.RawFlags
+		delta.MTUChanged = old.mtu != attrs.MTU
+		delta.HardwareAddrChanged = !bytes.Equal(old.hardwareAddr, attrs.HardwareAddr)
+	}
+	if known && old.protodown != protodown {
+		delta.ProtodownChanged = true
+	}
+	// The oper state isn't part of the delta, so it's stored even if nothing else changed.
+	m.linkAttrs[ifIndex] = trackedLinkAttrs{
+		rawFlags:     attrs.RawFlags,
+		mtu:          attrs.MTU,
+		hardwareAddr: attrs.HardwareAddr,
+		protodown:    protodown,
+		operState:    attrs.OperState,
+	}
+	if delta.isEmpty() {
+		return
+	}
+
+	delta.RawFlags = attrs.RawFlags
+	delta.MTU = attrs.MTU
+	delta.HardwareAddr = attrs.HardwareAddr
+	delta.Protodown = protodown
+
+	if m.LinkAttrsCallback == nil || m.isExcludedInterface(ifaceName) {
+		return
+	}
+	log.WithFields(log.Fields{
+		"ifaceName": ifaceName,
+		"delta":     delta,
+	}).Debug("Link attributes changed")
+	m.LinkAttrsCallback(ifaceName, ifIndex, delta)
+}
@@ -0,0 +1,37 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ifacemonitor
+
+import (
+	"net"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+// zoneLinkLocalAddrs returns a copy of addrs in which the IPv6 link-local addresses have the
+// interface name as their zone, for example "fe80::1%eth0".  Addresses that already have a
+// zone are left alone.
+func zoneLinkLocalAddrs(ifaceName string, addrs set.Set) set.Set {
+	zoned := set.New()
+	addrs.Iter(func(item interface{}) error {
+		addr := item.(string)
+		if ip := net.ParseIP(addr); ip != nil && ip.To4() == nil && ip.IsLinkLocalUnicast() {
+			addr = addr + "%" + ifaceName
+		}
+		zoned.Add(addr)
+		return nil
+	})
+	return zoned
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"time"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ifacemonitor/testutils"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Link-local address zones", func() {
+	var nl *netlinkTest
+	var resyncC chan time.Time
+	var im *ifacemonitor.InterfaceMonitor
+	var recorder *testutils.Recorder
+
+	start := func(config ifacemonitor.Config) {
+		resyncC = make(chan time.Time)
+		im, nl, recorder = startMonitor(config, func(nl *netlinkTest, im *ifacemonitor.InterfaceMonitor) {
+			setLinkNoSignal(nl, "eth0", "up", "10.0.0.1/32", "fe80::1/128")
+		}, withResyncC(resyncC))
+	}
+
+	AfterEach(func() {
+		im.Stop()
+	})
+
+	It("should report bare link-local addresses by default", func() {
+		start(ifacemonitor.Config{})
+		recorder.ExpectSequence(
+			testutils.StateEvent("eth0", ifacemonitor.StateUp),
+			testutils.AddrsEvent("eth0", "10.0.0.1", "fe80::1"),
+		)
+		nl.addAddr("eth0", "fe80::2/128")
+		recorder.ExpectSequence(testutils.AddrsEvent("eth0", "10.0.0.1", "fe80::1", "fe80::2"))
+	})
+
+	It("should add the zone to link-local addresses, if configured", func() {
+		start(ifacemonitor.Config{LinkLocalAddrZones: true})
+		recorder.ExpectSequence(
+			testutils.StateEvent("eth0", ifacemonitor.StateUp),
+			testutils.AddrsEvent("eth0", "10.0.0.1", "fe80::1%eth0"),
+		)
+		nl.addAddr("eth0", "fe80::2/128")
+		recorder.ExpectSequence(testutils.AddrsEvent("eth0", "10.0.0.1", "fe80::1%eth0", "fe80::2%eth0"))
+		nl.delAddr("eth0", "fe80::1/128")
+		recorder.ExpectSequence(testutils.AddrsEvent("eth0", "10.0.0.1", "fe80::2%eth0"))
+
+		// A resync finds the same addresses, so there's nothing to report.
+		resyncC <- time.Now()
+		resyncC <- time.Now()
+		recorder.ExpectNoNewEvents()
+		Expect(im.Interfaces()[0].Addrs).To(Equal([]string{"10.0.0.1", "fe80::2%eth0"}))
+	})
+
+	It("should move the zone to the new name when an interface is renamed", func() {
+		start(ifacemonitor.Config{LinkLocalAddrZones: true})
+		recorder.ExpectAddrs("eth0", "10.0.0.1", "fe80::1%eth0")
+		recorder.NewEvents()
+
+		nl.renameLink("eth0", "eth1")
+		recorder.ExpectSequence(
+			testutils.AddrsGoneEvent("eth0"),
+			testutils.StateEvent("eth0", ifacemonitor.StateDown),
+			testutils.StateEvent("eth1", ifacemonitor.StateUp),
+			testutils.AddrsEvent("eth1", "10.0.0.1", "fe80::1%eth1"),
+		)
+		nl.addAddr("eth1", "fe80::2/128")
+		recorder.ExpectSequence(testutils.AddrsEvent("eth1", "10.0.0.1", "fe80::1%eth1", "fe80::2%eth1"))
+	})
+})
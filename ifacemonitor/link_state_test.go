@@ -0,0 +1,63 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+// The flags from linux/if.h that the syscall package doesn't have.
+const (
+	iffLowerUp = 0x10000
+	iffDormant = 0x20000
+)
+
+var _ = DescribeTable("StateFromFlags",
+	func(rawFlags uint32, expected ifacemonitor.State) {
+		Expect(ifacemonitor.StateFromFlags(rawFlags)).To(Equal(expected))
+	},
+	Entry("no flags", uint32(0), ifacemonitor.State(ifacemonitor.StateAdminDown)),
+	Entry("up, not running", uint32(syscall.IFF_UP), ifacemonitor.State(ifacemonitor.StateNoCarrier)),
+	Entry("up and running", uint32(syscall.IFF_UP|syscall.IFF_RUNNING), ifacemonitor.State(ifacemonitor.StateUp)),
+	Entry("up, running and lower up", uint32(syscall.IFF_UP|syscall.IFF_RUNNING|iffLowerUp), ifacemonitor.State(ifacemonitor.StateUp)),
+	Entry("up and dormant", uint32(syscall.IFF_UP|iffDormant), ifacemonitor.State(ifacemonitor.StateNoCarrier)),
+	Entry("up, lower up but not running", uint32(syscall.IFF_UP|iffLowerUp), ifacemonitor.State(ifacemonitor.StateNoCarrier)),
+	Entry("disabled with other flags", uint32(syscall.IFF_BROADCAST|syscall.IFF_MULTICAST), ifacemonitor.State(ifacemonitor.StateAdminDown)),
+	// Only the oper state counts for StateUp, so this is up too.
+	Entry("running but not up", uint32(syscall.IFF_RUNNING), ifacemonitor.State(ifacemonitor.StateUp)),
+)
+
+var _ = DescribeTable("StateFromOperState",
+	func(rawFlags uint32, operState netlink.LinkOperState, expected ifacemonitor.State) {
+		Expect(ifacemonitor.StateFromOperState(rawFlags, operState)).To(Equal(expected))
+	},
+	Entry("lower layer down", uint32(syscall.IFF_UP), netlink.LinkOperState(netlink.OperLowerLayerDown), ifacemonitor.State(ifacemonitor.StateLowerLayerDown)),
+	Entry("dormant", uint32(syscall.IFF_UP|iffDormant|iffLowerUp), netlink.LinkOperState(netlink.OperDormant), ifacemonitor.State(ifacemonitor.StateDormant)),
+	Entry("not present", uint32(syscall.IFF_UP), netlink.LinkOperState(netlink.OperNotPresent), ifacemonitor.State(ifacemonitor.StateMissingComponent)),
+	Entry("down", uint32(syscall.IFF_UP), netlink.LinkOperState(netlink.OperDown), ifacemonitor.State(ifacemonitor.StateNoCarrier)),
+	Entry("unknown", uint32(syscall.IFF_UP), netlink.LinkOperState(netlink.OperUnknown), ifacemonitor.State(ifacemonitor.StateNoCarrier)),
+	// The flags take precedence: the oper state only says why an interface has no carrier.
+	Entry("disabled", uint32(0), netlink.LinkOperState(netlink.OperLowerLayerDown), ifacemonitor.State(ifacemonitor.StateAdminDown)),
+	Entry("up and running", uint32(syscall.IFF_UP|syscall.IFF_RUNNING), netlink.LinkOperState(netlink.OperUp), ifacemonitor.State(ifacemonitor.StateUp)),
+)
@@ -0,0 +1,145 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// MasterStateCallback is called when the effective state of a master (a bridge or bond, or any
+// other interface with members) changes, along with its current members.  A master can be
+// oper-up while all its members are down, in which case it can't carry any traffic, so its
+// effective state is only up if it is up and at least one of its members is up.  See
+// Config.EmptyMasterDown for masters with no members.
+type MasterStateCallback func(masterName string, effectiveState State, members []string)
+
+// storeMasterKind records whether a link is a bridge or bond, so that we treat it as a master
+// even when it has no members.
+func (m *InterfaceMonitor) storeMasterKind(link netlink.Link) {
+	switch link.Type() {
+	case "bridge", "bond":
+		m.masterIdxs[link.Attrs().Index] = true
+	default:
+		delete(m.masterIdxs, link.Attrs().Index)
+	}
+}
+
+// masterMembers returns the indexes of the known members of each master.
+func (m *InterfaceMonitor) masterMembers() map[int][]int {
+	members := map[int][]int{}
+	for ifIndex := range m.masterIdxs {
+		members[ifIndex] = nil
+	}
+	for memberIdx, masterIdx := range m.linkMasters {
+		if _, known := m.ifaceName[memberIdx]; known {
+			members[masterIdx] = append(members[masterIdx], memberIdx)
+		}
+	}
+	return members
+}
+
+func (m *InterfaceMonitor) isUpIdx(ifIndex int) bool {
+	upIdx, up := m.upIfaces[m.ifaceName[ifIndex]]
+	return up && upIdx == ifIndex
+}
+
+// masterEffectiveState derives the effective state of a master from its own state and its
+// members'.
+func (m *InterfaceMonitor) masterEffectiveState(ifIndex int, memberIdxs []int) State {
+	if !m.isUpIdx(ifIndex) {
+		return StateDown
+	}
+	if len(memberIdxs) == 0 {
+		if m.EmptyMasterDown {
+			return StateDown
+		}
+		return StateUp
+	}
+	for _, memberIdx := range memberIdxs {
+		if m.isUpIdx(memberIdx) {
+			return StateUp
+		}
+	}
+	return StateDown
+}
+
+func (m *InterfaceMonitor) memberNames(memberIdxs []int) []string {
+	var names []string
+	for _, memberIdx := range memberIdxs {
+		names = append(names, m.ifaceName[memberIdx])
+	}
+	sort.Strings(names)
+	return names
+}
+
+// refreshMasterStates re-derives the effective states of all the masters and notifies any that
+// changed.  Called after each link update, so that changes to the masters' and members' states
+// and to membership are all picked up, and after each resync.  Does nothing on hosts without
+// masters.
+func (m *InterfaceMonitor) refreshMasterStates() {
+	if len(m.masterIdxs) == 0 && len(m.linkMasters) == 0 && len(m.masterStates) == 0 {
+		return
+	}
+	members := m.masterMembers()
+	for ifIndex := range m.masterStates {
+		if _, isMaster := members[ifIndex]; !isMaster {
+			// Gone or no longer a master; don't notify since the consumer knows that from
+			// the interface's own state.
+			delete(m.masterStates, ifIndex)
+		}
+	}
+	for ifIndex, memberIdxs := range members {
+		ifaceName, known := m.ifaceName[ifIndex]
+		if !known {
+			// Members of a master that we haven't heard about (yet).
+			continue
+		}
+		state := m.masterEffectiveState(ifIndex, memberIdxs)
+		if m.masterStates[ifIndex] == state {
+			continue
+		}
+		m.masterStates[ifIndex] = state
+		memberNames := m.memberNames(memberIdxs)
+		log.WithFields(log.Fields{
+			"ifaceName":      ifaceName,
+			"effectiveState": state,
+			"members":        memberNames,
+		}).Info("Master's effective state changed.")
+		if m.MasterStateCallback != nil && !m.isExcludedInterface(ifaceName) {
+			m.MasterStateCallback(ifaceName, state, memberNames)
+		}
+	}
+}
+
+// masterInfo returns the effective state and members of a master, for Interfaces and
+// Snapshot; the state is StateUnknown if the interface isn't a master.
+func (m *InterfaceMonitor) masterInfo(ifIndex int) (State, []string) {
+	state, isMaster := m.masterStates[ifIndex]
+	if !isMaster {
+		return StateUnknown, nil
+	}
+	var memberIdxs []int
+	for memberIdx, masterIdx := range m.linkMasters {
+		if _, known := m.ifaceName[memberIdx]; known && masterIdx == ifIndex {
+			memberIdxs = append(memberIdxs, memberIdx)
+		}
+	}
+	return state, m.memberNames(memberIdxs)
+}
@@ -0,0 +1,155 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ifacemonitor/testutils"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Master effective state", func() {
+	var nl *netlinkTest
+	var config ifacemonitor.Config
+	var im *ifacemonitor.InterfaceMonitor
+	var recorder *testutils.Recorder
+	var lock sync.Mutex
+	var notifications []string
+
+	getNotifications := func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string(nil), notifications...)
+	}
+	// configureLinkNoSignal sets the kind and master of a link.
+	configureLinkNoSignal := func(nl *netlinkTest, name, kind, master string) {
+		nl.linksMutex.Lock()
+		defer nl.linksMutex.Unlock()
+		link := nl.links[name]
+		link.linkType = kind
+		if master != "" {
+			link.masterIndex = nl.links[master].index
+		}
+		nl.links[name] = link
+	}
+	masterStatus := func(name string) string {
+		for _, status := range im.Interfaces() {
+			if status.Name == name {
+				return fmt.Sprintf("%s [%s]", status.EffectiveState, strings.Join(status.Members, " "))
+			}
+		}
+		return ""
+	}
+
+	BeforeEach(func() {
+		config = ifacemonitor.Config{}
+		lock.Lock()
+		notifications = nil
+		lock.Unlock()
+	})
+
+	JustBeforeEach(func() {
+		im, nl, recorder = startMonitor(config, func(nl *netlinkTest, im *ifacemonitor.InterfaceMonitor) {
+			setLinkNoSignal(nl, "br0", "up")
+			setLinkNoSignal(nl, "br1", "up")
+			setLinkNoSignal(nl, "eth1", "up")
+			setLinkNoSignal(nl, "eth2", "down")
+			configureLinkNoSignal(nl, "br0", "bridge", "")
+			configureLinkNoSignal(nl, "br1", "bridge", "")
+			configureLinkNoSignal(nl, "eth1", "", "br0")
+			configureLinkNoSignal(nl, "eth2", "", "br0")
+			im.MasterStateCallback = func(masterName string, effectiveState ifacemonitor.State, members []string) {
+				lock.Lock()
+				defer lock.Unlock()
+				notifications = append(notifications,
+					fmt.Sprintf("%s %s [%s]", masterName, effectiveState, strings.Join(members, " ")))
+			}
+		})
+		recorder.ExpectState("eth1", ifacemonitor.StateUp)
+	})
+
+	AfterEach(func() {
+		im.Stop()
+	})
+
+	It("should track the last member going down and the first coming up", func() {
+		Eventually(getNotifications).Should(ConsistOf("br0 up [eth1 eth2]", "br1 up []"))
+		Expect(masterStatus("br0")).To(Equal("up [eth1 eth2]"))
+		Expect(masterStatus("eth1")).To(Equal(" []"))
+
+		nl.changeLinkState("eth1", "down")
+		Eventually(getNotifications).Should(HaveLen(3))
+		Expect(getNotifications()[2]).To(Equal("br0 down [eth1 eth2]"))
+
+		nl.changeLinkState("eth2", "up")
+		Eventually(getNotifications).Should(HaveLen(4))
+		Expect(getNotifications()[3]).To(Equal("br0 up [eth1 eth2]"))
+
+		// Another member coming up doesn't change anything.
+		nl.changeLinkState("eth1", "up")
+		recorder.ExpectState("eth1", ifacemonitor.StateUp)
+		Expect(getNotifications()).To(HaveLen(4))
+
+		// The master going down does.
+		nl.changeLinkState("br0", "down")
+		Eventually(getNotifications).Should(HaveLen(5))
+		Expect(getNotifications()[4]).To(Equal("br0 down [eth1 eth2]"))
+	})
+
+	It("should track members migrating between masters", func() {
+		Eventually(getNotifications).Should(HaveLen(2))
+
+		nl.setMaster("eth1", "br1")
+		Eventually(getNotifications).Should(HaveLen(3))
+		// br1's effective state doesn't change, since it was up without any members.
+		Expect(getNotifications()[2]).To(Equal("br0 down [eth2]"))
+		Expect(masterStatus("br1")).To(Equal("up [eth1]"))
+
+		nl.changeLinkState("eth1", "down")
+		Eventually(getNotifications).Should(HaveLen(4))
+		Expect(getNotifications()[3]).To(Equal("br1 down [eth1]"))
+
+		nl.setMaster("eth1", "br0")
+		Eventually(getNotifications).Should(HaveLen(5))
+		Expect(getNotifications()[4]).To(Equal("br1 up []"))
+		Expect(masterStatus("br0")).To(Equal("down [eth1 eth2]"))
+
+		nl.delLink("eth2")
+		Eventually(func() string { return masterStatus("br0") }).Should(Equal("down [eth1]"))
+		Expect(getNotifications()).To(HaveLen(5))
+	})
+
+	Context("with EmptyMasterDown", func() {
+		BeforeEach(func() {
+			config.EmptyMasterDown = true
+		})
+
+		It("should report masters without members as down", func() {
+			Eventually(getNotifications).Should(ConsistOf("br0 up [eth1 eth2]", "br1 down []"))
+
+			nl.setMaster("eth1", "br1")
+			Eventually(getNotifications).Should(HaveLen(4))
+			Expect(getNotifications()[2:]).To(ConsistOf("br0 down [eth2]", "br1 up [eth1]"))
+		})
+	})
+})
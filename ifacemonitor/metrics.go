@@ -0,0 +1,258 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	cprometheus "github.com/projectcalico/libcalico-go/lib/prometheus"
+)
+
+// monitorMetrics are a monitor's Prometheus collectors.  Each monitor has its own, which are
+// only registered if Config.Registerer is set.  Monitors that share a Registerer share the
+// collectors that the first of them registered: their counters add up and, since each monitor
+// only adds its share to the gauges, the gauges are the totals across the monitors.
+type monitorMetrics struct {
+	sysfsStateDiscrepancies     *prometheus.CounterVec
+	notifications               *prometheus.CounterVec
+	callbackGiveUps             prometheus.Counter
+	middlewarePanics            prometheus.Counter
+	canaryResults               *prometheus.CounterVec
+	unclaimedIfaces             gaugeShare
+	duplicateMACs               gaugeShare
+	upIfacesMatching            gaugeVecShare
+	addrCountThresholdCrossings prometheus.Counter
+	missingExpectedIfaces       gaugeShare
+	coalescedUpdates            prometheus.Counter
+	resyncFailures              prometheus.Counter
+	linkUpdates                 prometheus.Counter
+	addrUpdates                 prometheus.Counter
+	resyncs                     prometheus.Counter
+	resyncTime                  prometheus.Summary
+	upIfaces                    gaugeShare
+	addrs                       gaugeShare
+	resubscribes                prometheus.Counter
+}
+
+func newMonitorMetrics(registerer prometheus.Registerer) *monitorMetrics {
+	mm := &monitorMetrics{
+		sysfsStateDiscrepancies: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "felix_iface_monitor_sysfs_state_discrepancies",
+			Help: "Number of times the interface oper state from netlink disagreed with /sys/class/net, by origin.",
+		}, []string{"origin"}),
+		notifications: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "felix_iface_monitor_notifications",
+			Help: "Number of state and address notifications made, by type and origin.",
+		}, []string{"type", "origin"}),
+		callbackGiveUps: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "felix_iface_monitor_callback_give_ups",
+			Help: "Number of notifications that were dropped after the callback failed too many times.",
+		}),
+		middlewarePanics: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "felix_iface_monitor_middleware_panics",
+			Help: "Number of times that a middleware panicked and was skipped.",
+		}),
+		canaryResults: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "felix_iface_monitor_canary_results",
+			Help: "Number of interface monitor self-tests, by result.",
+		}, []string{"result"}),
+		unclaimedIfaces: gaugeShare{gauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "felix_iface_monitor_unclaimed_ifaces",
+			Help: "Number of workload interfaces that have been unclaimed for longer than the grace period.",
+		})},
+		duplicateMACs: gaugeShare{gauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "felix_iface_monitor_duplicate_macs",
+			Help: "Number of MAC addresses that are shared by unrelated interfaces.",
+		})},
+		upIfacesMatching: gaugeVecShare{
+			vec: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+				Name: "felix_iface_monitor_up_ifaces_matching",
+				Help: "Number of up interfaces that match each watched pattern.",
+			}, []string{"watch"}),
+			values: map[string]float64{},
+		},
+		addrCountThresholdCrossings: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "felix_iface_monitor_addr_count_threshold_crossings",
+			Help: "Number of times an interface's address count has crossed the threshold.",
+		}),
+		missingExpectedIfaces: gaugeShare{gauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "felix_iface_monitor_missing_expected_ifaces",
+			Help: "Number of expected interfaces that are missing or down.",
+		})},
+		coalescedUpdates: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "felix_iface_monitor_coalesced_updates",
+			Help: "Number of address updates that were skipped because a later update in the same batch cancelled them out.",
+		}),
+		resyncFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "felix_iface_monitor_resync_failures",
+			Help: "Number of periodic resyncs that failed.",
+		}),
+		linkUpdates: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "felix_iface_monitor_link_updates",
+			Help: "Number of netlink link updates processed.",
+		}),
+		addrUpdates: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "felix_iface_monitor_addr_updates",
+			Help: "Number of netlink address updates processed.",
+		}),
+		resyncs: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "felix_iface_monitor_resyncs",
+			Help: "Number of resyncs run, including failed ones.",
+		}),
+		resyncTime: cprometheus.NewSummary(prometheus.SummaryOpts{
+			Name: "felix_iface_monitor_resync_seconds",
+			Help: "Time taken to list the interfaces and their addresses during a resync.",
+		}),
+		upIfaces: gaugeShare{gauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "felix_iface_monitor_up_ifaces",
+			Help: "Number of interfaces that are currently up.",
+		})},
+		addrs: gaugeShare{gauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "felix_iface_monitor_addrs",
+			Help: "Number of addresses that are currently tracked, across all interfaces.",
+		})},
+		resubscribes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "felix_iface_monitor_resubscribes",
+			Help: "Number of times that the netlink subscription was restarted after it failed.",
+		}),
+	}
+	if registerer == nil {
+		// The collectors still count, so that the rest of the monitor doesn't have to check,
+		// but nothing can see them.
+		return mm
+	}
+	mm.sysfsStateDiscrepancies = register(registerer, mm.sysfsStateDiscrepancies).(*prometheus.CounterVec)
+	mm.notifications = register(registerer, mm.notifications).(*prometheus.CounterVec)
+	mm.callbackGiveUps = register(registerer, mm.callbackGiveUps).(prometheus.Counter)
+	mm.middlewarePanics = register(registerer, mm.middlewarePanics).(prometheus.Counter)
+	mm.canaryResults = register(registerer, mm.canaryResults).(*prometheus.CounterVec)
+	mm.unclaimedIfaces.gauge = register(registerer, mm.unclaimedIfaces.gauge).(prometheus.Gauge)
+	mm.duplicateMACs.gauge = register(registerer, mm.duplicateMACs.gauge).(prometheus.Gauge)
+	mm.upIfacesMatching.vec = register(registerer, mm.upIfacesMatching.vec).(*prometheus.GaugeVec)
+	mm.addrCountThresholdCrossings = register(registerer, mm.addrCountThresholdCrossings).(prometheus.Counter)
+	mm.missingExpectedIfaces.gauge = register(registerer, mm.missingExpectedIfaces.gauge).(prometheus.Gauge)
+	mm.coalescedUpdates = register(registerer, mm.coalescedUpdates).(prometheus.Counter)
+	mm.resyncFailures = register(registerer, mm.resyncFailures).(prometheus.Counter)
+	mm.linkUpdates = register(registerer, mm.linkUpdates).(prometheus.Counter)
+	mm.addrUpdates = register(registerer, mm.addrUpdates).(prometheus.Counter)
+	mm.resyncs = register(registerer, mm.resyncs).(prometheus.Counter)
+	mm.resyncTime = register(registerer, mm.resyncTime).(prometheus.Summary)
+	mm.upIfaces.gauge = register(registerer, mm.upIfaces.gauge).(prometheus.Gauge)
+	mm.addrs.gauge = register(registerer, mm.addrs.gauge).(prometheus.Gauge)
+	mm.resubscribes = register(registerer, mm.resubscribes).(prometheus.Counter)
+	return mm
+}
+
+// register registers c, or returns the collector that is already registered in its place,
+// for example by another monitor.
+func register(registerer prometheus.Registerer, c prometheus.Collector) prometheus.Collector {
+	err := registerer.Register(c)
+	if err == nil {
+		return c
+	}
+	if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+		return are.ExistingCollector
+	}
+	log.WithError(err).Panic("Failed to register interface monitor metric.")
+	return nil
+}
+
+// withdrawGauges removes the monitor's shares from the gauges, once it has stopped.
+func (mm *monitorMetrics) withdrawGauges() {
+	mm.unclaimedIfaces.Set(0)
+	mm.duplicateMACs.Set(0)
+	mm.missingExpectedIfaces.Set(0)
+	mm.upIfaces.Set(0)
+	mm.addrs.Set(0)
+	for label := range mm.upIfacesMatching.values {
+		mm.upIfacesMatching.Delete(label)
+	}
+}
+
+// gaugeShare is one monitor's share of a gauge.  Set adds the change in the monitor's value to
+// the gauge, rather than setting it, so that other monitors' shares are kept.
+type gaugeShare struct {
+	gauge prometheus.Gauge
+	value float64
+}
+
+func (g *gaugeShare) Set(value float64) {
+	g.gauge.Add(value - g.value)
+	g.value = value
+}
+
+// gaugeVecShare is gaugeShare for a GaugeVec with a single label.
+type gaugeVecShare struct {
+	vec    *prometheus.GaugeVec
+	values map[string]float64
+}
+
+func (g *gaugeVecShare) Set(label string, value float64) {
+	g.vec.WithLabelValues(label).Add(value - g.values[label])
+	g.values[label] = value
+}
+
+// Delete removes the monitor's share for the label.  The series itself is kept, at the total of
+// the other monitors' shares, since we can't tell whether they have any.
+func (g *gaugeVecShare) Delete(label string) {
+	if value, ok := g.values[label]; ok {
+		g.vec.WithLabelValues(label).Sub(value)
+		delete(g.values, label)
+	}
+}
+
+func (mm *monitorMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		mm.sysfsStateDiscrepancies,
+		mm.callbackGiveUps,
+		mm.middlewarePanics,
+		mm.notifications,
+		mm.canaryResults,
+		mm.unclaimedIfaces.gauge,
+		mm.duplicateMACs.gauge,
+		mm.upIfacesMatching.vec,
+		mm.addrCountThresholdCrossings,
+		mm.missingExpectedIfaces.gauge,
+		mm.coalescedUpdates,
+		mm.resyncFailures,
+		mm.linkUpdates,
+		mm.addrUpdates,
+		mm.resyncs,
+		mm.resyncTime,
+		mm.upIfaces.gauge,
+		mm.addrs.gauge,
+		mm.resubscribes,
+	}
+}
+
+// Collectors returns the monitor's metrics.  They are registered with Config.Registerer, if it's
+// set; a consumer that serves another registry can register them there as well.
+func (m *InterfaceMonitor) Collectors() []prometheus.Collector {
+	return m.metrics.collectors()
+}
+
+// updateAddrsGauge recalculates the number of tracked addresses.  Called after each batch of
+// updates and each resync, rather than on every change, since ifaceAddrs is updated in many
+// places.
+func (m *InterfaceMonitor) updateAddrsGauge() {
+	numAddrs := 0
+	for _, addrs := range m.ifaceAddrs {
+		numAddrs += addrs.Len()
+	}
+	m.metrics.addrs.Set(float64(numAddrs))
+}
@@ -0,0 +1,236 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"regexp"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ifacemonitor/testutils"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Monitor activity metrics", func() {
+	var nl *netlinkTest
+	var resyncC chan time.Time
+	var im *ifacemonitor.InterfaceMonitor
+	var recorder *testutils.Recorder
+	var errC chan error
+	var registry *prometheus.Registry
+
+	metric := func(name string) *dto.Metric {
+		families, err := registry.Gather()
+		Expect(err).NotTo(HaveOccurred())
+		for _, family := range families {
+			if family.GetName() == name {
+				return family.GetMetric()[0]
+			}
+		}
+		Fail("No metric named " + name)
+		return nil
+	}
+	counter := func(name string) float64 {
+		return metric(name).GetCounter().GetValue()
+	}
+	resyncTimings := func() uint64 {
+		return metric("felix_iface_monitor_resync_seconds").GetSummary().GetSampleCount()
+	}
+	upIfaces := func() float64 {
+		return metric("felix_iface_monitor_up_ifaces").GetGauge().GetValue()
+	}
+	numAddrs := func() float64 {
+		return metric("felix_iface_monitor_addrs").GetGauge().GetValue()
+	}
+
+	BeforeEach(func() {
+		resyncC = make(chan time.Time)
+		registry = prometheus.NewRegistry()
+		errC = make(chan error, 1)
+		im, nl, recorder = startMonitor(ifacemonitor.Config{Registerer: registry}, func(nl *netlinkTest, im *ifacemonitor.InterfaceMonitor) {
+			setLinkNoSignal(nl, "eth0", "up", "10.0.0.1/32")
+		}, withResyncC(resyncC), withErrC(errC))
+		recorder.ExpectSequence(
+			testutils.StateEvent("eth0", ifacemonitor.StateUp),
+			testutils.AddrsEvent("eth0", "10.0.0.1"),
+		)
+	})
+
+	AfterEach(func() {
+		im.Stop()
+	})
+
+	It("should count the updates and resyncs that it processes", func() {
+		startLinkUpdates := counter("felix_iface_monitor_link_updates")
+		startAddrUpdates := counter("felix_iface_monitor_addr_updates")
+		startResyncs := counter("felix_iface_monitor_resyncs")
+		startResyncTimings := resyncTimings()
+		startResubscribes := counter("felix_iface_monitor_resubscribes")
+		Expect(upIfaces()).To(Equal(1.0))
+
+		nl.addLink("cali1")
+		recorder.ExpectSequence(testutils.AddrsEvent("cali1"))
+		nl.changeLinkState("cali1", "up")
+		recorder.ExpectSequence(testutils.StateEvent("cali1", ifacemonitor.StateUp))
+		nl.addAddr("cali1", "10.0.0.2/32")
+		recorder.ExpectSequence(testutils.AddrsEvent("cali1", "10.0.0.2"))
+		Expect(counter("felix_iface_monitor_link_updates") - startLinkUpdates).To(Equal(2.0))
+		Expect(counter("felix_iface_monitor_addr_updates") - startAddrUpdates).To(Equal(1.0))
+		Expect(upIfaces()).To(Equal(2.0))
+		Eventually(numAddrs).Should(Equal(2.0))
+
+		resyncC <- time.Time{}
+		Eventually(func() float64 {
+			return counter("felix_iface_monitor_resyncs") - startResyncs
+		}).Should(Equal(1.0))
+		Eventually(resyncTimings).Should(Equal(startResyncTimings + 1))
+
+		// Restarting the subscription resyncs as well.
+		setLinkNoSignal(nl, "eth0", "down", "10.0.0.1/32")
+		close(nl.updates)
+		<-nl.userSubscribed
+		recorder.ExpectSequence(testutils.StateEvent("eth0", ifacemonitor.StateDown))
+		Expect(counter("felix_iface_monitor_resubscribes") - startResubscribes).To(Equal(1.0))
+		Expect(counter("felix_iface_monitor_resyncs") - startResyncs).To(Equal(2.0))
+		Expect(upIfaces()).To(Equal(1.0))
+		Consistently(errC).ShouldNot(Receive())
+	})
+
+	It("should allow the metrics to be registered with another registry", func() {
+		otherRegistry := prometheus.NewRegistry()
+		for _, c := range im.Collectors() {
+			Expect(otherRegistry.Register(c)).To(Succeed())
+		}
+		families, err := otherRegistry.Gather()
+		Expect(err).NotTo(HaveOccurred())
+		var names []string
+		for _, family := range families {
+			names = append(names, family.GetName())
+		}
+		Expect(names).To(ContainElement("felix_iface_monitor_link_updates"))
+		Expect(names).To(ContainElement("felix_iface_monitor_up_ifaces"))
+	})
+
+	It("should not register any metrics without a Registerer", func() {
+		// Only the monitor above has a Registerer, and it has its own registry.
+		unregistered := ifacemonitor.NewWithStubs(ifacemonitor.Config{}, nl, resyncC)
+		Expect(unregistered.Collectors()).NotTo(BeEmpty())
+		families, err := prometheus.DefaultGatherer.Gather()
+		Expect(err).NotTo(HaveOccurred())
+		for _, family := range families {
+			Expect(family.GetName()).NotTo(HavePrefix("felix_iface_monitor_"))
+		}
+	})
+})
+
+var _ = Describe("Metrics of monitors that share a Registerer", func() {
+	var registry *prometheus.Registry
+	var nl1 *netlinkTest
+	var im1, im2 *ifacemonitor.InterfaceMonitor
+	var recorder1, recorder2 *testutils.Recorder
+	var im2DoneC chan struct{}
+
+	gauge := func(name string) float64 {
+		families, err := registry.Gather()
+		Expect(err).NotTo(HaveOccurred())
+		for _, family := range families {
+			if family.GetName() == name {
+				return family.GetMetric()[0].GetGauge().GetValue()
+			}
+		}
+		return 0
+	}
+	counter := func(name string) float64 {
+		families, err := registry.Gather()
+		Expect(err).NotTo(HaveOccurred())
+		for _, family := range families {
+			if family.GetName() == name {
+				return family.GetMetric()[0].GetCounter().GetValue()
+			}
+		}
+		return 0
+	}
+
+	BeforeEach(func() {
+		registry = prometheus.NewRegistry()
+		config := ifacemonitor.Config{Registerer: registry}
+
+		im1, nl1, recorder1 = startMonitor(config, func(nl *netlinkTest, im *ifacemonitor.InterfaceMonitor) {
+			setLinkNoSignal(nl, "eth0", "up", "10.0.0.1/32")
+		})
+		recorder1.ExpectAddrs("eth0", "10.0.0.1")
+
+		im2DoneC = make(chan struct{})
+		im2, _, recorder2 = startMonitor(config, func(nl *netlinkTest, im *ifacemonitor.InterfaceMonitor) {
+			setLinkNoSignal(nl, "eth0", "up", "10.0.1.1/32", "10.0.1.2/32")
+			setLinkNoSignal(nl, "eth1", "up")
+		}, withDoneC(im2DoneC))
+		recorder2.ExpectAddrs("eth0", "10.0.1.1", "10.0.1.2")
+		recorder2.ExpectState("eth1", ifacemonitor.StateUp)
+	})
+
+	AfterEach(func() {
+		im1.Stop()
+		im2.Stop()
+	})
+
+	It("should report the totals across the monitors", func() {
+		Expect(gauge("felix_iface_monitor_up_ifaces")).To(Equal(3.0))
+		Eventually(func() float64 {
+			return gauge("felix_iface_monitor_addrs")
+		}).Should(Equal(3.0))
+		Expect(counter("felix_iface_monitor_resyncs")).To(Equal(2.0))
+
+		nl1.changeLinkState("eth0", "down")
+		recorder1.ExpectState("eth0", ifacemonitor.StateDown)
+		Expect(gauge("felix_iface_monitor_up_ifaces")).To(Equal(2.0))
+		Expect(counter("felix_iface_monitor_link_updates")).To(Equal(1.0))
+	})
+
+	It("should withdraw a monitor's share of the gauges once it stops", func() {
+		Eventually(func() float64 {
+			return gauge("felix_iface_monitor_addrs")
+		}).Should(Equal(3.0))
+		im2.Stop()
+		Eventually(im2DoneC).Should(BeClosed())
+		Expect(gauge("felix_iface_monitor_up_ifaces")).To(Equal(1.0))
+		Expect(gauge("felix_iface_monitor_addrs")).To(Equal(1.0))
+	})
+
+	It("should add up the gauges for a watch in each monitor", func() {
+		watched := func() float64 {
+			families, err := registry.Gather()
+			Expect(err).NotTo(HaveOccurred())
+			for _, family := range families {
+				if family.GetName() == "felix_iface_monitor_up_ifaces_matching" {
+					return family.GetMetric()[0].GetGauge().GetValue()
+				}
+			}
+			return 0
+		}
+		im1.WatchUpCount("eths", regexp.MustCompile("^eth"), func(string, bool) {})
+		im2.WatchUpCount("eths", regexp.MustCompile("^eth"), func(string, bool) {})
+		Expect(watched()).To(Equal(3.0))
+		im2.UnwatchUpCount("eths")
+		Expect(watched()).To(Equal(1.0))
+	})
+})
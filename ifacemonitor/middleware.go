@@ -0,0 +1,183 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"net"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+// UpdateKind says whether an Update is a state or an address update.
+type UpdateKind string
+
+const (
+	UpdateKindState UpdateKind = "state"
+	UpdateKindAddrs UpdateKind = "addrs"
+)
+
+// Update is a state or address notification on its way to a consumer; see Middleware.
+type Update struct {
+	Kind      UpdateKind
+	IfaceName string
+	IfIndex   int
+	// State is only set for state updates.
+	State State
+	// Addrs is only set for address updates.  nil means that the interface has gone.
+	Addrs  set.Set
+	Origin UpdateOrigin
+}
+
+// Middleware sees each state and address update before it is delivered.  It returns the update
+// to deliver, which may be modified, or false to drop it.  Only changes to IfaceName, State and
+// Addrs take effect.  The update, including its Addrs, is the middleware's own copy.
+//
+// Middleware only affects delivery; the monitor's own view of the interfaces is unchanged.  It is
+// called for each delivery, that is, once for the StateCallback or AddrCallback and once for each
+// subscriber that gets the update, on the monitor's goroutine.  A middleware that drops some of
+// an interface's updates should usually drop all of them, so that the consumer's view stays
+// consistent.  A middleware that panics is skipped: the panic is logged and counted and the
+// update carries on unchanged.
+type Middleware func(upd Update) (Update, bool)
+
+// runMiddleware passes an update through the Middleware chain, in order.
+func (m *InterfaceMonitor) runMiddleware(upd Update) (Update, bool) {
+	for _, mw := range m.Middleware {
+		out, ok, panicked := callMiddleware(mw, upd)
+		if panicked {
+			m.metrics.middlewarePanics.Inc()
+			continue
+		}
+		if !ok {
+			return Update{}, false
+		}
+		upd.IfaceName = out.IfaceName
+		upd.State = out.State
+		upd.Addrs = out.Addrs
+	}
+	return upd, true
+}
+
+func callMiddleware(mw Middleware, upd Update) (out Update, ok, panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.WithFields(log.Fields{
+				"ifaceName": upd.IfaceName,
+				"kind":      upd.Kind,
+				"panic":     r,
+			}).Error("Interface monitor middleware panicked, skipping it.")
+			panicked = true
+		}
+	}()
+	if upd.Addrs != nil {
+		upd.Addrs = upd.Addrs.Copy()
+	}
+	out, ok = mw(upd)
+	return
+}
+
+// stateMiddleware and addrsMiddleware run the Middleware, if any, for a single delivery.
+func (m *InterfaceMonitor) stateMiddleware(ifaceName string, state State, ifIndex int, origin UpdateOrigin) (string, State, bool) {
+	if len(m.Middleware) == 0 {
+		return ifaceName, state, true
+	}
+	upd, ok := m.runMiddleware(Update{
+		Kind:      UpdateKindState,
+		IfaceName: ifaceName,
+		IfIndex:   ifIndex,
+		State:     state,
+		Origin:    origin,
+	})
+	return upd.IfaceName, upd.State, ok
+}
+
+func (m *InterfaceMonitor) addrsMiddleware(ifaceName string, addrs set.Set, ifIndex int, origin UpdateOrigin) (string, set.Set, bool) {
+	if len(m.Middleware) == 0 {
+		return ifaceName, addrs, true
+	}
+	upd, ok := m.runMiddleware(Update{
+		Kind:      UpdateKindAddrs,
+		IfaceName: ifaceName,
+		IfIndex:   ifIndex,
+		Addrs:     addrs,
+		Origin:    origin,
+	})
+	return upd.IfaceName, upd.Addrs, ok
+}
+
+// NamePrefixFilter returns a Middleware that only passes on the updates for interfaces whose
+// names start with one of the given prefixes.
+func NamePrefixFilter(prefixes ...string) Middleware {
+	return func(upd Update) (Update, bool) {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(upd.IfaceName, prefix) {
+				return upd, true
+			}
+		}
+		return upd, false
+	}
+}
+
+// AddrScope is the scope of an address, as reported by "ip addr".
+type AddrScope string
+
+const (
+	AddrScopeGlobal AddrScope = "global"
+	AddrScopeLink   AddrScope = "link"
+	AddrScopeHost   AddrScope = "host"
+)
+
+// addrScope works out the scope of an address from the address itself.
+func addrScope(addr string) AddrScope {
+	if i := strings.IndexByte(addr, '%'); i >= 0 {
+		addr = addr[:i]
+	}
+	ip := net.ParseIP(addr)
+	switch {
+	case ip == nil:
+		return AddrScopeGlobal
+	case ip.IsLoopback():
+		return AddrScopeHost
+	case ip.IsLinkLocalUnicast():
+		return AddrScopeLink
+	}
+	return AddrScopeGlobal
+}
+
+// AddrScopeFilter returns a Middleware that removes the addresses whose scopes aren't listed from
+// address updates.
+func AddrScopeFilter(scopes ...AddrScope) Middleware {
+	keep := map[AddrScope]bool{}
+	for _, scope := range scopes {
+		keep[scope] = true
+	}
+	return func(upd Update) (Update, bool) {
+		if upd.Addrs == nil {
+			return upd, true
+		}
+		upd.Addrs.Iter(func(item interface{}) error {
+			if !keep[addrScope(item.(string))] {
+				return set.RemoveItem
+			}
+			return nil
+		})
+		return upd, true
+	}
+}
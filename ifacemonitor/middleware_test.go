@@ -0,0 +1,128 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"strings"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ifacemonitor/testutils"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Middleware", func() {
+	var nl *netlinkTest
+	var im *ifacemonitor.InterfaceMonitor
+	var recorder *testutils.Recorder
+
+	start := func(middleware ...ifacemonitor.Middleware) {
+		im, nl, recorder = startMonitor(ifacemonitor.Config{}, func(nl *netlinkTest, im *ifacemonitor.InterfaceMonitor) {
+			setLinkNoSignal(nl, "eth0", "up", "10.0.0.1/32", "fe80::1/64")
+			setLinkNoSignal(nl, "cali1", "up", "10.0.1.1/32")
+			im.Middleware = middleware
+		})
+	}
+
+	AfterEach(func() {
+		im.Stop()
+	})
+
+	It("should run the middleware in order", func() {
+		// The second middleware sees the first's changes.
+		start(
+			func(upd ifacemonitor.Update) (ifacemonitor.Update, bool) {
+				upd.IfaceName = strings.ToUpper(upd.IfaceName)
+				return upd, true
+			},
+			func(upd ifacemonitor.Update) (ifacemonitor.Update, bool) {
+				return upd, !strings.HasPrefix(upd.IfaceName, "CALI")
+			},
+		)
+		recorder.ExpectState("ETH0", ifacemonitor.StateUp)
+		recorder.ExpectAddrs("ETH0", "10.0.0.1", "fe80::1")
+		recorder.ExpectNoEventsFor("cali1")
+		recorder.ExpectNoEventsFor("CALI1")
+		recorder.ExpectNoEventsFor("eth0")
+	})
+
+	It("should filter addresses by scope", func() {
+		start(ifacemonitor.AddrScopeFilter(ifacemonitor.AddrScopeGlobal))
+		recorder.ExpectAddrs("eth0", "10.0.0.1")
+
+		nl.addAddr("eth0", "fe80::2/64")
+		nl.addAddr("eth0", "10.0.0.2/32")
+		recorder.ExpectAddrs("eth0", "10.0.0.1", "10.0.0.2")
+
+		// The monitor's own view is unaffected.
+		Eventually(func() []string {
+			for _, status := range im.Interfaces() {
+				if status.Name == "eth0" {
+					return status.Addrs
+				}
+			}
+			return nil
+		}).Should(ConsistOf("10.0.0.1", "10.0.0.2", "fe80::1", "fe80::2"))
+	})
+
+	It("should only affect delivery", func() {
+		start(ifacemonitor.NamePrefixFilter("eth"))
+		recorder.ExpectAddrs("eth0", "10.0.0.1", "fe80::1")
+		recorder.ExpectNoEventsFor("cali1")
+
+		var names []string
+		for _, status := range im.Interfaces() {
+			names = append(names, status.Name)
+		}
+		Expect(names).To(ConsistOf("eth0", "cali1"))
+
+		// Subscribers' snapshots go through the middleware too.
+		subRecorder := testutils.NewRecorder()
+		im.AddSubscriber(ifacemonitor.Subscriber{
+			StateCallback: subRecorder.StateCallback,
+			AddrCallback:  subRecorder.AddrCallback,
+		})
+		subRecorder.ExpectAddrs("eth0", "10.0.0.1", "fe80::1")
+		subRecorder.ExpectNoEventsFor("cali1")
+
+		nl.delLink("cali1")
+		nl.delLink("eth0")
+		recorder.ExpectState("eth0", ifacemonitor.StateDown)
+		subRecorder.ExpectState("eth0", ifacemonitor.StateDown)
+		recorder.ExpectNoEventsFor("cali1")
+		subRecorder.ExpectNoEventsFor("cali1")
+	})
+
+	It("should skip a middleware that panics", func() {
+		start(
+			func(upd ifacemonitor.Update) (ifacemonitor.Update, bool) {
+				if upd.IfaceName == "cali1" {
+					panic("bang")
+				}
+				return upd, true
+			},
+			func(upd ifacemonitor.Update) (ifacemonitor.Update, bool) {
+				upd.IfaceName += "-seen"
+				return upd, true
+			},
+		)
+		recorder.ExpectState("cali1-seen", ifacemonitor.StateUp)
+		recorder.ExpectAddrs("cali1-seen", "10.0.1.1")
+		recorder.ExpectState("eth0-seen", ifacemonitor.StateUp)
+	})
+})
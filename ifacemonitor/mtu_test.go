@@ -0,0 +1,121 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"time"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ifacemonitor/testutils"
+
+	. "github.com/onsi/ginkgo"
+)
+
+var _ = Describe("MTU changes", func() {
+	var nl *netlinkTest
+	var resyncC chan time.Time
+	var im *ifacemonitor.InterfaceMonitor
+	var recorder *testutils.Recorder
+
+	BeforeEach(func() {
+		resyncC = make(chan time.Time)
+		// The callbacks only use this spec's recorder, in case the last spec's monitor is
+		// still shutting down.
+		rec := testutils.NewRecorder()
+		im, nl, recorder = startMonitor(ifacemonitor.Config{}, func(nl *netlinkTest, im *ifacemonitor.InterfaceMonitor) {
+			setLinkNoSignal(nl, "eth0", "up")
+			im.AddrCallback = func(ifaceName string, addrs set.Set) {}
+			im.LinkAttrsCallback = func(ifaceName string, ifIndex int, delta ifacemonitor.LinkAttrsDelta) {
+				if delta.MTUChanged {
+					rec.RecordOther(ifaceName, "attrs mtu=%d", delta.MTU)
+				}
+			}
+			im.InfoCallback = func(info ifacemonitor.InterfaceInfo) {
+				rec.RecordOther(info.Name, "info %s mtu=%d", info.State, info.MTU)
+			}
+		}, withResyncC(resyncC), withRecorder(rec))
+		recorder.ExpectSequence(
+			testutils.OtherEvent("eth0", "attrs mtu=1500"),
+			testutils.StateEvent("eth0", ifacemonitor.StateUp),
+			testutils.OtherEvent("eth0", "info up mtu=1500"),
+		)
+	})
+
+	AfterEach(func() {
+		im.Stop()
+	})
+
+	setMTUNoSignal := func(mtu int) {
+		nl.linksMutex.Lock()
+		defer nl.linksMutex.Unlock()
+		link := nl.links["eth0"]
+		link.mtu = mtu
+		nl.links["eth0"] = link
+	}
+
+	It("should report an MTU change with no state change", func() {
+		nl.changeLinkMTU("eth0", 9000)
+		recorder.ExpectSequence(
+			testutils.OtherEvent("eth0", "attrs mtu=9000"),
+			testutils.OtherEvent("eth0", "info up mtu=9000"),
+		)
+		recorder.ExpectNoNewEvents()
+	})
+
+	It("should report the MTU before the state when both change at once", func() {
+		setMTUNoSignal(9000)
+		nl.changeLinkState("eth0", "down")
+		recorder.ExpectSequence(
+			testutils.OtherEvent("eth0", "attrs mtu=9000"),
+			testutils.StateEvent("eth0", ifacemonitor.StateDown),
+			testutils.OtherEvent("eth0", "info down mtu=9000"),
+		)
+		recorder.ExpectNoNewEvents()
+	})
+
+	It("should track the MTU of a down interface", func() {
+		nl.changeLinkState("eth0", "down")
+		recorder.ExpectSequence(
+			testutils.StateEvent("eth0", ifacemonitor.StateDown),
+			testutils.OtherEvent("eth0", "info down mtu=1500"),
+		)
+		nl.changeLinkMTU("eth0", 1400)
+		recorder.ExpectSequence(
+			testutils.OtherEvent("eth0", "attrs mtu=1400"),
+			testutils.OtherEvent("eth0", "info down mtu=1400"),
+		)
+		nl.changeLinkState("eth0", "up")
+		recorder.ExpectSequence(
+			testutils.StateEvent("eth0", ifacemonitor.StateUp),
+			testutils.OtherEvent("eth0", "info up mtu=1400"),
+		)
+	})
+
+	It("should pick up an MTU change that it only sees on resync", func() {
+		setMTUNoSignal(1400)
+		recorder.ExpectNoNewEvents()
+		resyncC <- time.Time{}
+		recorder.ExpectSequence(
+			testutils.OtherEvent("eth0", "attrs mtu=1400"),
+			testutils.OtherEvent("eth0", "info up mtu=1400"),
+		)
+		resyncC <- time.Time{}
+		recorder.ExpectNoNewEvents()
+	})
+})
@@ -0,0 +1,209 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+type MultiMonitorEventType int
+
+const (
+	// EventTypeState events carry an interface state change (as passed to the StateCallback).
+	EventTypeState MultiMonitorEventType = iota
+	// EventTypeAddrs events carry an interface's addresses (as passed to the AddrCallback).
+	EventTypeAddrs
+	// EventTypeError events report that a namespace's monitor failed.  The namespace has been
+	// removed by the time the event is sent, so it can be added again.
+	EventTypeError
+)
+
+// MultiMonitorEvent is an update from one of the MultiMonitor's per-namespace monitors.
+type MultiMonitorEvent struct {
+	// Namespace identifies the monitor that the event came from.
+	Namespace string
+	Type      MultiMonitorEventType
+	IfaceName string
+
+	// State and IfIndex are set for EventTypeState events.
+	State   State
+	IfIndex int
+
+	// Addrs is set for EventTypeAddrs events; nil if the interface has gone.
+	Addrs set.Set
+
+	// Err is set for EventTypeError events.  It can be passed to IsPermissionError.
+	Err error
+}
+
+// MonitorFactory creates an InterfaceMonitor for the given namespace.  The MultiMonitor sets the
+// monitor's StateCallback and AddrCallback and runs it.
+type MonitorFactory func(namespace string) (*InterfaceMonitor, error)
+
+// MultiMonitor runs an InterfaceMonitor per namespace and merges their updates into a single
+// stream of events, tagged with the namespace.  Namespaces can be added and removed while it's
+// running.
+type MultiMonitor struct {
+	factory MonitorFactory
+	events  chan MultiMonitorEvent
+	stopC   chan struct{}
+
+	lock     sync.Mutex
+	monitors map[string]*InterfaceMonitor
+	stopped  bool
+}
+
+func NewMultiMonitor(factory MonitorFactory) *MultiMonitor {
+	return &MultiMonitor{
+		factory:  factory,
+		events:   make(chan MultiMonitorEvent, 10),
+		stopC:    make(chan struct{}),
+		monitors: map[string]*InterfaceMonitor{},
+	}
+}
+
+// Events returns the merged event stream.  The consumer must keep reading from it; the
+// per-namespace monitors block until their events are read.
+func (mm *MultiMonitor) Events() <-chan MultiMonitorEvent {
+	return mm.events
+}
+
+// AddNamespace creates and starts a monitor for the given namespace.  If the monitor fails, the
+// namespace is removed and the failure is reported as an EventTypeError event.
+func (mm *MultiMonitor) AddNamespace(namespace string) error {
+	mm.lock.Lock()
+	defer mm.lock.Unlock()
+	if mm.stopped {
+		return fmt.Errorf("multi-monitor is stopped")
+	}
+	if _, ok := mm.monitors[namespace]; ok {
+		return fmt.Errorf("already monitoring namespace %q", namespace)
+	}
+	m, err := mm.factory(namespace)
+	if err != nil {
+		return err
+	}
+	m.StateCallback = func(ifaceName string, state State, ifIndex int) {
+		mm.sendEvent(m, MultiMonitorEvent{
+			Namespace: namespace,
+			Type:      EventTypeState,
+			IfaceName: ifaceName,
+			State:     state,
+			IfIndex:   ifIndex,
+		})
+	}
+	m.AddrCallback = func(ifaceName string, addrs set.Set) {
+		mm.sendEvent(m, MultiMonitorEvent{
+			Namespace: namespace,
+			Type:      EventTypeAddrs,
+			IfaceName: ifaceName,
+			Addrs:     addrs,
+		})
+	}
+	mm.monitors[namespace] = m
+	log.WithField("namespace", namespace).Info("Starting interface monitor for namespace.")
+	go mm.runMonitor(namespace, m)
+	return nil
+}
+
+// runMonitor runs a namespace's monitor.  If it fails, it removes the namespace and reports the
+// failure as an event, after the monitor's other events.
+func (mm *MultiMonitor) runMonitor(namespace string, m *InterfaceMonitor) {
+	err := m.Run()
+	if err == nil {
+		// Stopped by RemoveNamespace or Stop.
+		return
+	}
+	logCxt := log.WithField("namespace", namespace)
+	logCxt.WithError(err).Error("Interface monitor for namespace failed.")
+	mm.lock.Lock()
+	current := mm.monitors[namespace] == m
+	if current {
+		m.Stop()
+		delete(mm.monitors, namespace)
+	}
+	mm.lock.Unlock()
+	if !current {
+		// Removed while it was failing, so no-one is interested.
+		return
+	}
+	select {
+	case mm.events <- MultiMonitorEvent{
+		Namespace: namespace,
+		Type:      EventTypeError,
+		Err:       err,
+	}:
+	case <-mm.stopC:
+		logCxt.Debug("Multi-monitor stopped, dropping error event.")
+	}
+}
+
+// sendEvent is called on the sub-monitor's goroutine.  It gives up if the sub-monitor is
+// stopped so that a removed monitor can't get stuck waiting for the consumer.
+func (mm *MultiMonitor) sendEvent(m *InterfaceMonitor, event MultiMonitorEvent) {
+	select {
+	case mm.events <- event:
+	case <-m.stopC:
+		log.WithField("namespace", event.Namespace).Debug("Monitor stopped, dropping event.")
+	}
+}
+
+// RemoveNamespace stops the monitor for the given namespace.  Events that it has already queued
+// may still be delivered.
+func (mm *MultiMonitor) RemoveNamespace(namespace string) {
+	mm.lock.Lock()
+	defer mm.lock.Unlock()
+	m, ok := mm.monitors[namespace]
+	if !ok {
+		return
+	}
+	log.WithField("namespace", namespace).Info("Stopping interface monitor for namespace.")
+	m.Stop()
+	delete(mm.monitors, namespace)
+}
+
+// Namespaces returns the sorted list of namespaces being monitored.
+func (mm *MultiMonitor) Namespaces() []string {
+	mm.lock.Lock()
+	defer mm.lock.Unlock()
+	var namespaces []string
+	for namespace := range mm.monitors {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// Stop stops all the per-namespace monitors.  No more namespaces can be added afterwards.
+func (mm *MultiMonitor) Stop() {
+	mm.lock.Lock()
+	defer mm.lock.Unlock()
+	for namespace, m := range mm.monitors {
+		m.Stop()
+		delete(mm.monitors, namespace)
+	}
+	if !mm.stopped {
+		close(mm.stopC)
+	}
+	mm.stopped = true
+}
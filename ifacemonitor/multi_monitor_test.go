@@ -0,0 +1,180 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"errors"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/timeshim/mocktime"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("MultiMonitor", func() {
+	var mm *ifacemonitor.MultiMonitor
+	var nls map[string]*netlinkTest
+	var nlsLock sync.Mutex
+
+	BeforeEach(func() {
+		nls = map[string]*netlinkTest{}
+		mm = ifacemonitor.NewMultiMonitor(func(namespace string) (*ifacemonitor.InterfaceMonitor, error) {
+			if namespace == "bad" {
+				return nil, errors.New("no such namespace")
+			}
+			nl := &netlinkTest{
+				userSubscribed: make(chan int),
+				nextIndex:      10,
+			}
+			if namespace == "eperm" {
+				nl.subscribeErr = syscall.EPERM
+			}
+			nlsLock.Lock()
+			nls[namespace] = nl
+			nlsLock.Unlock()
+			return ifacemonitor.NewWithStubs(
+				ifacemonitor.Config{},
+				nl,
+				make(chan time.Time),
+				ifacemonitor.WithMonitorTimeShim(mocktime.New()),
+			), nil
+		})
+	})
+
+	AfterEach(func() {
+		mm.Stop()
+	})
+
+	addNamespace := func(namespace string) *netlinkTest {
+		Expect(mm.AddNamespace(namespace)).To(Succeed())
+		nlsLock.Lock()
+		nl := nls[namespace]
+		nlsLock.Unlock()
+		<-nl.userSubscribed
+		return nl
+	}
+
+	// expectEvent reads events until it finds one of the given type, skipping the others.
+	expectEvent := func(eventType ifacemonitor.MultiMonitorEventType) ifacemonitor.MultiMonitorEvent {
+		for {
+			var ev ifacemonitor.MultiMonitorEvent
+			Eventually(mm.Events()).Should(Receive(&ev))
+			if ev.Type == eventType {
+				return ev
+			}
+		}
+	}
+	expectStateEvent := func() ifacemonitor.MultiMonitorEvent {
+		return expectEvent(ifacemonitor.EventTypeState)
+	}
+
+	It("should tag events with the namespace", func() {
+		nl1 := addNamespace("ns1")
+		nl2 := addNamespace("ns2")
+		Expect(mm.Namespaces()).To(Equal([]string{"ns1", "ns2"}))
+
+		idx := nl1.nextIndex
+		nl1.addLinkNoSignal("eth0")
+		nl1.changeLinkState("eth0", "up")
+		Expect(expectStateEvent()).To(Equal(ifacemonitor.MultiMonitorEvent{
+			Namespace: "ns1",
+			Type:      ifacemonitor.EventTypeState,
+			IfaceName: "eth0",
+			State:     ifacemonitor.StateUp,
+			IfIndex:   idx,
+		}))
+
+		idx = nl2.nextIndex
+		nl2.addLinkNoSignal("eth0")
+		nl2.changeLinkState("eth0", "up")
+		Expect(expectStateEvent()).To(Equal(ifacemonitor.MultiMonitorEvent{
+			Namespace: "ns2",
+			Type:      ifacemonitor.EventTypeState,
+			IfaceName: "eth0",
+			State:     ifacemonitor.StateUp,
+			IfIndex:   idx,
+		}))
+	})
+
+	It("should report address events", func() {
+		nl := addNamespace("ns1")
+		nl.addLinkNoSignal("eth0")
+		nl.changeLinkState("eth0", "up")
+		expectStateEvent()
+		nl.addAddr("eth0", "10.0.0.1/32")
+		for {
+			ev := expectEvent(ifacemonitor.EventTypeAddrs)
+			Expect(ev.Namespace).To(Equal("ns1"))
+			Expect(ev.IfaceName).To(Equal("eth0"))
+			if ev.Addrs.Contains("10.0.0.1") {
+				break
+			}
+		}
+	})
+
+	It("should reject duplicate and failed namespaces", func() {
+		addNamespace("ns1")
+		Expect(mm.AddNamespace("ns1")).NotTo(Succeed())
+		Expect(mm.AddNamespace("bad")).NotTo(Succeed())
+		Expect(mm.Namespaces()).To(Equal([]string{"ns1"}))
+	})
+
+	It("should report a failed monitor and remove its namespace", func() {
+		addNamespace("ns1")
+		Expect(mm.AddNamespace("eperm")).To(Succeed())
+		ev := expectEvent(ifacemonitor.EventTypeError)
+		Expect(ev.Namespace).To(Equal("eperm"))
+		Expect(ifacemonitor.IsPermissionError(ev.Err)).To(BeTrue())
+		Expect(mm.Namespaces()).To(Equal([]string{"ns1"}))
+
+		// It can be added again, although here it fails the same way.
+		Expect(mm.AddNamespace("eperm")).To(Succeed())
+		Expect(expectEvent(ifacemonitor.EventTypeError).Namespace).To(Equal("eperm"))
+	})
+
+	It("should stop the monitor when a namespace is removed", func() {
+		nl1 := addNamespace("ns1")
+		nl2 := addNamespace("ns2")
+		mm.RemoveNamespace("ns1")
+		Expect(mm.Namespaces()).To(Equal([]string{"ns2"}))
+		Eventually(nl1.done).Should(BeClosed())
+		Consistently(nl2.done).ShouldNot(BeClosed())
+
+		// The remaining namespace still works.
+		nl2.addLinkNoSignal("eth0")
+		nl2.changeLinkState("eth0", "up")
+		Expect(expectStateEvent().Namespace).To(Equal("ns2"))
+
+		// And the removed one can be re-added.
+		addNamespace("ns1")
+		Expect(mm.Namespaces()).To(Equal([]string{"ns1", "ns2"}))
+	})
+
+	It("should stop all monitors on Stop", func() {
+		nl1 := addNamespace("ns1")
+		nl2 := addNamespace("ns2")
+		mm.Stop()
+		Eventually(nl1.done).Should(BeClosed())
+		Eventually(nl2.done).Should(BeClosed())
+		Expect(mm.Namespaces()).To(BeEmpty())
+		Expect(mm.AddNamespace("ns3")).NotTo(Succeed())
+	})
+})
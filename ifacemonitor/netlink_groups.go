@@ -0,0 +1,77 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// NetlinkGroups is a set of netlink multicast groups for the monitor to subscribe to.
+type NetlinkGroups uint32
+
+const (
+	// NetlinkGroupLink covers link (interface) updates.
+	NetlinkGroupLink NetlinkGroups = 1 << iota
+	// NetlinkGroupRoute covers IPv4 and IPv6 route updates; we track addresses via their local
+	// routes and use the main table to track the default route.
+	NetlinkGroupRoute
+)
+
+// NetlinkUpdate is a link or route update from netlink; exactly one of Link and Route is set.
+// Both kinds of update share a channel so that we see them in the order that the kernel sent
+// them.  Otherwise, for example, we might see an address being added to an interface before we
+// see the interface.
+type NetlinkUpdate struct {
+	Link  *netlink.LinkUpdate
+	Route *netlink.RouteUpdate
+}
+
+func (g NetlinkGroups) String() string {
+	var names []string
+	if g&NetlinkGroupLink != 0 {
+		names = append(names, "link")
+	}
+	if g&NetlinkGroupRoute != 0 {
+		names = append(names, "route")
+	}
+	return "{" + strings.Join(names, ",") + "}"
+}
+
+// netlinkGroups works out which netlink groups we need given our configuration, so that we don't
+// receive (and then discard) updates that we'll never use.
+func (m *InterfaceMonitor) netlinkGroups() NetlinkGroups {
+	groups := NetlinkGroupLink
+	if !m.DisableAddrMonitoring || m.DefaultRouteCallback != nil {
+		groups |= NetlinkGroupRoute
+	}
+	return groups
+}
+
+// subscribe subscribes to the netlink groups that the configuration needs.  The group set is
+// calculated once so that any later subscription uses exactly the same set.
+func (m *InterfaceMonitor) subscribe() (updates chan NetlinkUpdate, err error) {
+	if m.subscribedGroups == 0 {
+		m.subscribedGroups = m.netlinkGroups()
+	}
+	updates = make(chan NetlinkUpdate, 10)
+	log.WithField("groups", m.subscribedGroups).Info("Subscribing to netlink groups.")
+	err = m.netlinkStub.Subscribe(m.subscribedGroups, updates, m.stopC)
+	return
+}
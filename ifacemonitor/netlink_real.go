@@ -12,45 +12,470 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+// +build !darwin
+
 package ifacemonitor
 
 import (
+	"bytes"
+	"errors"
+	"net"
+	"syscall"
+	"time"
+
 	log "github.com/sirupsen/logrus"
 	"github.com/vishvananda/netlink"
+	nlpkg "github.com/vishvananda/netlink/nl"
 	"golang.org/x/sys/unix"
-	//"syscall"
 )
 
+// netlinkReal talks to the kernel in the network namespace ns; by default, the caller's.
 type netlinkReal struct {
+	ns *targetNetns
 }
 
-func (nl *netlinkReal) Subscribe(
-	linkUpdates chan netlink.LinkUpdate,
-	routeUpdates chan netlink.RouteUpdate,
-) error {
-	cancel := make(chan struct{})
-
-	if err := netlink.LinkSubscribe(linkUpdates, cancel); err != nil {
-		log.WithError(err).Panic("Failed to subscribe to link updates")
+// Subscribe opens a single netlink socket for all the groups, rather than using the netlink
+// library's subscriptions, which have a socket (and a channel) each.  That way, the kernel
+// delivers the link and route updates to us in the order that it sent them.
+func (nl *netlinkReal) Subscribe(groups NetlinkGroups, updates chan<- NetlinkUpdate, done <-chan struct{}) error {
+	var mcastGroups uint32
+	if groups&NetlinkGroupLink != 0 {
+		mcastGroups |= unix.RTMGRP_LINK
+	}
+	if groups&NetlinkGroupRoute != 0 {
+		mcastGroups |= unix.RTMGRP_IPV4_ROUTE | unix.RTMGRP_IPV6_ROUTE
+	}
+	if nl.ns != nil {
+		if err := nl.ns.reopen(); err != nil {
+			log.WithError(err).Error("Failed to re-open network namespace")
+			return err
+		}
+	}
+	var fd int
+	err := nl.ns.run(func() (err error) {
+		fd, err = unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+		return
+	})
+	if err != nil {
+		log.WithError(err).Error("Failed to open netlink socket")
 		return err
 	}
-	if err := netlink.RouteSubscribe(routeUpdates, cancel); err != nil {
-		log.WithError(err).Panic("Failed to subscribe to addr updates")
+	// Time out reads so that the receive loop notices when we're done.
+	timeout := unix.NsecToTimeval(netlinkReceiveTimeout.Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeout); err != nil {
+		log.WithError(err).Error("Failed to set netlink socket timeout")
+		_ = unix.Close(fd)
 		return err
 	}
-
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: mcastGroups}); err != nil {
+		log.WithError(err).Error("Failed to subscribe to netlink updates")
+		_ = unix.Close(fd)
+		return err
+	}
+	go receiveNetlinkUpdates(fd, updates, done)
 	return nil
 }
 
-func (nl *netlinkReal) LinkList() ([]netlink.Link, error) {
-	return netlink.LinkList()
+const (
+	netlinkReceiveTimeout    = time.Second
+	netlinkReceiveBufferSize = 65536
+)
+
+// receiveNetlinkUpdates reads updates from the socket until done is closed, when it closes the
+// socket.  If reading fails, it closes updates as well.
+//
+// If the kernel drops updates because the socket's buffer is full, we've no way to tell which
+// ones we missed, so receiveNetlinkUpdates closes updates.  The monitor then re-subscribes and
+// resyncs, which picks up the current state.
+func receiveNetlinkUpdates(fd int, updates chan<- NetlinkUpdate, done <-chan struct{}) {
+	defer func() {
+		_ = unix.Close(fd)
+	}()
+	lostUpdates := func() {
+		log.Warn("Netlink socket overrun, some updates were lost; re-subscribing to resync.")
+		close(updates)
+	}
+	buf := make([]byte, netlinkReceiveBufferSize)
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		n, from, err := unix.Recvfrom(fd, buf, 0)
+		if err == unix.EAGAIN || err == unix.EINTR {
+			continue
+		}
+		if err == unix.ENOBUFS {
+			lostUpdates()
+			return
+		}
+		if err != nil {
+			log.WithError(err).Error("Failed to read netlink updates")
+			close(updates)
+			return
+		}
+		if sa, ok := from.(*unix.SockaddrNetlink); !ok || sa.Pid != 0 {
+			// Not from the kernel.
+			continue
+		}
+		// The parsed updates point into the data (addresses, MACs and so on) and they can
+		// still be queued when we read the next message, so each read gets its own copy.
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		msgs, err := syscall.ParseNetlinkMessage(data)
+		if err != nil {
+			log.WithError(err).Warn("Failed to parse netlink message, ignoring")
+			continue
+		}
+		for _, msg := range msgs {
+			switch msg.Header.Type {
+			case unix.NLMSG_OVERRUN:
+				lostUpdates()
+				return
+			case unix.NLMSG_ERROR:
+				err := netlinkMessageError(msg)
+				if err == unix.ENOBUFS {
+					lostUpdates()
+					return
+				}
+				if err != nil {
+					log.WithError(err).Error("Netlink reported an error on the update socket")
+				}
+				continue
+			}
+			update, err := parseNetlinkUpdate(msg)
+			if err != nil {
+				log.WithError(err).WithField("type", msg.Header.Type).Warn(
+					"Failed to parse netlink update, ignoring")
+				continue
+			}
+			if update.Link == nil && update.Route == nil {
+				continue
+			}
+			select {
+			case updates <- update:
+			case <-done:
+				return
+			}
+		}
+	}
 }
 
-func (nl *netlinkReal) ListLocalRoutes(link netlink.Link, family int) ([]netlink.Route, error) {
-	routeFilter := &netlink.Route{}
+// netlinkMessageError returns the error in an NLMSG_ERROR message, or nil if it's an ack.
+func netlinkMessageError(msg syscall.NetlinkMessage) error {
+	if len(msg.Data) < 4 {
+		return errors.New("netlink error message too short")
+	}
+	errno := -int32(nlpkg.NativeEndian().Uint32(msg.Data[0:4]))
+	if errno == 0 {
+		return nil
+	}
+	return syscall.Errno(errno)
+}
+
+// parseNetlinkUpdate converts a link or route message into a NetlinkUpdate.  For other messages,
+// it returns an empty NetlinkUpdate.
+func parseNetlinkUpdate(msg syscall.NetlinkMessage) (NetlinkUpdate, error) {
+	header := unix.NlMsghdr(msg.Header)
+	switch msg.Header.Type {
+	case unix.RTM_NEWLINK, unix.RTM_DELLINK:
+		if len(msg.Data) < unix.SizeofIfInfomsg {
+			return NetlinkUpdate{}, errors.New("link message too short")
+		}
+		link, err := netlink.LinkDeserialize(&header, msg.Data)
+		if err != nil {
+			return NetlinkUpdate{}, err
+		}
+		return NetlinkUpdate{Link: &netlink.LinkUpdate{
+			IfInfomsg: *nlpkg.DeserializeIfInfomsg(msg.Data),
+			Header:    header,
+			Link:      link,
+		}}, nil
+	case unix.RTM_NEWROUTE, unix.RTM_DELROUTE:
+		route, err := parseRoute(msg.Data)
+		if err != nil {
+			return NetlinkUpdate{}, err
+		}
+		return NetlinkUpdate{Route: &netlink.RouteUpdate{Type: msg.Header.Type, Route: route}}, nil
+	}
+	return NetlinkUpdate{}, nil
+}
+
+// parseRoute parses the parts of a route message that we use.  The netlink library only parses
+// routes for its own subscriptions and list calls.
+func parseRoute(data []byte) (netlink.Route, error) {
+	if len(data) < unix.SizeofRtMsg {
+		return netlink.Route{}, errors.New("route message too short")
+	}
+	msg := nlpkg.DeserializeRtMsg(data)
+	attrs, err := nlpkg.ParseRouteAttr(data[unix.SizeofRtMsg:])
+	if err != nil {
+		return netlink.Route{}, err
+	}
+	native := nlpkg.NativeEndian()
+	route := netlink.Route{
+		Scope: netlink.Scope(msg.Scope),
+		Table: int(msg.Table),
+		Type:  int(msg.Type),
+	}
+	for _, attr := range attrs {
+		switch attr.Attr.Type {
+		case unix.RTA_DST:
+			route.Dst = &net.IPNet{
+				IP:   attr.Value,
+				Mask: net.CIDRMask(int(msg.Dst_len), 8*len(attr.Value)),
+			}
+		case unix.RTA_PREFSRC:
+			route.Src = attr.Value
+		case unix.RTA_GATEWAY:
+			route.Gw = attr.Value
+		case unix.RTA_OIF:
+			route.LinkIndex = int(native.Uint32(attr.Value))
+		case unix.RTA_PRIORITY:
+			route.Priority = int(native.Uint32(attr.Value))
+		case unix.RTA_TABLE:
+			route.Table = int(native.Uint32(attr.Value))
+		case unix.RTA_MULTIPATH:
+			route.MultiPath, err = parseMultiPath(attr.Value)
+			if err != nil {
+				return netlink.Route{}, err
+			}
+		}
+	}
+	return route, nil
+}
+
+func parseMultiPath(value []byte) ([]*netlink.NexthopInfo, error) {
+	native := nlpkg.NativeEndian()
+	var nexthops []*netlink.NexthopInfo
+	for len(value) >= unix.SizeofRtNexthop {
+		length := int(native.Uint16(value[0:2]))
+		if length < unix.SizeofRtNexthop || length > len(value) {
+			return nil, errors.New("bad multipath next hop length")
+		}
+		nexthop := &netlink.NexthopInfo{
+			Hops:      int(value[3]),
+			LinkIndex: int(native.Uint32(value[4:8])),
+		}
+		attrs, err := nlpkg.ParseRouteAttr(value[unix.SizeofRtNexthop:length])
+		if err != nil {
+			return nil, err
+		}
+		for _, attr := range attrs {
+			if attr.Attr.Type == unix.RTA_GATEWAY {
+				nexthop.Gw = attr.Value
+			}
+		}
+		nexthops = append(nexthops, nexthop)
+		length = (length + unix.RTA_ALIGNTO - 1) &^ (unix.RTA_ALIGNTO - 1)
+		if length > len(value) {
+			break
+		}
+		value = value[length:]
+	}
+	return nexthops, nil
+}
+
+func (nl *netlinkReal) LinkList() (links []netlink.Link, err error) {
+	err = nl.ns.run(func() (err error) {
+		links, err = netlink.LinkList()
+		return
+	})
+	return
+}
+
+func (nl *netlinkReal) ListLocalRoutes(link netlink.Link, family int) (routes []netlink.Route, err error) {
+	ifIndex := 0
 	if link != nil {
-		routeFilter.LinkIndex = link.Attrs().Index
+		ifIndex = link.Attrs().Index
+	}
+	err = nl.ns.run(func() (err error) {
+		routes, err = dumpRoutes(family, unix.RT_TABLE_LOCAL, ifIndex, false)
+		return
+	})
+	return
+}
+
+func (nl *netlinkReal) ListDefaultRoutes(family int) ([]netlink.Route, error) {
+	var routes []netlink.Route
+	err := nl.ns.run(func() (err error) {
+		routes, err = dumpRoutes(family, unix.RT_TABLE_MAIN, 0, true)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	var defaultRoutes []netlink.Route
+	for _, route := range routes {
+		if !isDefaultRoute(&route) {
+			continue
+		}
+		defaultRoutes = append(defaultRoutes, route)
+	}
+	return defaultRoutes, nil
+}
+
+// dumpRoutes lists the routes in the given table and, if ifIndex isn't 0, on the given
+// interface.  It enables NETLINK_GET_STRICT_CHK on its socket so that the kernel only returns
+// the routes that match; the netlink library doesn't, so the kernel would dump every table.
+// Kernels without strict checking still ignore the filters (see filterLocalRoutes).
+//
+// If defaultOnly is set, it skips the routes that have a destination prefix, without parsing
+// them.  The kernel can't do that for us: it rejects a dump request with a destination length.
+func dumpRoutes(family, table, ifIndex int, defaultOnly bool) ([]netlink.Route, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = unix.Close(fd)
+	}()
+	_ = unix.SetsockoptInt(fd, unix.SOL_NETLINK, netlinkGetStrictChk, 1)
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+
+	// With strict checking, the kernel rejects a dump request whose header has anything set
+	// other than the family and the fields that it filters on.
+	req := nlpkg.NewNetlinkRequest(unix.RTM_GETROUTE, unix.NLM_F_DUMP)
+	msg := &nlpkg.RtMsg{}
+	msg.Family = uint8(family)
+	if table < 256 {
+		msg.Table = uint8(table)
+	}
+	req.AddData(msg)
+	req.AddData(nlpkg.NewRtAttr(unix.RTA_TABLE, nlpkg.Uint32Attr(uint32(table))))
+	if ifIndex != 0 {
+		req.AddData(nlpkg.NewRtAttr(unix.RTA_OIF, nlpkg.Uint32Attr(uint32(ifIndex))))
+	}
+	if err := unix.Sendto(fd, req.Serialize(), 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+
+	var routes []netlink.Route
+	buf := make([]byte, netlinkReceiveBufferSize)
+	for {
+		n, from, err := unix.Recvfrom(fd, buf, 0)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if sa, ok := from.(*unix.SockaddrNetlink); !ok || sa.Pid != 0 {
+			// Not from the kernel.
+			continue
+		}
+		// The parsed routes point into the data, so each read gets its own copy.
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		msgs, err := syscall.ParseNetlinkMessage(data)
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range msgs {
+			if msg.Header.Seq != req.Seq {
+				continue
+			}
+			switch msg.Header.Type {
+			case unix.NLMSG_DONE, unix.NLMSG_ERROR:
+				if err := netlinkMessageError(msg); err != nil {
+					return nil, err
+				}
+				return routes, nil
+			case unix.RTM_NEWROUTE:
+				if defaultOnly && len(msg.Data) >= unix.SizeofRtMsg && nlpkg.DeserializeRtMsg(msg.Data).Dst_len != 0 {
+					continue
+				}
+				route, err := parseRoute(msg.Data)
+				if err != nil {
+					return nil, err
+				}
+				routes = append(routes, route)
+			}
+		}
+	}
+}
+
+func (nl *netlinkReal) AddrList(link netlink.Link, family int) (addrs []netlink.Addr, err error) {
+	err = nl.ns.run(func() (err error) {
+		addrs, err = netlink.AddrList(link, family)
+		return
+	})
+	return
+}
+
+// IFLA_PROP_LIST and IFLA_ALT_IFNAME from linux/if_link.h (added in kernel 5.5).  Our netlink
+// library doesn't parse them.
+const (
+	iflaPropList  = 52
+	iflaAltIfname = 53
+	nlaTypeMask   = ^uint16(unix.NLA_F_NESTED | unix.NLA_F_NET_BYTEORDER)
+)
+
+func (nl *netlinkReal) LinkAltNames(ifIndex int) (altNames []string, err error) {
+	err = nl.ns.run(func() (err error) {
+		altNames, err = linkAltNames(ifIndex)
+		return
+	})
+	return
+}
+
+// linkAltNames sends an RTM_GETLINK for a single interface and parses the altnames out of the
+// IFLA_PROP_LIST attribute.  On older kernels, there's no such attribute and we return nil.
+func linkAltNames(ifIndex int) ([]string, error) {
+	req := nlpkg.NewNetlinkRequest(unix.RTM_GETLINK, unix.NLM_F_ACK)
+	msg := nlpkg.NewIfInfomsg(unix.AF_UNSPEC)
+	msg.Index = int32(ifIndex)
+	req.AddData(msg)
+	msgs, err := req.Execute(unix.NETLINK_ROUTE, unix.RTM_NEWLINK)
+	if err != nil {
+		return nil, err
+	}
+	var altNames []string
+	for _, m := range msgs {
+		if len(m) < unix.SizeofIfInfomsg {
+			continue
+		}
+		attrs, err := nlpkg.ParseRouteAttr(m[unix.SizeofIfInfomsg:])
+		if err != nil {
+			return nil, err
+		}
+		for _, attr := range attrs {
+			if attr.Attr.Type&nlaTypeMask != iflaPropList {
+				continue
+			}
+			props, err := nlpkg.ParseRouteAttr(attr.Value)
+			if err != nil {
+				return nil, err
+			}
+			for _, prop := range props {
+				if prop.Attr.Type&nlaTypeMask != iflaAltIfname {
+					continue
+				}
+				altNames = append(altNames, string(bytes.TrimRight(prop.Value, "\x00")))
+			}
+		}
+	}
+	return altNames, nil
+}
+
+// netlinkGetStrictChk is NETLINK_GET_STRICT_CHK from linux/netlink.h (added in kernel 4.20).
+const netlinkGetStrictChk = 12
+
+func (nl *netlinkReal) ProbeCapabilities() KernelCapabilities {
+	var caps KernelCapabilities
+	var fd int
+	err := nl.ns.run(func() (err error) {
+		fd, err = unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+		return
+	})
+	if err != nil {
+		log.WithError(err).Warn("Failed to open netlink socket to probe kernel capabilities.")
+		return caps
 	}
-	routeFilter.Table = unix.RT_TABLE_LOCAL
-	return netlink.RouteListFiltered(family, routeFilter, netlink.RT_FILTER_TABLE|netlink.RT_FILTER_OIF)
+	defer unix.Close(fd)
+	caps.StrictCheck = unix.SetsockoptInt(fd, unix.SOL_NETLINK, netlinkGetStrictChk, 1) == nil
+	return caps
 }
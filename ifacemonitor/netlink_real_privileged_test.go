@@ -0,0 +1,242 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build privileged,!darwin
+
+// These tests create a network namespace, so they need CAP_SYS_ADMIN.  Run them with:
+// sudo -E go test -tags privileged ./ifacemonitor/ -count=1 -args -ginkgo.focus=Privileged
+
+package ifacemonitor_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ifacemonitor/testutils"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Privileged netlink update parsing", func() {
+	var ns netns.NsHandle
+	var nsHandle *netlink.Handle
+	var im *ifacemonitor.InterfaceMonitor
+	var recorder *testutils.Recorder
+	var blockC chan struct{}
+	var blockedC chan struct{}
+	var doneC chan struct{}
+
+	BeforeEach(func() {
+		im = nil
+		if os.Geteuid() != 0 {
+			Skip("Needs root to create a network namespace.")
+		}
+		var err error
+		ns, err = newTestNetns()
+		if err != nil {
+			Skip(fmt.Sprintf("Can't create network namespaces: %v", err))
+		}
+		nsHandle, err = netlink.NewHandleAt(ns)
+		Expect(err).NotTo(HaveOccurred())
+
+		im = ifacemonitor.NewInNamespace(ifacemonitor.Config{}, ns)
+		recorder = testutils.NewRecorder()
+		recorder.Attach(im)
+		// Lets the test hold up the monitor's goroutine, so that the updates that the kernel
+		// sends in the meantime queue up behind it.
+		blockC = make(chan struct{})
+		blockedC = make(chan struct{})
+		im.Middleware = []ifacemonitor.Middleware{func(upd ifacemonitor.Update) (ifacemonitor.Update, bool) {
+			if upd.IfaceName == "block0" {
+				select {
+				case <-blockedC:
+				default:
+					close(blockedC)
+					<-blockC
+				}
+			}
+			return upd, true
+		}}
+		doneC = make(chan struct{})
+		go func(im *ifacemonitor.InterfaceMonitor, doneC chan struct{}) {
+			defer close(doneC)
+			defer GinkgoRecover()
+			Expect(im.Run()).To(Succeed())
+		}(im, doneC)
+		recorder.ExpectAddrs("lo")
+	})
+
+	AfterEach(func() {
+		if im == nil {
+			return
+		}
+		im.Stop()
+		Eventually(doneC).Should(BeClosed())
+		nsHandle.Delete()
+		Expect(ns.Close()).To(Succeed())
+	})
+
+	It("should keep each update's MAC and addresses while later messages are read", func() {
+		addBridge := func(name string, i int) {
+			mac := net.HardwareAddr{0x02, 0, 0, 0, 0, byte(i)}
+			Expect(nsHandle.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{
+				Name:         name,
+				HardwareAddr: mac,
+			}})).To(Succeed())
+			link, err := nsHandle.LinkByName(name)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(nsHandle.LinkSetUp(link)).To(Succeed())
+			Expect(nsHandle.AddrAdd(link, &netlink.Addr{IPNet: &net.IPNet{
+				IP:   net.IPv4(10, 99, 1, byte(i)),
+				Mask: net.CIDRMask(32, 32),
+			}})).To(Succeed())
+		}
+		addBridge("block0", 100)
+		Eventually(blockedC).Should(BeClosed())
+
+		// Each of these arrives in its own read from the socket.  They're parsed straight away
+		// but the monitor only handles them once it's unblocked.
+		const numBridges = 5
+		for i := 1; i <= numBridges; i++ {
+			addBridge(fmt.Sprintf("br%d", i), i)
+		}
+		time.Sleep(200 * time.Millisecond)
+		close(blockC)
+
+		for i := 1; i <= numBridges; i++ {
+			name := fmt.Sprintf("br%d", i)
+			Eventually(func() []string {
+				return im.InterfaceAddrs(name)
+			}).Should(Equal([]string{fmt.Sprintf("10.99.1.%d", i)}), name)
+			var hwAddr string
+			for _, status := range im.Interfaces() {
+				if status.Name == name {
+					hwAddr = status.HardwareAddr
+				}
+			}
+			Expect(hwAddr).To(Equal(fmt.Sprintf("02:00:00:00:00:%02x", i)), name)
+		}
+	})
+})
+
+var _ = Describe("Privileged route dumps", func() {
+	var ns netns.NsHandle
+	var nsHandle *netlink.Handle
+	var tempDir string
+	var im *ifacemonitor.InterfaceMonitor
+	var recorder *testutils.Recorder
+	var doneC chan struct{}
+
+	BeforeEach(func() {
+		im = nil
+		if os.Geteuid() != 0 {
+			Skip("Needs root to create a network namespace.")
+		}
+		var err error
+		ns, err = newTestNetns()
+		if err != nil {
+			Skip(fmt.Sprintf("Can't create network namespaces: %v", err))
+		}
+		nsHandle, err = netlink.NewHandleAt(ns)
+		Expect(err).NotTo(HaveOccurred())
+		tempDir, err = ioutil.TempDir("", "ifacemonitor")
+		Expect(err).NotTo(HaveOccurred())
+
+		// The recording shows what each route dump returned, before any filtering of ours.
+		im = ifacemonitor.NewInNamespace(ifacemonitor.Config{
+			RecordFile: filepath.Join(tempDir, "recording.jsonl"),
+		}, ns)
+		recorder = testutils.NewRecorder()
+		recorder.Attach(im)
+		doneC = make(chan struct{})
+		go func(im *ifacemonitor.InterfaceMonitor, doneC chan struct{}) {
+			defer close(doneC)
+			defer GinkgoRecover()
+			Expect(im.Run()).To(Succeed())
+		}(im, doneC)
+		recorder.ExpectAddrs("lo")
+	})
+
+	AfterEach(func() {
+		if im == nil {
+			return
+		}
+		im.Stop()
+		Eventually(doneC).Should(BeClosed())
+		nsHandle.Delete()
+		Expect(ns.Close()).To(Succeed())
+		Expect(os.RemoveAll(tempDir)).To(Succeed())
+	})
+
+	It("should only get the requested interface's local routes from the kernel", func() {
+		caps, ok := im.Capabilities()
+		Expect(ok).To(BeTrue())
+		if !caps.StrictCheck {
+			Skip("Kernel doesn't support NETLINK_GET_STRICT_CHK.")
+		}
+		for i := 1; i <= 2; i++ {
+			name := fmt.Sprintf("br%d", i)
+			Expect(nsHandle.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: name}})).To(Succeed())
+			link, err := nsHandle.LinkByName(name)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(nsHandle.AddrAdd(link, &netlink.Addr{IPNet: &net.IPNet{
+				IP:   net.IPv4(10, 99, 2, byte(i)),
+				Mask: net.CIDRMask(32, 32),
+			}})).To(Succeed())
+			Eventually(func() []string {
+				return im.InterfaceAddrs(name)
+			}).Should(ContainElement(fmt.Sprintf("10.99.2.%d", i)), name)
+		}
+		im.Stop()
+		Eventually(doneC).Should(BeClosed())
+
+		f, err := os.Open(filepath.Join(tempDir, "recording.jsonl"))
+		Expect(err).NotTo(HaveOccurred())
+		defer f.Close()
+		numDumps := 0
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var event struct {
+				Type    string `json:"type"`
+				IfIndex int    `json:"if_index"`
+				Routes  []struct {
+					LinkIndex int `json:"link_index"`
+					Table     int `json:"table"`
+				} `json:"routes"`
+			}
+			Expect(json.Unmarshal(scanner.Bytes(), &event)).To(Succeed())
+			if event.Type != "local-routes" {
+				continue
+			}
+			numDumps++
+			for _, route := range event.Routes {
+				Expect(route.LinkIndex).To(Equal(event.IfIndex), scanner.Text())
+				Expect(route.Table).To(Equal(255), scanner.Text())
+			}
+		}
+		Expect(scanner.Err()).NotTo(HaveOccurred())
+		Expect(numDumps).To(BeNumerically(">", 2))
+	})
+})
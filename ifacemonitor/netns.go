@@ -0,0 +1,129 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"fmt"
+	"runtime"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netns"
+)
+
+// NewInNamespace creates a monitor, like New, for the interfaces in the given network namespace
+// rather than the caller's.  Several such monitors can run at once, each with its own callbacks;
+// see also MultiMonitor.  The caller keeps ownership of ns and must keep it open until the
+// monitor has stopped.
+//
+// The monitor's netlink sockets, including the one for the self-test, are opened in ns, but
+// /sys/class/net always shows the namespace that sysfs was mounted from, so the options that
+// read it (SysfsOperStateCheck and TrackProtodown) are turned off.  An AddrAnnouncer from
+// NewAddrAnnouncer sends from the caller's namespace, so it isn't suitable either.
+func NewInNamespace(config Config, ns netns.NsHandle) *InterfaceMonitor {
+	return newInNamespace(config, &targetNetns{handle: ns})
+}
+
+// NewInNamespacePath is NewInNamespace for the network namespace at the given path, such as
+// /proc/1/ns/net or /var/run/netns/<name>.  It returns an error straight away if the namespace
+// can't be opened.  The monitor opens the path again each time it subscribes to netlink, so
+// that it follows a namespace that has been recreated at the same path, and closes it once Run
+// returns.
+func NewInNamespacePath(config Config, path string) (*InterfaceMonitor, error) {
+	target := &targetNetns{handle: netns.None(), path: path}
+	if err := target.reopen(); err != nil {
+		return nil, err
+	}
+	m := newInNamespace(config, target)
+	m.ownedNetns = target
+	return m, nil
+}
+
+func newInNamespace(config Config, target *targetNetns) *InterfaceMonitor {
+	if config.SysfsOperStateCheck || config.TrackProtodown {
+		log.WithField("netns", target).Warn(
+			"Can't read /sys for another network namespace; disabling sysfs checks.")
+		config.SysfsOperStateCheck = false
+		config.TrackProtodown = false
+	}
+	return newWithRealNetlink(config, &netlinkReal{ns: target}, WithCanaryStub(&canaryReal{ns: target}))
+}
+
+// targetNetns is the network namespace that the real netlink and canary stubs work in.  nil
+// means the caller's own namespace.  It's only used from the monitor's goroutine.
+type targetNetns struct {
+	handle netns.NsHandle
+	// path, if set, is where the namespace was opened from.
+	path string
+}
+
+func (t *targetNetns) String() string {
+	if t.path != "" {
+		return t.path
+	}
+	return t.handle.String()
+}
+
+// reopen opens the namespace's path again, if it has one, replacing the handle.
+func (t *targetNetns) reopen() error {
+	if t.path == "" {
+		return nil
+	}
+	handle, err := netns.GetFromPath(t.path)
+	if err != nil {
+		return fmt.Errorf("failed to open network namespace %s: %w", t.path, err)
+	}
+	t.close()
+	t.handle = handle
+	return nil
+}
+
+func (t *targetNetns) close() {
+	if t == nil || !t.handle.IsOpen() {
+		return
+	}
+	if err := t.handle.Close(); err != nil {
+		log.WithError(err).WithField("netns", t).Warn("Failed to close network namespace.")
+	}
+	t.handle = netns.None()
+}
+
+// run calls fn with the calling goroutine's thread switched into the namespace.  Netlink sockets
+// belong to the namespace that they were opened in, so fn needn't do anything special, as long
+// as it opens its sockets before returning and doesn't start any goroutines that open more.
+func (t *targetNetns) run(fn func() error) error {
+	if t == nil {
+		return fn()
+	}
+	// Namespaces are per-thread, so we need to stay on this one until we've switched back.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origNs, err := netns.Get()
+	if err != nil {
+		return err
+	}
+	defer origNs.Close()
+	if err := netns.Set(t.handle); err != nil {
+		return err
+	}
+	defer func() {
+		if err := netns.Set(origNs); err != nil {
+			// We can't safely let anything else run on this thread.
+			log.WithError(err).Panic("Failed to switch back to our own network namespace.")
+		}
+	}()
+	return fn()
+}
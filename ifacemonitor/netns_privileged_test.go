@@ -0,0 +1,193 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build privileged,!darwin
+
+// These tests create network namespaces, so they need CAP_SYS_ADMIN.  Run them with:
+// sudo -E go test -tags privileged ./ifacemonitor/ -count=1 -args -ginkgo.focus=Privileged
+
+package ifacemonitor_test
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ifacemonitor/testutils"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Privileged monitor in another network namespace", func() {
+	var ns netns.NsHandle
+	var nsHandle *netlink.Handle
+	var im *ifacemonitor.InterfaceMonitor
+	var recorder *testutils.Recorder
+	var doneC chan struct{}
+
+	BeforeEach(func() {
+		im = nil
+		if os.Geteuid() != 0 {
+			Skip("Needs root to create a network namespace.")
+		}
+		var err error
+		ns, err = newTestNetns()
+		if err != nil {
+			Skip(fmt.Sprintf("Can't create network namespaces: %v", err))
+		}
+		nsHandle, err = netlink.NewHandleAt(ns)
+		Expect(err).NotTo(HaveOccurred())
+
+		im = ifacemonitor.NewInNamespace(ifacemonitor.Config{}, ns)
+		recorder = testutils.NewRecorder()
+		recorder.Attach(im)
+		doneC = make(chan struct{})
+		go func(im *ifacemonitor.InterfaceMonitor, doneC chan struct{}) {
+			defer close(doneC)
+			defer GinkgoRecover()
+			Expect(im.Run()).To(Succeed())
+		}(im, doneC)
+	})
+
+	AfterEach(func() {
+		if im == nil {
+			return
+		}
+		im.Stop()
+		Eventually(doneC).Should(BeClosed())
+		nsHandle.Delete()
+		Expect(ns.Close()).To(Succeed())
+	})
+
+	It("should only see the namespace's interfaces", func() {
+		// A new namespace has only a loopback interface, which starts down.
+		recorder.ExpectAddrs("lo")
+		Expect(im.UpInterfaces()).To(BeEmpty())
+
+		lo, err := nsHandle.LinkByName("lo")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(nsHandle.AddrAdd(lo, &netlink.Addr{IPNet: &net.IPNet{
+			IP:   net.ParseIP("10.99.0.1"),
+			Mask: net.CIDRMask(32, 32),
+		}})).To(Succeed())
+		Expect(nsHandle.LinkSetUp(lo)).To(Succeed())
+		recorder.ExpectState("lo", ifacemonitor.StateUp)
+		Eventually(func() []string {
+			return im.InterfaceAddrs("lo")
+		}).Should(ContainElement("10.99.0.1"))
+
+		// Nothing from our own namespace.
+		var names []string
+		for _, status := range im.Interfaces() {
+			names = append(names, status.Name)
+		}
+		Expect(names).To(Equal([]string{"lo"}))
+	})
+})
+
+var _ = Describe("Privileged monitor in a network namespace given by path", func() {
+	var ns netns.NsHandle
+	var nsHandle *netlink.Handle
+	var im *ifacemonitor.InterfaceMonitor
+	var recorder *testutils.Recorder
+	var doneC chan struct{}
+
+	BeforeEach(func() {
+		im = nil
+		if os.Geteuid() != 0 {
+			Skip("Needs root to create a network namespace.")
+		}
+		var err error
+		ns, err = newTestNetns()
+		if err != nil {
+			Skip(fmt.Sprintf("Can't create network namespaces: %v", err))
+		}
+		nsHandle, err = netlink.NewHandleAt(ns)
+		Expect(err).NotTo(HaveOccurred())
+
+		im, err = ifacemonitor.NewInNamespacePath(ifacemonitor.Config{}, fmt.Sprintf("/proc/self/fd/%d", int(ns)))
+		Expect(err).NotTo(HaveOccurred())
+		recorder = testutils.NewRecorder()
+		recorder.Attach(im)
+		doneC = make(chan struct{})
+		go func(im *ifacemonitor.InterfaceMonitor, doneC chan struct{}) {
+			defer close(doneC)
+			defer GinkgoRecover()
+			Expect(im.Run()).To(Succeed())
+		}(im, doneC)
+	})
+
+	AfterEach(func() {
+		if im == nil {
+			return
+		}
+		im.Stop()
+		Eventually(doneC).Should(BeClosed())
+		nsHandle.Delete()
+		Expect(ns.Close()).To(Succeed())
+	})
+
+	It("should see a veth that's added inside the namespace", func() {
+		recorder.ExpectAddrs("lo")
+		veth := &netlink.Veth{
+			LinkAttrs: netlink.LinkAttrs{Name: "test-veth0"},
+			PeerName:  "test-veth1",
+		}
+		if err := nsHandle.LinkAdd(veth); err != nil {
+			Skip(fmt.Sprintf("Can't create a veth: %v", err))
+		}
+		recorder.ExpectAddrs("test-veth0")
+		recorder.ExpectAddrs("test-veth1")
+
+		peer, err := nsHandle.LinkByName("test-veth1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(nsHandle.LinkSetUp(peer)).To(Succeed())
+		link, err := nsHandle.LinkByName("test-veth0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(nsHandle.AddrAdd(link, &netlink.Addr{IPNet: &net.IPNet{
+			IP:   net.ParseIP("10.99.1.1"),
+			Mask: net.CIDRMask(32, 32),
+		}})).To(Succeed())
+		Expect(nsHandle.LinkSetUp(link)).To(Succeed())
+		recorder.ExpectState("test-veth0", ifacemonitor.StateUp)
+		Eventually(func() []string {
+			return im.InterfaceAddrs("test-veth0")
+		}).Should(ContainElement("10.99.1.1"))
+
+		Expect(nsHandle.LinkDel(link)).To(Succeed())
+		recorder.ExpectAddrsGone("test-veth0")
+		recorder.ExpectAddrsGone("test-veth1")
+	})
+})
+
+// newTestNetns creates a network namespace without leaving this goroutine's thread in it.
+func newTestNetns() (netns.NsHandle, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origNs, err := netns.Get()
+	if err != nil {
+		return netns.None(), err
+	}
+	defer origNs.Close()
+	defer func() {
+		Expect(netns.Set(origNs)).To(Succeed())
+	}()
+	return netns.New()
+}
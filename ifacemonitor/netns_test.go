@@ -0,0 +1,32 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"github.com/projectcalico/felix/ifacemonitor"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Monitor in a network namespace given by path", func() {
+	It("should fail straight away if the namespace can't be opened", func() {
+		im, err := ifacemonitor.NewInNamespacePath(ifacemonitor.Config{}, "/nonexistent/ns/net")
+		Expect(err).To(MatchError(ContainSubstring("failed to open network namespace /nonexistent/ns/net")))
+		Expect(im).To(BeNil())
+	})
+})
@@ -0,0 +1,191 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// maxParentChainDepth bounds the parent chain; real stacks are only a few levels deep.
+const maxParentChainDepth = 8
+
+// ParentChain lists the ancestors of a stacked virtual device, nearest first, down to the
+// physical device(s).  For example, for a VLAN on a bond, the chain is [[bond0] [eno1 eno2]]:
+// a device's parent is its IFLA_LINK device (as used by VLANs, macvlans, tunnels and so on)
+// and a master's parents are its slaves.
+type ParentChain struct {
+	Levels [][]string `json:"levels"`
+	// Incomplete is set if we don't know about one of the ancestors (for example, because it
+	// has been deleted or it's in another namespace).
+	Incomplete bool `json:"incomplete,omitempty"`
+}
+
+func (c *ParentChain) String() string {
+	var levels []string
+	for _, level := range c.Levels {
+		levels = append(levels, strings.Join(level, ","))
+	}
+	s := strings.Join(levels, " -> ")
+	if c.Incomplete {
+		s += " (incomplete)"
+	}
+	return s
+}
+
+func (c *ParentChain) equal(other *ParentChain) bool {
+	if c == nil || other == nil {
+		return c == other
+	}
+	if c.Incomplete != other.Incomplete || len(c.Levels) != len(other.Levels) {
+		return false
+	}
+	for i := range c.Levels {
+		if strings.Join(c.Levels[i], ",") != strings.Join(other.Levels[i], ",") {
+			return false
+		}
+	}
+	return true
+}
+
+// ParentChainCallback is called when the parent chain of an interface changes, including when
+// an ancestor is renamed or removed.  chain is nil if the interface no longer has any parents
+// (or has been removed).
+type ParentChainCallback func(ifaceName string, chain *ParentChain)
+
+// storeLinkTopology records the parent (IFLA_LINK) and master of a link.  Returns true if
+// either changed.  A veth's IFLA_LINK is its peer, not a parent, so we ignore it.
+func (m *InterfaceMonitor) storeLinkTopology(link netlink.Link) bool {
+	attrs := link.Attrs()
+	parentIdx := attrs.ParentIndex
+	if _, isVeth := link.(*netlink.Veth); isVeth || parentIdx == attrs.Index {
+		parentIdx = 0
+	}
+	changed := storeOrDeleteIdx(m.linkParents, attrs.Index, parentIdx)
+	if storeOrDeleteIdx(m.linkMasters, attrs.Index, attrs.MasterIndex) {
+		changed = true
+	}
+	return changed
+}
+
+func (m *InterfaceMonitor) forgetLinkTopology(ifIndex int) {
+	delete(m.linkParents, ifIndex)
+	delete(m.linkMasters, ifIndex)
+}
+
+func storeOrDeleteIdx(idxs map[int]int, ifIndex, value int) (changed bool) {
+	if idxs[ifIndex] == value {
+		return false
+	}
+	if value == 0 {
+		delete(idxs, ifIndex)
+	} else {
+		idxs[ifIndex] = value
+	}
+	return true
+}
+
+// refreshParentChains recalculates the parent chains of all interfaces and notifies any that
+// changed.  Called when an interface is added, removed or renamed or its parent or master
+// changes.  Does nothing on hosts without stacked devices.
+func (m *InterfaceMonitor) refreshParentChains() {
+	if len(m.linkParents) == 0 && len(m.linkMasters) == 0 && len(m.parentChains) == 0 {
+		return
+	}
+	slaves := map[int][]int{}
+	for slaveIdx, masterIdx := range m.linkMasters {
+		slaves[masterIdx] = append(slaves[masterIdx], slaveIdx)
+	}
+	for ifIndex := range m.parentChains {
+		if _, known := m.ifaceName[ifIndex]; !known {
+			// Interface has gone; don't notify since the consumer knows that anyway.
+			delete(m.parentChains, ifIndex)
+		}
+	}
+	for ifIndex, ifaceName := range m.ifaceName {
+		chain := m.calculateParentChain(ifIndex, slaves)
+		if chain.equal(m.parentChains[ifIndex]) {
+			continue
+		}
+		if chain == nil {
+			delete(m.parentChains, ifIndex)
+		} else {
+			m.parentChains[ifIndex] = chain
+		}
+		log.WithFields(log.Fields{
+			"ifaceName":   ifaceName,
+			"parentChain": chain,
+		}).Debug("Interface parent chain changed.")
+		if m.ParentChainCallback != nil && !m.isExcludedInterface(ifaceName) {
+			m.ParentChainCallback(ifaceName, chain.copy())
+		}
+	}
+}
+
+// calculateParentChain walks down from the given interface, a level at a time.  Each
+// interface is visited at most once so a loop (which shouldn't happen) can't make us spin.
+func (m *InterfaceMonitor) calculateParentChain(ifIndex int, slaves map[int][]int) *ParentChain {
+	var chain ParentChain
+	visited := map[int]bool{ifIndex: true}
+	level := []int{ifIndex}
+	for depth := 0; depth < maxParentChainDepth && len(level) > 0; depth++ {
+		var nextLevel []int
+		var names []string
+		for _, idx := range level {
+			lowers := slaves[idx]
+			if parentIdx := m.linkParents[idx]; parentIdx != 0 {
+				lowers = append([]int{parentIdx}, lowers...)
+			}
+			for _, lower := range lowers {
+				if visited[lower] {
+					continue
+				}
+				visited[lower] = true
+				name, known := m.ifaceName[lower]
+				if !known {
+					chain.Incomplete = true
+					continue
+				}
+				nextLevel = append(nextLevel, lower)
+				names = append(names, name)
+			}
+		}
+		if len(names) > 0 {
+			sort.Strings(names)
+			chain.Levels = append(chain.Levels, names)
+		}
+		level = nextLevel
+	}
+	if len(chain.Levels) == 0 && !chain.Incomplete {
+		return nil
+	}
+	return &chain
+}
+
+func (c *ParentChain) copy() *ParentChain {
+	if c == nil {
+		return nil
+	}
+	cp := &ParentChain{Incomplete: c.Incomplete}
+	for _, level := range c.Levels {
+		cp.Levels = append(cp.Levels, append([]string(nil), level...))
+	}
+	return cp
+}
@@ -0,0 +1,220 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+const defaultMaxPauseDuration = time.Minute
+
+// heldNotification is the latest state and addresses for an interface that we've held back
+// while paused.
+type heldNotification struct {
+	hasState bool
+	state    State
+	ifIndex  int
+	hasAddrs bool
+	addrs    set.Set
+}
+
+// Pause holds back the StateCallback and AddrCallback notifications until Resume is called, for
+// consumers that want to handle a batch of changes in one go.  The monitor carries on tracking
+// the interfaces as normal.  The other callbacks and the subscribers aren't affected.  If Resume
+// isn't called within MaxPauseDuration, the monitor resumes by itself.  Safe to call from any
+// goroutine; pausing an already-paused monitor does nothing.
+func (m *InterfaceMonitor) Pause() {
+	m.runOnMonitorLoop(m.pause)
+}
+
+// Resume makes the notifications held back since Pause, coalesced so that there's at most one
+// AddrCallback and one StateCallback for each interface, giving its final addresses and state.
+// Notifications that would just repeat what the callbacks were told before the pause are
+// dropped.  The interfaces are notified in name order, each one's addresses before its state.
+// The callbacks have been made by the time that Resume returns, unless the monitor has stopped.
+func (m *InterfaceMonitor) Resume() {
+	m.runOnMonitorLoop(m.resume)
+}
+
+func (m *InterfaceMonitor) maxPauseDuration() time.Duration {
+	if m.MaxPauseDuration <= 0 {
+		return defaultMaxPauseDuration
+	}
+	return m.MaxPauseDuration
+}
+
+func (m *InterfaceMonitor) pause() {
+	if m.paused {
+		return
+	}
+	log.Info("Pausing interface notifications.")
+	m.paused = true
+	m.pauseTimer = m.time.NewTimer(m.maxPauseDuration())
+	m.pauseTimerC = m.pauseTimer.Chan()
+}
+
+func (m *InterfaceMonitor) resume() {
+	if !m.paused {
+		return
+	}
+	m.paused = false
+	m.pauseTimer.Stop()
+	m.pauseTimer = nil
+	m.pauseTimerC = nil
+	log.Info("Resuming interface notifications.")
+	// Anything held for a batch goes out now too.
+	m.stopBatchTimer()
+	m.deliverHeldNotifications()
+}
+
+// deliverHeldNotifications makes the notifications that were held back while paused or
+// batching, coalesced, in name order.
+func (m *InterfaceMonitor) deliverHeldNotifications() {
+	held := m.heldNotifications
+	m.heldNotifications = map[string]*heldNotification{}
+	names := make([]string, 0, len(held))
+	for name := range held {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	log.WithField("numIfaces", len(names)).Debug("Delivering held notifications.")
+	for _, name := range names {
+		h := held[name]
+		if h.hasAddrs && !addrSetsEqual(m.deliveredAddrs[name], h.addrs) {
+			m.deliverAddrsNow(name, h.addrs, h.ifIndex)
+		}
+		if h.hasState && m.isNewState(name, h.state) {
+			m.deliverStateNow(name, h.state, h.ifIndex)
+		}
+	}
+}
+
+// isNewState returns true if the state differs from what we last gave to the StateCallback for
+// the interface.  Until we've told it otherwise, the StateCallback assumes that an interface is
+// down or, with Config.DetailedStates, not present.
+func (m *InterfaceMonitor) isNewState(ifaceName string, state State) bool {
+	delivered, ok := m.deliveredStates[ifaceName]
+	if !ok {
+		delivered = StateDown
+		if m.DetailedStates {
+			delivered = StateNotPresent
+		}
+	}
+	return delivered != state
+}
+
+// deliverState makes the StateCallback, or holds it back if we're paused or batching.
+func (m *InterfaceMonitor) deliverState(ifaceName string, state State, ifIndex int) {
+	if m.paused || m.holdForBatch() {
+		h := m.heldNotification(ifaceName)
+		h.hasState = true
+		h.state = state
+		h.ifIndex = ifIndex
+		return
+	}
+	if m.DetailedStates && !m.isNewState(ifaceName, state) {
+		// For example, an interface that we never reported has been deleted.
+		return
+	}
+	m.deliverStateNow(ifaceName, state, ifIndex)
+}
+
+func (m *InterfaceMonitor) deliverStateNow(ifaceName string, state State, ifIndex int) {
+	if state == StateDown || state == StateNotPresent {
+		delete(m.deliveredStates, ifaceName)
+	} else {
+		m.deliveredStates[ifaceName] = state
+	}
+	ifaceName, state, ok := m.stateMiddleware(ifaceName, state, ifIndex, m.origin)
+	if !ok {
+		return
+	}
+	if m.StateCallback != nil {
+		m.StateCallback(ifaceName, state, ifIndex)
+	}
+	for _, callback := range m.addedStateCallbacks {
+		callback(ifaceName, state, ifIndex)
+	}
+}
+
+// deliverAddrs makes the AddrCallback, or holds it back if we're paused or batching.
+func (m *InterfaceMonitor) deliverAddrs(ifaceName string, addrs set.Set, ifIndex int) {
+	if m.paused || m.holdForBatch() {
+		h := m.heldNotification(ifaceName)
+		h.hasAddrs = true
+		h.addrs = nil
+		if addrs != nil {
+			// Our copy mustn't change if the caller modifies the set later.
+			h.addrs = addrs.Copy()
+		}
+		h.ifIndex = ifIndex
+		return
+	}
+	m.deliverAddrsNow(ifaceName, addrs, ifIndex)
+}
+
+func (m *InterfaceMonitor) deliverAddrsNow(ifaceName string, addrs set.Set, ifIndex int) {
+	if addrs == nil {
+		delete(m.deliveredAddrs, ifaceName)
+	} else {
+		// Our copy mustn't change if the callback modifies the set.
+		m.deliveredAddrs[ifaceName] = addrs.Copy()
+	}
+	ifaceName, addrs, ok := m.addrsMiddleware(ifaceName, addrs, ifIndex, m.origin)
+	if !ok {
+		return
+	}
+	// Take the added callbacks' copies first, in case the AddrCallback modifies the set.
+	copies := make([]set.Set, len(m.addedAddrCallbacks))
+	var deltaAddrs set.Set
+	if addrs != nil {
+		for i := range copies {
+			copies[i] = addrs.Copy()
+		}
+		if m.AddrDeltaCallback != nil {
+			deltaAddrs = addrs.Copy()
+		}
+	}
+	if m.AddrCallback != nil {
+		m.AddrCallback(ifaceName, addrs)
+	}
+	for i, callback := range m.addedAddrCallbacks {
+		callback(ifaceName, copies[i])
+	}
+	m.notifyAddrDelta(ifaceName, deltaAddrs)
+}
+
+func (m *InterfaceMonitor) heldNotification(ifaceName string) *heldNotification {
+	h := m.heldNotifications[ifaceName]
+	if h == nil {
+		h = &heldNotification{}
+		m.heldNotifications[ifaceName] = h
+	}
+	return h
+}
+
+func addrSetsEqual(a, b set.Set) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Equals(b)
+}
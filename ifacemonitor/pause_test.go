@@ -0,0 +1,145 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ifacemonitor/testutils"
+	"github.com/projectcalico/felix/timeshim/mocktime"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Pause and resume", func() {
+	var nl *netlinkTest
+	var im *ifacemonitor.InterfaceMonitor
+	var mockTime *mocktime.MockTime
+	var recorder *testutils.Recorder
+
+	BeforeEach(func() {
+		mockTime = mocktime.New()
+	})
+
+	AfterEach(func() {
+		im.Stop()
+	})
+
+	// start runs the monitor, with the links that addLinks adds, if non-nil, in the start-of-day
+	// resync.
+	start := func(addLinks func(nl *netlinkTest)) {
+		im, nl, recorder = startMonitor(ifacemonitor.Config{MaxPauseDuration: time.Minute},
+			func(nl *netlinkTest, im *ifacemonitor.InterfaceMonitor) {
+				if addLinks != nil {
+					addLinks(nl)
+				}
+			},
+			withMonitorOps(ifacemonitor.WithMonitorTimeShim(mockTime)),
+			withRecorderOps(testutils.WithTimeShim(mockTime)),
+		)
+	}
+
+	// view summarises the monitor's view of the interfaces, which it keeps up to date even while
+	// paused.
+	view := func() []string {
+		var summary []string
+		for _, status := range im.Interfaces() {
+			summary = append(summary, fmt.Sprintf("%s %s %v", status.Name, status.State, status.Addrs))
+		}
+		return summary
+	}
+
+	It("should deliver a single batch with the final state on resume", func() {
+		start(func(nl *netlinkTest) {
+			setLinkNoSignal(nl, "cali1", "up", "10.0.0.1/32")
+			setLinkNoSignal(nl, "cali2", "up")
+		})
+		Eventually(view).Should(Equal([]string{
+			"cali1 up [10.0.0.1]",
+			"cali2 up []",
+		}))
+		// The initial resync reports the interfaces in no particular order.
+		recorder.ExpectState("cali1", ifacemonitor.StateUp)
+		recorder.ExpectAddrs("cali1", "10.0.0.1")
+		recorder.ExpectState("cali2", ifacemonitor.StateUp)
+		recorder.ExpectAddrs("cali2")
+		Expect(recorder.NewEvents()).To(HaveLen(4))
+
+		im.Pause()
+		for i := 0; i < 10; i++ {
+			// Flapping, with an address that comes and goes.
+			nl.changeLinkState("cali1", "down")
+			nl.addAddr("cali1", "10.0.0.2/32")
+			nl.changeLinkState("cali1", "up")
+			nl.delAddr("cali1", "10.0.0.2/32")
+		}
+		nl.addAddr("cali1", "10.0.0.3/32")
+		nl.changeLinkState("cali2", "down")
+		// An interface that comes and goes while we're paused.
+		nl.addLink("cali3")
+		nl.changeLinkState("cali3", "up")
+		nl.addAddr("cali3", "10.0.3.1/32")
+		nl.delLink("cali3")
+		nl.addLink("cali4")
+		nl.changeLinkState("cali4", "up")
+		nl.addAddr("cali4", "10.0.4.1/32")
+		Eventually(view).Should(Equal([]string{
+			"cali1 up [10.0.0.1 10.0.0.3]",
+			"cali2 down []",
+			"cali4 up [10.0.4.1]",
+		}))
+		recorder.ExpectNoNewEvents()
+
+		im.Resume()
+		recorder.ExpectSequence(
+			testutils.AddrsEvent("cali1", "10.0.0.1", "10.0.0.3"),
+			testutils.StateEvent("cali2", ifacemonitor.StateDown),
+			testutils.AddrsEvent("cali4", "10.0.4.1"),
+			testutils.StateEvent("cali4", ifacemonitor.StateUp),
+		)
+		recorder.ExpectNoEventsFor("cali3")
+		recorder.ExpectNoNewEvents()
+
+		// Back to normal.
+		nl.changeLinkState("cali4", "down")
+		recorder.ExpectSequence(testutils.StateEvent("cali4", ifacemonitor.StateDown))
+	})
+
+	It("should resume by itself after the maximum pause", func() {
+		start(nil)
+		pausedAt := mockTime.Now()
+		im.Pause()
+		nl.addLink("cali1")
+		nl.changeLinkState("cali1", "up")
+		Eventually(view).Should(Equal([]string{"cali1 up []"}))
+
+		mockTime.IncrementTime(59 * time.Second)
+		recorder.ExpectNoNewEvents()
+		// The recorder moves the clock on while it waits, until the pause runs out.
+		recorder.ExpectSequence(
+			testutils.AddrsEvent("cali1"),
+			testutils.StateEvent("cali1", ifacemonitor.StateUp),
+		)
+		Expect(recorder.Events()[1].Time.Sub(pausedAt)).To(BeNumerically("~", time.Minute, 50*time.Millisecond))
+
+		nl.changeLinkState("cali1", "down")
+		recorder.ExpectState("cali1", ifacemonitor.StateDown)
+	})
+})
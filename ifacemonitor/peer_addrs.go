@@ -0,0 +1,98 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// PeerAddrCallback is called with the peer addresses of a point-to-point interface (such as a
+// tunnel or PPP device), as a map from local address to the address of the remote end.  The map
+// is empty when the interface no longer has any peer addresses.
+type PeerAddrCallback func(ifaceName string, peerAddrs map[string]string)
+
+// refreshPeerAddrs re-reads the peer addresses of a point-to-point interface and notifies the
+// PeerAddrCallback if they changed.  Called whenever the interface's addresses change.  The
+// local routes that we use to track addresses don't include the peer address so we have to
+// list the addresses to get it (the IFA_ADDRESS attribute, as opposed to IFA_LOCAL).
+func (m *InterfaceMonitor) refreshPeerAddrs(ifIndex int) {
+	if m.PeerAddrCallback == nil {
+		return
+	}
+	ifaceName, known := m.ifaceName[ifIndex]
+	if !known {
+		return
+	}
+	newPeers := map[string]string{}
+	if m.ifaceAddrs[ifIndex] != nil && m.linkAttrs[ifIndex].rawFlags&syscall.IFF_POINTOPOINT != 0 {
+		link := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: ifaceName, Index: ifIndex}}
+		for _, family := range [2]int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+			addrs, err := m.netlinkStub.AddrList(link, family)
+			if err != nil {
+				log.WithError(err).Warn("Netlink address list operation failed.")
+				return
+			}
+			for _, addr := range addrs {
+				if addr.IPNet == nil || addr.Peer == nil || addr.Peer.IP.Equal(addr.IP) {
+					continue
+				}
+				newPeers[addr.IP.String()] = addr.Peer.IP.String()
+			}
+		}
+	}
+	m.storeAndNotifyPeerAddrs(ifIndex, ifaceName, newPeers)
+}
+
+func (m *InterfaceMonitor) storeAndNotifyPeerAddrs(ifIndex int, ifaceName string, newPeers map[string]string) {
+	if m.PeerAddrCallback == nil {
+		return
+	}
+	if stringMapsEqual(m.peerAddrs[ifIndex], newPeers) {
+		return
+	}
+	if len(newPeers) == 0 {
+		delete(m.peerAddrs, ifIndex)
+	} else {
+		m.peerAddrs[ifIndex] = newPeers
+	}
+	log.WithFields(log.Fields{
+		"ifaceName": ifaceName,
+		"peerAddrs": newPeers,
+	}).Info("Interface peer addresses changed.")
+
+	// Take a copy, so that the callback's map is independent of ours.
+	peersCopy := make(map[string]string, len(newPeers))
+	for local, peer := range newPeers {
+		peersCopy[local] = peer
+	}
+	m.PeerAddrCallback(ifaceName, peersCopy)
+}
+
+func stringMapsEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,37 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// readProtodown returns the protodown state of an interface if TrackProtodown is enabled.  The
+// version of the netlink library that we use doesn't parse IFLA_PROTO_DOWN so we read it from
+// /sys/class/net instead.  Interfaces whose driver doesn't support protodown always read as 0.
+func (m *InterfaceMonitor) readProtodown(ifaceName string) bool {
+	if !m.TrackProtodown || m.isExcludedInterface(ifaceName) {
+		return false
+	}
+	protodown, err := m.readSysfsAttr(ifaceName, "proto_down")
+	if err != nil {
+		// Most likely, the interface has just been removed.
+		log.WithError(err).WithField("ifaceName", ifaceName).Debug("Failed to read proto_down.")
+		return false
+	}
+	return protodown == "1"
+}
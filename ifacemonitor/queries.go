@@ -0,0 +1,87 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"sort"
+	"sync/atomic"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+// UpInterfaces returns the names of the interfaces that the monitor has reported as up, sorted.
+// Unlike Interfaces, it doesn't need a round trip to the monitor's goroutine, so it is safe to
+// call from any goroutine, including from within the monitor's callbacks.
+func (m *InterfaceMonitor) UpInterfaces() []string {
+	m.upWaitersLock.Lock()
+	names := make([]string, 0, len(m.upNames))
+	for name := range m.upNames {
+		names = append(names, name)
+	}
+	m.upWaitersLock.Unlock()
+	sort.Strings(names)
+	return names
+}
+
+// IsUp returns true if the monitor has reported the named interface as up.  Like UpInterfaces,
+// it is safe to call from any goroutine.
+func (m *InterfaceMonitor) IsUp(ifaceName string) bool {
+	m.upWaitersLock.Lock()
+	defer m.upWaitersLock.Unlock()
+	return m.upNames[ifaceName]
+}
+
+// InSync returns true once the monitor has reported all the interfaces that existed when it
+// started.  Until then, the answers to the other queries only cover the interfaces reported so
+// far, so an interface that they don't mention may still exist.
+func (m *InterfaceMonitor) InSync() bool {
+	return atomic.LoadInt32(&m.inSync) != 0
+}
+
+// InterfaceAddrs returns the addresses that the monitor last reported for the named interface,
+// sorted, or nil if it hasn't reported any (or has reported that they've gone).  Like
+// UpInterfaces, it is safe to call from any goroutine, including from within the callbacks.
+func (m *InterfaceMonitor) InterfaceAddrs(ifaceName string) []string {
+	m.reportedAddrsLock.Lock()
+	defer m.reportedAddrsLock.Unlock()
+	addrs, known := m.reportedAddrNames[ifaceName]
+	if !known {
+		return nil
+	}
+	return append([]string{}, addrs...)
+}
+
+// recordReportedAddrs is called on the monitor's goroutine, before the callbacks, for each
+// address notification.  nil addrs means the interface has gone.
+func (m *InterfaceMonitor) recordReportedAddrs(ifaceName string, addrs set.Set) {
+	var sorted []string
+	if addrs != nil {
+		sorted = []string{}
+		addrs.Iter(func(item interface{}) error {
+			sorted = append(sorted, item.(string))
+			return nil
+		})
+		sort.Strings(sorted)
+	}
+	m.reportedAddrsLock.Lock()
+	defer m.reportedAddrsLock.Unlock()
+	if sorted == nil {
+		delete(m.reportedAddrNames, ifaceName)
+		return
+	}
+	m.reportedAddrNames[ifaceName] = sorted
+}
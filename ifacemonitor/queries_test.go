@@ -0,0 +1,132 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("State queries", func() {
+	var nl *netlinkTest
+	var im *ifacemonitor.InterfaceMonitor
+	var updates chan string
+
+	BeforeEach(func() {
+		// The callbacks use their own monitor and channel, which can't be replaced under them
+		// by the next spec if this monitor is still stopping.
+		updatesC := make(chan string, 10)
+		updates = updatesC
+		im, nl, _ = startMonitor(ifacemonitor.Config{}, func(nl *netlinkTest, monitor *ifacemonitor.InterfaceMonitor) {
+			setLinkNoSignal(nl, "eth0", "up", "10.0.0.1/32")
+			// The callbacks query the monitor, which must not deadlock, and see the state
+			// that they're being told about.
+			monitor.StateCallback = func(ifaceName string, state ifacemonitor.State, ifIndex int) {
+				updatesC <- fmt.Sprintf("%s %s up=%v", ifaceName, state, monitor.UpInterfaces())
+			}
+			monitor.AddrCallback = func(ifaceName string, addrs set.Set) {
+				updatesC <- fmt.Sprintf("%s addrs=%v", ifaceName, monitor.InterfaceAddrs(ifaceName))
+			}
+		})
+		Eventually(updates).Should(Receive(Equal("eth0 up up=[eth0]")))
+		Eventually(updates).Should(Receive(Equal("eth0 addrs=[10.0.0.1]")))
+	})
+
+	AfterEach(func() {
+		im.Stop()
+	})
+
+	It("should be answered from within the callbacks", func() {
+		nl.addLink("cali1")
+		Eventually(updates).Should(Receive(Equal("cali1 addrs=[]")))
+		nl.changeLinkState("cali1", "up")
+		Eventually(updates).Should(Receive(Equal("cali1 up up=[cali1 eth0]")))
+		nl.addAddr("cali1", "10.0.1.1/32")
+		Eventually(updates).Should(Receive(Equal("cali1 addrs=[10.0.1.1]")))
+
+		nl.delLink("cali1")
+		Eventually(updates).Should(Receive(Equal("cali1 addrs=[]")))
+		Eventually(updates).Should(Receive(Equal("cali1 down up=[eth0]")))
+	})
+
+	It("should be answered from other goroutines", func() {
+		nl.addAddr("eth0", "10.0.0.2/32")
+		Eventually(func() []string {
+			return im.InterfaceAddrs("eth0")
+		}).Should(Equal([]string{"10.0.0.1", "10.0.0.2"}))
+		Expect(im.UpInterfaces()).To(Equal([]string{"eth0"}))
+		Expect(im.IsUp("eth0")).To(BeTrue())
+		Expect(im.InterfaceAddrs("cali1")).To(BeNil())
+		Expect(im.IsUp("cali1")).To(BeFalse())
+		Expect(im.InSync()).To(BeTrue())
+
+		nl.changeLinkState("eth0", "down")
+		Eventually(im.UpInterfaces).Should(BeEmpty())
+		Expect(im.IsUp("eth0")).To(BeFalse())
+	})
+
+	It("should say that it isn't in sync before the monitor has started", func() {
+		notStarted := ifacemonitor.NewWithStubs(ifacemonitor.Config{}, nl, make(chan time.Time))
+		Expect(notStarted.InSync()).To(BeFalse())
+		Expect(notStarted.UpInterfaces()).To(BeEmpty())
+	})
+
+	It("should be safe to hammer while interfaces come and go", func() {
+		doneC := make(chan struct{})
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-doneC:
+						return
+					default:
+					}
+					im.UpInterfaces()
+					im.IsUp("cali1")
+					im.InterfaceAddrs("cali1")
+					im.InSync()
+					time.Sleep(100 * time.Microsecond)
+				}
+			}()
+		}
+
+		for i := 0; i < 5; i++ {
+			nl.addLink("cali1")
+			Eventually(updates).Should(Receive(Equal("cali1 addrs=[]")))
+			nl.changeLinkState("cali1", "up")
+			Eventually(updates).Should(Receive(Equal("cali1 up up=[cali1 eth0]")))
+			nl.addAddr("cali1", "10.0.1.1/32")
+			Eventually(updates).Should(Receive(Equal("cali1 addrs=[10.0.1.1]")))
+			nl.delLink("cali1")
+			Eventually(updates).Should(Receive(Equal("cali1 addrs=[]")))
+			Eventually(updates).Should(Receive(Equal("cali1 down up=[eth0]")))
+		}
+		close(doneC)
+		wg.Wait()
+	})
+})
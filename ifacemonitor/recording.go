@@ -0,0 +1,474 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// A recording is a file of newline-delimited JSON.  The first line is a recordingHeader and
+// each of the others is a recordedEvent: an update from netlink, a resync trigger or a request
+// that the monitor made (to netlink or /sys) along with its result, in the order that the
+// monitor's main loop saw them.  Updates are recorded as they come out of the flap damping
+// filter, just before they are handled, so the recording captures exactly what the monitor
+// acted on.  Fields may be added to the format without changing recordingVersion: readers ignore
+// fields that they don't know and fields that are missing read as zero.  The version is only
+// bumped for changes that an older reader would misinterpret.
+const recordingVersion = 1
+
+type recordingHeader struct {
+	Version int       `json:"version"`
+	Start   time.Time `json:"start"`
+	// Config is the part of the monitor's config that affects its behaviour.
+	Config *helperConfig `json:"config"`
+}
+
+// Types of recordedEvent.  The first four are inputs to the monitor's main loop; the others are
+// requests made by the monitor.
+const (
+	recordedLinkUpdate         = "link-update"
+	recordedRouteUpdate        = "route-update"
+	recordedDefaultRouteUpdate = "default-route-update"
+	recordedResync             = "resync"
+	recordedSubscribe          = "subscribe"
+	recordedLinkList           = "link-list"
+	recordedLocalRoutes        = "local-routes"
+	recordedDefaultRoutes      = "default-routes"
+	recordedAddrList           = "addr-list"
+	recordedAltNames           = "alt-names"
+	recordedCapabilities       = "capabilities"
+	recordedSysfsRead          = "sysfs-read"
+)
+
+type recordedEvent struct {
+	Type string `json:"type"`
+	// Offset is the time since the start of the recording.
+	Offset time.Duration `json:"offset"`
+
+	// The arguments of requests.
+	Groups  NetlinkGroups `json:"groups,omitempty"`
+	IfIndex int           `json:"if_index,omitempty"`
+	Family  int           `json:"family,omitempty"`
+	Path    string        `json:"path,omitempty"`
+
+	// The results of requests, or the content of updates.
+	Err string `json:"err,omitempty"`
+	// MsgType is the netlink message type of an update, for example RTM_NEWLINK.
+	MsgType uint16 `json:"msg_type,omitempty"`
+	// Change is the change mask of a link update.
+	Change       uint32              `json:"change,omitempty"`
+	Links        []recordedLink      `json:"links,omitempty"`
+	Routes       []recordedRoute     `json:"routes,omitempty"`
+	Addrs        []recordedAddr      `json:"addrs,omitempty"`
+	AltNames     []string            `json:"alt_names,omitempty"`
+	Capabilities *KernelCapabilities `json:"capabilities,omitempty"`
+	Data         string              `json:"data,omitempty"`
+}
+
+// recordedLink holds the attributes of a link that the monitor uses.  Kind is the netlink link
+// type; Mode and ActiveSlave are only set for the kinds that have them.
+type recordedLink struct {
+	Kind         string `json:"kind"`
+	Index        int    `json:"index"`
+	Name         string `json:"name"`
+	MTU          int    `json:"mtu,omitempty"`
+	HardwareAddr string `json:"hardware_addr,omitempty"`
+	Flags        uint   `json:"flags,omitempty"`
+	RawFlags     uint32 `json:"raw_flags,omitempty"`
+	OperState    uint8  `json:"oper_state,omitempty"`
+	ParentIndex  int    `json:"parent_index,omitempty"`
+	MasterIndex  int    `json:"master_index,omitempty"`
+	Alias        string `json:"alias,omitempty"`
+	EncapType    string `json:"encap_type,omitempty"`
+	Mode         int    `json:"mode,omitempty"`
+	ActiveSlave  int    `json:"active_slave,omitempty"`
+}
+
+type recordedNexthop struct {
+	LinkIndex int    `json:"link_index"`
+	Gw        string `json:"gw,omitempty"`
+}
+
+type recordedRoute struct {
+	LinkIndex int               `json:"link_index"`
+	Dst       string            `json:"dst,omitempty"`
+	Src       string            `json:"src,omitempty"`
+	Gw        string            `json:"gw,omitempty"`
+	Table     int               `json:"table,omitempty"`
+	Type      int               `json:"type,omitempty"`
+	Scope     uint8             `json:"scope,omitempty"`
+	Protocol  int               `json:"protocol,omitempty"`
+	MultiPath []recordedNexthop `json:"multi_path,omitempty"`
+}
+
+type recordedAddr struct {
+	IPNet     string `json:"ipnet"`
+	Peer      string `json:"peer,omitempty"`
+	Label     string `json:"label,omitempty"`
+	Flags     int    `json:"flags,omitempty"`
+	Scope     int    `json:"scope,omitempty"`
+	LinkIndex int    `json:"link_index,omitempty"`
+}
+
+func newRecordedLink(link netlink.Link) recordedLink {
+	attrs := link.Attrs()
+	rl := recordedLink{
+		Kind:         link.Type(),
+		Index:        attrs.Index,
+		Name:         attrs.Name,
+		MTU:          attrs.MTU,
+		HardwareAddr: attrs.HardwareAddr.String(),
+		Flags:        uint(attrs.Flags),
+		RawFlags:     attrs.RawFlags,
+		OperState:    uint8(attrs.OperState),
+		ParentIndex:  attrs.ParentIndex,
+		MasterIndex:  attrs.MasterIndex,
+		Alias:        attrs.Alias,
+		EncapType:    attrs.EncapType,
+	}
+	switch l := link.(type) {
+	case *netlink.Macvlan:
+		rl.Mode = int(l.Mode)
+	case *netlink.IPVlan:
+		rl.Mode = int(l.Mode)
+	case *netlink.Bond:
+		rl.ActiveSlave = l.ActiveSlave
+	}
+	return rl
+}
+
+// link converts back to a netlink.Link of the same concrete type, for the kinds that the monitor
+// cares about.  Other kinds become GenericLinks of the same Type().
+func (rl *recordedLink) link() netlink.Link {
+	attrs := netlink.LinkAttrs{
+		Index:       rl.Index,
+		Name:        rl.Name,
+		MTU:         rl.MTU,
+		Flags:       net.Flags(rl.Flags),
+		RawFlags:    rl.RawFlags,
+		OperState:   netlink.LinkOperState(rl.OperState),
+		ParentIndex: rl.ParentIndex,
+		MasterIndex: rl.MasterIndex,
+		Alias:       rl.Alias,
+		EncapType:   rl.EncapType,
+	}
+	if rl.HardwareAddr != "" {
+		attrs.HardwareAddr, _ = net.ParseMAC(rl.HardwareAddr)
+	}
+	switch rl.Kind {
+	case "device":
+		return &netlink.Device{LinkAttrs: attrs}
+	case "veth":
+		return &netlink.Veth{LinkAttrs: attrs}
+	case "bond":
+		return &netlink.Bond{LinkAttrs: attrs, ActiveSlave: rl.ActiveSlave}
+	case "macvlan":
+		return &netlink.Macvlan{LinkAttrs: attrs, Mode: netlink.MacvlanMode(rl.Mode)}
+	case "ipvlan":
+		return &netlink.IPVlan{LinkAttrs: attrs, Mode: netlink.IPVlanMode(rl.Mode)}
+	default:
+		return &netlink.GenericLink{LinkAttrs: attrs, LinkType: rl.Kind}
+	}
+}
+
+func newRecordedRoute(route *netlink.Route) recordedRoute {
+	rr := recordedRoute{
+		LinkIndex: route.LinkIndex,
+		Table:     route.Table,
+		Type:      route.Type,
+		Scope:     uint8(route.Scope),
+		Protocol:  int(route.Protocol),
+	}
+	if route.Dst != nil {
+		rr.Dst = route.Dst.String()
+	}
+	if route.Src != nil {
+		rr.Src = route.Src.String()
+	}
+	if route.Gw != nil {
+		rr.Gw = route.Gw.String()
+	}
+	for _, nh := range route.MultiPath {
+		rnh := recordedNexthop{LinkIndex: nh.LinkIndex}
+		if nh.Gw != nil {
+			rnh.Gw = nh.Gw.String()
+		}
+		rr.MultiPath = append(rr.MultiPath, rnh)
+	}
+	return rr
+}
+
+func (rr *recordedRoute) route() netlink.Route {
+	route := netlink.Route{
+		LinkIndex: rr.LinkIndex,
+		Src:       net.ParseIP(rr.Src),
+		Gw:        net.ParseIP(rr.Gw),
+		Table:     rr.Table,
+		Type:      rr.Type,
+		Scope:     netlink.Scope(rr.Scope),
+		Protocol:  netlink.RouteProtocol(rr.Protocol),
+	}
+	route.Dst = parseIPNet(rr.Dst)
+	for _, rnh := range rr.MultiPath {
+		route.MultiPath = append(route.MultiPath, &netlink.NexthopInfo{
+			LinkIndex: rnh.LinkIndex,
+			Gw:        net.ParseIP(rnh.Gw),
+		})
+	}
+	return route
+}
+
+func newRecordedAddr(addr *netlink.Addr) recordedAddr {
+	ra := recordedAddr{
+		Label:     addr.Label,
+		Flags:     addr.Flags,
+		Scope:     addr.Scope,
+		LinkIndex: addr.LinkIndex,
+	}
+	if addr.IPNet != nil {
+		ra.IPNet = addr.IPNet.String()
+	}
+	if addr.Peer != nil {
+		ra.Peer = addr.Peer.String()
+	}
+	return ra
+}
+
+func (ra *recordedAddr) addr() netlink.Addr {
+	addr := netlink.Addr{
+		Label:     ra.Label,
+		Flags:     ra.Flags,
+		Scope:     ra.Scope,
+		LinkIndex: ra.LinkIndex,
+	}
+	addr.IPNet = parseIPNet(ra.IPNet)
+	addr.Peer = parseIPNet(ra.Peer)
+	return addr
+}
+
+// parseIPNet parses a CIDR, keeping the host part of the address, as netlink reports it.
+func parseIPNet(cidr string) *net.IPNet {
+	ip, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil
+	}
+	ipNet.IP = ip
+	return ipNet
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// recorder writes a recording to the RecordFile.
+type recorder struct {
+	lock   sync.Mutex
+	file   *os.File
+	enc    *json.Encoder
+	start  time.Time
+	failed bool
+}
+
+// startRecording opens the RecordFile, if configured, and wraps our netlink and sysfs stubs so
+// that everything that passes through them is recorded.  Returns nil if we're not recording.
+// Problems with the file are logged and otherwise ignored.
+func (m *InterfaceMonitor) startRecording() *recorder {
+	if m.RecordFile == "" {
+		return nil
+	}
+	logCxt := log.WithField("file", m.RecordFile)
+	f, err := os.OpenFile(m.RecordFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		logCxt.WithError(err).Warn("Failed to open interface monitor record file, not recording.")
+		return nil
+	}
+	r := &recorder{
+		file:  f,
+		enc:   json.NewEncoder(f),
+		start: time.Now(),
+	}
+	if err := r.enc.Encode(&recordingHeader{
+		Version: recordingVersion,
+		Start:   r.start,
+		Config:  newHelperConfig(m.Config),
+	}); err != nil {
+		logCxt.WithError(err).Warn("Failed to write interface monitor record file, not recording.")
+		_ = f.Close()
+		return nil
+	}
+	logCxt.Info("Recording netlink updates and requests.")
+	m.netlinkStub = &recordingNetlink{netlinkStub: m.netlinkStub, rec: r}
+	m.sysfs = &recordingSysfs{sysfsStub: m.sysfs, rec: r}
+	m.recorder = r
+	return r
+}
+
+// recordLinkUpdate records a link update that the main loop is about to handle, if we're
+// recording.
+func (m *InterfaceMonitor) recordLinkUpdate(update netlink.LinkUpdate) {
+	if m.recorder == nil {
+		return
+	}
+	event := &recordedEvent{
+		Type:    recordedLinkUpdate,
+		MsgType: update.Header.Type,
+		Change:  update.IfInfomsg.Change,
+	}
+	if update.Link != nil && update.Link.Attrs() != nil {
+		event.Links = []recordedLink{newRecordedLink(update.Link)}
+	}
+	m.recorder.record(event)
+}
+
+// recordRouteUpdate records an address (local route) or default route update that the main loop
+// is about to handle, if we're recording.
+func (m *InterfaceMonitor) recordRouteUpdate(eventType string, update netlink.RouteUpdate) {
+	if m.recorder == nil {
+		return
+	}
+	m.recorder.record(&recordedEvent{
+		Type:    eventType,
+		MsgType: update.Type,
+		Routes:  []recordedRoute{newRecordedRoute(&update.Route)},
+	})
+}
+
+// recordResync records a periodic resync trigger, if we're recording.
+func (m *InterfaceMonitor) recordResync() {
+	if m.recorder == nil {
+		return
+	}
+	m.recorder.record(&recordedEvent{Type: recordedResync})
+}
+
+func (r *recorder) record(event *recordedEvent) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.failed {
+		return
+	}
+	event.Offset = time.Since(r.start)
+	if err := r.enc.Encode(event); err != nil {
+		log.WithError(err).Warn("Failed to write interface monitor record file, no longer recording.")
+		r.failed = true
+	}
+}
+
+func (r *recorder) close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.failed = true
+	if err := r.file.Close(); err != nil {
+		log.WithError(err).Warn("Failed to close interface monitor record file.")
+	}
+}
+
+// recordingNetlink wraps a netlinkStub, recording the subscription and the results of the
+// requests that we make.  The updates are recorded by the main loop.
+type recordingNetlink struct {
+	netlinkStub
+	rec *recorder
+}
+
+func (nl *recordingNetlink) Subscribe(groups NetlinkGroups, updates chan<- NetlinkUpdate, done <-chan struct{}) error {
+	err := nl.netlinkStub.Subscribe(groups, updates, done)
+	nl.rec.record(&recordedEvent{Type: recordedSubscribe, Groups: groups, Err: errString(err)})
+	return err
+}
+
+func (nl *recordingNetlink) LinkList() ([]netlink.Link, error) {
+	links, err := nl.netlinkStub.LinkList()
+	event := &recordedEvent{Type: recordedLinkList, Err: errString(err)}
+	for _, link := range links {
+		if link.Attrs() != nil {
+			event.Links = append(event.Links, newRecordedLink(link))
+		}
+	}
+	nl.rec.record(event)
+	return links, err
+}
+
+func (nl *recordingNetlink) ListLocalRoutes(link netlink.Link, family int) ([]netlink.Route, error) {
+	routes, err := nl.netlinkStub.ListLocalRoutes(link, family)
+	nl.recordRoutes(recordedLocalRoutes, linkIndex(link), family, routes, err)
+	return routes, err
+}
+
+func (nl *recordingNetlink) ListDefaultRoutes(family int) ([]netlink.Route, error) {
+	routes, err := nl.netlinkStub.ListDefaultRoutes(family)
+	nl.recordRoutes(recordedDefaultRoutes, 0, family, routes, err)
+	return routes, err
+}
+
+func (nl *recordingNetlink) recordRoutes(eventType string, ifIndex, family int, routes []netlink.Route, err error) {
+	event := &recordedEvent{Type: eventType, IfIndex: ifIndex, Family: family, Err: errString(err)}
+	for i := range routes {
+		event.Routes = append(event.Routes, newRecordedRoute(&routes[i]))
+	}
+	nl.rec.record(event)
+}
+
+func (nl *recordingNetlink) AddrList(link netlink.Link, family int) ([]netlink.Addr, error) {
+	addrs, err := nl.netlinkStub.AddrList(link, family)
+	event := &recordedEvent{Type: recordedAddrList, IfIndex: linkIndex(link), Family: family, Err: errString(err)}
+	for i := range addrs {
+		event.Addrs = append(event.Addrs, newRecordedAddr(&addrs[i]))
+	}
+	nl.rec.record(event)
+	return addrs, err
+}
+
+func (nl *recordingNetlink) LinkAltNames(ifIndex int) ([]string, error) {
+	altNames, err := nl.netlinkStub.LinkAltNames(ifIndex)
+	nl.rec.record(&recordedEvent{Type: recordedAltNames, IfIndex: ifIndex, AltNames: altNames, Err: errString(err)})
+	return altNames, err
+}
+
+func (nl *recordingNetlink) ProbeCapabilities() KernelCapabilities {
+	caps := nl.netlinkStub.ProbeCapabilities()
+	nl.rec.record(&recordedEvent{Type: recordedCapabilities, Capabilities: &caps})
+	return caps
+}
+
+func linkIndex(link netlink.Link) int {
+	if link == nil || link.Attrs() == nil {
+		return 0
+	}
+	return link.Attrs().Index
+}
+
+// recordingSysfs wraps a sysfsStub, recording the files that we read.
+type recordingSysfs struct {
+	sysfsStub
+	rec *recorder
+}
+
+func (s *recordingSysfs) ReadFile(path string) ([]byte, error) {
+	data, err := s.sysfsStub.ReadFile(path)
+	s.rec.record(&recordedEvent{Type: recordedSysfsRead, Path: path, Data: string(data), Err: errString(err)})
+	return data, err
+}
@@ -0,0 +1,426 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// Recording is a recording of the netlink updates that a monitor received and the requests that
+// it made, as written to the Config.RecordFile.  It can be replayed through a real monitor with
+// a Replayer.
+type Recording struct {
+	header recordingHeader
+	events []recordedEvent
+}
+
+// ReadRecordingFile reads a recording from a file.
+func ReadRecordingFile(path string) (*Recording, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadRecording(f)
+}
+
+// ReadRecording reads a recording.  Recordings from a newer, incompatible, version of the format
+// are rejected.
+func ReadRecording(r io.Reader) (*Recording, error) {
+	dec := json.NewDecoder(r)
+	rec := &Recording{}
+	if err := dec.Decode(&rec.header); err != nil {
+		return nil, fmt.Errorf("failed to read recording header: %w", err)
+	}
+	if rec.header.Version < 1 || rec.header.Version > recordingVersion {
+		return nil, fmt.Errorf("unsupported recording version %d (we support up to %d)",
+			rec.header.Version, recordingVersion)
+	}
+	for {
+		var event recordedEvent
+		err := dec.Decode(&event)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read event %d of recording: %w", len(rec.events), err)
+		}
+		rec.events = append(rec.events, event)
+	}
+	return rec, nil
+}
+
+// Config returns the config of the monitor that made the recording, so that the replay can use
+// the same.  Only the parts of the config that affect the monitor's behaviour are recorded.
+func (rec *Recording) Config() (Config, error) {
+	if rec.header.Config == nil {
+		return Config{}, errors.New("recording has no config")
+	}
+	return rec.header.Config.config()
+}
+
+// ReplayTiming controls how fast a Replayer delivers the recorded updates.
+type ReplayTiming int
+
+const (
+	// ReplayCompressed delivers the updates as fast as the monitor takes them.
+	ReplayCompressed ReplayTiming = iota
+	// ReplayOriginalTiming delivers the updates with the same gaps between them as in the
+	// recording.
+	ReplayOriginalTiming
+)
+
+// Replayer replays a Recording through a real monitor, by standing in for netlink and /sys.  It
+// feeds the recorded updates and resync triggers to the monitor's main loop one at a time,
+// waiting for each to be handled, and answers the monitor's requests with the recorded results.
+// Each input is held back until the monitor has made the requests that came before it in the
+// recording.  Since the monitor's requests depend only on its inputs, the replay follows the
+// original run unless the monitor's behaviour has changed (or it has a different config), in
+// which case the replay diverges: the monitor makes a request that doesn't match the recording.
+// The replay then stops and Err returns the details.
+//
+// Since the recorded updates have already been through the flap damping filter, the replayed
+// monitor doesn't filter them again.  Monitors created by NewMonitor shouldn't have a StateFile
+// or RecordFile, and any optional callbacks that cause requests (such as the
+// DefaultRouteCallback) must be set as they were for the recording.
+type Replayer struct {
+	rec     *Recording
+	timing  ReplayTiming
+	resyncC chan time.Time
+	// handledC is signalled by the monitor when it has handled an input.
+	handledC chan struct{}
+
+	lock sync.Mutex
+	// nextReq is the index in rec.events of the next request that we expect from the monitor,
+	// or len(rec.events) if there are no more.
+	nextReq int
+	// progressC is closed and replaced when nextReq advances or the replay diverges.
+	progressC chan struct{}
+	err       error
+
+	doneC chan struct{}
+}
+
+func NewReplayer(rec *Recording, timing ReplayTiming) *Replayer {
+	r := &Replayer{
+		rec:       rec,
+		timing:    timing,
+		resyncC:   make(chan time.Time),
+		handledC:  make(chan struct{}, 1),
+		progressC: make(chan struct{}),
+		doneC:     make(chan struct{}),
+	}
+	r.nextReq = r.findReq(0)
+	return r
+}
+
+// NewMonitor creates a monitor that is driven by the replay.  It is started in the usual way,
+// with MonitorInterfaces or Run.
+func (r *Replayer) NewMonitor(config Config, options ...InterfaceMonitorOp) *InterfaceMonitor {
+	m := NewWithStubs(config, r, r.resyncC, options...)
+	m.sysfs = r
+	m.replayer = r
+	return m
+}
+
+// replayEventHandled is called by the main loop when it has handled an input.
+func (m *InterfaceMonitor) replayEventHandled() {
+	if m.replayer == nil {
+		return
+	}
+	select {
+	case m.replayer.handledC <- struct{}{}:
+	default:
+		// We only deliver one input at a time so there can't be a signal pending.
+	}
+}
+
+// Done returns a channel that is closed once every recorded input has been handled and the
+// monitor has made every recorded request.
+func (r *Replayer) Done() <-chan struct{} {
+	return r.doneC
+}
+
+// Err returns the reason that the replay diverged, or nil if it hasn't.
+func (r *Replayer) Err() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.err
+}
+
+// isRecordedInput returns true for the events that are inputs to the main loop, rather than
+// requests.
+func isRecordedInput(event *recordedEvent) bool {
+	switch event.Type {
+	case recordedLinkUpdate, recordedRouteUpdate, recordedDefaultRouteUpdate, recordedResync:
+		return true
+	}
+	return false
+}
+
+// findReq returns the index of the first request in rec.events at or after start.
+func (r *Replayer) findReq(start int) int {
+	for i := start; i < len(r.rec.events); i++ {
+		if !isRecordedInput(&r.rec.events[i]) {
+			return i
+		}
+	}
+	return len(r.rec.events)
+}
+
+// nextRequest checks that a request from the monitor matches the next request in the recording
+// and, if so, returns the recorded event for it.
+func (r *Replayer) nextRequest(eventType string, ifIndex, family int, path string) (*recordedEvent, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.err != nil {
+		return nil, r.err
+	}
+	describe := func(eventType string, ifIndex, family int, path string) string {
+		return fmt.Sprintf("%s (ifIndex=%d family=%d path=%q)", eventType, ifIndex, family, path)
+	}
+	req := describe(eventType, ifIndex, family, path)
+	if r.nextReq >= len(r.rec.events) {
+		r.diverged(fmt.Errorf("replay diverged: monitor made request %s after the end of the recording", req))
+		return nil, r.err
+	}
+	event := &r.rec.events[r.nextReq]
+	if event.Type != eventType || event.IfIndex != ifIndex || event.Family != family || event.Path != path {
+		r.diverged(fmt.Errorf("replay diverged at event %d: monitor made request %s but the recording has %s",
+			r.nextReq, req, describe(event.Type, event.IfIndex, event.Family, event.Path)))
+		return nil, r.err
+	}
+	r.nextReq = r.findReq(r.nextReq + 1)
+	r.signalProgress()
+	if event.Err != "" {
+		return event, errors.New(event.Err)
+	}
+	return event, nil
+}
+
+func (r *Replayer) diverged(err error) {
+	log.WithError(err).Error("Replay diverged from the recording.")
+	r.err = err
+	r.signalProgress()
+}
+
+func (r *Replayer) signalProgress() {
+	close(r.progressC)
+	r.progressC = make(chan struct{})
+}
+
+// waitForRequestsBefore waits until the monitor has made all the recorded requests before the
+// given index.  Returns false if the replay diverges or the monitor stops first.
+func (r *Replayer) waitForRequestsBefore(idx int, done <-chan struct{}) bool {
+	for {
+		r.lock.Lock()
+		reached := r.nextReq >= idx
+		failed := r.err != nil
+		progressC := r.progressC
+		r.lock.Unlock()
+		if failed {
+			return false
+		}
+		if reached {
+			return true
+		}
+		select {
+		case <-progressC:
+		case <-done:
+			return false
+		}
+	}
+}
+
+// deliverInputs delivers the recorded inputs that follow the subscription at subIdx.
+func (r *Replayer) deliverInputs(
+	subIdx int,
+	updates chan<- NetlinkUpdate,
+	done <-chan struct{},
+) {
+	start := time.Now()
+	baseOffset := r.rec.events[subIdx].Offset
+	for i := subIdx + 1; i < len(r.rec.events); i++ {
+		event := &r.rec.events[i]
+		if !isRecordedInput(event) {
+			continue
+		}
+		if !r.waitForRequestsBefore(i, done) {
+			return
+		}
+		if r.timing == ReplayOriginalTiming {
+			if delay := time.Until(start.Add(event.Offset - baseOffset)); delay > 0 {
+				select {
+				case <-time.After(delay):
+				case <-done:
+					return
+				}
+			}
+		}
+		if !r.deliverInput(event, updates, done) {
+			return
+		}
+	}
+	if r.waitForRequestsBefore(len(r.rec.events), done) {
+		log.Info("Replay complete.")
+		close(r.doneC)
+	}
+}
+
+// deliverInput delivers one input to the main loop and waits for it to be handled.  Returns
+// false if the monitor stops first.
+func (r *Replayer) deliverInput(
+	event *recordedEvent,
+	updates chan<- NetlinkUpdate,
+	done <-chan struct{},
+) bool {
+	switch event.Type {
+	case recordedResync:
+		select {
+		case r.resyncC <- time.Now():
+		case <-done:
+			return false
+		}
+	case recordedLinkUpdate:
+		if len(event.Links) == 0 {
+			return true
+		}
+		update := netlink.LinkUpdate{Link: event.Links[0].link()}
+		update.Header.Type = event.MsgType
+		update.IfInfomsg.Index = int32(event.Links[0].Index)
+		update.IfInfomsg.Flags = event.Links[0].RawFlags
+		update.IfInfomsg.Change = event.Change
+		select {
+		case updates <- NetlinkUpdate{Link: &update}:
+		case <-done:
+			return false
+		}
+	default:
+		// Address and default route updates arrive on the same channel; the monitor splits
+		// them.
+		if len(event.Routes) == 0 {
+			return true
+		}
+		update := netlink.RouteUpdate{Type: event.MsgType, Route: event.Routes[0].route()}
+		select {
+		case updates <- NetlinkUpdate{Route: &update}:
+		case <-done:
+			return false
+		}
+	}
+	select {
+	case <-r.handledC:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+func (r *Replayer) Subscribe(groups NetlinkGroups, updates chan<- NetlinkUpdate, done <-chan struct{}) error {
+	r.lock.Lock()
+	subIdx := r.nextReq
+	r.lock.Unlock()
+	event, err := r.nextRequest(recordedSubscribe, 0, 0, "")
+	if err != nil {
+		return err
+	}
+	if event.Groups != groups {
+		r.lock.Lock()
+		r.diverged(fmt.Errorf("replay diverged: monitor subscribed to groups %v but the recording has %v",
+			groups, event.Groups))
+		r.lock.Unlock()
+		return r.Err()
+	}
+	go r.deliverInputs(subIdx, updates, done)
+	return nil
+}
+
+func (r *Replayer) LinkList() ([]netlink.Link, error) {
+	event, err := r.nextRequest(recordedLinkList, 0, 0, "")
+	if event == nil {
+		return nil, err
+	}
+	var links []netlink.Link
+	for i := range event.Links {
+		links = append(links, event.Links[i].link())
+	}
+	return links, err
+}
+
+func (r *Replayer) ListLocalRoutes(link netlink.Link, family int) ([]netlink.Route, error) {
+	return r.routes(r.nextRequest(recordedLocalRoutes, linkIndex(link), family, ""))
+}
+
+func (r *Replayer) ListDefaultRoutes(family int) ([]netlink.Route, error) {
+	return r.routes(r.nextRequest(recordedDefaultRoutes, 0, family, ""))
+}
+
+func (r *Replayer) routes(event *recordedEvent, err error) ([]netlink.Route, error) {
+	if event == nil {
+		return nil, err
+	}
+	var routes []netlink.Route
+	for i := range event.Routes {
+		routes = append(routes, event.Routes[i].route())
+	}
+	return routes, err
+}
+
+func (r *Replayer) AddrList(link netlink.Link, family int) ([]netlink.Addr, error) {
+	event, err := r.nextRequest(recordedAddrList, linkIndex(link), family, "")
+	if event == nil {
+		return nil, err
+	}
+	var addrs []netlink.Addr
+	for i := range event.Addrs {
+		addrs = append(addrs, event.Addrs[i].addr())
+	}
+	return addrs, err
+}
+
+func (r *Replayer) LinkAltNames(ifIndex int) ([]string, error) {
+	event, err := r.nextRequest(recordedAltNames, ifIndex, 0, "")
+	if event == nil {
+		return nil, err
+	}
+	return event.AltNames, err
+}
+
+func (r *Replayer) ProbeCapabilities() KernelCapabilities {
+	event, _ := r.nextRequest(recordedCapabilities, 0, 0, "")
+	if event == nil || event.Capabilities == nil {
+		return KernelCapabilities{}
+	}
+	return *event.Capabilities
+}
+
+// ReadFile stands in for /sys.
+func (r *Replayer) ReadFile(path string) ([]byte, error) {
+	event, err := r.nextRequest(recordedSysfsRead, 0, 0, path)
+	if event == nil {
+		return nil, err
+	}
+	return []byte(event.Data), err
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ifacemonitor/testutils"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Recording and replay", func() {
+	// replay replays the recording through a new monitor, with the recorded config, and checks
+	// that it makes the expected callbacks.
+	replay := func(rec *ifacemonitor.Recording, expected []testutils.Event) {
+		config, err := rec.Config()
+		Expect(err).NotTo(HaveOccurred())
+		replayer := ifacemonitor.NewReplayer(rec, ifacemonitor.ReplayCompressed)
+		m := replayer.NewMonitor(config)
+		recorder := testutils.NewRecorder()
+		recorder.Attach(m)
+		go m.MonitorInterfaces()
+		defer m.Stop()
+		Eventually(replayer.Done()).Should(BeClosed())
+		Expect(replayer.Err()).NotTo(HaveOccurred())
+		recorder.ExpectSequence(expected...)
+		recorder.ExpectNoNewEvents()
+	}
+
+	// fixtureEvents are the callbacks made for the scenario in testdata/replay.jsonl.
+	fixtureEvents := []testutils.Event{
+		testutils.StateEvent("eth0", ifacemonitor.StateUp),
+		testutils.AddrsEvent("eth0", "10.0.0.1"),
+		testutils.AddrsEvent("cali1"),
+		testutils.StateEvent("cali1", ifacemonitor.StateUp),
+		testutils.AddrsEvent("cali1", "10.0.1.1"),
+		testutils.AddrsEvent("eth0", "10.0.0.1", "10.0.0.2"),
+		testutils.AddrsGoneEvent("cali1"),
+		testutils.StateEvent("cali1", ifacemonitor.StateDown),
+	}
+
+	It("should reproduce a recorded run", func() {
+		dir, err := ioutil.TempDir("", "ifacemonitor-test")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+		recordFile := filepath.Join(dir, "recording.jsonl")
+
+		resyncC := make(chan time.Time)
+		doneC := make(chan struct{})
+		m, nl, recorder := startMonitor(ifacemonitor.Config{RecordFile: recordFile}, func(nl *netlinkTest, im *ifacemonitor.InterfaceMonitor) {
+			setLinkNoSignal(nl, "eth0", "up", "10.0.0.1/32")
+		}, withResyncC(resyncC), withDoneC(doneC))
+
+		recorder.ExpectSequence(fixtureEvents[:2]...)
+		nl.addLink("cali1")
+		recorder.ExpectSequence(fixtureEvents[2])
+		nl.changeLinkState("cali1", "up")
+		recorder.ExpectSequence(fixtureEvents[3])
+		nl.addAddr("cali1", "10.0.1.1/32")
+		recorder.ExpectSequence(fixtureEvents[4])
+		// An address that is only picked up by a resync.
+		setLinkNoSignal(nl, "eth0", "up", "10.0.0.1/32", "10.0.0.2/32")
+		resyncC <- time.Now()
+		recorder.ExpectSequence(fixtureEvents[5])
+		nl.delLink("cali1")
+		recorder.ExpectSequence(fixtureEvents[6:]...)
+		m.Stop()
+		Eventually(doneC).Should(BeClosed())
+
+		rec, err := ifacemonitor.ReadRecordingFile(recordFile)
+		Expect(err).NotTo(HaveOccurred())
+		replay(rec, recorder.Events())
+	})
+
+	It("should replay the bundled recording", func() {
+		rec, err := ifacemonitor.ReadRecordingFile("testdata/replay.jsonl")
+		Expect(err).NotTo(HaveOccurred())
+		replay(rec, fixtureEvents)
+	})
+
+	It("should detect when the monitor diverges from the recording", func() {
+		rec, err := ifacemonitor.ReadRecordingFile("testdata/replay.jsonl")
+		Expect(err).NotTo(HaveOccurred())
+		config, err := rec.Config()
+		Expect(err).NotTo(HaveOccurred())
+		config.DisableAddrMonitoring = true
+		replayer := ifacemonitor.NewReplayer(rec, ifacemonitor.ReplayCompressed)
+		m := replayer.NewMonitor(config)
+		testutils.NewRecorder().Attach(m)
+		runErrC := make(chan error, 1)
+		go func() {
+			runErrC <- m.Run()
+		}()
+		defer m.Stop()
+		Eventually(replayer.Err).Should(MatchError(ContainSubstring("replay diverged")))
+		Consistently(replayer.Done()).ShouldNot(BeClosed())
+		Eventually(runErrC).Should(Receive(HaveOccurred()))
+	})
+
+	It("should ignore fields that it doesn't know about", func() {
+		rec, err := ifacemonitor.ReadRecording(strings.NewReader(
+			`{"version":1,"config":{},"new_header_field":true}` + "\n" +
+				`{"type":"subscribe","groups":3,"new_event_field":"foo"}` + "\n"))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = rec.Config()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should reject recordings from a newer version of the format", func() {
+		_, err := ifacemonitor.ReadRecording(strings.NewReader(`{"version":2,"config":{}}` + "\n"))
+		Expect(err).To(MatchError(ContainSubstring("unsupported recording version 2")))
+	})
+})
@@ -0,0 +1,98 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"context"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// subscribeUpdates subscribes to netlink and starts the goroutines that pick out the default
+// route updates (if we're tracking the default route) and filter the rest.  The returned
+// channels are closed if the subscription fails.
+func (m *InterfaceMonitor) subscribeUpdates(ctx context.Context) (
+	filteredUpdates chan NetlinkUpdate,
+	defaultRouteUpdates chan netlink.RouteUpdate,
+	err error,
+) {
+	updates, err := m.subscribe()
+	if err != nil {
+		return nil, nil, err
+	}
+	if m.DefaultRouteCallback != nil {
+		// The update filter discards all but local routes so we need to pick out the default
+		// route updates before they get there.
+		defaultRouteUpdates = make(chan netlink.RouteUpdate, 10)
+		splitUpdates := make(chan NetlinkUpdate, 10)
+		go splitDefaultRouteUpdates(ctx, updates, splitUpdates, defaultRouteUpdates, !m.DisableAddrMonitoring)
+		updates = splitUpdates
+		// We may have missed some while we weren't subscribed.
+		m.defaultRoutesStale = true
+	}
+	filteredUpdates = updates
+	if m.replayer == nil {
+		// Recordings hold the updates as they came out of the filter.
+		filteredUpdates = make(chan NetlinkUpdate, 10)
+		go filterUpdates(ctx, filteredUpdates, updates)
+	}
+	log.Info("Subscribed to netlink updates.")
+	return filteredUpdates, defaultRouteUpdates, nil
+}
+
+// resubscribe is called from the main loop when the netlink subscription has failed, for
+// example because the kernel overflowed its buffer.  It subscribes again and then resyncs, to
+// pick up whatever we missed in the meantime.  If subscribing fails, it returns nil channels
+// and schedules another attempt, with the same backoff as the resync retries; it only returns
+// an error once ResyncRetryAttempts attempts in a row have failed.
+func (m *InterfaceMonitor) resubscribe(ctx context.Context) (
+	filteredUpdates chan NetlinkUpdate,
+	defaultRouteUpdates chan netlink.RouteUpdate,
+	err error,
+) {
+	filteredUpdates, defaultRouteUpdates, err = m.subscribeUpdates(ctx)
+	if err != nil {
+		m.resubscribeFailures++
+		maxAttempts := m.ResyncRetryAttempts
+		if maxAttempts <= 0 {
+			maxAttempts = defaultResyncRetryAttempts
+		}
+		logCxt := log.WithError(err).WithField("failures", m.resubscribeFailures)
+		if m.resubscribeFailures >= maxAttempts {
+			logCxt.Error("Failed to re-subscribe to netlink too many times, giving up.")
+			return nil, nil, fmt.Errorf("failed to subscribe to netlink: %w", err)
+		}
+		interval := m.ResyncRetryInterval
+		if interval <= 0 {
+			interval = defaultResyncRetryInterval
+		}
+		interval <<= uint(m.resubscribeFailures - 1)
+		logCxt.WithField("retryIn", interval).Warn("Failed to re-subscribe to netlink, will retry.")
+		m.resubscribeTimer = m.time.NewTimer(interval)
+		m.resubscribeTimerC = m.resubscribeTimer.Chan()
+		return nil, nil, nil
+	}
+	m.resubscribeFailures = 0
+	m.metrics.resubscribes.Inc()
+	m.recordResync()
+	if err := m.resyncWithRetry(); err != nil {
+		return nil, nil, fmt.Errorf("failed to read link states from netlink: %w", err)
+	}
+	return filteredUpdates, defaultRouteUpdates, nil
+}
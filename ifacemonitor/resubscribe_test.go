@@ -0,0 +1,185 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ifacemonitor/testutils"
+	"github.com/projectcalico/felix/timeshim/mocktime"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Re-subscribing", func() {
+	var nl *netlinkTest
+	var mockTime *mocktime.MockTime
+	var im *ifacemonitor.InterfaceMonitor
+	var recorder *testutils.Recorder
+	var errC chan error
+
+	BeforeEach(func() {
+		mockTime = mocktime.New()
+		errC = make(chan error, 1)
+		im, nl, recorder = startMonitor(ifacemonitor.Config{
+			ResyncRetryAttempts: 3,
+		}, func(nl *netlinkTest, im *ifacemonitor.InterfaceMonitor) {
+			setLinkNoSignal(nl, "eth0", "up", "10.0.0.1/32")
+		}, withErrC(errC), withMonitorOps(ifacemonitor.WithMonitorTimeShim(mockTime)))
+		recorder.ExpectSequence(
+			testutils.StateEvent("eth0", ifacemonitor.StateUp),
+			testutils.AddrsEvent("eth0", "10.0.0.1"),
+		)
+	})
+
+	AfterEach(func() {
+		im.Stop()
+	})
+
+	It("should re-subscribe and resync when the subscription closes", func() {
+		// A change that we miss while the subscription is broken.
+		setLinkNoSignal(nl, "eth0", "down", "10.0.0.1/32")
+		close(nl.updates)
+		<-nl.userSubscribed
+		recorder.ExpectSequence(testutils.StateEvent("eth0", ifacemonitor.StateDown))
+
+		// And the new subscription works.
+		nl.addAddr("eth0", "10.0.0.2/32")
+		recorder.ExpectSequence(testutils.AddrsEvent("eth0", "10.0.0.1", "10.0.0.2"))
+		Consistently(errC).ShouldNot(Receive())
+	})
+
+	It("should leave no stale state after changes made while the subscription was broken", func() {
+		nl.addLink("cali1")
+		nl.addAddr("cali1", "10.0.1.1/32")
+		nl.changeLinkState("cali1", "up")
+		recorder.ExpectState("cali1", ifacemonitor.StateUp)
+		recorder.ExpectAddrs("cali1", "10.0.1.1")
+		nl.linksMutex.Lock()
+		oldEth0Index := nl.links["eth0"].index
+		nl.linksMutex.Unlock()
+
+		// While we're not listening: eth0 is recreated, with a new index and address; cali1
+		// flaps and gets a new address; cali2 comes and goes again.
+		nl.delLinkNoSignal("eth0")
+		setLinkNoSignal(nl, "eth0", "up", "10.0.0.2/32")
+		setLinkNoSignal(nl, "cali1", "down", "10.0.1.1/32")
+		setLinkNoSignal(nl, "cali1", "up", "10.0.1.2/32")
+		setLinkNoSignal(nl, "cali2", "up", "10.0.2.1/32")
+		nl.delLinkNoSignal("cali2")
+		close(nl.updates)
+		<-nl.userSubscribed
+
+		recorder.ExpectAddrs("eth0", "10.0.0.2")
+		recorder.ExpectAddrs("cali1", "10.0.1.2")
+		recorder.ExpectState("eth0", ifacemonitor.StateUp)
+		recorder.ExpectState("cali1", ifacemonitor.StateUp)
+		recorder.ExpectNoEventsFor("cali2")
+		Expect(im.UpInterfaces()).To(Equal([]string{"cali1", "eth0"}))
+		Expect(im.InterfaceAddrs("eth0")).To(Equal([]string{"10.0.0.2"}))
+		Expect(im.InterfaceAddrs("cali1")).To(Equal([]string{"10.0.1.2"}))
+		for _, status := range im.Interfaces() {
+			if status.Name == "eth0" {
+				Expect(status.Index).NotTo(Equal(oldEth0Index))
+			}
+		}
+		Consistently(errC).ShouldNot(Receive())
+	})
+
+	It("should retry a failed re-subscription with backoff", func() {
+		nl.subscribeErr = syscall.ENOBUFS
+		close(nl.updates)
+		Eventually(mockTime.HasTimers).Should(BeTrue())
+		mockTime.IncrementTime(100 * time.Millisecond)
+		Eventually(mockTime.HasTimers).Should(BeTrue())
+
+		nl.subscribeErr = nil
+		mockTime.IncrementTime(100 * time.Millisecond)
+		Consistently(nl.userSubscribed, "50ms", "5ms").ShouldNot(Receive())
+		mockTime.IncrementTime(100 * time.Millisecond)
+		<-nl.userSubscribed
+		nl.changeLinkState("eth0", "down")
+		recorder.ExpectSequence(testutils.StateEvent("eth0", ifacemonitor.StateDown))
+		Consistently(errC).ShouldNot(Receive())
+	})
+
+	It("should give up after too many failures in a row", func() {
+		nl.subscribeErr = syscall.ENOBUFS
+		close(nl.updates)
+		Eventually(mockTime.HasTimers).Should(BeTrue())
+		mockTime.IncrementTime(100 * time.Millisecond)
+		Eventually(mockTime.HasTimers).Should(BeTrue())
+		mockTime.IncrementTime(200 * time.Millisecond)
+
+		var err error
+		Eventually(errC).Should(Receive(&err))
+		Expect(err).To(MatchError(ContainSubstring("failed to subscribe to netlink")))
+	})
+})
+
+var _ = Describe("Re-subscribing while tracking the default route", func() {
+	var nl *netlinkTest
+	var im *ifacemonitor.InterfaceMonitor
+	var recorder *testutils.Recorder
+	// routes records the default route callbacks, separately from the recorder's state and address
+	// callbacks.
+	var routes *testutils.Recorder
+	var errC chan error
+
+	BeforeEach(func() {
+		rec := testutils.NewRecorder()
+		routes = rec
+		errC = make(chan error, 1)
+		im, nl, recorder = startMonitor(ifacemonitor.Config{}, func(nl *netlinkTest, im *ifacemonitor.InterfaceMonitor) {
+			setLinkNoSignal(nl, "eth0", "up", "10.0.0.1/32")
+			setLinkNoSignal(nl, "eth1", "up", "10.0.1.1/32")
+			nl.defaultRoutes = map[int][]string{netlink.FAMILY_V4: {"eth0"}}
+			im.DefaultRouteCallback = func(family int, ifaceNames []string) {
+				if family == netlink.FAMILY_V4 {
+					rec.RecordOther("", "v4 default via [%s]", strings.Join(ifaceNames, " "))
+				}
+			}
+		}, withErrC(errC))
+		routes.ExpectSequence(testutils.OtherEvent("", "v4 default via [eth0]"))
+	})
+
+	AfterEach(func() {
+		im.Stop()
+	})
+
+	It("should pick up a missed default route change and carry on tracking it", func() {
+		nl.linksMutex.Lock()
+		nl.defaultRoutes[netlink.FAMILY_V4] = []string{"eth1"}
+		nl.linksMutex.Unlock()
+		close(nl.updates)
+		<-nl.userSubscribed
+		routes.ExpectSequence(testutils.OtherEvent("", "v4 default via [eth1]"))
+
+		// Both the default route and the other updates come through the new subscription.
+		nl.setDefaultRoute(netlink.FAMILY_V4, "eth0", "eth1")
+		routes.ExpectSequence(testutils.OtherEvent("", "v4 default via [eth0 eth1]"))
+		nl.addAddr("eth1", "10.0.1.2/32")
+		recorder.ExpectAddrs("eth1", "10.0.1.1", "10.0.1.2")
+		Consistently(errC).ShouldNot(Receive())
+	})
+})
@@ -0,0 +1,76 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultResyncRetryAttempts = 5
+	defaultResyncRetryInterval = 100 * time.Millisecond
+)
+
+// resyncWithRetry does a resync from the main loop.  A failed resync, for example because netlink
+// ran out of buffer space during a storm of updates, is retried with backoff; we only return an
+// error once ResyncRetryAttempts resyncs in a row have failed.
+func (m *InterfaceMonitor) resyncWithRetry() error {
+	err := m.resync()
+	if err == nil {
+		if m.resyncFailures > 0 {
+			log.WithField("failures", m.resyncFailures).Info("Resync succeeded after failures.")
+		}
+		m.resyncFailures = 0
+		m.scheduleResyncRetry(0)
+		return nil
+	}
+	m.resyncFailures++
+	m.metrics.resyncFailures.Inc()
+	maxAttempts := m.ResyncRetryAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultResyncRetryAttempts
+	}
+	logCxt := log.WithError(err).WithField("failures", m.resyncFailures)
+	if m.resyncFailures >= maxAttempts {
+		logCxt.Error("Resync failed too many times, giving up.")
+		return err
+	}
+	interval := m.ResyncRetryInterval
+	if interval <= 0 {
+		interval = defaultResyncRetryInterval
+	}
+	interval <<= uint(m.resyncFailures - 1)
+	logCxt.WithField("retryIn", interval).Warn("Resync failed, will retry.")
+	m.scheduleResyncRetry(interval)
+	return nil
+}
+
+// scheduleResyncRetry (re)starts the resync retry timer, or stops it if interval is 0.
+func (m *InterfaceMonitor) scheduleResyncRetry(interval time.Duration) {
+	if m.resyncRetryTimer != nil {
+		m.resyncRetryTimer.Stop()
+		m.resyncRetryTimer = nil
+		m.resyncRetryTimerC = nil
+	}
+	if interval <= 0 {
+		return
+	}
+	m.resyncRetryTimer = m.time.NewTimer(interval)
+	m.resyncRetryTimerC = m.resyncRetryTimer.Chan()
+}
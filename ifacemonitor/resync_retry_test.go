@@ -0,0 +1,98 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ifacemonitor/testutils"
+	"github.com/projectcalico/felix/timeshim/mocktime"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Resync retries", func() {
+	var nl *netlinkTest
+	var resyncC chan time.Time
+	var mockTime *mocktime.MockTime
+	var im *ifacemonitor.InterfaceMonitor
+	var recorder *testutils.Recorder
+	var errC chan error
+
+	BeforeEach(func() {
+		resyncC = make(chan time.Time)
+		mockTime = mocktime.New()
+		errC = make(chan error, 1)
+		im, nl, recorder = startMonitor(ifacemonitor.Config{
+			ResyncRetryAttempts: 3,
+		}, func(nl *netlinkTest, im *ifacemonitor.InterfaceMonitor) {
+			setLinkNoSignal(nl, "eth0", "up", "10.0.0.1/32")
+		}, withResyncC(resyncC), withErrC(errC), withMonitorOps(ifacemonitor.WithMonitorTimeShim(mockTime)))
+		recorder.ExpectSequence(
+			testutils.StateEvent("eth0", ifacemonitor.StateUp),
+			testutils.AddrsEvent("eth0", "10.0.0.1"),
+		)
+		Expect(mockTime.HasTimers()).To(BeFalse())
+	})
+
+	AfterEach(func() {
+		im.Stop()
+	})
+
+	setLinkListErr := func(err error) {
+		nl.linksMutex.Lock()
+		defer nl.linksMutex.Unlock()
+		nl.linkListErr = err
+	}
+
+	It("should retry a failed resync with backoff", func() {
+		setLinkListErr(syscall.ENOBUFS)
+		resyncC <- time.Time{}
+		Eventually(mockTime.HasTimers).Should(BeTrue())
+
+		// The first retry fails too, so the second is after twice the interval.
+		mockTime.IncrementTime(100 * time.Millisecond)
+		Eventually(mockTime.HasTimers).Should(BeTrue())
+		setLinkListErr(nil)
+		setLinkNoSignal(nl, "eth0", "down", "10.0.0.1/32")
+		mockTime.IncrementTime(100 * time.Millisecond)
+		recorder.ExpectNoNewEvents()
+		mockTime.IncrementTime(100 * time.Millisecond)
+		recorder.ExpectSequence(testutils.StateEvent("eth0", ifacemonitor.StateDown))
+
+		// Success resets the backoff.
+		Expect(mockTime.HasTimers()).To(BeFalse())
+		Consistently(errC).ShouldNot(Receive())
+	})
+
+	It("should give up after too many failures in a row", func() {
+		setLinkListErr(syscall.ENOBUFS)
+		resyncC <- time.Time{}
+		Eventually(mockTime.HasTimers).Should(BeTrue())
+		mockTime.IncrementTime(100 * time.Millisecond)
+		Eventually(mockTime.HasTimers).Should(BeTrue())
+		mockTime.IncrementTime(200 * time.Millisecond)
+
+		var err error
+		Eventually(errC).Should(Receive(&err))
+		Expect(err).To(MatchError(ContainSubstring("failed to read link states from netlink")))
+		Expect(mockTime.HasTimers()).To(BeFalse())
+	})
+})
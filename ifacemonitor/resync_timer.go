@@ -0,0 +1,81 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"math/rand"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// resyncJitterFraction is the fraction of the resync interval by which we vary each resync, in
+// either direction, so that monitors that were started together (such as Felix on every node of
+// a cluster after an upgrade) don't all list their interfaces at the same moment.
+const resyncJitterFraction = 0.1
+
+// WithPeriodicResync makes the monitor resync at the given interval, with jitter, as New does
+// for Config.ResyncInterval.  It is for use with NewWithStubs, which otherwise only resyncs when
+// its resync channel fires.  An interval <= 0 leaves periodic resyncs disabled.
+func WithPeriodicResync(interval time.Duration) InterfaceMonitorOp {
+	return func(m *InterfaceMonitor) {
+		m.resyncInterval = interval
+	}
+}
+
+// RequestResync asks the monitor to resync as soon as possible, rather than waiting for the next
+// periodic resync; for example, if the caller suspects that it has missed an update.  It doesn't
+// wait for the resync.  Requests that are made before the monitor gets round to resyncing are
+// coalesced into one resync.  Safe to call from any goroutine, including before MonitorInterfaces
+// (in which case the start-of-day resync satisfies the request) and after Stop (when it does
+// nothing).
+func (m *InterfaceMonitor) RequestResync() {
+	select {
+	case m.resyncReqC <- struct{}{}:
+	default:
+		log.Debug("Resync already requested.")
+	}
+}
+
+// clearResyncRequest discards any pending RequestResync, just before a resync that satisfies it.
+func (m *InterfaceMonitor) clearResyncRequest() {
+	select {
+	case <-m.resyncReqC:
+	default:
+	}
+}
+
+// scheduleResync (re)starts the periodic resync timer, if periodic resyncs are enabled.
+func (m *InterfaceMonitor) scheduleResync() {
+	if m.resyncInterval <= 0 {
+		return
+	}
+	if m.resyncTimer != nil {
+		m.resyncTimer.Stop()
+	}
+	m.resyncTimer = m.time.NewTimer(jitterInterval(m.resyncInterval))
+	m.resyncTimerC = m.resyncTimer.Chan()
+}
+
+// jitterInterval returns a random duration within resyncJitterFraction of interval.
+func jitterInterval(interval time.Duration) time.Duration {
+	maxJitter := int64(float64(interval) * resyncJitterFraction)
+	if maxJitter <= 0 {
+		return interval
+	}
+	return interval - time.Duration(maxJitter) + time.Duration(rand.Int63n(2*maxJitter+1))
+}
@@ -0,0 +1,161 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"time"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ifacemonitor/testutils"
+	"github.com/projectcalico/felix/timeshim/mocktime"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Periodic resyncs", func() {
+	var nl *netlinkTest
+	var mockTime *mocktime.MockTime
+	var im *ifacemonitor.InterfaceMonitor
+	var recorder *testutils.Recorder
+
+	start := func(interval time.Duration) {
+		im, nl, recorder = startMonitor(ifacemonitor.Config{}, func(nl *netlinkTest, im *ifacemonitor.InterfaceMonitor) {
+			setLinkNoSignal(nl, "eth0", "up", "10.0.0.1/32")
+		}, withMonitorOps(
+			ifacemonitor.WithMonitorTimeShim(mockTime),
+			ifacemonitor.WithPeriodicResync(interval),
+		))
+		recorder.ExpectAddrs("eth0", "10.0.0.1")
+	}
+
+	BeforeEach(func() {
+		mockTime = mocktime.New()
+	})
+
+	AfterEach(func() {
+		im.Stop()
+	})
+
+	// addAddrNoSignal adds an address that only a resync will find.
+	addAddrNoSignal := func(addr string) {
+		nl.linksMutex.Lock()
+		defer nl.linksMutex.Unlock()
+		nl.links["eth0"].addrs.Add(addr)
+	}
+
+	expectNoResync := func() {
+		ConsistentlyWithOffset(1, func() string {
+			return recorder.Addrs("eth0")
+		}, "50ms", "5ms").Should(Equal(recorder.Addrs("eth0")))
+	}
+
+	It("should resync within 10% of the interval, every interval", func() {
+		start(10 * time.Second)
+		Eventually(mockTime.HasTimers).Should(BeTrue())
+
+		addAddrNoSignal("10.0.0.2/32")
+		mockTime.IncrementTime(8900 * time.Millisecond)
+		expectNoResync()
+		mockTime.IncrementTime(2100 * time.Millisecond)
+		recorder.ExpectAddrs("eth0", "10.0.0.1", "10.0.0.2")
+
+		// The next one is scheduled from when the last one happened.
+		addAddrNoSignal("10.0.0.3/32")
+		mockTime.IncrementTime(8900 * time.Millisecond)
+		expectNoResync()
+		mockTime.IncrementTime(2100 * time.Millisecond)
+		recorder.ExpectAddrs("eth0", "10.0.0.1", "10.0.0.2", "10.0.0.3")
+	})
+
+	It("should not resync if periodic resyncs are disabled", func() {
+		start(-1)
+		addAddrNoSignal("10.0.0.2/32")
+		mockTime.IncrementTime(time.Hour)
+		expectNoResync()
+		Expect(mockTime.HasTimers()).To(BeFalse())
+	})
+})
+
+var _ = Describe("Requested resyncs", func() {
+	var nl *netlinkTest
+	var im *ifacemonitor.InterfaceMonitor
+	var recorder *testutils.Recorder
+
+	AfterEach(func() {
+		im.Stop()
+	})
+
+	// start runs the monitor, after calling beforeStart, if non-nil.
+	start := func(beforeStart func(im *ifacemonitor.InterfaceMonitor)) {
+		im, nl, recorder = startMonitor(ifacemonitor.Config{}, func(nl *netlinkTest, im *ifacemonitor.InterfaceMonitor) {
+			setLinkNoSignal(nl, "eth0", "up", "10.0.0.1/32")
+			if beforeStart != nil {
+				beforeStart(im)
+			}
+		})
+		recorder.ExpectAddrs("eth0", "10.0.0.1")
+	}
+
+	It("should resync straight away", func() {
+		start(nil)
+		nl.linksMutex.Lock()
+		nl.links["eth0"].addrs.Add("10.0.0.2/32")
+		nl.linksMutex.Unlock()
+		im.RequestResync()
+		recorder.ExpectAddrs("eth0", "10.0.0.1", "10.0.0.2")
+	})
+
+	It("should coalesce requests that are made while the monitor is busy", func() {
+		// Hold up the monitor's goroutine in a callback while we make the requests.
+		blockedC := make(chan struct{})
+		unblockC := make(chan struct{})
+		start(func(im *ifacemonitor.InterfaceMonitor) {
+			im.AddCallback(func(ifaceName string, state ifacemonitor.State, ifIndex int) {
+				if ifaceName == "eth1" {
+					close(blockedC)
+					<-unblockC
+				}
+			})
+		})
+		numLists := nl.getNumLinkListCalls()
+
+		nl.addLink("eth1")
+		nl.changeLinkState("eth1", "up")
+		<-blockedC
+		im.RequestResync()
+		im.RequestResync()
+		close(unblockC)
+		Eventually(nl.getNumLinkListCalls).Should(Equal(numLists + 1))
+		Consistently(nl.getNumLinkListCalls, "50ms", "5ms").Should(Equal(numLists + 1))
+	})
+
+	It("should satisfy requests made before it starts with the start-of-day resync", func() {
+		start(func(im *ifacemonitor.InterfaceMonitor) {
+			im.RequestResync()
+			im.RequestResync()
+		})
+		Consistently(nl.getNumLinkListCalls, "50ms", "5ms").Should(Equal(1))
+	})
+
+	It("should ignore requests after it has stopped", func() {
+		start(nil)
+		im.Stop()
+		im.RequestResync()
+		im.RequestResync()
+	})
+})
@@ -0,0 +1,84 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// When a primary IPv4 address is deleted and the interface's promote_secondaries sysctl is off,
+// the kernel silently deletes its secondary addresses too: we only get the update for the
+// primary.  To spot that, we track the flags of each IPv4 address and re-list the addresses of
+// an interface when one of its primaries goes.  The local routes that we use to track addresses
+// don't carry the flags, so we have to list the addresses to get them.  A lone IPv4 address is
+// always primary, with no secondaries to lose, so we only do that for interfaces that have more
+// than one.
+
+// refreshV4AddrFlags re-reads the flags of an interface's IPv4 addresses.  Called whenever its
+// addresses change.
+func (m *InterfaceMonitor) refreshV4AddrFlags(ifIndex int) {
+	numV4Addrs := 0
+	if addrs := m.ifaceAddrs[ifIndex]; addrs != nil {
+		addrs.Iter(func(item interface{}) error {
+			if !strings.Contains(item.(string), ":") {
+				numV4Addrs++
+			}
+			return nil
+		})
+	}
+	if numV4Addrs < 2 {
+		delete(m.v4AddrFlags, ifIndex)
+		return
+	}
+	link := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: m.ifaceName[ifIndex], Index: ifIndex}}
+	addrs, err := m.netlinkStub.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		log.WithError(err).Warn("Netlink address list operation failed.")
+		delete(m.v4AddrFlags, ifIndex)
+		return
+	}
+	flags := map[string]int{}
+	for _, addr := range addrs {
+		if addr.IPNet == nil {
+			continue
+		}
+		flags[addr.IP.String()] = addr.Flags
+	}
+	m.v4AddrFlags[ifIndex] = flags
+}
+
+func (m *InterfaceMonitor) isPrimaryV4Addr(ifIndex int, addr string) bool {
+	flags, known := m.v4AddrFlags[ifIndex][addr]
+	return known && flags&unix.IFA_F_SECONDARY == 0
+}
+
+// onPrimaryV4AddrDeleted re-lists the addresses of an interface that has lost a primary IPv4
+// address, in case the kernel took its secondaries with it.  If promote_secondaries is on, one
+// of them will have been promoted instead and the re-list finds no change.
+func (m *InterfaceMonitor) onPrimaryV4AddrDeleted(ifIndex int) {
+	ifaceName := m.ifaceName[ifIndex]
+	log.WithField("ifaceName", ifaceName).Debug(
+		"Primary IPv4 address deleted, re-listing addresses in case its secondaries went too.")
+	link := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: ifaceName, Index: ifIndex}}
+	if !m.listAndNotifyAddrs(ifIndex, link) {
+		m.refreshV4AddrFlags(ifIndex)
+	}
+}
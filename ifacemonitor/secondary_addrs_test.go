@@ -0,0 +1,70 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ifacemonitor/testutils"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Secondary IPv4 addresses", func() {
+	var nl *netlinkTest
+	var im *ifacemonitor.InterfaceMonitor
+	var recorder *testutils.Recorder
+
+	BeforeEach(func() {
+		im, nl, recorder = startMonitor(ifacemonitor.Config{}, func(nl *netlinkTest, im *ifacemonitor.InterfaceMonitor) {
+			setLinkNoSignal(nl, "eth0", "up", "10.0.0.1/24", "fd00::1/64")
+		})
+		recorder.ExpectAddrs("eth0", "10.0.0.1", "fd00::1")
+
+		nl.addSecondaryAddr("eth0", "10.0.0.2/24")
+		nl.addSecondaryAddr("eth0", "10.0.0.3/24")
+		recorder.ExpectAddrs("eth0", "10.0.0.1", "10.0.0.2", "10.0.0.3", "fd00::1")
+	})
+
+	AfterEach(func() {
+		im.Stop()
+	})
+
+	It("should remove the secondaries that the kernel purges with their primary", func() {
+		nl.delPrimaryAddr("eth0", "10.0.0.1/24", false)
+		recorder.ExpectAddrs("eth0", "fd00::1")
+	})
+
+	It("should keep the secondaries if one is promoted", func() {
+		nl.delPrimaryAddr("eth0", "10.0.0.1/24", true)
+		recorder.ExpectAddrs("eth0", "10.0.0.2", "10.0.0.3", "fd00::1")
+		Consistently(func() string {
+			return recorder.Addrs("eth0")
+		}, "50ms", "5ms").Should(Equal(testutils.AddrsEvent("eth0", "10.0.0.2", "10.0.0.3", "fd00::1").String()))
+
+		// The promoted address is now the primary.
+		nl.delPrimaryAddr("eth0", "10.0.0.2/24", false)
+		recorder.ExpectAddrs("eth0", "fd00::1")
+	})
+
+	It("should not re-list addresses when a secondary is deleted", func() {
+		numListRoutesCalls := nl.getNumListRoutesCalls()
+		nl.delAddr("eth0", "10.0.0.3/24")
+		recorder.ExpectAddrs("eth0", "10.0.0.1", "10.0.0.2", "fd00::1")
+		Expect(nl.getNumListRoutesCalls()).To(Equal(numListRoutesCalls))
+	})
+})
@@ -0,0 +1,229 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+// snapshotVersion is the current version of the snapshot format.  Bump it if the format changes
+// incompatibly; Restore rejects versions that it doesn't understand.
+const snapshotVersion = 1
+
+type snapshot struct {
+	Version     int             `json:"version"`
+	NextIfaceID uint64          `json:"next_iface_id"`
+	Interfaces  []snapshotIface `json:"interfaces"`
+}
+
+type snapshotIface struct {
+	Index int    `json:"index"`
+	Name  string `json:"name"`
+	ID    uint64 `json:"id"`
+	Up    bool   `json:"up"`
+	// Class is set if there is a Classifier.
+	Class InterfaceClass `json:"class,omitempty"`
+	// AltNames is set if Config.MatchAltNames is enabled.  For information only.
+	AltNames []string `json:"alt_names,omitempty"`
+	// Addrs is nil if we haven't listed the interface's addresses (for example, because it is
+	// excluded).
+	Addrs []string `json:"addrs"`
+	// Attrs is nil if we haven't recorded the interface's link attributes.
+	Attrs *snapshotLinkAttrs `json:"attrs,omitempty"`
+	// VethPeer is set if the interface is a veth.  For information only; it isn't restored
+	// since the start-of-day resync refreshes it anyway.
+	VethPeer *VethPeer `json:"veth_peer,omitempty"`
+	// VFs lists the SR-IOV virtual functions of a physical NIC.  Also for information only.
+	VFs []VFInfo `json:"vfs,omitempty"`
+	// SubDevice is set if the interface is a macvlan or ipvlan.  Also for information only.
+	SubDevice *SubDevice `json:"sub_device,omitempty"`
+	// ParentChain is set for stacked devices.  Also for information only.
+	ParentChain *ParentChain `json:"parent_chain,omitempty"`
+	// Members lists the members of a master, such as a bridge or bond.  Also for information
+	// only.
+	Members []string `json:"members,omitempty"`
+}
+
+type snapshotLinkAttrs struct {
+	RawFlags     uint32 `json:"raw_flags"`
+	MTU          int    `json:"mtu"`
+	HardwareAddr string `json:"hardware_addr,omitempty"`
+	Protodown    bool   `json:"protodown,omitempty"`
+}
+
+type snapshotResponse struct {
+	data []byte
+	err  error
+}
+
+// Snapshot serializes the monitor's view of the interfaces so that a restarted monitor can
+// Restore it and avoid re-notifying everything.  Safe to call from any goroutine; if the
+// monitor is running, the snapshot is taken on the monitor's goroutine.  After the monitor has
+// stopped, or Run has failed, it returns the monitor's final state.
+func (m *InterfaceMonitor) Snapshot() ([]byte, error) {
+	if atomic.LoadInt32(&m.loopRunning) == 0 {
+		return m.snapshot()
+	}
+	respC := make(chan snapshotResponse, 1)
+	select {
+	case m.snapshotReqC <- respC:
+	case <-m.loopDoneC:
+		return m.snapshot()
+	}
+	select {
+	case resp := <-respC:
+		return resp.data, resp.err
+	case <-m.loopDoneC:
+		return m.snapshot()
+	}
+}
+
+func (m *InterfaceMonitor) snapshot() ([]byte, error) {
+	snap := snapshot{
+		Version:     snapshotVersion,
+		NextIfaceID: m.nextIfaceID,
+	}
+	for ifIndex, name := range m.ifaceName {
+		iface := snapshotIface{
+			Index:       ifIndex,
+			Name:        name,
+			ID:          m.ifaceIDs[ifIndex].id,
+			Class:       m.classes[ifIndex],
+			AltNames:    m.altNames[name],
+			VethPeer:    m.vethPeer(ifIndex),
+			VFs:         m.vfs[ifIndex],
+			SubDevice:   m.subDevice(ifIndex),
+			ParentChain: m.parentChains[ifIndex],
+		}
+		if upIdx, up := m.upIfaces[name]; up && upIdx == ifIndex {
+			iface.Up = true
+		}
+		_, iface.Members = m.masterInfo(ifIndex)
+		if addrs := m.ifaceAddrs[ifIndex]; addrs != nil {
+			iface.Addrs = []string{}
+			addrs.Iter(func(item interface{}) error {
+				iface.Addrs = append(iface.Addrs, item.(string))
+				return nil
+			})
+			sort.Strings(iface.Addrs)
+		}
+		if attrs, known := m.linkAttrs[ifIndex]; known {
+			iface.Attrs = &snapshotLinkAttrs{
+				RawFlags:     attrs.rawFlags,
+				MTU:          attrs.mtu,
+				HardwareAddr: attrs.hardwareAddr.String(),
+				Protodown:    attrs.protodown,
+			}
+		}
+		snap.Interfaces = append(snap.Interfaces, iface)
+	}
+	sort.Slice(snap.Interfaces, func(i, j int) bool {
+		return snap.Interfaces[i].Index < snap.Interfaces[j].Index
+	})
+	return json.Marshal(&snap)
+}
+
+// Restore loads state that was previously returned by Snapshot.  It must be called before
+// MonitorInterfaces.  The start-of-day resync then compares the actual interfaces against the
+// restored state and only makes callbacks for interfaces that changed while we weren't running;
+// the UnchangedIfaceCallback, if set, is called for the others.  If the snapshot is rejected,
+// our state is left as it was.
+func (m *InterfaceMonitor) Restore(data []byte) error {
+	if atomic.LoadInt32(&m.loopRunning) != 0 {
+		return fmt.Errorf("cannot restore state while the monitor is running")
+	}
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("failed to parse interface monitor snapshot: %w", err)
+	}
+	if snap.Version != snapshotVersion {
+		return fmt.Errorf("unsupported interface monitor snapshot version %d (expected %d)",
+			snap.Version, snapshotVersion)
+	}
+	// Check the whole snapshot before we touch our state so that a bad snapshot is harmless.
+	hwAddrs := make([]net.HardwareAddr, len(snap.Interfaces))
+	for i, iface := range snap.Interfaces {
+		if iface.Attrs == nil || iface.Attrs.HardwareAddr == "" {
+			continue
+		}
+		hwAddr, err := net.ParseMAC(iface.Attrs.HardwareAddr)
+		if err != nil {
+			return fmt.Errorf("bad MAC in interface monitor snapshot: %w", err)
+		}
+		hwAddrs[i] = hwAddr
+	}
+	for i, iface := range snap.Interfaces {
+		m.ifaceName[iface.Index] = iface.Name
+		m.restoredIfaces[iface.Index] = true
+		if iface.Up {
+			m.upIfaces[iface.Name] = iface.Index
+			m.metrics.upIfaces.Set(float64(len(m.upIfaces)))
+		}
+		if iface.Class != "" {
+			m.classes[iface.Index] = iface.Class
+		}
+		if iface.Addrs != nil {
+			addrs := set.New()
+			for _, addr := range iface.Addrs {
+				addrs.Add(addr)
+			}
+			m.ifaceAddrs[iface.Index] = addrs
+		}
+		identity := ifaceIdentity{id: iface.ID, name: iface.Name}
+		if iface.Attrs != nil {
+			m.linkAttrs[iface.Index] = trackedLinkAttrs{
+				rawFlags:     iface.Attrs.RawFlags,
+				mtu:          iface.Attrs.MTU,
+				hardwareAddr: hwAddrs[i],
+				protodown:    iface.Attrs.Protodown,
+			}
+			identity.hardwareAddr = hwAddrs[i]
+		}
+		m.ifaceIDs[iface.Index] = identity
+	}
+	if snap.NextIfaceID > m.nextIfaceID {
+		m.nextIfaceID = snap.NextIfaceID
+	}
+	log.WithField("numInterfaces", len(snap.Interfaces)).Info("Restored interface monitor state.")
+	return nil
+}
+
+// resyncRemovedIfaces cleans up (and notifies) interfaces that we know about but whose index
+// wasn't in the latest link list.  Normally, we'd have seen a deletion for those, but that's not
+// the case if our state was restored from a snapshot or if we missed netlink updates.
+func (m *InterfaceMonitor) resyncRemovedIfaces(currentIdxs set.Set) {
+	for ifIndex, name := range m.ifaceName {
+		if currentIdxs.Contains(ifIndex) {
+			continue
+		}
+		log.WithField("ifaceName", name).Info("Spotted removal of down interface on resync.")
+		m.storeAndNotifyLink(false, &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{
+			Name:  name,
+			Index: ifIndex,
+		}}, 0)
+		m.releaseIfaceID(ifIndex)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+const defaultStateFileMaxAge = 10 * time.Minute
+
+// UnchangedIfaceCallback is called for an interface that was restored from a snapshot and is
+// unchanged, so that a consumer that has restarted along with us can rebuild its state without
+// reprogramming anything.  addrs is nil if we don't track the interface's addresses.
+type UnchangedIfaceCallback func(ifaceName string, state State, ifIndex int, addrs set.Set)
+
+type stateFile struct {
+	WrittenAt time.Time       `json:"written_at"`
+	Snapshot  json.RawMessage `json:"snapshot"`
+}
+
+// loadStateFile restores our state from the StateFile, if there is one and it's usable.
+// Problems with the file are logged and otherwise ignored; we just start from scratch.
+func (m *InterfaceMonitor) loadStateFile() {
+	if m.StateFile == "" {
+		return
+	}
+	logCxt := log.WithField("file", m.StateFile)
+	data, err := ioutil.ReadFile(m.StateFile)
+	if os.IsNotExist(err) {
+		logCxt.Info("No interface monitor state file, starting from scratch.")
+		return
+	} else if err != nil {
+		logCxt.WithError(err).Warn("Failed to read interface monitor state file, ignoring it.")
+		return
+	}
+	var sf stateFile
+	if err := json.Unmarshal(data, &sf); err != nil {
+		logCxt.WithError(err).Warn("Failed to parse interface monitor state file, ignoring it.")
+		return
+	}
+	maxAge := m.StateFileMaxAge
+	if maxAge <= 0 {
+		maxAge = defaultStateFileMaxAge
+	}
+	if age := m.time.Since(sf.WrittenAt); age < 0 || age > maxAge {
+		logCxt.WithField("writtenAt", sf.WrittenAt).Warn(
+			"Interface monitor state file is stale, ignoring it.")
+		return
+	}
+	if err := m.Restore(sf.Snapshot); err != nil {
+		logCxt.WithError(err).Warn("Failed to restore interface monitor state file, ignoring it.")
+	}
+}
+
+// writeStateFile saves our state to the StateFile, if configured.  The file is replaced
+// atomically so that a crash part way through leaves the previous version.
+func (m *InterfaceMonitor) writeStateFile() {
+	if m.StateFile == "" {
+		return
+	}
+	logCxt := log.WithField("file", m.StateFile)
+	snap, err := m.snapshot()
+	if err != nil {
+		logCxt.WithError(err).Warn("Failed to snapshot interface monitor state.")
+		return
+	}
+	data, err := json.Marshal(&stateFile{
+		WrittenAt: m.time.Now(),
+		Snapshot:  snap,
+	})
+	if err != nil {
+		logCxt.WithError(err).Warn("Failed to serialize interface monitor state.")
+		return
+	}
+	tmpFile := m.StateFile + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, data, 0600); err != nil {
+		logCxt.WithError(err).Warn("Failed to write interface monitor state file.")
+		return
+	}
+	if err := os.Rename(tmpFile, m.StateFile); err != nil {
+		logCxt.WithError(err).Warn("Failed to replace interface monitor state file.")
+		return
+	}
+	logCxt.Debug("Wrote interface monitor state file.")
+}
+
+// removeStateFile removes the StateFile, if configured, so that we start from scratch next time.
+func (m *InterfaceMonitor) removeStateFile() {
+	if m.StateFile == "" {
+		return
+	}
+	if err := os.Remove(m.StateFile); err != nil && !os.IsNotExist(err) {
+		log.WithError(err).WithField("file", m.StateFile).Warn(
+			"Failed to remove interface monitor state file.")
+	}
+}
+
+// notifyUnchangedIfaces calls the UnchangedIfaceCallback for the restored interfaces that we
+// haven't made any callbacks for during the start-of-day resync.
+func (m *InterfaceMonitor) notifyUnchangedIfaces() {
+	defer func() {
+		m.restoredIfaces = map[int]bool{}
+	}()
+	if m.UnchangedIfaceCallback == nil {
+		return
+	}
+	var ifIndexes []int
+	for ifIndex := range m.restoredIfaces {
+		ifIndexes = append(ifIndexes, ifIndex)
+	}
+	sort.Ints(ifIndexes)
+	for _, ifIndex := range ifIndexes {
+		ifaceName, known := m.ifaceName[ifIndex]
+		if !known {
+			continue
+		}
+		var state State = StateDown
+		if m.isReportedUp(ifIndex, ifaceName) {
+			state = StateUp
+		}
+		addrs := m.reportedAddrs(ifIndex, ifaceName)
+		if addrs != nil {
+			addrs = addrs.Copy()
+		}
+		m.UnchangedIfaceCallback(ifaceName, state, ifIndex, addrs)
+	}
+}
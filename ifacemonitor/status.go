@@ -0,0 +1,117 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+// Interfaces returns the monitor's view of all the interfaces, in index order.  Safe to call
+// from any goroutine.  Returns nil if the monitor has been stopped.
+func (m *InterfaceMonitor) Interfaces() []InterfaceStatus {
+	var statuses []InterfaceStatus
+	m.runOnMonitorLoop(func() {
+		statuses = m.interfaceStatuses()
+	})
+	return statuses
+}
+
+// interfaceStatuses implements Interfaces; it must be called from the monitor's goroutine.
+func (m *InterfaceMonitor) interfaceStatuses() (statuses []InterfaceStatus) {
+	for _, ifIndex := range m.sortedIfIndexes() {
+		name := m.ifaceName[ifIndex]
+		status := InterfaceStatus{
+			Index:         ifIndex,
+			Name:          name,
+			Excluded:      m.isExcludedInterface(name),
+			Class:         m.classes[ifIndex],
+			AltNames:      m.altNames[name],
+			Unclaimed:     m.unclaimedFlagged[ifIndex],
+			MACSharedWith: m.macSharedWith(ifIndex),
+			TooManyAddrs:  m.tooManyAddrs[ifIndex],
+		}
+		if !status.Excluded {
+			status.State = StateDown
+			if m.isReportedUp(ifIndex, name) {
+				status.State = StateUp
+			}
+		}
+		if addrs := m.reportedAddrs(ifIndex, name); addrs != nil {
+			status.Addrs = []string{}
+			addrs.Iter(func(item interface{}) error {
+				status.Addrs = append(status.Addrs, item.(string))
+				return nil
+			})
+			sort.Strings(status.Addrs)
+		}
+		status.EffectiveState, status.Members = m.masterInfo(ifIndex)
+		if attrs, known := m.linkAttrs[ifIndex]; known {
+			status.MTU = attrs.mtu
+			if attrs.hardwareAddr != nil {
+				status.HardwareAddr = attrs.hardwareAddr.String()
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// ListInterfaces lists the interfaces once, exactly as the monitor does at start of day, and
+// returns what it found, as Interfaces would.  It doesn't subscribe to netlink or leave
+// anything running.
+func ListInterfaces(config Config) ([]InterfaceStatus, error) {
+	return ListInterfacesWithStubs(config, &netlinkReal{})
+}
+
+// ListInterfacesWithStubs is ListInterfaces with the given netlink stub.
+func ListInterfacesWithStubs(config Config, netlinkStub netlinkStub, options ...InterfaceMonitorOp) ([]InterfaceStatus, error) {
+	m := NewWithStubs(config, netlinkStub, nil, options...)
+	if err := m.ResyncOnce(); err != nil {
+		return nil, err
+	}
+	return m.interfaceStatuses(), nil
+}
+
+// ResyncOnce lists the interfaces and their addresses, making the usual callbacks (if set)
+// once each, without subscribing to netlink updates.  Interfaces then returns what was found.
+// It is for one-shot tools that want to see what the monitor would see; it can't be combined
+// with MonitorInterfaces or Run.  Failed notifications aren't retried.
+func (m *InterfaceMonitor) ResyncOnce() error {
+	if atomic.LoadInt32(&m.loopRunning) != 0 {
+		return errors.New("monitor is already running")
+	}
+	if m.StateCallback == nil {
+		m.StateCallback = func(ifaceName string, ifaceState State, ifIndex int) {}
+	}
+	if m.AddrCallback == nil {
+		m.AddrCallback = func(ifaceName string, addrs set.Set) {}
+	}
+	if err := m.resync(); err != nil {
+		return fmt.Errorf("failed to read link states from netlink: %w", err)
+	}
+	m.startOfDayResyncDone = true
+	m.notifyUnchangedIfaces()
+	m.notifyInSync()
+	m.endBatch()
+	m.dropPendingRetries()
+	return nil
+}
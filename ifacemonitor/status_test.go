@@ -0,0 +1,151 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"syscall"
+	"time"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ifacemonitor/testutils"
+	"github.com/projectcalico/felix/timeshim/mocktime"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("One-shot use", func() {
+	var nl *netlinkTest
+	var im *ifacemonitor.InterfaceMonitor
+
+	BeforeEach(func() {
+		nl = &netlinkTest{
+			userSubscribed: make(chan int),
+			nextIndex:      10,
+		}
+		setLinkNoSignal(nl, "eth0", "up", "10.0.0.1/32", "10.0.0.2/32")
+		setLinkNoSignal(nl, "kube-ipvs0", "up", "10.96.0.1/32")
+		setLinkNoSignal(nl, "cali1", "down")
+		im = ifacemonitor.NewWithStubs(
+			ifacemonitor.Config{
+				InterfaceExcludes: []*regexp.Regexp{regexp.MustCompile("^kube-ipvs")},
+			},
+			nl,
+			make(chan time.Time),
+			ifacemonitor.WithMonitorTimeShim(mocktime.New()),
+		)
+	})
+
+	It("should list the interfaces without subscribing", func() {
+		Expect(im.ResyncOnce()).To(Succeed())
+		Expect(nl.updates).To(BeNil())
+		Expect(im.Interfaces()).To(Equal([]ifacemonitor.InterfaceStatus{
+			{
+				Index:        10,
+				Name:         "eth0",
+				State:        ifacemonitor.StateUp,
+				Addrs:        []string{"10.0.0.1", "10.0.0.2"},
+				MTU:          1500,
+				HardwareAddr: "ee:ee:00:00:00:0a",
+			},
+			{
+				Index:        11,
+				Name:         "kube-ipvs0",
+				Excluded:     true,
+				MTU:          1500,
+				HardwareAddr: "ee:ee:00:00:00:0b",
+			},
+			{
+				Index:        12,
+				Name:         "cali1",
+				State:        ifacemonitor.StateDown,
+				Addrs:        []string{},
+				MTU:          1500,
+				HardwareAddr: "ee:ee:00:00:00:0c",
+			},
+		}))
+	})
+
+	It("should list the same interfaces as a long-running monitor sees after its first resync", func() {
+		nl.addVethPairNoSignal("cali2", "veth2")
+		setLinkNoSignal(nl, "br0", "up")
+		nl.linksMutex.Lock()
+		br0 := nl.links["br0"]
+		br0.linkType = "bridge"
+		nl.links["br0"] = br0
+		eth0 := nl.links["eth0"]
+		eth0.masterIndex = br0.index
+		nl.links["eth0"] = eth0
+		nl.links["cali1"].addrs.Add("10.0.1.1/32")
+		nl.links["cali1"].peers["10.0.1.1/32"] = "10.0.1.2"
+		nl.linksMutex.Unlock()
+		config := ifacemonitor.Config{
+			InterfaceExcludes:  []*regexp.Regexp{regexp.MustCompile("^kube-ipvs")},
+			LinkLocalAddrZones: true,
+		}
+
+		oneShotNL := nl.clone()
+		oneShot, err := ifacemonitor.ListInterfacesWithStubs(config, oneShotNL)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(oneShotNL.updates).To(BeNil())
+		Expect(oneShot).To(HaveLen(6))
+
+		runningNL := nl.clone()
+		running := ifacemonitor.NewWithStubs(config, runningNL, make(chan time.Time))
+		testutils.NewRecorder().Attach(running)
+		go running.MonitorInterfaces()
+		defer running.Stop()
+		<-runningNL.userSubscribed
+		Eventually(running.Interfaces).Should(Equal(oneShot))
+	})
+
+	It("should make each callback once and leave nothing running", func() {
+		mockTime := mocktime.New()
+		im = ifacemonitor.NewWithStubs(ifacemonitor.Config{}, nl, make(chan time.Time),
+			ifacemonitor.WithMonitorTimeShim(mockTime))
+		var updates []string
+		im.SetFallibleCallbacks(
+			func(ifaceName string, state ifacemonitor.State, ifIndex int) error {
+				updates = append(updates, fmt.Sprintf("%s %s", ifaceName, state))
+				return errors.New("dataplane not ready")
+			},
+			func(ifaceName string, addrs set.Set) error {
+				updates = append(updates, fmt.Sprintf("%s %d addrs", ifaceName, addrs.Len()))
+				return nil
+			},
+		)
+		Expect(im.ResyncOnce()).To(Succeed())
+		Expect(updates).To(ConsistOf(
+			"eth0 up", "eth0 2 addrs", "kube-ipvs0 up", "kube-ipvs0 1 addrs", "cali1 0 addrs",
+		))
+		// The failed state notifications aren't retried.
+		Expect(mockTime.HasTimers()).To(BeFalse())
+	})
+
+	It("should return permission errors from Run", func() {
+		nl.subscribeErr = syscall.EPERM
+		err := im.Run()
+		Expect(err).To(HaveOccurred())
+		Expect(ifacemonitor.IsPermissionError(err)).To(BeTrue())
+		Expect(ifacemonitor.IsPermissionError(errors.New("netlink went away"))).To(BeFalse())
+	})
+})
@@ -0,0 +1,98 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"runtime"
+	"syscall"
+	"time"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Restarting the monitor", func() {
+	It("should return nil from Run after Stop without leaking goroutines", func() {
+		baseline := runtime.NumGoroutine()
+		for i := 0; i < 5; i++ {
+			errC := make(chan error, 1)
+			im, nl, recorder := startMonitor(ifacemonitor.Config{}, func(nl *netlinkTest, im *ifacemonitor.InterfaceMonitor) {
+				setLinkNoSignal(nl, "eth0", "up", "10.0.0.1/32")
+				// The default route callback adds another goroutine to the pipeline.
+				im.DefaultRouteCallback = func(family int, ifaceNames []string) {}
+			}, withErrC(errC))
+			recorder.ExpectAddrs("eth0", "10.0.0.1")
+
+			im.Stop()
+			Eventually(errC).Should(Receive(BeNil()))
+			Expect(nl.done).To(BeClosed())
+		}
+		Eventually(runtime.NumGoroutine).Should(BeNumerically("<=", baseline))
+	})
+})
+
+var _ = Describe("After Run has failed", func() {
+	var nl *netlinkTest
+	var im *ifacemonitor.InterfaceMonitor
+
+	BeforeEach(func() {
+		nl = &netlinkTest{
+			userSubscribed: make(chan int),
+			nextIndex:      10,
+		}
+		nl.subscribeErr = syscall.EPERM
+		im = ifacemonitor.NewWithStubs(ifacemonitor.Config{}, nl, make(chan time.Time))
+		im.StateCallback = func(ifaceName string, state ifacemonitor.State, ifIndex int) {}
+		im.AddrCallback = func(ifaceName string, addrs set.Set) {}
+		Expect(im.Run()).To(MatchError(ContainSubstring("failed to subscribe to netlink")))
+	})
+
+	// returns runs fn on another goroutine so that a hang fails the test rather than blocking
+	// it.
+	returns := func(fn func()) chan struct{} {
+		doneC := make(chan struct{})
+		go func() {
+			defer close(doneC)
+			fn()
+		}()
+		return doneC
+	}
+
+	It("should not hang in Pause and Resume", func() {
+		Eventually(returns(im.Pause)).Should(BeClosed())
+		Eventually(returns(im.Resume)).Should(BeClosed())
+	})
+
+	It("should not hang when subscribing and unsubscribing", func() {
+		var unsubscribe func()
+		Eventually(returns(func() {
+			unsubscribe = im.AddSubscriber(ifacemonitor.Subscriber{
+				StateCallback: func(ifaceName string, state ifacemonitor.State, ifIndex int) {},
+			})
+		})).Should(BeClosed())
+		Eventually(returns(unsubscribe)).Should(BeClosed())
+	})
+
+	It("should not hang in StopAndWithdraw", func() {
+		Eventually(returns(im.StopAndWithdraw)).Should(BeClosed())
+		Eventually(returns(im.Pause)).Should(BeClosed())
+	})
+})
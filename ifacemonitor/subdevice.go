@@ -0,0 +1,148 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// SubDevice describes a macvlan or ipvlan interface: its mode and the parent device that it
+// sits on.
+type SubDevice struct {
+	// Kind is "macvlan" or "ipvlan".
+	Kind string `json:"kind"`
+	// Mode is the macvlan mode ("private", "vepa", "bridge", "passthru" or "source") or the
+	// ipvlan mode ("l2", "l3" or "l3s").
+	Mode        string `json:"mode"`
+	ParentIndex int    `json:"parent_index"`
+	// ParentName is the name of the parent, if it is an interface that we know about; empty if
+	// the parent is unknown or has gone.
+	ParentName string `json:"parent_name,omitempty"`
+}
+
+func (d SubDevice) String() string {
+	parent := d.ParentName
+	if parent == "" {
+		parent = fmt.Sprintf("unknown parent (index %d)", d.ParentIndex)
+	}
+	return fmt.Sprintf("%s %s on %s", d.Kind, d.Mode, parent)
+}
+
+// SubDeviceCallback is called when a macvlan or ipvlan interface appears or its mode or parent
+// changes, including when its parent goes away.  subDevice is nil when the interface is
+// removed.
+type SubDeviceCallback func(ifaceName string, subDevice *SubDevice)
+
+var macvlanModeNames = map[netlink.MacvlanMode]string{
+	netlink.MACVLAN_MODE_DEFAULT:  "default",
+	netlink.MACVLAN_MODE_PRIVATE:  "private",
+	netlink.MACVLAN_MODE_VEPA:     "vepa",
+	netlink.MACVLAN_MODE_BRIDGE:   "bridge",
+	netlink.MACVLAN_MODE_PASSTHRU: "passthru",
+	netlink.MACVLAN_MODE_SOURCE:   "source",
+}
+
+var ipvlanModeNames = map[netlink.IPVlanMode]string{
+	netlink.IPVLAN_MODE_L2:  "l2",
+	netlink.IPVLAN_MODE_L3:  "l3",
+	netlink.IPVLAN_MODE_L3S: "l3s",
+}
+
+// subDeviceFromLink returns the SubDevice for a macvlan or ipvlan link, without the parent's
+// name; nil for any other kind of link.
+func subDeviceFromLink(link netlink.Link) *SubDevice {
+	var subDev SubDevice
+	switch l := link.(type) {
+	case *netlink.Macvlan:
+		subDev.Kind = "macvlan"
+		subDev.Mode = macvlanModeNames[l.Mode]
+	case *netlink.IPVlan:
+		subDev.Kind = "ipvlan"
+		subDev.Mode = ipvlanModeNames[l.Mode]
+	default:
+		return nil
+	}
+	subDev.ParentIndex = link.Attrs().ParentIndex
+	return &subDev
+}
+
+// storeSubDevice records the mode and parent of a macvlan or ipvlan link and notifies the
+// SubDeviceCallback if they changed.
+func (m *InterfaceMonitor) storeSubDevice(ifaceName string, link netlink.Link) {
+	subDev := subDeviceFromLink(link)
+	if subDev != nil {
+		subDev.ParentName = m.ifaceName[subDev.ParentIndex]
+	}
+	m.storeAndNotifySubDevice(link.Attrs().Index, ifaceName, subDev)
+}
+
+// refreshSubDeviceParents re-resolves the parents of the sub-devices that we know about, after
+// an interface has been added, renamed or removed.  Cheap when there are no sub-devices.
+func (m *InterfaceMonitor) refreshSubDeviceParents() {
+	for ifIndex, subDev := range m.subDevices {
+		parentName := m.ifaceName[subDev.ParentIndex]
+		if parentName == subDev.ParentName {
+			continue
+		}
+		updated := *subDev
+		updated.ParentName = parentName
+		m.storeAndNotifySubDevice(ifIndex, m.ifaceName[ifIndex], &updated)
+	}
+}
+
+func (m *InterfaceMonitor) storeAndNotifySubDevice(ifIndex int, ifaceName string, subDev *SubDevice) {
+	old := m.subDevices[ifIndex]
+	if (old == nil && subDev == nil) || (old != nil && subDev != nil && *old == *subDev) {
+		return
+	}
+	if subDev == nil {
+		delete(m.subDevices, ifIndex)
+	} else {
+		m.subDevices[ifIndex] = subDev
+	}
+	logCxt := log.WithFields(log.Fields{
+		"ifaceName": ifaceName,
+		"subDevice": subDev,
+	})
+	if subDev != nil && subDev.ParentName == "" {
+		logCxt.Info("Sub-device's parent is unknown or has gone.")
+	} else {
+		logCxt.Debug("Sub-device changed.")
+	}
+	if m.SubDeviceCallback == nil || m.isExcludedInterface(ifaceName) {
+		return
+	}
+	var subDevCopy *SubDevice
+	if subDev != nil {
+		c := *subDev
+		subDevCopy = &c
+	}
+	m.SubDeviceCallback(ifaceName, subDevCopy)
+}
+
+// subDevice returns a copy of the tracked SubDevice for the given interface, or nil.
+func (m *InterfaceMonitor) subDevice(ifIndex int) *SubDevice {
+	subDev := m.subDevices[ifIndex]
+	if subDev == nil {
+		return nil
+	}
+	c := *subDev
+	return &c
+}
@@ -0,0 +1,422 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"regexp"
+	"sort"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+// SubscriberFilter selects the interfaces that a Subscriber gets updates for.  An interface must
+// match all the fields that are set; the zero filter matches everything.
+type SubscriberFilter struct {
+	NameRegexp *regexp.Regexp
+	// Classes matches interfaces whose class, as determined by the monitor's Classifier, is one
+	// of those listed.  Nothing matches if there's no Classifier.
+	Classes []InterfaceClass
+}
+
+func (f *SubscriberFilter) matches(ifaceName string, class InterfaceClass) bool {
+	if f.NameRegexp != nil && !f.NameRegexp.MatchString(ifaceName) {
+		return false
+	}
+	if len(f.Classes) == 0 {
+		return true
+	}
+	for _, c := range f.Classes {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscriber receives the same state and address callbacks as the monitor's StateCallback and
+// AddrCallback but only for the interfaces that match its filter.  If an interface starts to
+// match (for example, because it has been reclassified), the subscriber gets its current state
+// and addresses, as if it had just appeared; if it stops matching, the subscriber gets the
+// callbacks that it would get if the interface had been removed.  AddrCallback and
+// SnapshotDoneCallback are optional.
+type Subscriber struct {
+	Filter        SubscriberFilter
+	StateCallback InterfaceStateCallback
+	AddrCallback  AddrStateCallback
+	// StateOriginCallback and AddrOriginCallback, if set, are used instead of StateCallback and
+	// AddrCallback, for subscribers that want to know the origin of each update.
+	StateOriginCallback InterfaceStateOriginCallback
+	AddrOriginCallback  AddrStateOriginCallback
+	// SnapshotDoneCallback marks the end of the initial batch of updates delivered by
+	// Subscribe(sub, true); everything after it is a live update.
+	SnapshotDoneCallback func()
+}
+
+type subscription struct {
+	Subscriber
+
+	// matchCache caches the result of the filter for each interface, along with the inputs so
+	// that we can spot when it needs to be re-evaluated.
+	matchCache map[int]subscriptionMatch
+	// told records, by interface index, what we've told the subscriber, so that we can undo it.
+	told map[int]*subscriptionToldState
+	// interests holds the names of the interfaces that the subscriber wants updates for
+	// regardless of its filter; see Subscription.RequestUpdatesFor.
+	interests map[string]bool
+	// monitor is the monitor whose Middleware we run on each update.
+	monitor *InterfaceMonitor
+}
+
+type subscriptionMatch struct {
+	name    string
+	class   InterfaceClass
+	matches bool
+}
+
+type subscriptionToldState struct {
+	name  string
+	up    bool
+	addrs bool
+}
+
+// AddSubscriber is shorthand for Subscribe(sub, true).
+func (m *InterfaceMonitor) AddSubscriber(sub Subscriber) (unsubscribe func()) {
+	return m.Subscribe(sub, true)
+}
+
+// Subscribe registers a subscriber.  Safe to call from any goroutine; the subscriber's callbacks
+// are made from the monitor's goroutine.  The returned function removes the subscriber.
+//
+// If withSnapshot is true, the current state of each matching interface (in index order) is
+// delivered as an initial batch, as if the interface had just appeared, followed by a call to
+// SnapshotDoneCallback.  The snapshot and the registration happen together on the monitor's
+// goroutine, between two updates, so the subscriber sees every later update exactly once: an
+// update that is reflected in the snapshot is never delivered again and no update that comes
+// after the snapshot is missed.  The initial batch is complete before Subscribe returns.
+//
+// If withSnapshot is false, only later updates are delivered.  Those are consistent with the
+// current state, which the subscriber isn't told; for example, an interface that is already up
+// gets a down update when it goes down.
+func (m *InterfaceMonitor) Subscribe(sub Subscriber, withSnapshot bool) (unsubscribe func()) {
+	return m.addSubscription(newSubscription(sub), withSnapshot)
+}
+
+func newSubscription(sub Subscriber) *subscription {
+	return &subscription{
+		Subscriber: sub,
+		matchCache: map[int]subscriptionMatch{},
+		told:       map[int]*subscriptionToldState{},
+		interests:  map[string]bool{},
+	}
+}
+
+func (m *InterfaceMonitor) addSubscription(s *subscription, withSnapshot bool) (unsubscribe func()) {
+	m.runOnMonitorLoop(func() {
+		m.registerSubscription(s, withSnapshot)
+	})
+	return func() {
+		m.runOnMonitorLoop(func() {
+			m.unregisterSubscription(s)
+		})
+	}
+}
+
+// registerSubscription and unregisterSubscription implement addSubscription; they must be
+// called from the monitor's goroutine.
+func (m *InterfaceMonitor) registerSubscription(s *subscription, withSnapshot bool) {
+	s.monitor = m
+	m.subscriptions = append(m.subscriptions, s)
+	if withSnapshot {
+		m.sendSubscriptionSnapshot(s)
+		return
+	}
+	for _, ifIndex := range m.sortedIfIndexes() {
+		m.assumeSubscriptionTold(s, ifIndex)
+	}
+}
+
+func (m *InterfaceMonitor) unregisterSubscription(s *subscription) {
+	for i, other := range m.subscriptions {
+		if other == s {
+			m.subscriptions = append(m.subscriptions[:i], m.subscriptions[i+1:]...)
+			break
+		}
+	}
+}
+
+// sendSubscriptionSnapshot sends the current state of the matching interfaces to a subscriber,
+// followed by a call to its SnapshotDoneCallback.  Anything that the subscriber was told before
+// is forgotten so the subscriber should discard its own state first.  Must be called from the
+// monitor's goroutine.
+func (m *InterfaceMonitor) sendSubscriptionSnapshot(s *subscription) {
+	defer m.setOrigin(OriginReplay)()
+	s.told = map[int]*subscriptionToldState{}
+	for _, ifIndex := range m.sortedIfIndexes() {
+		m.refreshSubscription(s, ifIndex)
+	}
+	if s.SnapshotDoneCallback != nil {
+		s.SnapshotDoneCallback()
+	}
+}
+
+func (m *InterfaceMonitor) sortedIfIndexes() []int {
+	var ifIndexes []int
+	for ifIndex := range m.ifaceName {
+		ifIndexes = append(ifIndexes, ifIndex)
+	}
+	sort.Ints(ifIndexes)
+	return ifIndexes
+}
+
+// runOnMonitorLoop runs fn on the monitor's goroutine, if it's running, and waits for it to
+// finish.  fn isn't run if the monitor has been stopped.  If Run has returned an error without
+// the monitor being stopped, fn is run on the caller's goroutine, as it is before Run starts.
+func (m *InterfaceMonitor) runOnMonitorLoop(fn func()) {
+	if atomic.LoadInt32(&m.loopRunning) == 0 {
+		fn()
+		return
+	}
+	doneC := make(chan struct{})
+	select {
+	case m.loopFuncC <- func() { fn(); close(doneC) }:
+		<-doneC
+	case <-m.stopC:
+		log.Debug("Monitor stopped, ignoring request.")
+	case <-m.loopDoneC:
+		select {
+		case <-m.stopC:
+			log.Debug("Monitor stopped, ignoring request.")
+		default:
+			// Nothing else touches the monitor's state now.
+			fn()
+		}
+	}
+}
+
+func (s *subscription) matches(m *InterfaceMonitor, ifIndex int, ifaceName string) bool {
+	if s.interests[ifaceName] {
+		return true
+	}
+	class := m.classes[ifIndex]
+	if cached, ok := s.matchCache[ifIndex]; ok && cached.name == ifaceName && cached.class == class {
+		return cached.matches
+	}
+	matches := s.Filter.matches(ifaceName, class)
+	s.matchCache[ifIndex] = subscriptionMatch{name: ifaceName, class: class, matches: matches}
+	return matches
+}
+
+func (s *subscription) toldState(ifIndex int, ifaceName string) *subscriptionToldState {
+	told := s.told[ifIndex]
+	if told == nil {
+		told = &subscriptionToldState{name: ifaceName}
+		s.told[ifIndex] = told
+	}
+	return told
+}
+
+func (s *subscription) sendState(ifIndex int, ifaceName string, state State, origin UpdateOrigin) {
+	told := s.toldState(ifIndex, ifaceName)
+	told.up = state == StateUp
+	s.callState(ifaceName, state, ifIndex, origin)
+	s.cleanUpTold(ifIndex)
+}
+
+func (s *subscription) sendAddrs(ifIndex int, ifaceName string, addrs set.Set, origin UpdateOrigin) {
+	told := s.toldState(ifIndex, ifaceName)
+	told.addrs = addrs != nil
+	if addrs != nil {
+		addrs = addrs.Copy()
+	}
+	s.callAddrs(ifaceName, addrs, ifIndex, origin)
+	s.cleanUpTold(ifIndex)
+}
+
+// callState and callAddrs make the subscriber's callbacks, with or without the origin, after
+// running the monitor's Middleware.
+func (s *subscription) callState(ifaceName string, state State, ifIndex int, origin UpdateOrigin) {
+	ifaceName, state, ok := s.monitor.stateMiddleware(ifaceName, state, ifIndex, origin)
+	if !ok {
+		return
+	}
+	if s.StateOriginCallback != nil {
+		s.StateOriginCallback(ifaceName, state, ifIndex, origin)
+		return
+	}
+	s.StateCallback(ifaceName, state, ifIndex)
+}
+
+func (s *subscription) callAddrs(ifaceName string, addrs set.Set, ifIndex int, origin UpdateOrigin) {
+	ifaceName, addrs, ok := s.monitor.addrsMiddleware(ifaceName, addrs, ifIndex, origin)
+	if !ok {
+		return
+	}
+	if s.AddrOriginCallback != nil {
+		s.AddrOriginCallback(ifaceName, addrs, origin)
+	} else if s.AddrCallback != nil {
+		s.AddrCallback(ifaceName, addrs)
+	}
+}
+
+func (s *subscription) cleanUpTold(ifIndex int) {
+	if told := s.told[ifIndex]; told != nil && !told.up && !told.addrs {
+		delete(s.told, ifIndex)
+	}
+}
+
+// notifySubscribersState passes on a state notification to the subscribers that match the
+// interface.  Down transitions go to any subscriber that we told the interface was up, even if
+// it no longer matches.
+func (m *InterfaceMonitor) notifySubscribersState(ifaceName string, state State, ifIndex int) {
+	for _, s := range m.subscriptions {
+		if state == StateUp {
+			if s.matches(m, ifIndex, ifaceName) {
+				s.sendState(ifIndex, ifaceName, state, m.origin)
+			}
+		} else if told := s.told[ifIndex]; told != nil && told.up {
+			s.sendState(ifIndex, told.name, state, m.origin)
+		}
+	}
+}
+
+// notifySubscribersAddrs is the equivalent of notifySubscribersState for addresses.  nil addrs
+// means the interface has gone.
+func (m *InterfaceMonitor) notifySubscribersAddrs(ifaceName string, ifIndex int, addrs set.Set) {
+	for _, s := range m.subscriptions {
+		if addrs != nil {
+			if s.matches(m, ifIndex, ifaceName) {
+				s.sendAddrs(ifIndex, ifaceName, addrs, m.origin)
+			}
+		} else if told := s.told[ifIndex]; told != nil && told.addrs {
+			s.sendAddrs(ifIndex, told.name, nil, m.origin)
+		}
+	}
+}
+
+// notifyAddrs calls the AddrCallback and the subscribers.  If FlushAddrs is set, nil addrs are
+// preceded by an empty set, unless the addresses were already flushed when the interface went
+// down.
+func (m *InterfaceMonitor) notifyAddrs(ifaceName string, ifIndex int, addrs set.Set) {
+	if addrs == nil {
+		if m.flushAddrsEnabled() && !m.addrsFlushed[ifIndex] {
+			m.sendAddrs(ifaceName, ifIndex, set.New())
+		}
+		delete(m.addrsFlushed, ifIndex)
+	}
+	m.sendAddrs(ifaceName, ifIndex, addrs)
+}
+
+func (m *InterfaceMonitor) sendAddrs(ifaceName string, ifIndex int, addrs set.Set) {
+	delete(m.restoredIfaces, ifIndex)
+	m.recordReportedAddrs(ifaceName, addrs)
+	m.metrics.notifications.WithLabelValues("addrs", string(m.origin)).Inc()
+	m.deliverAddrs(ifaceName, addrs, ifIndex)
+	m.notifySubscribersAddrs(ifaceName, ifIndex, addrs)
+}
+
+// refreshSubscriptions re-evaluates the subscribers' filters for an interface after a change
+// that isn't accompanied by the usual notifications, such as a reclassification.
+func (m *InterfaceMonitor) refreshSubscriptions(ifIndex int) {
+	for _, s := range m.subscriptions {
+		m.refreshSubscription(s, ifIndex)
+	}
+}
+
+// refreshSubscription sends the synthetic transitions that a subscriber needs if an interface
+// has started or stopped matching its filter.
+func (m *InterfaceMonitor) refreshSubscription(s *subscription, ifIndex int) {
+	ifaceName, known := m.ifaceName[ifIndex]
+	matches := known && s.matches(m, ifIndex, ifaceName)
+	told := s.told[ifIndex]
+	if matches && told == nil {
+		if m.isReportedUp(ifIndex, ifaceName) {
+			s.sendState(ifIndex, ifaceName, StateUp, m.origin)
+		}
+		if addrs := m.reportedAddrs(ifIndex, ifaceName); addrs != nil {
+			s.sendAddrs(ifIndex, ifaceName, addrs, m.origin)
+		}
+	} else if !matches && told != nil {
+		log.WithFields(log.Fields{
+			"ifaceName": told.name,
+			"ifIndex":   ifIndex,
+		}).Debug("Interface no longer matches subscriber's filter.")
+		if told.up {
+			s.sendState(ifIndex, told.name, StateDown, m.origin)
+		}
+		if told.addrs {
+			s.sendAddrs(ifIndex, told.name, nil, m.origin)
+		}
+	}
+}
+
+// assumeSubscriptionTold records the current state of an interface as if the subscriber had
+// been told about it, without telling it.
+func (m *InterfaceMonitor) assumeSubscriptionTold(s *subscription, ifIndex int) {
+	ifaceName := m.ifaceName[ifIndex]
+	if !s.matches(m, ifIndex, ifaceName) {
+		return
+	}
+	up := m.isReportedUp(ifIndex, ifaceName)
+	addrs := m.reportedAddrs(ifIndex, ifaceName) != nil
+	if up || addrs {
+		s.told[ifIndex] = &subscriptionToldState{name: ifaceName, up: up, addrs: addrs}
+	}
+}
+
+// isReportedUp returns true if we've reported the interface as up.
+func (m *InterfaceMonitor) isReportedUp(ifIndex int, ifaceName string) bool {
+	upIdx, up := m.upIfaces[ifaceName]
+	return up && upIdx == ifIndex
+}
+
+// reportedAddrs returns the addresses that we've reported for the interface or nil if we
+// haven't reported any.
+func (m *InterfaceMonitor) reportedAddrs(ifIndex int, ifaceName string) set.Set {
+	if m.isExcludedInterface(ifaceName) || m.DisableAddrMonitoring {
+		return nil
+	}
+	if m.addrsFlushed[ifIndex] {
+		return set.New()
+	}
+	if addrs := m.ifaceAddrs[ifIndex]; addrs != nil {
+		return m.addrsForReport(ifaceName, addrs)
+	}
+	return nil
+}
+
+// addrsForReport converts a set of addresses, as we store them, to the form in which we report
+// them.  We store bare addresses, so that they compare equal however they were learned, and add
+// the zones to link-local addresses (if LinkLocalAddrZones is set) here, using the interface's
+// current name.
+func (m *InterfaceMonitor) addrsForReport(ifaceName string, addrs set.Set) set.Set {
+	if !m.LinkLocalAddrZones {
+		return addrs
+	}
+	return zoneLinkLocalAddrs(ifaceName, addrs)
+}
+
+// forgetSubscriptions is called when an interface is removed.  It makes sure that the
+// subscribers have been told that the interface has gone and cleans up their filter caches.
+func (m *InterfaceMonitor) forgetSubscriptions(ifIndex int) {
+	for _, s := range m.subscriptions {
+		m.refreshSubscription(s, ifIndex)
+		delete(s.matchCache, ifIndex)
+	}
+}
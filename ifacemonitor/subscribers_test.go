@@ -0,0 +1,255 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/timeshim/mocktime"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// subscriberView rebuilds the state of the interfaces from a subscriber's updates, recording
+// any update that doesn't make sense given the updates before it.
+type subscriberView struct {
+	lock         sync.Mutex
+	up           map[string]bool
+	addrs        map[string]set.Set
+	snapshotDone bool
+	problems     []string
+}
+
+func newSubscriberView() *subscriberView {
+	return &subscriberView{
+		up:    map[string]bool{},
+		addrs: map[string]set.Set{},
+	}
+}
+
+func (v *subscriberView) subscriber(filter ifacemonitor.SubscriberFilter) ifacemonitor.Subscriber {
+	return ifacemonitor.Subscriber{
+		Filter: filter,
+		StateCallback: func(ifaceName string, state ifacemonitor.State, ifIndex int) {
+			v.lock.Lock()
+			defer v.lock.Unlock()
+			v.onState(ifaceName, state)
+		},
+		AddrCallback: func(ifaceName string, addrs set.Set) {
+			v.lock.Lock()
+			defer v.lock.Unlock()
+			v.onAddrs(ifaceName, addrs)
+		},
+		SnapshotDoneCallback: func() {
+			v.lock.Lock()
+			defer v.lock.Unlock()
+			v.onSnapshotDone()
+		},
+	}
+}
+
+// apply applies a message from a ChannelSubscription.
+func (v *subscriberView) apply(msg interface{}) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	switch msg := msg.(type) {
+	case *ifacemonitor.IfaceSnapshotStart:
+		v.up = map[string]bool{}
+		v.addrs = map[string]set.Set{}
+		v.snapshotDone = false
+	case *ifacemonitor.IfaceSnapshotEnd:
+		v.onSnapshotDone()
+	case *ifacemonitor.IfaceUpdate:
+		v.onState(msg.Name, msg.State)
+	case *ifacemonitor.IfaceAddrsUpdate:
+		v.onAddrs(msg.Name, msg.Addrs)
+	default:
+		v.problems = append(v.problems, fmt.Sprintf("unexpected message %v", msg))
+	}
+}
+
+func (v *subscriberView) onState(ifaceName string, state ifacemonitor.State) {
+	if (state == ifacemonitor.StateUp) == v.up[ifaceName] {
+		v.problems = append(v.problems, fmt.Sprintf("duplicate %s update for %s", state, ifaceName))
+	}
+	if state == ifacemonitor.StateUp {
+		v.up[ifaceName] = true
+	} else {
+		delete(v.up, ifaceName)
+	}
+}
+
+func (v *subscriberView) onAddrs(ifaceName string, addrs set.Set) {
+	if addrs == nil {
+		if v.addrs[ifaceName] == nil {
+			v.problems = append(v.problems, fmt.Sprintf("%s removed twice", ifaceName))
+		}
+		delete(v.addrs, ifaceName)
+		return
+	}
+	v.addrs[ifaceName] = addrs
+}
+
+func (v *subscriberView) onSnapshotDone() {
+	if v.snapshotDone {
+		v.problems = append(v.problems, "snapshot marked as done twice")
+	}
+	v.snapshotDone = true
+}
+
+// matchesKernel returns a description of the first difference between the view and the fake
+// kernel, or "" if they match.
+func (v *subscriberView) matchesKernel(nl *netlinkTest) string {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	nl.linksMutex.Lock()
+	defer nl.linksMutex.Unlock()
+	for name, link := range nl.links {
+		if v.up[name] != (link.state == "up") {
+			return fmt.Sprintf("%s: up=%v but kernel has %s", name, v.up[name], link.state)
+		}
+		kernelAddrs := set.New()
+		link.addrs.Iter(func(item interface{}) error {
+			kernelAddrs.Add(strings.TrimSuffix(item.(string), "/32"))
+			return nil
+		})
+		if v.addrs[name] == nil || !v.addrs[name].Equals(kernelAddrs) {
+			return fmt.Sprintf("%s: addrs=%v but kernel has %v", name, v.addrs[name], kernelAddrs)
+		}
+	}
+	for name := range v.addrs {
+		if _, ok := nl.links[name]; !ok {
+			return fmt.Sprintf("%s: not in kernel", name)
+		}
+	}
+	for name := range v.up {
+		if _, ok := nl.links[name]; !ok {
+			return fmt.Sprintf("%s: up but not in kernel", name)
+		}
+	}
+	return ""
+}
+
+var _ = Describe("Subscribe", func() {
+	var nl *netlinkTest
+	var im *ifacemonitor.InterfaceMonitor
+
+	BeforeEach(func() {
+		im, nl, _ = startMonitor(ifacemonitor.Config{}, nil, withMonitorOps(ifacemonitor.WithMonitorTimeShim(mocktime.New())))
+	})
+
+	AfterEach(func() {
+		im.Stop()
+	})
+
+	It("should only send later updates without a snapshot", func() {
+		nl.addLink("cali1")
+		nl.changeLinkState("cali1", "up")
+		nl.addLink("cali2")
+		// Wait for the monitor to catch up.
+		view := newSubscriberView()
+		im.Subscribe(view.subscriber(ifacemonitor.SubscriberFilter{}), true)
+		Eventually(func() string {
+			return view.matchesKernel(nl)
+		}).Should(BeEmpty())
+
+		updates := make(chan string, 10)
+		im.Subscribe(ifacemonitor.Subscriber{
+			StateCallback: func(ifaceName string, state ifacemonitor.State, ifIndex int) {
+				updates <- fmt.Sprintf("%s %s", ifaceName, state)
+			},
+			AddrCallback: func(ifaceName string, addrs set.Set) {
+				updates <- fmt.Sprintf("%s addrs=%v", ifaceName, addrs)
+			},
+			SnapshotDoneCallback: func() {
+				updates <- "snapshot done"
+			},
+		}, false)
+		Consistently(updates, "50ms", "5ms").ShouldNot(Receive())
+
+		// Updates are consistent with the state that the subscriber wasn't told about.
+		nl.changeLinkState("cali1", "down")
+		Eventually(updates).Should(Receive(Equal("cali1 down")))
+		nl.delLink("cali2")
+		Eventually(updates).Should(Receive(Equal("cali2 addrs=<nil>")))
+		Consistently(updates, "50ms", "5ms").ShouldNot(Receive())
+	})
+
+	It("should give each subscriber a consistent view despite churn", func() {
+		const numIfaces = 5
+		churnDone := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			defer close(churnDone)
+			exists := map[string]bool{}
+			for i := 0; i < 500; i++ {
+				name := fmt.Sprintf("cali%d", i%numIfaces)
+				if !exists[name] {
+					nl.addLink(name)
+					exists[name] = true
+					continue
+				}
+				switch i / numIfaces % 4 {
+				case 0:
+					nl.changeLinkState(name, "up")
+				case 1:
+					nl.addAddr(name, fmt.Sprintf("10.0.%d.%d/32", i%numIfaces, i%7))
+				case 2:
+					nl.changeLinkState(name, "down")
+				case 3:
+					nl.delLink(name)
+					exists[name] = false
+				}
+			}
+		}()
+
+		var views []*subscriberView
+		filter := ifacemonitor.SubscriberFilter{NameRegexp: regexp.MustCompile("^cali")}
+	subscribeLoop:
+		for {
+			view := newSubscriberView()
+			im.Subscribe(view.subscriber(filter), true)
+			view.lock.Lock()
+			Expect(view.snapshotDone).To(BeTrue(), "Initial batch should be complete before Subscribe returns")
+			view.lock.Unlock()
+			views = append(views, view)
+			select {
+			case <-churnDone:
+				break subscribeLoop
+			case <-time.After(time.Millisecond):
+			}
+		}
+		Expect(len(views)).To(BeNumerically(">", 1))
+
+		for i, view := range views {
+			Eventually(func() string {
+				return view.matchesKernel(nl)
+			}).Should(BeEmpty(), fmt.Sprintf("View %d doesn't match the kernel", i))
+			view.lock.Lock()
+			Expect(view.problems).To(BeEmpty(), fmt.Sprintf("View %d had inconsistent updates", i))
+			view.lock.Unlock()
+		}
+	})
+})
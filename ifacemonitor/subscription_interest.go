@@ -0,0 +1,136 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// Subscription is a handle on a subscriber, returned by NewSubscription.  It allows the
+// subscriber to register interest in particular interfaces, on top of its filter.
+type Subscription struct {
+	m           *InterfaceMonitor
+	s           *subscription
+	unsubscribe func()
+}
+
+// NewSubscription is like Subscribe but it returns a handle on the subscription.
+func (m *InterfaceMonitor) NewSubscription(sub Subscriber, withSnapshot bool) *Subscription {
+	s := newSubscription(sub)
+	return &Subscription{
+		m:           m,
+		s:           s,
+		unsubscribe: m.addSubscription(s, withSnapshot),
+	}
+}
+
+// RequestUpdatesFor is for subscribers that learn about an interface from elsewhere (for
+// example, a workload endpoint that names it) and want to know about it now.  It immediately
+// tells the subscriber what the monitor knows about the interface: its state and, if the
+// monitor tracks them, its addresses.  An interface that the monitor doesn't know about, or
+// that is excluded, is reported as down with nil addrs.  Then it refreshes the interface from
+// netlink, passing on any changes as usual.  From then on, the subscriber gets updates for the
+// interface even if it doesn't match the subscriber's filter, until CancelUpdatesFor.  The
+// callbacks are made before RequestUpdatesFor returns.
+func (h *Subscription) RequestUpdatesFor(ifaceName string) {
+	h.m.runOnMonitorLoop(func() {
+		h.m.requestUpdatesFor(h.s, ifaceName)
+	})
+}
+
+// CancelUpdatesFor undoes RequestUpdatesFor.  If the interface doesn't match the subscriber's
+// filter, the subscriber is told that it has gone, as if it had stopped matching the filter.
+func (h *Subscription) CancelUpdatesFor(ifaceName string) {
+	h.m.runOnMonitorLoop(func() {
+		if !h.s.interests[ifaceName] {
+			return
+		}
+		delete(h.s.interests, ifaceName)
+		if ifIndex, known := h.m.ifIndexForName(ifaceName); known {
+			h.m.refreshSubscription(h.s, ifIndex)
+		}
+	})
+}
+
+// Close removes the subscriber.
+func (h *Subscription) Close() {
+	h.unsubscribe()
+}
+
+func (m *InterfaceMonitor) requestUpdatesFor(s *subscription, ifaceName string) {
+	logCxt := log.WithField("ifaceName", ifaceName)
+	logCxt.Debug("Subscriber requested updates for interface.")
+	s.interests[ifaceName] = true
+
+	// Tell the subscriber what we know now...
+	if ifIndex, known := m.ifIndexForName(ifaceName); known {
+		state := State(StateDown)
+		if m.isReportedUp(ifIndex, ifaceName) {
+			state = StateUp
+		}
+		s.sendState(ifIndex, ifaceName, state, OriginReplay)
+		if !m.DisableAddrMonitoring {
+			s.sendAddrs(ifIndex, ifaceName, m.reportedAddrs(ifIndex, ifaceName), OriginReplay)
+		}
+	} else {
+		logCxt.Debug("Interface not known, reporting it as not present.")
+		s.callState(ifaceName, StateDown, 0, OriginReplay)
+		if !m.DisableAddrMonitoring {
+			s.callAddrs(ifaceName, nil, 0, OriginReplay)
+		}
+	}
+
+	// ...then make sure that it's up to date.  Any changes reach the subscriber through the
+	// usual notifications.
+	m.resyncIfaceByName(ifaceName)
+}
+
+// resyncIfaceByName refreshes a single interface from netlink.  If the interface has gone, we
+// fall back to a full resync, which handles removals.
+func (m *InterfaceMonitor) resyncIfaceByName(ifaceName string) {
+	links, err := m.netlinkStub.LinkList()
+	if err != nil {
+		log.WithError(err).Warn("Netlink list operation failed, interface may be stale until next resync.")
+		return
+	}
+	for _, link := range links {
+		if attrs := link.Attrs(); attrs != nil && attrs.Name == ifaceName {
+			restoreOrigin := m.setOrigin(OriginResync)
+			m.inResync = true
+			m.storeAndNotifyLink(true, link, 0)
+			m.inResync = false
+			restoreOrigin()
+			return
+		}
+	}
+	if _, known := m.ifIndexForName(ifaceName); !known {
+		return
+	}
+	if err := m.resync(); err != nil {
+		log.WithError(err).Warn("Resync failed, interface may be stale until next resync.")
+	}
+}
+
+// ifIndexForName returns the index of the interface that we know by the given name.
+func (m *InterfaceMonitor) ifIndexForName(ifaceName string) (int, bool) {
+	for ifIndex, name := range m.ifaceName {
+		if name == ifaceName {
+			return ifIndex, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"regexp"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ifacemonitor/testutils"
+
+	. "github.com/onsi/ginkgo"
+)
+
+var _ = Describe("Subscription interest", func() {
+	var nl *netlinkTest
+	var im *ifacemonitor.InterfaceMonitor
+	var recorder *testutils.Recorder
+	var sub *ifacemonitor.Subscription
+
+	BeforeEach(func() {
+		im, nl, _ = startMonitor(ifacemonitor.Config{}, func(nl *netlinkTest, im *ifacemonitor.InterfaceMonitor) {
+			setLinkNoSignal(nl, "eth0", "up", "10.0.0.1/32")
+			setLinkNoSignal(nl, "cali2", "up", "10.0.2.1/32")
+		})
+
+		recorder = testutils.NewRecorder()
+		sub = im.NewSubscription(ifacemonitor.Subscriber{
+			Filter:        ifacemonitor.SubscriberFilter{NameRegexp: regexp.MustCompile("^eth")},
+			StateCallback: recorder.StateCallback,
+			AddrCallback:  recorder.AddrCallback,
+		}, true)
+		recorder.ExpectSequence(
+			testutils.StateEvent("eth0", ifacemonitor.StateUp),
+			testutils.AddrsEvent("eth0", "10.0.0.1"),
+		)
+	})
+
+	AfterEach(func() {
+		sub.Close()
+		im.Stop()
+	})
+
+	It("should report an unknown interface as not present and then follow it", func() {
+		sub.RequestUpdatesFor("cali1")
+		recorder.ExpectSequence(
+			testutils.StateEvent("cali1", ifacemonitor.StateDown),
+			testutils.AddrsGoneEvent("cali1"),
+		)
+
+		nl.addLink("cali1")
+		recorder.ExpectSequence(testutils.AddrsEvent("cali1"))
+		nl.changeLinkState("cali1", "up")
+		recorder.ExpectSequence(testutils.StateEvent("cali1", ifacemonitor.StateUp))
+		nl.addAddr("cali1", "10.0.1.1/32")
+		recorder.ExpectSequence(testutils.AddrsEvent("cali1", "10.0.1.1"))
+
+		// Cancelling is like the interface no longer matching the filter.
+		sub.CancelUpdatesFor("cali1")
+		recorder.ExpectSequence(
+			testutils.StateEvent("cali1", ifacemonitor.StateDown),
+			testutils.AddrsGoneEvent("cali1"),
+		)
+		nl.changeLinkState("cali1", "down")
+		recorder.ExpectNoNewEvents()
+	})
+
+	It("should report a known interface's current state and then refresh it", func() {
+		recorder.ExpectNoEventsFor("cali2")
+
+		// A change that we haven't heard about from netlink.
+		setLinkNoSignal(nl, "cali2", "up", "10.0.2.1/32", "10.0.2.2/32")
+		sub.RequestUpdatesFor("cali2")
+		recorder.ExpectSequence(
+			testutils.StateEvent("cali2", ifacemonitor.StateUp),
+			testutils.AddrsEvent("cali2", "10.0.2.1"),
+			testutils.AddrsEvent("cali2", "10.0.2.1", "10.0.2.2"),
+		)
+
+		nl.changeLinkState("cali2", "down")
+		recorder.ExpectSequence(testutils.StateEvent("cali2", ifacemonitor.StateDown))
+		nl.delLink("cali2")
+		recorder.ExpectSequence(testutils.AddrsGoneEvent("cali2"))
+		recorder.ExpectNoNewEvents()
+	})
+})
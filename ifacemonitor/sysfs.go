@@ -0,0 +1,95 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const sysClassNet = "/sys/class/net"
+
+type sysfsStub interface {
+	ReadFile(path string) ([]byte, error)
+}
+
+type sysfsReal struct {
+}
+
+func (s *sysfsReal) ReadFile(path string) ([]byte, error) {
+	return ioutil.ReadFile(path)
+}
+
+func WithSysfsStub(s sysfsStub) InterfaceMonitorOp {
+	return func(m *InterfaceMonitor) {
+		m.sysfs = s
+	}
+}
+
+func (m *InterfaceMonitor) readSysfsAttr(ifaceName, attr string) (string, error) {
+	data, err := m.sysfs.ReadFile(filepath.Join(sysClassNet, ifaceName, attr))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// sysfsOperUp reads the oper state of the interface from /sys/class/net.  Returns ok=false if
+// the files couldn't be read (for example, because the interface has just been removed) or
+// the state isn't one that we understand.
+func (m *InterfaceMonitor) sysfsOperUp(ifaceName string) (up bool, ok bool) {
+	operState, err := m.readSysfsAttr(ifaceName, "operstate")
+	if err != nil {
+		log.WithError(err).WithField("ifaceName", ifaceName).Debug("Failed to read operstate.")
+		return false, false
+	}
+	switch operState {
+	case "up":
+		return true, true
+	case "down", "lowerlayerdown", "notpresent", "dormant":
+		return false, true
+	case "unknown":
+		// Some drivers (tun devices, for example) don't maintain the operstate; fall back to
+		// the carrier.  Reading the carrier fails if the interface is admin down.
+		carrier, err := m.readSysfsAttr(ifaceName, "carrier")
+		if err != nil {
+			log.WithError(err).WithField("ifaceName", ifaceName).Debug("Failed to read carrier.")
+			return false, false
+		}
+		return carrier == "1", true
+	}
+	return false, false
+}
+
+// verifyOperStateWithSysfs compares the oper state that we derived from netlink with the one
+// in /sys/class/net.  If they disagree, the /sys value wins.
+func (m *InterfaceMonitor) verifyOperStateWithSysfs(ifaceName string, netlinkUp bool) bool {
+	sysfsUp, ok := m.sysfsOperUp(ifaceName)
+	if !ok || sysfsUp == netlinkUp {
+		return netlinkUp
+	}
+	log.WithFields(log.Fields{
+		"ifaceName": ifaceName,
+		"netlinkUp": netlinkUp,
+		"sysfsUp":   sysfsUp,
+	}).Warn("Interface oper state from netlink disagrees with /sys/class/net; using /sys value.")
+	m.metrics.sysfsStateDiscrepancies.WithLabelValues(string(m.origin)).Inc()
+	return sysfsUp
+}
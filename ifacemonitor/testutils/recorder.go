@@ -0,0 +1,392 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package testutils contains helpers for testing code that consumes the interface monitor's
+// callbacks.
+package testutils
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/types"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/timeshim"
+)
+
+type EventType string
+
+const (
+	EventState EventType = "state"
+	EventAddrs EventType = "addrs"
+	// EventOther is for the monitor's other callbacks, which the test records with
+	// RecordOther.
+	EventOther EventType = "other"
+)
+
+// Event is a callback that the Recorder has received.
+type Event struct {
+	Type      EventType
+	IfaceName string
+	// State and IfIndex are set for EventState.
+	State   ifacemonitor.State
+	IfIndex int
+	// Addrs is set for EventAddrs, sorted.  It is nil if the interface's addresses have gone.
+	Addrs []string
+	// Detail is set for EventOther.
+	Detail string
+	// Origin is set if the Recorder was attached with AttachWithOrigins.
+	Origin ifacemonitor.UpdateOrigin
+	// Time is when the Recorder received the callback, according to its clock.
+	Time time.Time
+}
+
+// StateEvent, AddrsEvent, AddrsGoneEvent and OtherEvent make Events for use with ExpectSequence.
+func StateEvent(ifaceName string, state ifacemonitor.State) Event {
+	return Event{Type: EventState, IfaceName: ifaceName, State: state}
+}
+
+func AddrsEvent(ifaceName string, addrs ...string) Event {
+	sorted := make([]string, len(addrs))
+	copy(sorted, addrs)
+	sort.Strings(sorted)
+	return Event{Type: EventAddrs, IfaceName: ifaceName, Addrs: sorted}
+}
+
+func AddrsGoneEvent(ifaceName string) Event {
+	return Event{Type: EventAddrs, IfaceName: ifaceName}
+}
+
+func OtherEvent(ifaceName, detail string) Event {
+	return Event{Type: EventOther, IfaceName: ifaceName, Detail: detail}
+}
+
+// String formats the event for comparisons and failure messages, for example "eth0 up",
+// "eth0 addrs=[10.0.0.1]", "eth0 gone" or, for EventOther, the interface name (if any) and the
+// detail.
+// IfIndex and Time are omitted.
+func (e Event) String() string {
+	switch e.Type {
+	case EventState:
+		return fmt.Sprintf("%s %s", e.IfaceName, e.State)
+	case EventAddrs:
+		if e.Addrs == nil {
+			return fmt.Sprintf("%s gone", e.IfaceName)
+		}
+		return fmt.Sprintf("%s addrs=%v", e.IfaceName, e.Addrs)
+	case EventOther:
+		if e.IfaceName == "" {
+			return e.Detail
+		}
+		return fmt.Sprintf("%s %s", e.IfaceName, e.Detail)
+	}
+	return fmt.Sprintf("%s %s", e.IfaceName, e.Type)
+}
+
+// Recorder implements the monitor's StateCallback and AddrCallback, recording a timeline of the
+// callbacks, and has Gomega assertions on that timeline.  The test can put its other callbacks on
+// the same timeline with RecordOther.  Safe to use from any goroutine.
+//
+// The assertions poll, since the monitor makes its callbacks from its own goroutine.  The
+// Expect... methods that wait for something to happen give up after Timeout (if zero, 1s),
+// checking every PollInterval (if zero, 10ms); ExpectNoEventsFor and ExpectNoNewEvents check
+// that nothing happens for QuietPeriod (if zero, 100ms).  All of those are measured on the
+// Recorder's clock, which also timestamps the events.  If the test uses a mock clock, it should
+// give the Recorder the same one as the monitor: while the Recorder waits it advances a mock
+// clock by PollInterval between checks, so the monitor's timers fire just as they would with
+// real time.
+type Recorder struct {
+	Timeout      time.Duration
+	PollInterval time.Duration
+	QuietPeriod  time.Duration
+
+	time timeshim.Interface
+	// advance moves the clock on, if it's a mock clock; otherwise it's nil.
+	advance func(d time.Duration)
+
+	lock   sync.Mutex
+	events []Event
+	// cursor is the index of the first event that ExpectSequence hasn't matched yet.
+	cursor int
+}
+
+type RecorderOp func(r *Recorder)
+
+// WithTimeShim sets the clock that the Recorder uses to timestamp events and time its waits.
+func WithTimeShim(t timeshim.Interface) RecorderOp {
+	return func(r *Recorder) {
+		r.time = t
+		r.advance = nil
+		if mock, ok := t.(mockClock); ok {
+			r.advance = mock.IncrementTime
+		}
+	}
+}
+
+// mockClock is implemented by mock clocks, such as mocktime.MockTime, that the Recorder can
+// advance while it waits.
+type mockClock interface {
+	IncrementTime(d time.Duration)
+}
+
+func NewRecorder(options ...RecorderOp) *Recorder {
+	r := &Recorder{
+		time: timeshim.RealTime(),
+	}
+	for _, op := range options {
+		op(r)
+	}
+	return r
+}
+
+// Attach sets the Recorder's callbacks on the monitor.
+func (r *Recorder) Attach(m ifacemonitor.Monitor) {
+	m.SetCallbacks(r.StateCallback, r.AddrCallback)
+}
+
+// AttachWithOrigins is like Attach but it also records the origin of each event.
+func (r *Recorder) AttachWithOrigins(m *ifacemonitor.InterfaceMonitor) {
+	m.SetOriginCallbacks(r.StateOriginCallback, r.AddrOriginCallback)
+}
+
+func (r *Recorder) StateCallback(ifaceName string, state ifacemonitor.State, ifIndex int) {
+	r.StateOriginCallback(ifaceName, state, ifIndex, "")
+}
+
+func (r *Recorder) AddrCallback(ifaceName string, addrs set.Set) {
+	r.AddrOriginCallback(ifaceName, addrs, "")
+}
+
+func (r *Recorder) StateOriginCallback(ifaceName string, state ifacemonitor.State, ifIndex int, origin ifacemonitor.UpdateOrigin) {
+	r.record(Event{Type: EventState, IfaceName: ifaceName, State: state, IfIndex: ifIndex, Origin: origin})
+}
+
+func (r *Recorder) AddrOriginCallback(ifaceName string, addrs set.Set, origin ifacemonitor.UpdateOrigin) {
+	e := Event{Type: EventAddrs, IfaceName: ifaceName, Origin: origin}
+	if addrs != nil {
+		e.Addrs = []string{}
+		addrs.Iter(func(item interface{}) error {
+			e.Addrs = append(e.Addrs, item.(string))
+			return nil
+		})
+		sort.Strings(e.Addrs)
+	}
+	r.record(e)
+}
+
+// RecordOther records an EventOther for the interface, with the formatted detail.  For example,
+// a LinkAttrsCallback might record "mtu=9000".  ifaceName is empty for a callback that isn't
+// about one interface, such as the DefaultRouteCallback.
+func (r *Recorder) RecordOther(ifaceName, format string, args ...interface{}) {
+	r.record(Event{Type: EventOther, IfaceName: ifaceName, Detail: fmt.Sprintf(format, args...)})
+}
+
+func (r *Recorder) record(e Event) {
+	e.Time = r.time.Now()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.events = append(r.events, e)
+}
+
+// Events returns a copy of the timeline.
+func (r *Recorder) Events() []Event {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]Event(nil), r.events...)
+}
+
+// NewEvents returns the events that ExpectSequence hasn't matched yet and marks them as
+// matched.
+func (r *Recorder) NewEvents() []Event {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	events := append([]Event(nil), r.events[r.cursor:]...)
+	r.cursor = len(r.events)
+	return events
+}
+
+// State returns the last state reported for the interface, or StateUnknown if there hasn't been
+// one.
+func (r *Recorder) State(ifaceName string) ifacemonitor.State {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for i := len(r.events) - 1; i >= 0; i-- {
+		if e := r.events[i]; e.Type == EventState && e.IfaceName == ifaceName {
+			return e.State
+		}
+	}
+	return ifacemonitor.StateUnknown
+}
+
+// Addrs returns the last addresses reported for the interface, formatted as by Event.String,
+// or "" if there haven't been any.
+func (r *Recorder) Addrs(ifaceName string) string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for i := len(r.events) - 1; i >= 0; i-- {
+		if e := r.events[i]; e.Type == EventAddrs && e.IfaceName == ifaceName {
+			return e.String()
+		}
+	}
+	return ""
+}
+
+// ExpectState waits for the last reported state of the interface to be state.
+func (r *Recorder) ExpectState(ifaceName string, state ifacemonitor.State) {
+	r.eventually(func() interface{} {
+		return r.State(ifaceName)
+	}, Equal(state), "unexpected state for %s", ifaceName)
+}
+
+// ExpectAddrs waits for the last reported addresses of the interface to be addrs.
+func (r *Recorder) ExpectAddrs(ifaceName string, addrs ...string) {
+	r.eventually(func() interface{} {
+		return r.Addrs(ifaceName)
+	}, Equal(AddrsEvent(ifaceName, addrs...).String()))
+}
+
+// ExpectAddrsGone waits for the interface's addresses to be reported as gone.
+func (r *Recorder) ExpectAddrsGone(ifaceName string) {
+	r.eventually(func() interface{} {
+		return r.Addrs(ifaceName)
+	}, Equal(AddrsGoneEvent(ifaceName).String()))
+}
+
+// ExpectSequence waits for the next events, after those that it has already matched, to be
+// the given events, in order, and then marks them as matched.  IfIndex and Time aren't
+// compared.
+func (r *Recorder) ExpectSequence(events ...Event) {
+	if len(events) == 0 {
+		return
+	}
+	var expected []string
+	for _, e := range events {
+		expected = append(expected, e.String())
+	}
+	r.eventually(func() interface{} {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		var matched []string
+		for _, e := range r.events[r.cursor:] {
+			if len(matched) == len(expected) {
+				break
+			}
+			matched = append(matched, e.String())
+		}
+		return matched
+	}, Equal(expected))
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.cursor += len(expected)
+}
+
+// ExpectNoEventsFor checks that there are no events for the interface, either already or
+// during the QuietPeriod.
+func (r *Recorder) ExpectNoEventsFor(ifaceName string) {
+	r.consistently(func() interface{} {
+		var found []string
+		for _, e := range r.Events() {
+			if e.IfaceName == ifaceName {
+				found = append(found, e.String())
+			}
+		}
+		return found
+	}, BeEmpty())
+}
+
+// ExpectNoNewEvents checks that there are no events after those that ExpectSequence has
+// matched, either already or during the QuietPeriod.
+func (r *Recorder) ExpectNoNewEvents() {
+	r.consistently(func() interface{} {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		var found []string
+		for _, e := range r.events[r.cursor:] {
+			found = append(found, e.String())
+		}
+		return found
+	}, BeEmpty())
+}
+
+// eventually polls actual until it matches, failing the test if it hasn't by the Timeout.  Like
+// consistently, it must be called directly from one of the Expect... methods, so that failures
+// are reported at the line that called that.
+func (r *Recorder) eventually(actual func() interface{}, matcher types.GomegaMatcher, description ...interface{}) {
+	deadline := r.time.Now().Add(r.timeout())
+	for {
+		value := actual()
+		if ok, err := matcher.Match(value); ok && err == nil {
+			return
+		}
+		if !r.time.Now().Before(deadline) {
+			ExpectWithOffset(2, value).To(matcher, description...)
+			return
+		}
+		r.wait()
+	}
+}
+
+// consistently polls actual until the QuietPeriod has passed, failing the test if it ever
+// doesn't match.
+func (r *Recorder) consistently(actual func() interface{}, matcher types.GomegaMatcher, description ...interface{}) {
+	deadline := r.time.Now().Add(r.quietPeriod())
+	for {
+		value := actual()
+		if ok, err := matcher.Match(value); !ok || err != nil {
+			ExpectWithOffset(2, value).To(matcher, description...)
+			return
+		}
+		if !r.time.Now().Before(deadline) {
+			return
+		}
+		r.wait()
+	}
+}
+
+// wait gives the monitor a PollInterval to make its callbacks, moving a mock clock on by the
+// same amount.
+func (r *Recorder) wait() {
+	pollInterval := r.pollInterval()
+	time.Sleep(pollInterval)
+	if r.advance != nil {
+		r.advance(pollInterval)
+	}
+}
+
+func (r *Recorder) timeout() time.Duration {
+	if r.Timeout == 0 {
+		return time.Second
+	}
+	return r.Timeout
+}
+
+func (r *Recorder) pollInterval() time.Duration {
+	if r.PollInterval == 0 {
+		return 10 * time.Millisecond
+	}
+	return r.PollInterval
+}
+
+func (r *Recorder) quietPeriod() time.Duration {
+	if r.QuietPeriod == 0 {
+		return 100 * time.Millisecond
+	}
+	return r.QuietPeriod
+}
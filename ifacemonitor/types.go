@@ -0,0 +1,310 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ifacemonitor
+
+import (
+	"errors"
+	"regexp"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+// This file holds the declarations that are shared by the platform-specific implementations of
+// the monitor.
+
+type State string
+
+const (
+	StateUnknown = ""
+	StateUp      = "up"
+	StateDown    = "down"
+
+	// With Config.DetailedStates, the StateCallback is given one of these instead of StateDown,
+	// saying why the interface is down, and it is also called when an interface that stays
+	// down changes from one to another.  The InterfaceInfo always carries them.  All of them
+	// map to StateDown; see State.Coarse.
+	//
+	// StateNotPresent means that the interface has been deleted or renamed.
+	StateNotPresent = "not-present"
+	// StateAdminDown means that the interface has been disabled (IFF_UP is clear).
+	StateAdminDown = "admin-down"
+	// StateNoCarrier means that the interface is enabled but not running, for example because
+	// its cable is unplugged or its veth peer is down.  Often transient.
+	StateNoCarrier = "no-carrier"
+	// StateHeldDown means that the interface is running but that the monitor is reporting it
+	// as down anyway; see Config.ProtodownAsDown and Config.TeardownWindow.
+	StateHeldDown = "held-down"
+
+	// On kernels that report the oper state (see KernelCapabilities.OperState), these take the
+	// place of StateNoCarrier when the oper state says more.
+	//
+	// StateLowerLayerDown means that a device that the interface is stacked on is down, for
+	// example the parent of a VLAN.
+	StateLowerLayerDown = "lower-layer-down"
+	// StateDormant means that the interface is waiting for an external event, such as 802.1X
+	// authentication, before it can pass traffic.
+	StateDormant = "dormant"
+	// StateMissingComponent means that a component of the interface, typically hardware, is
+	// missing.
+	StateMissingComponent = "missing-component"
+)
+
+// Coarse maps the detailed states to StateDown, giving the state as it is reported without
+// Config.DetailedStates.  Consumers that can be configured either way should compare
+// state.Coarse() with StateDown, rather than state itself.
+func (s State) Coarse() State {
+	switch s {
+	case StateUnknown, StateUp, StateDown:
+		return s
+	}
+	return StateDown
+}
+
+type InterfaceStateCallback func(ifaceName string, ifaceState State, ifIndex int)
+type AddrStateCallback func(ifaceName string, addrs set.Set)
+
+// UpdateOrigin says what caused the monitor to make a notification.
+type UpdateOrigin string
+
+const (
+	// OriginEvent is a notification caused by a netlink event.
+	OriginEvent UpdateOrigin = "event"
+	// OriginResync is a correction made by a periodic (or targeted) resync.  Since it means that
+	// we missed an event, consumers may want to log it.
+	OriginResync UpdateOrigin = "resync"
+	// OriginReplay is a notification of the existing state, made by the start-of-day resync or
+	// as part of a snapshot for a new subscriber.
+	OriginReplay UpdateOrigin = "replay"
+)
+
+// InterfaceStateOriginCallback and AddrStateOriginCallback are the same as InterfaceStateCallback
+// and AddrStateCallback but with the origin of the notification.
+type InterfaceStateOriginCallback func(ifaceName string, ifaceState State, ifIndex int, origin UpdateOrigin)
+type AddrStateOriginCallback func(ifaceName string, addrs set.Set, origin UpdateOrigin)
+
+// Heartbeat is passed to the HeartbeatCallback after each resync.
+type Heartbeat struct {
+	// NumInterfaces is the number of non-excluded interfaces that the monitor knows about.
+	NumInterfaces int
+	Timestamp     time.Time
+}
+
+type HeartbeatCallback func(heartbeat Heartbeat)
+
+// InSyncCallback is called once the monitor has reported the interfaces and addresses that
+// existed when it started.
+type InSyncCallback func()
+
+// Monitor is the interface shared by the InterfaceMonitor and the HelperClient, which runs the
+// monitor in a helper process.
+type Monitor interface {
+	SetCallbacks(stateCallback InterfaceStateCallback, addrCallback AddrStateCallback)
+	MonitorInterfaces()
+	Stop()
+}
+
+type Config struct {
+	// InterfaceExcludes is a list of interface names that we don't want callbacks for.
+	InterfaceExcludes []*regexp.Regexp
+	// InterfaceIncludes, if non-empty, is a list of interface names that we do want callbacks
+	// for; an interface that matches none of them is treated as if it matched
+	// InterfaceExcludes.  An interface that is renamed into or out of the set is reported as if
+	// the old one had been deleted and the new one created.
+	InterfaceIncludes []*regexp.Regexp
+	// ResyncInterval is the interval at which we rescan all the interfaces.  If 0, defaults to
+	// 10s; if <0, rescanning is disabled and we rely on netlink updates alone.  On Linux, each
+	// interval is varied by up to 10% either way so that hosts don't all rescan in step.
+	ResyncInterval time.Duration
+	// TeardownWindow is the length of time after we see an interface being deleted (a DELLINK
+	// for its index, or its disappearance in a resync) during which we suppress "up"
+	// notifications for that index.  This avoids reporting spurious flaps from stale updates
+	// for an interface that is in the process of disappearing.  When the window expires, an
+	// interface with that index that is up is reported straight away.  Zero disables the
+	// suppression.
+	TeardownWindow time.Duration
+	// AddrAnnounceInterval is the minimum interval between announcements of the same address by
+	// the AddrAnnouncer.  If <=0, defaults to 10s.
+	AddrAnnounceInterval time.Duration
+	// IPv4OnlyInterfaces and IPv6OnlyInterfaces match interfaces that are expected to carry
+	// addresses of only that IP family.  An address of the other family is logged and reported
+	// to the UnexpectedAddrFamilyCallback.
+	IPv4OnlyInterfaces []*regexp.Regexp
+	IPv6OnlyInterfaces []*regexp.Regexp
+	// SysfsOperStateCheck enables a cross check of the interface oper state that we derive from
+	// netlink against /sys/class/net/<iface>/operstate (and carrier).  The check is only done
+	// on state transitions and during resync.  If the two disagree, the /sys value is used.
+	SysfsOperStateCheck bool
+	// DisableAddrMonitoring turns off address tracking for consumers that only care about link
+	// state.  We don't subscribe to address (local route) updates or list addresses, and the
+	// AddrCallback is never called.
+	DisableAddrMonitoring bool
+	// TrackProtodown enables tracking of the protodown state of interfaces, which switch
+	// automation and some NIC drivers use to disable a port administratively.  It is reported
+	// in the InterfaceInfo and LinkAttrsDelta.
+	TrackProtodown bool
+	// ProtodownAsDown, with TrackProtodown, reports protodown interfaces as down, since they
+	// can't be used for routing.
+	ProtodownAsDown bool
+	// DetailedStates makes the StateCallback report why an interface is down (StateAdminDown,
+	// StateNoCarrier, StateDormant and so on) instead of StateDown, and report changes between those for an
+	// interface that stays down.  The other callbacks and the subscribers still get StateDown.
+	DetailedStates bool
+	// MatchAltNames enables tracking of interfaces' alternative names (altnames).  An interface
+	// matches InterfaceExcludes if any of its names match.  Needs a netlink request per link
+	// update so it is off by default.
+	MatchAltNames bool
+	// StateFile, if set, is the path of a file that we save our state to when the monitor is
+	// stopped and every StateFileWriteInterval (if >0).  At start of day, the state is restored
+	// from the file, as if by Restore, unless it is older than StateFileMaxAge (if <=0,
+	// defaults to 10 minutes) or can't be read.
+	StateFile              string
+	StateFileWriteInterval time.Duration
+	StateFileMaxAge        time.Duration
+	// EventStreamSocket, if set, is the path of a unix socket on which we serve a read-only
+	// stream of our updates, as newline-delimited JSON StreamEvents, for debugging tools.  Each
+	// client has its own queue of up to EventStreamQueueLen events (if <=0, defaults to 1000);
+	// if the client falls behind, the oldest events are dropped.
+	EventStreamSocket   string
+	EventStreamQueueLen int
+	// RecordFile, if set, is the path of a file that we record the netlink updates that we
+	// receive, and the results of our netlink and /sys requests, to.  The recording can be
+	// replayed with a Replayer to reproduce a problem.  The file is overwritten each time the
+	// monitor starts and grows without limit, so this is only for debugging.
+	RecordFile string
+	// CallbackRetryAttempts and CallbackRetryInterval control the retries of notifications that
+	// a callback set with SetFallibleCallbacks fails.  A notification is attempted up to
+	// CallbackRetryAttempts times in total (if <=0, defaults to 5); the first retry is after
+	// CallbackRetryInterval (if <=0, defaults to 100ms) and the interval doubles after each
+	// failed retry.
+	CallbackRetryAttempts int
+	CallbackRetryInterval time.Duration
+	// ResyncRetryAttempts and ResyncRetryInterval control the retries of periodic resyncs that
+	// fail.  After a failure, the resync is retried after ResyncRetryInterval (if <=0, defaults
+	// to 100ms), doubling after each failed retry; once ResyncRetryAttempts resyncs in a row
+	// (if <=0, defaults to 5) have failed, the monitor stops and Run returns the error.  The
+	// start-of-day resync isn't retried.  The same settings apply to re-subscribing to netlink
+	// if the subscription fails, after which the monitor resyncs to catch up.
+	ResyncRetryAttempts int
+	ResyncRetryInterval time.Duration
+	// MaxPauseDuration is the longest that the monitor stays paused (see Pause) before it
+	// resumes by itself, with a warning.  If <=0, defaults to 1 minute.
+	MaxPauseDuration time.Duration
+	// BatchDelay, if >0, makes the monitor coalesce bursts of StateCallback and AddrCallback
+	// notifications: the first notification starts a batch and is held back, along with any
+	// others, until BatchDelay has passed.  The held notifications are then made in the same
+	// way as on Resume, so an interface that flaps within the batch may not be reported at
+	// all.  No notification is delayed by more than BatchDelay.  If <=0, notifications are
+	// made immediately.
+	BatchDelay time.Duration
+	// MaxUpdateBatch is the largest number of netlink updates that we handle in one go, before
+	// checking for other work, such as a resync.  If <=0, defaults to 100.
+	MaxUpdateBatch int
+	// FlushAddrs makes the monitor report an empty set of addresses for an interface just
+	// before it reports that the interface's addresses have gone (nil addrs), so that consumers
+	// can clean up through their usual address removal path.  FlushAddrsOnDown (which implies
+	// FlushAddrs) also reports an empty set when an interface goes down; further address
+	// changes are then held back until the interface comes up again, when its current addresses
+	// are reported.
+	FlushAddrs       bool
+	FlushAddrsOnDown bool
+	// LinkLocalAddrZones makes the monitor report IPv6 link-local addresses with the name of
+	// their interface as the zone, for example "fe80::1%eth0", since the bare address is
+	// ambiguous across interfaces.
+	LinkLocalAddrZones bool
+	// ExcludeLinkLocalAddrs and ExcludeLoopbackAddrs make the monitor ignore link-local
+	// (169.254.0.0/16 and fe80::/10) and loopback addresses, respectively, as if the interfaces
+	// didn't have them, so that adding or removing one doesn't cause an AddrCallback.
+	ExcludeLinkLocalAddrs bool
+	ExcludeLoopbackAddrs  bool
+	// CanaryInterval, if >0, enables a self-test that checks that netlink events are reaching
+	// the monitor: at this interval, the monitor toggles the admin state of a dummy interface,
+	// CanaryIfaceName (creating it if need be), and checks that the event arrives within
+	// CanaryTimeout (if <=0, 5s).  The results are passed to the CanaryCallback.  Needs
+	// CAP_NET_ADMIN; without it, the self-test is disabled after logging a warning.
+	CanaryInterval time.Duration
+	CanaryTimeout  time.Duration
+	// UnclaimedIfaceGracePeriod is how long a workload interface can be unclaimed before the
+	// monitor flags it; see InterfaceMonitor.ClaimFunc.  If <=0, defaults to 10 minutes.
+	UnclaimedIfaceGracePeriod time.Duration
+	// ExportDir, if set, is a directory that we mirror our view of the interfaces into, for
+	// tools that can't use netlink: one ExportedIface JSON file per interface, named
+	// "iface-<name>.json", and an ExportSummary in "summary.json".  Files are replaced
+	// atomically, and only when their contents change; changes are batched up for
+	// ExportCoalesceInterval (if <=0, defaults to 500ms).  Files for interfaces that no longer
+	// exist are removed, including those left over from a previous run.
+	ExportDir              string
+	ExportCoalesceInterval time.Duration
+	// AddrCountThreshold, if >0, is the number of addresses that an interface can have before
+	// we flag it, since a bug that keeps adding addresses to one interface slows everything
+	// down.  Crossing the threshold is logged, at most once per AddrCountWarnInterval (if <=0,
+	// defaults to 1 minute) for each interface, counted and reported by Interfaces.  The flag
+	// is cleared once the count falls to 90% of the threshold.
+	AddrCountThreshold    int
+	AddrCountWarnInterval time.Duration
+	// EmptyMasterDown makes the effective state of a bridge or bond with no members down (see
+	// MasterStateCallback).  By default, it's the master's own state.
+	EmptyMasterDown bool
+	// Registerer, if set, is the Prometheus registry that the monitor's metrics are registered
+	// with; if nil, the monitor doesn't export any metrics.  Monitors that share a Registerer,
+	// such as the per-namespace monitors of a MultiMonitor, share its metrics, which are then
+	// the totals across the monitors.  It isn't passed to the helper process of a HelperClient,
+	// which has no way to export them.
+	Registerer prometheus.Registerer
+}
+
+// InterfaceClass is the bucket that a Classifier puts an interface in.
+type InterfaceClass string
+
+const (
+	ClassWorkload InterfaceClass = "workload"
+	ClassHost     InterfaceClass = "host"
+	ClassTunnel   InterfaceClass = "tunnel"
+	ClassIgnore   InterfaceClass = "ignore"
+)
+
+// InterfaceStatus is the monitor's view of an interface, as returned by Interfaces.
+type InterfaceStatus struct {
+	Index int    `json:"index"`
+	Name  string `json:"name"`
+	// State is StateUnknown for excluded interfaces, since we don't track their state.
+	State    State `json:"state"`
+	Excluded bool  `json:"excluded,omitempty"`
+	// Addrs is nil if we don't track the interface's addresses.
+	Addrs        []string       `json:"addrs"`
+	MTU          int            `json:"mtu,omitempty"`
+	HardwareAddr string         `json:"hardware_addr,omitempty"`
+	Class        InterfaceClass `json:"class,omitempty"`
+	AltNames     []string       `json:"alt_names,omitempty"`
+	// Unclaimed is set for workload interfaces that have been flagged as unclaimed.
+	Unclaimed bool `json:"unclaimed,omitempty"`
+	// MACSharedWith lists the unrelated interfaces that have the same MAC address, if any.
+	MACSharedWith []string `json:"mac_shared_with,omitempty"`
+	// TooManyAddrs is set if the interface has more than Config.AddrCountThreshold addresses.
+	TooManyAddrs bool `json:"too_many_addrs,omitempty"`
+	// EffectiveState and Members are only set for masters, such as bridges and bonds; see
+	// MasterStateCallback.
+	EffectiveState State    `json:"effective_state,omitempty"`
+	Members        []string `json:"members,omitempty"`
+}
+
+// IsPermissionError returns true if err, from Run or ResyncOnce, was caused by a lack of
+// permission to use netlink.
+func IsPermissionError(err error) bool {
+	return errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES)
+}
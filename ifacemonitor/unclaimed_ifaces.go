@@ -0,0 +1,88 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultUnclaimedIfaceGracePeriod = 10 * time.Minute
+
+// IfaceClaimFunc returns true if the consumer knows what a workload interface is for, for
+// example, because a workload endpoint names it.  It is called from the monitor's goroutine so
+// it should be quick.
+type IfaceClaimFunc func(ifaceName string) bool
+
+// UnclaimedIfaceCallback is called when a workload interface has been unclaimed for longer than
+// the grace period, which may mean that it has leaked.  It's only called once for each
+// interface, unless the interface is claimed in the meantime.
+type UnclaimedIfaceCallback func(ifaceName string, ifIndex int, unclaimedFor time.Duration)
+
+func (m *InterfaceMonitor) unclaimedIfaceGracePeriod() time.Duration {
+	if m.UnclaimedIfaceGracePeriod <= 0 {
+		return defaultUnclaimedIfaceGracePeriod
+	}
+	return m.UnclaimedIfaceGracePeriod
+}
+
+// checkUnclaimedIfaces is called after each resync.  It asks the ClaimFunc about each
+// interface that the Classifier says is a workload interface and flags the ones that have been
+// unclaimed for longer than the grace period.  Since we can't tell how old an interface is,
+// the grace period runs from when we first see it unclaimed.
+func (m *InterfaceMonitor) checkUnclaimedIfaces() {
+	if m.ClaimFunc == nil || m.Classifier == nil {
+		return
+	}
+	now := m.time.Now()
+	gracePeriod := m.unclaimedIfaceGracePeriod()
+	for ifIndex, ifaceName := range m.ifaceName {
+		if m.classes[ifIndex] != ClassWorkload || m.isExcludedInterface(ifaceName) || m.ClaimFunc(ifaceName) {
+			m.forgetUnclaimedIface(ifIndex)
+			continue
+		}
+		since, known := m.unclaimedSince[ifIndex]
+		if !known {
+			m.unclaimedSince[ifIndex] = now
+			continue
+		}
+		unclaimedFor := now.Sub(since)
+		if m.unclaimedFlagged[ifIndex] || unclaimedFor < gracePeriod {
+			continue
+		}
+		log.WithFields(log.Fields{
+			"ifaceName":    ifaceName,
+			"unclaimedFor": unclaimedFor,
+		}).Warn("Workload interface has been unclaimed for a long time; it may have leaked.")
+		m.unclaimedFlagged[ifIndex] = true
+		if m.UnclaimedIfaceCallback != nil {
+			m.UnclaimedIfaceCallback(ifaceName, ifIndex, unclaimedFor)
+		}
+	}
+	m.metrics.unclaimedIfaces.Set(float64(len(m.unclaimedFlagged)))
+}
+
+// forgetUnclaimedIface is called when an interface is claimed, stops being a workload
+// interface or is removed.
+func (m *InterfaceMonitor) forgetUnclaimedIface(ifIndex int) {
+	delete(m.unclaimedSince, ifIndex)
+	if m.unclaimedFlagged[ifIndex] {
+		delete(m.unclaimedFlagged, ifIndex)
+		m.metrics.unclaimedIfaces.Set(float64(len(m.unclaimedFlagged)))
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"sync"
+	"time"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ifacemonitor/testutils"
+	"github.com/projectcalico/felix/timeshim/mocktime"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type unclaimedIface struct {
+	name         string
+	unclaimedFor time.Duration
+}
+
+var _ = Describe("Unclaimed workload interfaces", func() {
+	var nl *netlinkTest
+	var resyncC chan time.Time
+	var mockTime *mocktime.MockTime
+	var im *ifacemonitor.InterfaceMonitor
+	var recorder *testutils.Recorder
+	var lock sync.Mutex
+	var claimed map[string]bool
+	var flagged []unclaimedIface
+
+	getFlagged := func() []unclaimedIface {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]unclaimedIface(nil), flagged...)
+	}
+	claim := func(name string) {
+		lock.Lock()
+		defer lock.Unlock()
+		claimed[name] = true
+	}
+	resync := func() {
+		resyncC <- time.Now()
+		resyncC <- time.Now()
+	}
+	unclaimedNames := func() (names []string) {
+		for _, status := range im.Interfaces() {
+			if status.Unclaimed {
+				names = append(names, status.Name)
+			}
+		}
+		return
+	}
+
+	BeforeEach(func() {
+		resyncC = make(chan time.Time)
+		mockTime = mocktime.New()
+		lock.Lock()
+		claimed = map[string]bool{}
+		flagged = nil
+		lock.Unlock()
+		im, nl, recorder = startMonitor(ifacemonitor.Config{
+			UnclaimedIfaceGracePeriod: time.Minute,
+		}, func(nl *netlinkTest, im *ifacemonitor.InterfaceMonitor) {
+			setLinkNoSignal(nl, "eth0", "up")
+			setLinkNoSignal(nl, "cali1", "up")
+			setLinkNoSignal(nl, "cali2", "up")
+			im.Classifier = ifacemonitor.DefaultClassifier
+			im.ClaimFunc = func(ifaceName string) bool {
+				lock.Lock()
+				defer lock.Unlock()
+				return claimed[ifaceName]
+			}
+			im.UnclaimedIfaceCallback = func(ifaceName string, ifIndex int, unclaimedFor time.Duration) {
+				lock.Lock()
+				defer lock.Unlock()
+				flagged = append(flagged, unclaimedIface{ifaceName, unclaimedFor})
+			}
+		}, withResyncC(resyncC), withMonitorOps(ifacemonitor.WithMonitorTimeShim(mockTime)))
+		recorder.ExpectState("cali2", ifacemonitor.StateUp)
+	})
+
+	AfterEach(func() {
+		im.Stop()
+	})
+
+	It("should only flag interfaces that are still unclaimed after the grace period", func() {
+		// cali1's endpoint shows up late, but within the grace period.
+		mockTime.IncrementTime(30 * time.Second)
+		claim("cali1")
+		resync()
+		Expect(getFlagged()).To(BeEmpty())
+
+		mockTime.IncrementTime(31 * time.Second)
+		resync()
+		Expect(getFlagged()).To(Equal([]unclaimedIface{{"cali2", 61 * time.Second}}))
+		Expect(unclaimedNames()).To(Equal([]string{"cali2"}))
+
+		// Only flagged once.
+		mockTime.IncrementTime(time.Hour)
+		resync()
+		Expect(getFlagged()).To(HaveLen(1))
+	})
+
+	It("should clear the flag when the interface is claimed", func() {
+		mockTime.IncrementTime(2 * time.Minute)
+		resync()
+		Expect(unclaimedNames()).To(Equal([]string{"cali1", "cali2"}))
+
+		claim("cali2")
+		resync()
+		Expect(unclaimedNames()).To(Equal([]string{"cali1"}))
+		Expect(getFlagged()).To(HaveLen(2))
+	})
+
+	It("should forget interfaces that are removed", func() {
+		mockTime.IncrementTime(2 * time.Minute)
+		resync()
+		Expect(getFlagged()).To(HaveLen(2))
+
+		nl.delLink("cali2")
+		recorder.ExpectState("cali2", ifacemonitor.StateDown)
+		Expect(unclaimedNames()).To(Equal([]string{"cali1"}))
+
+		// A new interface with the same name gets a new grace period.
+		nl.addLink("cali2")
+		resync()
+		mockTime.IncrementTime(30 * time.Second)
+		resync()
+		Expect(getFlagged()).To(HaveLen(2))
+		mockTime.IncrementTime(30 * time.Second)
+		resync()
+		Expect(getFlagged()).To(HaveLen(3))
+		Expect(getFlagged()[2]).To(Equal(unclaimedIface{"cali2", time.Minute}))
+	})
+})
@@ -0,0 +1,110 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"regexp"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+// UpCountCallback is called when the set of up interfaces that match a watched pattern (see
+// WatchUpCount) becomes non-empty (anyUp is true) or empty.  It isn't called while the number
+// of interfaces changes between non-zero values.
+type UpCountCallback func(watchName string, anyUp bool)
+
+type upCountWatch struct {
+	pattern  *regexp.Regexp
+	callback UpCountCallback
+	// upNames holds the names of the up interfaces that match the pattern.
+	upNames set.Set
+}
+
+// WatchUpCount registers a named pattern.  The monitor keeps count of the up interfaces whose
+// names match it, exposes the count as a gauge, labelled with the name, and calls the callback
+// when there are no longer any or there are some again.  A new watch starts out empty, so the
+// callback is called straight away if some interfaces already match.  Registering a watch with
+// the same name as an existing one replaces it; the callback is called if that changes whether
+// any interfaces match.  Safe to call from any goroutine; the callback is called from the
+// monitor's goroutine.
+func (m *InterfaceMonitor) WatchUpCount(watchName string, pattern *regexp.Regexp, callback UpCountCallback) {
+	m.runOnMonitorLoop(func() {
+		w := &upCountWatch{
+			pattern:  pattern,
+			callback: callback,
+			upNames:  set.New(),
+		}
+		wasAnyUp := false
+		if old := m.upCountWatches[watchName]; old != nil {
+			wasAnyUp = old.upNames.Len() > 0
+		}
+		for ifaceName := range m.upIfaces {
+			if pattern.MatchString(ifaceName) {
+				w.upNames.Add(ifaceName)
+			}
+		}
+		m.upCountWatches[watchName] = w
+		m.updateUpCount(watchName, w, wasAnyUp)
+	})
+}
+
+// UnwatchUpCount removes a watch added by WatchUpCount, along with its share of the gauge.
+func (m *InterfaceMonitor) UnwatchUpCount(watchName string) {
+	m.runOnMonitorLoop(func() {
+		delete(m.upCountWatches, watchName)
+		m.metrics.upIfacesMatching.Delete(watchName)
+	})
+}
+
+// countUpIface is called for each state notification.
+func (m *InterfaceMonitor) countUpIface(ifaceName string, state State) {
+	for watchName, w := range m.upCountWatches {
+		if !w.pattern.MatchString(ifaceName) {
+			continue
+		}
+		wasAnyUp := w.upNames.Len() > 0
+		if state == StateUp {
+			w.upNames.Add(ifaceName)
+		} else {
+			w.upNames.Discard(ifaceName)
+		}
+		m.updateUpCount(watchName, w, wasAnyUp)
+	}
+}
+
+func (m *InterfaceMonitor) updateUpCount(watchName string, w *upCountWatch, wasAnyUp bool) {
+	numUp := w.upNames.Len()
+	m.metrics.upIfacesMatching.Set(watchName, float64(numUp))
+	anyUp := numUp > 0
+	if anyUp == wasAnyUp {
+		return
+	}
+	logCxt := log.WithFields(log.Fields{
+		"watch":   watchName,
+		"pattern": w.pattern,
+	})
+	if anyUp {
+		logCxt.Info("Interfaces matching pattern are up.")
+	} else {
+		logCxt.Warn("No interfaces matching pattern are up.")
+	}
+	if w.callback != nil {
+		w.callback(watchName, anyUp)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ifacemonitor/testutils"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Up interface counts", func() {
+	var nl *netlinkTest
+	var im *ifacemonitor.InterfaceMonitor
+	var recorder *testutils.Recorder
+	var lock sync.Mutex
+	var transitions []string
+
+	getTransitions := func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string(nil), transitions...)
+	}
+	onTransition := func(watchName string, anyUp bool) {
+		lock.Lock()
+		defer lock.Unlock()
+		transitions = append(transitions, fmt.Sprintf("%s %v", watchName, anyUp))
+	}
+
+	BeforeEach(func() {
+		lock.Lock()
+		transitions = nil
+		lock.Unlock()
+		im, nl, recorder = startMonitor(ifacemonitor.Config{}, func(nl *netlinkTest, im *ifacemonitor.InterfaceMonitor) {
+			setLinkNoSignal(nl, "eth0", "up")
+			setLinkNoSignal(nl, "cali1", "down")
+			setLinkNoSignal(nl, "cali2", "down")
+			im.WatchUpCount("workloads", regexp.MustCompile("^cali"), onTransition)
+			im.WatchUpCount("uplinks", regexp.MustCompile("^eth"), onTransition)
+		})
+		recorder.ExpectState("eth0", ifacemonitor.StateUp)
+		Eventually(getTransitions).Should(Equal([]string{"uplinks true"}))
+	})
+
+	AfterEach(func() {
+		im.Stop()
+	})
+
+	It("should only signal the first interface coming up and the last going down", func() {
+		nl.changeLinkState("cali1", "up")
+		Eventually(getTransitions).Should(Equal([]string{"uplinks true", "workloads true"}))
+
+		// No storm while the count moves between non-zero values.
+		nl.changeLinkState("cali2", "up")
+		nl.changeLinkState("cali1", "down")
+		nl.changeLinkState("cali1", "up")
+		nl.delLink("cali2")
+		recorder.ExpectState("cali2", ifacemonitor.StateDown)
+		Consistently(getTransitions, "50ms").Should(HaveLen(2))
+
+		nl.changeLinkState("cali1", "down")
+		Eventually(getTransitions).Should(Equal([]string{"uplinks true", "workloads true", "workloads false"}))
+
+		nl.delLink("eth0")
+		Eventually(getTransitions).Should(HaveLen(4))
+		Expect(getTransitions()[3]).To(Equal("uplinks false"))
+	})
+
+	It("should signal transitions caused by changing the pattern", func() {
+		nl.changeLinkState("cali1", "up")
+		Eventually(getTransitions).Should(HaveLen(2))
+
+		// Still matches cali1, so no change.
+		im.WatchUpCount("workloads", regexp.MustCompile("^cali[0-9]"), onTransition)
+		Expect(getTransitions()).To(HaveLen(2))
+
+		im.WatchUpCount("workloads", regexp.MustCompile("^tap"), onTransition)
+		Expect(getTransitions()[2:]).To(Equal([]string{"workloads false"}))
+
+		im.WatchUpCount("workloads", regexp.MustCompile("^(tap|cali)"), onTransition)
+		Expect(getTransitions()[3:]).To(Equal([]string{"workloads true"}))
+
+		// Once the watch has gone, there are no more callbacks.
+		im.UnwatchUpCount("workloads")
+		nl.changeLinkState("cali1", "down")
+		recorder.ExpectState("cali1", ifacemonitor.StateDown)
+		Expect(getTransitions()).To(HaveLen(4))
+	})
+})
@@ -0,0 +1,133 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const defaultMaxUpdateBatch = 100
+
+func (m *InterfaceMonitor) maxUpdateBatch() int {
+	if m.MaxUpdateBatch <= 0 {
+		return defaultMaxUpdateBatch
+	}
+	return m.MaxUpdateBatch
+}
+
+// readUpdateBatch returns the given update followed by whatever other updates are available
+// straight away, up to the maximum batch size.  The bound means that a continuous stream of
+// updates can't keep us from the other triggers for long.  closed is true if the channel has
+// been closed.
+func (m *InterfaceMonitor) readUpdateBatch(first NetlinkUpdate, updates <-chan NetlinkUpdate) (batch []NetlinkUpdate, closed bool) {
+	batch = []NetlinkUpdate{first}
+	maxBatch := m.maxUpdateBatch()
+	for len(batch) < maxBatch {
+		select {
+		case update, ok := <-updates:
+			if !ok {
+				return batch, true
+			}
+			batch = append(batch, update)
+		default:
+			return batch, false
+		}
+	}
+	return batch, false
+}
+
+func updateIfIndex(update NetlinkUpdate) int {
+	if update.Link != nil {
+		return int(update.Link.Index)
+	}
+	return update.Route.LinkIndex
+}
+
+// findCancellingAddrUpdates finds the address adds in a batch that are followed by a delete of
+// the same address, with no other updates for the interface in between.  It returns a map from
+// the position of each such add to the position of its delete.
+func findCancellingAddrUpdates(batch []NetlinkUpdate) map[int]int {
+	var cancelling map[int]int
+	lastPos := map[int]int{}
+	for pos, update := range batch {
+		ifIndex := updateIfIndex(update)
+		prevPos, seen := lastPos[ifIndex]
+		lastPos[ifIndex] = pos
+		if !seen || update.Route == nil || update.Route.Type != unix.RTM_DELROUTE {
+			continue
+		}
+		prev := batch[prevPos].Route
+		if prev == nil || prev.Type != unix.RTM_NEWROUTE || !ipNetsEqual(prev.Dst, update.Route.Dst) {
+			continue
+		}
+		if cancelling == nil {
+			cancelling = map[int]int{}
+		}
+		cancelling[prevPos] = pos
+	}
+	return cancelling
+}
+
+// handleUpdateBatch handles a batch of updates, in order.  An address add that is followed by
+// a delete of the same address (see findCancellingAddrUpdates) is skipped.  If we didn't
+// already have the address, the delete is skipped too, since together they make no change.
+// Skipped updates aren't recorded.
+func (m *InterfaceMonitor) handleUpdateBatch(batch []NetlinkUpdate) {
+	cancelling := findCancellingAddrUpdates(batch)
+	var skip map[int]bool
+	for pos, update := range batch {
+		if skip[pos] {
+			m.metrics.coalescedUpdates.Inc()
+			m.replayEventHandled()
+			continue
+		}
+		if delPos, ok := cancelling[pos]; ok {
+			ifIndex := update.Route.LinkIndex
+			addr := update.Route.Dst.IP.String()
+			if addrs := m.ifaceAddrs[ifIndex]; addrs == nil || !addrs.Contains(addr) {
+				if skip == nil {
+					skip = map[int]bool{}
+				}
+				skip[delPos] = true
+			}
+			log.WithFields(log.Fields{
+				"ifIndex":      ifIndex,
+				"addr":         addr,
+				"skipDeletion": skip[delPos],
+			}).Debug("Address added and deleted again in the same batch, skipping the add.")
+			m.metrics.coalescedUpdates.Inc()
+			m.replayEventHandled()
+			continue
+		}
+		m.handleUpdate(update)
+	}
+	m.updateAddrsGauge()
+}
+
+func (m *InterfaceMonitor) handleUpdate(update NetlinkUpdate) {
+	if update.Link != nil {
+		log.WithField("update", *update.Link).Debug("Link update")
+		m.recordLinkUpdate(*update.Link)
+		m.handleNetlinkUpdate(*update.Link)
+	} else {
+		log.WithField("addrUpdate", *update.Route).Debug("Address update")
+		m.recordRouteUpdate(recordedRouteUpdate, *update.Route)
+		m.handleNetlinkRouteUpdate(*update.Route)
+	}
+	m.replayEventHandled()
+}
@@ -0,0 +1,57 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+// BenchmarkLinkUpdateThroughput measures how fast the monitor handles a stream of link updates,
+// which the update filter passes straight through.
+func BenchmarkLinkUpdateThroughput(b *testing.B) {
+	logLevel := logrus.GetLevel()
+	logrus.SetLevel(logrus.WarnLevel)
+	defer logrus.SetLevel(logLevel)
+
+	mtuC := make(chan int, 10)
+	im, nl, _ := startMonitor(ifacemonitor.Config{}, func(nl *netlinkTest, im *ifacemonitor.InterfaceMonitor) {
+		setLinkNoSignal(nl, "eth0", "up")
+		im.LinkAttrsCallback = func(ifaceName string, ifIndex int, delta ifacemonitor.LinkAttrsDelta) {
+			if delta.MTUChanged {
+				mtuC <- delta.MTU
+			}
+		}
+		im.SetCallbacks(func(string, ifacemonitor.State, int) {}, func(string, set.Set) {})
+	})
+	defer im.Stop()
+	<-mtuC // Start of day.
+
+	b.ResetTimer()
+	go func() {
+		for i := 0; i < b.N; i++ {
+			nl.changeLinkMTU("eth0", 1000+i%2)
+		}
+	}()
+	for i := 0; i < b.N; i++ {
+		<-mtuC
+	}
+}
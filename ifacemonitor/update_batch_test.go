@@ -0,0 +1,140 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ifacemonitor/testutils"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Update batching", func() {
+	var nl *netlinkTest
+	var resyncC chan time.Time
+	var im *ifacemonitor.InterfaceMonitor
+	var recorder *testutils.Recorder
+	var blockC, blockedC chan struct{}
+	var registry *prometheus.Registry
+
+	coalescedUpdates := func() float64 {
+		families, err := registry.Gather()
+		Expect(err).NotTo(HaveOccurred())
+		for _, family := range families {
+			if family.GetName() == "felix_iface_monitor_coalesced_updates" {
+				return family.GetMetric()[0].GetCounter().GetValue()
+			}
+		}
+		return 0
+	}
+
+	BeforeEach(func() {
+		resyncC = make(chan time.Time)
+		registry = prometheus.NewRegistry()
+		// Lets the test hold up the monitor's goroutine, so that updates queue up, by
+		// bringing eth1 up.
+		blockC = make(chan struct{})
+		blockedC = make(chan struct{})
+		im, nl, recorder = startMonitor(ifacemonitor.Config{
+			MaxUpdateBatch: 5,
+			Registerer:     registry,
+		}, func(nl *netlinkTest, im *ifacemonitor.InterfaceMonitor) {
+			setLinkNoSignal(nl, "eth0", "up", "10.0.0.1/32")
+			setLinkNoSignal(nl, "eth1", "down")
+			im.Middleware = []ifacemonitor.Middleware{func(upd ifacemonitor.Update) (ifacemonitor.Update, bool) {
+				if upd.IfaceName == "eth1" && upd.State == ifacemonitor.StateUp {
+					close(blockedC)
+					<-blockC
+				}
+				return upd, true
+			}}
+		}, withResyncC(resyncC))
+		recorder.ExpectAddrs("eth0", "10.0.0.1")
+	})
+
+	AfterEach(func() {
+		im.Stop()
+	})
+
+	It("should cancel out an address that is added and deleted again in the same batch", func() {
+		nl.changeLinkState("eth1", "up")
+		<-blockedC
+		nl.addAddr("eth0", "10.0.0.2/32")
+		nl.delAddr("eth0", "10.0.0.2/32")
+		nl.addAddr("eth0", "10.0.0.3/32")
+		// The update filter holds on to deletions for a while in case they're part of a flap.
+		time.Sleep(2 * ifacemonitor.FlapDampingDelay)
+		recorder.NewEvents()
+		close(blockC)
+
+		recorder.ExpectSequence(
+			testutils.StateEvent("eth1", ifacemonitor.StateUp),
+			testutils.AddrsEvent("eth0", "10.0.0.1", "10.0.0.3"),
+		)
+		recorder.ExpectNoNewEvents()
+		Expect(coalescedUpdates()).To(Equal(2.0))
+	})
+
+	It("should still apply a deletion of an address that we already had", func() {
+		nl.changeLinkState("eth1", "up")
+		<-blockedC
+		// The kernel doesn't send a duplicate add but we may see one if we listed the
+		// addresses in the meantime.
+		nl.addAddr("eth0", "10.0.0.1/32")
+		nl.delAddr("eth0", "10.0.0.1/32")
+		time.Sleep(2 * ifacemonitor.FlapDampingDelay)
+		close(blockC)
+
+		recorder.ExpectAddrs("eth0")
+	})
+
+	It("should not let a stream of updates hold up a resync", func() {
+		stopC := make(chan struct{})
+		doneC := make(chan struct{})
+		close(blockC)
+		go func() {
+			defer close(doneC)
+			for i := 0; ; i++ {
+				select {
+				case <-stopC:
+					return
+				default:
+				}
+				nl.addAddr("eth0", fmt.Sprintf("10.1.0.%d/32", i%250+1))
+			}
+		}()
+		defer func() {
+			close(stopC)
+			<-doneC
+		}()
+
+		for i := 0; i < 3; i++ {
+			sentC := make(chan struct{})
+			go func() {
+				defer close(sentC)
+				resyncC <- time.Now()
+			}()
+			Eventually(sentC, "2s").Should(BeClosed())
+		}
+	})
+})
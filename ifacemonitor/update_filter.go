@@ -12,6 +12,8 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+// +build !darwin
+
 package ifacemonitor
 
 import (
@@ -44,15 +46,68 @@ func WithTimeShim(t timeshim.Interface) UpdateFilterOp {
 // FilterUpdates filters out updates that occur when IPs are quickly removed and re-added.
 // Some DHCP clients flap the IP during an IP renewal, for example.
 //
-// Algorithm:
-// * Maintain a queue of link and address updates per interface.
-// * When we see a potential flap (i.e. an IP deletion), defer processing the queue for a while.
-// * If the flap resolves itself (i.e. the IP is added back), suppress the IP deletion.
+// FilterUpdates takes link and address updates on separate channels, so updates on different
+// channels may be processed in a different order from the one that the kernel sent them in.
+// The monitor itself uses a single, ordered stream of updates.
 func FilterUpdates(ctx context.Context,
 	addrOutC chan<- netlink.RouteUpdate, routeInC <-chan netlink.RouteUpdate,
 	linkOutC chan<- netlink.LinkUpdate, linkInC <-chan netlink.LinkUpdate,
 	options ...UpdateFilterOp) {
 
+	inC := make(chan NetlinkUpdate)
+	outC := make(chan NetlinkUpdate)
+	go func() {
+		for {
+			var upd NetlinkUpdate
+			select {
+			case <-ctx.Done():
+				return
+			case linkUpd := <-linkInC:
+				upd.Link = &linkUpd
+			case routeUpd := <-routeInC:
+				upd.Route = &routeUpd
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case inC <- upd:
+			}
+		}
+	}()
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case upd := <-outC:
+				if upd.Link != nil {
+					select {
+					case <-ctx.Done():
+						return
+					case linkOutC <- *upd.Link:
+					}
+				} else {
+					select {
+					case <-ctx.Done():
+						return
+					case addrOutC <- *upd.Route:
+					}
+				}
+			}
+		}
+	}()
+	filterUpdates(ctx, outC, inC, options...)
+}
+
+// filterUpdates is FilterUpdates for a single stream of link and address updates.  Updates for
+// the same interface come out in the order that they went in, apart from the ones that are
+// squashed.  If inC is closed, filterUpdates closes outC.
+//
+// Algorithm:
+// * Maintain a queue of link and address updates per interface.
+// * When we see a potential flap (i.e. an IP deletion), defer processing the queue for a while.
+// * If the flap resolves itself (i.e. the IP is added back), suppress the IP deletion.
+func filterUpdates(ctx context.Context, outC chan<- NetlinkUpdate, inC <-chan NetlinkUpdate, options ...UpdateFilterOp) {
 	u := &updateFilter{
 		Time: timeshim.RealTime(),
 	}
@@ -65,7 +120,7 @@ func FilterUpdates(ctx context.Context,
 
 	type timestampedUpd struct {
 		ReadyAt time.Time
-		Update  interface{} // RouteUpdate or LinkUpdate
+		Update  NetlinkUpdate
 	}
 
 	updatesByIfaceIdx := map[int][]timestampedUpd{}
@@ -76,84 +131,94 @@ mainLoop:
 		case <-ctx.Done():
 			logrus.Info("FilterUpdates: Context expired, stopping")
 			return
-		case linkUpd := <-linkInC:
-			idx := int(linkUpd.Index)
-			linkIsUp := linkUpd.Header.Type == syscall.RTM_NEWLINK && linkIsOperUp(linkUpd.Link)
-			var delay time.Duration
-			if linkIsUp {
-				if len(updatesByIfaceIdx[idx]) == 0 {
-					// Empty queue (so no flap in progress) and the link is up, no need to delay the message.
-					linkOutC <- linkUpd
-					continue mainLoop
-				}
-				// Link is up but potential flap in progress, queue the update behind the other messages.
-				delay = 0
-			} else {
-				// We delay link down updates because a flap can involve both a link down and an IP removal.
-				// Since we receive those two messages over separate channels, the two messages can race.
-				delay = FlapDampingDelay
-			}
-
-			updatesByIfaceIdx[idx] = append(updatesByIfaceIdx[idx],
-				timestampedUpd{
-					ReadyAt: u.Time.Now().Add(delay),
-					Update:  linkUpd,
-				})
-		case routeUpd := <-routeInC:
-			logrus.WithField("route", routeUpd).Debug("Route update")
-			if routeUpd.Route.Type&unix.RTN_LOCAL == 0 {
-				logrus.WithField("route", routeUpd).Debug("Ignoring non-local route.")
-				continue
-			}
-			if routeUpd.LinkIndex == 0 {
-				logrus.WithField("route", routeUpd).Debug("Ignoring route with no link index.")
-				continue
+		case upd, ok := <-inC:
+			if !ok {
+				logrus.Info("FilterUpdates: Input closed, stopping")
+				close(outC)
+				return
 			}
+			switch {
+			case upd.Link != nil:
+				linkUpd := upd.Link
+				idx := int(linkUpd.Index)
+				linkIsUp := linkUpd.Header.Type == syscall.RTM_NEWLINK && linkIsOperUp(linkUpd.Link)
+				var delay time.Duration
+				if linkIsUp {
+					if len(updatesByIfaceIdx[idx]) == 0 {
+						// Empty queue (so no flap in progress) and the link is up, no need to delay the message.
+						outC <- upd
+						continue mainLoop
+					}
+					// Link is up but potential flap in progress, queue the update behind the other messages.
+					delay = 0
+				} else {
+					// We delay link down updates because a flap can involve both a link down and an IP
+					// removal, and we want to be able to squash the IP removal.
+					delay = FlapDampingDelay
+				}
 
-			idx := routeUpd.LinkIndex
-			oldUpds := updatesByIfaceIdx[idx]
-
-			var readyToSendTime time.Time
-			if routeUpd.Type == unix.RTM_NEWROUTE {
-				logrus.WithField("addr", routeUpd.Dst).Debug("FilterUpdates: got address ADD")
-				if len(oldUpds) == 0 {
-					// This is an add for a new IP and there's nothing else in the queue for this interface.
-					// Short circuit.  We care about flaps where IPs are temporarily removed so no need to
-					// delay an add.
-					logrus.Debug("FilterUpdates: add with empty queue, short circuit.")
-					addrOutC <- routeUpd
+				updatesByIfaceIdx[idx] = append(updatesByIfaceIdx[idx],
+					timestampedUpd{
+						ReadyAt: u.Time.Now().Add(delay),
+						Update:  upd,
+					})
+			default:
+				routeUpd := upd.Route
+				logrus.WithField("route", routeUpd).Debug("Route update")
+				if routeUpd.Route.Type&unix.RTN_LOCAL == 0 {
+					logrus.WithField("route", routeUpd).Debug("Ignoring non-local route.")
+					continue
+				}
+				if routeUpd.LinkIndex == 0 {
+					logrus.WithField("route", routeUpd).Debug("Ignoring route with no link index.")
 					continue
 				}
 
-				// Else, there's something else in the queue, need to process the queue...
-				logrus.Debug("FilterUpdates: add with non-empty queue.")
-				// We don't actually need to delay the add itself so we don't set any delay here.  It will
-				// still be queued up behind other updates.
-				readyToSendTime = u.Time.Now()
-			} else {
-				// Got a delete, it might be a flap so queue the update.
-				logrus.WithField("addr", routeUpd.Dst).Debug("FilterUpdates: got address DEL")
-				readyToSendTime = u.Time.Now().Add(FlapDampingDelay)
-			}
+				idx := routeUpd.LinkIndex
+				oldUpds := updatesByIfaceIdx[idx]
 
-			// Coalesce updates for the same IP by squashing any previous updates for the same CIDR before
-			// we append this update to the queue.  We need to scan the whole queue because there may be
-			// updates for different IPs in flight.
-			upds := oldUpds[:0]
-			for _, upd := range oldUpds {
-				logrus.WithField("previous", upd).Debug("FilterUpdates: examining previous update.")
-				if oldAddrUpd, ok := upd.Update.(netlink.RouteUpdate); ok {
-					if ipNetsEqual(oldAddrUpd.Dst, routeUpd.Dst) {
-						// New update for the same IP, suppress the old update
-						logrus.WithField("address", oldAddrUpd.Dst.String()).Debug(
-							"Received update for same IP within a short time, squashed the old update.")
+				var readyToSendTime time.Time
+				if routeUpd.Type == unix.RTM_NEWROUTE {
+					logrus.WithField("addr", routeUpd.Dst).Debug("FilterUpdates: got address ADD")
+					if len(oldUpds) == 0 {
+						// This is an add for a new IP and there's nothing else in the queue for this interface.
+						// Short circuit.  We care about flaps where IPs are temporarily removed so no need to
+						// delay an add.
+						logrus.Debug("FilterUpdates: add with empty queue, short circuit.")
+						outC <- upd
 						continue
 					}
+
+					// Else, there's something else in the queue, need to process the queue...
+					logrus.Debug("FilterUpdates: add with non-empty queue.")
+					// We don't actually need to delay the add itself so we don't set any delay here.  It will
+					// still be queued up behind other updates.
+					readyToSendTime = u.Time.Now()
+				} else {
+					// Got a delete, it might be a flap so queue the update.
+					logrus.WithField("addr", routeUpd.Dst).Debug("FilterUpdates: got address DEL")
+					readyToSendTime = u.Time.Now().Add(FlapDampingDelay)
+				}
+
+				// Coalesce updates for the same IP by squashing any previous updates for the same CIDR before
+				// we append this update to the queue.  We need to scan the whole queue because there may be
+				// updates for different IPs in flight.
+				upds := oldUpds[:0]
+				for _, oldUpd := range oldUpds {
+					logrus.WithField("previous", oldUpd).Debug("FilterUpdates: examining previous update.")
+					if oldAddrUpd := oldUpd.Update.Route; oldAddrUpd != nil {
+						if ipNetsEqual(oldAddrUpd.Dst, routeUpd.Dst) {
+							// New update for the same IP, suppress the old update
+							logrus.WithField("address", oldAddrUpd.Dst.String()).Debug(
+								"Received update for same IP within a short time, squashed the old update.")
+							continue
+						}
+					}
+					upds = append(upds, oldUpd)
 				}
-				upds = append(upds, upd)
+				upds = append(upds, timestampedUpd{ReadyAt: readyToSendTime, Update: upd})
+				updatesByIfaceIdx[idx] = upds
 			}
-			upds = append(upds, timestampedUpd{ReadyAt: readyToSendTime, Update: routeUpd})
-			updatesByIfaceIdx[idx] = upds
 		case <-timerC:
 			logrus.Debug("FilterUpdates: timer popped.")
 			timerC = nil
@@ -175,12 +240,7 @@ mainLoop:
 					// Either update is old enough to prevent flapping or it's an address being added.
 					// Ready to send...
 					logrus.WithField("update", firstUpd).Debug("FilterUpdates: update ready to send.")
-					switch u := firstUpd.Update.(type) {
-					case netlink.RouteUpdate:
-						addrOutC <- u
-					case netlink.LinkUpdate:
-						linkOutC <- u
-					}
+					outC <- firstUpd.Update
 					upds = upds[1:]
 				} else {
 					// Update is too new, figure out when it'll be safe to send it.
@@ -0,0 +1,156 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ifacemonitor/testutils"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Update ordering", func() {
+	var dir string
+	var nl *netlinkTest
+	var im *ifacemonitor.InterfaceMonitor
+	var recorder *testutils.Recorder
+	var doneC chan struct{}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "ifacemonitor-test")
+		Expect(err).NotTo(HaveOccurred())
+		doneC = make(chan struct{})
+		im, nl, recorder = startMonitor(ifacemonitor.Config{
+			RecordFile: filepath.Join(dir, "recording.jsonl"),
+		}, func(nl *netlinkTest, im *ifacemonitor.InterfaceMonitor) {
+			setLinkNoSignal(nl, "eth0", "up", "10.0.0.1/32")
+		}, withDoneC(doneC))
+		recorder.ExpectAddrs("eth0", "10.0.0.1")
+	})
+
+	AfterEach(func() {
+		im.Stop()
+		Eventually(doneC).Should(BeClosed())
+		_ = os.RemoveAll(dir)
+	})
+
+	// handledUpdates reads back the updates that the monitor handled, in order, from its
+	// recording.
+	handledUpdates := func() []string {
+		im.Stop()
+		Eventually(doneC).Should(BeClosed())
+		f, err := os.Open(filepath.Join(dir, "recording.jsonl"))
+		Expect(err).NotTo(HaveOccurred())
+		defer f.Close()
+		var updates []string
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var event struct {
+				Type  string `json:"type"`
+				Links []struct {
+					Index int `json:"index"`
+				} `json:"links"`
+				Routes []struct {
+					LinkIndex int    `json:"link_index"`
+					Dst       string `json:"dst"`
+				} `json:"routes"`
+			}
+			Expect(json.Unmarshal(scanner.Bytes(), &event)).To(Succeed())
+			switch event.Type {
+			case "link-update":
+				updates = append(updates, fmt.Sprintf("link %d", event.Links[0].Index))
+			case "route-update":
+				updates = append(updates, fmt.Sprintf("addr %d %s", event.Routes[0].LinkIndex, event.Routes[0].Dst))
+			}
+		}
+		Expect(scanner.Err()).NotTo(HaveOccurred())
+		return updates
+	}
+
+	for _, seed := range []int64{1, 2, 3, 4} {
+		seed := seed
+		It(fmt.Sprintf("should handle interleaved link and address updates in kernel order (seed %d)", seed), func() {
+			// Each new interface is signalled, then two addresses.  Interleave the interfaces'
+			// updates randomly, as the kernel might.
+			type step struct {
+				name, addr string
+			}
+			var pending [][]step
+			for i := 1; i <= 4; i++ {
+				name := fmt.Sprintf("cali%d", i)
+				pending = append(pending, []step{
+					{name: name},
+					{name: name, addr: fmt.Sprintf("10.0.%d.1/32", i)},
+					{name: name, addr: fmt.Sprintf("10.0.%d.2/32", i)},
+				})
+			}
+			r := rand.New(rand.NewSource(seed))
+			indexes := map[string]int{}
+			var sent []string
+			for len(pending) > 0 {
+				i := r.Intn(len(pending))
+				s := pending[i][0]
+				if pending[i] = pending[i][1:]; len(pending[i]) == 0 {
+					pending = append(pending[:i], pending[i+1:]...)
+				}
+				if s.addr == "" {
+					indexes[s.name] = nl.nextIndex
+					setLinkNoSignal(nl, s.name, "up")
+					nl.signalLink(s.name, 0)
+					sent = append(sent, fmt.Sprintf("link %d", indexes[s.name]))
+				} else {
+					nl.addAddr(s.name, s.addr)
+					sent = append(sent, fmt.Sprintf("addr %d %s", indexes[s.name], s.addr))
+				}
+			}
+
+			for i := 1; i <= 4; i++ {
+				recorder.ExpectAddrs(fmt.Sprintf("cali%d", i), fmt.Sprintf("10.0.%d.1", i), fmt.Sprintf("10.0.%d.2", i))
+			}
+			Expect(handledUpdates()).To(Equal(sent))
+		})
+	}
+
+	It("should apply an address update that follows its link's, even if the address list missed it", func() {
+		// The link's address list is taken when the link update is handled, which can be after
+		// the address has gone again.  The address updates still have to be applied in order.
+		setLinkNoSignal(nl, "cali1", "up")
+		nl.signalLink("cali1", 0)
+		nl.addAddr("cali1", "10.0.1.1/32")
+		setLinkNoSignal(nl, "cali1", "up")
+		recorder.ExpectAddrs("cali1", "10.0.1.1")
+	})
+
+	It("should pick up an address whose update arrived before its link's", func() {
+		// The address update is dropped, since the link is unknown, but the link update lists
+		// the link's addresses when it's handled.
+		nl.addLinkNoSignal("cali1")
+		nl.addAddr("cali1", "10.0.1.1/32")
+		nl.signalLink("cali1", 0)
+		recorder.ExpectAddrs("cali1", "10.0.1.1")
+	})
+})
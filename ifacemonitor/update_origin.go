@@ -0,0 +1,42 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+// SetOriginCallbacks sets callbacks that are told the origin of each notification, in place of
+// the StateCallback and AddrCallback.  Must be called before MonitorInterfaces.
+func (m *InterfaceMonitor) SetOriginCallbacks(stateCallback InterfaceStateOriginCallback, addrCallback AddrStateOriginCallback) {
+	m.StateCallback = func(ifaceName string, ifaceState State, ifIndex int) {
+		stateCallback(ifaceName, ifaceState, ifIndex, m.origin)
+	}
+	m.AddrCallback = func(ifaceName string, addrs set.Set) {
+		addrCallback(ifaceName, addrs, m.origin)
+	}
+}
+
+// setOrigin sets the origin of the notifications that we make until the returned function is
+// called, which restores the previous origin.
+func (m *InterfaceMonitor) setOrigin(origin UpdateOrigin) (restore func()) {
+	oldOrigin := m.origin
+	m.origin = origin
+	return func() {
+		m.origin = oldOrigin
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor_test
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ifacemonitor/testutils"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Update origins", func() {
+	var nl *netlinkTest
+	var resyncC chan time.Time
+	var im *ifacemonitor.InterfaceMonitor
+	var recorder *testutils.Recorder
+	var infosLock sync.Mutex
+	var infoSummaries []string
+
+	// origins summarises the recorder's new events along with their origins.
+	origins := func() []string {
+		var summary []string
+		for _, e := range recorder.NewEvents() {
+			summary = append(summary, fmt.Sprintf("%v (%s)", e, e.Origin))
+		}
+		return summary
+	}
+
+	infos := func() []string {
+		infosLock.Lock()
+		defer infosLock.Unlock()
+		return append([]string(nil), infoSummaries...)
+	}
+
+	BeforeEach(func() {
+		resyncC = make(chan time.Time)
+		recorder = testutils.NewRecorder()
+		infosLock.Lock()
+		infoSummaries = nil
+		infosLock.Unlock()
+		im, nl, _ = startMonitor(ifacemonitor.Config{}, func(nl *netlinkTest, im *ifacemonitor.InterfaceMonitor) {
+			setLinkNoSignal(nl, "eth0", "up", "10.0.0.1/32")
+			// In place of the plain callbacks.
+			recorder.AttachWithOrigins(im)
+			im.InfoCallback = func(info ifacemonitor.InterfaceInfo) {
+				infosLock.Lock()
+				defer infosLock.Unlock()
+				infoSummaries = append(infoSummaries, fmt.Sprintf("%s %s (%s)", info.Name, info.State, info.Origin))
+			}
+		}, withResyncC(resyncC))
+		recorder.ExpectState("eth0", ifacemonitor.StateUp)
+		recorder.ExpectAddrs("eth0", "10.0.0.1")
+	})
+
+	AfterEach(func() {
+		im.Stop()
+	})
+
+	It("should mark the start of day as a replay", func() {
+		Expect(origins()).To(Equal([]string{
+			"eth0 up (replay)",
+			"eth0 addrs=[10.0.0.1] (replay)",
+		}))
+	})
+
+	It("should mark netlink events and the corrections made by a resync", func() {
+		recorder.NewEvents()
+		nl.addLink("cali1")
+		nl.changeLinkState("cali1", "up")
+		recorder.ExpectState("cali1", ifacemonitor.StateUp)
+		Expect(origins()).To(Equal([]string{
+			"cali1 addrs=[] (event)",
+			"cali1 up (event)",
+		}))
+
+		// Changes that we don't hear about from netlink, which the resync picks up.
+		setLinkNoSignal(nl, "cali1", "down")
+		setLinkNoSignal(nl, "eth0", "up", "10.0.0.1/32", "10.0.0.2/32")
+		resyncC <- time.Now()
+		recorder.ExpectState("cali1", ifacemonitor.StateDown)
+		recorder.ExpectAddrs("eth0", "10.0.0.1", "10.0.0.2")
+		Expect(origins()).To(ConsistOf(
+			"cali1 down (resync)",
+			"eth0 addrs=[10.0.0.1 10.0.0.2] (resync)",
+		))
+
+		// And back to normal.
+		nl.changeLinkState("cali1", "up")
+		recorder.ExpectState("cali1", ifacemonitor.StateUp)
+		Expect(origins()).To(Equal([]string{"cali1 up (event)"}))
+	})
+
+	It("should mark a subscriber's snapshot as a replay", func() {
+		subRecorder := testutils.NewRecorder()
+		unsubscribe := im.Subscribe(ifacemonitor.Subscriber{
+			StateOriginCallback: subRecorder.StateOriginCallback,
+			AddrOriginCallback:  subRecorder.AddrOriginCallback,
+		}, true)
+		defer unsubscribe()
+		subRecorder.ExpectAddrs("eth0", "10.0.0.1")
+		nl.changeLinkState("eth0", "down")
+		subRecorder.ExpectState("eth0", ifacemonitor.StateDown)
+
+		var summary []string
+		for _, e := range subRecorder.Events() {
+			summary = append(summary, fmt.Sprintf("%v (%s)", e, e.Origin))
+		}
+		Expect(summary).To(Equal([]string{
+			"eth0 up (replay)",
+			"eth0 addrs=[10.0.0.1] (replay)",
+			"eth0 down (event)",
+		}))
+	})
+
+	It("should pass the origin to the InfoCallback", func() {
+		nl.changeLinkState("eth0", "down")
+		Eventually(infos).Should(Equal([]string{
+			"eth0 up (replay)",
+			"eth0 down (event)",
+		}))
+	})
+})
@@ -0,0 +1,69 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+)
+
+// VethPeer describes the other end of a veth.
+type VethPeer struct {
+	// Index is the peer's interface index.  If the peer is in another network namespace, the
+	// index is only meaningful in that namespace.
+	Index int `json:"index"`
+	// Name is the peer's name, if it is in our namespace; empty otherwise.
+	Name string `json:"name,omitempty"`
+	// InOtherNetns is true if the peer isn't in our namespace (for example, the pod end of a
+	// workload's veth).
+	InOtherNetns bool `json:"in_other_netns,omitempty"`
+}
+
+func (p VethPeer) String() string {
+	if p.InOtherNetns {
+		return fmt.Sprintf("peer index %d in other netns", p.Index)
+	}
+	return fmt.Sprintf("peer %s (index %d)", p.Name, p.Index)
+}
+
+// storeVethPeer records the peer index (IFLA_LINK) of a veth.
+func (m *InterfaceMonitor) storeVethPeer(link netlink.Link) {
+	attrs := link.Attrs()
+	if _, isVeth := link.(*netlink.Veth); !isVeth || attrs.ParentIndex == 0 {
+		delete(m.vethPeerIdxs, attrs.Index)
+		return
+	}
+	m.vethPeerIdxs[attrs.Index] = attrs.ParentIndex
+}
+
+// vethPeer resolves the peer of the veth with the given index.  Returns nil if the interface
+// isn't a veth.  The kernel doesn't tell us directly whether the peer is in our namespace, but
+// if it is then it must be a veth that we know about whose own peer is the given interface.
+// Otherwise, the index belongs to another namespace and we mustn't resolve it to a name.
+func (m *InterfaceMonitor) vethPeer(ifIndex int) *VethPeer {
+	peerIdx, isVeth := m.vethPeerIdxs[ifIndex]
+	if !isVeth {
+		return nil
+	}
+	if m.vethPeerIdxs[peerIdx] == ifIndex {
+		if name, known := m.ifaceName[peerIdx]; known {
+			return &VethPeer{Index: peerIdx, Name: name}
+		}
+	}
+	return &VethPeer{Index: peerIdx, InOtherNetns: true}
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// VFLinkState is the link state of an SR-IOV virtual function, as configured on its physical
+// function with "ip link set <pf> vf <n> state ...".  The values match IFLA_VF_LINK_STATE_*.
+type VFLinkState uint32
+
+const (
+	// VFLinkStateAuto means the VF's link follows the physical link.
+	VFLinkStateAuto VFLinkState = iota
+	VFLinkStateEnable
+	VFLinkStateDisable
+)
+
+func (s VFLinkState) String() string {
+	switch s {
+	case VFLinkStateAuto:
+		return "auto"
+	case VFLinkStateEnable:
+		return "enable"
+	case VFLinkStateDisable:
+		return "disable"
+	}
+	return "unknown"
+}
+
+// VFInfo describes one SR-IOV virtual function of a physical NIC.
+type VFInfo struct {
+	ID         int         `json:"id"`
+	MAC        string      `json:"mac,omitempty"`
+	LinkState  VFLinkState `json:"link_state"`
+	SpoofCheck bool        `json:"spoof_check"`
+}
+
+// VFCallback is called with the virtual functions of an SR-IOV physical function when any of
+// them change (for example, a VF's link state is toggled or its MAC changes).  The VFs are
+// sorted by ID; the slice is empty when the PF goes away or no longer has any VFs.
+type VFCallback func(pfName string, vfs []VFInfo)
+
+func vfInfosFromAttrs(attrs *netlink.LinkAttrs) []VFInfo {
+	if len(attrs.Vfs) == 0 {
+		return nil
+	}
+	vfs := make([]VFInfo, 0, len(attrs.Vfs))
+	for _, vf := range attrs.Vfs {
+		info := VFInfo{
+			ID:         vf.ID,
+			LinkState:  VFLinkState(vf.LinkState),
+			SpoofCheck: vf.Spoofchk,
+		}
+		if len(vf.Mac) > 0 {
+			info.MAC = vf.Mac.String()
+		}
+		vfs = append(vfs, info)
+	}
+	sort.Slice(vfs, func(i, j int) bool {
+		return vfs[i].ID < vfs[j].ID
+	})
+	return vfs
+}
+
+// storeAndNotifyVFs records the VFs of a physical function and notifies the VFCallback if they
+// changed.  The kernel only includes the VF list in link dumps that ask for it, not in link
+// notifications, so this should only be called with links from a LinkList.  Interfaces without
+// VFs don't get an entry.
+func (m *InterfaceMonitor) storeAndNotifyVFs(ifIndex int, ifaceName string, newVFs []VFInfo) {
+	if vfInfosEqual(m.vfs[ifIndex], newVFs) {
+		return
+	}
+	if len(newVFs) == 0 {
+		delete(m.vfs, ifIndex)
+	} else {
+		m.vfs[ifIndex] = newVFs
+	}
+	log.WithFields(log.Fields{
+		"ifaceName": ifaceName,
+		"vfs":       newVFs,
+	}).Info("SR-IOV virtual functions changed.")
+	if m.VFCallback == nil {
+		return
+	}
+	// Take a copy, so that the callback's slice is independent of ours.
+	m.VFCallback(ifaceName, append([]VFInfo{}, newVFs...))
+}
+
+func vfInfosEqual(a, b []VFInfo) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
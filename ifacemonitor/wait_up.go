@@ -0,0 +1,93 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+
+package ifacemonitor
+
+import (
+	"context"
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrMonitorStopped is returned by WaitForIfaceUp if the monitor is stopped.
+var ErrMonitorStopped = errors.New("interface monitor stopped")
+
+// WaitForIfaceUp waits until the monitor reports the named interface as up.  It returns
+// immediately if the interface is already up, or ctx's error if the context expires first.  It
+// can be called from any goroutine, and by any number of goroutines at once.  Note that
+// interfaces are only known to be up once the monitor has done its start-of-day resync.
+func (m *InterfaceMonitor) WaitForIfaceUp(ctx context.Context, ifaceName string) error {
+	m.upWaitersLock.Lock()
+	if m.upNames[ifaceName] {
+		m.upWaitersLock.Unlock()
+		return nil
+	}
+	select {
+	case <-m.stopC:
+		m.upWaitersLock.Unlock()
+		return ErrMonitorStopped
+	default:
+	}
+	upC := make(chan struct{})
+	m.upWaiters[ifaceName] = append(m.upWaiters[ifaceName], upC)
+	m.upWaitersLock.Unlock()
+
+	log.WithField("ifaceName", ifaceName).Debug("Waiting for interface to come up.")
+	select {
+	case <-upC:
+		return nil
+	case <-ctx.Done():
+		m.removeUpWaiter(ifaceName, upC)
+		return ctx.Err()
+	case <-m.stopC:
+		m.removeUpWaiter(ifaceName, upC)
+		return ErrMonitorStopped
+	}
+}
+
+func (m *InterfaceMonitor) removeUpWaiter(ifaceName string, upC chan struct{}) {
+	m.upWaitersLock.Lock()
+	defer m.upWaitersLock.Unlock()
+	waiters := m.upWaiters[ifaceName]
+	for i, c := range waiters {
+		if c == upC {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(m.upWaiters, ifaceName)
+	} else {
+		m.upWaiters[ifaceName] = waiters
+	}
+}
+
+// recordIfaceStateForWaiters is called on the monitor's goroutine for each state notification;
+// it wakes up the waiters when an interface comes up.
+func (m *InterfaceMonitor) recordIfaceStateForWaiters(ifaceName string, state State) {
+	m.upWaitersLock.Lock()
+	defer m.upWaitersLock.Unlock()
+	if state != StateUp {
+		delete(m.upNames, ifaceName)
+		return
+	}
+	m.upNames[ifaceName] = true
+	for _, c := range m.upWaiters[ifaceName] {
+		close(c)
+	}
+	delete(m.upWaiters, ifaceName)
+}